@@ -0,0 +1,43 @@
+package butterfish
+
+import (
+	"fmt"
+)
+
+// With --accessible, shell mode output is linear plain text that a screen
+// reader can follow: nothing is drawn over the line you're typing on, so
+// there's no autosuggest and annotations go on their own line, markdown
+// isn't rendered, and each answer is between marker lines.
+
+const (
+	accessibleAnswerStart = "[butterfish answer]"
+	accessibleAnswerEnd   = "[end of answer]"
+)
+
+// Called when we start waiting for a response, marks where it starts
+func (this *ShellState) markAnswerStart() {
+	if !this.Butterfish.Config.Accessible || this.AnswerMarked {
+		return
+	}
+	fmt.Fprintf(this.ParentOut, "\r\n%s\r\n", accessibleAnswerStart)
+	this.AnswerMarked = true
+}
+
+// Called when a response is done
+func (this *ShellState) markAnswerEnd() {
+	if !this.AnswerMarked {
+		return
+	}
+	fmt.Fprintf(this.ParentOut, "\r\n%s\r\n", accessibleAnswerEnd)
+	this.AnswerMarked = false
+}
+
+// What to write before a line of our own, like an annotation, when the shell
+// is at a prompt. Usually we overwrite the prompt line and ask for a new
+// prompt below, in accessible mode we start a new line instead.
+func (this *ShellState) ownLinePrefix() string {
+	if this.Butterfish.Config.Accessible {
+		return "\r\n"
+	}
+	return "\r\x1b[K"
+}
@@ -0,0 +1,167 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// Limits for command annotations, which should be fast and cheap since we
+// make a call after every command
+const (
+	annotateTimeout        = 10 * time.Second
+	annotateMaxOutputBytes = 2000
+	annotateMaxTokens      = 64
+)
+
+// The last command run in the shell and the output that followed it
+func (this *ShellHistory) LastCommand() (string, string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for i := len(this.Blocks) - 1; i >= 0; i-- {
+		if this.Blocks[i].Type != historyTypeShellInput {
+			continue
+		}
+
+		output := strings.Builder{}
+		for _, block := range this.Blocks[i+1:] {
+			if block.Type == historyTypeShellOutput {
+				output.WriteString(block.Content.String())
+			}
+		}
+		return strings.TrimSpace(this.Blocks[i].Content.String()), output.String()
+	}
+	return "", ""
+}
+
+// Turn command annotations on or off, with no args we toggle
+func (this *ShellState) ToggleAnnotate(args []string) {
+	switch {
+	case len(args) > 0 && args[0] == "on":
+		this.AnnotateEnabled = true
+	case len(args) > 0 && args[0] == "off":
+		this.AnnotateEnabled = false
+	default:
+		this.AnnotateEnabled = !this.AnnotateEnabled
+	}
+
+	text := "Command annotations off.\n"
+	if this.AnnotateEnabled {
+		text = fmt.Sprintf("Command annotations on, using %s.\n", this.Butterfish.Config.ShellAnnotateModel)
+	}
+	fmt.Fprintf(this.ParentOut, "%s%s%s", this.Color.Answer,
+		strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+	this.SendPromptResponse("")
+}
+
+// Ask the annotation model to describe the last command in the background.
+// The description is sent to AnnotationChan if annotations are on, and the
+// command is added to the command history if recording is on.
+func (this *ShellState) DescribeLastCommand(exitCode int) {
+	command, output := this.History.LastCommand()
+	if command == "" {
+		return
+	}
+	output = denoiseOutput(output)
+	if len(output) > annotateMaxOutputBytes {
+		output = strings.ToValidUTF8(output[len(output)-annotateMaxOutputBytes:], "")
+	}
+
+	promptStr, err := this.GetPrompt(prompt.ShellAnnotateCommand,
+		"command", command,
+		"exit_code", fmt.Sprintf("%d", exitCode),
+		"output", output)
+	if err != nil {
+		log.Printf("Error getting annotation prompt: %s", err)
+		return
+	}
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		log.Printf("Error getting annotation system message: %s", err)
+		return
+	}
+
+	annotate := this.AnnotateEnabled
+	var record *CommandRecord
+	if this.Butterfish.Config.ShellRecordHistory {
+		host, _ := os.Hostname()
+		record = &CommandRecord{
+			Time:     time.Now(),
+			Command:  command,
+			ExitCode: exitCode,
+			Cwd:      shellWorkingDir(),
+			Host:     host,
+		}
+	}
+
+	bf := this.Butterfish.snapshot()
+	go func() {
+		ctx, cancel := context.WithTimeout(bf.Ctx, annotateTimeout)
+		defer cancel()
+
+		request := &util.CompletionRequest{
+			Ctx:              ctx,
+			Prompt:           promptStr,
+			PromptName:       prompt.ShellAnnotateCommand,
+			Model:            bf.Config.ShellAnnotateModel,
+			MaxTokens:        annotateMaxTokens,
+			Temperature:      0.2,
+			SystemMessage:    sysMsg,
+			SystemPromptName: prompt.PromptSystemMessage,
+			Task:             TaskAnnotate,
+		}
+		description := ""
+		response, err := bf.LLMClient.Completion(request)
+		if err != nil {
+			log.Printf("Error describing command: %s", err)
+		} else {
+			// keep only the first line
+			description, _, _ = strings.Cut(strings.TrimSpace(response.Completion), "\n")
+		}
+
+		if record != nil {
+			// we still record the command if we couldn't describe it
+			record.Description = description
+			err = bf.RecordCommand(bf.Ctx, record)
+			if err != nil {
+				log.Printf("Error recording command: %s", err)
+			}
+		}
+
+		if !annotate || description == "" {
+			return
+		}
+		select {
+		case this.AnnotationChan <- description:
+		case <-bf.Ctx.Done():
+		}
+	}()
+}
+
+// Print an annotation above a fresh prompt. If the user has started typing
+// we drop it rather than interrupt them.
+func (this *ShellState) ShowAnnotation(annotation string) {
+	if this.State != stateNormal || this.GoalMode || this.Command.Size() > 0 || this.Prompt.Size() > 0 {
+		log.Printf("Dropping annotation, shell is busy: %s", annotation)
+		return
+	}
+	if this.lastPrompt == "" {
+		log.Printf("Dropping annotation, the prompt to redraw isn't known: %s", annotation)
+		return
+	}
+
+	// We overwrite the current prompt line with the annotation, then draw the
+	// prompt again below it. The shell's line is empty and its cursor is at
+	// the end of the prompt either way, so it doesn't need to know, and
+	// nothing is run in the shell.
+	this.ClearAutosuggest(this.Color.Command)
+	fmt.Fprintf(this.ParentOut, "%s%s# %s%s\r\n%s", this.ownLinePrefix(), this.Color.Autosuggest,
+		annotation, this.Color.Command, this.lastPrompt)
+}
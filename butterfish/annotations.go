@@ -0,0 +1,154 @@
+package butterfish
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/spf13/afero"
+)
+
+// With --format github, review and summarize print GitHub Actions workflow
+// commands rather than styled text, e.g.
+//
+//	::error file=deploy.sh,line=12,title=butterfish review::Unquoted variable...
+//
+// so a workflow step running butterfish shows its findings as annotations on
+// the pull request's changed files.
+
+const FormatGitHub = "github"
+
+// Escape workflow command data, per the GitHub Actions toolkit
+func escapeAnnotationData(s string) string {
+	s = strings.ReplaceAll(s, "%", "%25")
+	s = strings.ReplaceAll(s, "\r", "%0D")
+	return strings.ReplaceAll(s, "\n", "%0A")
+}
+
+// Escape a workflow command property value, which also can't contain : or ,
+func escapeAnnotationProperty(s string) string {
+	s = escapeAnnotationData(s)
+	s = strings.ReplaceAll(s, ":", "%3A")
+	return strings.ReplaceAll(s, ",", "%2C")
+}
+
+// Write an annotation, level is error, warning, or notice. The file and line
+// are left out if empty or 0.
+func writeGitHubAnnotation(writer io.Writer, level, file string, line int, title, message string) {
+	props := []string{}
+	if file != "" {
+		props = append(props, "file="+escapeAnnotationProperty(file))
+		if line > 0 {
+			props = append(props, "line="+strconv.Itoa(line))
+		}
+	}
+	if title != "" {
+		props = append(props, "title="+escapeAnnotationProperty(title))
+	}
+	fmt.Fprintf(writer, "::%s %s::%s\n", level, strings.Join(props, ","),
+		escapeAnnotationData(strings.TrimSpace(message)))
+}
+
+type reviewIssue struct {
+	// 0 if the issue doesn't name a line
+	Line     int
+	Severity string
+	Message  string
+}
+
+var (
+	reviewIssueStart = regexp.MustCompile(`^\s*\d+[.)]\s+`)
+	reviewIssueLine  = regexp.MustCompile(`(?i)\blines?\s*:?\s*\**\s*(\d+)`)
+
+	// A severity where the review gives one, e.g. (high), severity: high,
+	// high severity, or "Line 3, medium:", rather than any use of the words
+	reviewIssueSeverity = regexp.MustCompile(`(?i)\(\s*(high|medium|low)\s*\)|` +
+		`severity\W{0,5}(high|medium|low)\b|` +
+		`\b(high|medium|low)[ -](?:severity|priority)\b|` +
+		`(?:^|[,*\-]\s*)(high|medium|low)\s*:`)
+)
+
+// Split the numbered list of issues in a review response into issues, lines
+// that don't start an item are part of the item before them
+func parseReviewIssues(issues string) []reviewIssue {
+	items := []string{}
+	for _, line := range strings.Split(issues, "\n") {
+		if reviewIssueStart.MatchString(line) {
+			items = append(items, reviewIssueStart.ReplaceAllString(line, ""))
+		} else if len(items) > 0 && strings.TrimSpace(line) != "" {
+			items[len(items)-1] += "\n" + strings.TrimSpace(line)
+		}
+	}
+
+	parsed := []reviewIssue{}
+	for _, item := range items {
+		issue := reviewIssue{Message: item}
+		if match := reviewIssueLine.FindStringSubmatch(item); match != nil {
+			issue.Line, _ = strconv.Atoi(match[1])
+		}
+		if match := reviewIssueSeverity.FindStringSubmatch(item); match != nil {
+			// one of the alternatives matched
+			issue.Severity = strings.ToLower(strings.Join(match[1:], ""))
+		}
+		parsed = append(parsed, issue)
+	}
+	return parsed
+}
+
+// The annotation level for a review issue's severity
+func annotationLevel(severity string) string {
+	switch severity {
+	case "high":
+		return "error"
+	case "low":
+		return "notice"
+	}
+	return "warning"
+}
+
+// Write a review's issues as annotations on the script. If the response
+// wasn't a numbered list the whole text is one warning.
+func writeReviewAnnotations(writer io.Writer, script, issues string) {
+	parsed := parseReviewIssues(issues)
+	if len(parsed) == 0 && strings.TrimSpace(issues) != "" {
+		parsed = append(parsed, reviewIssue{Message: issues})
+	}
+	for _, issue := range parsed {
+		writeGitHubAnnotation(writer, annotationLevel(issue.Severity), script,
+			issue.Line, "butterfish review", issue.Message)
+	}
+}
+
+// Summarize content as a notice annotation on file, or with no file for
+// piped input
+func (this *ButterfishCtx) summarizeAnnotation(file string, chunks [][]byte) error {
+	summary := strings.Builder{}
+	err := this.summarizeChunksTo(chunks, this.teeWriter(&summary))
+	if err != nil {
+		return err
+	}
+	title := "Summary"
+	if file != "" {
+		title = "Summary of " + file
+	}
+	writeGitHubAnnotation(this.Out, "notice", file, 0, title, summary.String())
+	return nil
+}
+
+func (this *ButterfishCtx) summarizePathAnnotations(paths []string, chunkSize, maxChunks int) error {
+	fs := afero.NewOsFs()
+	for _, path := range paths {
+		chunks, err := util.GetFileChunks(this.Ctx, fs, path, chunkSize, maxChunks)
+		if err != nil {
+			return err
+		}
+		err = this.summarizeAnnotation(path, chunks)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package butterfish
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+// Autosuggest requests are streamed so that if the user keeps typing while a
+// request is in flight we can check what the model has produced so far. If
+// the new input agrees with it we let the request finish and show the rest of
+// the suggestion, rather than cancelling it and starting a new request.
+
+// A dumb artifact of autosuggest few-shot learning, the model sometimes
+// starts its suggestion with this
+const autosuggestPredictionPrefix = "prediction: "
+
+// Which autosuggest prompt to use for what the user has typed
+func autosuggestPromptName(command string) string {
+	if len(command) == 0 {
+		// command completion when we haven't started a command
+		return prompt.ShellAutosuggestNewCommand
+	} else if !unicode.IsUpper(rune(command[0])) {
+		// command completion when we have started typing a command
+		return prompt.ShellAutosuggestCommand
+	}
+	// prompt completion, like we're asking a question
+	return prompt.ShellAutosuggestPrompt
+}
+
+// Work out what to show after the text in the buffer for a suggestion. The
+// model either repeats the command it was given followed by the completion,
+// or, when completing a prompt, may give only the continuation. The buffer
+// may be ahead of the command the suggestion was requested for if the user
+// kept typing. Returns false if the suggestion doesn't fit the buffer.
+func autosuggestRemainder(command, suggestion, current string, requirePrefix bool) (string, bool) {
+	full := suggestion
+	if command != "" && !strings.HasPrefix(strings.ToLower(suggestion), strings.ToLower(command)) {
+		if requirePrefix {
+			return "", false
+		}
+		full = command + suggestion
+	}
+	if !strings.HasPrefix(strings.ToLower(full), strings.ToLower(current)) {
+		return "", false
+	}
+	return full[len(current):], true
+}
+
+// Check whether a partial suggestion for base could still fit what's been
+// typed since. While the first line is still streaming we're optimistic if
+// the partial is shorter than what's typed but agrees with it so far.
+func autosuggestConsistent(base, partial, typed string, requirePrefix bool) bool {
+	if strings.HasPrefix(autosuggestPredictionPrefix, partial) {
+		// nothing useful streamed yet
+		return true
+	}
+	partial = strings.TrimPrefix(partial, autosuggestPredictionPrefix)
+	partial, _, complete := strings.Cut(partial, "\n")
+
+	candidates := []string{partial}
+	if !requirePrefix && base != "" {
+		candidates = append(candidates, base+partial)
+	}
+	typed = strings.ToLower(typed)
+	for _, candidate := range candidates {
+		candidate = strings.ToLower(candidate)
+		if strings.HasPrefix(candidate, typed) || (!complete && strings.HasPrefix(typed, candidate)) {
+			return true
+		}
+	}
+	return false
+}
+
+// An autosuggest request in flight, the LLM streams into it
+type pendingAutosuggest struct {
+	Ctx        context.Context
+	Command    string
+	PromptName string
+
+	mutex   sync.Mutex
+	started bool
+	done    bool
+	partial strings.Builder
+}
+
+func (this *pendingAutosuggest) Write(data []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.partial.Write(data)
+}
+
+// Called once the delay is over and the request is sent
+func (this *pendingAutosuggest) start() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.started = true
+}
+
+func (this *pendingAutosuggest) finish() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.done = true
+}
+
+// Whether this request can be left to finish now that the user has typed
+// command. We only continue requests that have been sent, since one that's
+// still waiting out the delay costs nothing to restart.
+func (this *pendingAutosuggest) CanContinue(command, promptName string, requirePrefix bool) bool {
+	if this == nil {
+		return false
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !this.started || this.done || this.Ctx.Err() != nil || promptName != this.PromptName {
+		return false
+	}
+	if len(command) <= len(this.Command) || !strings.HasPrefix(command, this.Command) {
+		return false
+	}
+	return autosuggestConsistent(this.Command, this.partial.String(), command, requirePrefix)
+}
@@ -0,0 +1,387 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// The batch command runs a prompt against each file matching a glob and
+// writes each output to a file in the output directory. Finished inputs are
+// appended to a progress file in the output directory so that a batch that
+// was interrupted, or had failures, can be run again and only the unfinished
+// inputs are sent.
+const batchProgressFile = ".butterfish_batch_progress.jsonl"
+
+// Outputs are written next to each other in the output directory, mirroring
+// the layout of the inputs, with this extension added
+const batchOutputExt = ".out"
+
+// The number of times we'll send an input before counting it as failed. The
+// LLM client already retries transient errors, so this only comes into play
+// when the rate limit is being hit for a sustained period.
+const batchMaxAttempts = 3
+
+type batchProgressEntry struct {
+	Input  string    `json:"input"`
+	Output string    `json:"output"`
+	Key    string    `json:"key"`
+	Time   time.Time `json:"time"`
+}
+
+// The progress file for an output directory, safe to use from each worker
+type batchProgress struct {
+	Path  string
+	done  map[string]bool
+	mutex sync.Mutex
+}
+
+func loadBatchProgress(outDir string) (*batchProgress, error) {
+	progress := &batchProgress{
+		Path: filepath.Join(outDir, batchProgressFile),
+		done: map[string]bool{},
+	}
+
+	file, err := os.Open(progress.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// skip lines that can't be parsed, e.g. if we were killed mid-write
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := &batchProgressEntry{}
+		if json.Unmarshal(scanner.Bytes(), entry) == nil {
+			progress.done[entry.Key] = true
+		}
+	}
+	return progress, scanner.Err()
+}
+
+func (this *batchProgress) IsDone(key string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.done[key]
+}
+
+func (this *batchProgress) MarkDone(entry *batchProgressEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	file, err := os.OpenFile(this.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	this.done[entry.Key] = true
+	return nil
+}
+
+// Identifies an input's result, so that a changed input, prompt, or model
+// is run again
+func batchKey(template, model string, content []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(template))
+	hash.Write([]byte{0})
+	hash.Write([]byte(model))
+	hash.Write([]byte{0})
+	hash.Write(content)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// The directory a glob is relative to, i.e. the part before the first
+// pattern character, so logs/*/app.txt gives logs
+func globBaseDir(glob string) string {
+	dir := filepath.Dir(glob)
+	for dir != "." && dir != string(filepath.Separator) && strings.ContainsAny(dir, `*?[\`) {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// Where the output for an input is written, keeping its path relative to
+// the glob's base directory so that inputs with the same name in different
+// directories don't collide
+func batchOutputPath(outDir, baseDir, input string) string {
+	rel, err := filepath.Rel(baseDir, input)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(input)
+	}
+	return filepath.Join(outDir, rel+batchOutputExt)
+}
+
+// Write to a temp file and rename it so that an interrupted batch never
+// leaves a partial output
+func writeFileAtomic(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// Shared by the workers so that when one of them is rate limited they all
+// pause, rather than each one continuing to hit the limit
+type batchThrottle struct {
+	mutex      sync.Mutex
+	pauseUntil time.Time
+	pauses     int
+}
+
+func (this *batchThrottle) Pause() time.Duration {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delay := backoffDelay(this.pauses)
+	this.pauses++
+	if until := time.Now().Add(delay); until.After(this.pauseUntil) {
+		this.pauseUntil = until
+	}
+	return delay
+}
+
+// Wait out any pause, returning early with the context's error if it's
+// cancelled first
+func (this *batchThrottle) Wait(ctx context.Context) error {
+	this.mutex.Lock()
+	wait := time.Until(this.pauseUntil)
+	this.mutex.Unlock()
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type batchResult int
+
+const (
+	batchDone batchResult = iota
+	batchSkipped
+	batchFailed
+)
+
+type batchRun struct {
+	Template string
+	Request  util.CompletionRequest
+	BaseDir  string
+	OutDir   string
+	Progress *batchProgress
+	Throttle *batchThrottle
+}
+
+func (this *ButterfishCtx) runBatchInput(run *batchRun, input string) (batchResult, error) {
+	content, err := os.ReadFile(input)
+	if err != nil {
+		return batchFailed, err
+	}
+	outPath := batchOutputPath(run.OutDir, run.BaseDir, input)
+	key := batchKey(run.Template, run.Request.Model, content)
+	if run.Progress.IsDone(key) {
+		if _, err := os.Stat(outPath); err == nil {
+			return batchSkipped, nil
+		}
+	}
+
+	promptStr, err := this.interpolateUsedFields(run.Template, map[string]string{
+		"content": string(content),
+		"path":    input,
+	})
+	if err != nil {
+		return batchFailed, err
+	}
+
+	// each worker needs its own request, the LLM client may change it
+	req := run.Request
+	req.Prompt = promptStr
+
+	var resp *util.CompletionResponse
+	for attempt := 1; ; attempt++ {
+		err = run.Throttle.Wait(req.Ctx)
+		if err != nil {
+			return batchFailed, err
+		}
+		resp, err = this.LLMClient.Completion(&req)
+		if err == nil {
+			break
+		}
+		if !isTransientError(err) || attempt >= batchMaxAttempts {
+			return batchFailed, err
+		}
+		delay := run.Throttle.Pause()
+		this.StylePrintf(this.Config.Styles.Grey, "Rate limited on %s, pausing for %s\n", input, delay.Round(time.Second))
+	}
+
+	err = writeFileAtomic(outPath, []byte(strings.TrimSpace(resp.Completion)+"\n"))
+	if err != nil {
+		return batchFailed, err
+	}
+	err = run.Progress.MarkDone(&batchProgressEntry{
+		Input:  input,
+		Output: outPath,
+		Key:    key,
+		Time:   time.Now(),
+	})
+	if err != nil {
+		return batchFailed, err
+	}
+	return batchDone, nil
+}
+
+// Run a prompt against each file matching a glob, concurrently, writing
+// outputs and progress to the output directory
+func (this *ButterfishCtx) batchCommand(options *CliCommandConfig) error {
+	batch := options.Batch
+	if batch.Concurrency < 1 {
+		return errors.New("Concurrency must be at least 1")
+	}
+
+	template, err := this.loadPromptTemplate(batch.PromptName)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(template, "{content}") {
+		return fmt.Errorf("%s has no {content} field, so each input would get the same output", batch.PromptName)
+	}
+
+	inputs, err := filepath.Glob(batch.InputGlob)
+	if err != nil {
+		return err
+	}
+	files := []string{}
+	for _, input := range inputs {
+		info, err := os.Stat(input)
+		if err == nil && info.Mode().IsRegular() {
+			files = append(files, input)
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("No files match %s", batch.InputGlob)
+	}
+
+	err = os.MkdirAll(batch.Out, 0755)
+	if err != nil {
+		return err
+	}
+	progress, err := loadBatchProgress(batch.Out)
+	if err != nil {
+		return err
+	}
+
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return err
+	}
+	run := &batchRun{
+		Template: template,
+		Request: util.CompletionRequest{
+			Ctx:              this.Ctx,
+			Model:            batch.Model,
+			MaxTokens:        batch.NumTokens,
+			Temperature:      batch.Temperature,
+			SystemMessage:    sysMsg,
+			SystemPromptName: prompt.PromptSystemMessage,
+			Verbose:          this.Config.Verbose > 0,
+			TokenTimeout:     this.Config.TokenTimeout,
+			Task:             TaskBatch,
+		},
+		BaseDir:  globBaseDir(batch.InputGlob),
+		OutDir:   batch.Out,
+		Progress: progress,
+		Throttle: &batchThrottle{},
+	}
+
+	jobs := make(chan string)
+	counts := map[batchResult]int{}
+	finished := 0
+	mutex := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < min(batch.Concurrency, len(files)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for input := range jobs {
+				result, err := this.runBatchInput(run, input)
+
+				mutex.Lock()
+				counts[result]++
+				finished++
+				switch result {
+				case batchDone:
+					this.StylePrintf(this.Config.Styles.Foreground, "[%d/%d] %s\n", finished, len(files), input)
+				case batchSkipped:
+					this.StylePrintf(this.Config.Styles.Grey, "[%d/%d] %s already done\n", finished, len(files), input)
+				case batchFailed:
+					this.StylePrintf(this.Config.Styles.Error, "[%d/%d] %s failed: %s\n", finished, len(files), input, err)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, input := range files {
+		if this.Ctx.Err() != nil {
+			break
+		}
+		jobs <- input
+	}
+	close(jobs)
+	wg.Wait()
+
+	this.StylePrintf(this.Config.Styles.Highlight, "%d done, %d already done, %d failed, outputs in %s\n",
+		counts[batchDone], counts[batchSkipped], counts[batchFailed], batch.Out)
+	if this.Ctx.Err() != nil {
+		return this.Ctx.Err()
+	}
+	if counts[batchFailed] > 0 {
+		return fmt.Errorf("%d inputs failed, run the same command again to retry them", counts[batchFailed])
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/term"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The width of the side by side output if we're not writing to a terminal
+const benchDefaultWidth = 120
+
+// A recorded input for the prompts bench command, the fields are used to
+// interpolate each prompt variant. The inputs file is a YAML list, e.g.
+//
+//	# bench inputs
+//	- name: find go files
+//	  fields:
+//	    content: find all go files modified in the last day
+type BenchCase struct {
+	Name   string            `yaml:"name" json:"name"`
+	Fields map[string]string `yaml:"fields" json:"fields"`
+}
+
+// The outputs of both variants for a single case, scores are 0 if the judge
+// wasn't used
+type BenchResult struct {
+	Case    BenchCase `json:"case"`
+	OutputA string    `json:"output_a"`
+	OutputB string    `json:"output_b"`
+	ScoreA  int       `json:"score_a,omitempty"`
+	ScoreB  int       `json:"score_b,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// The response we ask the judge for
+type benchJudgement struct {
+	ScoreA int    `json:"score_a"`
+	ScoreB int    `json:"score_b"`
+	Reason string `json:"reason"`
+}
+
+func LoadBenchCases(path string) ([]BenchCase, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cases := []BenchCase{}
+	err = yaml.UnmarshalStrict(data, &cases)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", path, err)
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("No cases found in %s", path)
+	}
+
+	for i := range cases {
+		if cases[i].Name == "" {
+			cases[i].Name = fmt.Sprintf("case %d", i+1)
+		}
+	}
+	return cases, nil
+}
+
+// A template is either the name of a prompt in the prompt library or the path
+// of a file containing a prompt template
+func (this *ButterfishCtx) loadPromptTemplate(name string) (string, error) {
+	template, err := this.PromptLibrary.GetUninterpolatedPrompt(name)
+	if err == nil {
+		return template, nil
+	}
+
+	path, err := homedir.Expand(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%s is not a prompt in the prompt library or a file", name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\n"), nil
+}
+
+// Interpolate a template from the prompt library or a file, which may not
+// use every field, so we only pass the fields that appear in the template
+func (this *ButterfishCtx) interpolateUsedFields(template string, fields map[string]string) (string, error) {
+	args := []string{}
+	for _, name := range prompt.FieldNames(template) {
+		if value, ok := fields[name]; ok {
+			args = append(args, name, value)
+		}
+	}
+	return this.PromptLibrary.InterpolatePrompt(template, args...)
+}
+
+// Interpolate a variant with a case, variants may not use every field
+func (this *ButterfishCtx) interpolateBenchCase(template string, benchCase BenchCase) (string, error) {
+	return this.interpolateUsedFields(template, benchCase.Fields)
+}
+
+func (this *ButterfishCtx) runBenchVariant(req *util.CompletionRequest, template string, benchCase BenchCase) (string, error) {
+	promptStr, err := this.interpolateBenchCase(template, benchCase)
+	if err != nil {
+		return "", fmt.Errorf("Error interpolating %s: %w", benchCase.Name, err)
+	}
+	req.Prompt = promptStr
+
+	resp, err := this.LLMClient.Completion(req)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(resp.Completion), nil
+}
+
+// Format the fields of a case for the judge prompt
+func benchCaseString(benchCase BenchCase) string {
+	names := make([]string, 0, len(benchCase.Fields))
+	for name := range benchCase.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	builder := strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(&builder, "%s: %s\n", name, benchCase.Fields[name])
+	}
+	return builder.String()
+}
+
+var judgementRegex = regexp.MustCompile(`(?s)\{.*\}`)
+
+// Pull the judgement JSON out of the judge's response, which may be wrapped
+// in other text or a code block
+func parseBenchJudgement(response string) (*benchJudgement, error) {
+	match := judgementRegex.FindString(response)
+	if match == "" {
+		return nil, fmt.Errorf("No JSON found in judge response: %s", response)
+	}
+
+	judgement := &benchJudgement{}
+	err := json.Unmarshal([]byte(match), judgement)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing judge response: %w", err)
+	}
+	return judgement, nil
+}
+
+func (this *ButterfishCtx) judgeBenchResult(options *CliCommandConfig, result *BenchResult) error {
+	promptStr, err := this.GetPrompt(prompt.PromptBenchJudge,
+		"input", benchCaseString(result.Case),
+		"output_a", result.OutputA,
+		"output_b", result.OutputB)
+	if err != nil {
+		return err
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:           this.Ctx,
+		Prompt:        promptStr,
+		PromptName:    prompt.PromptBenchJudge,
+		Model:         options.Prompts.Bench.JudgeModel,
+		MaxTokens:     512,
+		Temperature:   0,
+		SystemMessage: "N/A",
+		Verbose:       this.Config.Verbose > 0,
+		TokenTimeout:  this.Config.TokenTimeout,
+	}
+	resp, err := this.LLMClient.Completion(req)
+	if err != nil {
+		return err
+	}
+
+	judgement, err := parseBenchJudgement(resp.Completion)
+	if err != nil {
+		return err
+	}
+	result.ScoreA = judgement.ScoreA
+	result.ScoreB = judgement.ScoreB
+	result.Reason = judgement.Reason
+	return nil
+}
+
+// Run both prompt variants over each recorded input, print the outputs side
+// by side, and optionally score them with an LLM judge
+func (this *ButterfishCtx) promptsBenchCommand(options *CliCommandConfig) error {
+	bench := options.Prompts.Bench
+	cases, err := LoadBenchCases(bench.Inputs)
+	if err != nil {
+		return err
+	}
+
+	templateA, err := this.loadPromptTemplate(bench.VariantA)
+	if err != nil {
+		return err
+	}
+	templateB, err := this.loadPromptTemplate(bench.VariantB)
+	if err != nil {
+		return err
+	}
+
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return err
+	}
+	req := &util.CompletionRequest{
+		Ctx:              this.Ctx,
+		Model:            bench.Model,
+		MaxTokens:        bench.NumTokens,
+		Temperature:      bench.Temperature,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.PromptSystemMessage,
+		Verbose:          this.Config.Verbose > 0,
+		TokenTimeout:     this.Config.TokenTimeout,
+	}
+
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		width = benchDefaultWidth
+	}
+	results := []*BenchResult{}
+
+	for i, benchCase := range cases {
+		this.StylePrintf(this.Config.Styles.Highlight, "[%d/%d] %s\n", i+1, len(cases), benchCase.Name)
+		result := &BenchResult{Case: benchCase}
+
+		result.OutputA, err = this.runBenchVariant(req, templateA, benchCase)
+		if err != nil {
+			return err
+		}
+		result.OutputB, err = this.runBenchVariant(req, templateB, benchCase)
+		if err != nil {
+			return err
+		}
+
+		this.Printf("%s\n", util.SideBySide("A: "+bench.VariantA, "B: "+bench.VariantB, width))
+		this.Printf("%s\n", util.SideBySide(result.OutputA, result.OutputB, width))
+
+		if bench.Judge {
+			err = this.judgeBenchResult(options, result)
+			if err != nil {
+				this.ErrorPrintf("Judge failed for %s: %s\n", benchCase.Name, err)
+			} else {
+				this.StylePrintf(this.Config.Styles.Grey, "Judge: A %d, B %d. %s\n",
+					result.ScoreA, result.ScoreB, result.Reason)
+			}
+		}
+		this.Printf("\n")
+		results = append(results, result)
+	}
+
+	if bench.Judge {
+		this.Printf("%s\n", benchSummary(results))
+	}
+
+	if bench.Output != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(bench.Output, data, 0644)
+		if err != nil {
+			return err
+		}
+		this.StylePrintf(this.Config.Styles.Grey, "Wrote results to %s\n", bench.Output)
+	}
+
+	return nil
+}
+
+// Average judge scores and win counts, cases the judge failed on are skipped
+func benchSummary(results []*BenchResult) string {
+	judged, totalA, totalB, winsA, winsB := 0, 0, 0, 0, 0
+	for _, result := range results {
+		if result.ScoreA == 0 && result.ScoreB == 0 {
+			continue
+		}
+		judged++
+		totalA += result.ScoreA
+		totalB += result.ScoreB
+		if result.ScoreA > result.ScoreB {
+			winsA++
+		} else if result.ScoreB > result.ScoreA {
+			winsB++
+		}
+	}
+
+	if judged == 0 {
+		return "No cases were judged"
+	}
+	return fmt.Sprintf("Judged %d cases: A averaged %.1f with %d wins, B averaged %.1f with %d wins, %d ties",
+		judged, float64(totalA)/float64(judged), winsA,
+		float64(totalB)/float64(judged), winsB, judged-winsA-winsB)
+}
@@ -0,0 +1,245 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// Conversation branches let you fork the shell history with !fork <name>,
+// try out a different line of questioning, then go back with !return or
+// bring a summary of what you found back with !merge. Each branch has its
+// own copy of the history, so nothing said in a branch is sent as context
+// in another.
+const mainBranch = "main"
+
+type conversationBranch struct {
+	Name    string
+	Parent  string
+	History *ShellHistory
+	// The number of blocks copied from the parent, the blocks after these
+	// are what happened in the branch
+	ForkedAt int
+}
+
+type ConversationBranches struct {
+	Current  string
+	branches map[string]*conversationBranch
+}
+
+func NewConversationBranches(history *ShellHistory) *ConversationBranches {
+	return &ConversationBranches{
+		Current: mainBranch,
+		branches: map[string]*conversationBranch{
+			mainBranch: {Name: mainBranch, History: history},
+		},
+	}
+}
+
+func (this *ConversationBranches) current() *conversationBranch {
+	return this.branches[this.Current]
+}
+
+// Copy the history so the copy can be appended to without changing the
+// original, blocks are appended to in place so we copy them too
+func (this *ShellHistory) Copy() *ShellHistory {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	history := NewShellHistory()
+	history.Host = this.Host
+	for _, block := range this.Blocks {
+		content := NewShellBuffer()
+		content.Write(block.Content.String())
+		history.Blocks = append(history.Blocks, &HistoryBuffer{
+			Type:           block.Type,
+			Content:        content,
+			FunctionName:   block.FunctionName,
+			FunctionParams: block.FunctionParams,
+			ToolCalls:      block.ToolCalls,
+			ToolCallId:     block.ToolCallId,
+			Host:           block.Host,
+		})
+	}
+	return history
+}
+
+// Fork the current branch into a new branch and switch to it
+func (this *ConversationBranches) Fork(name string) (*ShellHistory, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Usage: !fork <name>")
+	}
+	if this.branches[name] != nil {
+		return nil, fmt.Errorf("Branch %s already exists, use !switch %s", name, name)
+	}
+
+	history := this.current().History.Copy()
+	this.branches[name] = &conversationBranch{
+		Name:     name,
+		Parent:   this.Current,
+		History:  history,
+		ForkedAt: len(history.Blocks),
+	}
+	this.Current = name
+	return history, nil
+}
+
+func (this *ConversationBranches) Switch(name string) (*ShellHistory, error) {
+	branch := this.branches[name]
+	if branch == nil {
+		return nil, fmt.Errorf("No branch named %s, branches are %s", name, strings.Join(this.Names(), ", "))
+	}
+	this.Current = name
+	return branch.History, nil
+}
+
+// Switch to the parent of the current branch, returning the parent and the
+// branch we left
+func (this *ConversationBranches) Return() (*conversationBranch, *conversationBranch, error) {
+	branch := this.current()
+	if branch.Parent == "" {
+		return nil, nil, fmt.Errorf("Already on the %s branch", mainBranch)
+	}
+	parent := this.branches[branch.Parent]
+	this.Current = parent.Name
+	return parent, branch, nil
+}
+
+// Names of branches, main first then the rest sorted
+func (this *ConversationBranches) Names() []string {
+	names := []string{}
+	for name := range this.branches {
+		if name != mainBranch {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{mainBranch}, names...)
+}
+
+// What happened in a branch since it was forked, as text for the summary
+// prompt
+func (this *conversationBranch) NewEntries() string {
+	history := NewShellHistory()
+	this.History.mutex.Lock()
+	history.Blocks = this.History.Blocks[this.ForkedAt:]
+	this.History.mutex.Unlock()
+
+	builder := strings.Builder{}
+	for _, entry := range history.TranscriptEntries() {
+		fmt.Fprintf(&builder, "%s: %s\n", entry.Type, entry.Content)
+	}
+	return builder.String()
+}
+
+// Handle the !fork, !switch, !return, !merge, and !branches commands
+func (this *ShellState) BranchCommand(command string, args []string) {
+	name := strings.Join(args, " ")
+	var text string
+
+	switch command {
+	case "fork":
+		history, err := this.Branches.Fork(name)
+		if err != nil {
+			text = err.Error()
+			break
+		}
+		this.History = history
+		text = fmt.Sprintf("Forked branch %s, use !return to go back or !merge to bring a summary back.", name)
+
+	case "switch":
+		history, err := this.Branches.Switch(name)
+		if err != nil {
+			text = err.Error()
+			break
+		}
+		this.History = history
+		text = fmt.Sprintf("Switched to branch %s.", name)
+
+	case "return":
+		parent, branch, err := this.Branches.Return()
+		if err != nil {
+			text = err.Error()
+			break
+		}
+		this.History = parent.History
+		text = fmt.Sprintf("Returned to branch %s, use !switch %s to go back.", parent.Name, branch.Name)
+
+	case "merge":
+		this.MergeBranch()
+		return
+
+	case "branches":
+		lines := []string{}
+		for _, name := range this.Branches.Names() {
+			marker := "  "
+			if name == this.Branches.Current {
+				marker = "* "
+			}
+			lines = append(lines, marker+name)
+		}
+		text = strings.Join(lines, "\n")
+	}
+
+	fmt.Fprintf(this.ParentOut, "%s%s%s\r\n", this.Color.Answer,
+		strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+	this.UpdateStatusLine()
+	this.SendPromptResponse("")
+}
+
+// Return to the parent branch and add a summary of what happened in the
+// current branch to it. The summary is streamed like a prompt answer so it
+// ends up in the parent's history as LLM output.
+func (this *ShellState) MergeBranch() {
+	parent, branch, err := this.Branches.Return()
+	if err != nil {
+		fmt.Fprintf(this.ParentOut, "%s%s%s\r\n", this.Color.Answer, err, this.Color.Command)
+		this.SendPromptResponse("")
+		return
+	}
+	this.History = parent.History
+
+	entries := branch.NewEntries()
+	if entries == "" {
+		fmt.Fprintf(this.ParentOut, "%sNothing happened in branch %s, returned to %s.%s\r\n",
+			this.Color.Answer, branch.Name, parent.Name, this.Color.Command)
+		this.UpdateStatusLine()
+		this.SendPromptResponse("")
+		return
+	}
+
+	promptStr, err := this.GetPrompt(prompt.PromptSummarizeBranch,
+		"name", branch.Name,
+		"history", entries)
+	if err != nil {
+		this.PrintError(err)
+		this.SendPromptResponse("")
+		return
+	}
+
+	this.setState(statePromptResponse)
+	requestCtx, cancel := context.WithCancel(context.Background())
+	this.PromptResponseCancel = cancel
+	this.History.Append(historyTypePrompt, fmt.Sprintf("Summarize what we found in branch %s", branch.Name))
+
+	request := &util.CompletionRequest{
+		Ctx:           requestCtx,
+		Prompt:        promptStr,
+		PromptName:    prompt.PromptSummarizeBranch,
+		Model:         this.Butterfish.Config.ShellPromptModel,
+		MaxTokens:     this.Butterfish.Config.ShellMaxResponseTokens,
+		Temperature:   0.3,
+		SystemMessage: "You are an assistant that summarizes shell sessions.",
+		Verbose:       this.Butterfish.Config.Verbose > 0,
+		Task:          TaskSummarize,
+		TokenTimeout:  this.Butterfish.Config.TokenTimeout,
+	}
+
+	go CompletionRoutine(request, this.Butterfish.LLMClient,
+		this.PromptAnswerWriter, this.PromptOutputChan,
+		this.Color.Answer, this.Color.Error, this.StyleWriter)
+}
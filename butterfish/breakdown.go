@@ -0,0 +1,264 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// In shell mode !breakdown, or the explain_last_command keybinding, explains
+// the last command token by token: the program, each flag and argument,
+// pipes, and redirections. Excerpts from the local man pages of the programs
+// in the command are sent with it, and the answer is printed as a table,
+// e.g.
+//
+//	tar -czf src.tgz src | ssh host 'cat > src.tgz'
+//
+//	  tar      create, list, or extract archives
+//	  -czf     create (-c) a gzip compressed (-z) archive in a file (-f)
+//	  ...
+//	  |        pipe the archive into ssh
+
+const (
+	breakdownMaxTokens = 1024
+	// Tokens longer than this get their explanation on the next line
+	breakdownTokenWidth = 16
+)
+
+// Split a command line into the tokens we explain: words as they were
+// written, with their quotes, and operators like |, &&, ;, and redirections
+// like > and 2>&1 on their own
+func breakdownTokens(command string) []string {
+	tokens := []string{}
+	word := strings.Builder{}
+	quote := rune(0)
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			word.WriteRune(r)
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' && i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			word.WriteRune(r)
+		case r == '\\' && i+1 < len(runes):
+			word.WriteRune(r)
+			i++
+			word.WriteRune(runes[i])
+		case unicode.IsSpace(r):
+			flush()
+		case strings.ContainsRune("|&;<>", r):
+			// a number right before a redirect is its file descriptor
+			operator := ""
+			if (r == '<' || r == '>') && word.Len() > 0 && strings.Trim(word.String(), "0123456789") == "" {
+				operator = word.String()
+				word.Reset()
+			}
+			flush()
+			operator += string(r)
+			for r != ';' && i+1 < len(runes) && strings.ContainsRune("|&<>", runes[i+1]) {
+				i++
+				operator += string(runes[i])
+			}
+			// the file descriptor a redirect duplicates, e.g. 2>&1
+			if strings.HasSuffix(operator, "&") && strings.ContainsAny(operator, "<>") {
+				for i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '-') {
+					i++
+					operator += string(runes[i])
+				}
+			}
+			tokens = append(tokens, operator)
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// The words of a simple command from the program on, skipping variable
+// assignments, keywords, and wrappers like sudo with their options, see
+// splitWrappers
+func programFields(words []string) []string {
+	_, fields := splitWrappers(words)
+	return fields
+}
+
+// Documentation excerpts for each program in the command, split between
+// them so a long pipeline doesn't crowd out the rest. Returns the excerpts
+// and where they came from.
+func breakdownDocs(ctx context.Context, command string) (string, []string) {
+	commands := [][]string{}
+	seen := map[string]bool{}
+	for _, words := range splitShellCommands(command) {
+		fields := programFields(words)
+		if len(fields) == 0 || seen[fields[0]] {
+			continue
+		}
+		seen[fields[0]] = true
+		commands = append(commands, fields)
+	}
+	if len(commands) == 0 {
+		return "", nil
+	}
+
+	builder := strings.Builder{}
+	sources := []string{}
+	budget := explainMaxDocBytes / len(commands)
+	for _, fields := range commands {
+		docs, source, err := commandDocs(ctx, fields)
+		if err != nil {
+			continue
+		}
+		sources = append(sources, source)
+		fmt.Fprintf(&builder, "From %s:\n%s\n", source, relevantDocExcerpts(docs, commandFlags(fields), budget))
+	}
+	return builder.String(), sources
+}
+
+var breakdownSchema = &jsonschema.Definition{
+	Type: jsonschema.Object,
+	Properties: map[string]jsonschema.Definition{
+		"parts": {
+			Type: jsonschema.Array,
+			Items: &jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"token":       {Type: jsonschema.String},
+					"explanation": {Type: jsonschema.String},
+				},
+				Required:             []string{"token", "explanation"},
+				AdditionalProperties: false,
+			},
+			Description: "One part for each token, in order",
+		},
+	},
+	Required:             []string{"parts"},
+	AdditionalProperties: false,
+}
+
+// A token of a command and what it does
+type BreakdownPart struct {
+	Token       string `json:"token"`
+	Explanation string `json:"explanation"`
+}
+
+// The breakdown as a table of tokens and explanations under the command
+func formatBreakdown(command string, parts []BreakdownPart, sources []string) string {
+	width := 0
+	for _, part := range parts {
+		if length := len([]rune(part.Token)); length <= breakdownTokenWidth {
+			width = max(width, length)
+		}
+	}
+
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "%s\n\n", command)
+	for _, part := range parts {
+		explanation := strings.Join(strings.Fields(part.Explanation), " ")
+		if len([]rune(part.Token)) > width {
+			fmt.Fprintf(&builder, "  %s\n  %s  %s\n", part.Token, strings.Repeat(" ", width), explanation)
+		} else {
+			fmt.Fprintf(&builder, "  %-*s  %s\n", width, part.Token, explanation)
+		}
+	}
+	if len(sources) > 0 {
+		fmt.Fprintf(&builder, "\nFrom the local docs: %s\n", strings.Join(sources, ", "))
+	}
+	return builder.String()
+}
+
+// Break a command down token by token with the model
+func (this *ButterfishCtx) commandBreakdown(ctx context.Context, command, model string) (string, error) {
+	tokens := breakdownTokens(command)
+	if len(tokens) == 0 {
+		return "", errors.New("No command to break down")
+	}
+	docs, sources := breakdownDocs(ctx, command)
+	if docs == "" {
+		docs = "(no local documentation found)"
+	}
+
+	promptStr, err := this.GetPrompt(prompt.PromptCommandBreakdown,
+		"command", command,
+		"tokens", strings.Join(tokens, "\n"),
+		"docs", docs)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := this.completeWithSchema(&util.CompletionRequest{
+		Ctx:           ctx,
+		Prompt:        promptStr,
+		PromptName:    prompt.PromptCommandBreakdown,
+		Model:         model,
+		MaxTokens:     breakdownMaxTokens,
+		Temperature:   0.2,
+		SystemMessage: "You are an assistant that explains Unix shell commands.",
+		Task:          TaskExplain,
+		Verbose:       this.Config.Verbose > 0,
+		TokenTimeout:  this.Config.TokenTimeout,
+	}, breakdownSchema)
+	if err != nil {
+		return "", err
+	}
+
+	breakdown := struct {
+		Parts []BreakdownPart `json:"parts"`
+	}{}
+	err = json.Unmarshal([]byte(response.Completion), &breakdown)
+	if err != nil {
+		return "", err
+	}
+	return formatBreakdown(command, breakdown.Parts, sources), nil
+}
+
+// Break down a command in the shell, by default the last command run
+func (this *ShellState) BreakdownCommand(command string) {
+	if command == "" {
+		command, _ = this.History.LastCommand()
+	}
+	if command == "" {
+		fmt.Fprintf(this.ParentOut, "%sNo command to break down.%s\r\n", this.Color.Answer, this.Color.Command)
+		this.SendPromptResponse("")
+		return
+	}
+
+	this.setState(statePromptResponse)
+	requestCtx, cancel := context.WithCancel(context.Background())
+	this.PromptResponseCancel = cancel
+	this.History.Append(historyTypePrompt, "Break down "+command)
+
+	// looking up docs can be slow so we do it in the goroutine
+	bf := this.Butterfish.snapshot()
+	go func() {
+		text, err := bf.commandBreakdown(requestCtx, command, bf.Config.ShellPromptModel)
+		if err != nil {
+			fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s\n", this.Color.Error, err, this.Color.Command)
+			this.PromptOutputChan <- &util.CompletionResponse{}
+			return
+		}
+		fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
+		this.PromptOutputChan <- &util.CompletionResponse{Completion: text}
+	}()
+}
@@ -0,0 +1,160 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// BudgetConfig sets dollar limits on the estimated spend of a session, set in
+// the config file, e.g.
+//
+//	budget:
+//	  soft_limit: 1
+//	  hard_limit: 5
+//
+// At the soft limit the shell shows a warning, at the hard limit LLM calls
+// fail until the user runs !budget override. Spend is estimated from token
+// counts, calls to models we don't have a price for aren't counted.
+type BudgetConfig struct {
+	// Warn once the session has spent this many dollars, 0 is off
+	SoftLimit float64 `yaml:"soft_limit,omitempty"`
+	// Refuse calls once the session has spent this many dollars, 0 is off
+	HardLimit float64 `yaml:"hard_limit,omitempty"`
+}
+
+func (this *BudgetConfig) Validate() error {
+	if this.SoftLimit < 0 || this.HardLimit < 0 {
+		return errors.New("budget limits can't be negative")
+	}
+	if this.SoftLimit > 0 && this.HardLimit > 0 && this.SoftLimit > this.HardLimit {
+		return errors.New("budget soft_limit must be below hard_limit")
+	}
+	return nil
+}
+
+var ErrBudgetReached = errors.New("Session budget reached")
+
+// SessionBudget checks the session's spend against the configured limits
+type SessionBudget struct {
+	// Replace with SetConfig once requests may be running, e.g. on reload
+	Config *BudgetConfig
+	Usage  *SessionUsage
+	// set by !budget override, calls aren't refused after it
+	overridden bool
+	// the soft limit warning has been shown
+	warned bool
+	mutex  sync.Mutex
+}
+
+func NewSessionBudget(config *BudgetConfig, usage *SessionUsage) *SessionBudget {
+	return &SessionBudget{Config: config, Usage: usage}
+}
+
+// An error if the hard limit has been reached and not overridden, a nil
+// budget allows everything
+func (this *SessionBudget) Check() error {
+	if this == nil {
+		return nil
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.Config == nil || this.Config.HardLimit <= 0 {
+		return nil
+	}
+
+	spent := this.Usage.TotalCost()
+	if this.overridden || spent < this.Config.HardLimit {
+		return nil
+	}
+	return fmt.Errorf("%w: $%.2f (%s spent), no more LLM calls will be made. Run !budget override to keep going.",
+		ErrBudgetReached, this.Config.HardLimit, this.Usage.CostString())
+}
+
+// A warning the first time the session's spend is over the soft limit,
+// empty otherwise
+func (this *SessionBudget) SoftLimitWarning() string {
+	if this == nil {
+		return ""
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.Config == nil || this.Config.SoftLimit <= 0 {
+		return ""
+	}
+
+	if this.warned || this.Usage.TotalCost() < this.Config.SoftLimit {
+		return ""
+	}
+	this.warned = true
+	warning := fmt.Sprintf("This session has spent %s, over the $%.2f soft limit.", this.Usage.CostString(), this.Config.SoftLimit)
+	if this.Config.HardLimit > 0 && !this.overridden {
+		warning += fmt.Sprintf(" LLM calls will stop at $%.2f.", this.Config.HardLimit)
+	}
+	return warning
+}
+
+// Swap in new limits, e.g. when the config is reloaded
+func (this *SessionBudget) SetConfig(config *BudgetConfig) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.Config = config
+}
+
+// Allow calls past the hard limit for the rest of the session
+func (this *SessionBudget) Override() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.overridden = true
+}
+
+// The spend and limits, e.g. for !budget
+func (this *SessionBudget) String() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	parts := []string{fmt.Sprintf("Session spend: %s (estimated)", this.Usage.CostString())}
+	if this.Config != nil && this.Config.SoftLimit > 0 {
+		parts = append(parts, fmt.Sprintf("soft limit: $%.2f", this.Config.SoftLimit))
+	}
+	if this.Config != nil && this.Config.HardLimit > 0 {
+		hard := fmt.Sprintf("hard limit: $%.2f", this.Config.HardLimit)
+		if this.overridden {
+			hard += " (overridden)"
+		}
+		parts = append(parts, hard)
+	}
+	if len(parts) == 1 {
+		parts = append(parts, "no limits, set them in the budget section of the config file")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// !budget shows the session's spend and limits, !budget override lifts the
+// hard limit for the rest of the session
+func (this *ShellState) BudgetCommand(args []string) {
+	budget := this.Butterfish.Budget
+	text := ""
+	switch {
+	case len(args) == 0:
+		text = budget.String() + ".\n"
+	case args[0] == "override":
+		budget.Override()
+		text = "Budget hard limit lifted for this session.\n"
+	default:
+		text = "Usage: !budget [override]\n"
+	}
+	fmt.Fprintf(this.ParentOut, "%s%s%s", this.Color.Answer,
+		strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+	this.SendPromptResponse("")
+}
+
+// Show the soft limit warning if the session just went over it
+func (this *ShellState) CheckBudget() {
+	warning := this.Butterfish.Budget.SoftLimitWarning()
+	if warning == "" {
+		return
+	}
+	fmt.Fprintf(this.ParentOut, "\r\n%s%s%s", this.Color.Error, warning, this.Color.Command)
+}
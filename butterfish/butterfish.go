@@ -23,6 +23,7 @@ import (
 
 	"github.com/bakks/butterfish/embedding"
 	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/storage"
 	"github.com/bakks/butterfish/util"
 )
 
@@ -52,6 +53,42 @@ type ButterfishConfig struct {
 	// LLM API communication client that implements the LLM interface
 	LLMClient LLM
 
+	// Optional secondary provider to switch to if the primary keeps failing
+	Failover *FailoverConfig
+
+	// Optional rate limit shared by all butterfish processes
+	RateLimit *RateLimitConfig
+
+	// Optional git repo of team prompts to merge into the library
+	PromptSync *PromptSyncConfig
+
+	// Times to resume a streamed response that was interrupted partway
+	ResumeAttempts int
+
+	// Optional verification of answers by a second model
+	Verify *VerifyConfig
+	// Recording and transcription of spoken prompts, see speech.go
+	Speech *SpeechConfig
+	// Dollar limits on a session's spend, see budget.go
+	Budget *BudgetConfig
+	// Compression of retrieved snippets and shell history, see compression.go
+	Compression *CompressionConfig
+	// Scripts or webhooks run on goal mode events, see hooks.go
+	Hooks *HooksConfig
+
+	// Optional encryption at rest for history, sessions, and indexes
+	Encryption *EncryptionConfig
+
+	// Optional routing of requests to a fast or strong model by task
+	Routing *RoutingConfig
+
+	// Optional settings for the env_vars context provider
+	EnvContext *EnvContextConfig
+
+	// Record LLM calls to or replay them from a cassette file, see cassette.go
+	CassettePath string
+	CassetteMode string // CassetteModeRecord or CassetteModeReplay
+
 	// Color scheme to use for the shell, see GruvboxDark below
 	ColorScheme *ColorScheme
 
@@ -59,6 +96,15 @@ type ButterfishConfig struct {
 	// These are what should actually be used during rendering
 	Styles    *styles
 	ColorDark bool
+	// Print LLM output as-is rather than rendering markdown
+	PlainOutput bool
+	// Screen reader friendly output, see accessible.go
+	Accessible bool
+	// Never ask the user anything and never print ANSI escapes, see
+	// headless.go
+	Headless bool
+	// Locale of prompts and answers, e.g. es or auto, see language.go
+	Language string
 
 	// Path of yaml file from which to load LLM prompts
 	// Defaults to ~/.config/butterfish/prompts.yaml
@@ -67,6 +113,26 @@ type ButterfishConfig struct {
 	// The instantiated prompt library used when interpolating prompts before
 	// calling the LLM
 	PromptLibrary PromptLibrary
+	// Use the default prompts without reading or writing the prompt library
+	// file, ignored if PromptLibrary is set
+	NoPromptFile bool
+
+	// Where the prompt library, saved sessions, the embedding cache, and
+	// index files are kept, keyed by the path of the file they'd otherwise
+	// be written to. Files on disk if nil, see storage/storage.go.
+	Store storage.Store
+
+	// Path of the config file, re-read when the shell reloads its config
+	ConfigFilePath string
+	// Where the provider's model list is cached and refreshed from, see
+	// capabilities.go. Only the built in capabilities are used if empty.
+	ModelsPath string
+	// Model aliases and the default model of each command from the config
+	// file, see models.go
+	ModelAliases  map[string]string
+	ModelDefaults map[string]string
+	// Sampling defaults for commands from the config file, see sampling.go
+	Sampling map[string]*SamplingConfig
 
 	// Shell mode configuration
 	ShellMode               bool
@@ -76,6 +142,11 @@ type ButterfishConfig struct {
 	ShellLeavePromptAlone   bool   // don't try to edit the shell prompt
 	ShellAutosuggestEnabled bool   // whether to use autosuggest
 	ShellAutosuggestModel   string // used when we're autocompleting a command
+	// Temperature of answers to prompts
+	ShellTemperature float32
+	// Shell mode flags given on the command line, by name, which take
+	// precedence over the config file
+	ShellFlagsGiven map[string]bool
 	// how long to wait between when the user stos typing and we ask for an
 	// autosuggest
 	ShellAutosuggestTimeout time.Duration
@@ -87,11 +158,57 @@ type ButterfishConfig struct {
 	ShellMaxHistoryBlockTokens int
 	// Maximum tokens for the response, reserved when calculating history and passed as max_tokens during inference
 	ShellMaxResponseTokens int
+	// Number of consecutive failed commands in goal mode before we stop and
+	// hand control back to the user
+	ShellGoalModeMaxRetries int
+	// Print a status line with model, token, and spend info after each response
+	ShellStatusLine bool
+	// Keys bound to shell mode actions like accepting an autosuggestion, set
+	// from the config file, DefaultKeyBindings() if nil
+	ShellKeyBindings *KeyBindings
+	// If set to pane or popup and we're running in tmux, render prompt answers
+	// in a split pane or popup rather than inline
+	ShellTmuxMode string
+	// Print a one-line annotation of what each command did, generated by
+	// ShellAnnotateModel, can be toggled in the shell with !annotate
+	ShellAnnotate      bool
+	ShellAnnotateModel string
+	// Read short answers aloud, see tts.go
+	ShellSpeak bool
+	// Record each command with its annotation to the command history so it
+	// can be searched with the history command
+	ShellRecordHistory bool
+	// Summarize the output of commands that run longer than this, 0 is off,
+	// and with ShellNotify send the summary as a desktop notification
+	ShellSummarizeAfter time.Duration
+	ShellNotify         bool
+	// Terminal whose protocols to use for answers, auto detects it, see
+	// terminal.go
+	ShellTerminal string
+	// Save commands suggested by the model that fixed a failure, and offer
+	// them when the same error comes up again, see fixes.go
+	ShellLearnFixes bool
+	// Commands left out of the history with their output, see private.go
+	ShellPrivateCommands []*regexp.Regexp
+	// Don't autosuggest while the user is in an ssh session from the shell
+	ShellRemotePauseAutosuggest bool
+	// Don't add docker and kubernetes state to prompts that mention them
+	ShellNoKeywordContext bool
+	// Add excerpts of indexed project files to autosuggest requests
+	ShellProjectContext bool
+	// Don't read the user's aliases, functions, and tools at startup
+	ShellNoProfile bool
 
 	// Model, temp, and max tokens to use when executing the `gencmd` command
 	GencmdModel       string
 	GencmdTemperature float32
+	GencmdTopP        float32
 	GencmdMaxTokens   int
+	GencmdStop        []string
+	GencmdLogitBias   map[string]int
+	// Explain generated commands, and whether they're read-only or mutating,
+	// before offering to run them, for gencmd and goal mode in the shell
+	ExplainBeforeExecute bool
 
 	// Model, temp, and max tokens to use when executing the `exec` command
 	ExeccheckModel       string
@@ -101,7 +218,10 @@ type ButterfishConfig struct {
 	// Model, temp, and max tokens to use when executing the `summarize` command
 	SummarizeModel       string
 	SummarizeTemperature float32
+	SummarizeTopP        float32
 	SummarizeMaxTokens   int
+	SummarizeStop        []string
+	SummarizeLogitBias   map[string]int
 }
 
 func (this *ButterfishConfig) ParseShell() string {
@@ -117,7 +237,8 @@ type PromptLibrary interface {
 	// For example, if the prompt is "Hello, {name}", then you would call
 	// GetPrompt("greeting", "name", "Peter") and "Hello, Peter" would be
 	// returned. If a variable is not found, or an argument is passed that doesn't
-	// have a corresponding variable, an error is returned.
+	// have a corresponding variable, an error is returned. Variables the prompt
+	// declares with a default can be left out.
 	GetPrompt(name string, args ...string) (string, error)
 
 	GetUninterpolatedPrompt(name string) (string, error)
@@ -129,7 +250,7 @@ type PromptLibrary interface {
 type LLM interface {
 	CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error)
 	Completion(request *util.CompletionRequest) (*util.CompletionResponse, error)
-	Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error)
+	Embeddings(request *util.EmbeddingRequest) ([][]float32, error)
 }
 
 type ButterfishCtx struct {
@@ -139,6 +260,8 @@ type ButterfishCtx struct {
 	Cancel context.CancelFunc
 	// output writer
 	Out io.Writer
+	// a copy of streamed responses is written here if set, see tee.go
+	Tee io.Writer
 
 	// configuration
 	Config *ButterfishConfig
@@ -148,10 +271,22 @@ type ButterfishCtx struct {
 	PromptLibrary PromptLibrary
 	// GPT client
 	LLMClient LLM
+	// token usage and estimated spend for this session
+	Usage *SessionUsage
+	// Limits on Usage's estimated spend, see budget.go
+	Budget *SessionBudget
 	// landing space for generated commands
 	CommandRegister string
 	// embedding index for searching local files
 	VectorIndex embedding.FileEmbeddingIndex
+	// record of commands run in the wrapped shell
+	CommandHistory *CommandHistory
+	// snapshots of files taken before we change them, for undo
+	Checkpoints *CheckpointStore
+	// encrypts files at rest, nil if encryption is off
+	Cipher *util.Cipher
+	// local log of usage for butterfish stats
+	Stats *StatsLog
 }
 
 type ColorScheme struct {
@@ -197,6 +332,20 @@ var GruvboxLight = ColorScheme{
 
 const BestCompletionModel = "gpt-3.5-turbo"
 
+// The defaults of butterfish shell's flags, for programs that run the shell
+// without the CLI
+const (
+	DefaultShellPromptModel               = "gpt-4o"
+	DefaultShellAutosuggestModel          = "gpt-3.5-turbo-instruct"
+	DefaultShellAnnotateModel             = "gpt-4o-mini"
+	DefaultShellAutosuggestTimeout        = 500 * time.Millisecond
+	DefaultShellNewlineAutosuggestTimeout = 3500 * time.Millisecond
+	DefaultShellMaxPromptTokens           = 16384
+	DefaultShellMaxHistoryBlockTokens     = 1024
+	DefaultShellMaxResponseTokens         = 2048
+	DefaultShellGoalModeMaxRetries        = 5
+)
+
 func MakeButterfishConfig() *ButterfishConfig {
 	colorScheme := &GruvboxDark
 
@@ -213,6 +362,11 @@ func MakeButterfishConfig() *ButterfishConfig {
 		SummarizeModel:       BestCompletionModel,
 		SummarizeTemperature: 0.7,
 		SummarizeMaxTokens:   1024,
+		ShellTemperature:     0.7,
+		ResumeAttempts:       defaultResumeAttempts,
+
+		ShellGoalModeMaxRetries: DefaultShellGoalModeMaxRetries,
+		ShellAnnotateModel:      DefaultShellAnnotateModel,
 	}
 }
 
@@ -314,8 +468,14 @@ func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.Fi
 	return ptmx, cleanup, nil
 }
 
-func (this *ButterfishCtx) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
-	return this.LLMClient.Embeddings(ctx, content, this.Config.Verbose > 0)
+func (this *ButterfishCtx) CalculateEmbeddings(ctx context.Context, content []string, model string, dimensions int) ([][]float32, error) {
+	return this.LLMClient.Embeddings(&util.EmbeddingRequest{
+		Ctx:        ctx,
+		Input:      content,
+		Model:      model,
+		Dimensions: dimensions,
+		Verbose:    this.Config.Verbose > 0,
+	})
 }
 
 // A local printf that writes to the butterfishctx out using a lipgloss style
@@ -336,6 +496,18 @@ func (this *ButterfishCtx) ErrorPrintf(format string, a ...any) {
 	this.StylePrintf(this.Config.Styles.Error, format, a...)
 }
 
+// Embeddings of chunks are cached here by model and content hash, so that
+// re-indexing or indexing a duplicate file reuses them
+const defaultEmbeddingCacheDir = "~/.config/butterfish/embeddings"
+
+// The configured store, or files on disk
+func (this *ButterfishCtx) store() storage.Store {
+	if this.Config.Store != nil {
+		return this.Config.Store
+	}
+	return storage.NewDiskStore("")
+}
+
 // Ensure we have a vector index object, idempotent
 func (this *ButterfishCtx) initVectorIndex(pathsToLoad []string) error {
 	if this.VectorIndex != nil {
@@ -344,6 +516,16 @@ func (this *ButterfishCtx) initVectorIndex(pathsToLoad []string) error {
 
 	out := util.NewStyledWriter(this.Out, this.Config.Styles.Foreground)
 	index := embedding.NewDiskCachedEmbeddingIndex(this, out)
+	index.Cipher = this.Cipher
+	index.Store = this.Config.Store
+	// the cache isn't encrypted, so it's only kept for unencrypted indexes
+	if this.Cipher == nil {
+		cacheDir, err := homedir.Expand(defaultEmbeddingCacheDir)
+		if err != nil {
+			return err
+		}
+		index.Cache = embedding.NewStoreEmbeddingCache(this.store(), cacheDir)
+	}
 
 	if this.Config.Verbose > 0 {
 		index.SetOutput(this.Out)
@@ -352,10 +534,11 @@ func (this *ButterfishCtx) initVectorIndex(pathsToLoad []string) error {
 	this.VectorIndex = index
 
 	if !this.InConsoleMode {
-		// if we're running from the command line then we first load the curr
-		// dir index
-		if pathsToLoad == nil || len(pathsToLoad) == 0 {
-			pathsToLoad = []string{"."}
+		// if we're running from the command line then we search the curr dir
+		// index, reading it a directory at a time rather than loading it all
+		if len(pathsToLoad) == 0 {
+			index.ScanPaths = []string{"."}
+			return nil
 		}
 
 		err := this.VectorIndex.LoadPaths(this.Ctx, pathsToLoad)
@@ -417,8 +600,12 @@ func ColorSchemeToStyles(colorScheme *ColorScheme) *styles {
 // Either way, we'll then add the default prompts to the library, replacing
 // loaded prompts only if OkToReplace is set on them. Then we save the library
 // at the same path.
-func NewDiskPromptLibrary(path string, verbose bool, writer io.Writer) (*prompt.DiskPromptLibrary, error) {
+// The library is kept in store, or in a file at path if store is nil
+func NewDiskPromptLibrary(path string, verbose bool, writer io.Writer, store storage.Store) (*prompt.DiskPromptLibrary, error) {
 	promptLibrary := prompt.NewPromptLibrary(path, verbose, writer)
+	promptLibrary.Store = store
+	promptLibrary.Usage = prompt.NewUsageLog(prompt.UsagePath(path))
+	promptLibrary.Usage.Store = store
 	loaded := false
 
 	if promptLibrary.LibraryFileExists() {
@@ -439,13 +626,35 @@ func NewDiskPromptLibrary(path string, verbose bool, writer io.Writer) (*prompt.
 }
 
 func initLLM(config *ButterfishConfig) (LLM, error) {
-	if config.OpenAIToken == "" && config.LLMClient != nil {
+	if config.CassetteMode == CassetteModeReplay {
+		// replaying doesn't need a real client
+		cassette, err := NewReplayLLM(config.CassettePath)
+		if err != nil {
+			return nil, err
+		}
+		return cassette, nil
+	}
+
+	if config.OpenAIToken == "" && config.LLMClient == nil {
 		return nil, errors.New("Must provide either an OpenAI Token or an LLM client.")
 	} else if config.OpenAIToken != "" && config.LLMClient != nil {
 		return nil, errors.New("Must provide either an OpenAI Token or an LLM client, not both.")
 	} else if config.OpenAIToken != "" {
 		gpt := NewGPT(config.OpenAIToken, config.BaseURL)
-		return gpt, nil
+		if config.Failover == nil {
+			return gpt, nil
+		}
+
+		token := config.OpenAIToken
+		if config.Failover.APIKeyEnv != "" {
+			token = os.Getenv(config.Failover.APIKeyEnv)
+		}
+		baseURL := config.BaseURL
+		if config.Failover.BaseURL != "" {
+			baseURL = config.Failover.BaseURL
+		}
+		secondary := NewGPT(token, baseURL)
+		return NewFailoverLLM(gpt, secondary, config.Failover.Model, config.Failover.AfterFailures), nil
 	} else {
 		return config.LLMClient, nil
 	}
@@ -458,12 +667,41 @@ func initPromptLibrary(config *ButterfishConfig) (PromptLibrary, error) {
 		return config.PromptLibrary, nil
 	}
 
+	if config.NoPromptFile {
+		library := prompt.NewMemoryPromptLibrary(prompt.DefaultPrompts)
+		library.Language = resolveLanguage(config.Language, os.Getenv)
+		return library, nil
+	}
+
 	promptPath, err := homedir.Expand(config.PromptLibraryPath)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewDiskPromptLibrary(promptPath, config.Verbose > 0, verboseWriter)
+	library, err := NewDiskPromptLibrary(promptPath, config.Verbose > 0, verboseWriter, config.Store)
+	if err != nil {
+		return nil, err
+	}
+	library.Language = resolveLanguage(config.Language, os.Getenv)
+	return library, nil
+}
+
+// A copy for a goroutine to use while the shell carries on. A reload replaces
+// the config and prompt library of the shell's ButterfishCtx rather than
+// changing them, so the copy keeps the ones it started with.
+func (this *ButterfishCtx) snapshot() *ButterfishCtx {
+	snapshot := *this
+	return &snapshot
+}
+
+// Write what's kept in memory before exiting, the prompt usage counts
+func (this *ButterfishCtx) Close() {
+	if library, ok := this.PromptLibrary.(*prompt.DiskPromptLibrary); ok {
+		err := library.Usage.Flush()
+		if err != nil {
+			log.Printf("Error recording prompt usage: %s", err)
+		}
+	}
 }
 
 func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCtx, error) {
@@ -477,17 +715,77 @@ func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCt
 		return nil, err
 	}
 
+	if config.CassetteMode == CassetteModeRecord {
+		llmClient = NewRecordingLLM(llmClient, config.CassettePath)
+	}
+
+	cipher, err := NewConfiguredCipher(config.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	commandHistory, err := NewCommandHistory(defaultCommandHistoryPath)
+	if err != nil {
+		return nil, err
+	}
+	commandHistory.Cipher = cipher
+
+	checkpoints, err := NewCheckpointStore(defaultCheckpointDir)
+	if err != nil {
+		return nil, err
+	}
+	checkpoints.Cipher = cipher
+
+	stats, err := NewStatsLog(defaultStatsPath)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
+	usage := NewSessionUsage()
+
+	if config.RateLimit != nil {
+		limiter, err := NewSharedRateLimiter(config.RateLimit)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		llmClient = NewRateLimitedLLM(ctx, llmClient, limiter)
+	}
+
+	if config.ResumeAttempts > 0 {
+		llmClient = NewResumingLLM(llmClient, config.ResumeAttempts)
+	}
+
+	budget := NewSessionBudget(config.Budget, usage)
+	trackingLLM := NewUsageTrackingLLM(llmClient, usage)
+	trackingLLM.Stats = stats
+	trackingLLM.Budget = budget
+	if library, ok := promptLibrary.(*prompt.DiskPromptLibrary); ok {
+		trackingLLM.Prompts = library.Usage
+	}
+	var butterfishLLM LLM = trackingLLM
+	if config.Routing != nil {
+		butterfishLLM = NewRoutingLLM(trackingLLM, config.Routing)
+	}
 
 	butterfishCtx := &ButterfishCtx{
-		Ctx:           ctx,
-		Cancel:        cancel,
-		PromptLibrary: promptLibrary,
-		InConsoleMode: false,
-		Config:        config,
-		LLMClient:     llmClient,
-		Out:           os.Stdout,
+		Ctx:            ctx,
+		Cancel:         cancel,
+		PromptLibrary:  promptLibrary,
+		InConsoleMode:  false,
+		Config:         config,
+		LLMClient:      butterfishLLM,
+		Usage:          usage,
+		Budget:         budget,
+		CommandHistory: commandHistory,
+		Checkpoints:    checkpoints,
+		Cipher:         cipher,
+		Stats:          stats,
+		Out:            os.Stdout,
 	}
+	capabilities.SetPath(config.ModelsPath)
+	butterfishCtx.refreshCapabilitiesIfStale()
 
 	return butterfishCtx, nil
 }
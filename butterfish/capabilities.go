@@ -0,0 +1,427 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/storage"
+	"github.com/mitchellh/go-homedir"
+)
+
+// What a model can do, so commands can adapt to it, e.g. failing fast when
+// an image is attached for a text-only model. Capabilities come from the
+// provider's model list where it reports them, OpenRouter, Groq, and vLLM do
+// for example, and otherwise from MODEL_TO_CAPABILITIES. The CLI caches the
+// model list in ~/.config/butterfish/models.json, see ModelsPath in the
+// config, and refreshes it when it's a day old, or with butterfish models
+// --refresh.
+
+type ModelCapabilities struct {
+	// Context window in tokens, 0 if unknown
+	ContextTokens int `json:"context_tokens,omitempty"`
+	// Reads images attached to the prompt
+	Vision bool `json:"vision,omitempty"`
+	// Supports tool and function calls
+	Tools bool `json:"tools,omitempty"`
+	// Supports structured output, i.e. a response_format JSON schema
+	JSONMode bool `json:"json_mode,omitempty"`
+	// Length of the vectors of an embedding model
+	EmbeddingDims int `json:"embedding_dims,omitempty"`
+}
+
+// Capabilities of models we know, context sizes are in MODEL_TO_NUM_TOKENS.
+// Like the other model tables, a dated model matches its base name.
+var MODEL_TO_CAPABILITIES = map[string]ModelCapabilities{
+	"gpt-4o":                 {Vision: true, Tools: true, JSONMode: true},
+	"gpt-4o-2024-05-13":      {Vision: true, Tools: true},
+	"gpt-4o-mini":            {Vision: true, Tools: true, JSONMode: true},
+	"gpt-4-turbo":            {Vision: true, Tools: true},
+	"gpt-4-turbo-preview":    {Tools: true},
+	"gpt-4-1106":             {Tools: true},
+	"gpt-4-0125-preview":     {Tools: true},
+	"gpt-4-vision":           {Vision: true},
+	"gpt-4":                  {Tools: true},
+	"gpt-4-32k":              {Tools: true},
+	"gpt-3.5-turbo":          {Tools: true},
+	"gpt-3.5-turbo-instruct": {},
+	"text-embedding-3-small": {ContextTokens: 8191, EmbeddingDims: 1536},
+	"text-embedding-3-large": {ContextTokens: 8191, EmbeddingDims: 3072},
+	"text-embedding-ada-002": {ContextTokens: 8191, EmbeddingDims: 1536},
+}
+
+const (
+	capabilitiesRefreshAge = 24 * time.Hour
+	defaultProviderBaseURL = "https://api.openai.com/v1"
+)
+
+// The cached model list of a provider
+type capabilitiesCache struct {
+	BaseURL string                        `json:"base_url"`
+	Updated time.Time                     `json:"updated"`
+	Models  map[string]*ModelCapabilities `json:"models"`
+}
+
+// CapabilityRegistry looks up model capabilities in the cached model list and
+// the built in table
+type CapabilityRegistry struct {
+	// Where the model list is cached, it's only kept in memory if empty
+	Path  string
+	cache *capabilitiesCache
+	// Set once a background refresh has been started, so there's one per
+	// process however many contexts are made
+	refreshStarted bool
+	mutex          sync.Mutex
+}
+
+// The registry used by commands, its path is set from the config by
+// NewButterfish
+var capabilities = &CapabilityRegistry{}
+
+// Use the model list cached at path, dropping the one loaded from the
+// previous path
+func (this *CapabilityRegistry) SetPath(path string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if path != this.Path {
+		this.Path = path
+		this.cache = nil
+	}
+}
+
+// Capabilities of a model, false if we don't know the model, in which case
+// commands shouldn't assume it lacks anything
+func ModelCapabilitiesFor(model string) (*ModelCapabilities, bool) {
+	return capabilities.Lookup(model)
+}
+
+func (this *CapabilityRegistry) load() *capabilitiesCache {
+	if this.cache != nil {
+		return this.cache
+	}
+	this.cache = &capabilitiesCache{}
+	if this.Path == "" {
+		return this.cache
+	}
+	path, err := homedir.Expand(this.Path)
+	if err != nil {
+		return this.cache
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error reading model capabilities: %s", err)
+		}
+		return this.cache
+	}
+	err = json.Unmarshal(data, this.cache)
+	if err != nil {
+		log.Printf("Error parsing %s: %s", path, err)
+	}
+	return this.cache
+}
+
+// The provider's listing of the model, nil if it isn't listed
+func (this *CapabilityRegistry) listed(model string) *ModelCapabilities {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.load().Models[model]
+}
+
+func builtinCapabilities(model string) (*ModelCapabilities, bool) {
+	found, builtin := findModelValue(model, MODEL_TO_CAPABILITIES)
+	if found == "" {
+		return nil, false
+	}
+	if builtin.ContextTokens == 0 {
+		_, builtin.ContextTokens = findModelValue(model, MODEL_TO_NUM_TOKENS)
+	}
+	return &builtin, true
+}
+
+func (this *CapabilityRegistry) Lookup(model string) (*ModelCapabilities, bool) {
+	if listed := this.listed(model); listed != nil {
+		return listed, true
+	}
+	return builtinCapabilities(model)
+}
+
+// Whether the cached list is older than capabilitiesRefreshAge or is for
+// another provider
+func (this *CapabilityRegistry) Stale(baseURL string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	cache := this.load()
+	return cache.BaseURL != providerBaseURL(baseURL) || time.Since(cache.Updated) > capabilitiesRefreshAge
+}
+
+func providerBaseURL(baseURL string) string {
+	if baseURL == "" {
+		return defaultProviderBaseURL
+	}
+	return strings.TrimRight(baseURL, "/")
+}
+
+// An entry of a provider's model list. Providers add their own fields to
+// OpenAI's, we read the ones we know.
+type providerModel struct {
+	ID string `json:"id"`
+	// OpenRouter, Groq, and vLLM name the context window differently
+	ContextLength float64 `json:"context_length"`
+	ContextWindow float64 `json:"context_window"`
+	MaxModelLen   float64 `json:"max_model_len"`
+
+	InputModalities []string `json:"input_modalities"`
+	Architecture    struct {
+		InputModalities []string `json:"input_modalities"`
+	} `json:"architecture"`
+	SupportedParameters []string `json:"supported_parameters"`
+}
+
+// The capabilities of a listed model, the built in ones with what the
+// provider reports on top. Returns nil if we know nothing about the model.
+func (this *providerModel) capabilities() *ModelCapabilities {
+	caps, known := builtinCapabilities(this.ID)
+	if !known {
+		caps = &ModelCapabilities{}
+	}
+
+	for _, context := range []float64{this.ContextLength, this.ContextWindow, this.MaxModelLen} {
+		if context > 0 {
+			caps.ContextTokens = int(context)
+			known = true
+			break
+		}
+	}
+	modalities := this.InputModalities
+	if modalities == nil {
+		modalities = this.Architecture.InputModalities
+	}
+	if modalities != nil {
+		caps.Vision = slices.Contains(modalities, "image")
+		known = true
+	}
+	if this.SupportedParameters != nil {
+		caps.Tools = slices.Contains(this.SupportedParameters, "tools")
+		caps.JSONMode = slices.Contains(this.SupportedParameters, "structured_outputs") ||
+			slices.Contains(this.SupportedParameters, "response_format")
+		known = true
+	}
+
+	if !known {
+		return nil
+	}
+	return caps
+}
+
+// Fetch the provider's model list and cache the capabilities of the models
+// in it, returns the number of models cached
+func (this *CapabilityRegistry) Refresh(ctx context.Context, baseURL, token string) (int, error) {
+	baseURL = providerBaseURL(baseURL)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/models", nil)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Error listing models from %s: %s", baseURL, response.Status)
+	}
+
+	list := struct {
+		Data []providerModel `json:"data"`
+	}{}
+	err = json.Unmarshal(body, &list)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing the model list from %s: %w", baseURL, err)
+	}
+
+	cache := &capabilitiesCache{BaseURL: baseURL, Updated: time.Now(), Models: map[string]*ModelCapabilities{}}
+	for _, model := range list.Data {
+		if caps := model.capabilities(); caps != nil {
+			cache.Models[model.ID] = caps
+		}
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.cache = cache
+	if this.Path == "" {
+		return len(cache.Models), nil
+	}
+	path, err := homedir.Expand(this.Path)
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	// written to a temporary file and renamed so a process reading the list
+	// never sees half of it
+	return len(cache.Models), storage.NewDiskStore("").Put(ctx, path, data)
+}
+
+// Whether a background refresh should start, true at most once per process
+// and only for a model list cached on disk that's stale
+func (this *CapabilityRegistry) startRefresh(baseURL string) bool {
+	if this.Path == "" || !this.Stale(baseURL) {
+		return false
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.refreshStarted {
+		return false
+	}
+	this.refreshStarted = true
+	return true
+}
+
+// Refresh the model list in the background if it's stale
+func (this *ButterfishCtx) refreshCapabilitiesIfStale() {
+	if this.Config.OpenAIToken == "" || this.Config.CassetteMode == CassetteModeReplay ||
+		!capabilities.startRefresh(this.Config.BaseURL) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(this.Ctx, 30*time.Second)
+		defer cancel()
+		_, err := capabilities.Refresh(ctx, this.Config.BaseURL, this.Config.OpenAIToken)
+		if err != nil {
+			log.Printf("Error refreshing model capabilities: %s", err)
+		}
+	}()
+}
+
+// The models in the cached list, or the built in ones if nothing is cached
+func (this *CapabilityRegistry) Models() map[string]*ModelCapabilities {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if models := this.load().Models; len(models) > 0 {
+		return models
+	}
+	models := map[string]*ModelCapabilities{}
+	for name := range MODEL_TO_CAPABILITIES {
+		models[name], _ = builtinCapabilities(name)
+	}
+	return models
+}
+
+func (this *ButterfishCtx) modelsCommand(options *CliCommandConfig) error {
+	stale := this.Config.OpenAIToken != "" && capabilities.Stale(this.Config.BaseURL)
+	if options.Models.Refresh || stale {
+		if this.Config.OpenAIToken == "" {
+			return errors.New("Please set an API token to fetch the model list")
+		}
+		count, err := capabilities.Refresh(this.Ctx, this.Config.BaseURL, this.Config.OpenAIToken)
+		if err != nil {
+			return err
+		}
+		this.StylePrintf(this.Config.Styles.Grey, "Fetched %d models from %s\n", count, providerBaseURL(this.Config.BaseURL))
+	}
+	this.StylePrintf(this.Config.Styles.Foreground, "%s", formatCapabilities(capabilities.Models()))
+	return nil
+}
+
+// An error if the model is known not to read images
+func checkVisionModel(model string) error {
+	if caps, ok := ModelCapabilitiesFor(model); ok && !caps.Vision {
+		return fmt.Errorf("%s can't read images, use a model with vision such as gpt-4o", model)
+	}
+	return nil
+}
+
+// An error if the model is known not to call tools
+func checkToolsModel(model string) error {
+	if caps, ok := ModelCapabilitiesFor(model); ok && !caps.Tools {
+		return fmt.Errorf("%s doesn't support tool calls, use a model that does such as gpt-4o", model)
+	}
+	return nil
+}
+
+// An error if the embedding model is known to produce shorter vectors than
+// the dimensions asked for
+func checkEmbeddingDims(model string, dimensions int) error {
+	if dimensions == 0 {
+		return nil
+	}
+	if caps, ok := ModelCapabilitiesFor(model); ok && caps.EmbeddingDims > 0 && dimensions > caps.EmbeddingDims {
+		return fmt.Errorf("%s embeddings have %d dimensions, fewer than the %d asked for", model, caps.EmbeddingDims, dimensions)
+	}
+	return nil
+}
+
+// Whether to ask the model for structured output, unknown models are asked
+func supportsJSONMode(model string) bool {
+	if IsCompletionModel(model) {
+		return false
+	}
+	caps, ok := ModelCapabilitiesFor(model)
+	return !ok || caps.JSONMode
+}
+
+// An image file as a data URL to attach to a prompt
+func imageDataURL(path string) (string, error) {
+	mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(path)))
+	if !strings.HasPrefix(mimeType, "image/") {
+		return "", fmt.Errorf("%s isn't an image, attach png, jpeg, gif, or webp files", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// The capabilities of models for butterfish models, one per line
+func formatCapabilities(models map[string]*ModelCapabilities) string {
+	names := []string{}
+	for name := range models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	builder := strings.Builder{}
+	for _, name := range names {
+		caps := models[name]
+		features := []string{}
+		if caps.ContextTokens > 0 {
+			features = append(features, fmt.Sprintf("%s context", formatTokenCount(caps.ContextTokens)))
+		}
+		for _, feature := range []struct {
+			Name string
+			Has  bool
+		}{{"vision", caps.Vision}, {"tools", caps.Tools}, {"json", caps.JSONMode}} {
+			if feature.Has {
+				features = append(features, feature.Name)
+			}
+		}
+		if caps.EmbeddingDims > 0 {
+			features = append(features, fmt.Sprintf("%d dims", caps.EmbeddingDims))
+		}
+		fmt.Fprintf(&builder, "%-32s %s\n", name, strings.Join(features, ", "))
+	}
+	return builder.String()
+}
@@ -0,0 +1,304 @@
+package butterfish
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// Cassettes record LLM interactions to a file so they can be replayed later
+// without network access, e.g. for integration tests, demos, or reproducing a
+// bug report. Set one of these env vars to the path of a cassette file:
+//
+//	BUTTERFISH_RECORD=session.json butterfish shell
+//	BUTTERFISH_REPLAY=session.json butterfish shell
+const (
+	CassetteRecordEnv = "BUTTERFISH_RECORD"
+	CassetteReplayEnv = "BUTTERFISH_REPLAY"
+
+	CassetteModeRecord = "record"
+	CassetteModeReplay = "replay"
+)
+
+const (
+	cassetteKindCompletion = "completion"
+	cassetteKindStream     = "stream"
+	cassetteKindEmbeddings = "embeddings"
+)
+
+// Returns the cassette path and mode set in the environment, or empty strings
+// if neither env var is set
+func CassetteFromEnv() (string, string, error) {
+	record := os.Getenv(CassetteRecordEnv)
+	replay := os.Getenv(CassetteReplayEnv)
+	if record != "" && replay != "" {
+		return "", "", fmt.Errorf("Only one of %s and %s can be set", CassetteRecordEnv, CassetteReplayEnv)
+	}
+	if record != "" {
+		return record, CassetteModeRecord, nil
+	}
+	if replay != "" {
+		return replay, CassetteModeReplay, nil
+	}
+	return "", "", nil
+}
+
+// A single recorded call. The request fields other than the key are only
+// there to make cassettes readable.
+type CassetteInteraction struct {
+	Kind       string                   `json:"kind"`
+	Key        string                   `json:"key"`
+	Model      string                   `json:"model,omitempty"`
+	Prompt     string                   `json:"prompt,omitempty"`
+	Input      []string                 `json:"input,omitempty"`
+	Response   *util.CompletionResponse `json:"response,omitempty"`
+	Embeddings [][]float32              `json:"embeddings,omitempty"`
+	Error      string                   `json:"error,omitempty"`
+
+	used bool
+}
+
+type Cassette struct {
+	Interactions []*CassetteInteraction `json:"interactions"`
+}
+
+// The parts of a request that identify it, hashed to match recorded calls
+type cassetteRequestKey struct {
+	Kind          string
+	Model         string
+	Prompt        string
+	SystemMessage string
+	MaxTokens     int
+	Temperature   float32
+	HistoryBlocks []util.HistoryBlock
+	Functions     []util.FunctionDefinition
+	Tools         []util.ToolDefinition
+	// omitted when unset so keys of older recordings still match
+	ResponseSchema *jsonschema.Definition `json:",omitempty"`
+	Input          []string
+	Dimensions     int      `json:",omitempty"`
+	Images         []string `json:",omitempty"`
+}
+
+func cassetteKey(key *cassetteRequestKey) string {
+	data, err := json.Marshal(key)
+	if err != nil {
+		// this shouldn't happen since requests are plain data
+		panic(err)
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func requestCassetteKey(kind string, request *util.CompletionRequest) string {
+	return cassetteKey(&cassetteRequestKey{
+		Kind:           kind,
+		Model:          request.Model,
+		Prompt:         request.Prompt,
+		SystemMessage:  request.SystemMessage,
+		MaxTokens:      request.MaxTokens,
+		Temperature:    request.Temperature,
+		HistoryBlocks:  request.HistoryBlocks,
+		Functions:      request.Functions,
+		Tools:          request.Tools,
+		ResponseSchema: request.ResponseSchema,
+		Images:         request.Images,
+	})
+}
+
+// An LLM implementation that either records the calls made to a wrapped LLM
+// to a cassette file, or replays calls from a cassette file with no wrapped
+// LLM.
+//
+// On replay we look for the first unused interaction with the same request.
+// Requests often include things that change between runs, like the time in a
+// system message, so if there isn't an exact match we fall back to the next
+// unused interaction of the same kind in the order they were recorded.
+type CassetteLLM struct {
+	LLM  LLM
+	Path string
+	Mode string
+
+	mutex    sync.Mutex
+	cassette *Cassette
+}
+
+// Create a CassetteLLM that records calls to llm in a new cassette at path
+func NewRecordingLLM(llm LLM, path string) *CassetteLLM {
+	return &CassetteLLM{
+		LLM:      llm,
+		Path:     path,
+		Mode:     CassetteModeRecord,
+		cassette: &Cassette{},
+	}
+}
+
+// Create a CassetteLLM that replays the cassette at path
+func NewReplayLLM(path string) (*CassetteLLM, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cassette := &Cassette{}
+	err = json.Unmarshal(data, cassette)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing cassette %s: %w", path, err)
+	}
+
+	return &CassetteLLM{
+		Path:     path,
+		Mode:     CassetteModeReplay,
+		cassette: cassette,
+	}, nil
+}
+
+// Add an interaction and rewrite the cassette, we save after every call so
+// the cassette is complete even if butterfish exits uncleanly
+func (this *CassetteLLM) record(interaction *CassetteInteraction, err error) {
+	if err != nil {
+		interaction.Error = err.Error()
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.cassette.Interactions = append(this.cassette.Interactions, interaction)
+	data, err := json.MarshalIndent(this.cassette, "", "  ")
+	if err == nil {
+		err = os.WriteFile(this.Path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Error writing cassette %s: %s", this.Path, err)
+	}
+}
+
+func (this *CassetteLLM) replay(kind, key string) (*CassetteInteraction, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	var fallback *CassetteInteraction
+	for _, interaction := range this.cassette.Interactions {
+		if interaction.used || interaction.Kind != kind {
+			continue
+		}
+		if interaction.Key == key {
+			interaction.used = true
+			return interaction, nil
+		}
+		if fallback == nil {
+			fallback = interaction
+		}
+	}
+
+	if fallback == nil {
+		return nil, fmt.Errorf("No more recorded %s calls in cassette %s", kind, this.Path)
+	}
+	log.Printf("Cassette has no exact match for %s request, replaying the next recorded call", kind)
+	fallback.used = true
+	return fallback, nil
+}
+
+// Replay the response and error of an interaction
+func replayedResult(interaction *CassetteInteraction) (*util.CompletionResponse, error) {
+	var err error
+	if interaction.Error != "" {
+		err = errors.New(interaction.Error)
+	}
+	return interaction.Response, err
+}
+
+func (this *CassetteLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	key := requestCassetteKey(cassetteKindStream, request)
+
+	if this.Mode == CassetteModeReplay {
+		interaction, err := this.replay(cassetteKindStream, key)
+		if err != nil {
+			return nil, err
+		}
+		if interaction.Response != nil && interaction.Response.Completion != "" {
+			writer.Write([]byte(interaction.Response.Completion))
+		}
+		return replayedResult(interaction)
+	}
+
+	response, err := this.LLM.CompletionStream(request, writer)
+	this.record(&CassetteInteraction{
+		Kind:     cassetteKindStream,
+		Key:      key,
+		Model:    request.Model,
+		Prompt:   request.Prompt,
+		Response: response,
+	}, err)
+	return response, err
+}
+
+func (this *CassetteLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	key := requestCassetteKey(cassetteKindCompletion, request)
+
+	if this.Mode == CassetteModeReplay {
+		interaction, err := this.replay(cassetteKindCompletion, key)
+		if err != nil {
+			return nil, err
+		}
+		return replayedResult(interaction)
+	}
+
+	response, err := this.LLM.Completion(request)
+	this.record(&CassetteInteraction{
+		Kind:     cassetteKindCompletion,
+		Key:      key,
+		Model:    request.Model,
+		Prompt:   request.Prompt,
+		Response: response,
+	}, err)
+	return response, err
+}
+
+func (this *CassetteLLM) Embeddings(request *util.EmbeddingRequest) ([][]float32, error) {
+	key := cassetteKey(&cassetteRequestKey{
+		Kind:       cassetteKindEmbeddings,
+		Model:      request.Model,
+		Input:      request.Input,
+		Dimensions: request.Dimensions,
+	})
+
+	if this.Mode == CassetteModeReplay {
+		interaction, err := this.replay(cassetteKindEmbeddings, key)
+		if err != nil {
+			return nil, err
+		}
+		if interaction.Error != "" {
+			return nil, errors.New(interaction.Error)
+		}
+		return interaction.Embeddings, nil
+	}
+
+	embeddings, err := this.LLM.Embeddings(request)
+	this.record(&CassetteInteraction{
+		Kind:       cassetteKindEmbeddings,
+		Key:        key,
+		Model:      request.Model,
+		Input:      request.Input,
+		Embeddings: embeddings,
+	}, err)
+	return embeddings, err
+}
+
+// Transcriptions aren't recorded, audio files don't make for stable keys
+func (this *CassetteLLM) Transcribe(ctx context.Context, path, model, language string) (string, error) {
+	if this.Mode == CassetteModeReplay {
+		return "", errors.New("Transcriptions can't be replayed from a cassette")
+	}
+	return transcribeWith(this.LLM, ctx, path, model, language)
+}
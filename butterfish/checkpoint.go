@@ -0,0 +1,474 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/mitchellh/go-homedir"
+)
+
+// Before butterfish changes files (edit, review, refactor, generate, and
+// commands run in goal mode) it snapshots the originals into a checkpoint,
+// so that `butterfish undo` can restore them without relying on git. Each
+// checkpoint is a directory holding a manifest and a copy of each file.
+
+const (
+	defaultCheckpointDir   = "~/.config/butterfish/checkpoints"
+	checkpointManifestName = "checkpoint.json"
+	// Older checkpoints are deleted once there are more than this
+	checkpointMaxCount = 50
+	// Larger files aren't copied into checkpoints
+	checkpointMaxFileBytes = 10 << 20
+)
+
+// A file saved in a checkpoint
+type CheckpointFile struct {
+	Path string `json:"path"`
+	// If false the file didn't exist, so undo deletes it
+	Existed bool        `json:"existed"`
+	Mode    fs.FileMode `json:"mode,omitempty"`
+	// Name of the copy of the file in the checkpoint directory
+	Blob string `json:"blob,omitempty"`
+}
+
+type Checkpoint struct {
+	Time        time.Time        `json:"time"`
+	Source      string           `json:"source"`
+	Description string           `json:"description"`
+	Files       []CheckpointFile `json:"files"`
+	// Paths that weren't saved because they aren't regular files, e.g.
+	// directories, or are too large, so undo can't restore them
+	Skipped []string `json:"skipped,omitempty"`
+
+	dir string
+}
+
+type CheckpointStore struct {
+	Dir string
+	// Encrypts the manifests and file copies if set, see encryption.go
+	Cipher *util.Cipher
+}
+
+func NewCheckpointStore(dir string) (*CheckpointStore, error) {
+	if dir == "" {
+		dir = defaultCheckpointDir
+	}
+	dir, err := homedir.Expand(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &CheckpointStore{Dir: dir}, nil
+}
+
+// Snapshot files before they're changed. Paths are made absolute so the
+// checkpoint can be restored from any directory. Files that don't exist yet
+// are recorded so undo removes them. Directories, other files that aren't
+// regular, and files over checkpointMaxFileBytes are listed in Skipped.
+func (this *CheckpointStore) Save(source, description string, paths []string) (*Checkpoint, error) {
+	now := time.Now()
+	checkpoint := &Checkpoint{
+		Time:        now,
+		Source:      source,
+		Description: description,
+		dir:         filepath.Join(this.Dir, fmt.Sprintf("%d-%s", now.UnixNano(), source)),
+	}
+
+	// checkpoints can hold secrets from the files, only the user can read them
+	err := os.MkdirAll(checkpoint.dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		file := CheckpointFile{Path: path}
+		info, err := os.Stat(path)
+		if err == nil && info.Mode().IsRegular() && info.Size() <= checkpointMaxFileBytes {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			file.Existed = true
+			file.Mode = info.Mode().Perm()
+			file.Blob = fmt.Sprintf("%d", len(checkpoint.Files))
+			err = this.write(filepath.Join(checkpoint.dir, file.Blob), content)
+			if err != nil {
+				return nil, err
+			}
+		} else if err == nil {
+			// we only snapshot regular files that aren't too large
+			checkpoint.Skipped = append(checkpoint.Skipped, path)
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		checkpoint.Files = append(checkpoint.Files, file)
+	}
+
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = this.write(filepath.Join(checkpoint.dir, checkpointManifestName), data)
+	if err != nil {
+		return nil, err
+	}
+
+	this.prune()
+	return checkpoint, nil
+}
+
+func (this *CheckpointStore) write(path string, data []byte) error {
+	data, err := this.Cipher.Encrypt(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func (this *CheckpointStore) read(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return this.Cipher.Decrypt(data)
+}
+
+// Checkpoints, newest first
+func (this *CheckpointStore) List() ([]*Checkpoint, error) {
+	entries, err := os.ReadDir(this.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoints := []*Checkpoint{}
+	for _, entry := range entries {
+		dir := filepath.Join(this.Dir, entry.Name())
+		data, err := this.read(filepath.Join(dir, checkpointManifestName))
+		if err != nil {
+			// a checkpoint that was interrupted while saving, or that was
+			// encrypted and encryption is now off
+			continue
+		}
+		checkpoint := &Checkpoint{dir: dir}
+		if json.Unmarshal(data, checkpoint) == nil {
+			checkpoints = append(checkpoints, checkpoint)
+		}
+	}
+
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Time.After(checkpoints[j].Time)
+	})
+	return checkpoints, nil
+}
+
+func (this *CheckpointStore) prune() {
+	checkpoints, err := this.List()
+	if err != nil {
+		log.Printf("Error listing checkpoints: %s", err)
+		return
+	}
+	for i := checkpointMaxCount; i < len(checkpoints); i++ {
+		os.RemoveAll(checkpoints[i].dir)
+	}
+}
+
+// Put the files back as they were when the checkpoint was saved, then
+// delete the checkpoint
+func (this *CheckpointStore) Restore(checkpoint *Checkpoint) error {
+	for _, file := range checkpoint.Files {
+		if !file.Existed {
+			err := os.Remove(file.Path)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+
+		content, err := this.read(filepath.Join(checkpoint.dir, file.Blob))
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(file.Path), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(file.Path, content, file.Mode)
+		if err != nil {
+			return err
+		}
+		// WriteFile doesn't change the mode of an existing file
+		err = os.Chmod(file.Path, file.Mode)
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(checkpoint.dir)
+}
+
+func (this *Checkpoint) String() string {
+	paths := make([]string, len(this.Files))
+	for i, file := range this.Files {
+		paths[i] = relativePath(file.Path)
+		if !file.Existed {
+			paths[i] += " (new)"
+		}
+	}
+	return fmt.Sprintf("%s %s: %s [%s]", this.Time.Format("2006-01-02 15:04:05"),
+		this.Source, this.Description, strings.Join(paths, ", "))
+}
+
+// Save a checkpoint of files we're about to change
+func (this *ButterfishCtx) Checkpoint(source, description string, paths ...string) error {
+	if len(paths) == 0 || this.Checkpoints == nil {
+		return nil
+	}
+	checkpoint, err := this.Checkpoints.Save(source, description, paths)
+	if err != nil {
+		return fmt.Errorf("Could not save a checkpoint before changing files: %w", err)
+	}
+	if len(checkpoint.Skipped) > 0 {
+		this.ErrorPrintf("Only files up to %dMB are checkpointed, undo can't restore %s\n",
+			checkpointMaxFileBytes>>20,
+			strings.Join(checkpoint.Skipped, ", "))
+	}
+	return nil
+}
+
+func (this *ButterfishCtx) undoCommand(options *CliCommandConfig) error {
+	undo := options.Undo
+	checkpoints, err := this.Checkpoints.List()
+	if err != nil {
+		return err
+	}
+	if len(checkpoints) == 0 {
+		return errors.New("No checkpoints to undo")
+	}
+
+	if undo.List {
+		for i, checkpoint := range checkpoints {
+			this.Printf("%d. %s\n", i+1, checkpoint)
+		}
+		return nil
+	}
+
+	if undo.Count < 1 {
+		return errors.New("Please give a number of changes to undo of at least 1")
+	}
+	count := min(undo.Count, len(checkpoints))
+	for _, checkpoint := range checkpoints[:count] {
+		err = this.Checkpoints.Restore(checkpoint)
+		if err != nil {
+			return fmt.Errorf("Error undoing %s: %w", checkpoint, err)
+		}
+		this.StylePrintf(this.Config.Styles.Grey, "Undid %s\n", checkpoint)
+	}
+	return nil
+}
+
+// Split a command line into simple commands at ;, &&, ||, and | and split
+// each into words, handling quotes and escapes. Output redirects become their
+// own word, e.g. "echo hi 2>>log" gives echo, hi, >>, log. This is only meant
+// for spotting the files a command writes, it doesn't handle expansions.
+func splitShellCommands(command string) [][]string {
+	commands := [][]string{}
+	words := []string{}
+	word := strings.Builder{}
+	inWord := false
+	quote := rune(0)
+
+	flush := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		flush()
+		if len(words) > 0 {
+			commands = append(commands, words)
+			words = []string{}
+		}
+	}
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' && i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\' && i+1 < len(runes):
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case unicode.IsSpace(r):
+			flush()
+		case r == '&' && i+1 < len(runes) && runes[i+1] == '>':
+			// &> redirects stdout and stderr, handled with the >
+		case r == ';' || r == '|' || r == '&':
+			endCommand()
+		case r == '>':
+			// a number right before the redirect is the file descriptor
+			if inWord && strings.Trim(word.String(), "0123456789") == "" {
+				word.Reset()
+				inWord = false
+			}
+			flush()
+			operator := ">"
+			for i+1 < len(runes) && (runes[i+1] == '>' || runes[i+1] == '|') {
+				i++
+				operator += string(runes[i])
+			}
+			if i+1 < len(runes) && runes[i+1] == '&' {
+				// duplicating a file descriptor like 2>&1, not a file
+				i++
+				for i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '-') {
+					i++
+				}
+				continue
+			}
+			words = append(words, operator)
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	endCommand()
+	return commands
+}
+
+// Commands that change the files given as arguments
+var fileWritingCommands = map[string]bool{
+	"rm":       true,
+	"truncate": true,
+	"tee":      true,
+	"touch":    true,
+}
+
+// Commands that write to their last argument
+var fileCopyingCommands = map[string]bool{
+	"cp": true,
+	"mv": true,
+}
+
+// Find the files a shell command will probably change, so goal mode can
+// checkpoint them. This is a best effort that understands redirects, in-place
+// edits with sed and perl, and a few common commands, anything else (e.g. a
+// script that writes files) isn't covered.
+func commandWriteTargets(command string) []string {
+	targets := []string{}
+	for _, words := range splitShellCommands(command) {
+		targets = append(targets, wordsWriteTargets(words)...)
+	}
+	return targets
+}
+
+func wordsWriteTargets(words []string) []string {
+	targets := []string{}
+	args := []string{}
+	for i := 0; i < len(words); i++ {
+		if strings.HasPrefix(words[i], ">") {
+			if i+1 < len(words) && words[i+1] != "/dev/null" {
+				targets = append(targets, words[i+1])
+			}
+			i++
+			continue
+		}
+		args = append(args, words[i])
+	}
+	if len(args) == 0 {
+		return targets
+	}
+
+	name := filepath.Base(args[0])
+	files := []string{}
+	inPlace := false
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "-") {
+			if strings.HasPrefix(arg, "-i") || arg == "--in-place" || (name == "perl" && strings.Contains(arg, "i")) {
+				inPlace = true
+			}
+			continue
+		}
+		files = append(files, arg)
+	}
+
+	switch {
+	case fileWritingCommands[name]:
+		targets = append(targets, files...)
+	case fileCopyingCommands[name] && len(files) > 1:
+		targets = append(targets, files[len(files)-1])
+		if name == "mv" {
+			targets = append(targets, files[:len(files)-1]...)
+		}
+	case (name == "sed" || name == "perl") && inPlace && len(files) > 1:
+		// the first argument is the script
+		targets = append(targets, files[1:]...)
+	}
+	return targets
+}
+
+// Checkpoint the files a goal mode command looks like it will change, once
+// the user has run it, we don't stop the command if this fails since it's a
+// best effort
+func (this *ShellState) CheckpointGoalCommand(command string) {
+	if this.RemoteHost != "" {
+		// the files are on the remote host
+		return
+	}
+
+	cwd := shellWorkingDir()
+	targets := commandWriteTargets(command)
+	for i, target := range targets {
+		if !filepath.IsAbs(target) {
+			targets[i] = filepath.Join(cwd, target)
+		}
+	}
+	err := this.Butterfish.Checkpoint("goal", command, targets...)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+}
+
+// Called when the user runs what's at the prompt, if it's a goal mode
+// command they've accepted it so it's checkpointed
+func (this *ShellState) checkpointAcceptedGoalCommand() {
+	command := this.goalModePendingCommand
+	this.goalModePendingCommand = ""
+	if command != "" && this.GoalMode {
+		this.CheckpointGoalCommand(command)
+	}
+}
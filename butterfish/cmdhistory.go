@@ -0,0 +1,335 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/drewlanenga/govector"
+	"github.com/mitchellh/go-homedir"
+)
+
+// When recording is on, the wrapped shell appends each command it runs to
+// this file, one JSON record per line, so that `butterfish history` can answer
+// questions like "what did I run to fix the build last week?"
+const defaultCommandHistoryPath = "~/.config/butterfish/command_history.jsonl"
+
+// A command run in the wrapped shell
+type CommandRecord struct {
+	Time        time.Time `json:"time"`
+	Command     string    `json:"command"`
+	ExitCode    int       `json:"exit_code"`
+	Cwd         string    `json:"cwd,omitempty"`
+	Host        string    `json:"host,omitempty"`
+	Description string    `json:"description,omitempty"`
+	// Embedding of the command and description, missing if embedding failed
+	Embedding []float32 `json:"embedding,omitempty"`
+}
+
+// The text we embed for a record
+func (this *CommandRecord) embeddingText() string {
+	return fmt.Sprintf("%s\n%s", this.Command, this.Description)
+}
+
+// CommandHistory is an append-only file of CommandRecords, appends are safe
+// across processes since each record is written with a single write
+type CommandHistory struct {
+	Path string
+	// If set, each record is encrypted and written as a line of base64
+	Cipher *util.Cipher
+	mutex  sync.Mutex
+}
+
+func NewCommandHistory(path string) (*CommandHistory, error) {
+	if path == "" {
+		path = defaultCommandHistoryPath
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	return &CommandHistory{Path: path}, nil
+}
+
+func (this *CommandHistory) Append(record *CommandRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if this.Cipher != nil {
+		data, err = this.Cipher.Encrypt(data)
+		if err != nil {
+			return err
+		}
+		data = []byte(base64.StdEncoding.EncodeToString(data))
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(this.Path), 0755)
+	if err != nil {
+		return err
+	}
+	// commands can contain secrets, so only the user can read the file
+	file, err := os.OpenFile(this.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Load all records, skipping lines that can't be parsed. Records written
+// before encryption was turned on are plain JSON lines.
+func (this *CommandHistory) Load() ([]*CommandRecord, error) {
+	file, err := os.Open(this.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []*CommandRecord{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) > 0 && line[0] != '{' {
+			data, err := base64.StdEncoding.DecodeString(string(line))
+			if err != nil {
+				continue
+			}
+			line, err = this.Cipher.Decrypt(data)
+			if err != nil {
+				return nil, fmt.Errorf("Error loading %s: %w", this.Path, err)
+			}
+		}
+
+		record := &CommandRecord{}
+		if json.Unmarshal(line, record) == nil {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// Describe and embed a command, then add it to the history. The description
+// is optional, e.g. the annotation shown in the shell.
+func (this *ButterfishCtx) RecordCommand(ctx context.Context, record *CommandRecord) error {
+	embeddings, err := this.LLMClient.Embeddings(&util.EmbeddingRequest{
+		Ctx:   ctx,
+		Input: []string{record.embeddingText()},
+	})
+	if err == nil && len(embeddings) == 1 {
+		record.Embedding = embeddings[0]
+	}
+	return this.CommandHistory.Append(record)
+}
+
+var (
+	relativeRangeRegex = regexp.MustCompile(`\b(?:last|past) (\d+) (hour|day|week|month)s?\b`)
+	agoRegex           = regexp.MustCompile(`\b(\d+) (hour|day|week|month)s? ago\b`)
+)
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// Weeks start on Monday
+func startOfWeek(t time.Time) time.Time {
+	day := startOfDay(t)
+	offset := (int(day.Weekday()) + 6) % 7
+	return day.AddDate(0, 0, -offset)
+}
+
+func addUnit(t time.Time, n int, unit string) time.Time {
+	switch unit {
+	case "hour":
+		return t.Add(time.Duration(n) * time.Hour)
+	case "day":
+		return t.AddDate(0, 0, n)
+	case "week":
+		return t.AddDate(0, 0, 7*n)
+	default:
+		return t.AddDate(0, n, 0)
+	}
+}
+
+// Find a time range in a question like "what did I run yesterday?", returns
+// false if the question doesn't mention one
+func parseTimeRange(question string, now time.Time) (time.Time, time.Time, bool) {
+	question = strings.ToLower(question)
+
+	if match := relativeRangeRegex.FindStringSubmatch(question); match != nil {
+		n, _ := strconv.Atoi(match[1])
+		return addUnit(now, -n, match[2]), now, true
+	}
+	if match := agoRegex.FindStringSubmatch(question); match != nil {
+		// a window of one unit around the time, e.g. 3 days ago is that day
+		n, _ := strconv.Atoi(match[1])
+		at := addUnit(now, -n, match[2])
+		if match[2] == "hour" {
+			return at.Add(-time.Hour), at.Add(time.Hour), true
+		}
+		start := startOfDay(at)
+		return start, addUnit(start, 1, "day"), true
+	}
+
+	today := startOfDay(now)
+	thisWeek := startOfWeek(now)
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	switch {
+	case strings.Contains(question, "today"):
+		return today, now, true
+	case strings.Contains(question, "yesterday"), strings.Contains(question, "last night"):
+		return today.AddDate(0, 0, -1), today, true
+	case strings.Contains(question, "last week"):
+		return thisWeek.AddDate(0, 0, -7), thisWeek, true
+	case strings.Contains(question, "this week"):
+		return thisWeek, now, true
+	case strings.Contains(question, "last month"):
+		return thisMonth.AddDate(0, -1, 0), thisMonth, true
+	case strings.Contains(question, "this month"):
+		return thisMonth, now, true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// Pick the records most relevant to a question. We filter by any time range
+// in the question, then rank by similarity to the question if we have an
+// embedding, otherwise we take the most recent. Results are in time order.
+func selectCommandRecords(records []*CommandRecord, question string, questionVector []float32,
+	now time.Time, maxResults int) []*CommandRecord {
+	start, end, hasRange := parseTimeRange(question, now)
+
+	type scored struct {
+		record *CommandRecord
+		score  float64
+	}
+	candidates := []scored{}
+	query, queryErr := govector.AsVector(questionVector)
+
+	for _, record := range records {
+		if hasRange && (record.Time.Before(start) || !record.Time.Before(end)) {
+			continue
+		}
+
+		// records without an embedding sort after those with one
+		score := -1.0
+		if questionVector != nil && queryErr == nil && len(record.Embedding) == len(questionVector) {
+			vector, err := govector.AsVector(record.Embedding)
+			if err == nil {
+				score, err = govector.Cosine(query, vector)
+				if err != nil {
+					score = -1
+				}
+			}
+		}
+		candidates = append(candidates, scored{record, score})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].record.Time.After(candidates[j].record.Time)
+	})
+	candidates = candidates[:util.Min(len(candidates), maxResults)]
+
+	selected := make([]*CommandRecord, len(candidates))
+	for i, candidate := range candidates {
+		selected[i] = candidate.record
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Time.Before(selected[j].Time)
+	})
+	return selected
+}
+
+func formatCommandRecords(records []*CommandRecord) string {
+	builder := strings.Builder{}
+	for _, record := range records {
+		fmt.Fprintf(&builder, "%s (exit %d) in %s: %s",
+			record.Time.Format("Mon 2006-01-02 15:04"), record.ExitCode, record.Cwd, record.Command)
+		if record.Host != "" {
+			fmt.Fprintf(&builder, " [host %s]", record.Host)
+		}
+		if record.Description != "" {
+			fmt.Fprintf(&builder, " # %s", record.Description)
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// Answer a question about past shell activity using the recorded commands
+func (this *ButterfishCtx) commandHistoryCommand(options *CliCommandConfig) error {
+	question := this.cleanInput(options.History.Question)
+	if question == "" {
+		return errors.New("Please ask a question about your command history")
+	}
+
+	records, err := this.CommandHistory.Load()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("No commands recorded in %s, run butterfish shell with --record-history to record them", this.CommandHistory.Path)
+	}
+
+	var questionVector []float32
+	embeddings, err := this.LLMClient.Embeddings(&util.EmbeddingRequest{
+		Ctx:   this.Ctx,
+		Input: []string{question},
+	})
+	if err == nil && len(embeddings) == 1 {
+		questionVector = embeddings[0]
+	}
+
+	now := time.Now()
+	selected := selectCommandRecords(records, question, questionVector, now, options.History.NumResults)
+	if len(selected) == 0 {
+		return errors.New("No recorded commands match that time range")
+	}
+	if this.Config.Verbose > 0 {
+		this.StylePrintf(this.Config.Styles.Grey, "%s", formatCommandRecords(selected))
+	}
+
+	promptStr, err := this.GetPrompt(prompt.PromptCommandHistoryQuestion,
+		"now", now.Format("Mon 2006-01-02 15:04"),
+		"commands", formatCommandRecords(selected),
+		"question", question)
+	if err != nil {
+		return err
+	}
+
+	commandConfig := &promptCommand{
+		Prompt:      promptStr,
+		Model:       options.History.Model,
+		NumTokens:   1024,
+		Temperature: 0.3,
+		Verbose:     this.Config.Verbose,
+	}
+	_, err = this.Prompt(commandConfig)
+	return err
+}
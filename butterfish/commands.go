@@ -1,6 +1,7 @@
 package butterfish
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
@@ -8,9 +9,11 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/charmbracelet/lipgloss"
@@ -20,6 +23,7 @@ import (
 	"github.com/spf13/afero"
 	"golang.org/x/term"
 
+	"github.com/bakks/butterfish/embedding"
 	"github.com/bakks/butterfish/prompt"
 	"github.com/bakks/butterfish/util"
 )
@@ -54,14 +58,26 @@ func (this *ButterfishCtx) ParseCommand(cmd string) (*kong.Context, *CliCommandC
 // Kong CLI parser option configuration
 type CliCommandConfig struct {
 	Prompt struct {
-		Prompt        []string `arg:"" help:"LLM model prompt, e.g. 'what is the unix shell?'" optional:""`
-		SystemMessage string   `short:"s" default:"" help:"System message to send to model as instructions, e.g. 'respond succinctly'."`
-		Model         string   `short:"m" default:"gpt-4-turbo" help:"LLM to use for the prompt."`
-		NumTokens     int      `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
-		Temperature   float32  `short:"T" default:"0.7" help:"Temperature to use for the prompt, higher temperature indicates more freedom/randomness when generating each token."`
-		Functions     string   `short:"f" default:"" help:"Path to json file with functions to use for prompt."`
-		NoColor       bool     `default:"false" help:"Disable color output."`
-		NoBackticks   bool     `default:"false" help:"Strip out backticks around codeblocks."`
+		Prompt        []string       `arg:"" help:"LLM model prompt, e.g. 'what is the unix shell?', - is replaced with stdin." optional:""`
+		SystemMessage string         `short:"s" default:"" help:"System message to send to model as instructions, e.g. 'respond succinctly'."`
+		Model         string         `short:"m" default:"gpt-4-turbo" help:"LLM to use for the prompt."`
+		NumTokens     int            `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
+		Temperature   float32        `short:"T" default:"0.7" help:"Temperature to use for the prompt, higher temperature indicates more freedom/randomness when generating each token."`
+		TopP          float32        `default:"0" help:"Nucleus sampling, only sample from the most likely tokens that add up to this probability, e.g. 0.9. 0 leaves it to the provider."`
+		Stop          []string       `sep:"none" help:"Stop the response at this sequence, can be given up to 4 times."`
+		LogitBias     map[string]int `mapsep:"none" placeholder:"TEXT=BIAS" help:"Bias from -100 (never) to 100 (always) for text or a token id, e.g. 'Sure=-100', can be given more than once. Text is biased by its tokens, which are only known for OpenAI models."`
+		Functions     string         `short:"f" default:"" help:"Path to json file with functions to use for prompt."`
+		Schema        string         `default:"" help:"Path to a JSON schema file, the response will be JSON matching the schema. Uses structured output where the model supports it, otherwise the response is validated and retried."`
+		NoColor       bool           `default:"false" help:"Disable color output."`
+		NoBackticks   bool           `default:"false" help:"Strip out backticks around codeblocks."`
+		Out           string         `short:"o" aliases:"tee" default:"" help:"Also write the response to this file as it streams in, without styling."`
+		Models        []string       `help:"Compare models, query each of these in parallel and show the answers side by side, e.g. gpt-4o,claude-sonnet."`
+		Sequential    bool           `default:"false" help:"With --models, show the answers one after another rather than side by side."`
+		Verify        bool           `default:"false" help:"Have a second model check the answer for made up commands and flags before it's shown, its critique is shown if it isn't confident. The model is set in the verify section of the config file."`
+		ContextFile   []string       `sep:"none" placeholder:"PATH" help:"Add the contents of this file to the prompt as context, can be given more than once, e.g. /dev/fd/3."`
+		ContextFd     []int          `placeholder:"FD" help:"Add what's read from this file descriptor to the prompt as context, e.g. 3 with 3<notes.txt."`
+		Image         []string       `sep:"none" placeholder:"PATH" help:"Attach this image to the prompt, can be given more than once, e.g. a screenshot of an error. The model needs vision, e.g. gpt-4o."`
+		Mic           bool           `default:"false" help:"Speak the prompt, recording from the microphone until you press Enter. The transcript is added after any prompt text. Transcribes with the Whisper API unless speech.transcribe_command is set in the config file."`
 	} `cmd:"" help:"Run an LLM prompt without wrapping, stream results back. This is a straight-through call to the LLM from the command line with a given prompt. This accepts piped input, if there is both piped input and a prompt then they will be concatenated together (prompt first). It is recommended that you wrap the prompt with quotes. The default GPT model is gpt-4-turbo."`
 
 	Promptedit struct {
@@ -78,55 +94,261 @@ type CliCommandConfig struct {
 		Model       string  `short:"m" default:"gpt-4-turbo" help:"LLM to use for the prompt."`
 		NumTokens   int     `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
 		Temperature float32 `short:"T" default:"0.7" help:"Temperature to use for the prompt, higher temperature indicates more freedom/randomness when generating each token."`
-		InPlace     bool    `short:"i" default:"false" help:"Edit the file in-place, otherwise we write to stdout."`
+		InPlace     bool    `short:"i" default:"false" help:"Edit the file in-place, otherwise we write to stdout. Changes are shown as a diff and you can accept or reject each hunk."`
+		Yes         bool    `short:"y" default:"false" help:"When editing in-place, apply all changes without asking about each hunk."`
+		NoBackup    bool    `default:"false" help:"When editing in-place, don't keep a copy of the original file at <filepath>.bak."`
+		Diff        bool    `short:"d" default:"false" help:"Write the changes to stdout as a unified diff rather than writing the whole edited file."`
 		NoColor     bool    `default:"false" help:"Disable color output."`
 		NoBackticks bool    `default:"false" help:"Strip out backticks around codeblocks."`
-	} `cmd:"" help:"Edit a file by using a line range editing tool."`
+	} `cmd:"" help:"Edit a file by using a line range editing tool. The changes are printed as a unified diff, with -i you can review each hunk and the accepted hunks are written to the file."`
 
 	Summarize struct {
-		Files     []string `arg:"" help:"File paths to summarize." optional:""`
-		ChunkSize int      `short:"c" default:"3600" help:"Number of bytes to summarize at a time if the file must be split up."`
-		MaxChunks int      `short:"C" default:"8" help:"Maximum number of chunks to summarize from a specific file."`
+		Files       []string `arg:"" help:"File paths to summarize." optional:""`
+		ChunkSize   int      `short:"c" default:"3600" help:"Number of bytes to summarize at a time if the file must be split up."`
+		MaxChunks   int      `short:"C" default:"8" help:"Maximum number of chunks to summarize from a specific file."`
+		Temperature float32  `short:"T" default:"0.7" help:"Temperature to use for the summary."`
+		TopP        float32  `default:"0" help:"Nucleus sampling, e.g. 0.9. 0 leaves it to the provider."`
+		MaxTokens   int      `short:"n" default:"1024" help:"Maximum number of tokens in each summary."`
+		Out         string   `short:"o" aliases:"tee" default:"" help:"Also write the summary to this file as it streams in, without styling."`
+		Format      string   `default:"text" enum:"text,github" help:"Output format, text or github. github prints each file's summary as a GitHub Actions notice annotation on the file."`
 	} `cmd:"" help:"Semantically summarize a list of files (or piped input). We read in the file, if it is short then we hand it directly to the LLM and ask for a summary. If it is longer then we break it into chunks and ask for a list of facts from each chunk (max 8 chunks), then concatenate facts and ask GPT for an overall summary."`
 
 	Gencmd struct {
-		Prompt []string `arg:"" help:"Prompt describing the desired shell command."`
-		Force  bool     `short:"f" default:"false" help:"Execute the command without prompting."`
+		Prompt         []string       `arg:"" help:"Prompt describing the desired shell command."`
+		Force          bool           `short:"f" default:"false" help:"Execute the command without prompting."`
+		Explain        bool           `short:"e" default:"false" help:"Explain the command in one sentence and say whether it's read-only or mutating, then offer to run it. Always on if explain_before_execute is set in the config file."`
+		ProjectContext bool           `default:"false" help:"Include excerpts of project files like the Makefile or package.json that are related to the prompt, so the command uses the project's own scripts. Files are found with the embeddings index, so the project needs to be indexed with 'butterfish index'."`
+		NoToolCheck    bool           `default:"false" help:"Don't check that the programs the command runs are installed. By default, if they aren't, an alternative with installed tools is generated, or an install command is offered."`
+		Temperature    float32        `short:"T" default:"0.6" help:"Temperature to use when generating the command, 0 gives the most predictable commands."`
+		TopP           float32        `default:"0" help:"Nucleus sampling, e.g. 0.9. 0 leaves it to the provider."`
+		MaxTokens      int            `short:"n" default:"512" help:"Maximum number of tokens in the generated command."`
+		Stop           []string       `sep:"none" help:"Stop the response at this sequence, can be given up to 4 times."`
+		LogitBias      map[string]int `mapsep:"none" placeholder:"TEXT=BIAS" help:"Bias from -100 (never) to 100 (always) for text or a token id, can be given more than once. A bias of -100 for three backticks keeps markdown fences out of the command."`
+		Verify         bool           `default:"false" help:"Have a second model check the command for made up programs and flags before it's shown, its critique is shown if it isn't confident, and -f asks before running."`
+		Refine         bool           `short:"r" default:"false" help:"After the command is generated, reply with changes like 'use rsync instead' to revise it, press enter to keep it."`
 	} `cmd:"" help:"Generate a shell command from a prompt, i.e. pass in what you want, a shell command will be generated. Accepts piped input. You can use the -f command to execute it sight-unseen."`
 
 	Exec struct {
-		Command []string `arg:"" help:"Command to execute." optional:""`
+		Command      []string      `arg:"" help:"Command to execute." optional:""`
+		Timeout      time.Duration `default:"0s" help:"Kill the command if it runs longer than this, e.g. 30s, and ask for a fix. 0 means no timeout."`
+		Retries      int           `default:"0" help:"Run a failing command again up to this many times before asking for a fix, for flaky commands."`
+		Capture      string        `enum:"tail,head,sample,all" default:"tail" help:"Which lines of the output to send to the LLM when asking for a fix: the last or first --capture-lines lines, a sample from the start, middle, and end, or all of it."`
+		CaptureLines int           `default:"200" help:"Number of output lines to send to the LLM."`
 	} `cmd:"" help:"Execute a command and try to debug problems. The command can either passed in or in the command register (if you have run gencmd in Console Mode)."`
 
+	Commit struct {
+		Model         string `short:"m" default:"gpt-4o" help:"LLM to use to write the message."`
+		Editor        string `short:"e" default:"" help:"Editor to use to edit the message, defaults to the EDITOR env var."`
+		NoEdit        bool   `default:"false" help:"Don't open the generated message in an editor."`
+		Run           bool   `short:"r" default:"false" help:"Run git commit with the message, otherwise the message is printed."`
+		MaxDiffTokens int    `default:"8000" help:"Truncate the staged diff to this many tokens before sending it to the LLM."`
+	} `cmd:"" help:"Write a commit message for the staged changes (git diff --cached). The message is generated from the commit_message prompt in the prompt library, which you can customize, and opened in your editor. Use -r to run git commit with the result."`
+
+	Gitsummary struct {
+		Range     string `arg:"" help:"Git range to summarize, e.g. main..HEAD or a single base ref to compare with HEAD. Defaults to the default branch." optional:""`
+		Model     string `short:"m" default:"gpt-4o" help:"LLM to use for the summary."`
+		ChunkSize int    `short:"c" default:"6000" help:"Number of tokens of diff to summarize at a time if the diff must be split up."`
+		MaxChunks int    `short:"C" default:"16" help:"Maximum number of diff chunks to summarize."`
+	} `cmd:"" help:"Summarize the commits and diff in a git range into a pull request description. If the diff is large we summarize it in chunks and then combine the chunk summaries."`
+
+	Explain struct {
+		Command []string `arg:"" passthrough:"" help:"Command to explain, e.g. 'tar -xzvf foo.tar.gz'. It is recommended that you wrap the command with quotes."`
+		Model   string   `short:"m" default:"gpt-4o" help:"LLM to use for the explanation."`
+	} `cmd:"" help:"Explain a shell command. We pull the command's man page or --help output from the local machine and include the parts relevant to the flags used, so the explanation matches the version installed."`
+
+	Tokens struct {
+		Model string `short:"m" default:"gpt-4o" help:"Model whose tokenizer to use."`
+	} `cmd:"" help:"Count the tokens in piped input using the model's tokenizer, e.g. 'cat file.go | butterfish tokens'. OpenAI models use their tiktoken encoding, for other providers the count is estimated from the number of characters."`
+
+	Models struct {
+		Refresh bool `short:"r" default:"false" help:"Fetch the provider's model list now rather than using the cached one."`
+	} `cmd:"" help:"List the models the provider offers and what each can do: context size, vision, tools, JSON mode, and embedding dimensions. The list is fetched from the provider's models API and cached in ~/.config/butterfish/models.json for a day, models the provider doesn't describe use butterfish's built in table."`
+
+	Prompts struct {
+		Bench struct {
+			VariantA    string  `arg:"" completion:"prompts" help:"First prompt variant, either the name of a prompt in the prompt library or a file containing a prompt template."`
+			VariantB    string  `arg:"" completion:"prompts" help:"Second prompt variant."`
+			Inputs      string  `short:"i" required:"" help:"YAML file of recorded inputs, a list of cases each with a name and a map of fields to interpolate into the variants."`
+			Model       string  `short:"m" default:"gpt-4o" help:"LLM to run the variants with."`
+			NumTokens   int     `short:"n" default:"1024" help:"Maximum number of tokens to generate for each output."`
+			Temperature float32 `short:"T" default:"0.7" help:"Temperature to use for each output."`
+			Judge       bool    `short:"j" default:"false" help:"Score each pair of outputs with an LLM judge."`
+			JudgeModel  string  `default:"gpt-4o" help:"LLM to use as the judge."`
+			Output      string  `short:"o" default:"" help:"Write the outputs and scores to this file as JSON."`
+		} `cmd:"" help:"Run two prompt variants against a set of recorded inputs and print the outputs side by side, to help tune a custom prompt library. With -j an LLM judge scores each pair of outputs and the scores are summarized at the end."`
+
+		Sync struct {
+			URL    string `default:"" help:"Git URL of the prompt repo, overrides prompt_sync url in the config file."`
+			Branch string `short:"b" default:"" help:"Branch to sync, by default the repo's default branch."`
+			Path   string `short:"p" default:"" help:"YAML file or directory of YAML files in the repo to load prompts from, by default the repo root."`
+		} `cmd:"" help:"Fetch a git repo of team prompts (YAML in the same format as prompts.yaml) and merge them into the local prompt library. Prompts you've customized, i.e. with OkToReplace set to false, are kept. Synced prompts are updated by later syncs, to keep a local change to one clear its Source."`
+
+		Stats struct {
+			Sort string `short:"s" default:"uses" enum:"uses,last-used,tokens" help:"Sort by uses, last-used, or tokens (average response tokens), most first."`
+		} `cmd:"" help:"Show how many times each prompt in the library was used, when it was last used, and the average number of tokens in its responses, to find prompts that are never used or that are expensive. Usage is kept in a file next to the prompt library, e.g. ~/.config/butterfish/prompts_usage.json."`
+	} `cmd:"" help:"Tools for working with the prompt library."`
+
+	Transcript struct {
+		Export struct {
+			Session string `short:"s" default:"~/.config/butterfish/last_session.json" help:"Saved session to export."`
+			Output  string `short:"o" default:"" help:"File to write the transcript to, by default it's printed."`
+			Format  string `short:"f" default:"" enum:",markdown,html" help:"Transcript format, markdown or html. By default this is picked from the output file extension, or markdown."`
+		} `cmd:"" help:"Export the last wrapped shell session (commands, output, and LLM exchanges) to markdown or HTML. The session is saved when butterfish shell exits, inside a running shell use !export instead."`
+	} `cmd:"" help:"Work with transcripts of butterfish shell sessions."`
+
+	History struct {
+		Question   []string `arg:"" help:"Question about commands you've run, e.g. 'what did I run to fix the docker build last week?'"`
+		Model      string   `short:"m" default:"gpt-4o" help:"LLM to use to answer the question."`
+		NumResults int      `short:"n" default:"30" help:"Maximum number of recorded commands to pass to the LLM."`
+	} `cmd:"" help:"Ask a question about your past shell activity. This searches the commands recorded by butterfish shell --record-history, filtering by time ranges in the question like 'yesterday' or 'last week' and ranking by similarity to the question."`
+
+	Stats struct {
+		Days int `short:"d" default:"30" help:"Number of days to report on, including today."`
+	} `cmd:"" help:"Report on how you use butterfish: goal mode commands generated vs accepted, autosuggest acceptance rate, tokens and estimated cost per day per model, and LLM latency percentiles. This is computed from a log kept in ~/.config/butterfish/stats.jsonl, which only holds counts and timings and is never uploaded."`
+
+	Batch struct {
+		PromptName  string  `short:"p" required:"" completion:"prompts" help:"Prompt to run, either the name of a prompt in the prompt library or a file containing a prompt template. The template must use {content}, which is the content of each input file, and may use {path}, its path."`
+		InputGlob   string  `short:"i" required:"" help:"Glob of input files, e.g. 'logs/*.txt', quoted so the shell doesn't expand it."`
+		Out         string  `short:"o" required:"" help:"Directory to write outputs to, each output is the input's path under the glob's directory plus .out."`
+		Concurrency int     `short:"c" default:"4" help:"Number of inputs to run at once."`
+		Model       string  `short:"m" default:"gpt-4o" help:"LLM to run the prompt with."`
+		NumTokens   int     `short:"n" default:"1024" help:"Maximum number of tokens to generate for each output."`
+		Temperature float32 `short:"T" default:"0.7" help:"Temperature to use for each output."`
+	} `cmd:"" help:"Run a prompt against many files in parallel, e.g. butterfish batch -p summarize -i 'logs/*.txt' -o results/. Progress is saved in the output directory, so if the batch is interrupted or some inputs fail, running it again only sends the unfinished inputs. If a rate limit is configured, batch requests wait behind interactive ones."`
+
+	Tasks struct {
+		Dir string `arg:"" optional:"" help:"Directory to look in, defaults to the current directory."`
+	} `cmd:"" help:"List the tasks defined in the Makefile, package.json scripts, and justfile of a directory, with the command that runs each. The same list is given to the model in shell mode when a prompt mentions building, testing, or the like, and in goal mode."`
+
+	Undo struct {
+		Count int  `arg:"" optional:"" default:"1" help:"Number of changes to undo, most recent first."`
+		List  bool `default:"false" help:"List the changes that can be undone rather than undoing them."`
+	} `cmd:"" help:"Undo changes butterfish made to files. Before edit, review, refactor, generate, or a goal mode command changes files, the originals are saved to ~/.config/butterfish/checkpoints, this restores them. This works without git and keeps the last 50 changes."`
+
+	Refactor struct {
+		Instruction []string `arg:"" help:"The refactor to make, e.g. 'rename the Config type to Settings'."`
+		Files       []string `short:"f" help:"Files to include in the refactor, in addition to relevant files found in the embeddings index."`
+		MaxFiles    int      `short:"k" default:"8" help:"Maximum number of files to consider."`
+		Model       string   `short:"m" default:"gpt-4o" help:"LLM to use for planning and editing."`
+		NumTokens   int      `short:"n" default:"8192" help:"Maximum number of tokens for each edited file."`
+		Yes         bool     `short:"y" default:"false" help:"Apply the plan and all changes without asking."`
+		RevertPatch string   `short:"r" default:"" help:"Where to write the patch that undoes the refactor, by default butterfish-revert-<time>.patch in the current directory."`
+	} `cmd:"" help:"Refactor across several files. Relevant files are found with the embeddings index (run butterfish index first) or given with -f, the LLM proposes a plan for which files to change, and once you approve it each file is edited and you can accept or reject each change. A patch to undo the refactor is written before any files are changed, apply it with git apply."`
+
+	Review struct {
+		Script    string `arg:"" help:"Path to the shell script to review."`
+		Model     string `short:"m" default:"gpt-4o" help:"LLM to use for the review."`
+		NumTokens int    `short:"n" default:"4096" help:"Maximum number of tokens to generate, this needs room for the corrected script."`
+		InPlace   bool   `short:"i" default:"false" help:"Apply the corrections to the script, you can accept or reject each hunk."`
+		Yes       bool   `short:"y" default:"false" help:"When applying corrections, apply all of them without asking about each hunk."`
+		NoBackup  bool   `default:"false" help:"When applying corrections, don't keep a copy of the original script at <script>.bak."`
+		Format    string `default:"text" enum:"text,github" help:"Output format, text or github. github prints each issue as a GitHub Actions annotation on the script, e.g. ::error file=deploy.sh,line=12::..., for review steps in a workflow."`
+	} `cmd:"" help:"Review a shell script for bugs, portability, and safety issues. The script is checked with shellcheck if it's installed, then the LLM lists the issues in order of priority and shows a corrected version as a diff."`
+
+	Generate struct {
+		Instructions []string `arg:"" help:"What to generate, e.g. 'a http handler for creating users with tests'."`
+		Template     string   `short:"t" default:"generate_file" help:"Prompt library template, or a file containing a template. Templates can use the fields {instructions}, {output}, {context}, and {existing}."`
+		Out          string   `short:"o" required:"" help:"File to write, or a directory (ending with /) to write several files into."`
+		Model        string   `short:"m" default:"gpt-4o" help:"LLM to use for generation."`
+		NumTokens    int      `short:"n" default:"4096" help:"Maximum number of tokens to generate."`
+		NumSnippets  int      `short:"k" default:"5" help:"Number of snippets from the embeddings index of the current directory to include as project context, 0 to disable."`
+		Yes          bool     `short:"y" default:"false" help:"Write the files without asking for confirmation."`
+	} `cmd:"" help:"Scaffold files from a prompt library template, your instructions, and project context from the embeddings index. The generated files are previewed and only written once you confirm."`
+
+	Schedule struct {
+		Description []string `arg:"" help:"What to run and when, e.g. 'backup ~/photos nightly at 2am'."`
+		Systemd     bool     `short:"s" default:"false" help:"Generate a systemd timer and service rather than a crontab entry."`
+		Name        string   `default:"" help:"Name of the systemd units, by default one is generated from the description."`
+		Model       string   `short:"m" default:"gpt-4o" help:"LLM to use."`
+		Install     bool     `short:"i" default:"false" help:"Install the job after confirming: add it to your crontab, or write the units to ~/.config/systemd/user and start the timer."`
+		Yes         bool     `short:"y" default:"false" help:"With --install, install without asking."`
+	} `cmd:"" help:"Generate a crontab entry or a systemd timer for a job described in plain words. The schedule is validated and shown, and with --install it's installed once you confirm."`
+
+	Rx struct {
+		Description []string `arg:"" help:"What the expression should match or extract, e.g. 'the status code and path of each request'."`
+		Kind        string   `short:"k" enum:"regex,jq,awk" default:"regex" help:"Build a regex, a jq filter, or an awk program."`
+		Sample      string   `short:"s" default:"" help:"File of sample input to run the expression on, by default stdin."`
+		Expect      string   `short:"e" default:"" help:"File with the output the expression should produce, attempts continue until it matches rather than asking you."`
+		Model       string   `short:"m" default:"gpt-4o" help:"LLM to use."`
+		MaxAttempts int      `short:"a" default:"5" help:"Maximum number of expressions to try."`
+	} `cmd:"" help:"Build a regex, jq filter, or awk program from a description and run it on sample input right away. Say what's wrong with the output to get a new attempt, or give the expected output with --expect to iterate until it matches."`
+
+	Sql struct {
+		Request []string `arg:"" help:"The query you want in plain words, e.g. 'customers who ordered twice last month'."`
+		Dsn     string   `short:"d" default:"" help:"Database to read the schema from and run the query on, e.g. postgres://localhost/shop, mysql://user@localhost/shop, or a sqlite file."`
+		Schema  string   `short:"s" default:"" help:"File of DDL describing the schema, instead of reading it from --dsn."`
+		Dialect string   `default:"" help:"SQL dialect of the schema, e.g. postgres, mysql, or sqlite. By default it comes from the DSN."`
+		Refresh bool     `default:"false" help:"Read the schema from --dsn again rather than using the cached one."`
+		Run     bool     `short:"r" default:"false" help:"Run the query on --dsn in a read-only session and show the results."`
+		Model   string   `short:"m" default:"gpt-4o" help:"LLM to use."`
+	} `cmd:"" help:"Write a SQL query for a request in plain words against your schema, read from a database with --dsn or a DDL file with --schema. The schema is cached for the project so later queries don't need it again. With --run the query is run read-only and the results are shown."`
+
+	Watch struct {
+		Target         []string `arg:"" help:"Log file to tail, or a command whose output to watch, e.g. 'docker logs -f api'."`
+		Model          string   `short:"m" default:"gpt-4o" help:"LLM to explain anomalies the triage model flags."`
+		TriageModel    string   `short:"t" default:"gpt-4o-mini" help:"Cheap LLM that decides whether an anomaly is worth explaining."`
+		NumTokens      int      `short:"n" default:"512" help:"Maximum number of tokens in an explanation."`
+		BurstThreshold int      `short:"b" default:"5" help:"Number of error lines within a couple of seconds that counts as a burst."`
+		Echo           bool     `short:"e" default:"false" help:"Print the watched lines as well as explanations."`
+	} `cmd:"" help:"Tail a log file or a command's output and explain problems as they happen. Error bursts and stack traces are checked by a cheap triage model, and only those it flags are explained by the main model, so you only hear about noteworthy events."`
+
 	Index struct {
-		Paths     []string `arg:"" help:"Paths to index." optional:""`
-		Force     bool     `short:"f" default:"false" help:"Force re-indexing of files rather than skipping cached embeddings."`
-		ChunkSize int      `short:"c" default:"512" help:"Number of bytes to embed at a time when the file is split up."`
-		MaxChunks int      `short:"C" default:"256" help:"Maximum number of chunks to embed from a specific file."`
-	} `cmd:"" help:"Recursively index the current directory using embeddings. This will read each file, split it into chunks, embed the chunks, and write a .butterfish_index file to each directory caching the embeddings. If you re-run this it will skip over previously embedded files unless you force a re-index. This implements an exponential backoff if you hit OpenAI API rate limits."`
+		Files struct {
+			Paths []string `arg:"" help:"Paths to index." optional:""`
+		} `cmd:"" default:"withargs" help:"Recursively index the current directory using embeddings. This will read each file, split it into chunks, embed the chunks, and write a .butterfish_index file to each directory caching the embeddings. If you re-run this it will skip over previously embedded files unless you force a re-index. This implements an exponential backoff if you hit OpenAI API rate limits. This is the default, i.e. 'butterfish index .' is the same as 'butterfish index files .'."`
+		AddURL struct {
+			URLs []string `arg:"" name:"url" help:"URLs of the pages to add."`
+			Dir  string   `short:"d" default:"." help:"Directory whose index the pages are added to."`
+		} `cmd:"" name:"add-url" help:"Download web pages, e.g. the docs of a library you use, and add them to the index of a directory. The page text is cleaned, chunked, and embedded, and stored in the index with its URL, which search results cite in place of a file path. Adding a page again fetches it again."`
+		Export struct {
+			File string `arg:"" help:"Archive to write, e.g. index.tar.zst."`
+			Dir  string `short:"d" default:"." help:"Directory whose index files are exported, recursively."`
+		} `cmd:"" help:"Export the index files under a directory to a zstd compressed tar, e.g. to build the index of a big repo in CI and share it with your team. The archive also holds a hash of each indexed file, so importing it can tell which files match."`
+		Import struct {
+			File string `arg:"" help:"Archive written by index export."`
+			Dir  string `short:"d" default:"." help:"Directory to import the index files into, e.g. the root of your checkout."`
+		} `cmd:"" help:"Import index files exported with index export, replacing the index files there. Files that match the exported ones are marked as indexed, others are embedded again by the next index. Encrypted indexes need the same key to import."`
+		Force          bool   `short:"f" default:"false" help:"Force re-indexing of files rather than skipping cached embeddings."`
+		ChunkSize      int    `short:"c" default:"512" help:"Number of bytes to embed at a time when the file is split up."`
+		MaxChunks      int    `short:"C" default:"256" help:"Maximum number of chunks to embed from a specific file."`
+		EmbeddingModel string `default:"text-embedding-ada-002" help:"Model to embed files with, recorded in the index and used to embed search queries. Directories embedded with another model are re-indexed."`
+		Dimensions     int    `default:"0" help:"Length of the embedding vectors, for models that support shortening them, e.g. text-embedding-3-small. 0 uses the model's default."`
+		Precision      string `help:"Precision to store embeddings at, float32, float16, or int8. float16 and int8 shrink the index about 2x and 4x on disk and in memory, with slightly less accurate search. Existing embeddings are converted without re-embedding. Defaults to the precision each directory was indexed at, or float32."`
+		ANN            bool   `default:"false" help:"Build an approximate nearest neighbor (HNSW) graph for directories with 1000 or more chunks, so searches over large indexes take milliseconds. Smaller directories are searched exactly. Once built, graphs are kept up to date on re-index."`
+	} `cmd:"" help:"Index files and web pages using embeddings."`
 
 	Clearindex struct {
-		Paths []string `arg:"" help:"Paths to clear from the index." optional:""`
+		Paths []string `arg:"" completion:"indexed" help:"Paths to clear from the index." optional:""`
 	} `cmd:"" help:"Clear paths from the index, both from the in-memory index (if in Console Mode) and to delete .butterfish_index files. Defaults to loading from the current directory but allows you to pass in paths to load."`
 
+	Indexgc struct {
+		Paths []string `arg:"" completion:"indexed" help:"Paths to garbage collect." optional:""`
+	} `cmd:"" help:"Garbage collect the .butterfish_index files in a path, removing embeddings of files that were deleted and duplicate chunks, and rewriting the index files. Reports the disk space reclaimed. Defaults to the current directory."`
+
 	Loadindex struct {
-		Paths []string `arg:"" help:"Paths to load into the index." optional:""`
+		Paths []string `arg:"" completion:"indexed" help:"Paths to load into the index." optional:""`
 	} `cmd:"" help:"Load paths into the index. This is specifically for Console Mode when you want to load a set of cached indexes into memory. Defaults to loading from the current directory but allows you to pass in paths to load."`
 
 	Showindex struct {
-		Paths []string `arg:"" help:"Paths to show from the index." optional:""`
+		Paths []string `arg:"" completion:"indexed" help:"Paths to show from the index." optional:""`
 	} `cmd:"" help:"Show which files are present in the loaded index. You can pass in a path but it defaults to the current directory."`
 
 	Indexsearch struct {
-		Query   string `arg:"" help:"Query to search for."`
-		Results int    `short:"r" default:"5" help:"Number of results to return."`
+		Query   string   `arg:"" help:"Query to search for."`
+		Results int      `short:"r" default:"5" help:"Number of results to return."`
+		Tag     []string `help:"Only search files with this tag, from the frontmatter of markdown files. Can be given more than once, files must have all the tags."`
+		Filter  string   `help:"Only search files that match all of these comma-separated conditions: ext=go|ts for the file extension, path~internal/ for a path substring or glob like path~*_test.go, mtime>7d or mtime<2024-01-31 for the modification time, and tag=runbook."`
 	} `cmd:"" help:"Search embedding index and return relevant file snippets. This uses the embedding API to embed the search string, then does a brute-force cosine similarity against every indexed chunk of text, returning those chunks and their scores."`
 
 	Indexquestion struct {
-		Question    string  `arg:"" help:"Question to ask."`
-		Model       string  `short:"m" default:"gpt-4-turbo" help:"GPT model to use for the prompt."`
-		NumTokens   int     `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
-		Temperature float32 `short:"T" default:"0.7" help:"Temperature to use for the prompt."`
+		Question    string   `arg:"" help:"Question to ask."`
+		Model       string   `short:"m" default:"gpt-4-turbo" help:"GPT model to use for the prompt."`
+		NumTokens   int      `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
+		Temperature float32  `short:"T" default:"0.7" help:"Temperature to use for the prompt."`
+		Results     int      `short:"r" default:"3" help:"Number of snippets to fetch from the index."`
+		Compress    int      `default:"0" placeholder:"TOKENS" help:"Compress the snippets to about this many tokens, keeping their most informative sentences, to cut the cost of questions over many snippets. 0 uses compression.snippet_tokens from the config file, which is off by default."`
+		Tag         []string `help:"Only use snippets from files with this tag, from the frontmatter of markdown files. Can be given more than once, files must have all the tags."`
+		Filter      string   `help:"Only use snippets from files that match all of these comma-separated conditions: ext=go|ts for the file extension, path~internal/ for a path substring or glob like path~*_test.go, mtime>7d or mtime<2024-01-31 for the modification time, and tag=runbook."`
 	} `cmd:"" help:"Ask a question using the embeddings index. This fetches text snippets from the index and passes them to the LLM to generate an answer, thus you need to run the index command first."`
 }
 
@@ -251,6 +473,20 @@ func ApplyEditToolToLineBuffer(toolCall *util.ToolCall, lineBuffer *LineBuffer)
 	return nil
 }
 
+// The index search filter for the --filter and --tag flags, nil if neither
+// is set
+func searchFilter(expr string, tags []string) (*embedding.SearchFilter, error) {
+	if expr == "" && len(tags) == 0 {
+		return nil, nil
+	}
+	filter, err := embedding.ParseSearchFilter(expr, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	filter.Tags = append(filter.Tags, tags...)
+	return filter, nil
+}
+
 // A function to handle a cmd string when received from consoleCommand channel
 func (this *ButterfishCtx) ExecCommand(
 	parsed *kong.Context,
@@ -271,24 +507,35 @@ func (this *ButterfishCtx) ExecCommand(
 		// The prompt command accepts both stdin and a prompt string, but needs at
 		// least one of them. If we have both then we concatenate them with prompt
 		// first.
-		promptArr := options.Prompt.Prompt
-		prompt := ""
-		if promptArr != nil && len(promptArr) > 0 {
-			prompt = strings.Join(promptArr, " ")
+		// An argument of - is replaced with stdin, see plumbing.go.
+		input, err := promptInput(options.Prompt.Prompt, this.getPipedStdinReader())
+		if err != nil {
+			return err
 		}
-		piped := this.getPipedStdin()
-
-		var input string
-
-		if piped == "" && prompt == "" {
+		if options.Prompt.Mic {
+			transcript, err := this.micPrompt()
+			if err != nil {
+				return err
+			}
+			input = strings.TrimSpace(input + "\n" + transcript)
+		}
+		if strings.TrimSpace(input) == "" {
 			return errors.New("Please provide a prompt")
-		} else if piped == "" {
-			input = prompt
-		} else if prompt == "" {
-			input = piped
-		} else {
-			input = fmt.Sprintf("%s\n%s", prompt, piped)
 		}
+		promptContext, err := readPromptContext(options.Prompt.ContextFile, options.Prompt.ContextFd)
+		if err != nil {
+			return err
+		}
+		input = promptContext + input
+
+		if err := validateStopAndBias(options.Prompt.Stop, options.Prompt.LogitBias); err != nil {
+			return err
+		}
+		closeOut, err := this.openTee(options.Prompt.Out)
+		if err != nil {
+			return err
+		}
+		defer closeOut()
 
 		commandConfig := &promptCommand{
 			Prompt:      input,
@@ -296,13 +543,22 @@ func (this *ButterfishCtx) ExecCommand(
 			Model:       options.Prompt.Model,
 			NumTokens:   options.Prompt.NumTokens,
 			Temperature: options.Prompt.Temperature,
+			TopP:        options.Prompt.TopP,
+			Stop:        options.Prompt.Stop,
+			LogitBias:   options.Prompt.LogitBias,
 			Functions:   options.Prompt.Functions,
+			Schema:      options.Prompt.Schema,
+			Images:      options.Prompt.Image,
 			NoColor:     options.Prompt.NoColor,
 			NoBackticks: options.Prompt.NoBackticks,
+			Verify:      options.Prompt.Verify || this.Config.Verify.EnabledFor("prompt"),
 			Verbose:     this.Config.Verbose,
 		}
 
-		_, err := this.Prompt(commandConfig)
+		if len(options.Prompt.Models) > 0 {
+			return this.comparePrompt(commandConfig, options.Prompt.Models, options.Prompt.Sequential)
+		}
+		_, err = this.Prompt(commandConfig)
 		return err
 
 	case "promptedit":
@@ -314,28 +570,7 @@ func (this *ButterfishCtx) ExecCommand(
 			return err
 		}
 
-		// get EDITOR env var if not specified
-		if editor == "" {
-			editor = os.Getenv("EDITOR")
-		}
-		if editor == "" {
-			editor = "vi"
-			if this.Config.Verbose > 0 {
-				this.StylePrintf(this.Config.Styles.Grey, "Defaulting to %s for editor, you can set this with --editor or the EDITOR env var\n", editor)
-			}
-		}
-
-		if this.Config.Verbose > 0 {
-			this.StylePrintf(this.Config.Styles.Grey, "%s %s\n", editor, targetFile)
-		}
-
-		cmd := exec.Command(editor, targetFile)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Env = os.Environ()
-
-		err = cmd.Run()
+		err = this.editFile(editor, targetFile)
 		if err != nil {
 			return err
 		}
@@ -377,17 +612,44 @@ func (this *ButterfishCtx) ExecCommand(
 		if err != nil {
 			return err
 		}
+		original := append([]string{}, lineBuffer.Lines...)
 
 		err = this.EditLineBuffer(lineBuffer, prompt, options)
 		if err != nil {
 			return err
 		}
 
+		hunks := DiffHunks(original, lineBuffer.Lines, 3)
+
 		if options.Edit.InPlace {
-			err = os.WriteFile(filepath, []byte(lineBuffer.String()), 0644)
+			if len(hunks) == 0 {
+				this.StylePrintf(this.Config.Styles.Grey, "No changes to %s\n", filepath)
+				return nil
+			}
+
+			if !options.Edit.Yes {
+				if err := this.requireInteractive("Apply this hunk?"); err != nil {
+					return err
+				}
+				hunks = this.ReviewHunks(hunks, bufio.NewReader(os.Stdin))
+				if len(hunks) == 0 {
+					this.StylePrintf(this.Config.Styles.Grey, "No changes applied\n")
+					return nil
+				}
+			}
+
+			err = this.Checkpoint("edit", prompt, filepath)
 			if err != nil {
 				return err
 			}
+			content := strings.Join(ApplyHunks(original, hunks), "\n")
+			err = writeFileWithBackup(filepath, []byte(content), !options.Edit.NoBackup)
+			if err != nil {
+				return err
+			}
+			this.StylePrintf(this.Config.Styles.Grey, "Applied %d hunk(s) to %s\n", len(hunks), filepath)
+		} else if options.Edit.Diff {
+			fmt.Fprint(this.Out, UnifiedDiff(options.Edit.Filepath, hunks))
 		} else {
 			fmt.Fprintf(this.Out, "%s\n", lineBuffer.String())
 		}
@@ -395,6 +657,15 @@ func (this *ButterfishCtx) ExecCommand(
 		return nil
 
 	case "summarize":
+		this.Config.SummarizeTemperature = options.Summarize.Temperature
+		this.Config.SummarizeTopP = options.Summarize.TopP
+		this.Config.SummarizeMaxTokens = options.Summarize.MaxTokens
+		closeOut, err := this.openTee(options.Summarize.Out)
+		if err != nil {
+			return err
+		}
+		defer closeOut()
+
 		chunks, err := util.GetChunks(
 			os.Stdin,
 			options.Summarize.ChunkSize,
@@ -408,15 +679,31 @@ func (this *ButterfishCtx) ExecCommand(
 			return errors.New("No input to summarize")
 		}
 
+		if options.Summarize.Format == FormatGitHub {
+			return this.summarizeAnnotation("", chunks)
+		}
 		return this.SummarizeChunks(chunks)
 
 	case "summarize <files>":
+		this.Config.SummarizeTemperature = options.Summarize.Temperature
+		this.Config.SummarizeTopP = options.Summarize.TopP
+		this.Config.SummarizeMaxTokens = options.Summarize.MaxTokens
 		files := options.Summarize.Files
 		if len(files) == 0 {
 			return errors.New("Please provide file paths or piped data to summarize")
 		}
+		closeOut, err := this.openTee(options.Summarize.Out)
+		if err != nil {
+			return err
+		}
+		defer closeOut()
 
-		err := this.SummarizePaths(files,
+		if options.Summarize.Format == FormatGitHub {
+			return this.summarizePathAnnotations(files,
+				options.Summarize.ChunkSize,
+				options.Summarize.MaxChunks)
+		}
+		err = this.SummarizePaths(files,
 			options.Summarize.ChunkSize,
 			options.Summarize.MaxChunks)
 		return err
@@ -426,8 +713,21 @@ func (this *ButterfishCtx) ExecCommand(
 		if input == "" {
 			return errors.New("Please provide a description to generate a command")
 		}
+		this.Config.GencmdTemperature = options.Gencmd.Temperature
+		this.Config.GencmdTopP = options.Gencmd.TopP
+		this.Config.GencmdMaxTokens = options.Gencmd.MaxTokens
+		if len(options.Gencmd.Stop) > 0 {
+			this.Config.GencmdStop = options.Gencmd.Stop
+		}
+		if len(options.Gencmd.LogitBias) > 0 {
+			this.Config.GencmdLogitBias = options.Gencmd.LogitBias
+		}
+		err := validateStopAndBias(this.Config.GencmdStop, this.Config.GencmdLogitBias)
+		if err != nil {
+			return err
+		}
 
-		cmd, err := this.gencmdCommand(input)
+		cmd, err := this.gencmdCommand(input, options.Gencmd.ProjectContext)
 		if err != nil {
 			return err
 		}
@@ -435,6 +735,46 @@ func (this *ButterfishCtx) ExecCommand(
 		// trim whitespace
 		cmd = strings.TrimSpace(cmd)
 
+		if options.Gencmd.Refine {
+			if err := this.requireInteractive("Change (enter to keep):"); err != nil {
+				return err
+			}
+			cmd, err = this.refineCommand(input, cmd, bufio.NewReader(os.Stdin))
+			if err != nil {
+				return err
+			}
+		}
+
+		if !options.Gencmd.NoToolCheck {
+			cmd, err = this.ensureRunnableCommand(input, cmd, options.Gencmd.Force)
+			if err != nil {
+				return err
+			}
+		}
+
+		force := options.Gencmd.Force
+		if options.Gencmd.Verify || this.Config.Verify.EnabledFor("gencmd") {
+			critique := this.answerCritique(input, cmd)
+			if critique != "" {
+				this.StylePrintf(this.Config.Styles.Error, "%s\n", critique)
+				// don't run a doubtful command sight-unseen
+				force = false
+			}
+		}
+
+		if options.Gencmd.Explain || this.Config.ExplainBeforeExecute {
+			return this.explainAndOfferCommand(cmd, force)
+		}
+
+		if force != options.Gencmd.Force {
+			ok, err := this.confirm(fmt.Sprintf("Run %s?", cmd))
+			if err != nil || !ok {
+				return err
+			}
+			_, err = this.execCommand(cmd)
+			return err
+		}
+
 		if !options.Gencmd.Force {
 			this.StylePrintf(this.Config.Styles.Highlight, "%s\n", cmd)
 		} else {
@@ -445,6 +785,98 @@ func (this *ButterfishCtx) ExecCommand(
 		}
 		return nil
 
+	case "commit":
+		return this.commitCommand(options)
+
+	case "gitsummary", "gitsummary <range>":
+		return this.gitSummaryCommand(options)
+
+	case "explain <command>":
+		input := this.cleanInput(options.Explain.Command)
+		if input == "" {
+			return errors.New("Please provide a command to explain")
+		}
+
+		promptStr, err := this.explainPrompt(this.Ctx, input)
+		if err != nil {
+			return err
+		}
+
+		commandConfig := &promptCommand{
+			Prompt:      promptStr,
+			Model:       options.Explain.Model,
+			NumTokens:   1024,
+			Temperature: 0.3,
+			Verbose:     this.Config.Verbose,
+		}
+
+		_, err = this.Prompt(commandConfig)
+		return err
+
+	case "tokens":
+		input := this.getPipedStdin()
+		if input == "" {
+			return errors.New("Please pipe in the text to count tokens for")
+		}
+
+		tokenizer := TokenizerForModel(options.Tokens.Model)
+		if this.Config.Verbose > 0 {
+			this.StylePrintf(this.Config.Styles.Grey, "Tokenizer: %s\n", tokenizer.Name())
+		}
+		this.Printf("%d\n", tokenizer.CountTokens(input))
+		return nil
+
+	case "prompts bench <variant-a> <variant-b>":
+		return this.promptsBenchCommand(options)
+
+	case "prompts sync":
+		return this.promptsSyncCommand(options)
+
+	case "prompts stats":
+		return this.promptsStatsCommand(options)
+
+	case "batch":
+		return this.batchCommand(options)
+
+	case "tasks", "tasks <dir>":
+		return this.tasksCommand(options)
+
+	case "stats":
+		return this.statsCommand(options)
+
+	case "models":
+		return this.modelsCommand(options)
+
+	case "undo", "undo <count>":
+		return this.undoCommand(options)
+
+	case "refactor <instruction>":
+		return this.refactorCommand(options)
+
+	case "review <script>":
+		return this.reviewCommand(options)
+
+	case "generate <instructions>":
+		return this.generateCommand(options)
+
+	case "schedule <description>":
+		return this.scheduleCommand(options)
+
+	case "rx <description>":
+		return this.rxCommand(options)
+
+	case "sql <request>":
+		return this.sqlCommand(options)
+
+	case "watch <target>":
+		return this.watchCommand(options)
+
+	case "history <question>":
+		return this.commandHistoryCommand(options)
+
+	case "transcript export":
+		return this.transcriptExportCommand(options)
+
 	case "exec", "exec <command>":
 		input := this.cleanInput(options.Exec.Command)
 		if input == "" {
@@ -455,7 +887,14 @@ func (this *ButterfishCtx) ExecCommand(
 			return errors.New("No command to execute")
 		}
 
-		return this.execAndCheck(this.Ctx, input)
+		return this.execAndCheck(this.Ctx, input, execOptions{
+			Timeout: options.Exec.Timeout,
+			Retries: options.Exec.Retries,
+			Capture: outputCapture{
+				Mode:  options.Exec.Capture,
+				Lines: options.Exec.CaptureLines,
+			},
+		})
 
 	case "clearindex", "clearindex <paths>":
 		this.initVectorIndex(nil)
@@ -468,8 +907,29 @@ func (this *ButterfishCtx) ExecCommand(
 		this.VectorIndex.ClearPaths(this.Ctx, paths)
 		return nil
 
+	case "indexgc", "indexgc <paths>":
+		paths := options.Indexgc.Paths
+		if len(paths) == 0 {
+			paths = []string{"."}
+		}
+		this.initVectorIndex(paths)
+
+		stats, err := this.VectorIndex.CompactPaths(this.Ctx, paths)
+		if err != nil {
+			return err
+		}
+
+		this.Printf("Removed %d deleted files, %d chunks, and %d empty index files\n",
+			stats.FilesRemoved, stats.ChunksRemoved, stats.IndexesRemoved)
+		this.StylePrintf(this.Config.Styles.Highlight, "Reclaimed %d bytes (%d -> %d)\n",
+			stats.BytesReclaimed(), stats.BytesBefore, stats.BytesAfter)
+		return nil
+
 	case "showindex", "showindex <paths>":
 		paths := options.Showindex.Paths
+		if len(paths) == 0 {
+			paths = []string{"."}
+		}
 		this.initVectorIndex(paths)
 
 		indexedPaths := this.VectorIndex.IndexedFiles()
@@ -494,14 +954,23 @@ func (this *ButterfishCtx) ExecCommand(
 		}
 		this.Printf("Loaded %d files\n", len(this.VectorIndex.IndexedFiles()))
 
-	case "index", "index <paths>":
-		paths := options.Index.Paths
+	case "index files", "index files <paths>":
+		paths := options.Index.Files.Paths
 		if len(paths) == 0 {
 			paths = []string{"."}
 		}
 
 		this.Printf("Indexing %s\n", strings.Join(paths, ", "))
 		this.initVectorIndex(paths)
+		if err := checkEmbeddingDims(options.Index.EmbeddingModel, options.Index.Dimensions); err != nil {
+			return err
+		}
+		this.VectorIndex.SetEmbeddingModel(options.Index.EmbeddingModel, options.Index.Dimensions)
+		if options.Index.Precision != "" && !embedding.ValidPrecision(options.Index.Precision) {
+			return fmt.Errorf("Unknown precision %s, use float32, float16, or int8", options.Index.Precision)
+		}
+		this.VectorIndex.SetPrecision(options.Index.Precision)
+		this.VectorIndex.SetANN(options.Index.ANN)
 
 		err := this.VectorIndex.LoadPaths(this.Ctx, paths)
 		if err != nil {
@@ -522,6 +991,39 @@ func (this *ButterfishCtx) ExecCommand(
 		this.Printf("Done, %d files now loaded in the index\n", len(this.VectorIndex.IndexedFiles()))
 		return nil
 
+	case "index add-url <url>":
+		this.initVectorIndex(nil)
+		if err := checkEmbeddingDims(options.Index.EmbeddingModel, options.Index.Dimensions); err != nil {
+			return err
+		}
+		this.VectorIndex.SetEmbeddingModel(options.Index.EmbeddingModel, options.Index.Dimensions)
+		if options.Index.Precision != "" && !embedding.ValidPrecision(options.Index.Precision) {
+			return fmt.Errorf("Unknown precision %s, use float32, float16, or int8", options.Index.Precision)
+		}
+		this.VectorIndex.SetPrecision(options.Index.Precision)
+		this.VectorIndex.SetANN(options.Index.ANN)
+
+		for _, url := range options.Index.AddURL.URLs {
+			this.Printf("Fetching %s\n", url)
+			doc, err := this.VectorIndex.IndexURL(this.Ctx, options.Index.AddURL.Dir, url,
+				options.Index.ChunkSize, options.Index.MaxChunks)
+			if err != nil {
+				return err
+			}
+			if doc.Title != "" {
+				this.Printf("Added %s (%s)\n", url, doc.Title)
+			} else {
+				this.Printf("Added %s\n", url)
+			}
+		}
+		return nil
+
+	case "index export <file>":
+		return this.exportIndex(options.Index.Export.File, options.Index.Export.Dir)
+
+	case "index import <file>":
+		return this.importIndex(options.Index.Import.File, options.Index.Import.Dir)
+
 	case "indexsearch <query>":
 		this.initVectorIndex(nil)
 
@@ -530,6 +1032,11 @@ func (this *ButterfishCtx) ExecCommand(
 			return errors.New("Please provide search parameters")
 		}
 		numResults := options.Indexsearch.Results
+		filter, err := searchFilter(options.Indexsearch.Filter, options.Indexsearch.Tag)
+		if err != nil {
+			return err
+		}
+		this.VectorIndex.SetFilter(filter)
 
 		results, err := this.VectorIndex.Search(this.Ctx, input, numResults)
 		if err != nil {
@@ -537,7 +1044,7 @@ func (this *ButterfishCtx) ExecCommand(
 		}
 
 		for _, result := range results {
-			this.StylePrintf(this.Config.Styles.Highlight, "%s : %0.4f\n", result.FilePath, result.Score)
+			this.StylePrintf(this.Config.Styles.Highlight, "%s : %0.4f\n", result.Citation(), result.Score)
 			this.Printf("%s\n", result.Content)
 		}
 
@@ -551,8 +1058,13 @@ func (this *ButterfishCtx) ExecCommand(
 		if this.VectorIndex == nil {
 			return errors.New("No vector index loaded")
 		}
+		filter, err := searchFilter(options.Indexquestion.Filter, options.Indexquestion.Tag)
+		if err != nil {
+			return err
+		}
+		this.VectorIndex.SetFilter(filter)
 
-		results, err := this.VectorIndex.Search(this.Ctx, input, 3)
+		results, err := this.VectorIndex.Search(this.Ctx, input, options.Indexquestion.Results)
 		if err != nil {
 			return err
 		}
@@ -561,10 +1073,11 @@ func (this *ButterfishCtx) ExecCommand(
 		for _, result := range results {
 			samples = append(samples, result.Content)
 		}
+		samples = this.compressSnippets(samples, input, options.Indexquestion.Model, options.Indexquestion.Compress)
 
 		exerpts := strings.Join(samples, "\n---\n")
 
-		prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptQuestion,
+		promptStr, err := this.GetPrompt(prompt.PromptQuestion,
 			"snippets", exerpts,
 			"question", input)
 		if err != nil {
@@ -573,11 +1086,13 @@ func (this *ButterfishCtx) ExecCommand(
 
 		req := &util.CompletionRequest{
 			Ctx:           this.Ctx,
-			Prompt:        prompt,
+			Prompt:        promptStr,
 			Model:         options.Indexquestion.Model,
 			MaxTokens:     options.Indexquestion.NumTokens,
 			Temperature:   options.Indexquestion.Temperature,
 			SystemMessage: "N/A",
+			Task:          TaskIndexQuestion,
+			PromptName:    prompt.PromptQuestion,
 		}
 
 		_, err = this.LLMClient.CompletionStream(req, this.Out)
@@ -603,9 +1118,15 @@ type promptCommand struct {
 	Model       string
 	NumTokens   int
 	Temperature float32
+	TopP        float32
+	Stop        []string
+	LogitBias   map[string]int
 	Functions   string
+	Schema      string
+	Images      []string // paths of images to attach
 	NoColor     bool
 	NoBackticks bool
+	Verify      bool // check the answer with a second model, see verify.go
 	Verbose     int
 	History     []util.HistoryBlock
 	Tools       []util.ToolDefinition
@@ -614,7 +1135,8 @@ type promptCommand struct {
 func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse, error) {
 	writer := this.Out
 
-	if !cmd.NoColor {
+	// schema responses are printed plain so they can be parsed
+	if !cmd.NoColor && !this.Config.Headless && cmd.Schema == "" {
 		color := styleToEscape(this.Config.Styles.Answer.GetForeground())
 		highlight := styleToEscape(this.Config.Styles.Highlight.GetForeground())
 		this.Out.Write([]byte(color))
@@ -626,7 +1148,9 @@ func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse,
 			if !this.Config.ColorDark {
 				colorScheme = "monokailight"
 			}
-			writer = util.NewStyleCodeblocksWriter(this.Out, termWidth, color, highlight, colorScheme)
+			styleWriter := util.NewStyleCodeblocksWriter(this.Out, termWidth, color, highlight, colorScheme)
+			styleWriter.SetPlain(this.Config.PlainOutput)
+			writer = styleWriter
 		}
 	} else if cmd.NoBackticks {
 		// this is an else because the code blocks writer will strip out backticks
@@ -635,13 +1159,54 @@ func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse,
 		writer = util.NewStripbackticksWriter(this.Out)
 	}
 
+	req, err := this.promptRequest(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd.Schema != "" {
+		schema, err := LoadResponseSchema(cmd.Schema)
+		if err != nil {
+			return nil, err
+		}
+		return this.schemaPrompt(req, schema)
+	}
+
+	if cmd.Verify {
+		return this.verifiedPrompt(req, writer)
+	}
+
+	return this.LLMClient.CompletionStream(req, this.teeWriter(writer))
+}
+
+// Get the whole answer and verify it before printing, since a streamed
+// answer would be shown before it's checked
+func (this *ButterfishCtx) verifiedPrompt(req *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	response, err := this.LLMClient.Completion(req)
+	if err != nil {
+		return nil, err
+	}
+	critique := this.answerCritique(req.Prompt, response.Completion)
+
+	fmt.Fprintf(this.teeWriter(writer), "%s\n", strings.TrimRight(response.Completion, "\n"))
+	if critique != "" {
+		this.StylePrintf(this.Config.Styles.Error, "%s\n", critique)
+	}
+	return response, nil
+}
+
+// The request for a prompt command, with the default system message and the
+// functions file loaded
+func (this *ButterfishCtx) promptRequest(cmd *promptCommand) (*util.CompletionRequest, error) {
 	sysMsg := cmd.SysMsg
+	sysPromptName := ""
 	if sysMsg == "" {
 		var err error
-		sysMsg, err = this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+		sysMsg, err = this.GetSystemMessage(prompt.PromptSystemMessage)
 		if err != nil {
 			return nil, err
 		}
+		sysPromptName = prompt.PromptSystemMessage
 	}
 
 	var functions []util.FunctionDefinition
@@ -660,22 +1225,45 @@ func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse,
 			return nil, err
 		}
 	}
+	if len(functions) > 0 || len(cmd.Tools) > 0 {
+		if err := checkToolsModel(cmd.Model); err != nil {
+			return nil, err
+		}
+	}
 
-	req := &util.CompletionRequest{
-		Ctx:           this.Ctx,
-		Prompt:        cmd.Prompt,
-		Model:         cmd.Model,
-		MaxTokens:     cmd.NumTokens,
-		Temperature:   cmd.Temperature,
-		SystemMessage: sysMsg,
-		Verbose:       cmd.Verbose > 0,
-		Functions:     functions,
-		Tools:         cmd.Tools,
-		HistoryBlocks: cmd.History,
-		TokenTimeout:  this.Config.TokenTimeout,
+	var images []string
+	if len(cmd.Images) > 0 {
+		if err := checkVisionModel(cmd.Model); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range cmd.Images {
+		image, err := imageDataURL(path)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
 	}
 
-	return this.LLMClient.CompletionStream(req, writer)
+	req := &util.CompletionRequest{
+		Ctx:              this.Ctx,
+		Prompt:           cmd.Prompt,
+		Model:            cmd.Model,
+		MaxTokens:        cmd.NumTokens,
+		Temperature:      requestTemperature(cmd.Temperature),
+		TopP:             cmd.TopP,
+		Stop:             cmd.Stop,
+		LogitBias:        cmd.LogitBias,
+		SystemMessage:    sysMsg,
+		SystemPromptName: sysPromptName,
+		Verbose:          cmd.Verbose > 0,
+		Functions:        functions,
+		Tools:            cmd.Tools,
+		Images:           images,
+		HistoryBlocks:    cmd.History,
+		TokenTimeout:     this.Config.TokenTimeout,
+	}
+	return req, nil
 }
 
 var EditSysMsg = `You're helping an expert programmer edit a file of code. You can either respond with questions and clarifications, or you can use the edit() tool, which replaces a range from the file with new code. In some cases you may want to call edit() multiple times, I will apply the edits and give you the updated file after every call. Use the most recent file for your edits. If there are no more edits, just say "DONE!"`
@@ -778,6 +1366,100 @@ func (this *ButterfishCtx) EditLineBuffer(lineBuffer *LineBuffer, prompt string,
 	return nil
 }
 
+// Print a diff hunk with removed lines in red and added lines in green
+func (this *ButterfishCtx) PrintHunk(hunk *DiffHunk) {
+	this.StylePrintf(this.Config.Styles.Highlight, "%s\n", hunk.Header())
+	for _, line := range hunk.Lines {
+		style := this.Config.Styles.Foreground
+		switch line[0] {
+		case '-':
+			style = this.Config.Styles.Error
+		case '+':
+			style = this.Config.Styles.Go
+		}
+		this.StylePrintf(style, "%s\n", line)
+	}
+}
+
+// Show each hunk and ask the user whether to apply it, similar to
+// git add -p. Returns the accepted hunks.
+func (this *ButterfishCtx) ReviewHunks(hunks []*DiffHunk, input *bufio.Reader) []*DiffHunk {
+	accepted := []*DiffHunk{}
+
+	for i, hunk := range hunks {
+		this.PrintHunk(hunk)
+
+		for {
+			this.StylePrintf(this.Config.Styles.Question,
+				"Apply this hunk (%d/%d) [y,n,a,q,?]? ", i+1, len(hunks))
+			answer, err := input.ReadString('\n')
+			if err != nil {
+				// no more input, reject the remaining hunks
+				fmt.Fprintf(this.Out, "\n")
+				return accepted
+			}
+
+			switch strings.TrimSpace(strings.ToLower(answer)) {
+			case "y", "yes":
+				accepted = append(accepted, hunk)
+			case "n", "no":
+			case "a":
+				return append(accepted, hunks[i:]...)
+			case "q":
+				return accepted
+			default:
+				this.StylePrintf(this.Config.Styles.Grey,
+					"y - apply this hunk\nn - skip this hunk\na - apply this and all remaining hunks\nq - skip this and all remaining hunks\n")
+				continue
+			}
+			break
+		}
+	}
+
+	return accepted
+}
+
+// Write a file by writing to a temporary file in the same directory and
+// renaming it over the original, so that the file is never partially
+// written. If backup is set the original is first copied to path.bak.
+func writeFileWithBackup(path string, content []byte, backup bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if backup {
+		original, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(path+".bak", original, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(content)
+	if err == nil {
+		err = temp.Chmod(info.Mode().Perm())
+	}
+	closeErr := temp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
 func (this *ButterfishCtx) diffStrings(a, b string) string {
 	dmp := diffmatchpatch.New()
 	diffs := dmp.DiffMain(a, b, false)
@@ -797,26 +1479,253 @@ func (this *ButterfishCtx) diffStrings(a, b string) string {
 	return strBuilder.String()
 }
 
+// Open a file in the given editor, or the EDITOR env var, and wait for the
+// editor to exit
+func (this *ButterfishCtx) editFile(editor, path string) error {
+	if err := this.requireInteractive("Edit " + path); err != nil {
+		return err
+	}
+	// get EDITOR env var if not specified
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if this.Config.Verbose > 0 {
+			this.StylePrintf(this.Config.Styles.Grey, "Defaulting to %s for editor, you can set this with --editor or the EDITOR env var\n", editor)
+		}
+	}
+
+	if this.Config.Verbose > 0 {
+		this.StylePrintf(this.Config.Styles.Grey, "%s %s\n", editor, path)
+	}
+
+	cmd := exec.Command(editor, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+
+	return cmd.Run()
+}
+
+// Generate a commit message for the staged diff, let the user edit it, and
+// optionally commit
+func (this *ButterfishCtx) commitCommand(options *CliCommandConfig) error {
+	diff, err := gitOutput(this.Ctx, "diff", "--cached")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(diff) == "" {
+		return errors.New("No staged changes, stage files with git add first")
+	}
+	diff = truncateDiff(diff, TokenizerForModel(options.Commit.Model), options.Commit.MaxDiffTokens)
+
+	promptStr, err := this.GetPrompt(prompt.PromptCommitMessage, "diff", diff)
+	if err != nil {
+		return err
+	}
+
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return err
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:              this.Ctx,
+		Prompt:           promptStr,
+		Model:            options.Commit.Model,
+		MaxTokens:        512,
+		Temperature:      0.3,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.PromptSystemMessage,
+		Verbose:          this.Config.Verbose > 0,
+		Task:             TaskCommit,
+		PromptName:       prompt.PromptCommitMessage,
+		TokenTimeout:     this.Config.TokenTimeout,
+	}
+
+	resp, err := this.LLMClient.Completion(req)
+	if err != nil {
+		return err
+	}
+	message := cleanCommitMessage(resp.Completion)
+
+	// write the message to a file so it can be edited and passed to git
+	messageFile, err := os.CreateTemp("", "butterfish_commit_*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(messageFile.Name())
+
+	_, err = fmt.Fprintf(messageFile, "%s\n\n# Edit the generated commit message above, lines starting with # are\n# ignored. An empty message aborts.\n", message)
+	messageFile.Close()
+	if err != nil {
+		return err
+	}
+
+	if !options.Commit.NoEdit && !this.Config.Headless && term.IsTerminal(int(os.Stdin.Fd())) {
+		err = this.editFile(options.Commit.Editor, messageFile.Name())
+		if err != nil {
+			return err
+		}
+
+		content, err := os.ReadFile(messageFile.Name())
+		if err != nil {
+			return err
+		}
+		message = cleanCommitMessage(string(content))
+	}
+
+	if message == "" {
+		return errors.New("Empty commit message, aborting")
+	}
+
+	if !options.Commit.Run {
+		fmt.Fprintf(this.Out, "%s\n", message)
+		return nil
+	}
+
+	err = os.WriteFile(messageFile.Name(), []byte(message+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(this.Ctx, "git", "commit", "-F", messageFile.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = this.Out
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Summarize a git range into a pull request description. Large diffs are
+// summarized in chunks first, then the chunk summaries are combined.
+func (this *ButterfishCtx) gitSummaryCommand(options *CliCommandConfig) error {
+	logRange, diffRange, err := gitSummaryRange(this.Ctx, options.Gitsummary.Range)
+	if err != nil {
+		return err
+	}
+
+	commits, err := gitOutput(this.Ctx, "log", "--no-merges", "--format=%h %s%n%b", logRange)
+	if err != nil {
+		return err
+	}
+	diff, err := gitOutput(this.Ctx, "diff", diffRange)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(commits) == "" && strings.TrimSpace(diff) == "" {
+		return fmt.Errorf("No changes found in %s", logRange)
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:           this.Ctx,
+		Model:         options.Gitsummary.Model,
+		MaxTokens:     this.Config.SummarizeMaxTokens,
+		Temperature:   requestTemperature(this.Config.SummarizeTemperature),
+		TopP:          this.Config.SummarizeTopP,
+		Stop:          this.Config.SummarizeStop,
+		LogitBias:     this.Config.SummarizeLogitBias,
+		SystemMessage: "N/A",
+		Task:          TaskSummarize,
+		Verbose:       this.Config.Verbose > 0,
+		TokenTimeout:  this.Config.TokenTimeout,
+	}
+
+	changes := diff
+	chunks := chunkDiff(diff, TokenizerForModel(options.Gitsummary.Model), options.Gitsummary.ChunkSize)
+	if len(chunks) > 1 {
+		// the diff doesn't fit in one prompt, summarize each chunk and use the
+		// summaries as the changes
+		if len(chunks) > options.Gitsummary.MaxChunks {
+			this.StylePrintf(this.Config.Styles.Grey,
+				"Diff has %d chunks, only summarizing the first %d\n",
+				len(chunks), options.Gitsummary.MaxChunks)
+			chunks = chunks[:options.Gitsummary.MaxChunks]
+		}
+
+		summaries := strings.Builder{}
+		for i, chunk := range chunks {
+			if this.Config.Verbose > 0 {
+				this.StylePrintf(this.Config.Styles.Grey, "Summarizing diff chunk %d/%d\n", i+1, len(chunks))
+			}
+
+			promptStr, err := this.GetPrompt(prompt.PromptGitSummaryDiffChunk,
+				"diff", chunk)
+			if err != nil {
+				return err
+			}
+			req.Prompt = promptStr
+			req.PromptName = prompt.PromptGitSummaryDiffChunk
+			resp, err := this.LLMClient.Completion(req)
+			if err != nil {
+				return err
+			}
+			summaries.WriteString(resp.Completion)
+			summaries.WriteString("\n")
+		}
+		changes = summaries.String()
+	}
+
+	promptStr, err := this.GetPrompt(prompt.PromptGitSummary,
+		"commits", commits, "changes", changes)
+	if err != nil {
+		return err
+	}
+	req.Prompt = promptStr
+	req.PromptName = prompt.PromptGitSummary
+
+	writer := util.NewStyledWriter(this.Out, this.Config.Styles.Foreground)
+	_, err = this.LLMClient.CompletionStream(req, writer)
+	fmt.Fprintf(this.Out, "\n")
+	return err
+}
+
 // Given a description of functionality, we call GPT to generate a shell
 // command
-func (this *ButterfishCtx) gencmdCommand(description string) (string, error) {
-	promptStr, err := this.PromptLibrary.GetPrompt("generate_command", "content", description)
+func (this *ButterfishCtx) gencmdCommand(description string, projectContext bool) (string, error) {
+	promptStr, err := this.GetPrompt(prompt.PromptGenerateCommand, "content", description)
 	if err != nil {
 		return "", err
 	}
 
-	sysMsg, err := this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
 	if err != nil {
 		return "", err
 	}
+	tasks, err := DiscoverTasks(".")
+	if err == nil && len(tasks) > 0 {
+		sysMsg += "\n\nTasks defined by the project in the current directory, prefer these where they fit:\n" + formatTasks(tasks)
+	}
+	if projectContext {
+		dir, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		excerpts, err := this.projectContext(this.Ctx, dir, description)
+		if err != nil {
+			return "", err
+		}
+		if excerpts == "" {
+			this.StylePrintf(this.Config.Styles.Grey, "No index found for this project, run 'butterfish index' to use project context\n")
+		}
+		sysMsg += excerpts
+	}
+
 	req := &util.CompletionRequest{
-		Ctx:           this.Ctx,
-		Prompt:        promptStr,
-		Model:         this.Config.GencmdModel,
-		MaxTokens:     this.Config.GencmdMaxTokens,
-		Temperature:   this.Config.GencmdTemperature,
-		SystemMessage: sysMsg,
-		TokenTimeout:  this.Config.TokenTimeout,
+		Ctx:              this.Ctx,
+		Prompt:           promptStr,
+		Model:            this.Config.GencmdModel,
+		MaxTokens:        this.Config.GencmdMaxTokens,
+		Temperature:      requestTemperature(this.Config.GencmdTemperature),
+		TopP:             this.Config.GencmdTopP,
+		Stop:             this.Config.GencmdStop,
+		LogitBias:        this.Config.GencmdLogitBias,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.PromptSystemMessage,
+		Task:             TaskGencmd,
+		PromptName:       prompt.PromptGenerateCommand,
+		TokenTimeout:     this.Config.TokenTimeout,
 	}
 
 	resp, err := this.LLMClient.Completion(req)
@@ -857,9 +1766,9 @@ func fixCommandParse(s string) (string, error) {
 
 // Execute a command in a loop, if the exit status is non-zero then we call
 // GPT to give us a fixed command and ask the user if they want to run it
-func (this *ButterfishCtx) execAndCheck(ctx context.Context, cmd string) error {
+func (this *ButterfishCtx) execAndCheck(ctx context.Context, cmd string, options execOptions) error {
 	for {
-		result, err := this.execCommand(cmd)
+		result, err := this.execWithRetries(cmd, options)
 		if err != nil {
 			return err
 		}
@@ -868,12 +1777,16 @@ func (this *ButterfishCtx) execAndCheck(ctx context.Context, cmd string) error {
 			return nil
 		}
 
-		this.ErrorPrintf("Command failed with status %d, requesting fix...\n", result.Status)
+		this.ErrorPrintf("%s, requesting fix...\n", result.Failure(options.Timeout))
 
-		prompt, err := this.PromptLibrary.GetPrompt("fix_command",
+		status := fmt.Sprintf("%d", result.Status)
+		if result.TimedOut {
+			status += fmt.Sprintf(" (it timed out after %s and was killed)", options.Timeout)
+		}
+		fixPrompt, err := this.GetPrompt(prompt.PromptFixCommand,
 			"command", cmd,
-			"status", fmt.Sprintf("%d", result.Status),
-			"output", string(result.LastOutput))
+			"status", status,
+			"output", options.Capture.Apply(string(result.LastOutput)))
 		if err != nil {
 			return err
 		}
@@ -882,11 +1795,12 @@ func (this *ButterfishCtx) execAndCheck(ctx context.Context, cmd string) error {
 
 		req := &util.CompletionRequest{
 			Ctx:           this.Ctx,
-			Prompt:        prompt,
+			Prompt:        fixPrompt,
 			Model:         this.Config.ExeccheckModel,
 			MaxTokens:     this.Config.ExeccheckMaxTokens,
 			Temperature:   this.Config.ExeccheckTemperature,
 			SystemMessage: "N/A",
+			PromptName:    prompt.PromptFixCommand,
 			TokenTimeout:  this.Config.TokenTimeout,
 		}
 
@@ -900,23 +1814,26 @@ func (this *ButterfishCtx) execAndCheck(ctx context.Context, cmd string) error {
 			return err
 		}
 
-		this.StylePrintf(this.Config.Styles.Question, "Run this command? [y/N]: ")
-
-		var input string
-		_, err = fmt.Scanln(&input)
-		if err != nil {
+		ok, err := this.confirm("Run this command?")
+		if err != nil || !ok {
 			return err
 		}
-
-		if strings.ToLower(input) != "y" {
-			return nil
-		}
 	}
 }
 
 type executeResult struct {
 	LastOutput []byte
 	Status     int
+	// set if the command was killed for running past its timeout
+	TimedOut bool
+}
+
+// Describe how the command failed
+func (this *executeResult) Failure(timeout time.Duration) string {
+	if this.TimedOut {
+		return fmt.Sprintf("Command timed out after %s", timeout)
+	}
+	return fmt.Sprintf("Command failed with status %d", this.Status)
 }
 
 // Function that executes a command on the local host as a child and streams
@@ -928,6 +1845,10 @@ func executeCommand(ctx context.Context, cmd string, out io.Writer) (*executeRes
 	cacheWriter := util.NewCacheWriter(out)
 	c.Stdout = cacheWriter
 	c.Stderr = cacheWriter
+	setProcessGroup(c)
+
+	// don't wait on children that keep the output open after a timeout
+	c.WaitDelay = time.Second
 
 	err := c.Run()
 
@@ -947,6 +1868,20 @@ func executeCommand(ctx context.Context, cmd string, out io.Writer) (*executeRes
 	return result, err
 }
 
+// Run cmd in its own process group, so that when its context is done the
+// whole group is killed, including what a shell started
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return signalProcessGroup(cmd, syscall.SIGKILL)
+	}
+}
+
+// Signal the process group of a command started after setProcessGroup
+func signalProcessGroup(cmd *exec.Cmd, signal syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, signal)
+}
+
 // Execute the command as a child of this process (rather than a remote
 // process), either from the command register or from a command string
 func (this *ButterfishCtx) execCommand(cmd string) (*executeResult, error) {
@@ -1013,25 +1948,35 @@ func (this *ButterfishCtx) updateCommandRegister(cmd string) {
 }
 
 func (this *ButterfishCtx) SummarizeChunks(chunks [][]byte) error {
-	writer := util.NewStyledWriter(this.Out, this.Config.Styles.Foreground)
+	return this.summarizeChunksTo(chunks,
+		this.teeWriter(util.NewStyledWriter(this.Out, this.Config.Styles.Foreground)))
+}
+
+func (this *ButterfishCtx) summarizeChunksTo(chunks [][]byte, writer io.Writer) error {
 	req := &util.CompletionRequest{
 		Ctx:           this.Ctx,
 		Model:         this.Config.SummarizeModel,
 		MaxTokens:     this.Config.SummarizeMaxTokens,
-		Temperature:   this.Config.SummarizeTemperature,
+		Temperature:   requestTemperature(this.Config.SummarizeTemperature),
+		TopP:          this.Config.SummarizeTopP,
+		Stop:          this.Config.SummarizeStop,
+		LogitBias:     this.Config.SummarizeLogitBias,
 		SystemMessage: "N/A",
+		Task:          TaskSummarize,
 	}
 
 	if len(chunks) == 1 {
 		// the entire document fits within the token limit, summarize directly
-		prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptSummarize,
+		promptStr, err := this.GetPrompt(prompt.PromptSummarize,
 			"content", string(chunks[0]))
 		if err != nil {
 			return err
 		}
-		req.Prompt = prompt
+		req.Prompt = promptStr
+		req.PromptName = prompt.PromptSummarize
 
 		_, err = this.LLMClient.CompletionStream(req, writer)
+		return err
 	}
 
 	// the document doesn't fit within the token limit, we'll iterate over it
@@ -1043,12 +1988,13 @@ func (this *ButterfishCtx) SummarizeChunks(chunks [][]byte) error {
 			break
 		}
 
-		prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptSummarizeFacts,
+		promptStr, err := this.GetPrompt(prompt.PromptSummarizeFacts,
 			"content", string(chunk))
 		if err != nil {
 			return err
 		}
-		req.Prompt = prompt
+		req.Prompt = promptStr
+		req.PromptName = prompt.PromptSummarizeFacts
 		resp, err := this.LLMClient.Completion(req)
 		if err != nil {
 			return err
@@ -1058,13 +2004,14 @@ func (this *ButterfishCtx) SummarizeChunks(chunks [][]byte) error {
 	}
 
 	mergedFacts := facts.String()
-	prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptSummarizeListOfFacts,
+	promptStr, err := this.GetPrompt(prompt.PromptSummarizeListOfFacts,
 		"content", mergedFacts)
 	if err != nil {
 		return err
 	}
 
-	req.Prompt = prompt
+	req.Prompt = promptStr
+	req.PromptName = prompt.PromptSummarizeListOfFacts
 	_, err = this.LLMClient.CompletionStream(req, writer)
 	return err
 }
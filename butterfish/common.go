@@ -72,12 +72,34 @@ var MODEL_TO_TOKENS_PER_MESSAGE = map[string]int{
 	"gpt-3.5-turbo-16k-0613": 4,
 }
 
+// Price in USD per million tokens, used to estimate what a session is
+// costing. These are list prices from https://openai.com/api/pricing and will
+// drift over time, treat them as a rough guide.
+type ModelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+var MODEL_TO_PRICE = map[string]ModelPrice{
+	"gpt-4o":                 {2.50, 10.00},
+	"gpt-4o-2024-05-13":      {5.00, 15.00},
+	"gpt-4o-mini":            {0.15, 0.60},
+	"gpt-4":                  {30.00, 60.00},
+	"gpt-4-32k":              {60.00, 120.00},
+	"gpt-4-turbo":            {10.00, 30.00},
+	"gpt-4-1106":             {10.00, 30.00},
+	"gpt-4-0125-preview":     {10.00, 30.00},
+	"gpt-3.5-turbo":          {0.50, 1.50},
+	"gpt-3.5-turbo-instruct": {1.50, 2.00},
+	"gpt-3.5-turbo-16k":      {3.00, 4.00},
+}
+
 // Given a model name (e.g. gpt-4-32k-0613), search the kv map for the
 // value associated with the model name. If the model name is not found,
 // attempt to find a simpler model name by removing the last segment
 // (delimited by -) and searching again.
 // returns (model found, value)
-func findModelValue(model string, kv map[string]int) (string, int) {
+func findModelValue[T any](model string, kv map[string]T) (string, T) {
 	value, ok := kv[model]
 	if ok {
 		return model, value
@@ -98,10 +120,16 @@ func findModelValue(model string, kv map[string]int) (string, int) {
 		}
 	}
 
-	return "", -1
+	var zero T
+	return "", zero
 }
 
 func NumTokensForModel(model string) int {
+	// the provider's model list knows context sizes of models we don't
+	if caps := capabilities.listed(model); caps != nil && caps.ContextTokens > 0 {
+		return caps.ContextTokens
+	}
+
 	foundModel, numTokens := findModelValue(model, MODEL_TO_NUM_TOKENS)
 
 	// couldn't find model
@@ -133,6 +161,19 @@ func NumTokensPerMessageForModel(model string) int {
 	return numTokens
 }
 
+// Estimate the cost in USD of a call given the token counts, returns false if
+// we don't know the price of the model (e.g. a local model)
+func EstimateCostForModel(model string, promptTokens, completionTokens int) (float64, bool) {
+	foundModel, price := findModelValue(model, MODEL_TO_PRICE)
+	if foundModel == "" {
+		return 0, false
+	}
+
+	cost := float64(promptTokens)*price.Prompt/1e6 +
+		float64(completionTokens)*price.Completion/1e6
+	return cost, true
+}
+
 // Data type for passing byte chunks from a wrapped command around
 type byteMsg struct {
 	Data []byte
@@ -0,0 +1,157 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/sashabaranov/go-openai/jsonschema"
+	"golang.org/x/term"
+)
+
+// butterfish prompt --models sends the same prompt to several models at once
+// and shows the answers side by side, or one after another when there are
+// too many to fit, to help pick which model to standardize on.
+
+// Columns narrower than this are hard to read, so we print answers one after
+// another instead
+const compareMinColumnWidth = 40
+
+// A model's answer to the compared prompt
+type modelAnswer struct {
+	Model    string
+	Answer   string
+	Tokens   int
+	Duration time.Duration
+	Err      error
+}
+
+// The heading of an answer, with how long it took and its length
+func (this *modelAnswer) heading() string {
+	if this.Err != nil {
+		return fmt.Sprintf("%s (failed after %s)", this.Model, this.Duration.Round(100*time.Millisecond))
+	}
+	heading := fmt.Sprintf("%s (%s", this.Model, this.Duration.Round(100*time.Millisecond))
+	if this.Tokens > 0 {
+		heading += fmt.Sprintf(", %d tokens", this.Tokens)
+	}
+	return heading + ")"
+}
+
+func (this *modelAnswer) body() string {
+	if this.Err != nil {
+		return "Error: " + this.Err.Error()
+	}
+	return this.Answer
+}
+
+// Query each model with the prompt in parallel, answers are in the order of
+// models
+func (this *ButterfishCtx) queryModels(cmd *promptCommand, models []string) ([]*modelAnswer, error) {
+	req, err := this.promptRequest(cmd)
+	if err != nil {
+		return nil, err
+	}
+	var schema *jsonschema.Definition
+	if cmd.Schema != "" {
+		schema, err = LoadResponseSchema(cmd.Schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	answers := make([]*modelAnswer, len(models))
+	wg := sync.WaitGroup{}
+	for i, model := range models {
+		modelReq := *req
+		modelReq.Model = ResolveModel(this.Config.ModelAliases, model)
+		answer := &modelAnswer{Model: model}
+		answers[i] = answer
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			var response *util.CompletionResponse
+			if schema != nil {
+				response, answer.Err = this.completeWithSchema(&modelReq, schema)
+			} else {
+				response, answer.Err = this.LLMClient.Completion(&modelReq)
+			}
+			answer.Duration = time.Since(start)
+			if answer.Err == nil {
+				answer.Answer = strings.TrimSpace(response.Completion)
+				answer.Tokens = response.CompletionTokens
+			}
+		}()
+	}
+	wg.Wait()
+	return answers, nil
+}
+
+// Print the answers side by side if they fit in the terminal, otherwise one
+// after another with a heading for each. Headings are highlighted unless
+// noColor is set, the copy written to an --out file is plain.
+func (this *ButterfishCtx) printModelAnswers(answers []*modelAnswer, sequential, noColor bool) {
+	printLine := func(text string, highlight bool) {
+		if highlight && !noColor {
+			this.StylePrintf(this.Config.Styles.Highlight, "%s\n", text)
+		} else {
+			fmt.Fprintf(this.Out, "%s\n", text)
+		}
+		if this.Tee != nil {
+			fmt.Fprintf(this.Tee, "%s\n", text)
+		}
+	}
+
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		width = benchDefaultWidth
+	}
+	columnWidth := (width - 3*(len(answers)-1)) / len(answers)
+
+	if !sequential && columnWidth >= compareMinColumnWidth {
+		headings := []string{}
+		bodies := []string{}
+		for _, answer := range answers {
+			headings = append(headings, answer.heading())
+			bodies = append(bodies, answer.body())
+		}
+		printLine(util.Columns(headings, width), true)
+		printLine(util.Columns(bodies, width), false)
+		return
+	}
+
+	for i, answer := range answers {
+		if i > 0 {
+			printLine("", false)
+		}
+		printLine("== "+answer.heading()+" ==", true)
+		printLine(answer.body(), false)
+	}
+}
+
+// Run the prompt against each model and print the answers for comparison,
+// fails only if every model failed
+func (this *ButterfishCtx) comparePrompt(cmd *promptCommand, models []string, sequential bool) error {
+	if len(models) < 2 {
+		return errors.New("Give at least two models to compare, e.g. --models gpt-4o,gpt-4o-mini")
+	}
+
+	answers, err := this.queryModels(cmd, models)
+	if err != nil {
+		return err
+	}
+	this.printModelAnswers(answers, sequential, cmd.NoColor)
+
+	for _, answer := range answers {
+		if answer.Err == nil {
+			return nil
+		}
+	}
+	return errors.New("Every model failed")
+}
@@ -0,0 +1,231 @@
+package butterfish
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"github.com/bakks/butterfish/prompt"
+)
+
+// Tab completion for butterfish's own CLI. The scripts printed by
+// `butterfish completion <shell>` call the hidden `butterfish __complete`
+// command with the words typed so far, which completes subcommands and
+// flags from the CLI model. Flag and argument values are completed from
+// their enum, or from the struct tag completion:"prompts" for prompt library
+// names or completion:"indexed" for indexed directories. When there are no
+// candidates the shell falls back to completing file names.
+
+// How deep under the current directory to look for indexed directories
+const completionMaxDepth = 4
+
+const bashCompletionScript = `# butterfish bash completion, add to ~/.bashrc:
+#   source <(butterfish completion bash)
+_butterfish() {
+    local IFS=$'\n'
+    COMPREPLY=($(butterfish __complete -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _butterfish butterfish
+`
+
+const zshCompletionScript = `#compdef butterfish
+# butterfish zsh completion, add to ~/.zshrc after compinit:
+#   source <(butterfish completion zsh)
+_butterfish() {
+    local -a candidates
+    candidates=("${(@f)$(butterfish __complete -- "${words[@]:1:$((CURRENT-1))}" 2>/dev/null)}")
+    if [[ -n "${candidates[1]}" ]]; then
+        compadd -Q -- "${candidates[@]}"
+    else
+        _files
+    fi
+}
+compdef _butterfish butterfish
+`
+
+const fishCompletionScript = `# butterfish fish completion, save to
+# ~/.config/fish/completions/butterfish.fish:
+#   butterfish completion fish > ~/.config/fish/completions/butterfish.fish
+function __butterfish_complete
+    set -l tokens (commandline -opc) (commandline -ct)
+    butterfish __complete -- $tokens[2..-1] 2>/dev/null
+end
+complete -c butterfish -f -n 'test -n "$(__butterfish_complete)"' -a '(__butterfish_complete)'
+`
+
+// The completion script for a shell, one of bash, zsh, or fish
+func CompletionScript(shell string) (string, error) {
+	switch shell {
+	case "bash":
+		return bashCompletionScript, nil
+	case "zsh":
+		return zshCompletionScript, nil
+	case "fish":
+		return fishCompletionScript, nil
+	}
+	return "", fmt.Errorf("Unknown shell %s, completion is available for bash, zsh, and fish", shell)
+}
+
+// Complete the last of words, which are the arguments typed after
+// butterfish, the last being the partial word at the cursor. Prompt names
+// are read from the library at promptLibraryPath.
+func CompleteArgs(app *kong.Application, words []string, promptLibraryPath string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	current := words[len(words)-1]
+
+	// walk the words before the cursor to find the command and which
+	// positional argument or flag value the cursor is at
+	node := app.Node
+	positional := 0
+	var pendingFlag *kong.Flag
+	for _, word := range words[:len(words)-1] {
+		switch {
+		case pendingFlag != nil:
+			pendingFlag = nil
+		case strings.HasPrefix(word, "-") && len(word) > 1:
+			flag := findCompletionFlag(node, word)
+			if flag != nil && !strings.Contains(word, "=") && !flag.IsBool() && !flag.IsCounter() {
+				pendingFlag = flag
+			}
+		case positional == 0 && findCompletionChild(node, word) != nil:
+			node = findCompletionChild(node, word)
+		default:
+			positional++
+		}
+	}
+
+	candidates := []string{}
+	switch {
+	case pendingFlag != nil:
+		candidates = completeValue(pendingFlag.Value, promptLibraryPath)
+	case strings.HasPrefix(current, "-"):
+		for n := node; n != nil; n = n.Parent {
+			for _, flag := range n.Flags {
+				if flag.Hidden {
+					continue
+				}
+				candidates = append(candidates, "--"+flag.Name)
+				if flag.Short != 0 {
+					candidates = append(candidates, "-"+string(flag.Short))
+				}
+			}
+		}
+	default:
+		if positional == 0 {
+			for _, child := range node.Children {
+				if !child.Hidden {
+					candidates = append(candidates, child.Name)
+				}
+			}
+		}
+		// an argument of the default subcommand, e.g. index <paths>
+		args := node.Positional
+		if len(args) == 0 && node.DefaultCmd != nil {
+			args = node.DefaultCmd.Positional
+		}
+		if len(args) > 0 {
+			arg := args[min(positional, len(args)-1)]
+			if positional < len(args) || arg.IsSlice() {
+				candidates = append(candidates, completeValue(arg, promptLibraryPath)...)
+			}
+		}
+	}
+
+	matches := []string{}
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, current) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func findCompletionChild(node *kong.Node, name string) *kong.Node {
+	for _, child := range node.Children {
+		if child.Name == name {
+			return child
+		}
+		for _, alias := range child.Aliases {
+			if alias == name {
+				return child
+			}
+		}
+	}
+	return nil
+}
+
+// Find a flag like --model, --model=x, or -m on a node or its parents
+func findCompletionFlag(node *kong.Node, word string) *kong.Flag {
+	name, _, _ := strings.Cut(word, "=")
+	for n := node; n != nil; n = n.Parent {
+		for _, flag := range n.Flags {
+			if name == "--"+flag.Name || (flag.Short != 0 && name == "-"+string(flag.Short)) {
+				return flag
+			}
+		}
+	}
+	return nil
+}
+
+// The possible values of a flag or argument, empty if they're free-form
+func completeValue(value *kong.Value, promptLibraryPath string) []string {
+	switch value.Tag.Get("completion") {
+	case "prompts":
+		return completePromptNames(promptLibraryPath)
+	case "indexed":
+		return completeIndexedDirs()
+	}
+	if value.Enum != "" {
+		values := []string{}
+		for _, v := range strings.Split(value.Enum, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// The names of the prompts in the library, or the default prompts if the
+// library hasn't been written yet
+func completePromptNames(promptLibraryPath string) []string {
+	prompts := prompt.DefaultPrompts
+	library := prompt.NewPromptLibrary(promptLibraryPath, false, nil)
+	if library.LibraryFileExists() && library.Load() == nil {
+		prompts = library.Prompts
+	}
+
+	names := []string{}
+	for _, p := range prompts {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// The directories under the current one that have an embeddings index,
+// along with the current directory if it has one
+func completeIndexedDirs() []string {
+	dirs := []string{}
+	filepath.WalkDir(".", func(path string, entry os.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		if path != "." && (strings.HasPrefix(entry.Name(), ".") || entry.Name() == "node_modules" ||
+			strings.Count(path, string(filepath.Separator)) >= completionMaxDepth) {
+			return filepath.SkipDir
+		}
+		_, err = os.Stat(filepath.Join(path, ".butterfish_index"))
+		if err == nil {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	return dirs
+}
@@ -0,0 +1,224 @@
+package butterfish
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// CompressionConfig trims context to its most informative sentences before
+// it's sent, set in the config file, e.g.
+//
+//	compression:
+//	  snippet_tokens: 1500
+//	  history_tokens: 256
+//
+// Like LLMLingua, sentences are scored by how much information they carry,
+// but rather than a small model's perplexity we use the self-information of
+// their words within the context, so repeated boilerplate scores low and rare
+// identifiers and words of the question score high. The highest scoring
+// sentences that fit the target are kept in their original order, with ...
+// where sentences were dropped.
+type CompressionConfig struct {
+	// Compress indexquestion snippets to about this many tokens, 0 is off
+	SnippetTokens int `yaml:"snippet_tokens,omitempty"`
+	// Compress shell history blocks longer than this many tokens rather than
+	// cutting them off, 0 is off
+	HistoryTokens int `yaml:"history_tokens,omitempty"`
+}
+
+func (this *CompressionConfig) Validate() error {
+	if this.SnippetTokens < 0 || this.HistoryTokens < 0 {
+		return errors.New("compression token targets can't be negative")
+	}
+	return nil
+}
+
+// Words of the question count this much more than their self-information
+const compressionQueryWeight = 3.0
+
+// Split text into sentences and lines, each keeps the whitespace after it so
+// that joining them gives back the text
+func splitSentences(text string) []string {
+	sentences := []string{}
+	start := 0
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		end := false
+		switch runes[i] {
+		case '\n':
+			end = true
+		case '.', '!', '?':
+			end = i+1 < len(runes) && (runes[i+1] == ' ' || runes[i+1] == '\t')
+		}
+		if !end {
+			continue
+		}
+		for i+1 < len(runes) && (runes[i+1] == ' ' || runes[i+1] == '\t') {
+			i++
+		}
+		sentences = append(sentences, string(runes[start:i+1]))
+		start = i + 1
+	}
+	if start < len(runes) {
+		sentences = append(sentences, string(runes[start:]))
+	}
+	return sentences
+}
+
+// The lowercased words and identifiers of text, single characters are left
+// out
+func compressionWords(text string) []string {
+	words := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}) {
+		if len(word) > 1 {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+type compressionSentence struct {
+	text   string
+	tokens int
+	score  float64
+}
+
+// Compress texts together to about targetTokens in total, keeping the
+// sentences that carry the most information and those about the query.
+// Texts already within the target are returned as they are.
+func CompressTexts(texts []string, query string, targetTokens int, tokenizer Tokenizer) []string {
+	total := 0
+	for _, text := range texts {
+		total += tokenizer.CountTokens(text)
+	}
+	if targetTokens <= 0 || total <= targetTokens {
+		return texts
+	}
+
+	// word frequencies across all the texts, for self-information
+	split := make([][]*compressionSentence, len(texts))
+	counts := map[string]int{}
+	numWords := 0
+	for i, text := range texts {
+		for _, sentence := range splitSentences(text) {
+			split[i] = append(split[i], &compressionSentence{text: sentence, tokens: tokenizer.CountTokens(sentence)})
+			for _, word := range compressionWords(sentence) {
+				counts[word]++
+				numWords++
+			}
+		}
+	}
+	queryWords := map[string]bool{}
+	for _, word := range compressionWords(query) {
+		queryWords[word] = true
+	}
+
+	ranked := []*compressionSentence{}
+	seen := map[string]bool{}
+	for _, sentences := range split {
+		for _, sentence := range sentences {
+			words := compressionWords(sentence.text)
+			key := strings.TrimSpace(sentence.text)
+			// blank lines, punctuation, and repeats carry nothing
+			if len(words) == 0 || seen[key] {
+				continue
+			}
+			seen[key] = true
+			info := 0.0
+			for _, word := range words {
+				wordInfo := math.Log(float64(numWords) / float64(counts[word]))
+				if queryWords[word] {
+					wordInfo = (wordInfo + 1) * compressionQueryWeight
+				}
+				info += wordInfo
+			}
+			// favour dense sentences, but not one word fragments
+			sentence.score = info / math.Sqrt(float64(sentence.tokens+1))
+			ranked = append(ranked, sentence)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].score > ranked[j].score
+	})
+
+	kept := map[*compressionSentence]bool{}
+	used := 0
+	for _, sentence := range ranked {
+		if used+sentence.tokens > targetTokens {
+			continue
+		}
+		kept[sentence] = true
+		used += sentence.tokens
+	}
+
+	compressed := make([]string, len(texts))
+	for i, sentences := range split {
+		builder := strings.Builder{}
+		dropped := false
+		for _, sentence := range sentences {
+			if !kept[sentence] {
+				dropped = dropped || strings.TrimSpace(sentence.text) != ""
+				continue
+			}
+			if dropped {
+				builder.WriteString(compressionGap(builder.String()))
+				dropped = false
+			}
+			builder.WriteString(sentence.text)
+		}
+		if dropped {
+			builder.WriteString(compressionGap(builder.String()))
+		}
+		compressed[i] = builder.String()
+	}
+	return compressed
+}
+
+// The marker for dropped sentences, on its own line after a line
+func compressionGap(before string) string {
+	if before == "" || strings.HasSuffix(before, "\n") {
+		return "...\n"
+	}
+	return "... "
+}
+
+// CompressingTokenizer compresses shell history blocks that are over the
+// block limit rather than cutting them off, see getHistoryBlocksByTokens.
+// Otherwise it counts and truncates as the tokenizer it wraps.
+type CompressingTokenizer struct {
+	Tokenizer
+}
+
+// Tokenizations are cached by name, compressed ones are kept apart
+func (this *CompressingTokenizer) Name() string {
+	return this.Tokenizer.Name() + "+compressed"
+}
+
+func (this *CompressingTokenizer) Compress(text string, maxTokens int) string {
+	return CompressTexts([]string{text}, "", maxTokens, this.Tokenizer)[0]
+}
+
+// Compress retrieved snippets to targetTokens, or to the config file's
+// snippet_tokens if it's 0
+func (this *ButterfishCtx) compressSnippets(snippets []string, query, model string, targetTokens int) []string {
+	if targetTokens == 0 && this.Config.Compression != nil {
+		targetTokens = this.Config.Compression.SnippetTokens
+	}
+	if targetTokens <= 0 {
+		return snippets
+	}
+
+	tokenizer := TokenizerForModel(model)
+	compressed := CompressTexts(snippets, query, targetTokens, tokenizer)
+	if this.Config.Verbose > 0 {
+		before := tokenizer.CountTokens(strings.Join(snippets, ""))
+		after := tokenizer.CountTokens(strings.Join(compressed, ""))
+		this.StylePrintf(this.Config.Styles.Grey, "Compressed snippets from %d to %d tokens\n", before, after)
+	}
+	return compressed
+}
@@ -0,0 +1,351 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigFile is the optional YAML config file, usually at
+// ~/.config/butterfish/config.yaml, for settings that don't fit well as
+// command line flags. For example:
+//
+//	keybindings:
+//	  accept_autosuggest: ctrl-f
+//	  toggle_goal_mode: ctrl-x g
+//	failover:
+//	  model: gpt-4o-mini
+//	rate_limit:
+//	  requests_per_minute: 60
+//	prompt_sync:
+//	  url: git@github.com:example/prompts.git
+//	encryption:
+//	  key_env: BUTTERFISH_ENCRYPTION_KEY
+//	routing:
+//	  fast: gpt-4o-mini
+//	  strong: gpt-4o
+//	env_context:
+//	  unmasked: [NODE_ENV, PORT]
+//	explain_before_execute: true
+//	base_url: https://openrouter.ai/api/v1
+//	shell:
+//	  model: gpt-4o
+//	  temperature: 0.5
+//	prompt_library: ~/prompts/butterfish.yaml
+//	models:
+//	  fast: gpt-4o-mini
+//	  smart: gpt-4o
+//	model_defaults:
+//	  gencmd: fast
+//	sampling:
+//	  gencmd:
+//	    temperature: 0
+//
+// butterfish init writes a commented config file, see initwizard.go.
+type ConfigFile struct {
+	// Base URL of the OpenAI-compatible API, used if --base-url isn't given
+	BaseURL string `yaml:"base_url,omitempty"`
+	// Map of shell mode action to key, see keybindings.go
+	KeyBindings map[string]string `yaml:"keybindings,omitempty"`
+	// Secondary provider to use if the primary keeps failing, see failover.go
+	Failover *FailoverConfig `yaml:"failover,omitempty"`
+	// Request rate limit shared across butterfish processes, see ratelimit.go
+	RateLimit *RateLimitConfig `yaml:"rate_limit,omitempty"`
+	// Git repo of team prompts for butterfish prompts sync, see promptsync.go
+	PromptSync *PromptSyncConfig `yaml:"prompt_sync,omitempty"`
+	// Encrypt history, sessions, and indexes at rest, see encryption.go
+	Encryption *EncryptionConfig `yaml:"encryption,omitempty"`
+	// Fast and strong models to route requests to by task, see routing.go
+	Routing *RoutingConfig `yaml:"routing,omitempty"`
+	// Files and unmasked variables for the env_vars context provider, see
+	// envcontext.go
+	EnvContext *EnvContextConfig `yaml:"env_context,omitempty"`
+	// Explain generated commands before offering to run them, see preview.go
+	ExplainBeforeExecute bool `yaml:"explain_before_execute,omitempty"`
+	// Shell mode models and temperature, flags given on the command line take
+	// precedence
+	Shell *ShellConfigFile `yaml:"shell,omitempty"`
+	// Path of the prompt library, ~/.config/butterfish/prompts.yaml by default
+	PromptLibrary string `yaml:"prompt_library,omitempty"`
+	// Model aliases, which can be used anywhere a model is, see models.go
+	Models map[string]string `yaml:"models,omitempty"`
+	// Model or alias for each command's --model flag if it isn't given
+	ModelDefaults map[string]string `yaml:"model_defaults,omitempty"`
+	// Temperature, top_p, max_tokens, stop, and logit_bias for prompt,
+	// gencmd, and summarize, see sampling.go
+	Sampling map[string]*SamplingConfig `yaml:"sampling,omitempty"`
+	// Times to resume an interrupted streamed response, 0 turns it off, see
+	// resume.go
+	ResumeAttempts *int `yaml:"resume_attempts,omitempty"`
+	// A second model that checks answers for made up commands and flags, see
+	// verify.go
+	Verify *VerifyConfig `yaml:"verify,omitempty"`
+	// Shell commands left out of the history with their output, see
+	// private.go
+	PrivateCommands []string `yaml:"private_commands,omitempty"`
+	// Locale of prompts and answers, e.g. es, pt-BR, or auto, see
+	// language.go
+	Language string `yaml:"language,omitempty"`
+	// Recording and transcription of spoken prompts, see speech.go
+	Speech *SpeechConfig `yaml:"speech,omitempty"`
+	// Dollar limits on a session's spend, see budget.go
+	Budget *BudgetConfig `yaml:"budget,omitempty"`
+	// Compression of retrieved snippets and shell history, see
+	// compression.go
+	Compression *CompressionConfig `yaml:"compression,omitempty"`
+	// Scripts or webhooks run on goal mode events, see hooks.go
+	Hooks *HooksConfig `yaml:"hooks,omitempty"`
+
+	// Deprecated keys that were renamed when the file was loaded, see
+	// configcheck.go
+	Warnings []*ConfigIssue `yaml:"-"`
+}
+
+type ShellConfigFile struct {
+	Model            string  `yaml:"model,omitempty"`
+	AutosuggestModel string  `yaml:"autosuggest_model,omitempty"`
+	AnnotateModel    string  `yaml:"annotate_model,omitempty"`
+	Temperature      float32 `yaml:"temperature,omitempty"`
+}
+
+// Load the config file at path, returns an empty config if the file doesn't
+// exist.
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ConfigFile{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	issues, checked, err := CheckConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", path, err)
+	}
+	problems := []string{}
+	for _, issue := range issues {
+		if issue.Severity == configIssueError {
+			problems = append(problems, issue.String())
+		} else {
+			config.Warnings = append(config.Warnings, issue)
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("Errors in %s, run 'butterfish config check' to see them again:\n%s",
+			path, strings.Join(problems, "\n"))
+	}
+
+	// the checked config has deprecated keys renamed
+	data, err = yaml.Marshal(checked)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// Apply the config file settings to a ButterfishConfig
+func (this *ConfigFile) Apply(config *ButterfishConfig) error {
+	keyBindings, err := ParseKeyBindings(this.KeyBindings)
+	if err != nil {
+		return err
+	}
+	config.ShellKeyBindings = keyBindings
+
+	err = validateModelAliases(this.Models)
+	if err != nil {
+		return err
+	}
+	config.ModelAliases = this.Models
+	for command, model := range this.ModelDefaults {
+		if model == "" {
+			return fmt.Errorf("model_defaults %s needs a model", command)
+		}
+	}
+	config.ModelDefaults = this.ModelDefaults
+
+	for command, sampling := range this.Sampling {
+		if sampling == nil {
+			continue
+		}
+		err = sampling.Validate(command)
+		if err != nil {
+			return err
+		}
+		switch command {
+		case "gencmd":
+			sampling.apply(&config.GencmdTemperature, &config.GencmdTopP, &config.GencmdMaxTokens,
+				&config.GencmdStop, &config.GencmdLogitBias)
+		case "summarize":
+			sampling.apply(&config.SummarizeTemperature, &config.SummarizeTopP, &config.SummarizeMaxTokens,
+				&config.SummarizeStop, &config.SummarizeLogitBias)
+		}
+	}
+	config.Sampling = this.Sampling
+	resolve := func(model string) string {
+		return ResolveModel(this.Models, model)
+	}
+
+	if this.Failover != nil {
+		if this.Failover.BaseURL == "" && this.Failover.Model == "" {
+			return errors.New("failover needs a base_url or a model")
+		}
+		if this.Failover.APIKeyEnv != "" && os.Getenv(this.Failover.APIKeyEnv) == "" {
+			return fmt.Errorf("failover api_key_env %s is not set", this.Failover.APIKeyEnv)
+		}
+		failover := *this.Failover
+		failover.Model = resolve(failover.Model)
+		config.Failover = &failover
+	}
+
+	if this.RateLimit != nil {
+		if this.RateLimit.RequestsPerMinute <= 0 {
+			return errors.New("rate_limit needs a positive requests_per_minute")
+		}
+		config.RateLimit = this.RateLimit
+	}
+
+	if this.ResumeAttempts != nil {
+		if *this.ResumeAttempts < 0 {
+			return errors.New("resume_attempts can't be negative")
+		}
+		config.ResumeAttempts = *this.ResumeAttempts
+	}
+
+	if this.Verify != nil {
+		err = this.Verify.Validate()
+		if err != nil {
+			return err
+		}
+		verify := *this.Verify
+		verify.Model = resolve(verify.Model)
+		config.Verify = &verify
+	}
+
+	if this.PromptSync != nil {
+		if this.PromptSync.URL == "" {
+			return errors.New("prompt_sync needs a url")
+		}
+		config.PromptSync = this.PromptSync
+	}
+
+	config.Encryption = this.Encryption
+
+	if this.Routing != nil {
+		err = this.Routing.Validate()
+		if err != nil {
+			return err
+		}
+		routing := &RoutingConfig{
+			Fast:   resolve(this.Routing.Fast),
+			Strong: resolve(this.Routing.Strong),
+			Rules:  map[string]string{},
+		}
+		for task, target := range this.Routing.Rules {
+			if target != routingTierFast && target != routingTierStrong {
+				target = resolve(target)
+			}
+			routing.Rules[task] = target
+		}
+		config.Routing = routing
+	}
+
+	if this.EnvContext != nil {
+		err = this.EnvContext.Validate()
+		if err != nil {
+			return err
+		}
+		config.EnvContext = this.EnvContext
+	}
+
+	if len(this.PrivateCommands) > 0 {
+		config.ShellPrivateCommands, err = compilePrivatePatterns(this.PrivateCommands)
+		if err != nil {
+			return err
+		}
+	}
+
+	if this.ExplainBeforeExecute {
+		config.ExplainBeforeExecute = true
+	}
+
+	if this.Language != "" {
+		config.Language = this.Language
+	}
+
+	if this.Speech != nil {
+		err = this.Speech.Validate()
+		if err != nil {
+			return err
+		}
+		config.Speech = this.Speech
+	}
+
+	if this.Budget != nil {
+		err = this.Budget.Validate()
+		if err != nil {
+			return err
+		}
+		config.Budget = this.Budget
+	}
+
+	if this.Compression != nil {
+		err = this.Compression.Validate()
+		if err != nil {
+			return err
+		}
+		config.Compression = this.Compression
+	}
+
+	if this.Hooks != nil {
+		err = this.Hooks.Validate()
+		if err != nil {
+			return err
+		}
+		config.Hooks = this.Hooks
+	}
+
+	if config.BaseURL == "" {
+		config.BaseURL = this.BaseURL
+	}
+
+	if this.Shell != nil {
+		if this.Shell.Temperature < 0 || this.Shell.Temperature > 2 {
+			return errors.New("shell temperature must be between 0 and 2")
+		}
+		if this.Shell.Model != "" && !config.ShellFlagsGiven["model"] {
+			config.ShellPromptModel = resolve(this.Shell.Model)
+		}
+		if this.Shell.AutosuggestModel != "" && !config.ShellFlagsGiven["autosuggest-model"] {
+			config.ShellAutosuggestModel = resolve(this.Shell.AutosuggestModel)
+		}
+		if this.Shell.AnnotateModel != "" && !config.ShellFlagsGiven["annotate-model"] {
+			config.ShellAnnotateModel = resolve(this.Shell.AnnotateModel)
+		}
+		if this.Shell.Temperature != 0 {
+			config.ShellTemperature = this.Shell.Temperature
+		}
+	}
+
+	if this.PromptLibrary != "" {
+		config.PromptLibraryPath = this.PromptLibrary
+	}
+
+	return nil
+}
@@ -0,0 +1,379 @@
+package butterfish
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"github.com/mitchellh/go-homedir"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The config file is checked against the ConfigFile struct before it's
+// loaded, so that unknown keys, values of the wrong type, and deprecated
+// keys are reported together with the key's path and a suggested fix,
+// rather than the first error from the YAML decoder.
+
+const (
+	configIssueError   = "error"
+	configIssueWarning = "warning"
+)
+
+type ConfigIssue struct {
+	Severity string
+	Path     string // e.g. routing.fast
+	Message  string
+}
+
+func (this *ConfigIssue) String() string {
+	return fmt.Sprintf("%s: %s: %s", this.Severity, this.Path, this.Message)
+}
+
+// Keys that were renamed, by path, they still work but are reported as
+// deprecated. No keys have been renamed yet.
+var deprecatedConfigKeys = map[string]string{}
+
+// Check config file YAML against the ConfigFile struct. Returns the issues
+// found, and the parsed config with deprecated keys renamed, which is nil if
+// the YAML couldn't be parsed.
+func CheckConfig(data []byte) ([]*ConfigIssue, map[interface{}]interface{}, error) {
+	config := map[interface{}]interface{}{}
+	err := yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, nil, err
+	}
+	issues := checkConfigValue("", config, reflect.TypeOf(ConfigFile{}))
+	return issues, config, nil
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// The yaml key of a struct field, empty if it isn't set from yaml
+func yamlFieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "-" || !field.IsExported() {
+		return ""
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name
+}
+
+func checkConfigValue(path string, value interface{}, t reflect.Type) []*ConfigIssue {
+	if value == nil {
+		return nil
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	mismatch := func(expected string) []*ConfigIssue {
+		return []*ConfigIssue{{
+			Severity: configIssueError,
+			Path:     path,
+			Message:  fmt.Sprintf("expected %s but got %s", expected, describeConfigValue(value)),
+		}}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		values, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return mismatch("a section of settings")
+		}
+		return checkConfigStruct(path, values, t)
+
+	case reflect.Map:
+		values, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return mismatch("a map of names to values")
+		}
+		issues := []*ConfigIssue{}
+		for _, key := range sortedConfigKeys(values) {
+			issues = append(issues, checkConfigValue(joinConfigPath(path, key), values[key], t.Elem())...)
+		}
+		return issues
+
+	case reflect.Slice:
+		values, ok := value.([]interface{})
+		if !ok {
+			return mismatch(fmt.Sprintf("a list, e.g. [%s]", describeConfigValue(value)))
+		}
+		issues := []*ConfigIssue{}
+		for i, v := range values {
+			issues = append(issues, checkConfigValue(fmt.Sprintf("%s[%d]", path, i), v, t.Elem())...)
+		}
+		return issues
+
+	case reflect.String:
+		// the decoder reads any scalar as a string
+		switch value.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return mismatch("a string")
+		}
+
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return mismatch("true or false")
+		}
+
+	case reflect.Int, reflect.Int64:
+		if _, ok := value.(int); !ok {
+			return mismatch("a whole number")
+		}
+
+	case reflect.Float32, reflect.Float64:
+		switch value.(type) {
+		case int, float64:
+		default:
+			return mismatch("a number")
+		}
+	}
+	return nil
+}
+
+// Check the keys of a section, renaming deprecated keys in values
+func checkConfigStruct(path string, values map[interface{}]interface{}, t reflect.Type) []*ConfigIssue {
+	fields := map[string]reflect.Type{}
+	names := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlFieldName(t.Field(i))
+		if name != "" {
+			fields[name] = t.Field(i).Type
+			names = append(names, name)
+		}
+	}
+
+	issues := []*ConfigIssue{}
+	for _, key := range sortedConfigKeys(values) {
+		keyPath := joinConfigPath(path, key)
+		value := values[key]
+
+		if replacement, ok := deprecatedConfigKeys[keyPath]; ok {
+			newKey := replacement[strings.LastIndex(replacement, ".")+1:]
+			issues = append(issues, &ConfigIssue{
+				Severity: configIssueWarning,
+				Path:     keyPath,
+				Message:  fmt.Sprintf("deprecated, rename it to %s", replacement),
+			})
+			if _, exists := values[newKey]; exists {
+				issues = append(issues, &ConfigIssue{
+					Severity: configIssueError,
+					Path:     keyPath,
+					Message:  fmt.Sprintf("both %s and %s are set, remove %s", keyPath, replacement, keyPath),
+				})
+				continue
+			}
+			delete(values, key)
+			values[newKey] = value
+			key = newKey
+		}
+
+		fieldType, ok := fields[key]
+		if !ok {
+			message := "unknown setting"
+			if suggestion := closestConfigKey(key, names); suggestion != "" {
+				message += fmt.Sprintf(", did you mean %s?", joinConfigPath(path, suggestion))
+			} else {
+				message += fmt.Sprintf(", the settings here are %s", strings.Join(names, ", "))
+			}
+			issues = append(issues, &ConfigIssue{Severity: configIssueError, Path: keyPath, Message: message})
+			continue
+		}
+		issues = append(issues, checkConfigValue(joinConfigPath(path, key), value, fieldType)...)
+	}
+	return issues
+}
+
+func sortedConfigKeys(values map[interface{}]interface{}) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, fmt.Sprint(key))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func describeConfigValue(value interface{}) string {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		return "a section"
+	case []interface{}:
+		return "a list"
+	case string:
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprint(value)
+}
+
+// The known key closest to key, if it's close enough to be a typo
+func closestConfigKey(key string, known []string) string {
+	best := ""
+	bestDistance := len(key)/3 + 2
+	for _, candidate := range known {
+		distance := editDistance(key, candidate)
+		if distance < bestDistance {
+			best = candidate
+			bestDistance = distance
+		}
+	}
+	return best
+}
+
+// The Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(min(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// Check the config file at path, printing each issue, including errors
+// from applying the settings. Commands in model_defaults are checked against
+// app if it's set. Returns false if the config has errors.
+func CheckConfigFile(path string, out io.Writer, app *kong.Application) (bool, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(out, "No config file at %s, run 'butterfish init' to write one.\n", path)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	issues, _, err := CheckConfig(data)
+	if err != nil {
+		fmt.Fprintf(out, "%s isn't valid YAML: %s\n", path, err)
+		return false, nil
+	}
+	valid := true
+	for _, issue := range issues {
+		fmt.Fprintf(out, "%s\n", issue)
+		if issue.Severity == configIssueError {
+			valid = false
+		}
+	}
+	if valid {
+		// settings that are the right shape can still be invalid together
+		config := MakeButterfishConfig()
+		configFile, err := LoadConfigFile(path)
+		if err == nil {
+			err = configFile.Apply(config)
+		}
+		if err == nil && app != nil {
+			err = ValidateModelDefaults(app, config)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "%s: %s\n", configIssueError, err)
+			valid = false
+		}
+	}
+
+	if valid {
+		fmt.Fprintf(out, "%s is valid\n", path)
+	}
+	return valid, nil
+}
+
+// The settings in effect once the defaults, the config file, and flags are
+// merged, in the config file format
+func EffectiveConfigFile(configFile *ConfigFile, config *ButterfishConfig) *ConfigFile {
+	effective := &ConfigFile{
+		BaseURL:              config.BaseURL,
+		KeyBindings:          map[string]string{},
+		Failover:             config.Failover,
+		RateLimit:            config.RateLimit,
+		PromptSync:           config.PromptSync,
+		Encryption:           config.Encryption,
+		Routing:              config.Routing,
+		EnvContext:           config.EnvContext,
+		ExplainBeforeExecute: config.ExplainBeforeExecute,
+		Shell:                configFile.Shell,
+		PromptLibrary:        config.PromptLibraryPath,
+		Models:               config.ModelAliases,
+		ModelDefaults:        config.ModelDefaults,
+		Sampling:             config.Sampling,
+		ResumeAttempts:       &config.ResumeAttempts,
+		Verify:               config.Verify,
+		PrivateCommands:      configFile.PrivateCommands,
+		Language:             config.Language,
+		Speech:               config.Speech,
+		Budget:               config.Budget,
+		Compression:          config.Compression,
+		Hooks:                config.Hooks,
+	}
+	if effective.BaseURL == "" {
+		effective.BaseURL = "https://api.openai.com/v1"
+	}
+	for name, key := range defaultKeyBindings {
+		effective.KeyBindings[name] = key
+	}
+	for name, key := range configFile.KeyBindings {
+		effective.KeyBindings[name] = key
+	}
+	if effective.Failover != nil && effective.Failover.AfterFailures == 0 {
+		failover := *effective.Failover
+		failover.AfterFailures = defaultFailoverAfterFailures
+		effective.Failover = &failover
+	}
+	return effective
+}
+
+// Print the config file, or with effective set, the merged settings
+func ShowConfig(out io.Writer, path string, config *ButterfishConfig, effective bool) error {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return err
+	}
+
+	if !effective {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			fmt.Fprintf(out, "No config file at %s, run 'butterfish init' to write one.\n", path)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "# %s\n%s", path, data)
+		return nil
+	}
+
+	configFile, err := LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(EffectiveConfigFile(configFile, config))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "# Effective config, the defaults merged with %s and flags\n%s", path, data)
+	return nil
+}
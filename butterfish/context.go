@@ -0,0 +1,406 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+// Context providers attach machine state to prompts. A system message can
+// include a field like {ctx_git_status}, which is filled in by the provider
+// named git_status when the prompt is built. Providers are only run for
+// fields that appear in the message.
+
+// The timeout for a single context provider, and the maximum size of the
+// output it can add to a prompt
+const (
+	contextProviderTimeout  = 2 * time.Second
+	contextProviderMaxBytes = 2000
+	contextMaxExitCodes     = 5
+)
+
+// ContextEnv is the state available to context providers
+type ContextEnv struct {
+	Ctx       context.Context
+	Shell     string
+	ExitCodes []int // recent exit codes in the shell, most recent last
+	// Set if the shell is in an ssh session, in which case local state like
+	// the working directory doesn't apply
+	RemoteHost string
+	// A summary of the user's aliases, functions, and tools, only known in
+	// shell mode
+	ShellProfile string
+	// Settings for the env_vars provider, the defaults if nil
+	EnvContext *EnvContextConfig
+
+	getCwd func() string
+	cwd    string
+}
+
+func NewContextEnv(ctx context.Context, shell string, getCwd func() string) *ContextEnv {
+	return &ContextEnv{
+		Ctx:    ctx,
+		Shell:  shell,
+		getCwd: getCwd,
+	}
+}
+
+// The working directory of the shell, looked up the first time it's needed
+func (this *ContextEnv) Cwd() string {
+	if this.cwd == "" {
+		this.cwd = this.getCwd()
+	}
+	return this.cwd
+}
+
+// A ContextProvider returns machine state to add to a prompt
+type ContextProvider func(env *ContextEnv) (string, error)
+
+var contextProviders = map[string]ContextProvider{
+	"ls":           lsContextProvider,
+	"git_branch":   gitBranchContextProvider,
+	"git_status":   gitStatusContextProvider,
+	"exit_codes":   exitCodesContextProvider,
+	"uname":        unameContextProvider,
+	"env":          envContextProvider,
+	"docker_ps":    dockerPsContextProvider,
+	"kube_context": kubeContextContextProvider,
+	"kube_pods":    kubePodsContextProvider,
+	"tasks":        tasksContextProvider,
+	"env_vars":     envVarsContextProvider,
+}
+
+// Add a context provider, which can then be used in system messages with
+// the field {ctx_<name>}
+func RegisterContextProvider(name string, provider ContextProvider) {
+	contextProviders[name] = provider
+}
+
+// Fields that are filled in automatically in system messages, so that users
+// can add them to any system message in prompts.yaml. Values are only
+// computed for fields that appear in the message.
+var systemMessageFields = map[string]func(env *ContextEnv) string{
+	"os":       localField(func(*ContextEnv) string { return runtime.GOOS }),
+	"shell":    func(env *ContextEnv) string { return env.Shell },
+	"cwd":      localField(func(env *ContextEnv) string { return env.Cwd() }),
+	"datetime": func(*ContextEnv) string { return time.Now().Format(time.RFC1123) },
+	"sysinfo":  localField(func(*ContextEnv) string { return GetSystemInfo() }),
+	"platform": localField(func(*ContextEnv) string { return GetPlatform().String() }),
+	"shell_profile": localField(func(env *ContextEnv) string {
+		if env.ShellProfile == "" {
+			return "unknown"
+		}
+		return env.ShellProfile
+	}),
+}
+
+// Wrap a field that describes the local machine, during an ssh session we
+// don't know the value
+func localField(field func(env *ContextEnv) string) func(env *ContextEnv) string {
+	return func(env *ContextEnv) string {
+		if env.RemoteHost != "" {
+			return fmt.Sprintf("unknown, on remote host %s", env.RemoteHost)
+		}
+		return field(env)
+	}
+}
+
+// Context providers that still work during an ssh session, the rest look at
+// the local machine
+var remoteContextProviders = map[string]bool{
+	"exit_codes": true,
+}
+
+// Context providers that are added to shell prompts that mention them, so a
+// question like "why is my pod crashlooping" is answered with the state of
+// the cluster without the user pasting it in
+type keywordContext struct {
+	Keywords  *regexp.Regexp
+	Providers []string
+}
+
+var keywordContexts = []keywordContext{
+	{
+		Keywords:  regexp.MustCompile(`(?i)\b(docker|containers?|compose)\b`),
+		Providers: []string{"docker_ps"},
+	},
+	{
+		Keywords:  regexp.MustCompile(`(?i)\b(kubectl|kubernetes|k8s|pods?|deployments?|namespaces?|crashloop\w*|kube\w*)\b`),
+		Providers: []string{"kube_context", "kube_pods"},
+	},
+	{
+		Keywords:  regexp.MustCompile(`(?i)\b(build|compile|tests?|lint|format|deploy|release|install|bootstrap|make|npm|yarn|pnpm|just|tasks?|targets?|scripts?)\b`),
+		Providers: []string{"tasks"},
+	},
+}
+
+// Run the context providers whose keywords appear in a prompt, skipping any
+// already included in the system message. Returns text to add to the system
+// message, or an empty string if no keywords match.
+func keywordContextFor(prompt, sysMsg string, env *ContextEnv) string {
+	if env.RemoteHost != "" {
+		return ""
+	}
+
+	builder := strings.Builder{}
+	for _, keywordCtx := range keywordContexts {
+		if !keywordCtx.Keywords.MatchString(prompt) {
+			continue
+		}
+		for _, name := range keywordCtx.Providers {
+			if strings.Contains(sysMsg, "{ctx_"+name+"}") {
+				continue
+			}
+			output := runContextProvider(env, contextProviders[name])
+			fmt.Fprintf(&builder, "\n\nOutput of %s on the local machine:\n%s", name, output)
+		}
+	}
+	return builder.String()
+}
+
+// Run a context provider with a timeout, errors are included in the prompt
+// so the model knows the information is missing
+func runContextProvider(env *ContextEnv, provider ContextProvider) string {
+	ctx, cancel := context.WithTimeout(env.Ctx, contextProviderTimeout)
+	defer cancel()
+	providerEnv := *env
+	providerEnv.Ctx = ctx
+
+	output, err := provider(&providerEnv)
+	if err != nil {
+		return fmt.Sprintf("(unavailable: %s)", err)
+	}
+	output = strings.TrimRight(output, "\n")
+	if len(output) > contextProviderMaxBytes {
+		output = output[:contextProviderMaxBytes] + "\n... (truncated)"
+	}
+	return output
+}
+
+// Fill in the automatic fields and context provider fields of a system
+// message template, leaving other fields for the caller to interpolate.
+// Unknown {ctx_*} fields are left alone so interpolation reports them. The
+// values are escaped, so e.g. braces in git output aren't read as fields.
+func fillSystemMessageFields(template string, env *ContextEnv) string {
+	// a field can appear more than once, it's only computed once
+	values := map[string]string{}
+	return prompt.FillFields(template, func(name string) (string, bool) {
+		if value, ok := values[name]; ok {
+			return value, true
+		}
+		value, ok := systemMessageValue(name, env)
+		if ok {
+			values[name] = value
+		}
+		return value, ok
+	})
+}
+
+// Whether a field is an automatic or context provider field
+func isSystemMessageField(name string) bool {
+	if _, ok := systemMessageFields[name]; ok {
+		return true
+	}
+	providerName, ok := strings.CutPrefix(name, "ctx_")
+	if !ok {
+		return false
+	}
+	_, ok = contextProviders[providerName]
+	return ok
+}
+
+// The value of an automatic or context provider field, false if it's neither
+func systemMessageValue(name string, env *ContextEnv) (string, bool) {
+	if value, ok := systemMessageFields[name]; ok {
+		return value(env), true
+	}
+
+	providerName, ok := strings.CutPrefix(name, "ctx_")
+	if !ok {
+		return "", false
+	}
+	provider, ok := contextProviders[providerName]
+	if !ok {
+		return "", false
+	}
+	if env.RemoteHost != "" && !remoteContextProviders[providerName] {
+		return fmt.Sprintf("(unavailable on remote host %s)", env.RemoteHost), true
+	}
+	return runContextProvider(env, provider), true
+}
+
+func (this *ButterfishCtx) systemMessage(name string, env *ContextEnv, args ...string) (string, error) {
+	template, err := this.PromptLibrary.GetUninterpolatedPrompt(name)
+	if err != nil {
+		return "", err
+	}
+
+	template = fillSystemMessageFields(template, env)
+	sysMsg, err := this.PromptLibrary.InterpolatePrompt(template, args...)
+	if err != nil {
+		return "", err
+	}
+	return sysMsg + personaSystemNote(env) + languageSystemNote(this.Config.Language), nil
+}
+
+// The name of the user's shell, e.g. zsh
+func (this *ButterfishCtx) shellName() string {
+	return filepath.Base(this.shellPath())
+}
+
+// The user's shell, e.g. /bin/zsh
+func (this *ButterfishCtx) shellPath() string {
+	if this.Config.ShellBinary != "" {
+		return this.Config.ShellBinary
+	}
+	return os.Getenv("SHELL")
+}
+
+// The context for automatic fields outside of the shell, {cwd} is our
+// working directory
+func (this *ButterfishCtx) contextEnv() *ContextEnv {
+	env := NewContextEnv(this.Ctx, this.shellName(), func() string {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "."
+		}
+		return cwd
+	})
+	env.EnvContext = this.Config.EnvContext
+	return env
+}
+
+// Fetch a system message from the prompt library, filling in automatic fields
+// like {cwd} and {datetime} as well as the fields passed in args
+func (this *ButterfishCtx) GetSystemMessage(name string, args ...string) (string, error) {
+	return this.systemMessage(name, this.contextEnv(), args...)
+}
+
+// Fetch a prompt from the prompt library with the fields passed in args, and
+// any automatic or context provider fields like {ctx_git_status} that it
+// uses filled in
+func (this *ButterfishCtx) GetPrompt(name string, args ...string) (string, error) {
+	return this.getPrompt(name, this.contextEnv, args...)
+}
+
+// The context is only made if the prompt uses an automatic field
+func (this *ButterfishCtx) getPrompt(name string, getEnv func() *ContextEnv, args ...string) (string, error) {
+	template, err := this.PromptLibrary.GetUninterpolatedPrompt(name)
+	if err != nil {
+		return "", err
+	}
+
+	// the automatic fields are passed as arguments so the library still
+	// applies field defaults and validation, fields in args take precedence
+	passed := map[string]bool{}
+	for i := 0; i < len(args); i += 2 {
+		passed[args[i]] = true
+	}
+	var env *ContextEnv
+	for _, field := range prompt.FieldNames(template) {
+		if passed[field] || !isSystemMessageField(field) {
+			continue
+		}
+		if env == nil {
+			env = getEnv()
+		}
+		value, _ := systemMessageValue(field, env)
+		args = append(args, field, value)
+	}
+	return this.PromptLibrary.GetPrompt(name, args...)
+}
+
+func contextCommand(env *ContextEnv, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(env.Ctx, name, args...)
+	cmd.Dir = env.Cwd()
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w", name, err)
+	}
+	return string(output), nil
+}
+
+func lsContextProvider(env *ContextEnv) (string, error) {
+	return listDirTool(env.Cwd(), "")
+}
+
+// Run git for a context provider. Outside of a repository that's the
+// output, other failures like git not being installed are errors.
+func gitContextCommand(env *ContextEnv, args ...string) (string, error) {
+	output, err := contextCommand(env, "git", args...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && strings.Contains(string(exitErr.Stderr), "not a git repository") {
+		return "(not a git repository)", nil
+	}
+	return output, err
+}
+
+func gitBranchContextProvider(env *ContextEnv) (string, error) {
+	branch, err := gitContextCommand(env, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(branch), nil
+}
+
+func gitStatusContextProvider(env *ContextEnv) (string, error) {
+	return gitContextCommand(env, "status", "--short", "--branch")
+}
+
+func exitCodesContextProvider(env *ContextEnv) (string, error) {
+	if len(env.ExitCodes) == 0 {
+		return "(no commands run yet)", nil
+	}
+	codes := make([]string, len(env.ExitCodes))
+	for i, code := range env.ExitCodes {
+		codes[i] = fmt.Sprintf("%d", code)
+	}
+	return strings.Join(codes, " "), nil
+}
+
+func unameContextProvider(env *ContextEnv) (string, error) {
+	return contextCommand(env, "uname", "-a")
+}
+
+// Only a handful of environment variables are shared, the environment often
+// holds secrets like API keys
+var contextEnvVars = []string{
+	"PATH", "SHELL", "TERM", "LANG", "EDITOR", "VIRTUAL_ENV", "CONDA_DEFAULT_ENV", "GOPATH", "NODE_ENV",
+}
+
+func envContextProvider(env *ContextEnv) (string, error) {
+	builder := strings.Builder{}
+	for _, name := range contextEnvVars {
+		value := os.Getenv(name)
+		if value != "" {
+			fmt.Fprintf(&builder, "%s=%s\n", name, value)
+		}
+	}
+	return builder.String(), nil
+}
+
+func dockerPsContextProvider(env *ContextEnv) (string, error) {
+	return contextCommand(env, "docker", "ps", "--format", "table {{.Names}}\t{{.Image}}\t{{.Status}}\t{{.Ports}}")
+}
+
+func kubeContextContextProvider(env *ContextEnv) (string, error) {
+	kubeCtx, err := contextCommand(env, "kubectl", "config", "current-context")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(kubeCtx), nil
+}
+
+// Pods in the current namespace, which shows restarts and crash loops
+func kubePodsContextProvider(env *ContextEnv) (string, error) {
+	return contextCommand(env, "kubectl", "get", "pods", "-o", "wide")
+}
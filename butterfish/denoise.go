@@ -0,0 +1,136 @@
+package butterfish
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Terminal output is cleaned up before it's sent to the model as history:
+// ANSI codes are stripped, progress bars that redraw a line keep only their
+// final state, runs of progress lines and repeated lines are collapsed, and
+// binary garbage is left out. This keeps answers focused on what the output
+// says and saves tokens. The history keeps the raw output, it's cleaned when
+// it's read for a request.
+
+// Repeated lines and progress lines are collapsed in runs of at least this
+const denoiseMinRun = 3
+
+// Output read for a history block can be this many times its usual size
+// before it's denoised and truncated
+const denoiseCeilingFactor = 8
+
+// Lines with at least this share of garbage characters are binary output
+const denoiseBinaryRatio = 0.3
+
+// Progress lines have a bar like [=====>    ] or a run of block characters,
+// or a percentage on a line that was redrawn with carriage returns. A
+// percentage alone isn't enough, e.g. the Use% column of df.
+var progressBarRegexp = regexp.MustCompile(`\[[=#>\-. ]{5,}\]|[█▉▊▋▌▍▎▏▓▒░━─■□]{5,}`)
+var progressPercentRegexp = regexp.MustCompile(`\d+(\.\d+)?\s?%`)
+
+func isProgressLine(line string, redrawn bool) bool {
+	return progressBarRegexp.MatchString(line) ||
+		(redrawn && progressPercentRegexp.MatchString(line))
+}
+
+// Whether a line is mostly characters that aren't text, e.g. from cat on a
+// binary file
+func isBinaryLine(line string) bool {
+	total, garbage := 0, 0
+	for len(line) > 0 {
+		r, size := utf8.DecodeRuneInString(line)
+		line = line[size:]
+		total++
+		if (r == utf8.RuneError && size == 1) || (!unicode.IsPrint(r) && r != '\t') {
+			garbage++
+		}
+	}
+	return total >= 8 && float64(garbage)/float64(total) >= denoiseBinaryRatio
+}
+
+// What's left of a line after carriage returns redraw it, i.e. the text after
+// the last carriage return, or before it if nothing follows
+func redrawnLine(line string) string {
+	parts := strings.Split(line, "\r")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if strings.TrimSpace(parts[i]) != "" {
+			return parts[i]
+		}
+	}
+	return ""
+}
+
+// Clean up terminal output for the model, see the comment at the top
+func denoiseOutput(output string) string {
+	output = strings.ReplaceAll(stripANSI(output), "\r\n", "\n")
+	lines := strings.Split(output, "\n")
+
+	// redraws and binary output, progress[i] is whether cleaned[i] is a
+	// progress line
+	cleaned := make([]string, 0, len(lines))
+	progress := make([]bool, 0, len(lines))
+	binaryLines := 0
+	flushBinary := func() {
+		if binaryLines > 0 {
+			cleaned = append(cleaned, fmt.Sprintf("[%d lines of binary output left out]", binaryLines))
+			progress = append(progress, false)
+			binaryLines = 0
+		}
+	}
+	for _, line := range lines {
+		if isBinaryLine(line) {
+			binaryLines++
+			continue
+		}
+		flushBinary()
+		redrawn := filterNonPrintable(redrawnLine(line))
+		cleaned = append(cleaned, redrawn)
+		progress = append(progress, isProgressLine(redrawn, strings.Contains(line, "\r")))
+	}
+	flushBinary()
+
+	// runs of repeated lines and of progress lines
+	result := make([]string, 0, len(cleaned))
+	for i := 0; i < len(cleaned); {
+		line := cleaned[i]
+		end := i + 1
+		for end < len(cleaned) && cleaned[end] == line {
+			end++
+		}
+		if end-i >= denoiseMinRun && strings.TrimSpace(line) != "" {
+			result = append(result, line, fmt.Sprintf("[previous line repeated %d more times]", end-i-1))
+			i = end
+			continue
+		}
+
+		if progress[i] {
+			end = i + 1
+			for end < len(cleaned) && progress[end] {
+				end++
+			}
+			if end-i >= denoiseMinRun {
+				// the last progress line has the final state
+				result = append(result, fmt.Sprintf("[%d progress lines left out]", end-i-1), cleaned[end-1])
+				i = end
+				continue
+			}
+		}
+
+		result = append(result, line)
+		i++
+	}
+
+	return strings.Join(result, "\n")
+}
+
+// Clean up the content of a history block for the model, only command output
+// is denoised, other blocks only have ANSI codes removed
+func denoiseHistoryContent(blockType int, content string) string {
+	if blockType == historyTypeShellOutput || blockType == historyTypeToolOutput {
+		return denoiseOutput(content)
+	}
+	return sanitizeTTYString(content)
+}
@@ -0,0 +1,172 @@
+package butterfish
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// DiffHunk is a contiguous group of changed lines plus surrounding context,
+// as it would appear in a unified diff. Lines are prefixed with ' ' for
+// context, '-' for removed lines, and '+' for added lines.
+type DiffHunk struct {
+	OldStart int // 1-indexed as in a unified diff header
+	OldCount int
+	NewStart int
+	NewCount int
+	Lines    []string
+
+	oldIndex int // 0-indexed start of the hunk in the old lines
+}
+
+// The unified diff header, e.g. @@ -1,4 +1,5 @@
+func (this *DiffHunk) Header() string {
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", this.OldStart, this.OldCount, this.NewStart, this.NewCount)
+}
+
+func (this *DiffHunk) String() string {
+	return this.Header() + "\n" + strings.Join(this.Lines, "\n") + "\n"
+}
+
+// diffmatchpatch diffs runes, so we map each distinct line to a rune and diff
+// those. We skip the surrogate range since those aren't valid runes.
+func lineToRune(id int) rune {
+	if id >= 0xd800 {
+		id += 0x800
+	}
+	return rune(id)
+}
+
+// Compute a line by line diff between a and b, returns the lines prefixed
+// with ' ', '-', or '+'
+func diffLines(a, b []string) []string {
+	ids := map[string]rune{}
+	lines := map[rune]string{}
+	toRunes := func(strs []string) []rune {
+		runes := make([]rune, len(strs))
+		for i, str := range strs {
+			r, ok := ids[str]
+			if !ok {
+				r = lineToRune(len(ids) + 1)
+				ids[str] = r
+				lines[r] = str
+			}
+			runes[i] = r
+		}
+		return runes
+	}
+
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffMainRunes(toRunes(a), toRunes(b), false)
+
+	result := []string{}
+	for _, diff := range diffs {
+		prefix := " "
+		switch diff.Type {
+		case diffmatchpatch.DiffDelete:
+			prefix = "-"
+		case diffmatchpatch.DiffInsert:
+			prefix = "+"
+		}
+		for _, r := range diff.Text {
+			result = append(result, prefix+lines[r])
+		}
+	}
+
+	return result
+}
+
+// Group the differences between a and b into hunks, with up to context
+// unchanged lines around each change
+func DiffHunks(a, b []string, context int) []*DiffHunk {
+	lines := diffLines(a, b)
+
+	// find ranges of diff lines that make up each hunk, changes that are close
+	// enough for their context to overlap go in the same hunk
+	type span struct{ start, end int }
+	spans := []span{}
+	for i, line := range lines {
+		if line[0] == ' ' {
+			continue
+		}
+		start := max(i-context, 0)
+		end := min(i+1+context, len(lines))
+		if len(spans) > 0 && start <= spans[len(spans)-1].end {
+			spans[len(spans)-1].end = end
+		} else {
+			spans = append(spans, span{start, end})
+		}
+	}
+
+	hunks := []*DiffHunk{}
+	oldIndex, newIndex := 0, 0
+	pos := 0
+	for _, span := range spans {
+		// count lines up to the start of the hunk
+		for ; pos < span.start; pos++ {
+			if lines[pos][0] != '+' {
+				oldIndex++
+			}
+			if lines[pos][0] != '-' {
+				newIndex++
+			}
+		}
+
+		hunk := &DiffHunk{
+			Lines:    lines[span.start:span.end],
+			oldIndex: oldIndex,
+		}
+		for _, line := range hunk.Lines {
+			if line[0] != '+' {
+				hunk.OldCount++
+			}
+			if line[0] != '-' {
+				hunk.NewCount++
+			}
+		}
+
+		// unified diffs use the line before the hunk if it's empty
+		hunk.OldStart = oldIndex + 1
+		if hunk.OldCount == 0 {
+			hunk.OldStart = oldIndex
+		}
+		hunk.NewStart = newIndex + 1
+		if hunk.NewCount == 0 {
+			hunk.NewStart = newIndex
+		}
+
+		hunks = append(hunks, hunk)
+	}
+
+	return hunks
+}
+
+// Apply a subset of the hunks computed from a, returning the new lines. Hunks
+// must be in order.
+func ApplyHunks(a []string, hunks []*DiffHunk) []string {
+	result := []string{}
+	pos := 0
+
+	for _, hunk := range hunks {
+		result = append(result, a[pos:hunk.oldIndex]...)
+		for _, line := range hunk.Lines {
+			if line[0] != '-' {
+				result = append(result, line[1:])
+			}
+		}
+		pos = hunk.oldIndex + hunk.OldCount
+	}
+
+	return append(result, a[pos:]...)
+}
+
+// Render hunks as a unified diff of the file at path
+func UnifiedDiff(path string, hunks []*DiffHunk) string {
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "--- a/%s\n+++ b/%s\n", path, path)
+	for _, hunk := range hunks {
+		builder.WriteString(hunk.String())
+	}
+	return builder.String()
+}
@@ -0,0 +1,149 @@
+package butterfish
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// EncryptionConfig turns on encryption at rest for files that can hold
+// sensitive shell output: the command history, the saved shell session,
+// checkpoints, learned fixes, and embedding index files. Set in the config
+// file, e.g.
+//
+//	encryption:
+//	  key_env: BUTTERFISH_ENCRYPTION_KEY
+//
+// Use `encryption: {}` to keep the key in the OS keychain, which is created on
+// first use. Files written before encryption was turned on can still be read,
+// and files are encrypted the next time they're written.
+type EncryptionConfig struct {
+	// Environment variable holding a base64 encoded 32 byte key, if empty the
+	// key is kept in the OS keychain (macOS Keychain or Linux Secret Service)
+	KeyEnv string `yaml:"key_env"`
+}
+
+const (
+	keychainService = "butterfish"
+	keychainAccount = "encryption-key"
+)
+
+// Look up the key in the OS keychain, returns an empty string if it isn't
+// there. Other failures, e.g. a locked keychain, are errors, since reading
+// them as a missing key would replace the key files were encrypted with.
+func keychainLookup() (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password",
+			"-s", keychainService, "-a", keychainAccount, "-w")
+	case "linux":
+		cmd = exec.Command("secret-tool", "lookup",
+			"service", keychainService, "account", keychainAccount)
+	default:
+		return "", fmt.Errorf("No supported keychain on %s, set encryption key_env in the config file", runtime.GOOS)
+	}
+
+	_, err := exec.LookPath(cmd.Path)
+	if err != nil {
+		return "", fmt.Errorf("%s is needed to store the encryption key, or set encryption key_env in the config file", cmd.Args[0])
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return "", err
+		}
+		if keychainNotFound(runtime.GOOS, exitErr.ExitCode(), string(exitErr.Stderr)) {
+			return "", nil
+		}
+		return "", fmt.Errorf("Error reading the encryption key from the keychain with %s: %s %s",
+			cmd.Args[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Whether a failed keychain lookup means there's no key. security exits with
+// 44 (errSecItemNotFound), secret-tool exits with 1 without saying anything,
+// it prints a message for other failures.
+func keychainNotFound(goos string, exitCode int, stderr string) bool {
+	if goos == "darwin" {
+		return exitCode == 44
+	}
+	return exitCode == 1 && strings.TrimSpace(stderr) == ""
+}
+
+func keychainStore(key string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// -w without a value as the last argument makes security prompt for
+		// the password, and retype it, on stdin, so the key isn't in argv
+		// where ps shows it to other users
+		cmd = exec.Command("security", "add-generic-password",
+			"-s", keychainService, "-a", keychainAccount, "-w")
+		cmd.Stdin = strings.NewReader(key + "\n" + key + "\n")
+	default:
+		// secret-tool reads the secret from stdin
+		cmd = exec.Command("secret-tool", "store", "--label=butterfish encryption key",
+			"service", keychainService, "account", keychainAccount)
+		cmd.Stdin = strings.NewReader(key)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error storing the encryption key in the keychain: %s %s", err, output)
+	}
+	return nil
+}
+
+// Get the encryption key from the environment or the keychain, creating it
+// in the keychain if it doesn't exist
+func loadEncryptionKey(config *EncryptionConfig) ([]byte, error) {
+	var encoded string
+	if config.KeyEnv != "" {
+		encoded = os.Getenv(config.KeyEnv)
+		if encoded == "" {
+			return nil, fmt.Errorf("encryption key_env %s is not set", config.KeyEnv)
+		}
+	} else {
+		var err error
+		encoded, err = keychainLookup()
+		if err != nil {
+			return nil, err
+		}
+		if encoded == "" {
+			key, err := util.NewCipherKey()
+			if err != nil {
+				return nil, err
+			}
+			encoded = base64.StdEncoding.EncodeToString(key)
+			err = keychainStore(encoded)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("The encryption key must be base64 encoded")
+	}
+	return key, nil
+}
+
+func NewConfiguredCipher(config *EncryptionConfig) (*util.Cipher, error) {
+	if config == nil {
+		return nil, nil
+	}
+	key, err := loadEncryptionKey(config)
+	if err != nil {
+		return nil, err
+	}
+	return util.NewCipher(key)
+}
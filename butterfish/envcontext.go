@@ -0,0 +1,116 @@
+package butterfish
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// EnvContextConfig configures the env_vars context provider, which lists the
+// environment variables and the variables in .env files so the model knows
+// which configuration knobs exist. It's opt-in: add {ctx_env_vars} to a
+// system message in prompts.yaml to use it. Values are masked unless the
+// variable is in the unmasked list. Set in the config file, e.g.
+//
+//	env_context:
+//	  dotenv: [.env, .env.local]
+//	  unmasked: [NODE_ENV, PORT, "AWS_*"]
+type EnvContextConfig struct {
+	// Files to read variables from, relative to the shell's directory,
+	// defaults to .env
+	Dotenv []string `yaml:"dotenv"`
+	// Variables whose values are shown, may use * wildcards
+	Unmasked []string `yaml:"unmasked"`
+}
+
+const envMaskedValue = "****"
+
+// Shell bookkeeping variables that aren't configuration
+var envContextSkipVars = map[string]bool{
+	"_": true, "PWD": true, "OLDPWD": true, "SHLVL": true, "PS1": true, "PS2": true, "LS_COLORS": true,
+}
+
+var defaultEnvContextConfig = &EnvContextConfig{}
+
+func (this *EnvContextConfig) Validate() error {
+	for _, pattern := range this.Unmasked {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("env_context unmasked has a bad pattern %s", pattern)
+		}
+	}
+	return nil
+}
+
+func (this *EnvContextConfig) dotenvFiles() []string {
+	if len(this.Dotenv) == 0 {
+		return []string{".env"}
+	}
+	return this.Dotenv
+}
+
+func (this *EnvContextConfig) isUnmasked(name string) bool {
+	for _, pattern := range this.Unmasked {
+		match, err := path.Match(pattern, name)
+		if err == nil && match {
+			return true
+		}
+	}
+	return false
+}
+
+// Format variables one per line sorted by name, masking values that aren't
+// unmasked
+func (this *EnvContextConfig) formatVars(builder *strings.Builder, vars map[string]string) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		if !envContextSkipVars[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := envMaskedValue
+		if this.isUnmasked(name) {
+			value = vars[name]
+		}
+		fmt.Fprintf(builder, "%s=%s\n", name, value)
+	}
+}
+
+// The env_vars provider, with the settings from the user's config
+func envVarsContextProvider(env *ContextEnv) (string, error) {
+	if env.EnvContext == nil {
+		return defaultEnvContextConfig.Provider(env)
+	}
+	return env.EnvContext.Provider(env)
+}
+
+// List the variables in the dotenv files, then the environment. Output is
+// truncated like other providers, so the dotenv files come first since
+// they're specific to the project.
+func (this *EnvContextConfig) Provider(env *ContextEnv) (string, error) {
+	builder := strings.Builder{}
+	for _, file := range this.dotenvFiles() {
+		vars, err := godotenv.Read(resolveToolPath(env.Cwd(), file))
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&builder, "Variables in %s:\n", file)
+		this.formatVars(&builder, vars)
+	}
+
+	vars := map[string]string{}
+	for _, pair := range os.Environ() {
+		name, value, _ := strings.Cut(pair, "=")
+		vars[name] = value
+	}
+	builder.WriteString("Environment variables:\n")
+	this.formatVars(&builder, vars)
+	return builder.String(), nil
+}
@@ -0,0 +1,122 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Options for butterfish exec: a timeout for the command, retries for flaky
+// commands before asking for a fix, and how much of the output is sent to
+// the LLM, so that a noisy command doesn't fill the context window.
+type execOptions struct {
+	Timeout time.Duration
+	Retries int
+	Capture outputCapture
+}
+
+// The exit status we report for a command that timed out, as timeout(1) does
+const execTimeoutStatus = 124
+
+// Captured lines longer than this are cut short
+const captureMaxLineLength = 500
+
+const (
+	captureTail   = "tail"
+	captureHead   = "head"
+	captureSample = "sample"
+	captureAll    = "all"
+)
+
+// How much of a command's output is captured: the first or last Lines
+// lines, a sample of Lines lines from the start, middle, and end, or all of
+// it
+type outputCapture struct {
+	Mode  string
+	Lines int
+}
+
+// The part of output to send to the LLM, with markers where lines were left
+// out
+func (this outputCapture) Apply(output string) string {
+	output = stripANSI(strings.TrimRight(output, "\n"))
+	if output == "" {
+		return ""
+	}
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		if runes := []rune(line); len(runes) > captureMaxLineLength {
+			lines[i] = string(runes[:captureMaxLineLength]) + "..."
+		}
+	}
+
+	n := this.Lines
+	total := len(lines)
+	if this.Mode == captureAll || n <= 0 || total <= n {
+		return strings.Join(lines, "\n")
+	}
+
+	omitted := func(count int) string {
+		return fmt.Sprintf("[... %d lines left out ...]", count)
+	}
+	captured := []string{}
+	switch this.Mode {
+	case captureHead:
+		captured = append(captured, lines[:n]...)
+		captured = append(captured, omitted(total-n))
+	case captureSample:
+		// a third each from the start and end, and lines spread evenly
+		// through the middle
+		edge := n / 3
+		middle := lines[edge : total-edge]
+		picks := n - 2*edge
+		captured = append(captured, lines[:edge]...)
+		captured = append(captured, fmt.Sprintf("[... %d of the next %d lines, evenly spaced ...]", picks, len(middle)))
+		for i := 0; i < picks; i++ {
+			captured = append(captured, middle[i*len(middle)/picks])
+		}
+		captured = append(captured, omitted(len(middle)-picks))
+		captured = append(captured, lines[total-edge:]...)
+	default:
+		captured = append(captured, omitted(total-n))
+		captured = append(captured, lines[total-n:]...)
+	}
+	return strings.Join(captured, "\n")
+}
+
+// Run a command, killing it if it runs past the timeout, in which case the
+// result has execTimeoutStatus
+func (this *ButterfishCtx) execCommandWithTimeout(cmd string, timeout time.Duration) (*executeResult, error) {
+	if timeout <= 0 {
+		return this.execCommand(cmd)
+	}
+
+	ctx, cancel := context.WithTimeout(this.Ctx, timeout)
+	defer cancel()
+	if this.Config.Verbose > 0 {
+		this.StylePrintf(this.Config.Styles.Question, "exec> %s\n", cmd)
+	}
+	result, err := executeCommand(ctx, cmd, this.Out)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && this.Ctx.Err() == nil {
+		if result == nil {
+			result = &executeResult{}
+		}
+		result.Status = execTimeoutStatus
+		result.TimedOut = true
+		return result, nil
+	}
+	return result, err
+}
+
+// Run a command, running it again up to Retries times if it fails
+func (this *ButterfishCtx) execWithRetries(cmd string, options execOptions) (*executeResult, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := this.execCommandWithTimeout(cmd, options.Timeout)
+		if err != nil || result.Status == 0 || attempt >= options.Retries {
+			return result, err
+		}
+		this.ErrorPrintf("%s, retrying (%d/%d)...\n", result.Failure(options.Timeout), attempt+1, options.Retries)
+	}
+}
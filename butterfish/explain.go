@@ -0,0 +1,159 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+// Limits for pulling documentation for the explain command
+const (
+	explainDocTimeout     = 5 * time.Second
+	explainMaxDocBytes    = 12000
+	explainHeaderLines    = 20
+	explainMaxOptionLines = 12
+)
+
+// Man pages render bold and underline with backspace overstrikes, e.g.
+// "N\bNA\bAM\bME\bE", strip those so we have plain text
+var overstrikeRegex = regexp.MustCompile(".\x08")
+
+// Find the flags used in a command, e.g. "ls -la --color=auto" gives
+// -l, -a, -la, and --color
+func commandFlags(fields []string) []string {
+	flags := []string{}
+	for _, field := range fields {
+		if !strings.HasPrefix(field, "-") || field == "-" || field == "--" {
+			continue
+		}
+
+		flag, _, _ := strings.Cut(field, "=")
+		flags = append(flags, flag)
+
+		// split combined short flags like -la
+		if !strings.HasPrefix(flag, "--") && len(flag) > 2 {
+			for _, char := range flag[1:] {
+				flags = append(flags, "-"+string(char))
+			}
+		}
+	}
+	return flags
+}
+
+func runDocCommand(ctx context.Context, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, explainDocTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), "MANPAGER=cat", "PAGER=cat", "MANWIDTH=100")
+	// some commands print --help to stderr
+	output, err := cmd.CombinedOutput()
+	text := overstrikeRegex.ReplaceAllString(string(output), "")
+	if strings.TrimSpace(text) == "" && err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// Fetch local documentation for a command, trying the man page for the
+// subcommand (e.g. git-commit), then the command's man page, then --help.
+// Returns the documentation and a description of where it came from.
+func commandDocs(ctx context.Context, fields []string) (string, string, error) {
+	if len(fields) == 0 {
+		return "", "", errors.New("No command to explain")
+	}
+
+	name := filepath.Base(fields[0])
+	candidates := [][]string{}
+	if len(fields) > 1 && !strings.HasPrefix(fields[1], "-") {
+		candidates = append(candidates, []string{"man", name + "-" + fields[1]})
+	}
+	candidates = append(candidates, []string{"man", name})
+
+	// Only fall back to running --help for commands on the PATH, we don't
+	// want to run local scripts that might not understand the flag
+	if !strings.Contains(fields[0], "/") {
+		if _, err := exec.LookPath(fields[0]); err == nil {
+			candidates = append(candidates, []string{fields[0], "--help"})
+		}
+	}
+
+	for _, candidate := range candidates {
+		docs, err := runDocCommand(ctx, candidate[0], candidate[1:]...)
+		if err == nil && strings.TrimSpace(docs) != "" {
+			return docs, strings.Join(candidate, " "), nil
+		}
+	}
+
+	return "", "", fmt.Errorf("No man page or --help output found for %s", name)
+}
+
+// Pick the parts of the documentation relevant to a command, i.e. the
+// start of the doc (name and synopsis) and the description of each flag used
+func relevantDocExcerpts(docs string, flags []string, maxBytes int) string {
+	lines := strings.Split(docs, "\n")
+	builder := strings.Builder{}
+
+	header := lines[:min(explainHeaderLines, len(lines))]
+	builder.WriteString(strings.Join(header, "\n"))
+	builder.WriteString("\n")
+
+	seen := map[int]bool{}
+	for _, flag := range flags {
+		// match the flag where it's defined, i.e. at the start of an indented
+		// line, and not as a prefix of a longer flag
+		pattern := regexp.MustCompile(`^\s*(-\S+,\s+)*` + regexp.QuoteMeta(flag) + `([^\w-]|$)`)
+
+		for i, line := range lines {
+			if seen[i] || !pattern.MatchString(line) {
+				continue
+			}
+
+			builder.WriteString("...\n")
+			for j := i; j < len(lines) && j < i+explainMaxOptionLines; j++ {
+				if j > i && strings.TrimSpace(lines[j]) == "" {
+					break
+				}
+				seen[j] = true
+				builder.WriteString(lines[j])
+				builder.WriteString("\n")
+			}
+			break
+		}
+	}
+
+	excerpts := builder.String()
+	if len(seen) == 0 {
+		// no flags matched, fall back to the start of the doc
+		excerpts = docs
+	}
+	if len(excerpts) > maxBytes {
+		excerpts = excerpts[:maxBytes]
+	}
+	return excerpts
+}
+
+// Build the prompt to explain a command, with documentation excerpts pulled
+// from man pages or --help output
+func (this *ButterfishCtx) explainPrompt(ctx context.Context, command string) (string, error) {
+	fields := strings.Fields(command)
+	docs, source, err := commandDocs(ctx, fields)
+	if err != nil {
+		// we can still explain without docs
+		docs = "(no local documentation found)"
+		source = "none"
+	} else {
+		docs = relevantDocExcerpts(docs, commandFlags(fields), explainMaxDocBytes)
+	}
+
+	return this.GetPrompt(prompt.PromptExplainCommand,
+		"command", command, "source", source, "docs", docs)
+}
@@ -0,0 +1,150 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// FailoverConfig configures a secondary provider and/or model to switch to
+// when the primary keeps failing, set in the config file, e.g.
+//
+//	failover:
+//	  base_url: https://openrouter.ai/api/v1
+//	  api_key_env: OPENROUTER_API_KEY
+//	  model: openai/gpt-4o-mini
+//	  after_failures: 3
+type FailoverConfig struct {
+	// Base URL of an OpenAI-compatible API, defaults to the primary's
+	BaseURL string `yaml:"base_url"`
+	// Environment variable holding the API key, defaults to the primary's key
+	APIKeyEnv string `yaml:"api_key_env"`
+	// Model to use instead of the requested model, if empty we keep the model
+	Model string `yaml:"model"`
+	// Number of failed calls in a row before we fail over
+	AfterFailures int `yaml:"after_failures"`
+}
+
+const defaultFailoverAfterFailures = 3
+
+// An LLM implementation that sends requests to a primary LLM and switches to
+// a secondary after a number of consecutive transient failures (i.e. failures
+// that were already retried with backoff). Once we've failed over we stay on
+// the secondary for the rest of the session.
+type FailoverLLM struct {
+	Primary        LLM
+	Secondary      LLM
+	SecondaryModel string
+	AfterFailures  int
+
+	mutex      sync.Mutex
+	failures   int
+	failedOver bool
+	// A notice to print at the start of the next streamed response
+	notice string
+}
+
+func NewFailoverLLM(primary, secondary LLM, secondaryModel string, afterFailures int) *FailoverLLM {
+	if afterFailures <= 0 {
+		afterFailures = defaultFailoverAfterFailures
+	}
+	return &FailoverLLM{
+		Primary:        primary,
+		Secondary:      secondary,
+		SecondaryModel: secondaryModel,
+		AfterFailures:  afterFailures,
+	}
+}
+
+// Record the result of a call to the primary, returns true if we should
+// fail over and retry the call on the secondary
+func (this *FailoverLLM) recordPrimaryResult(err error) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !isTransientError(err) {
+		if err == nil {
+			this.failures = 0
+		}
+		return false
+	}
+
+	this.failures++
+	if this.failures < this.AfterFailures || this.failedOver {
+		return false
+	}
+
+	this.failedOver = true
+	this.notice = fmt.Sprintf("The primary LLM API failed %d times in a row, switching to the failover", this.failures)
+	if this.SecondaryModel != "" {
+		this.notice += fmt.Sprintf(" with model %s", this.SecondaryModel)
+	}
+	this.notice += " for the rest of the session."
+	log.Println(this.notice)
+	return true
+}
+
+func (this *FailoverLLM) isFailedOver() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.failedOver
+}
+
+func (this *FailoverLLM) takeNotice() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	notice := this.notice
+	this.notice = ""
+	return notice
+}
+
+func (this *FailoverLLM) secondaryRequest(request *util.CompletionRequest) *util.CompletionRequest {
+	if this.SecondaryModel == "" {
+		return request
+	}
+	secondary := *request
+	secondary.Model = this.SecondaryModel
+	return &secondary
+}
+
+func (this *FailoverLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	if !this.isFailedOver() {
+		response, err := this.Primary.CompletionStream(request, writer)
+		// if we streamed part of an answer then retrying would repeat it
+		partial := response != nil && response.Completion != ""
+		if !this.recordPrimaryResult(err) || partial {
+			return response, err
+		}
+	}
+
+	if notice := this.takeNotice(); notice != "" {
+		fmt.Fprintf(writer, "[%s]\n", notice)
+	}
+	return this.Secondary.CompletionStream(this.secondaryRequest(request), writer)
+}
+
+func (this *FailoverLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	if !this.isFailedOver() {
+		response, err := this.Primary.Completion(request)
+		if !this.recordPrimaryResult(err) {
+			return response, err
+		}
+	}
+
+	return this.Secondary.Completion(this.secondaryRequest(request))
+}
+
+// Embeddings always use the primary since an index must be built with a
+// single embedding model
+func (this *FailoverLLM) Embeddings(request *util.EmbeddingRequest) ([][]float32, error) {
+	return this.Primary.Embeddings(request)
+}
+
+// Transcriptions use the primary, the secondary model is for completions
+func (this *FailoverLLM) Transcribe(ctx context.Context, path, model, language string) (string, error) {
+	return transcribeWith(this.Primary, ctx, path, model, language)
+}
@@ -0,0 +1,328 @@
+package butterfish
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/storage"
+	"github.com/bakks/butterfish/util"
+	"github.com/mitchellh/go-homedir"
+)
+
+// With --learn-fixes, when a command fails and the user then runs a command
+// the model suggested (an accepted autosuggest, or a command from the last
+// answer) that succeeds, the pair is saved to a local file: a fingerprint of
+// the error and the command that fixed it. When a later command fails with
+// the same fingerprint the saved fix is shown and offered as the
+// autosuggest, without calling the model.
+
+const (
+	defaultFixesPath = "~/.config/butterfish/fixes.json"
+	// A suggested command only counts as a fix within this many commands of
+	// the failure
+	fixMaxCommandsAfter = 5
+	// Error lines that make up a fingerprint
+	fixErrorLines = 3
+)
+
+// A command that fixed an error before
+type KnownFix struct {
+	Fingerprint string `json:"fingerprint"`
+	Program     string `json:"program"`
+	// The error lines of the first failure, for reading the file
+	Error    string    `json:"error"`
+	Fix      string    `json:"fix"`
+	Count    int       `json:"count"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// FixKnowledgeBase is a file of KnownFixes keyed by fingerprint
+type FixKnowledgeBase struct {
+	Path string
+	// Encrypts the file if set, see encryption.go
+	Cipher *util.Cipher
+	mutex  sync.Mutex
+}
+
+func NewFixKnowledgeBase(path string) (*FixKnowledgeBase, error) {
+	if path == "" {
+		path = defaultFixesPath
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FixKnowledgeBase{Path: path}, nil
+}
+
+func (this *FixKnowledgeBase) load() (map[string]*KnownFix, error) {
+	fixes := map[string]*KnownFix{}
+	data, err := os.ReadFile(this.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fixes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err = this.Cipher.Decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &fixes)
+	if err != nil {
+		return nil, err
+	}
+	return fixes, nil
+}
+
+// The fix for an error fingerprint, nil if there isn't one
+func (this *FixKnowledgeBase) Lookup(fingerprint string) (*KnownFix, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	fixes, err := this.load()
+	if err != nil {
+		return nil, err
+	}
+	return fixes[fingerprint], nil
+}
+
+// Save a fix for an error, replacing an earlier fix for the same fingerprint
+func (this *FixKnowledgeBase) Record(fingerprint, program, errorText, fix string) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	fixes, err := this.load()
+	if err != nil {
+		return err
+	}
+	known := fixes[fingerprint]
+	if known == nil || known.Fix != fix {
+		known = &KnownFix{Fingerprint: fingerprint, Program: program, Error: errorText, Fix: fix}
+		fixes[fingerprint] = known
+	}
+	known.Count++
+	known.LastUsed = time.Now()
+
+	data, err := json.MarshalIndent(fixes, "", "  ")
+	if err != nil {
+		return err
+	}
+	data, err = this.Cipher.Encrypt(data)
+	if err != nil {
+		return err
+	}
+	// errors and commands can contain secrets, so only the user can read it,
+	// which is the disk store's default
+	return storage.NewDiskStore("").Put(context.Background(), this.Path, data)
+}
+
+var (
+	errorLineRegex   = regexp.MustCompile(`(?i)error|fatal|fail|denied|not found|no such|cannot|can't|unable|invalid|unknown|missing|refused|exception|panic|traceback`)
+	fixPathRegex     = regexp.MustCompile(`(?:~|\.{1,2})?/[^\s'"():,]+`)
+	fixHexRegex      = regexp.MustCompile(`\b(?:0x[0-9a-f]+|[0-9a-f]{7,})\b`)
+	fixNumberRegex   = regexp.MustCompile(`[0-9]+`)
+	fixWhitespaceRgx = regexp.MustCompile(`\s+`)
+	fixInlineCode    = regexp.MustCompile("`([^`\n]+)`")
+)
+
+// The lines of a command's output that describe its error, or the last line
+// if none look like an error
+func errorLines(output string) string {
+	lines := []string{}
+	last := ""
+	for _, line := range strings.Split(denoiseOutput(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		last = line
+		if len(lines) < fixErrorLines && errorLineRegex.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return last
+	}
+	return strings.Join(lines, "\n")
+}
+
+// A fingerprint of an error that ignores the parts that change between
+// runs: paths, numbers, and hashes. Names in the error, like a missing
+// module, are kept since the fix usually depends on them.
+func errorFingerprint(program, errorText string) string {
+	normalized := strings.ToLower(errorText)
+	normalized = fixPathRegex.ReplaceAllString(normalized, "<path>")
+	normalized = fixHexRegex.ReplaceAllString(normalized, "<hex>")
+	normalized = fixNumberRegex.ReplaceAllString(normalized, "<n>")
+	normalized = fixWhitespaceRgx.ReplaceAllString(normalized, " ")
+	hash := sha256.Sum256([]byte(program + "\n" + normalized))
+	return hex.EncodeToString(hash[:8])
+}
+
+// The program a command runs, skipping wrappers like sudo
+func fixProgram(command string) string {
+	fields := programFields(strings.Fields(command))
+	if len(fields) == 0 {
+		return ""
+	}
+	return filepath.Base(fields[0])
+}
+
+// Whether an answer suggests the command, as a line of its own, e.g. in a code
+// block, or as inline code. A $ prompt before it is ignored.
+func answerHasCommand(answer, command string) bool {
+	matches := func(text string) bool {
+		text = strings.TrimSpace(text)
+		return strings.TrimSpace(strings.TrimPrefix(text, "$ ")) == command
+	}
+	for _, line := range strings.Split(answer, "\n") {
+		if matches(line) {
+			return true
+		}
+	}
+	for _, match := range fixInlineCode.FindAllStringSubmatch(answer, -1) {
+		if matches(match[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the last answer in the history suggested the command
+func (this *ShellHistory) answerSuggests(command string) bool {
+	command = strings.TrimSpace(command)
+	if len(command) < 2 {
+		return false
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for i := len(this.Blocks) - 1; i >= 0; i-- {
+		if this.Blocks[i].Type == historyTypeLLMOutput {
+			return answerHasCommand(this.Blocks[i].Content.String(), command)
+		}
+	}
+	return false
+}
+
+// A failed command that a later suggested command might fix
+type failedCommand struct {
+	Command     string
+	Program     string
+	Error       string
+	Fingerprint string
+	// Successful commands run since the failure
+	CommandsSince int
+}
+
+// Called when a command is submitted, notes whether it was suggested by the
+// model after a failure so LearnFix can record it if it succeeds
+func (this *ShellState) WatchFix(command string) {
+	suggested := this.CommandFromSuggestion || this.History.answerSuggests(command)
+	this.CommandFromSuggestion = false
+	this.KnownFix = ""
+	this.FixCandidate = ""
+	command = strings.TrimSpace(command)
+	if this.FailedCommand != nil && suggested && command != this.FailedCommand.Command {
+		this.FixCandidate = command
+	}
+}
+
+// Called when a command finishes. A failure is fingerprinted and, if a fix
+// is known, offered. A success that followed a failure and was suggested by
+// the model is recorded as the fix.
+func (this *ShellState) LearnFix(exitCode int) {
+	if this.Fixes == nil {
+		fixes, err := NewFixKnowledgeBase("")
+		if err != nil {
+			log.Printf("Error opening fixes: %s", err)
+			return
+		}
+		fixes.Cipher = this.Butterfish.Cipher
+		this.Fixes = fixes
+	}
+	command, output := this.History.LastCommand()
+	candidate := this.FixCandidate
+	this.FixCandidate = ""
+
+	if exitCode == 0 {
+		failed := this.FailedCommand
+		if failed == nil {
+			return
+		}
+		if candidate == "" {
+			failed.CommandsSince++
+			if failed.CommandsSince >= fixMaxCommandsAfter {
+				this.FailedCommand = nil
+			}
+			return
+		}
+		err := this.Fixes.Record(failed.Fingerprint, failed.Program, failed.Error, candidate)
+		if err != nil {
+			log.Printf("Error recording fix: %s", err)
+		}
+		this.FailedCommand = nil
+		return
+	}
+
+	// an interrupted command didn't fail on its own
+	if exitCode == 130 {
+		return
+	}
+	errorText := errorLines(output)
+	if errorText == "" {
+		this.FailedCommand = nil
+		return
+	}
+	program := fixProgram(command)
+	this.FailedCommand = &failedCommand{
+		Command:     command,
+		Program:     program,
+		Error:       errorText,
+		Fingerprint: errorFingerprint(program, errorText),
+	}
+
+	known, err := this.Fixes.Lookup(this.FailedCommand.Fingerprint)
+	if err != nil {
+		log.Printf("Error looking up fix: %s", err)
+		return
+	}
+	if known == nil || known.Fix == command {
+		return
+	}
+	this.KnownFix = known.Fix
+	select {
+	case this.AnnotationChan <- "fixed this before with: " + known.Fix:
+	default:
+	}
+	this.RequestAutosuggest(0, "")
+}
+
+// Offer the known fix as the autosuggest rather than asking the model
+func (this *ShellState) suggestKnownFix() {
+	if this.AutosuggestCancel != nil {
+		this.AutosuggestCancel()
+	}
+	this.AutosuggestCtx, this.AutosuggestCancel = context.WithCancel(context.Background())
+	this.PendingAutosuggest = nil
+	result := &AutosuggestResult{Suggestion: this.KnownFix}
+	ctx := this.AutosuggestCtx
+	go func() {
+		select {
+		case this.AutosuggestChan <- result:
+		case <-ctx.Done():
+		}
+	}()
+}
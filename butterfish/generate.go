@@ -0,0 +1,232 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// The generate command scaffolds files from a prompt library template. The
+// template can use the fields {instructions}, {output}, {context} (snippets
+// from the embeddings index of the current directory), and {existing} (the
+// current content of the output file, if any). When the output is a directory
+// the model can write several files, each starting with a marker line.
+
+// Marks the start of a file in a multi-file response, e.g.
+// === FILE: cmd/main.go ===
+var generatedFileMarkerRegex = regexp.MustCompile(`(?m)^=== FILE: (.+?) ===\s*$`)
+
+// A file to be written by the generate command
+type GeneratedFile struct {
+	Path    string
+	Content string
+}
+
+// Strip a markdown code block around generated content, models often add
+// one even when asked not to
+func stripCodeFence(content string) string {
+	trimmed := strings.TrimSpace(content)
+	if !strings.HasPrefix(trimmed, "```") {
+		return content
+	}
+	_, body, _ := strings.Cut(trimmed, "\n")
+	if end := strings.LastIndex(body, "```"); end >= 0 {
+		body = body[:end]
+	}
+	return body
+}
+
+// Split a response into files. If the output is a directory the response
+// should contain file markers with paths relative to it, which must stay
+// inside the directory. Otherwise the whole response is the output file.
+func parseGeneratedFiles(response, output string, outputIsDir bool) ([]GeneratedFile, error) {
+	if !outputIsDir {
+		content := strings.TrimRight(stripCodeFence(response), "\n") + "\n"
+		return []GeneratedFile{{Path: output, Content: content}}, nil
+	}
+
+	markers := generatedFileMarkerRegex.FindAllStringSubmatchIndex(response, -1)
+	if len(markers) == 0 {
+		return nil, errors.New("The response didn't contain any file markers, try asking for specific files")
+	}
+
+	files := []GeneratedFile{}
+	for i, marker := range markers {
+		name := strings.TrimSpace(response[marker[2]:marker[3]])
+		path := filepath.Join(output, name)
+		relative, err := filepath.Rel(output, path)
+		if filepath.IsAbs(name) || err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("Generated file %s is outside of %s", name, output)
+		}
+
+		end := len(response)
+		if i+1 < len(markers) {
+			end = markers[i+1][0]
+		}
+		content := strings.TrimRight(stripCodeFence(response[marker[1]:end]), "\n") + "\n"
+		files = append(files, GeneratedFile{Path: path, Content: strings.TrimLeft(content, "\n")})
+	}
+	return files, nil
+}
+
+// Snippets from the embeddings index that are relevant to the instructions,
+// returns a note if nothing is indexed
+func (this *ButterfishCtx) generateContext(instructions string, numSnippets int) string {
+	if numSnippets <= 0 {
+		return "(none)"
+	}
+	err := this.initVectorIndex(nil)
+	if err != nil {
+		return fmt.Sprintf("(unavailable: %s)", err)
+	}
+
+	results, err := this.VectorIndex.Search(this.Ctx, instructions, numSnippets)
+	if err != nil {
+		return fmt.Sprintf("(unavailable: %s)", err)
+	}
+	if len(results) == 0 {
+		return "(no files indexed, run butterfish index to include project context)"
+	}
+
+	snippets := []string{}
+	for _, result := range results {
+		snippets = append(snippets, fmt.Sprintf("%s:\n%s", result.FilePath, result.Content))
+	}
+	return strings.Join(snippets, "\n---\n")
+}
+
+func (this *ButterfishCtx) confirm(question string) (bool, error) {
+	if err := this.requireInteractive(question); err != nil {
+		return false, err
+	}
+	this.StylePrintf(this.Config.Styles.Question, "%s [y/N]: ", question)
+
+	var input string
+	_, err := fmt.Scanln(&input)
+	if err != nil && err.Error() != "unexpected newline" {
+		return false, err
+	}
+	return strings.ToLower(input) == "y", nil
+}
+
+func writeGeneratedFiles(files []GeneratedFile) error {
+	for _, file := range files {
+		err := os.MkdirAll(filepath.Dir(file.Path), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(file.Path, []byte(file.Content), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Generate files from a template, instructions, and project context, then
+// preview them and write them once the user confirms
+func (this *ButterfishCtx) generateCommand(options *CliCommandConfig) error {
+	generate := options.Generate
+	instructions := this.cleanInput(generate.Instructions)
+	if instructions == "" {
+		return errors.New("Please describe what to generate")
+	}
+
+	template, err := this.loadPromptTemplate(generate.Template)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(generate.Out)
+	outputIsDir := strings.HasSuffix(generate.Out, string(filepath.Separator)) || (err == nil && info.IsDir())
+	existing := "(the file doesn't exist yet)"
+	output := fmt.Sprintf("the file %s", generate.Out)
+	if outputIsDir {
+		existing = "(none)"
+		output = fmt.Sprintf("files in the directory %s, start each file with a line like \"=== FILE: relative/path ===\"", generate.Out)
+	} else if err == nil {
+		data, err := os.ReadFile(generate.Out)
+		if err != nil {
+			return err
+		}
+		existing = string(data)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	promptStr, err := this.interpolateUsedFields(template, map[string]string{
+		"instructions": instructions,
+		"output":       output,
+		"context":      this.generateContext(instructions, generate.NumSnippets),
+		"existing":     existing,
+	})
+	if err != nil {
+		return err
+	}
+
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return err
+	}
+	request := &util.CompletionRequest{
+		Ctx:              this.Ctx,
+		Prompt:           promptStr,
+		Model:            generate.Model,
+		MaxTokens:        generate.NumTokens,
+		Temperature:      0.2,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.PromptSystemMessage,
+		Verbose:          this.Config.Verbose > 0,
+		TokenTimeout:     this.Config.TokenTimeout,
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "Generating with %s...\n", generate.Model)
+	response, err := this.LLMClient.Completion(request)
+	if err != nil {
+		return err
+	}
+
+	files, err := parseGeneratedFiles(response.Completion, generate.Out, outputIsDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		status := "new"
+		if _, err := os.Stat(file.Path); err == nil {
+			status = "overwrite"
+		}
+		this.StylePrintf(this.Config.Styles.Highlight, "\n%s (%s)\n", file.Path, status)
+		this.Printf("%s", file.Content)
+	}
+	this.Printf("\n")
+
+	if !generate.Yes {
+		ok, err := this.confirm(fmt.Sprintf("Write %d file(s)?", len(files)))
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.Path
+	}
+	err = this.Checkpoint("generate", instructions, paths...)
+	if err != nil {
+		return err
+	}
+
+	err = writeGeneratedFiles(files)
+	if err != nil {
+		return err
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "Wrote %d file(s)\n", len(files))
+	return nil
+}
@@ -0,0 +1,150 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Run a git command in the current directory and return its stdout
+func gitOutput(ctx context.Context, args ...string) (string, error) {
+	return gitOutputIn(ctx, "", args...)
+}
+
+// Run a git command in a directory and return its stdout
+func gitOutputIn(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return string(output), nil
+}
+
+// Truncate a diff to maxTokens, cutting at a line boundary and noting that
+// the diff was truncated
+func truncateDiff(diff string, tokenizer Tokenizer, maxTokens int) string {
+	if maxTokens <= 0 {
+		return diff
+	}
+
+	_, diff, truncated := tokenizer.Truncate(diff, maxTokens)
+	if !truncated {
+		return diff
+	}
+	if i := strings.LastIndex(diff, "\n"); i > 0 {
+		diff = diff[:i+1]
+	}
+	return diff + "[diff truncated]\n"
+}
+
+// Remove a markdown code fence around a message, and comment lines, i.e.
+// lines starting with #, and surrounding whitespace, as git does
+func cleanCommitMessage(message string) string {
+	message = strings.TrimSpace(message)
+	if strings.HasPrefix(message, "```") {
+		// drop the opening fence line, which may include a language
+		_, message, _ = strings.Cut(message, "\n")
+		message = strings.TrimSuffix(strings.TrimSpace(message), "```")
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(message, "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.TrimRight(line, " \t"))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// Split a diff into chunks of at most chunkSize tokens, keeping each file's
+// diff together where possible. Files larger than chunkSize are split.
+func chunkDiff(diff string, tokenizer Tokenizer, chunkSize int) []string {
+	// split on file boundaries
+	files := []string{}
+	for _, part := range strings.SplitAfter(diff, "\n") {
+		if strings.HasPrefix(part, "diff --git ") || len(files) == 0 {
+			files = append(files, part)
+		} else {
+			files[len(files)-1] += part
+		}
+	}
+
+	chunks := []string{}
+	current := strings.Builder{}
+	currentTokens := 0
+	for _, file := range files {
+		fileTokens := tokenizer.CountTokens(file)
+		if current.Len() > 0 && currentTokens+fileTokens > chunkSize {
+			chunks = append(chunks, current.String())
+			current.Reset()
+			currentTokens = 0
+		}
+
+		for fileTokens > chunkSize {
+			_, piece, _ := tokenizer.Truncate(file, chunkSize)
+			if piece == "" {
+				break
+			}
+			chunks = append(chunks, piece)
+			file = file[len(piece):]
+			fileTokens = tokenizer.CountTokens(file)
+		}
+		current.WriteString(file)
+		currentTokens += fileTokens
+	}
+	if current.Len() > 0 {
+		chunks = append(chunks, current.String())
+	}
+
+	return chunks
+}
+
+// Find the branch to compare against when no range is given, i.e. the
+// remote's default branch, or main or master if they exist
+func gitDefaultBase(ctx context.Context) (string, error) {
+	ref, err := gitOutput(ctx, "symbolic-ref", "--short", "refs/remotes/origin/HEAD")
+	if err == nil {
+		return strings.TrimSpace(ref), nil
+	}
+
+	for _, branch := range []string{"main", "master"} {
+		_, err := gitOutput(ctx, "rev-parse", "--verify", "--quiet", branch)
+		if err == nil {
+			return branch, nil
+		}
+	}
+
+	return "", errors.New("Could not find a base branch, please pass a range like main..HEAD")
+}
+
+// Turn the user's range argument into a range for git log and git diff. A
+// single ref is compared with HEAD, an empty range compares the default
+// branch with HEAD. Diffs use the merge base, i.e. base...head.
+func gitSummaryRange(ctx context.Context, rangeArg string) (string, string, error) {
+	if rangeArg == "" {
+		base, err := gitDefaultBase(ctx)
+		if err != nil {
+			return "", "", err
+		}
+		rangeArg = base
+	}
+
+	base, head, found := strings.Cut(rangeArg, "...")
+	if !found {
+		base, head, found = strings.Cut(rangeArg, "..")
+	}
+	if !found || head == "" {
+		head = "HEAD"
+	}
+
+	return base + ".." + head, base + "..." + head, nil
+}
@@ -9,11 +9,15 @@ import (
 	"io"
 	"log"
 	"math"
+	"math/rand"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bakks/butterfish/util"
 	openai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
 )
 
 const ERR_429 = "429:insufficient_quota"
@@ -260,6 +264,15 @@ func ShellHistoryTypeToRole(t int) string {
 	}
 }
 
+// The history type of a chat message's role, messages that aren't from the
+// assistant are prompts
+func HistoryTypeForRole(role string) int {
+	if role == "assistant" {
+		return historyTypeLLMOutput
+	}
+	return historyTypePrompt
+}
+
 func ShellHistoryBlockToGPTChat(block *util.HistoryBlock) *openai.ChatCompletionMessage {
 	role := ShellHistoryTypeToRole(block.Type)
 	name := ""
@@ -317,7 +330,7 @@ func ShellHistoryBlocksToGPTChat(systemMsg string, blocks []util.HistoryBlock) [
 	}
 
 	for _, block := range blocks {
-		if block.Content == "" && block.FunctionName == "" && block.ToolCalls == nil {
+		if block.Content == "" && block.FunctionName == "" && block.ToolCalls == nil && block.ToolCallId == "" {
 			// skip empty blocks
 			continue
 		}
@@ -384,6 +397,9 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 		Model:       request.Model,
 		MaxTokens:   request.MaxTokens,
 		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		Stop:        request.Stop,
+		LogitBias:   convertToOpenaiLogitBias(request.Model, request.LogitBias),
 	}
 
 	strBuilder := strings.Builder{}
@@ -402,6 +418,10 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 		LogCompletionRequest(req)
 	}
 	stream, err := this.client.CreateCompletionStream(request.Ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
 	var id string
 
 	for {
@@ -411,7 +431,12 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 		}
 
 		if err != nil {
-			return nil, err
+			// keep the partial output if the stream was interrupted
+			fmt.Fprintf(writer, "\n")
+			return &util.CompletionResponse{
+				Completion: strBuilder.String(),
+				Truncated:  true,
+			}, err
 		}
 
 		callback(response)
@@ -442,21 +467,37 @@ func (this *GPT) SimpleChatCompletionStream(request *util.CompletionRequest, wri
 				Role:    "system",
 				Content: request.SystemMessage,
 			},
-			{
-				Role:    "user",
-				Content: request.Prompt,
-			},
+			userChatMessage(request),
 		},
-		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
-		N:           1,
-		Functions:   convertToOpenaiFunctions(request.Functions),
-		Tools:       convertToOpenaiTools(request.Tools),
+		MaxTokens:      request.MaxTokens,
+		Temperature:    request.Temperature,
+		TopP:           request.TopP,
+		Stop:           request.Stop,
+		LogitBias:      convertToOpenaiLogitBias(request.Model, request.LogitBias),
+		N:              1,
+		Functions:      convertToOpenaiFunctions(request.Functions),
+		Tools:          convertToOpenaiTools(request.Tools),
+		ResponseFormat: convertToOpenaiResponseFormat(request.ResponseSchema),
 	}
 
 	return this.doChatStreamCompletion(request.Ctx, req, writer, request.TokenTimeout, request.Verbose)
 }
 
+// The user message of a request's prompt, with any images attached
+func userChatMessage(request *util.CompletionRequest) openai.ChatCompletionMessage {
+	if len(request.Images) == 0 {
+		return openai.ChatCompletionMessage{Role: "user", Content: request.Prompt}
+	}
+	parts := []openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: request.Prompt}}
+	for _, image := range request.Images {
+		parts = append(parts, openai.ChatMessagePart{
+			Type:     openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{URL: image},
+		})
+	}
+	return openai.ChatCompletionMessage{Role: "user", MultiContent: parts}
+}
+
 func convertToOpenaiFunctions(funcs []util.FunctionDefinition) []openai.FunctionDefinition {
 	if funcs == nil {
 		return nil
@@ -473,6 +514,72 @@ func convertToOpenaiFunctions(funcs []util.FunctionDefinition) []openai.Function
 	return out
 }
 
+// The API takes logit biases by token id, so biases for text are given to
+// each of the text's tokens in the model's encoding. Text can't be biased
+// for models we don't have the encoding of, e.g. other providers' models.
+func convertToOpenaiLogitBias(model string, bias map[string]int) map[string]int {
+	if len(bias) == 0 {
+		return nil
+	}
+
+	converted := map[string]int{}
+	for key, value := range bias {
+		if _, err := strconv.Atoi(key); err == nil {
+			converted[key] = value
+			continue
+		}
+		ids, err := tokenIDsForModel(model, key)
+		if err != nil {
+			log.Printf("Not biasing %q: %s", key, err)
+			continue
+		}
+		for _, id := range ids {
+			converted[strconv.Itoa(id)] = value
+		}
+	}
+	return converted
+}
+
+// Ask for structured output matching a schema. Strict mode makes the API
+// guarantee the schema, but it only accepts schemas where every object lists
+// all its properties as required and disallows additional properties.
+func convertToOpenaiResponseFormat(schema *jsonschema.Definition) *openai.ChatCompletionResponseFormat {
+	if schema == nil {
+		return nil
+	}
+
+	return &openai.ChatCompletionResponseFormat{
+		Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+		JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+			Name:   "response",
+			Schema: schema,
+			Strict: isStrictSchema(schema),
+		},
+	}
+}
+
+func isStrictSchema(schema *jsonschema.Definition) bool {
+	if schema.Type == jsonschema.Object {
+		if schema.AdditionalProperties != false || len(schema.Required) != len(schema.Properties) {
+			return false
+		}
+		for _, name := range schema.Required {
+			if _, ok := schema.Properties[name]; !ok {
+				return false
+			}
+		}
+	}
+	for _, property := range schema.Properties {
+		if !isStrictSchema(&property) {
+			return false
+		}
+	}
+	if schema.Items != nil && !isStrictSchema(schema.Items) {
+		return false
+	}
+	return true
+}
+
 func convertToOpenaiTools(tools []util.ToolDefinition) []openai.Tool {
 	if tools == nil {
 		return nil
@@ -502,20 +609,21 @@ func (this *GPT) FullChatCompletionStream(request *util.CompletionRequest, write
 	}
 
 	if request.Prompt != "" {
-		gptHistory = append(gptHistory, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: request.Prompt,
-		})
+		gptHistory = append(gptHistory, userChatMessage(request))
 	}
 
 	req := openai.ChatCompletionRequest{
-		Model:       request.Model,
-		Messages:    gptHistory,
-		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
-		N:           1,
-		Functions:   convertToOpenaiFunctions(request.Functions),
-		Tools:       convertToOpenaiTools(request.Tools),
+		Model:          request.Model,
+		Messages:       gptHistory,
+		MaxTokens:      request.MaxTokens,
+		Temperature:    request.Temperature,
+		TopP:           request.TopP,
+		Stop:           request.Stop,
+		LogitBias:      convertToOpenaiLogitBias(request.Model, request.LogitBias),
+		N:              1,
+		Functions:      convertToOpenaiFunctions(request.Functions),
+		Tools:          convertToOpenaiTools(request.Tools),
+		ResponseFormat: convertToOpenaiResponseFormat(request.ResponseSchema),
 	}
 
 	return this.doChatStreamCompletion(
@@ -551,7 +659,7 @@ func (this *GPT) doChatStreamCompletion(
 
 		select {
 		case <-time.After(tokenTimeout):
-			chunkTimeoutErr = fmt.Errorf("Timed out waiting for streaming response, this call set a timeout of %v between streaming token responses, set by the --token-timeout (-z) parameter.", tokenTimeout)
+			chunkTimeoutErr = fmt.Errorf("%w, this call set a timeout of %v between streaming token responses, set by the --token-timeout (-z) parameter.", errTokenTimeout, tokenTimeout)
 			cancel()
 
 			// if we get a chunk or the context fininshes we don't do anything
@@ -633,12 +741,15 @@ func (this *GPT) doChatStreamCompletion(
 		responseContent.WriteString(text)
 	}
 
+	// ask for token usage in the final chunk of the stream
+	req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+
 	if verbose {
 		LogChatCompletionRequest(req)
 	}
 	var stream *openai.ChatCompletionStream
 
-	err := withExponentialBackoff(func() error {
+	err := withExponentialBackoff(innerCtx, func() error {
 		var innerErr error
 		stream, innerErr = this.client.CreateChatCompletionStream(innerCtx, req)
 		return innerErr
@@ -653,8 +764,10 @@ func (this *GPT) doChatStreamCompletion(
 	if err != nil {
 		return nil, err
 	}
+	defer stream.Close()
 
 	var id string
+	var usage *openai.Usage
 	for {
 		response, err := stream.Recv()
 		if errors.Is(err, io.EOF) {
@@ -663,13 +776,22 @@ func (this *GPT) doChatStreamCompletion(
 
 		if err != nil {
 			if chunkTimeoutErr != nil {
-				return nil, chunkTimeoutErr
+				err = chunkTimeoutErr
 			}
-			return nil, err
+			// Keep what we received before the stream was interrupted, any
+			// function or tool calls are incomplete so we drop them
+			fmt.Fprintf(printWriter, "\n")
+			return &util.CompletionResponse{
+				Completion: responseContent.String(),
+				Truncated:  true,
+			}, err
 		}
 
 		callback(response)
 		id = response.ID
+		if response.Usage != nil {
+			usage = response.Usage
+		}
 	}
 
 	// this doesn't yet handle multiple tool calls
@@ -685,6 +807,10 @@ func (this *GPT) doChatStreamCompletion(
 		ToolCalls:          toolCalls,
 		FunctionParameters: functionArgs.String(),
 	}
+	if usage != nil {
+		response.PromptTokens = usage.PromptTokens
+		response.CompletionTokens = usage.CompletionTokens
+	}
 
 	if verbose {
 		LogCompletionResponse(response, id)
@@ -699,6 +825,9 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 		Model:       request.Model,
 		MaxTokens:   request.MaxTokens,
 		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		Stop:        request.Stop,
+		LogitBias:   convertToOpenaiLogitBias(request.Model, request.LogitBias),
 	}
 
 	if request.Verbose {
@@ -719,7 +848,9 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 	text = strings.TrimSpace(text)
 
 	response := util.CompletionResponse{
-		Completion: text,
+		Completion:       text,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
 	}
 
 	if request.Verbose {
@@ -732,10 +863,7 @@ func (this *GPT) FullChatCompletion(request *util.CompletionRequest) (*util.Comp
 	gptHistory := ShellHistoryBlocksToGPTChat(request.SystemMessage, request.HistoryBlocks)
 
 	if request.Prompt != "" {
-		gptHistory = append(gptHistory, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: request.Prompt,
-		})
+		gptHistory = append(gptHistory, userChatMessage(request))
 	}
 
 	if len(gptHistory) == 0 || gptHistory[0].Role != "system" {
@@ -743,12 +871,17 @@ func (this *GPT) FullChatCompletion(request *util.CompletionRequest) (*util.Comp
 	}
 
 	req := openai.ChatCompletionRequest{
-		Model:       request.Model,
-		Messages:    gptHistory,
-		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
-		N:           1,
-		Functions:   convertToOpenaiFunctions(request.Functions),
+		Model:          request.Model,
+		Messages:       gptHistory,
+		MaxTokens:      request.MaxTokens,
+		Temperature:    request.Temperature,
+		TopP:           request.TopP,
+		Stop:           request.Stop,
+		LogitBias:      convertToOpenaiLogitBias(request.Model, request.LogitBias),
+		N:              1,
+		Functions:      convertToOpenaiFunctions(request.Functions),
+		Tools:          convertToOpenaiTools(request.Tools),
+		ResponseFormat: convertToOpenaiResponseFormat(request.ResponseSchema),
 	}
 
 	return this.doChatCompletion(request.Ctx, req, request.Verbose)
@@ -766,15 +899,17 @@ func (this *GPT) SimpleChatCompletion(request *util.CompletionRequest) (*util.Co
 				Role:    "system",
 				Content: request.SystemMessage,
 			},
-			{
-				Role:    "user",
-				Content: request.Prompt,
-			},
+			userChatMessage(request),
 		},
-		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
-		N:           1,
-		Functions:   convertToOpenaiFunctions(request.Functions),
+		MaxTokens:      request.MaxTokens,
+		Temperature:    request.Temperature,
+		TopP:           request.TopP,
+		Stop:           request.Stop,
+		LogitBias:      convertToOpenaiLogitBias(request.Model, request.LogitBias),
+		N:              1,
+		Functions:      convertToOpenaiFunctions(request.Functions),
+		Tools:          convertToOpenaiTools(request.Tools),
+		ResponseFormat: convertToOpenaiResponseFormat(request.ResponseSchema),
 	}
 
 	return this.doChatCompletion(request.Ctx, req, request.Verbose)
@@ -786,7 +921,7 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 	}
 	var resp openai.ChatCompletionResponse
 
-	err := withExponentialBackoff(func() error {
+	err := withExponentialBackoff(ctx, func() error {
 		var innerErr error
 		resp, innerErr = this.client.CreateChatCompletion(ctx, request)
 		return innerErr
@@ -798,7 +933,9 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 	responseText := resp.Choices[0].Message.Content
 
 	response := util.CompletionResponse{
-		Completion: responseText,
+		Completion:       responseText,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
 	}
 
 	funcCall := resp.Choices[0].Message.FunctionCall
@@ -807,6 +944,17 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 		response.FunctionParameters = funcCall.Arguments
 	}
 
+	for _, toolCall := range resp.Choices[0].Message.ToolCalls {
+		response.ToolCalls = append(response.ToolCalls, &util.ToolCall{
+			Id:   toolCall.ID,
+			Type: string(toolCall.Type),
+			Function: util.FunctionCall{
+				Name:       toolCall.Function.Name,
+				Parameters: toolCall.Function.Arguments,
+			},
+		})
+	}
+
 	if verbose {
 		LogCompletionResponse(response, resp.ID)
 	}
@@ -816,34 +964,102 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 const GPTEmbeddingsMaxTokens = 8192
 const GPTEmbeddingsModel = openai.AdaEmbeddingV2
 
-func withExponentialBackoff(f func() error) error {
+// The number of times we retry a transient API failure, and the base delay
+// which grows exponentially with each retry
+const (
+	backoffMaxRetries = 4
+	backoffBaseDelay  = time.Second
+)
+
+func isTransientStatus(status int) bool {
+	switch status {
+	case 408, 409, 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// Returned when a stream goes quiet for longer than the token timeout
+var errTokenTimeout = errors.New("Timed out waiting for streaming response")
+
+// Returns true if an API error is likely to succeed if we try again, e.g. a
+// rate limit, server error, or network failure. Running out of quota and
+// cancelled or timed out requests aren't transient.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if strings.Contains(err.Error(), "insufficient_quota") {
+		return false
+	}
+
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return isTransientStatus(apiErr.HTTPStatusCode)
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return isTransientStatus(requestErr.HTTPStatusCode)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return strings.Contains(err.Error(), "429")
+}
+
+// The delay before retry number i (from 0), with up to 50% jitter either way
+// so that concurrent clients don't retry in lockstep
+func backoffDelay(i int) time.Duration {
+	delay := float64(backoffBaseDelay) * math.Pow(1.6, float64(i+1))
+	return time.Duration(delay * (0.5 + rand.Float64()))
+}
+
+// Call f, retrying transient errors with a growing delay. The wait between
+// retries ends early if ctx is cancelled.
+func withExponentialBackoff(ctx context.Context, f func() error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	for i := 0; ; i++ {
 		err := f()
+		if !isTransientError(err) {
+			return err
+		}
 
-		if err != nil && strings.Contains(err.Error(), "429") {
-			// TODO should probably have a better error detection
-			sleepTime := time.Duration(math.Pow(1.6, float64(i+1))) * time.Second
-			log.Printf("Rate limited, sleeping for %s\n", sleepTime)
-			time.Sleep(sleepTime)
-
-			if i > 3 {
-				return fmt.Errorf("Getting 429s from OpenAI API, this means you're hitting the rate limit, giving up after %d retries", i)
+		if i >= backoffMaxRetries {
+			if strings.Contains(err.Error(), "429") {
+				return fmt.Errorf("Getting 429s from the API, this means you're hitting the rate limit, giving up after %d retries: %w", i, err)
 			}
-			continue
+			return fmt.Errorf("Giving up after %d retries: %w", i, err)
+		}
+
+		sleepTime := backoffDelay(i)
+		log.Printf("Transient API error, retrying in %s: %s\n", sleepTime, err)
+		timer := time.NewTimer(sleepTime)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
 		}
-		return err
 	}
 }
 
-func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+func (this *GPT) Embeddings(request *util.EmbeddingRequest) ([][]float32, error) {
+	model := request.Model
+	if model == "" {
+		model = string(GPTEmbeddingsModel)
+	}
 	req := openai.EmbeddingRequest{
-		Input: input,
-		Model: GPTEmbeddingsModel,
+		Input:      request.Input,
+		Model:      openai.EmbeddingModel(model),
+		Dimensions: request.Dimensions,
 	}
 
-	if verbose {
-		summary := fmt.Sprintf("Embedding %d strings: [", len(input))
-		for i, s := range input {
+	if request.Verbose {
+		summary := fmt.Sprintf("Embedding %d strings with %s: [", len(request.Input), model)
+		for i, s := range request.Input {
 			if i > 0 {
 				summary += ",\n"
 			} else {
@@ -857,8 +1073,8 @@ func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) (
 
 	result := [][]float32{}
 
-	err := withExponentialBackoff(func() error {
-		resp, err := this.client.CreateEmbeddings(ctx, req)
+	err := withExponentialBackoff(request.Ctx, func() error {
+		resp, err := this.client.CreateEmbeddings(request.Ctx, req)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,113 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Headless mode, butterfish --headless, is for running commands in CI. It
+// never waits on the user: anything that would ask for confirmation, review,
+// or an edit fails instead, so pass -y or -f to commands that ask. Output has
+// no ANSI escapes, and the exit status says what happened:
+//
+//	0  success
+//	1  bad flags, config, or no API key
+//	3  butterfish couldn't start
+//	4  the command failed
+//	5  the command needed confirmation or other input
+//	6  the LLM provider returned an error or timed out
+//	9  the session budget was reached
+const (
+	ExitOK           = 0
+	ExitUsage        = 1
+	ExitStartup      = 3
+	ExitFailed       = 4
+	ExitConfirmation = 5
+	ExitProvider     = 6
+	ExitBudget       = 9
+)
+
+var ErrConfirmationRequired = errors.New("input isn't possible with --headless, pass -y or -f to commands that ask for confirmation")
+
+// The exit status for the error a command returned in headless mode
+func ExitCode(err error) int {
+	var apiErr *openai.APIError
+	var requestErr *openai.RequestError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrConfirmationRequired):
+		return ExitConfirmation
+	case errors.Is(err, ErrBudgetReached):
+		return ExitBudget
+	case errors.As(err, &apiErr), errors.As(err, &requestErr), errors.As(err, &netErr),
+		errors.Is(err, context.DeadlineExceeded):
+		return ExitProvider
+	}
+	return ExitFailed
+}
+
+// An error if we're headless, call before asking the user anything, e.g.
+// requireInteractive("Run this command?")
+func (this *ButterfishCtx) requireInteractive(question string) error {
+	if !this.Config.Headless {
+		return nil
+	}
+	return fmt.Errorf("%q: %w", question, ErrConfirmationRequired)
+}
+
+// PlainWriter drops ANSI escape sequences from what's written to it, a
+// sequence may be split across writes
+type PlainWriter struct {
+	Writer io.Writer
+	// bytes of an escape sequence that hasn't ended yet
+	pending []byte
+}
+
+func NewPlainWriter(writer io.Writer) *PlainWriter {
+	return &PlainWriter{Writer: writer}
+}
+
+// Whether seq, starting with ESC, is a whole escape sequence: CSI sequences
+// end with a byte from @ to ~, OSC sequences with BEL or ESC \, and others
+// are ESC and one byte
+func escapeSequenceEnded(seq []byte) bool {
+	if len(seq) < 2 {
+		return false
+	}
+	switch seq[1] {
+	case '[':
+		last := seq[len(seq)-1]
+		return len(seq) > 2 && last >= 0x40 && last <= 0x7e
+	case ']':
+		last := seq[len(seq)-1]
+		return last == '\a' || (len(seq) > 3 && last == '\\' && seq[len(seq)-2] == 0x1b)
+	}
+	return true
+}
+
+func (this *PlainWriter) Write(data []byte) (int, error) {
+	plain := make([]byte, 0, len(data))
+	for _, b := range data {
+		if len(this.pending) > 0 {
+			this.pending = append(this.pending, b)
+			if escapeSequenceEnded(this.pending) {
+				this.pending = this.pending[:0]
+			}
+			continue
+		}
+		if b == 0x1b {
+			this.pending = append(this.pending, b)
+			continue
+		}
+		plain = append(plain, b)
+	}
+	_, err := this.Writer.Write(plain)
+	return len(data), err
+}
@@ -0,0 +1,164 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// HooksConfig runs scripts or posts webhooks when goal mode finishes or
+// waits on the user, so a long goal running in a detached tmux session can
+// ping you. Set in the config file, e.g.
+//
+//	hooks:
+//	  goal_complete:
+//	    - webhook: https://hooks.slack.com/services/...
+//	  goal_failed:
+//	    - webhook: https://hooks.slack.com/services/...
+//	    - exec: ~/bin/page-me.sh
+//	  goal_confirm:
+//	    - exec: notify-send butterfish "$BUTTERFISH_MESSAGE"
+//
+// Webhooks are POSTed a JSON HookEvent, its text field is what Slack's
+// incoming webhooks show. Exec hooks are run with sh -c, the event is on
+// stdin as JSON and in the BUTTERFISH_EVENT, BUTTERFISH_GOAL, and
+// BUTTERFISH_MESSAGE environment variables. Hooks run in the background and
+// their errors are only logged.
+type HooksConfig struct {
+	// Goal mode finished the goal
+	GoalComplete []*Hook `yaml:"goal_complete,omitempty"`
+	// Goal mode gave up, or ran out of retries
+	GoalFailed []*Hook `yaml:"goal_failed,omitempty"`
+	// Goal mode is waiting for you to confirm a command or answer a question
+	GoalConfirm []*Hook `yaml:"goal_confirm,omitempty"`
+}
+
+// A Hook is either a command to run or a URL to POST to
+type Hook struct {
+	Exec    string `yaml:"exec,omitempty"`
+	Webhook string `yaml:"webhook,omitempty"`
+}
+
+const (
+	hookGoalComplete = "goal_complete"
+	hookGoalFailed   = "goal_failed"
+	hookGoalConfirm  = "goal_confirm"
+)
+
+const hookTimeout = 10 * time.Second
+
+func (this *HooksConfig) Validate() error {
+	for _, hooks := range [][]*Hook{this.GoalComplete, this.GoalFailed, this.GoalConfirm} {
+		for _, hook := range hooks {
+			if hook == nil || (hook.Exec == "") == (hook.Webhook == "") {
+				return errors.New("each hook needs one of exec or webhook")
+			}
+		}
+	}
+	return nil
+}
+
+func (this *HooksConfig) forEvent(event string) []*Hook {
+	if this == nil {
+		return nil
+	}
+	switch event {
+	case hookGoalComplete:
+		return this.GoalComplete
+	case hookGoalFailed:
+		return this.GoalFailed
+	case hookGoalConfirm:
+		return this.GoalConfirm
+	}
+	return nil
+}
+
+// What's sent to a hook
+type HookEvent struct {
+	Event   string `json:"event"`
+	Goal    string `json:"goal"`
+	Message string `json:"message"`
+	// A one line summary, for Slack
+	Text string `json:"text"`
+	Host string `json:"host,omitempty"`
+	Time string `json:"time"`
+}
+
+func newHookEvent(event, goal, message string) *HookEvent {
+	summaries := map[string]string{
+		hookGoalComplete: "butterfish goal complete",
+		hookGoalFailed:   "butterfish goal failed",
+		hookGoalConfirm:  "butterfish goal waiting on you",
+	}
+	host, _ := os.Hostname()
+	return &HookEvent{
+		Event:   event,
+		Goal:    goal,
+		Message: message,
+		Text:    fmt.Sprintf("%s: %s\n%s", summaries[event], goal, message),
+		Host:    host,
+		Time:    time.Now().Format(time.RFC3339),
+	}
+}
+
+func runHook(ctx context.Context, hook *Hook, event *HookEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	if hook.Webhook != "" {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.Webhook, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= 300 {
+			return fmt.Errorf("webhook returned %s", response.Status)
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hook.Exec)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"BUTTERFISH_EVENT="+event.Event,
+		"BUTTERFISH_GOAL="+event.Goal,
+		"BUTTERFISH_MESSAGE="+event.Message)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s %s", hook.Exec, err, output)
+	}
+	return nil
+}
+
+// Run the hooks configured for a goal mode event in the background
+func (this *ButterfishCtx) fireHooks(event, goal, message string) {
+	hooks := this.Config.Hooks.forEvent(event)
+	if len(hooks) == 0 {
+		return
+	}
+	payload := newHookEvent(event, goal, message)
+	for _, hook := range hooks {
+		go func(hook *Hook) {
+			err := runHook(this.Ctx, hook, payload)
+			if err != nil {
+				log.Printf("Error running %s hook: %s", event, err)
+			}
+		}(hook)
+	}
+}
@@ -0,0 +1,56 @@
+package butterfish
+
+import (
+	"os"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Export and import of index files, see embedding/share.go
+
+func (this *ButterfishCtx) exportIndex(archivePath, dir string) error {
+	archivePath, err := homedir.Expand(archivePath)
+	if err != nil {
+		return err
+	}
+	this.initVectorIndex(nil)
+
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	count, err := this.VectorIndex.ExportIndex(this.Ctx, dir, file)
+	closeErr := file.Close()
+	if err != nil {
+		os.Remove(archivePath)
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	this.Printf("Exported %d index files to %s\n", count, archivePath)
+	return nil
+}
+
+func (this *ButterfishCtx) importIndex(archivePath, dir string) error {
+	archivePath, err := homedir.Expand(archivePath)
+	if err != nil {
+		return err
+	}
+	this.initVectorIndex(nil)
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stats, err := this.VectorIndex.ImportIndex(this.Ctx, dir, file)
+	if err != nil {
+		return err
+	}
+	this.Printf("Imported %d index files, %d indexed files match, %d will be embedded again by the next index\n",
+		stats.Indexes, stats.Current, stats.Stale)
+	return nil
+}
@@ -0,0 +1,437 @@
+package butterfish
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// butterfish init walks a new user through choosing a provider, storing the
+// API key, picking models, adding shell integration to their rc file, and
+// writes a commented config file, rather than having them edit YAML by hand.
+
+// Marks the lines init adds to an rc file, so running it again doesn't add
+// them twice
+const initRcMarker = "# added by butterfish init"
+
+type initProvider struct {
+	Name    string
+	BaseURL string // empty for the OpenAI default
+	KeyURL  string // where to create a key, empty if none is needed
+	Strong  string
+	Fast    string
+}
+
+var initProviders = []initProvider{
+	{
+		Name:   "OpenAI",
+		KeyURL: "https://platform.openai.com/account/api-keys",
+		Strong: "gpt-4o",
+		Fast:   "gpt-4o-mini",
+	},
+	{
+		Name:    "OpenRouter",
+		BaseURL: "https://openrouter.ai/api/v1",
+		KeyURL:  "https://openrouter.ai/keys",
+		Strong:  "openai/gpt-4o",
+		Fast:    "openai/gpt-4o-mini",
+	},
+	{
+		Name:    "Ollama (local models)",
+		BaseURL: "http://localhost:11434/v1",
+		Strong:  "llama3.1",
+		Fast:    "llama3.2",
+	},
+	{
+		Name: "Another OpenAI-compatible API",
+	},
+}
+
+type InitWizard struct {
+	In         *bufio.Reader
+	Out        io.Writer
+	ConfigPath string
+	EnvPath    string
+	Shell      string // the user's shell, e.g. /bin/zsh
+	HomeDir    string
+}
+
+// The settings collected by the wizard
+type initSettings struct {
+	BaseURL              string
+	Strong               string
+	Fast                 string
+	ExplainBeforeExecute bool
+}
+
+func NewInitWizard(in io.Reader, out io.Writer, configPath, envPath string) (*InitWizard, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return &InitWizard{
+		In:         bufio.NewReader(in),
+		Out:        out,
+		ConfigPath: configPath,
+		EnvPath:    envPath,
+		Shell:      os.Getenv("SHELL"),
+		HomeDir:    home,
+	}, nil
+}
+
+func (this *InitWizard) Run() error {
+	fmt.Fprintf(this.Out, "Welcome to Butterfish! Let's get you set up, press enter to accept the [default].\n\n")
+
+	names := []string{}
+	for _, provider := range initProviders {
+		names = append(names, provider.Name)
+	}
+	choice, err := this.choose("Which LLM provider do you want to use?", names)
+	if err != nil {
+		return err
+	}
+	provider := initProviders[choice]
+
+	settings := &initSettings{BaseURL: provider.BaseURL}
+	for provider.Name == initProviders[len(initProviders)-1].Name && settings.BaseURL == "" {
+		settings.BaseURL, err = this.ask("Base URL of the API, e.g. https://api.example.com/v1", "")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = this.setupKey(provider)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(this.Out, "\nRequests are routed to a strong model for prompts, goal mode, and summaries, and a fast one for autosuggest and generating commands.\n")
+	for settings.Strong == "" {
+		settings.Strong, err = this.ask("Strong model", provider.Strong)
+		if err != nil {
+			return err
+		}
+	}
+	for settings.Fast == "" {
+		settings.Fast, err = this.ask("Fast model", provider.Fast)
+		if err != nil {
+			return err
+		}
+	}
+
+	settings.ExplainBeforeExecute, err = this.confirm("Explain generated commands, and whether they change anything, before offering to run them?", false)
+	if err != nil {
+		return err
+	}
+
+	err = this.setupShell()
+	if err != nil {
+		return err
+	}
+
+	err = this.writeConfig(settings)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(this.Out, "\nAll set, run 'butterfish shell' to get started. You can run 'butterfish init' again at any time.\n")
+	return nil
+}
+
+// Ask for the API key and store it in the env file. An existing key is kept
+// if the user doesn't enter one.
+func (this *InitWizard) setupKey(provider initProvider) error {
+	existing := readEnvFileKey(this.EnvPath)
+	if provider.KeyURL == "" && provider.BaseURL != "" {
+		// local models don't need a key, but the client needs one set
+		if existing == "" {
+			return writeEnvFileKey(this.EnvPath, "none")
+		}
+		return nil
+	}
+
+	fmt.Fprintf(this.Out, "\n")
+	if provider.KeyURL != "" {
+		fmt.Fprintf(this.Out, "You can create an API key at %s\n", provider.KeyURL)
+	}
+	question := "API key"
+	if existing != "" {
+		question = "API key (leave empty to keep the current one)"
+	}
+	key, err := this.ask(question, "")
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		if existing == "" {
+			fmt.Fprintf(this.Out, "No key saved, you'll be asked for one when you first run butterfish, or you can set OPENAI_API_KEY.\n")
+		}
+		return nil
+	}
+
+	err = writeEnvFileKey(this.EnvPath, key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(this.Out, "Saved the key to %s\n", this.EnvPath)
+	return nil
+}
+
+// The OPENAI_TOKEN value in an env file, empty if there isn't one
+func readEnvFileKey(path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if value, ok := strings.CutPrefix(line, "OPENAI_TOKEN="); ok {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// Set OPENAI_TOKEN in an env file, keeping its other lines
+func writeEnvFileKey(path, key string) error {
+	lines := []string{}
+	content, err := os.ReadFile(path)
+	if err == nil {
+		for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			if line != "" && !strings.HasPrefix(line, "OPENAI_TOKEN=") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	lines = append(lines, "OPENAI_TOKEN="+key)
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// The rc file for a shell and the lines init adds to it, an empty path if
+// we don't know the shell
+func initShellSnippet(shell, home string) (string, string) {
+	switch filepath.Base(shell) {
+	case "zsh":
+		// the completion script needs compinit, which not every zshrc runs
+		return filepath.Join(home, ".zshrc"), initRcMarker + "\nalias bf=\"butterfish\"\n" +
+			"(( $+functions[compdef] )) || { autoload -Uz compinit && compinit; }\n" +
+			"source <(butterfish completion zsh)\n"
+	case "bash":
+		return filepath.Join(home, ".bashrc"), initRcMarker + "\nalias bf=\"butterfish\"\nsource <(butterfish completion bash)\n"
+	case "fish":
+		return filepath.Join(home, ".config", "fish", "config.fish"), initRcMarker + "\nalias bf butterfish\n"
+	}
+	return "", ""
+}
+
+// Offer to add an alias and tab completion to the shell's rc file
+func (this *InitWizard) setupShell() error {
+	rcPath, snippet := initShellSnippet(this.Shell, this.HomeDir)
+	if rcPath == "" {
+		fmt.Fprintf(this.Out, "\nSkipping shell integration, %s isn't supported, see 'butterfish completion --help'.\n", this.Shell)
+		return nil
+	}
+
+	content, err := os.ReadFile(rcPath)
+	if err == nil && strings.Contains(string(content), initRcMarker) {
+		fmt.Fprintf(this.Out, "\nShell integration is already in %s\n", rcPath)
+		return nil
+	}
+
+	fmt.Fprintf(this.Out, "\nThese lines add a bf alias and tab completion for butterfish:\n\n%s\n", snippet)
+	ok, err := this.confirm(fmt.Sprintf("Add them to %s?", rcPath), true)
+	if err != nil || !ok {
+		return err
+	}
+
+	if filepath.Base(this.Shell) == "fish" {
+		// fish loads completions from a directory rather than the rc file
+		completionPath := filepath.Join(this.HomeDir, ".config", "fish", "completions", "butterfish.fish")
+		err = os.MkdirAll(filepath.Dir(completionPath), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(completionPath, []byte(fishCompletionScript), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(rcPath), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(rcPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "\n%s", snippet)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(this.Out, "Added to %s, open a new terminal to use it.\n", rcPath)
+	return nil
+}
+
+// A commented config file for the settings, the other settings are
+// included commented out so they're easy to find
+func buildInitConfig(settings *initSettings) string {
+	builder := strings.Builder{}
+	builder.WriteString("# Butterfish config, written by butterfish init. The API key is kept in\n")
+	builder.WriteString("# ~/.config/butterfish/butterfish.env rather than here.\n\n")
+
+	builder.WriteString("# Base URL of the OpenAI-compatible API, the --base-url flag overrides it\n")
+	if settings.BaseURL == "" {
+		builder.WriteString("# base_url: https://api.openai.com/v1\n\n")
+	} else {
+		fmt.Fprintf(&builder, "base_url: %s\n\n", settings.BaseURL)
+	}
+
+	// OpenAI with its default models works without routing, the flags'
+	// defaults are OpenAI models, so the block is only there to uncomment
+	openai := initProviders[0]
+	routed := settings.BaseURL != "" || settings.Strong != openai.Strong || settings.Fast != openai.Fast
+	prefix := ""
+	if !routed {
+		prefix = "# "
+	}
+	builder.WriteString("# Requests are sent to the fast or the strong model depending on the task,\n")
+	builder.WriteString("# routed tasks use these models even if a model flag is given\n")
+	fmt.Fprintf(&builder, "%srouting:\n", prefix)
+	fmt.Fprintf(&builder, "%s  fast: %s\n", prefix, settings.Fast)
+	fmt.Fprintf(&builder, "%s  strong: %s\n", prefix, settings.Strong)
+	fmt.Fprintf(&builder, "%s  rules:\n", prefix)
+	fmt.Fprintf(&builder, "%s    shell_prompt: strong\n", prefix)
+	fmt.Fprintf(&builder, "%s    goal_mode: strong\n", prefix)
+	fmt.Fprintf(&builder, "%s    explain: fast\n\n", prefix)
+
+	builder.WriteString("# Explain generated commands, and whether they change anything, before\n")
+	builder.WriteString("# offering to run them\n")
+	fmt.Fprintf(&builder, "explain_before_execute: %t\n\n", settings.ExplainBeforeExecute)
+
+	builder.WriteString(`# More settings, uncomment to use them:
+#
+# keybindings:
+#   accept_autosuggest: ctrl-f
+#   toggle_goal_mode: ctrl-x g
+# failover:
+#   model: gpt-4o-mini
+# rate_limit:
+#   requests_per_minute: 60
+# prompt_sync:
+#   url: git@github.com:example/prompts.git
+# encryption:
+#   key_env: BUTTERFISH_ENCRYPTION_KEY
+# env_context:
+#   unmasked: [NODE_ENV, PORT]
+`)
+	return builder.String()
+}
+
+// Write the config file, an existing one is backed up first
+func (this *InitWizard) writeConfig(settings *initSettings) error {
+	content := buildInitConfig(settings)
+	// make sure the config loads before we write it
+	err := yaml.UnmarshalStrict([]byte(content), &ConfigFile{})
+	if err != nil {
+		return fmt.Errorf("Error in the generated config: %w", err)
+	}
+
+	_, err = os.Stat(this.ConfigPath)
+	if err == nil {
+		ok, err := this.confirm(fmt.Sprintf("\n%s exists, replace it? The current one will be saved to %s.bak", this.ConfigPath, this.ConfigPath), false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintf(this.Out, "Keeping the current config, this is the one that would have been written:\n\n%s", content)
+			return nil
+		}
+		err = os.Rename(this.ConfigPath, this.ConfigPath+".bak")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(this.ConfigPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(this.ConfigPath, []byte(content), 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(this.Out, "\nWrote the config to %s\n", this.ConfigPath)
+	return nil
+}
+
+func (this *InitWizard) readLine() (string, error) {
+	line, err := this.In.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// Ask a question, returning the default if the answer is empty
+func (this *InitWizard) ask(question, defaultValue string) (string, error) {
+	if defaultValue != "" {
+		fmt.Fprintf(this.Out, "%s [%s]: ", question, defaultValue)
+	} else {
+		fmt.Fprintf(this.Out, "%s: ", question)
+	}
+	answer, err := this.readLine()
+	if err != nil {
+		return "", err
+	}
+	if answer == "" {
+		return defaultValue, nil
+	}
+	return answer, nil
+}
+
+func (this *InitWizard) confirm(question string, defaultValue bool) (bool, error) {
+	options := "y/N"
+	if defaultValue {
+		options = "Y/n"
+	}
+	fmt.Fprintf(this.Out, "%s [%s]: ", question, options)
+	answer, err := this.readLine()
+	if err != nil {
+		return false, err
+	}
+	if answer == "" {
+		return defaultValue, nil
+	}
+	return strings.ToLower(answer) == "y" || strings.ToLower(answer) == "yes", nil
+}
+
+// Ask the user to pick one of a numbered list, the first is the default
+func (this *InitWizard) choose(question string, options []string) (int, error) {
+	fmt.Fprintf(this.Out, "%s\n", question)
+	for i, option := range options {
+		fmt.Fprintf(this.Out, "  %d. %s\n", i+1, option)
+	}
+	for {
+		answer, err := this.ask("Choose a number", "1")
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.Atoi(answer)
+		if err == nil && n >= 1 && n <= len(options) {
+			return n - 1, nil
+		}
+		fmt.Fprintf(this.Out, "Please enter a number from 1 to %d\n", len(options))
+	}
+}
@@ -0,0 +1,212 @@
+package butterfish
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Shell mode actions that can be bound to keys
+const (
+	keyActionNone = iota
+	keyActionAcceptAutosuggest
+	keyActionInterrupt
+	keyActionToggleGoalMode
+	keyActionClearContext
+	keyActionExplainLastCommand
+	keyActionVoicePrompt
+)
+
+// Map from the action names used in the config file to the action enum
+var keyActionNames = map[string]int{
+	"accept_autosuggest":   keyActionAcceptAutosuggest,
+	"interrupt":            keyActionInterrupt,
+	"toggle_goal_mode":     keyActionToggleGoalMode,
+	"clear_context":        keyActionClearContext,
+	"explain_last_command": keyActionExplainLastCommand,
+	"voice_prompt":         keyActionVoicePrompt,
+}
+
+// The default bindings, toggle_goal_mode, clear_context,
+// explain_last_command, and voice_prompt are unbound by default since any
+// choice would collide with something
+var defaultKeyBindings = map[string]string{
+	"accept_autosuggest": "tab",
+	"interrupt":          "ctrl-c",
+}
+
+// Names of non-printable keys that can be used in a key binding. Escape on
+// its own isn't supported since it starts arrow keys and other sequences.
+var namedKeys = map[string][]byte{
+	"tab":       {'\t'},
+	"enter":     {'\r'},
+	"return":    {'\r'},
+	"space":     {' '},
+	"backspace": {0x7f},
+}
+
+// KeyBindings maps byte sequences read from the terminal to shell mode
+// actions. A binding can be a chord, i.e. a series of keys pressed one after
+// another like "ctrl-x g".
+type KeyBindings struct {
+	sequences map[int][]byte
+}
+
+func DefaultKeyBindings() *KeyBindings {
+	bindings, err := ParseKeyBindings(nil)
+	if err != nil {
+		panic(err)
+	}
+	return bindings
+}
+
+// Parse a map of action name to key binding, e.g. "interrupt: ctrl-g", on top
+// of the default bindings. An empty binding or "none" unbinds the action.
+func ParseKeyBindings(config map[string]string) (*KeyBindings, error) {
+	merged := map[string]string{}
+	for name, key := range defaultKeyBindings {
+		merged[name] = key
+	}
+	for name, key := range config {
+		if _, ok := keyActionNames[name]; !ok {
+			return nil, fmt.Errorf("Unknown keybinding action %q", name)
+		}
+		merged[name] = key
+	}
+
+	bindings := &KeyBindings{
+		sequences: make(map[int][]byte),
+	}
+
+	// iterate in a stable order so that errors are deterministic
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key := strings.TrimSpace(merged[name])
+		if key == "" || strings.ToLower(key) == "none" {
+			continue
+		}
+
+		seq, err := ParseKeySequence(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid keybinding for %s: %w", name, err)
+		}
+
+		for otherAction, otherSeq := range bindings.sequences {
+			if bytes.HasPrefix(seq, otherSeq) || bytes.HasPrefix(otherSeq, seq) {
+				return nil, fmt.Errorf("Keybinding for %s (%q) conflicts with %s",
+					name, key, keyActionToName(otherAction))
+			}
+		}
+
+		bindings.sequences[keyActionNames[name]] = seq
+	}
+
+	return bindings, nil
+}
+
+func keyActionToName(action int) string {
+	for name, a := range keyActionNames {
+		if a == action {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// Parse a key binding like "tab", "ctrl-g", "alt-x", or a chord of keys
+// separated by spaces like "ctrl-x ctrl-g", into the bytes the terminal sends.
+func ParseKeySequence(key string) ([]byte, error) {
+	fields := strings.Fields(key)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Empty key binding")
+	}
+
+	seq := []byte{}
+	for _, field := range fields {
+		keyBytes, err := parseKey(field)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, keyBytes...)
+	}
+
+	return seq, nil
+}
+
+func parseKey(key string) ([]byte, error) {
+	// a single character maps to itself, we check this first so that
+	// uppercase letters are preserved
+	if len(key) == 1 {
+		return []byte(key), nil
+	}
+
+	lower := strings.ToLower(key)
+	if keyBytes, ok := namedKeys[lower]; ok {
+		return keyBytes, nil
+	}
+
+	for _, prefix := range []string{"ctrl-", "c-", "^"} {
+		if !strings.HasPrefix(lower, prefix) {
+			continue
+		}
+		rest := lower[len(prefix):]
+		if rest == "space" || rest == "@" {
+			return []byte{0x00}, nil
+		}
+		if len(rest) != 1 {
+			break
+		}
+		char := rest[0]
+		switch {
+		case char >= 'a' && char <= 'z':
+			return []byte{char - 'a' + 1}, nil
+		case char >= '[' && char <= '_':
+			return []byte{char & 0x1f}, nil
+		}
+		break
+	}
+
+	for _, prefix := range []string{"alt-", "meta-", "m-"} {
+		if strings.HasPrefix(lower, prefix) {
+			// Alt sends escape followed by the key
+			keyBytes, err := parseKey(key[len(prefix):])
+			if err != nil {
+				return nil, err
+			}
+			if keyBytes[0] == '[' || keyBytes[0] == 0x1b {
+				return nil, fmt.Errorf("Key %q collides with terminal escape sequences", key)
+			}
+			return append([]byte{0x1b}, keyBytes...), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unrecognized key %q", key)
+}
+
+// The byte sequence bound to an action, or nil if the action is unbound
+func (this *KeyBindings) Sequence(action int) []byte {
+	return this.sequences[action]
+}
+
+// Check whether the start of data matches a key binding. Returns the action
+// and the number of bytes it consumed, or keyActionNone. If data is the
+// start of a chord but not a complete one then partial is true and the
+// caller should wait for more input.
+func (this *KeyBindings) Match(data []byte) (action int, length int, partial bool) {
+	for action, seq := range this.sequences {
+		if bytes.HasPrefix(data, seq) {
+			return action, len(seq), false
+		}
+		if len(data) < len(seq) && bytes.HasPrefix(seq, data) {
+			partial = true
+		}
+	}
+
+	return keyActionNone, 0, partial
+}
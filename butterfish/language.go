@@ -0,0 +1,81 @@
+package butterfish
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+// The language config setting, e.g.
+//
+//	language: es
+//
+// picks the prompt library's variants for that locale (see Translations in
+// prompt/library.go) and asks models to answer in the language. With auto
+// the locale comes from LC_ALL, LC_MESSAGES, or LANG. Commands, code, and
+// file names aren't translated.
+
+const LanguageAuto = "auto"
+
+// English names of common languages, so the instruction to the model doesn't
+// rely on it knowing locale codes
+var languageNames = map[string]string{
+	"ar": "Arabic",
+	"de": "German",
+	"en": "English",
+	"es": "Spanish",
+	"fr": "French",
+	"hi": "Hindi",
+	"id": "Indonesian",
+	"it": "Italian",
+	"ja": "Japanese",
+	"ko": "Korean",
+	"nl": "Dutch",
+	"pl": "Polish",
+	"pt": "Portuguese",
+	"ru": "Russian",
+	"sv": "Swedish",
+	"tr": "Turkish",
+	"uk": "Ukrainian",
+	"vi": "Vietnamese",
+	"zh": "Chinese",
+}
+
+// The locale a language setting refers to, empty for the defaults
+func resolveLanguage(setting string, getenv func(string) string) string {
+	if setting != LanguageAuto {
+		return prompt.NormalizeLocale(setting)
+	}
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := getenv(name); value != "" {
+			return prompt.NormalizeLocale(value)
+		}
+	}
+	return ""
+}
+
+// The name of a locale's language for the model, e.g. es-MX gives Spanish
+// (es-MX)
+func languageName(locale string) string {
+	base, _, _ := strings.Cut(locale, "-")
+	name, ok := languageNames[base]
+	if !ok {
+		return locale
+	}
+	if base != locale {
+		return fmt.Sprintf("%s (%s)", name, locale)
+	}
+	return name
+}
+
+// A note added to system messages asking for answers in the user's
+// language, empty for English or if no language is set
+func languageSystemNote(language string) string {
+	locale := resolveLanguage(language, os.Getenv)
+	if locale == "" || strings.HasPrefix(locale, "en") {
+		return ""
+	}
+	return fmt.Sprintf("\n\nAnswer in %s, the user's language. Keep commands, code, file names, and error messages as they are.", languageName(locale))
+}
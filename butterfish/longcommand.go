@@ -0,0 +1,142 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// When a command in shell mode runs longer than --summarize-after, its output
+// is summarized in a paragraph that's printed above the next prompt, and with
+// --notify sent as a desktop notification, so that someone coming back to
+// the terminal gets the gist without scrolling.
+
+const (
+	longCommandSummaryTimeout   = 30 * time.Second
+	longCommandSummaryMaxTokens = 256
+	// Output lines sent to the model, sampled from the start, middle, and end
+	longCommandSummaryLines = 200
+)
+
+// The prompt for summarizing a command's output
+func (this *ButterfishCtx) longCommandPrompt(command string, exitCode int, duration time.Duration, output string) (string, error) {
+	capture := outputCapture{Mode: captureSample, Lines: longCommandSummaryLines}
+	return this.GetPrompt(prompt.ShellSummarizeLongCommand,
+		"command", command,
+		"exit_code", fmt.Sprintf("%d", exitCode),
+		"duration", duration.Round(time.Second).String(),
+		"output", capture.Apply(denoiseOutput(output)))
+}
+
+// Summarize the last command in the background if it ran for longer than
+// the threshold. The summary is shown like an annotation, and sent as a
+// desktop notification if that's on.
+func (this *ShellState) SummarizeLongCommand(exitCode int) {
+	threshold := this.Butterfish.Config.ShellSummarizeAfter
+	duration := time.Since(this.CommandStart)
+	if threshold <= 0 || this.CommandStart.IsZero() || duration < threshold {
+		return
+	}
+	command, output := this.History.LastCommand()
+	if command == "" {
+		return
+	}
+
+	promptStr, err := this.Butterfish.longCommandPrompt(command, exitCode, duration, output)
+	if err != nil {
+		log.Printf("Error getting long command summary prompt: %s", err)
+		return
+	}
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		log.Printf("Error getting long command summary system message: %s", err)
+		return
+	}
+
+	notify := this.Butterfish.Config.ShellNotify
+	bf := this.Butterfish.snapshot()
+	go func() {
+		ctx, cancel := context.WithTimeout(bf.Ctx, longCommandSummaryTimeout)
+		defer cancel()
+
+		request := &util.CompletionRequest{
+			Ctx:              ctx,
+			Prompt:           promptStr,
+			PromptName:       prompt.ShellSummarizeLongCommand,
+			Model:            bf.Config.ShellAnnotateModel,
+			MaxTokens:        longCommandSummaryMaxTokens,
+			Temperature:      0.2,
+			SystemMessage:    sysMsg,
+			SystemPromptName: prompt.PromptSystemMessage,
+			Task:             TaskAnnotate,
+		}
+		summary := ""
+		response, err := bf.LLMClient.Completion(request)
+		if err != nil {
+			log.Printf("Error summarizing long command: %s", err)
+		} else {
+			summary = strings.Join(strings.Fields(response.Completion), " ")
+		}
+
+		status := "finished"
+		if exitCode != 0 {
+			status = fmt.Sprintf("failed with exit code %d", exitCode)
+		}
+		title := fmt.Sprintf("%s %s after %s", commandProgram(command), status, duration.Round(time.Second))
+		if notify {
+			err = sendDesktopNotification(title, summary)
+			if err != nil {
+				log.Printf("Error sending notification: %s", err)
+			}
+		}
+
+		if summary == "" {
+			return
+		}
+		select {
+		case this.AnnotationChan <- fmt.Sprintf("%s: %s", title, summary):
+		case <-bf.Ctx.Done():
+		}
+	}()
+}
+
+// The program a command line runs, for the notification title
+func commandProgram(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return command
+	}
+	return fields[0]
+}
+
+// Show a desktop notification with osascript on macOS or notify-send on
+// Linux
+func sendDesktopNotification(title, body string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		quote := func(s string) string {
+			s = strings.ReplaceAll(s, `\`, `\\`)
+			return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+		}
+		cmd = exec.Command("osascript", "-e",
+			fmt.Sprintf("display notification %s with title %s", quote(body), quote(title)))
+	case "linux":
+		cmd = exec.Command("notify-send", "--app-name=butterfish", title, body)
+	default:
+		return fmt.Errorf("Desktop notifications aren't supported on %s", runtime.GOOS)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s %s", cmd.Args[0], err, output)
+	}
+	return nil
+}
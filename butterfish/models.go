@@ -0,0 +1,160 @@
+package butterfish
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kong"
+)
+
+// Model aliases and per-command model defaults, set in the config file, so
+// that switching providers or models is a change in one place, e.g.
+//
+//	models:
+//	  fast: gpt-4o-mini
+//	  smart: claude-sonnet
+//	  default: smart
+//	model_defaults:
+//	  gencmd: fast
+//	  summarize: default
+//	  shell: smart
+//
+// An alias can be used anywhere a model is, in flags like --model and in the
+// shell, routing, and failover sections of the config file, and can refer to
+// another alias. model_defaults sets the --model of a command when the flag
+// isn't given, or the model of gencmd, summarize, and exec, which have no
+// flag. Commands are named as they're typed, e.g. "prompts bench".
+
+// The model that name stands for, following aliases to aliases, or name if
+// it isn't an alias
+func ResolveModel(aliases map[string]string, name string) string {
+	for i := 0; i <= len(aliases); i++ {
+		model, ok := aliases[name]
+		if !ok {
+			return name
+		}
+		name = model
+	}
+	return name
+}
+
+func validateModelAliases(aliases map[string]string) error {
+	for alias, model := range aliases {
+		if alias == "" || model == "" {
+			return fmt.Errorf("model alias %s needs a model", alias)
+		}
+		// following the chain should leave the aliases within len(aliases)
+		// steps, otherwise it loops
+		_, ok := aliases[ResolveModel(aliases, alias)]
+		if ok {
+			return fmt.Errorf("model alias %s refers back to itself", alias)
+		}
+	}
+	return nil
+}
+
+// The names of the flags given on the command line, rather than set from
+// their defaults
+func GivenFlags(ctx *kong.Context) map[string]bool {
+	given := map[string]bool{}
+	for _, path := range ctx.Path {
+		if path.Flag != nil {
+			given[path.Flag.Name] = true
+		}
+	}
+	return given
+}
+
+// The command being run, e.g. "prompts bench", without its arguments
+func commandName(ctx *kong.Context) string {
+	names := []string{}
+	for _, path := range ctx.Path {
+		if path.Command != nil {
+			names = append(names, path.Command.Name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// The commands that have a --model flag, which can be given a default
+func modelCommands(node *kong.Node, prefix string, commands map[string]bool) {
+	for _, child := range node.Children {
+		if child.Type != kong.CommandNode {
+			continue
+		}
+		name := strings.TrimSpace(prefix + " " + child.Name)
+		for _, flag := range child.Flags {
+			if flag.Name == "model" {
+				commands[name] = true
+			}
+		}
+		modelCommands(child, name, commands)
+	}
+}
+
+// The models of commands that don't have a --model flag
+func configModels(config *ButterfishConfig) map[string]*string {
+	return map[string]*string{
+		"gencmd":    &config.GencmdModel,
+		"summarize": &config.SummarizeModel,
+		"exec":      &config.ExeccheckModel,
+	}
+}
+
+// Check that model_defaults only names commands that take a model
+func ValidateModelDefaults(app *kong.Application, config *ButterfishConfig) error {
+	commands := map[string]bool{}
+	modelCommands(app.Node, "", commands)
+	for command := range configModels(config) {
+		commands[command] = true
+	}
+	for command := range config.ModelDefaults {
+		if !commands[command] {
+			names := []string{}
+			for name := range commands {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("model_defaults has %s, which isn't a command that takes a model, those are %s",
+				command, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// Set the --model flag of the command being run from model_defaults if the
+// flag wasn't given, then resolve aliases in the command's model flags.
+// gencmd, summarize, and exec, which have no --model flag, have their
+// models set in the config. Called after the config file is applied.
+func ApplyModelDefaults(ctx *kong.Context, config *ButterfishConfig) error {
+	err := ValidateModelDefaults(ctx.Model, config)
+	if err != nil {
+		return err
+	}
+
+	for command, model := range configModels(config) {
+		if defaultModel, ok := config.ModelDefaults[command]; ok {
+			*model = defaultModel
+		}
+		*model = ResolveModel(config.ModelAliases, *model)
+	}
+
+	given := GivenFlags(ctx)
+	model, hasDefault := config.ModelDefaults[commandName(ctx)]
+	for _, flag := range ctx.Flags() {
+		if flag.Name != "model" && !strings.HasSuffix(flag.Name, "-model") {
+			continue
+		}
+		target := flag.Value.Target
+		if target.Kind() != reflect.String || !target.CanSet() {
+			continue
+		}
+		if flag.Name == "model" && hasDefault && !given[flag.Name] {
+			target.SetString(model)
+		}
+		target.SetString(ResolveModel(config.ModelAliases, target.String()))
+	}
+	return nil
+}
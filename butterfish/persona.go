@@ -0,0 +1,122 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A project can describe itself to the model in a .butterfish.yaml file at
+// its root, e.g.
+//
+//	persona: You are assisting with a Terraform repo. Prefer the terraform
+//	  CLI and AWS, and never suggest terraform apply without a plan.
+//
+// The persona is added to the system message of every request made while the
+// shell's working directory, or the directory a command is run in, is inside
+// the project. The nearest file up the directory tree wins.
+
+const (
+	projectConfigFileName = ".butterfish.yaml"
+	// A persona is cut to this many bytes so a file can't crowd out the
+	// rest of the system message
+	personaMaxBytes = 2000
+)
+
+type ProjectConfig struct {
+	Persona string `yaml:"persona"`
+}
+
+// Parsed project files, re-read when they change
+type projectConfigEntry struct {
+	ModTime time.Time
+	Config  *ProjectConfig
+}
+
+var (
+	projectConfigs      = map[string]*projectConfigEntry{}
+	projectConfigsMutex sync.Mutex
+)
+
+// The nearest project file in dir or above it, and its config. Returns an
+// empty path if there isn't one.
+func findProjectConfig(dir string) (string, *ProjectConfig, error) {
+	if dir == "" {
+		return "", nil, nil
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for {
+		path := filepath.Join(dir, projectConfigFileName)
+		info, err := os.Stat(path)
+		if err == nil && !info.IsDir() {
+			config, err := loadProjectConfig(path, info.ModTime())
+			return path, config, err
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", nil, err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil, nil
+		}
+		dir = parent
+	}
+}
+
+func loadProjectConfig(path string, modTime time.Time) (*ProjectConfig, error) {
+	projectConfigsMutex.Lock()
+	defer projectConfigsMutex.Unlock()
+
+	if entry, ok := projectConfigs[path]; ok && entry.ModTime.Equal(modTime) {
+		return entry.Config, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &ProjectConfig{}
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", path, err)
+	}
+	projectConfigs[path] = &projectConfigEntry{ModTime: modTime, Config: config}
+	return config, nil
+}
+
+// The persona of the project containing the working directory, as text to
+// add to a system message, empty if there isn't one
+func personaSystemNote(env *ContextEnv) string {
+	if env.RemoteHost != "" {
+		return ""
+	}
+	path, config, err := findProjectConfig(env.Cwd())
+	if err != nil {
+		log.Printf("Error reading project config: %s", err)
+		return ""
+	}
+	if config == nil {
+		return ""
+	}
+	persona := strings.TrimSpace(config.Persona)
+	if persona == "" {
+		return ""
+	}
+	if len(persona) > personaMaxBytes {
+		persona = strings.ToValidUTF8(persona[:personaMaxBytes], "")
+	}
+	return fmt.Sprintf("\n\nThe user is working in the project at %s, which describes how to assist with it:\n%s",
+		filepath.Dir(path), persona)
+}
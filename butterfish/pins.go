@@ -0,0 +1,155 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Pins are pieces of context, like the last answer or a file, that are added
+// to the system message of every shell prompt rather than kept in the
+// history, so they aren't dropped when older history is truncated to fit the
+// context window. Pin with !pin or !pin <file>, and list or remove pins
+// with !pins.
+
+// Pins are sent with every prompt, so we cap them to leave room for history
+const maxPinnedTokens = 2048
+
+// How much of each pin to show when listing them
+const pinPreviewLength = 60
+
+type Pin struct {
+	// Where the pin came from, "answer" or "file <path>"
+	Source  string
+	Content string
+}
+
+// The text added to the system message for a set of pins
+func pinsSystemNote(pins []*Pin) string {
+	if len(pins) == 0 {
+		return ""
+	}
+	builder := strings.Builder{}
+	builder.WriteString("\n\nThe user pinned the following context, keep it in mind for the whole session:")
+	for _, pin := range pins {
+		fmt.Fprintf(&builder, "\n---\nPinned %s:\n%s", pin.Source, pin.Content)
+	}
+	return builder.String()
+}
+
+func pinPreview(content string) string {
+	preview := strings.Join(strings.Fields(content), " ")
+	if len(preview) > pinPreviewLength {
+		preview = preview[:pinPreviewLength] + "..."
+	}
+	return preview
+}
+
+// The content of the last LLM answer in the history
+func (this *ShellHistory) LastAnswer() string {
+	answer := ""
+	this.IterateBlocks(func(block *HistoryBuffer) bool {
+		if block.Type == historyTypeLLMOutput {
+			answer = strings.TrimSpace(strings.ReplaceAll(
+				sanitizeTTYString(block.Content.String()), "\r", ""))
+		}
+		return answer == ""
+	})
+	return answer
+}
+
+func loadPinFile(path string) (*Pin, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(shellWorkingDir(), path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("%s is not a text file", path)
+	}
+	return &Pin{Source: "file " + path, Content: strings.TrimSpace(string(data))}, nil
+}
+
+// Pin the last answer, or a file if a path is given
+func (this *ShellState) PinCommand(args []string) {
+	text, err := this.addPin(strings.Join(args, " "))
+	if err != nil {
+		text = fmt.Sprintf("Could not pin: %s", err)
+	}
+	fmt.Fprintf(this.ParentOut, "%s%s%s\r\n", this.Color.Answer, text, this.Color.Command)
+	this.SendPromptResponse("")
+}
+
+func (this *ShellState) addPin(path string) (string, error) {
+	var pin *Pin
+	if path == "" {
+		answer := this.History.LastAnswer()
+		if answer == "" {
+			return "", errors.New("there's no answer to pin yet")
+		}
+		pin = &Pin{Source: "answer", Content: answer}
+	} else {
+		var err error
+		pin, err = loadPinFile(path)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	pins := append(this.Pins, pin)
+	tokens := this.getPromptTokenizer().CountTokens(pinsSystemNote(pins))
+	if tokens > maxPinnedTokens {
+		return "", fmt.Errorf("pins would take %d tokens, the maximum is %d, remove some with !pins rm <number>", tokens, maxPinnedTokens)
+	}
+	this.Pins = pins
+	return fmt.Sprintf("Pinned %s (%d of %d pinned tokens used).", pin.Source, tokens, maxPinnedTokens), nil
+}
+
+// List pins, or remove them with !pins rm <number> or !pins clear
+func (this *ShellState) PinsCommand(args []string) {
+	var text string
+	switch {
+	case len(args) == 0:
+		if len(this.Pins) == 0 {
+			text = "Nothing pinned, use !pin to pin the last answer or !pin <file> to pin a file."
+			break
+		}
+		lines := []string{}
+		for i, pin := range this.Pins {
+			lines = append(lines, fmt.Sprintf("%d. %s: %s", i+1, pin.Source, pinPreview(pin.Content)))
+		}
+		text = strings.Join(lines, "\n")
+
+	case args[0] == "clear":
+		text = fmt.Sprintf("Removed %d pins.", len(this.Pins))
+		this.Pins = nil
+
+	case args[0] == "rm" && len(args) == 2:
+		i, err := strconv.Atoi(args[1])
+		if err != nil || i < 1 || i > len(this.Pins) {
+			text = fmt.Sprintf("No pin %s, use !pins to list them.", args[1])
+			break
+		}
+		text = fmt.Sprintf("Removed pin %d, %s.", i, this.Pins[i-1].Source)
+		this.Pins = append(this.Pins[:i-1], this.Pins[i:]...)
+
+	default:
+		text = "Usage: !pins, !pins rm <number>, or !pins clear"
+	}
+
+	fmt.Fprintf(this.ParentOut, "%s%s%s\r\n", this.Color.Answer,
+		strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+	this.SendPromptResponse("")
+}
@@ -0,0 +1,216 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// The pipeline builder in shell mode turns a request like "!pipe the 10
+// largest go files that mention context" into a shell pipeline, shown a
+// stage at a time with an explanation of each. The first stage is typed at
+// the prompt, and each "!pipe next" types the pipeline up to the next stage,
+// so the intermediate output can be checked before adding to it. Nothing is
+// run until the user presses enter.
+
+const pipelineTimeout = 60 * time.Second
+
+var pipelineSchema = &jsonschema.Definition{
+	Type: jsonschema.Object,
+	Properties: map[string]jsonschema.Definition{
+		"stages": {
+			Type: jsonschema.Array,
+			Items: &jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"command": {
+						Type:        jsonschema.String,
+						Description: "The stage's command, without the |",
+					},
+					"explanation": {
+						Type:        jsonschema.String,
+						Description: "What the stage does to its input",
+					},
+				},
+				Required:             []string{"command", "explanation"},
+				AdditionalProperties: false,
+			},
+		},
+	},
+	Required:             []string{"stages"},
+	AdditionalProperties: false,
+}
+
+type PipelineStage struct {
+	Command     string `json:"command"`
+	Explanation string `json:"explanation"`
+}
+
+type ShellPipeline struct {
+	Request string          `json:"-"`
+	Stages  []PipelineStage `json:"stages"`
+	// How many stages have been typed at the prompt
+	Typed int `json:"-"`
+}
+
+func parsePipeline(request, response string) (*ShellPipeline, error) {
+	pipeline := &ShellPipeline{Request: request}
+	err := json.Unmarshal([]byte(response), pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	stages := []PipelineStage{}
+	for _, stage := range pipeline.Stages {
+		stage.Command = strings.TrimSpace(strings.Trim(strings.TrimSpace(stage.Command), "|"))
+		if stage.Command != "" {
+			stages = append(stages, stage)
+		}
+	}
+	if len(stages) == 0 {
+		return nil, errors.New("the model didn't return any stages")
+	}
+	pipeline.Stages = stages
+	return pipeline, nil
+}
+
+// The pipeline up to and including stage n, counting from 1
+func (this *ShellPipeline) Command(n int) string {
+	commands := []string{}
+	for _, stage := range this.Stages[:n] {
+		commands = append(commands, stage.Command)
+	}
+	return strings.Join(commands, " | ")
+}
+
+// The numbered stages with their explanations, the stages that have been
+// typed are marked
+func (this *ShellPipeline) String() string {
+	builder := strings.Builder{}
+	for i, stage := range this.Stages {
+		marker := " "
+		if i < this.Typed {
+			marker = "*"
+		}
+		fmt.Fprintf(&builder, "%s%d. %s\n     %s\n", marker, i+1, stage.Command, stage.Explanation)
+	}
+	return builder.String()
+}
+
+// Handle !pipe, either with a request to build a new pipeline, or with
+// next, all, or no argument to work with the current one
+func (this *ShellState) PipelineCommand(args []string) {
+	if len(args) == 1 {
+		switch args[0] {
+		case "next", "all":
+			this.typePipeline(args[0] == "all")
+			return
+		}
+	}
+	if len(args) == 0 {
+		text := "No pipeline yet, use !pipe <request>, e.g. !pipe the 10 largest files under src\n"
+		if this.Pipeline != nil {
+			text = this.Pipeline.String() + pipelineHint(this.Pipeline)
+		}
+		this.printPipeline(text)
+		this.SendPromptResponse("")
+		return
+	}
+
+	request := strings.Join(args, " ")
+	promptStr, err := this.GetPrompt(prompt.ShellPipeline, "request", request)
+	if err != nil {
+		this.PrintError(err)
+		return
+	}
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		this.PrintError(err)
+		return
+	}
+
+	this.setState(statePromptResponse)
+	requestCtx, cancel := context.WithTimeout(context.Background(), pipelineTimeout)
+	this.PromptResponseCancel = cancel
+	this.History.Append(historyTypePrompt, "Build a pipeline: "+request)
+
+	bf := this.Butterfish.snapshot()
+	go func() {
+		defer cancel()
+		response, err := bf.completeWithSchema(&util.CompletionRequest{
+			Ctx:              requestCtx,
+			Prompt:           promptStr,
+			PromptName:       prompt.ShellPipeline,
+			Model:            bf.Config.ShellPromptModel,
+			MaxTokens:        bf.Config.ShellMaxResponseTokens,
+			Temperature:      0.2,
+			SystemMessage:    sysMsg,
+			SystemPromptName: prompt.PromptSystemMessage,
+			Verbose:          bf.Config.Verbose > 0,
+			Task:             TaskShellPrompt,
+			TokenTimeout:     bf.Config.TokenTimeout,
+		}, pipelineSchema)
+
+		var pipeline *ShellPipeline
+		if err == nil {
+			pipeline, err = parsePipeline(request, response.Completion)
+		}
+		if err != nil {
+			this.printPipeline(fmt.Sprintf("Could not build a pipeline: %s\n", err))
+			this.PromptOutputChan <- &util.CompletionResponse{}
+			return
+		}
+
+		// the first stage is typed when we get a new prompt
+		pipeline.Typed = 1
+		this.Pipeline = pipeline
+		this.PendingChildInput = pipeline.Command(1)
+		this.printPipeline(pipeline.String() + pipelineHint(pipeline))
+		this.PromptOutputChan <- &util.CompletionResponse{
+			Completion:       "Pipeline stages:\n" + pipeline.String(),
+			PromptTokens:     response.PromptTokens,
+			CompletionTokens: response.CompletionTokens,
+		}
+	}()
+}
+
+// Type the pipeline up to its next stage, or all of it, at the prompt
+func (this *ShellState) typePipeline(all bool) {
+	pipeline := this.Pipeline
+	switch {
+	case pipeline == nil:
+		this.printPipeline("No pipeline yet, use !pipe <request>\n")
+	case pipeline.Typed >= len(pipeline.Stages) && !all:
+		this.printPipeline("That was the last stage, the whole pipeline is typed.\n")
+		this.PendingChildInput = pipeline.Command(len(pipeline.Stages))
+	default:
+		pipeline.Typed++
+		if all {
+			pipeline.Typed = len(pipeline.Stages)
+		}
+		stage := pipeline.Stages[pipeline.Typed-1]
+		this.printPipeline(fmt.Sprintf("Stage %d of %d: %s\n", pipeline.Typed, len(pipeline.Stages), stage.Explanation))
+		this.PendingChildInput = pipeline.Command(pipeline.Typed)
+	}
+	this.SendPromptResponse("")
+}
+
+func pipelineHint(pipeline *ShellPipeline) string {
+	if pipeline.Typed >= len(pipeline.Stages) {
+		return "Press enter to run the pipeline.\n"
+	}
+	return fmt.Sprintf("Stage %d of %d is at the prompt, press enter to run it and check its output, then use !pipe next to add the next stage or !pipe all for the rest.\n",
+		pipeline.Typed, len(pipeline.Stages))
+}
+
+func (this *ShellState) printPipeline(text string) {
+	fmt.Fprintf(this.ParentOut, "%s%s%s", this.Color.Answer,
+		strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+}
@@ -0,0 +1,89 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// The user's OS, distro, and package manager are detected once and given to
+// the model as the {platform} system message field, so install instructions
+// and paths match their system, e.g. apt and /etc/apt on Debian rather than
+// brew.
+
+type Platform struct {
+	OS             string // runtime.GOOS, e.g. linux
+	Distro         string // e.g. Ubuntu 22.04.4 LTS or macOS 14.5
+	PackageManager string // e.g. apt, empty if none was found
+}
+
+func (this *Platform) String() string {
+	name := this.OS
+	if this.Distro != "" {
+		name = fmt.Sprintf("%s (%s)", this.Distro, this.OS)
+	}
+	if this.PackageManager == "" {
+		return name + ", no known package manager"
+	}
+	return fmt.Sprintf("%s, packages are installed with %s", name, this.PackageManager)
+}
+
+var (
+	platform     *Platform
+	platformOnce sync.Once
+)
+
+// Detect the platform the first time it's needed
+func GetPlatform() *Platform {
+	platformOnce.Do(func() {
+		platform = &Platform{
+			OS:             runtime.GOOS,
+			Distro:         detectDistro(),
+			PackageManager: detectPackageManager(),
+		}
+		log.Printf("Detected platform: %s", platform)
+	})
+	return platform
+}
+
+func detectDistro() string {
+	switch runtime.GOOS {
+	case "linux":
+		content, err := os.ReadFile("/etc/os-release")
+		if err != nil {
+			return ""
+		}
+		return parseOSRelease(string(content))
+	case "darwin":
+		out, err := exec.Command("sw_vers", "-productVersion").Output()
+		if err != nil {
+			return "macOS"
+		}
+		return "macOS " + strings.TrimSpace(string(out))
+	case "windows":
+		return "Windows"
+	}
+	return ""
+}
+
+// The distro name from the contents of /etc/os-release, preferring
+// PRETTY_NAME, then NAME and VERSION_ID
+func parseOSRelease(content string) string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		fields[key] = strings.Trim(value, `"'`)
+	}
+
+	if fields["PRETTY_NAME"] != "" {
+		return fields["PRETTY_NAME"]
+	}
+	return strings.TrimSpace(fields["NAME"] + " " + fields["VERSION_ID"])
+}
@@ -0,0 +1,153 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// So that butterfish prompt composes in pipelines and Makefiles, an argument
+// of - stands for stdin, and context can be read from files or extra file
+// descriptors, e.g.
+//
+//	git diff | butterfish prompt "Review this diff:" - --context-file STYLE.md
+//	butterfish prompt --context-fd 3 "Why did the build fail?" 3<build.log
+
+// File descriptors below this are checked at startup for --context-fd
+const contextFdLimit = 64
+
+// Only file descriptors that were open when butterfish started can be read
+// with --context-fd, not ones that the runtime or butterfish opened since,
+// e.g. the log file
+var inheritedFds = openFds(3, contextFdLimit)
+
+func openFds(from, to int) map[int]bool {
+	fds := map[int]bool{}
+	stat := syscall.Stat_t{}
+	for fd := from; fd < to; fd++ {
+		if syscall.Fstat(fd, &stat) == nil {
+			fds[fd] = true
+		}
+	}
+	return fds
+}
+
+// A duplicate of a --context-fd file descriptor to read from, so that
+// closing it leaves the original alone. It must be a file or a pipe.
+func openContextFd(fd int) (*os.File, error) {
+	if fd <= 2 || fd >= contextFdLimit {
+		return nil, fmt.Errorf("Context can't be read from fd %d, use 3 to %d", fd, contextFdLimit-1)
+	}
+	if !inheritedFds[fd] {
+		return nil, fmt.Errorf("fd %d isn't open, e.g. run with 3<file for --context-fd 3", fd)
+	}
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, fmt.Errorf("fd %d isn't open, e.g. run with 3<file for --context-fd 3", fd)
+	}
+	syscall.CloseOnExec(dup)
+	file := os.NewFile(uintptr(dup), fmt.Sprintf("fd %d", fd))
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() && info.Mode()&fs.ModeNamedPipe == 0 {
+		file.Close()
+		return nil, fmt.Errorf("Context can't be read from fd %d, it isn't a file or a pipe", fd)
+	}
+	return file, nil
+}
+
+// The prompt command's input from its arguments and stdin, which is nil if
+// nothing was piped. An argument of - is replaced with stdin, otherwise
+// stdin follows the arguments on a new line.
+func promptInput(args []string, stdin io.Reader) (string, error) {
+	hasDash := false
+	for _, arg := range args {
+		if arg == "-" {
+			hasDash = true
+		}
+	}
+	if hasDash && stdin == nil {
+		stdin = os.Stdin
+	}
+
+	piped := ""
+	if stdin != nil {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return "", err
+		}
+		piped = strings.TrimRight(string(data), "\n")
+	}
+
+	if hasDash {
+		parts := []string{}
+		for _, arg := range args {
+			if arg == "-" {
+				arg = piped
+			}
+			parts = append(parts, arg)
+		}
+		return strings.Join(parts, " "), nil
+	}
+
+	prompt := strings.Join(args, " ")
+	if piped == "" {
+		return prompt, nil
+	} else if prompt == "" {
+		return piped, nil
+	}
+	return fmt.Sprintf("%s\n%s", prompt, piped), nil
+}
+
+// Read the context files and file descriptors, each is quoted and labeled
+// so that the model can tell them apart from the prompt
+func readPromptContext(files []string, fds []int) (string, error) {
+	builder := strings.Builder{}
+	add := func(name string, reader io.Reader) error {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return fmt.Errorf("Error reading context from %s: %w", name, err)
+		}
+		content := strings.TrimRight(string(data), "\n")
+		if content != "" {
+			fmt.Fprintf(&builder, "Context from %s:\n'''\n%s\n'''\n\n", name, content)
+		}
+		return nil
+	}
+
+	for _, path := range files {
+		if path == "-" {
+			return "", errors.New("Context can't be read from stdin, use - as the prompt instead")
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		err = add(path, file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for _, fd := range fds {
+		file, err := openContextFd(fd)
+		if err != nil {
+			return "", err
+		}
+		err = add(file.Name(), file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return builder.String(), nil
+}
@@ -0,0 +1,198 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// With explain-before-execute on, a generated command is described in one
+// sentence, along with whether it only reads state or changes it, before
+// it's offered to run. This applies to gencmd and to goal mode commands in
+// shell mode, where it can be toggled with !explainfirst.
+
+const (
+	commandImpactReadOnly = "read-only"
+	commandImpactMutating = "mutating"
+
+	commandPreviewTimeout   = 20 * time.Second
+	commandPreviewMaxTokens = 256
+)
+
+var commandPreviewSchema = &jsonschema.Definition{
+	Type: jsonschema.Object,
+	Properties: map[string]jsonschema.Definition{
+		"explanation": {
+			Type:        jsonschema.String,
+			Description: "One sentence on what the command will do",
+		},
+		"impact": {
+			Type: jsonschema.String,
+			Enum: []string{commandImpactReadOnly, commandImpactMutating},
+		},
+	},
+	Required:             []string{"explanation", "impact"},
+	AdditionalProperties: false,
+}
+
+type CommandPreview struct {
+	Explanation string `json:"explanation"`
+	Impact      string `json:"impact"`
+}
+
+func (this *CommandPreview) Mutating() bool {
+	return this.Impact != commandImpactReadOnly
+}
+
+func (this *CommandPreview) String() string {
+	return fmt.Sprintf("%s [%s]", this.Explanation, this.Impact)
+}
+
+func parseCommandPreview(response string) (*CommandPreview, error) {
+	preview := &CommandPreview{}
+	err := json.Unmarshal([]byte(response), preview)
+	if err != nil {
+		return nil, err
+	}
+	preview.Explanation = strings.TrimSpace(preview.Explanation)
+	// anything we can't tell is read-only is treated as mutating
+	if preview.Impact != commandImpactReadOnly {
+		preview.Impact = commandImpactMutating
+	}
+	return preview, nil
+}
+
+// Ask the model to explain a command and assess its impact
+func (this *ButterfishCtx) previewCommand(ctx context.Context, command, model, sysMsg string) (*CommandPreview, error) {
+	promptStr, err := this.GetPrompt(prompt.PromptCommandPreview, "command", command)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, commandPreviewTimeout)
+	defer cancel()
+	response, err := this.completeWithSchema(&util.CompletionRequest{
+		Ctx:           ctx,
+		Prompt:        promptStr,
+		PromptName:    prompt.PromptCommandPreview,
+		Model:         model,
+		MaxTokens:     commandPreviewMaxTokens,
+		Temperature:   0,
+		SystemMessage: sysMsg,
+		// both callers use the default system message
+		SystemPromptName: prompt.PromptSystemMessage,
+		Verbose:          this.Config.Verbose > 0,
+		TokenTimeout:     this.Config.TokenTimeout,
+	}, commandPreviewSchema)
+	if err != nil {
+		return nil, err
+	}
+	return parseCommandPreview(response.Completion)
+}
+
+// Print a generated command with its explanation and impact, then run it if
+// the user confirms, or straight away if force is set
+func (this *ButterfishCtx) explainAndOfferCommand(command string, force bool) error {
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return err
+	}
+	preview, err := this.previewCommand(this.Ctx, command, this.Config.GencmdModel, sysMsg)
+	if err != nil {
+		return err
+	}
+
+	this.StylePrintf(this.Config.Styles.Highlight, "%s\n", command)
+	style := this.Config.Styles.Answer
+	if preview.Mutating() {
+		style = this.Config.Styles.Error
+	}
+	this.StylePrintf(style, "%s\n", preview)
+
+	if !force {
+		ok, err := this.confirm("Run this command?")
+		if err != nil || !ok {
+			return err
+		}
+	}
+	_, err = this.execCommand(command)
+	return err
+}
+
+// Turn explain-before-execute on or off, with no args we toggle
+func (this *ShellState) ToggleExplainFirst(args []string) {
+	switch {
+	case len(args) > 0 && args[0] == "on":
+		this.ExplainFirstEnabled = true
+	case len(args) > 0 && args[0] == "off":
+		this.ExplainFirstEnabled = false
+	default:
+		this.ExplainFirstEnabled = !this.ExplainFirstEnabled
+	}
+
+	text := "Goal mode commands won't be explained before they're offered to run.\n"
+	if this.ExplainFirstEnabled {
+		text = "Goal mode commands will be explained, and marked read-only or mutating, before they're offered to run.\n"
+	}
+	fmt.Fprintf(this.ParentOut, "%s%s%s", this.Color.Answer,
+		strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+	this.SendPromptResponse("")
+}
+
+type commandPreviewResult struct {
+	Command string
+	Preview *CommandPreview
+}
+
+// Explain a goal mode command in the background, the command is typed at the
+// prompt once the explanation is printed, see ShowCommandPreview. If the
+// explanation fails the command is still offered.
+func (this *ShellState) PreviewGoalModeCommand(command string) {
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		log.Printf("Error getting command preview system message: %s", err)
+	}
+
+	bf := this.Butterfish.snapshot()
+	go func() {
+		preview, err := bf.previewCommand(bf.Ctx, command,
+			bf.Config.ShellPromptModel, sysMsg)
+		if err != nil {
+			log.Printf("Error explaining command: %s", err)
+		}
+		select {
+		case this.CommandPreviewChan <- &commandPreviewResult{Command: command, Preview: preview}:
+		case <-bf.Ctx.Done():
+		}
+	}()
+}
+
+// Print a command's explanation and type the command at a new prompt
+func (this *ShellState) ShowCommandPreview(result *commandPreviewResult) {
+	if !this.GoalMode || this.GoalModeCommand != result.Command {
+		log.Printf("Dropping command preview, goal mode moved on: %s", result.Command)
+		return
+	}
+
+	// We overwrite the current prompt line with the explanation, then ask the
+	// shell for a new prompt below it. That prompt doesn't count towards the
+	// end of the command's output.
+	if result.Preview != nil {
+		color := this.Color.Answer
+		if result.Preview.Mutating() {
+			color = this.Color.Error
+		}
+		fmt.Fprintf(this.ParentOut, "%s%s# %s%s", this.ownLinePrefix(), color, result.Preview, this.Color.Command)
+		this.PromptSuffixCounter--
+		this.ChildIn.Write([]byte("\n"))
+	}
+	fmt.Fprintf(this.ChildIn, "%s", result.Command)
+	this.Butterfish.Stats.Record(StatsEvent{Type: statsEventCommandGenerated})
+}
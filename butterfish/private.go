@@ -0,0 +1,82 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Commands that handle secrets can be kept out of the history that's sent to
+// the model. A command matching one of the private_commands patterns in the
+// config file isn't captured, nor is its output, and isn't annotated,
+// summarized, or recorded. Patterns match the program or the whole command
+// line, and * matches any text, e.g.
+//
+//	private_commands: [pass, vault, history, "* --password*"]
+//
+// In the shell, !private turns the same thing on for every command until
+// it's turned off. Nothing typed is autosuggested from and goal mode hooks
+// don't fire while it's on.
+
+// Compile private command patterns, * matches any text and everything else
+// is literal
+func compilePrivatePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := []*regexp.Regexp{}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			return nil, errors.New("private_commands has an empty pattern")
+		}
+		parts := strings.Split(pattern, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		compiled = append(compiled, regexp.MustCompile("^"+strings.Join(parts, ".*")+"$"))
+	}
+	return compiled, nil
+}
+
+// Whether command matches a private command pattern
+func isPrivateCommand(patterns []*regexp.Regexp, command string) bool {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return false
+	}
+	program := commandProgram(command)
+	for _, pattern := range patterns {
+		if pattern.MatchString(program) || pattern.MatchString(command) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fire goal mode hooks unless private mode is on or command is private,
+// since hooks send the goal and message to other programs
+func (this *ShellState) fireHooks(event, command, message string) {
+	if this.PrivateEnabled || isPrivateCommand(this.Butterfish.Config.ShellPrivateCommands, command) {
+		return
+	}
+	this.Butterfish.fireHooks(event, this.GoalModeGoal, message)
+}
+
+func (this *ShellState) TogglePrivate(args []string) {
+	switch {
+	case len(args) > 0 && args[0] == "on":
+		this.PrivateEnabled = true
+	case len(args) > 0 && args[0] == "off":
+		this.PrivateEnabled = false
+	default:
+		this.PrivateEnabled = !this.PrivateEnabled
+	}
+
+	text := "Private mode off, commands and their output are added to the history again.\n"
+	if this.PrivateEnabled {
+		text = "Private mode on, commands and their output are left out of the history until !private off.\n"
+	}
+	this.UpdateStatusLine()
+	fmt.Fprintf(this.ParentOut, "%s%s%s", this.Color.Answer,
+		strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+	this.SendPromptResponse("")
+}
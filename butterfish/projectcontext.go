@@ -0,0 +1,109 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bakks/butterfish/embedding"
+)
+
+// Project context adds excerpts of project files like the Makefile,
+// package.json, or README, found with the embeddings index, to the system
+// message when generating commands, so that e.g. `gencmd "run the tests"`
+// gives the project's own test command. It's turned on with
+// --project-context and only uses files already indexed with
+// `butterfish index`.
+
+// Number of index results to include
+const projectContextResults = 3
+
+// Limit on the excerpts added to the system message
+const projectContextMaxBytes = 4000
+
+// Autosuggest doesn't have a description to search for, so we search for
+// the files that say how to work with the project
+const projectContextAutosuggestQuery = "How to build, test, run, lint, and deploy this project, e.g. Makefile targets, package.json scripts, or README instructions"
+
+// The root of the project containing dir, i.e. the git repo, or else dir
+func projectRoot(ctx context.Context, dir string) string {
+	root, err := gitOutputIn(ctx, dir, "rev-parse", "--show-toplevel")
+	if err != nil || strings.TrimSpace(root) == "" {
+		return dir
+	}
+	return strings.TrimSpace(root)
+}
+
+// An index that searches the cached index files under dir, a directory at a
+// time. We don't index anything here, we don't want to kick off embedding a
+// whole directory tree.
+func (this *ButterfishCtx) cachedIndex(dir string) *embedding.DiskCachedEmbeddingIndex {
+	index := embedding.NewDiskCachedEmbeddingIndex(this, io.Discard)
+	index.Cipher = this.Cipher
+	index.ScanPaths = []string{dir}
+	return index
+}
+
+// Search the index of the project containing dir and format the results to
+// be added to a system message, empty if the project isn't indexed
+func (this *ButterfishCtx) projectContext(ctx context.Context, dir, query string) (string, error) {
+	root := projectRoot(ctx, dir)
+	results, err := this.cachedIndex(root).Search(ctx, query, projectContextResults)
+	if err != nil {
+		return "", err
+	}
+
+	builder := strings.Builder{}
+	for _, result := range results {
+		path, err := filepath.Rel(root, result.FilePath)
+		if err != nil {
+			path = result.FilePath
+		}
+		fmt.Fprintf(&builder, "\n---\n%s:\n%s", path, result.Content)
+	}
+	excerpts := builder.String()
+	if excerpts == "" {
+		return "", nil
+	}
+	if len(excerpts) > projectContextMaxBytes {
+		excerpts = excerpts[:projectContextMaxBytes] + "\n..."
+	}
+	return "\n\nExcerpts from files in the current project, use the project's own commands and scripts where they fit:" + excerpts, nil
+}
+
+// Project context for autosuggest, cached per directory since the query is
+// the same for every suggestion
+type projectContextCache struct {
+	mutex   sync.Mutex
+	entries map[string]string
+}
+
+// Project context for an autosuggest request, called in its goroutine with a
+// snapshot of the ButterfishCtx
+func (this *ShellState) AutosuggestProjectContext(ctx context.Context, bf *ButterfishCtx) string {
+	dir := shellWorkingDir()
+	cache := this.ProjectContextCache
+
+	cache.mutex.Lock()
+	excerpts, ok := cache.entries[dir]
+	cache.mutex.Unlock()
+	if ok {
+		return excerpts
+	}
+
+	excerpts, err := bf.projectContext(ctx, dir, projectContextAutosuggestQuery)
+	if err != nil {
+		// try again next time, e.g. if the request was cancelled
+		log.Printf("Error getting project context: %s", err)
+		return ""
+	}
+
+	cache.mutex.Lock()
+	cache.entries[dir] = excerpts
+	cache.mutex.Unlock()
+	return excerpts
+}
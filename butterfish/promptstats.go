@@ -0,0 +1,88 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+// A row of the prompts stats report, Usage is empty for unused prompts
+type promptStatsRow struct {
+	Name  string
+	Usage prompt.PromptUsage
+}
+
+// Report the usage of each prompt in the library, sorted by uses, last
+// used, or average response tokens, most first. Prompts that were never
+// used are included so they can be pruned.
+func BuildPromptStatsReport(prompts []prompt.Prompt, usage map[string]*prompt.PromptUsage, sortBy string) string {
+	rows := []*promptStatsRow{}
+	for _, p := range prompts {
+		row := &promptStatsRow{Name: p.Name}
+		if usage[p.Name] != nil {
+			row.Usage = *usage[p.Name]
+		}
+		rows = append(rows, row)
+	}
+
+	less := func(a, b *promptStatsRow) bool {
+		return a.Usage.Invocations > b.Usage.Invocations
+	}
+	switch sortBy {
+	case "last-used":
+		less = func(a, b *promptStatsRow) bool {
+			return a.Usage.LastUsed.After(b.Usage.LastUsed)
+		}
+	case "tokens":
+		less = func(a, b *promptStatsRow) bool {
+			return a.Usage.AverageResponseTokens() > b.Usage.AverageResponseTokens()
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if less(rows[i], rows[j]) != less(rows[j], rows[i]) {
+			return less(rows[i], rows[j])
+		}
+		return rows[i].Name < rows[j].Name
+	})
+
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "%-36s %8s  %-16s  %s\n", "Prompt", "Uses", "Last used", "Avg response tokens")
+	unused := 0
+	for _, row := range rows {
+		lastUsed := "never"
+		if !row.Usage.LastUsed.IsZero() {
+			lastUsed = row.Usage.LastUsed.Local().Format("2006-01-02 15:04")
+		} else {
+			unused++
+		}
+		tokens := "-"
+		if row.Usage.Responses > 0 {
+			tokens = fmt.Sprintf("%.0f", row.Usage.AverageResponseTokens())
+		}
+		fmt.Fprintf(&builder, "%-36s %8d  %-16s  %s\n", row.Name, row.Usage.Invocations, lastUsed, tokens)
+	}
+	if unused > 0 {
+		fmt.Fprintf(&builder, "\n%d of %d prompts have never been used\n", unused, len(rows))
+	}
+	return builder.String()
+}
+
+func (this *ButterfishCtx) promptsStatsCommand(options *CliCommandConfig) error {
+	library, ok := this.PromptLibrary.(*prompt.DiskPromptLibrary)
+	if !ok || library.Usage == nil {
+		return errors.New("Prompt usage is only tracked for the prompt library file")
+	}
+
+	usage, err := library.Usage.Load()
+	if err != nil {
+		return err
+	}
+
+	this.StylePrintf(this.Config.Styles.Highlight, "Prompt usage from %s\n\n", library.Usage.Path)
+	this.StylePrintf(this.Config.Styles.Foreground, "%s",
+		BuildPromptStatsReport(library.Prompts, usage, options.Prompts.Stats.Sort))
+	return nil
+}
@@ -0,0 +1,181 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/mitchellh/go-homedir"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// `butterfish prompts sync` shares a prompt library across a team. It fetches
+// a git repo of prompt YAML files, in the same format as prompts.yaml, and
+// merges them into the local library. Prompts the user has customized
+// (OkToReplace false) are left alone. Configured in the config file with:
+//
+//	prompt_sync:
+//	  url: git@github.com:example/prompts.git
+//	  branch: main
+//	  path: butterfish
+type PromptSyncConfig struct {
+	// Git URL of the repo holding the prompts
+	URL string `yaml:"url"`
+	// Branch to sync, defaults to the remote's default branch
+	Branch string `yaml:"branch"`
+	// YAML file or directory of YAML files in the repo, defaults to the root
+	Path string `yaml:"path"`
+}
+
+// Where the synced repo is checked out
+const promptSyncDir = "~/.config/butterfish/prompt_sync"
+
+// Fetch the latest commit of the branch into dir, cloning if needed. We fetch
+// and reset rather than pull so that a changed URL or branch, or a history
+// rewrite upstream, doesn't leave the checkout stuck.
+func (this *ButterfishCtx) fetchPromptRepo(dir string, sync *PromptSyncConfig) error {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+		_, err = gitOutputIn(this.Ctx, dir, "init", "-q")
+		if err != nil {
+			return err
+		}
+		_, err = gitOutputIn(this.Ctx, dir, "remote", "add", "origin", sync.URL)
+	} else if err == nil {
+		_, err = gitOutputIn(this.Ctx, dir, "remote", "set-url", "origin", sync.URL)
+	}
+	if err != nil {
+		return err
+	}
+
+	ref := sync.Branch
+	if ref == "" {
+		ref = "HEAD"
+	}
+	_, err = gitOutputIn(this.Ctx, dir, "fetch", "-q", "--depth", "1", "origin", ref)
+	if err != nil {
+		return err
+	}
+	_, err = gitOutputIn(this.Ctx, dir, "reset", "-q", "--hard", "FETCH_HEAD")
+	return err
+}
+
+// Load prompts from a YAML file, or from each YAML file in a directory
+func LoadSyncedPrompts(path string) ([]prompt.Prompt, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files = []string{}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	prompts := []prompt.Prompt{}
+	seen := map[string]string{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		filePrompts := []prompt.Prompt{}
+		err = yaml.Unmarshal(data, &filePrompts)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %w", file, err)
+		}
+		for _, p := range filePrompts {
+			if p.Name == "" || strings.TrimSpace(p.Prompt) == "" {
+				return nil, fmt.Errorf("Prompts in %s need a name and a prompt", file)
+			}
+			if other, ok := seen[p.Name]; ok {
+				return nil, fmt.Errorf("Prompt %s is in both %s and %s", p.Name, other, file)
+			}
+			seen[p.Name] = file
+			prompts = append(prompts, p)
+		}
+	}
+
+	if len(prompts) == 0 {
+		return nil, fmt.Errorf("No prompts found in %s", path)
+	}
+	return prompts, nil
+}
+
+func (this *ButterfishCtx) promptsSyncCommand(options *CliCommandConfig) error {
+	args := options.Prompts.Sync
+	sync := PromptSyncConfig{}
+	if this.Config.PromptSync != nil {
+		sync = *this.Config.PromptSync
+	}
+	if args.URL != "" {
+		sync.URL = args.URL
+	}
+	if args.Branch != "" {
+		sync.Branch = args.Branch
+	}
+	if args.Path != "" {
+		sync.Path = args.Path
+	}
+	if sync.URL == "" {
+		return errors.New("No prompt repo configured, set prompt_sync url in the config file or pass --url")
+	}
+
+	library, ok := this.PromptLibrary.(*prompt.DiskPromptLibrary)
+	if !ok {
+		return errors.New("Prompts can only be synced into the prompt library file")
+	}
+
+	dir, err := homedir.Expand(promptSyncDir)
+	if err != nil {
+		return err
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "Fetching %s\n", sync.URL)
+	err = this.fetchPromptRepo(dir, &sync)
+	if err != nil {
+		return err
+	}
+
+	// keep the path inside the repo
+	relPath := filepath.Clean(filepath.Join("/", sync.Path))
+	prompts, err := LoadSyncedPrompts(filepath.Join(dir, relPath))
+	if err != nil {
+		return err
+	}
+
+	added, updated, skipped := library.SyncPrompts(prompts, sync.URL)
+	err = library.Save()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range added {
+		this.StylePrintf(this.Config.Styles.Answer, "Added %s\n", name)
+	}
+	for _, name := range updated {
+		this.StylePrintf(this.Config.Styles.Answer, "Updated %s\n", name)
+	}
+	for _, name := range skipped {
+		this.StylePrintf(this.Config.Styles.Grey, "Kept local %s, it's customized (OkToReplace is false)\n", name)
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "Synced %d prompt(s) into %s\n", len(prompts), library.Path)
+	return nil
+}
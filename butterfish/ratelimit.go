@@ -0,0 +1,245 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/mitchellh/go-homedir"
+)
+
+// RateLimitConfig configures a request rate limit shared by every butterfish
+// process run by the user, set in the config file, e.g.
+//
+//	rate_limit:
+//	  requests_per_minute: 60
+//	  background_reserve: 0.25
+type RateLimitConfig struct {
+	// Requests per minute across all butterfish processes
+	RequestsPerMinute float64 `yaml:"requests_per_minute"`
+	// Fraction of the bucket that background work like indexing can't use, so
+	// that interactive requests like autosuggest still go through
+	BackgroundReserve float64 `yaml:"background_reserve"`
+	// Path of the shared bucket state file
+	Path string `yaml:"path"`
+}
+
+const (
+	defaultRateLimitPath              = "~/.config/butterfish/ratelimit.json"
+	defaultRateLimitBackgroundReserve = 0.25
+	// The most we sleep before checking the bucket again, other processes
+	// may have changed it in the meantime
+	rateLimitMaxWait = time.Second
+)
+
+type RequestPriority int
+
+const (
+	PriorityInteractive RequestPriority = iota
+	PriorityBackground
+)
+
+// The token bucket state, stored in a file so that concurrent processes share
+// it
+type rateLimitState struct {
+	Tokens  float64 `json:"tokens"`
+	Updated int64   `json:"updated"` // unix nanoseconds
+}
+
+// A token bucket rate limiter shared between processes through a state file
+// which is locked with flock while it's updated. The bucket holds up to a
+// minute of requests. Background requests can only take a token if the bucket
+// is above the reserve, so a long indexing job in one shell leaves room for
+// autosuggest in another.
+type SharedRateLimiter struct {
+	Path              string
+	RequestsPerMinute float64
+	BackgroundReserve float64
+}
+
+func NewSharedRateLimiter(config *RateLimitConfig) (*SharedRateLimiter, error) {
+	if config.RequestsPerMinute <= 0 {
+		return nil, fmt.Errorf("rate_limit requests_per_minute must be positive, got %g", config.RequestsPerMinute)
+	}
+
+	path := config.Path
+	if path == "" {
+		path = defaultRateLimitPath
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reserve := config.BackgroundReserve
+	if reserve == 0 {
+		reserve = defaultRateLimitBackgroundReserve
+	}
+	if reserve < 0 || reserve >= 1 {
+		return nil, fmt.Errorf("rate_limit background_reserve must be between 0 and 1, got %g", reserve)
+	}
+
+	return &SharedRateLimiter{
+		Path:              path,
+		RequestsPerMinute: config.RequestsPerMinute,
+		BackgroundReserve: reserve,
+	}, nil
+}
+
+// Try to take a token from the bucket, if there isn't one available returns
+// how long to wait before trying again
+func (this *SharedRateLimiter) tryTake(priority RequestPriority) (time.Duration, error) {
+	err := os.MkdirAll(filepath.Dir(this.Path), 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(this.Path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	capacity := this.RequestsPerMinute
+	perSecond := this.RequestsPerMinute / 60
+	now := time.Now()
+
+	state := rateLimitState{Tokens: capacity, Updated: now.UnixNano()}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+	// a missing or corrupt file starts as a full bucket
+	if len(data) > 0 && json.Unmarshal(data, &state) == nil {
+		elapsed := now.Sub(time.Unix(0, state.Updated)).Seconds()
+		if elapsed > 0 {
+			state.Tokens = math.Min(capacity, state.Tokens+elapsed*perSecond)
+		}
+		state.Updated = now.UnixNano()
+	}
+
+	needed := 1.0
+	if priority == PriorityBackground {
+		// with a small bucket the reserve can be more than it holds, then
+		// background requests wait for a full bucket rather than forever
+		needed = math.Min(capacity, needed+this.BackgroundReserve*capacity)
+	}
+	if state.Tokens < needed {
+		wait := time.Duration((needed - state.Tokens) / perSecond * float64(time.Second))
+		return wait, nil
+	}
+
+	state.Tokens--
+	data, err = json.Marshal(state)
+	if err != nil {
+		return 0, err
+	}
+	err = file.Truncate(0)
+	if err != nil {
+		return 0, err
+	}
+	_, err = file.WriteAt(data, 0)
+	return 0, err
+}
+
+// Wait until a request of the given priority is allowed, or the context is
+// canceled
+func (this *SharedRateLimiter) Wait(ctx context.Context, priority RequestPriority) error {
+	for {
+		wait, err := this.tryTake(priority)
+		if err != nil {
+			return fmt.Errorf("Error reading rate limit state %s: %w", this.Path, err)
+		}
+		if wait == 0 {
+			return nil
+		}
+		if wait > rateLimitMaxWait {
+			wait = rateLimitMaxWait
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// An LLM implementation that waits on a SharedRateLimiter before each call.
+// Completions are interactive and embeddings, which are used for indexing,
+// are background requests.
+type RateLimitedLLM struct {
+	LLM     LLM
+	Limiter *SharedRateLimiter
+	Ctx     context.Context
+}
+
+func NewRateLimitedLLM(ctx context.Context, llm LLM, limiter *SharedRateLimiter) *RateLimitedLLM {
+	return &RateLimitedLLM{
+		LLM:     llm,
+		Limiter: limiter,
+		Ctx:     ctx,
+	}
+}
+
+// Requests may not have a context, in which case we use the session context
+func (this *RateLimitedLLM) requestCtx(request *util.CompletionRequest) context.Context {
+	if request.Ctx != nil {
+		return request.Ctx
+	}
+	return this.Ctx
+}
+
+// Batch requests wait behind interactive ones so that a long running batch
+// doesn't slow down the shell
+func requestPriority(request *util.CompletionRequest) RequestPriority {
+	if request.Task == TaskBatch {
+		return PriorityBackground
+	}
+	return PriorityInteractive
+}
+
+func (this *RateLimitedLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	err := this.Limiter.Wait(this.requestCtx(request), requestPriority(request))
+	if err != nil {
+		return nil, err
+	}
+	return this.LLM.CompletionStream(request, writer)
+}
+
+func (this *RateLimitedLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	err := this.Limiter.Wait(this.requestCtx(request), requestPriority(request))
+	if err != nil {
+		return nil, err
+	}
+	return this.LLM.Completion(request)
+}
+
+func (this *RateLimitedLLM) Embeddings(request *util.EmbeddingRequest) ([][]float32, error) {
+	err := this.Limiter.Wait(request.Ctx, PriorityBackground)
+	if err != nil {
+		return nil, err
+	}
+	return this.LLM.Embeddings(request)
+}
+
+func (this *RateLimitedLLM) Transcribe(ctx context.Context, path, model, language string) (string, error) {
+	err := this.Limiter.Wait(ctx, PriorityInteractive)
+	if err != nil {
+		return "", err
+	}
+	return transcribeWith(this.LLM, ctx, path, model, language)
+}
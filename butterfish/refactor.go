@@ -0,0 +1,343 @@
+package butterfish
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// The refactor command makes a change across several files. Relevant files
+// are found with the embeddings index, the model proposes a plan of which
+// files to change and how, and once the user approves it we ask for each
+// edited file, show the changes as diffs, and write them. Before writing we
+// save a patch that reverts the changes so they can be undone.
+
+// Maximum bytes of each file we include when planning
+const refactorMaxFileBytes = 20000
+
+// A change to one file in a refactor plan
+type RefactorChange struct {
+	Path        string `json:"path"`
+	Description string `json:"description"`
+}
+
+type RefactorPlan struct {
+	Summary string           `json:"summary"`
+	Changes []RefactorChange `json:"changes"`
+}
+
+var refactorPlanSchema = &jsonschema.Definition{
+	Type: jsonschema.Object,
+	Properties: map[string]jsonschema.Definition{
+		"summary": {
+			Type:        jsonschema.String,
+			Description: "A short summary of the refactor",
+		},
+		"changes": {
+			Type: jsonschema.Array,
+			Items: &jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"path": {
+						Type:        jsonschema.String,
+						Description: "Path of a file to edit, exactly as given",
+					},
+					"description": {
+						Type:        jsonschema.String,
+						Description: "What to change in the file",
+					},
+				},
+				Required:             []string{"path", "description"},
+				AdditionalProperties: false,
+			},
+		},
+	},
+	Required:             []string{"summary", "changes"},
+	AdditionalProperties: false,
+}
+
+// A file being refactored, lines don't include a trailing newline
+type refactorFile struct {
+	Path     string
+	Original []string
+	Edited   []string
+	Hunks    []*DiffHunk
+}
+
+func splitFileLines(content string) []string {
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+func joinFileLines(lines []string) string {
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Show a path relative to the working directory if it's inside it
+func relativePath(path string) string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	relative, err := filepath.Rel(cwd, path)
+	if err != nil || strings.HasPrefix(relative, "..") {
+		return path
+	}
+	return relative
+}
+
+// Find the files to refactor, those given by the user then the files of the
+// best matching snippets in the embeddings index
+func (this *ButterfishCtx) refactorFiles(instruction string, files []string, maxFiles int) ([]string, error) {
+	paths := []string{}
+	seen := map[string]bool{}
+	add := func(path string) {
+		path = relativePath(path)
+		if !seen[path] && len(paths) < maxFiles {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	for _, path := range files {
+		add(path)
+	}
+
+	if len(paths) < maxFiles {
+		err := this.initVectorIndex(nil)
+		if err != nil {
+			return nil, err
+		}
+		// several snippets can come from the same file
+		results, err := this.VectorIndex.Search(this.Ctx, instruction, maxFiles*3)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			add(result.FilePath)
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, errors.New("No relevant files found, index the project with butterfish index or pass files with -f")
+	}
+	return paths, nil
+}
+
+func formatRefactorFiles(paths []string) (string, error) {
+	builder := strings.Builder{}
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		if len(content) > refactorMaxFileBytes {
+			content = append(content[:refactorMaxFileBytes], []byte("\n... (truncated)")...)
+		}
+		fmt.Fprintf(&builder, "=== %s ===\n%s\n", path, content)
+	}
+	return builder.String(), nil
+}
+
+// Check a plan only edits files we showed the model
+func validateRefactorPlan(plan *RefactorPlan, paths []string) error {
+	if len(plan.Changes) == 0 {
+		return errors.New("The plan doesn't change any files")
+	}
+	for _, change := range plan.Changes {
+		if !slices.Contains(paths, change.Path) {
+			return fmt.Errorf("The plan changes %s, which isn't one of the files found for the refactor", change.Path)
+		}
+	}
+	return nil
+}
+
+func (this *ButterfishCtx) printRefactorPlan(plan *RefactorPlan) {
+	this.StylePrintf(this.Config.Styles.Highlight, "Plan: %s\n", plan.Summary)
+	for i, change := range plan.Changes {
+		this.StylePrintf(this.Config.Styles.Answer, "%d. %s: %s\n", i+1, change.Path, change.Description)
+	}
+	this.Printf("\n")
+}
+
+// A patch that undoes the changes to the files, it can be applied with
+// git apply or patch -p1
+func refactorRevertPatch(files []*refactorFile) string {
+	builder := strings.Builder{}
+	for _, file := range files {
+		applied := ApplyHunks(file.Original, file.Hunks)
+		builder.WriteString(UnifiedDiff(file.Path, DiffHunks(applied, file.Original, 3)))
+	}
+	return builder.String()
+}
+
+func (this *ButterfishCtx) refactorCommand(options *CliCommandConfig) error {
+	refactor := options.Refactor
+	instruction := this.cleanInput(refactor.Instruction)
+	if instruction == "" {
+		return errors.New("Please describe the refactor")
+	}
+
+	paths, err := this.refactorFiles(instruction, refactor.Files, refactor.MaxFiles)
+	if err != nil {
+		return err
+	}
+	filesStr, err := formatRefactorFiles(paths)
+	if err != nil {
+		return err
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "Planning with %s\n", strings.Join(paths, ", "))
+
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return err
+	}
+	planPrompt, err := this.GetPrompt(prompt.PromptRefactorPlan,
+		"instruction", instruction,
+		"files", filesStr)
+	if err != nil {
+		return err
+	}
+	request := &util.CompletionRequest{
+		Ctx:              this.Ctx,
+		Prompt:           planPrompt,
+		PromptName:       prompt.PromptRefactorPlan,
+		Model:            refactor.Model,
+		MaxTokens:        2048,
+		Temperature:      0.2,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.PromptSystemMessage,
+		Verbose:          this.Config.Verbose > 0,
+		TokenTimeout:     this.Config.TokenTimeout,
+	}
+	response, err := this.completeWithSchema(request, refactorPlanSchema)
+	if err != nil {
+		return err
+	}
+	plan := &RefactorPlan{}
+	err = json.Unmarshal([]byte(response.Completion), plan)
+	if err != nil {
+		return err
+	}
+	err = validateRefactorPlan(plan, paths)
+	if err != nil {
+		return err
+	}
+
+	this.printRefactorPlan(plan)
+	if !refactor.Yes {
+		ok, err := this.confirm("Apply this plan?")
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	planStr := plan.Summary
+	for _, change := range plan.Changes {
+		planStr += fmt.Sprintf("\n- %s: %s", change.Path, change.Description)
+	}
+
+	input := bufio.NewReader(os.Stdin)
+	files := []*refactorFile{}
+	for _, change := range plan.Changes {
+		content, err := os.ReadFile(change.Path)
+		if err != nil {
+			return err
+		}
+
+		editPrompt, err := this.GetPrompt(prompt.PromptRefactorEdit,
+			"instruction", instruction,
+			"plan", planStr,
+			"path", change.Path,
+			"change", change.Description,
+			"content", string(content))
+		if err != nil {
+			return err
+		}
+		this.StylePrintf(this.Config.Styles.Grey, "Editing %s...\n", change.Path)
+		response, err := this.LLMClient.Completion(&util.CompletionRequest{
+			Ctx:           this.Ctx,
+			Prompt:        editPrompt,
+			PromptName:    prompt.PromptRefactorEdit,
+			Model:         refactor.Model,
+			MaxTokens:     refactor.NumTokens,
+			Temperature:   0.2,
+			SystemMessage: sysMsg,
+			Verbose:       this.Config.Verbose > 0,
+			TokenTimeout:  this.Config.TokenTimeout,
+		})
+		if err != nil {
+			return err
+		}
+
+		file := &refactorFile{
+			Path:     change.Path,
+			Original: splitFileLines(string(content)),
+			Edited:   splitFileLines(stripCodeFence(response.Completion)),
+		}
+		file.Hunks = DiffHunks(file.Original, file.Edited, 3)
+		if len(file.Hunks) == 0 {
+			this.StylePrintf(this.Config.Styles.Grey, "No changes to %s\n", file.Path)
+			continue
+		}
+
+		this.StylePrintf(this.Config.Styles.Highlight, "\n%s\n", file.Path)
+		if refactor.Yes {
+			for _, hunk := range file.Hunks {
+				this.PrintHunk(hunk)
+			}
+		} else {
+			if err := this.requireInteractive("Apply this hunk?"); err != nil {
+				return err
+			}
+			file.Hunks = this.ReviewHunks(file.Hunks, input)
+		}
+		if len(file.Hunks) > 0 {
+			files = append(files, file)
+		}
+	}
+
+	if len(files) == 0 {
+		this.StylePrintf(this.Config.Styles.Grey, "No changes applied\n")
+		return nil
+	}
+
+	// save the revert patch before touching any files
+	patchPath := refactor.RevertPatch
+	if patchPath == "" {
+		patchPath = fmt.Sprintf("butterfish-revert-%s.patch", time.Now().Format("20060102-150405"))
+	}
+	err = os.WriteFile(patchPath, []byte(refactorRevertPatch(files)), 0644)
+	if err != nil {
+		return err
+	}
+
+	changed := make([]string, len(files))
+	for i, file := range files {
+		changed[i] = file.Path
+	}
+	err = this.Checkpoint("refactor", instruction, changed...)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		content := joinFileLines(ApplyHunks(file.Original, file.Hunks))
+		err = writeFileWithBackup(file.Path, []byte(content), false)
+		if err != nil {
+			return fmt.Errorf("Error writing %s, the revert patch is in %s: %w", file.Path, patchPath, err)
+		}
+	}
+
+	this.StylePrintf(this.Config.Styles.Grey, "Changed %d file(s), undo with: git apply %s\n", len(files), patchPath)
+	return nil
+}
@@ -0,0 +1,96 @@
+package butterfish
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// With gencmd --refine, a generated command can be revised by replying with
+// changes, e.g. "use rsync instead" or "exclude node_modules". Each change is
+// sent with the goal and the earlier commands and changes, so the model
+// edits the same command rather than starting over. An empty reply keeps
+// the command.
+
+// A command and the change the user asked for
+type commandRefinement struct {
+	Command string
+	Change  string
+}
+
+func formatRefinements(refinements []commandRefinement) string {
+	builder := strings.Builder{}
+	for _, refinement := range refinements {
+		fmt.Fprintf(&builder, "Command: %s\nChange: %s\n", refinement.Command, refinement.Change)
+	}
+	return strings.TrimRight(builder.String(), "\n")
+}
+
+// Ask the model to revise the last command with the last change
+func (this *ButterfishCtx) reviseCommand(description string, refinements []commandRefinement) (string, error) {
+	promptStr, err := this.GetPrompt(prompt.PromptRefineCommand,
+		"content", description,
+		"refinements", formatRefinements(refinements))
+	if err != nil {
+		return "", err
+	}
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := this.LLMClient.Completion(&util.CompletionRequest{
+		Ctx:              this.Ctx,
+		Prompt:           promptStr,
+		PromptName:       prompt.PromptRefineCommand,
+		Model:            this.Config.GencmdModel,
+		MaxTokens:        this.Config.GencmdMaxTokens,
+		Temperature:      requestTemperature(this.Config.GencmdTemperature),
+		TopP:             this.Config.GencmdTopP,
+		Stop:             this.Config.GencmdStop,
+		LogitBias:        this.Config.GencmdLogitBias,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.PromptSystemMessage,
+		Task:             TaskGencmd,
+		TokenTimeout:     this.Config.TokenTimeout,
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(resp.Completion), nil
+}
+
+// Show the command and revise it with each change the user replies with
+// until they reply with nothing. Returns the final command.
+func (this *ButterfishCtx) refineCommand(description, command string, input *bufio.Reader) (string, error) {
+	refinements := []commandRefinement{}
+	for {
+		this.StylePrintf(this.Config.Styles.Highlight, "%s\n", command)
+		this.StylePrintf(this.Config.Styles.Question, "Change (enter to keep): ")
+		answer, err := input.ReadString('\n')
+		change := strings.TrimSpace(answer)
+		if err != nil && change == "" {
+			// no more input, keep the command
+			fmt.Fprintf(this.Out, "\n")
+			return command, nil
+		}
+		if change == "" {
+			return command, nil
+		}
+
+		refinements = append(refinements, commandRefinement{Command: command, Change: change})
+		revised, err := this.reviseCommand(description, refinements)
+		if err != nil {
+			return "", err
+		}
+		if revised == "" {
+			this.StylePrintf(this.Config.Styles.Error, "No command came back, keeping the last one\n")
+			continue
+		}
+		command = revised
+		this.updateCommandRegister(command)
+	}
+}
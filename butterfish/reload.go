@@ -0,0 +1,202 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/term"
+)
+
+// A running shell can re-read the config file and the prompt library with
+// !reload, or when butterfish gets SIGHUP, so that models, temperature,
+// explain before execute, routing, keybindings, private commands, and
+// prompts can be changed without restarting and losing the conversation.
+// Failover, rate limit, and encryption settings, and flags, are only read at
+// startup.
+
+// Reload the config file and the prompt library. Returns a description of
+// each setting that changed.
+func (this *ButterfishCtx) ReloadConfig() ([]string, error) {
+	if this.Config.ConfigFilePath == "" {
+		return nil, errors.New("No config file to reload")
+	}
+	configFile, err := LoadConfigFile(this.Config.ConfigFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	reloaded := *this.Config
+	// settings that only come from the config file are cleared so that
+	// removing them takes effect
+	reloaded.Routing = nil
+	reloaded.EnvContext = nil
+	reloaded.ShellPrivateCommands = nil
+	reloaded.ExplainBeforeExecute = reloaded.ShellFlagsGiven["explain-first"]
+	reloaded.Language = ""
+	reloaded.Speech = nil
+	reloaded.Budget = nil
+	reloaded.Compression = nil
+	reloaded.Hooks = nil
+	err = configFile.Apply(&reloaded)
+	if err != nil {
+		return nil, fmt.Errorf("Error in %s: %s", this.Config.ConfigFilePath, err)
+	}
+
+	library := this.PromptLibrary
+	var diskLibrary *prompt.DiskPromptLibrary
+	if memoryLibrary, ok := library.(*prompt.MemoryPromptLibrary); ok && reloaded.NoPromptFile {
+		memoryLibrary.Language = resolveLanguage(reloaded.Language, os.Getenv)
+	} else if reloaded.PromptLibrary == nil {
+		promptPath, err := homedir.Expand(reloaded.PromptLibraryPath)
+		if err != nil {
+			return nil, err
+		}
+		diskLibrary, err = NewDiskPromptLibrary(promptPath, false, io.Discard, reloaded.Store)
+		if err != nil {
+			return nil, err
+		}
+		diskLibrary.Language = resolveLanguage(reloaded.Language, os.Getenv)
+		library = diskLibrary
+	}
+
+	changes := []string{}
+	changed := func(name string, before, after string) {
+		if before != after {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, before, after))
+		}
+	}
+	old := this.Config
+	changed("model", old.ShellPromptModel, reloaded.ShellPromptModel)
+	changed("autosuggest model", old.ShellAutosuggestModel, reloaded.ShellAutosuggestModel)
+	changed("annotate model", old.ShellAnnotateModel, reloaded.ShellAnnotateModel)
+	changed("temperature", fmt.Sprint(old.ShellTemperature), fmt.Sprint(reloaded.ShellTemperature))
+	changed("explain before execute", fmt.Sprint(old.ExplainBeforeExecute), fmt.Sprint(reloaded.ExplainBeforeExecute))
+	changed("routing", describeRouting(old.Routing), describeRouting(reloaded.Routing))
+	changed("private commands", fmt.Sprint(old.ShellPrivateCommands), fmt.Sprint(reloaded.ShellPrivateCommands))
+	changed("prompt library", old.PromptLibraryPath, reloaded.PromptLibraryPath)
+	changed("language", old.Language, reloaded.Language)
+	if !reflect.DeepEqual(old.Budget, reloaded.Budget) {
+		changes = append(changes, "budget changed")
+	}
+	if !reflect.DeepEqual(old.Compression, reloaded.Compression) {
+		changes = append(changes, "compression changed")
+	}
+	if !reflect.DeepEqual(old.Hooks, reloaded.Hooks) {
+		changes = append(changes, "hooks changed")
+	}
+	if !reflect.DeepEqual(old.ModelAliases, reloaded.ModelAliases) {
+		changes = append(changes, "models changed")
+	}
+	if !reflect.DeepEqual(old.EnvContext, reloaded.EnvContext) {
+		changes = append(changes, "env_context changed")
+	}
+	if !reflect.DeepEqual(old.ShellKeyBindings, reloaded.ShellKeyBindings) {
+		changes = append(changes, "keybindings changed")
+	}
+
+	if oldLibrary, ok := this.PromptLibrary.(*prompt.DiskPromptLibrary); ok && oldLibrary != library {
+		// the old library's usage counts would be lost otherwise
+		err := oldLibrary.Usage.Flush()
+		if err != nil {
+			log.Printf("Error recording prompt usage: %s", err)
+		}
+	}
+	// the config is replaced rather than changed so that goroutines working
+	// with a snapshot keep a consistent one, see ButterfishCtx.snapshot
+	this.Config = &reloaded
+	this.PromptLibrary = library
+	if this.Budget != nil {
+		this.Budget.SetConfig(reloaded.Budget)
+	}
+
+	llm := this.LLMClient
+	if routingLLM, ok := llm.(*RoutingLLM); ok {
+		routingLLM.SetConfig(reloaded.Routing)
+		llm = routingLLM.LLM
+	} else if reloaded.Routing != nil {
+		this.LLMClient = NewRoutingLLM(this.LLMClient, reloaded.Routing)
+	}
+	if tracking, ok := llm.(*UsageTrackingLLM); ok && diskLibrary != nil {
+		tracking.SetPrompts(diskLibrary.Usage)
+	}
+
+	return changes, nil
+}
+
+func describeRouting(routing *RoutingConfig) string {
+	if routing == nil {
+		return "off"
+	}
+	parts := []string{}
+	if routing.Fast != "" {
+		parts = append(parts, "fast "+routing.Fast)
+	}
+	if routing.Strong != "" {
+		parts = append(parts, "strong "+routing.Strong)
+	}
+	if len(routing.Rules) > 0 {
+		parts = append(parts, fmt.Sprintf("%d rules", len(routing.Rules)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Reload the config in the shell, printing what changed
+func (this *ShellState) ReloadConfig() {
+	text := this.reloadConfig()
+	fmt.Fprintf(this.ParentOut, "%s%s%s", this.Color.Answer,
+		strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+	this.SendPromptResponse("")
+}
+
+// Reload the config after SIGHUP. The signal can arrive at any point, e.g.
+// while the user is typing, so the result is only logged. SIGHUP is also
+// sent when the terminal is closed, in which case we exit.
+func (this *ShellState) ReloadConfigOnSignal() {
+	_, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		log.Printf("Got SIGHUP and the terminal is gone, exiting")
+		this.Butterfish.Cancel()
+		return
+	}
+	log.Printf("Got SIGHUP: %s", this.reloadConfig())
+}
+
+func (this *ShellState) reloadConfig() string {
+	explainFirst := this.Butterfish.Config.ExplainBeforeExecute
+	changes, err := this.Butterfish.ReloadConfig()
+	if err != nil {
+		return fmt.Sprintf("Config not reloaded: %s\n", err)
+	}
+	config := this.Butterfish.Config
+
+	// models and limits that were set up when the shell started
+	this.PromptMaxTokens = min(
+		NumTokensForModel(config.ShellPromptModel),
+		config.ShellMaxPromptTokens)
+	this.AutosuggestMaxTokens = min(
+		NumTokensForModel(config.ShellAutosuggestModel),
+		config.ShellMaxPromptTokens)
+	this.PromptTokenizer = nil
+	this.AutosuggestTokenizer = nil
+	this.KeyBindings = config.ShellKeyBindings
+	if this.KeyBindings == nil {
+		this.KeyBindings = DefaultKeyBindings()
+	}
+	// keep a !explainfirst toggle unless the setting itself changed
+	if config.ExplainBeforeExecute != explainFirst {
+		this.ExplainFirstEnabled = config.ExplainBeforeExecute
+	}
+
+	if len(changes) == 0 {
+		return fmt.Sprintf("Reloaded %s and the prompt library, no settings changed.\n", config.ConfigFilePath)
+	}
+	return fmt.Sprintf("Reloaded %s and the prompt library:\n  %s\n",
+		config.ConfigFilePath, strings.Join(changes, "\n  "))
+}
@@ -0,0 +1,100 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// When the user SSHes to another machine from the wrapped shell, commands run
+// on the remote host, so the local os, directory, and files no longer apply.
+// We can't see the remote shell's prompt (it doesn't have our PS1 markers),
+// so we treat the session as remote from when an interactive ssh command is
+// run until we see a local prompt again.
+
+// Commands that start an interactive remote session
+var remoteShellCommands = map[string]bool{
+	"ssh":     true,
+	"autossh": true,
+	"mosh":    true,
+}
+
+// ssh options that take an argument, e.g. -p 2222
+const sshOptionsWithArg = "BbcDEeFIiJLlmOoPpQRSWw"
+
+// Find the host of an interactive ssh session, e.g. "ssh -p 2222 me@box"
+// gives box. Returns an empty string if the command isn't ssh or runs a
+// remote command rather than a shell, e.g. "ssh box uptime".
+func sshDestination(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || !remoteShellCommands[filepath.Base(fields[0])] {
+		return ""
+	}
+
+	destination := ""
+	rest := fields[1:]
+	for i := 0; i < len(rest); i++ {
+		field := rest[i]
+		if strings.HasPrefix(field, "-") && len(field) > 1 {
+			// an option like -p 2222, or -p2222 with the value attached
+			if strings.HasPrefix(field, "--") {
+				continue
+			}
+			last := field[len(field)-1:]
+			if len(field) == 2 && strings.Contains(sshOptionsWithArg, last) {
+				i++
+			}
+			continue
+		}
+		if destination != "" {
+			// there's a remote command after the destination
+			return ""
+		}
+		destination = field
+	}
+
+	if strings.HasPrefix(destination, "ssh://") {
+		parsed, err := url.Parse(destination)
+		if err != nil {
+			return ""
+		}
+		return parsed.Hostname()
+	}
+	if _, host, ok := strings.Cut(destination, "@"); ok {
+		destination = host
+	}
+	return destination
+}
+
+// Check a command the user ran for the start of a remote session
+func (this *ShellState) CheckRemoteCommand(command string) {
+	host := sshDestination(command)
+	if host == "" {
+		return
+	}
+
+	log.Printf("Entering remote session on %s", host)
+	this.RemoteHost = host
+	this.History.SetHost(host)
+	this.UpdateStatusLine()
+}
+
+// Called when we see a local prompt, which means any remote session is over
+func (this *ShellState) ExitRemote() {
+	if this.RemoteHost == "" {
+		return
+	}
+
+	log.Printf("Leaving remote session on %s", this.RemoteHost)
+	this.RemoteHost = ""
+	this.History.SetHost("")
+	this.UpdateStatusLine()
+}
+
+// A note added to system messages during a remote session, so the model
+// doesn't assume the local machine
+func remoteSystemNote(host string) string {
+	return fmt.Sprintf("\n\nNote: the user is currently connected with ssh to the remote host %s, so commands run there rather than on the local machine. Don't assume the local os, current directory, or files apply.", host)
+}
@@ -0,0 +1,152 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+// When the user starts a REPL like python or psql from the wrapped shell, we
+// see its prompt (e.g. >>> or postgres=#) at the end of the output rather
+// than our PS1 markers. If the REPL's program is running under the shell we
+// treat the session as that REPL until we see a shell prompt again: input
+// goes to the REPL, including lines starting with a capital letter, and
+// autosuggest predicts code in the REPL's language rather than shell
+// commands.
+
+type replInfo struct {
+	// Program name as ps shows it, without a version suffix
+	Name     string
+	Language string
+	// Matches the REPL's prompts, including continuation prompts
+	Prompt *regexp.Regexp
+}
+
+var replPrograms = []*replInfo{
+	{"python", "Python", regexp.MustCompile(`^(>>>|\.\.\.|In \[\d+\]:|\s+\.\.\.:) ?$`)},
+	{"ipython", "Python", regexp.MustCompile(`^(In \[\d+\]:|\s+\.\.\.:) ?$`)},
+	{"node", "JavaScript", regexp.MustCompile(`^(>|\.\.\.) ?$`)},
+	{"psql", "PostgreSQL SQL and psql meta-commands", regexp.MustCompile(`^\S*[=\-(*'"][#>] ?$`)},
+	{"mysql", "MySQL SQL", regexp.MustCompile(`^(mysql|MariaDB \[[^\]]*\])> ?$|^\s*-> ?$`)},
+	{"sqlite", "SQLite SQL and sqlite3 dot-commands", regexp.MustCompile(`^(sqlite|\s*\.\.\.)> ?$`)},
+	{"gdb", "gdb commands", regexp.MustCompile(`^\(gdb\) ?$`)},
+	{"lldb", "lldb commands", regexp.MustCompile(`^\(lldb\) ?$`)},
+	{"irb", "Ruby", regexp.MustCompile(`^irb\([^)]*\):\d+(:\d+)?[>*"'] ?$`)},
+}
+
+// The program name of an executable without its path or version, e.g.
+// python3.11 gives python
+func replProgramName(executable string) string {
+	return strings.TrimRight(filepath.Base(executable), "0123456789.")
+}
+
+// The last line of output, which is the prompt if the REPL is waiting
+func lastOutputLine(output string) string {
+	output = stripANSI(output)
+	if index := strings.LastIndexAny(output, "\r\n"); index >= 0 {
+		output = output[index+1:]
+	}
+	return output
+}
+
+// The REPL whose prompt ends the output and whose program is running, nil if
+// there isn't one. Running processes are only listed if a prompt matches.
+func detectREPL(output string, running func() []string) *replInfo {
+	line := lastOutputLine(output)
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+	matches := []*replInfo{}
+	for _, repl := range replPrograms {
+		if repl.Prompt.MatchString(line) {
+			matches = append(matches, repl)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+
+	programs := map[string]bool{}
+	for _, executable := range running() {
+		programs[replProgramName(executable)] = true
+	}
+	for _, repl := range matches {
+		if programs[repl.Name] {
+			return repl
+		}
+	}
+	return nil
+}
+
+// Executables running under butterfish, other than shells
+func runningChildPrograms() []string {
+	executables, err := childExecutables(os.Getpid())
+	if err != nil {
+		log.Printf("Error listing child processes: %s", err)
+		return nil
+	}
+	return executables
+}
+
+// Check child output that isn't followed by a shell prompt for a REPL
+// prompt. Returns true if the output ends with the prompt of the current
+// REPL, i.e. the REPL is waiting for input.
+func (this *ShellState) CheckREPLPrompt(output string) bool {
+	if this.REPL != nil {
+		return this.REPL.Prompt.MatchString(lastOutputLine(output))
+	}
+	repl := detectREPL(output, runningChildPrograms)
+	if repl == nil {
+		return false
+	}
+
+	log.Printf("Entering %s REPL", repl.Name)
+	this.REPL = repl
+	this.UpdateStatusLine()
+	return true
+}
+
+// Called when we see a shell prompt, which means any REPL has exited
+func (this *ShellState) ExitREPL() {
+	if this.REPL == nil {
+		return
+	}
+
+	log.Printf("Leaving %s REPL", this.REPL.Name)
+	this.REPL = nil
+	this.UpdateStatusLine()
+}
+
+// The name of the autosuggest prompt in a REPL, there's no prompt completion
+// since capitals are just input
+func replAutosuggestPromptName(command string) string {
+	if command == "" {
+		return prompt.ShellAutosuggestREPLNewCommand
+	}
+	return prompt.ShellAutosuggestREPLCommand
+}
+
+// Fill in the REPL fields of an autosuggest prompt, leaving the history and
+// command to be interpolated as usual
+func fillREPLFields(template string, repl *replInfo) string {
+	return prompt.FillFields(template, func(field string) (string, bool) {
+		switch field {
+		case "repl":
+			return repl.Name, true
+		case "language":
+			return repl.Language, true
+		}
+		return "", false
+	})
+}
+
+// A note added to system messages in a REPL, so the model doesn't suggest
+// shell commands
+func replSystemNote(repl *replInfo) string {
+	return fmt.Sprintf("\n\nNote: the user is currently in a %s REPL inside the shell, so input is %s rather than shell commands.", repl.Name, repl.Language)
+}
@@ -0,0 +1,203 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// When a streamed response is interrupted partway through, e.g. by a network
+// blip or a rate limit, we ask the model to continue from the tail of what we
+// received rather than starting over. The continuation is streamed after the
+// partial response with any text that repeats the tail dropped, so callers
+// see a single response. The number of attempts is set in the config file
+// with resume_attempts, 0 turns this off.
+
+const defaultResumeAttempts = 2
+
+// Characters from the end of the partial response that the model is asked to
+// continue from
+const resumeTailLength = 200
+
+// Repeats of the tail shorter than this are kept, since a continuation can
+// legitimately start with the same few characters the tail ends with
+const resumeMinOverlap = 4
+
+// An LLM implementation that resumes interrupted streamed responses
+type ResumingLLM struct {
+	LLM      LLM
+	Attempts int
+}
+
+func NewResumingLLM(llm LLM, attempts int) *ResumingLLM {
+	return &ResumingLLM{
+		LLM:      llm,
+		Attempts: attempts,
+	}
+}
+
+// A streamed response can be resumed if part of it arrived before a failure
+// that's worth retrying, and the user didn't cancel it
+func resumable(request *util.CompletionRequest, response *util.CompletionResponse, err error) bool {
+	if err == nil || response == nil || !response.Truncated || response.Completion == "" {
+		return false
+	}
+	if request.Ctx != nil && request.Ctx.Err() != nil {
+		return false
+	}
+	return isTransientError(err) || errors.Is(err, errTokenTimeout)
+}
+
+// The last resumeTailLength characters of text
+func responseTail(text string) string {
+	runes := []rune(text)
+	if len(runes) <= resumeTailLength {
+		return text
+	}
+	return string(runes[len(runes)-resumeTailLength:])
+}
+
+// The length of the start of continuation that repeats the end of tail
+func seamOverlap(tail, continuation string) int {
+	for i := min(len(tail), len(continuation)); i >= resumeMinOverlap; i-- {
+		if strings.HasSuffix(tail, continuation[:i]) {
+			return i
+		}
+	}
+	return 0
+}
+
+func continueRequest(request *util.CompletionRequest, tail string) *util.CompletionRequest {
+	continuation := *request
+	continuation.Prompt = fmt.Sprintf("%s\n\nYour response was cut off. Reply with only the rest of it, picking up exactly where it stopped without repeating anything. Continue from:\n%s",
+		request.Prompt, tail)
+	return &continuation
+}
+
+func (this *ResumingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	seam := &seamWriter{writer: writer}
+	defer seam.finish()
+
+	response, err := this.LLM.CompletionStream(request, seam)
+	if !resumable(request, response, err) {
+		return response, err
+	}
+
+	completion := response.Completion
+	promptTokens := response.PromptTokens
+	completionTokens := response.CompletionTokens
+	for attempt := 1; attempt <= this.Attempts && resumable(request, response, err); attempt++ {
+		log.Printf("Streamed response interrupted (%s), resuming, attempt %d", err, attempt)
+		tail := responseTail(completion)
+		seam.resume(tail)
+		response, err = this.LLM.CompletionStream(continueRequest(request, tail), seam)
+		seam.flush()
+		if response == nil {
+			// the continuation failed before anything arrived
+			return &util.CompletionResponse{
+				Completion:       completion,
+				Truncated:        true,
+				PromptTokens:     promptTokens,
+				CompletionTokens: completionTokens,
+			}, err
+		}
+
+		completion += response.Completion[seamOverlap(tail, response.Completion):]
+		promptTokens += response.PromptTokens
+		completionTokens += response.CompletionTokens
+	}
+
+	response.Completion = completion
+	response.PromptTokens = promptTokens
+	response.CompletionTokens = completionTokens
+	return response, err
+}
+
+// Only streamed responses can be interrupted partway
+func (this *ResumingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return this.LLM.Completion(request)
+}
+
+func (this *ResumingLLM) Embeddings(request *util.EmbeddingRequest) ([][]float32, error) {
+	return this.LLM.Embeddings(request)
+}
+
+func (this *ResumingLLM) Transcribe(ctx context.Context, path, model, language string) (string, error) {
+	return transcribeWith(this.LLM, ctx, path, model, language)
+}
+
+// Joins a partial response and its continuations on the writer. The client
+// ends an interrupted stream with a newline, so a trailing newline is held
+// back until more is written, and dropped if a continuation arrives. The
+// start of a continuation is held until it's as long as the tail so that any
+// repeat of the tail can be dropped.
+type seamWriter struct {
+	writer  io.Writer
+	newline bool
+
+	deduping bool
+	tail     string
+	held     []byte
+}
+
+func (this *seamWriter) Write(p []byte) (int, error) {
+	if !this.deduping {
+		return len(p), this.write(p)
+	}
+	this.held = append(this.held, p...)
+	if len(this.held) >= len(this.tail) {
+		return len(p), this.flush()
+	}
+	return len(p), nil
+}
+
+func (this *seamWriter) write(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if this.newline {
+		_, err := this.writer.Write([]byte("\n"))
+		if err != nil {
+			return err
+		}
+	}
+	this.newline = p[len(p)-1] == '\n'
+	if this.newline {
+		p = p[:len(p)-1]
+	}
+	_, err := this.writer.Write(p)
+	return err
+}
+
+// Start holding a continuation of tail
+func (this *seamWriter) resume(tail string) {
+	this.deduping = true
+	this.tail = tail
+	this.held = nil
+}
+
+// Write what's held of a continuation, without the part that repeats the tail
+func (this *seamWriter) flush() error {
+	if !this.deduping {
+		return nil
+	}
+	this.deduping = false
+	rest := this.held[seamOverlap(this.tail, string(this.held)):]
+	if len(rest) > 0 {
+		// the continuation replaces the newline ending the interrupted part
+		this.newline = false
+	}
+	return this.write(rest)
+}
+
+func (this *seamWriter) finish() {
+	this.flush()
+	if this.newline {
+		this.writer.Write([]byte("\n"))
+	}
+}
@@ -0,0 +1,163 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/mitchellh/go-homedir"
+)
+
+// The review command checks a shell script with shellcheck, if it's
+// installed, then asks the model for a prioritized list of issues and a
+// corrected script, which is shown as a diff and can be applied.
+
+const shellcheckTimeout = 30 * time.Second
+
+// The response separates the issues from the corrected script with this line
+const reviewCorrectedMarker = "Corrected script:"
+
+// Run shellcheck on a script, returns a note if shellcheck isn't installed.
+// Shellcheck exits non-zero when it finds issues so we only fail if it
+// doesn't produce any output.
+func runShellcheck(ctx context.Context, path string) string {
+	shellcheck, err := exec.LookPath("shellcheck")
+	if err != nil {
+		return "(shellcheck is not installed)"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, shellcheckTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, shellcheck, "--format=gcc", path).CombinedOutput()
+	if err != nil && len(output) == 0 {
+		return fmt.Sprintf("(shellcheck failed: %s)", err)
+	}
+	if len(output) == 0 {
+		return "(no findings)"
+	}
+	return strings.TrimRight(string(output), "\n")
+}
+
+// Split a review response into the issues and the lines of the corrected
+// script, which is the code block after the marker. The corrected script is
+// nil if the response doesn't include one.
+func parseReviewResponse(response string) (string, []string) {
+	issues, corrected, found := strings.Cut(response, reviewCorrectedMarker)
+	issues = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(issues), "**"))
+	if !found {
+		return issues, nil
+	}
+
+	corrected = strings.TrimLeft(corrected, "*")
+	script := strings.Trim(stripCodeFence(corrected), "\n")
+	if script == "" {
+		return issues, nil
+	}
+	return issues, strings.Split(script, "\n")
+}
+
+func (this *ButterfishCtx) reviewCommand(options *CliCommandConfig) error {
+	review := options.Review
+	if review.Format == FormatGitHub && review.InPlace {
+		return errors.New("--format github can't be used with -i")
+	}
+	path, err := homedir.Expand(review.Script)
+	if err != nil {
+		return err
+	}
+	lineBuffer, err := NewLineBuffer(path)
+	if err != nil {
+		return err
+	}
+	original := lineBuffer.Lines
+
+	findings := runShellcheck(this.Ctx, path)
+	if this.Config.Verbose > 0 {
+		this.StylePrintf(this.Config.Styles.Grey, "shellcheck:\n%s\n", findings)
+	}
+
+	promptStr, err := this.GetPrompt(prompt.PromptReviewScript,
+		"script", lineBuffer.PrefixLineNumbers(),
+		"shellcheck", findings)
+	if err != nil {
+		return err
+	}
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return err
+	}
+
+	request := &util.CompletionRequest{
+		Ctx:              this.Ctx,
+		Prompt:           promptStr,
+		PromptName:       prompt.PromptReviewScript,
+		Model:            review.Model,
+		MaxTokens:        review.NumTokens,
+		Temperature:      0.2,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.PromptSystemMessage,
+		Verbose:          this.Config.Verbose > 0,
+		TokenTimeout:     this.Config.TokenTimeout,
+	}
+	response, err := this.LLMClient.Completion(request)
+	if err != nil {
+		return err
+	}
+
+	issues, corrected := parseReviewResponse(response.Completion)
+	if review.Format == FormatGitHub {
+		writeReviewAnnotations(this.Out, review.Script, issues)
+		return nil
+	}
+	this.StylePrintf(this.Config.Styles.Answer, "%s\n\n", issues)
+	if corrected == nil {
+		return errors.New("The response didn't include a corrected script")
+	}
+	// keep the original's trailing newline
+	if original[len(original)-1] == "" {
+		corrected = append(corrected, "")
+	}
+
+	hunks := DiffHunks(original, corrected, 3)
+	if len(hunks) == 0 {
+		this.StylePrintf(this.Config.Styles.Grey, "No changes suggested for %s\n", review.Script)
+		return nil
+	}
+
+	if !review.InPlace {
+		for _, hunk := range hunks {
+			this.PrintHunk(hunk)
+		}
+		return nil
+	}
+
+	if !review.Yes {
+		if err := this.requireInteractive("Apply this hunk?"); err != nil {
+			return err
+		}
+		hunks = this.ReviewHunks(hunks, bufio.NewReader(os.Stdin))
+		if len(hunks) == 0 {
+			this.StylePrintf(this.Config.Styles.Grey, "No changes applied\n")
+			return nil
+		}
+	}
+
+	err = this.Checkpoint("review", "review "+review.Script, path)
+	if err != nil {
+		return err
+	}
+	content := strings.Join(ApplyHunks(original, hunks), "\n")
+	err = writeFileWithBackup(path, []byte(content), !review.NoBackup)
+	if err != nil {
+		return err
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "Applied %d hunk(s) to %s\n", len(hunks), review.Script)
+	return nil
+}
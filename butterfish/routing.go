@@ -0,0 +1,154 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// RoutingConfig sends requests to a fast or a strong model based on the task,
+// so that interactive requests like autosuggest stay quick while analytical
+// ones like summarize get a better model. Set in the config file, e.g.
+//
+//	routing:
+//	  fast: gpt-4o-mini
+//	  strong: gpt-4o
+//	  rules:
+//	    shell_prompt: strong
+//	    explain: gpt-4.1-mini
+//
+// Rules map a task to fast, strong, or a model name and are added to the
+// default rules. Routed tasks use the routed model even if a model flag is
+// given.
+type RoutingConfig struct {
+	Fast   string            `yaml:"fast"`
+	Strong string            `yaml:"strong"`
+	Rules  map[string]string `yaml:"rules"`
+}
+
+// Tasks set on CompletionRequest.Task
+const (
+	TaskAutosuggest   = "autosuggest"
+	TaskGencmd        = "gencmd"
+	TaskAnnotate      = "annotate"
+	TaskExplain       = "explain"
+	TaskShellPrompt   = "shell_prompt"
+	TaskGoalMode      = "goal_mode"
+	TaskSummarize     = "summarize"
+	TaskIndexQuestion = "indexquestion"
+	TaskCommit        = "commit"
+	TaskBatch         = "batch"
+	TaskVerify        = "verify"
+)
+
+var routingTasks = []string{TaskAutosuggest, TaskGencmd, TaskAnnotate, TaskExplain,
+	TaskShellPrompt, TaskGoalMode, TaskSummarize, TaskIndexQuestion, TaskCommit, TaskBatch, TaskVerify}
+
+const (
+	routingTierFast   = "fast"
+	routingTierStrong = "strong"
+)
+
+var defaultRoutingRules = map[string]string{
+	TaskAutosuggest:   routingTierFast,
+	TaskGencmd:        routingTierFast,
+	TaskAnnotate:      routingTierFast,
+	TaskSummarize:     routingTierStrong,
+	TaskIndexQuestion: routingTierStrong,
+	TaskCommit:        routingTierStrong,
+}
+
+func (this *RoutingConfig) Validate() error {
+	if this.Fast == "" && this.Strong == "" {
+		return errors.New("routing needs a fast or a strong model")
+	}
+	for task, target := range this.Rules {
+		if !slices.Contains(routingTasks, task) {
+			return fmt.Errorf("routing rule for unknown task %s, tasks are %s", task, strings.Join(routingTasks, ", "))
+		}
+		if target == "" {
+			return fmt.Errorf("routing rule %s needs fast, strong, or a model", task)
+		}
+		if (target == routingTierFast && this.Fast == "") || (target == routingTierStrong && this.Strong == "") {
+			return fmt.Errorf("routing rule %s uses the %s model, which isn't set", task, target)
+		}
+	}
+	return nil
+}
+
+// The model a task is routed to, empty if the request keeps its model
+func (this *RoutingConfig) ModelFor(task string) string {
+	if this == nil || task == "" {
+		return ""
+	}
+	target, ok := this.Rules[task]
+	if !ok {
+		target = defaultRoutingRules[task]
+	}
+	switch target {
+	case routingTierFast:
+		return this.Fast
+	case routingTierStrong:
+		return this.Strong
+	}
+	return target
+}
+
+// An LLM implementation that changes the model of each request according to
+// the routing rules. The request is changed in place so that wrapping LLMs,
+// e.g. usage tracking, see the routed model.
+type RoutingLLM struct {
+	LLM LLM
+	// Replace with SetConfig once requests may be running, e.g. on reload
+	Config *RoutingConfig
+	mutex  sync.RWMutex
+}
+
+func NewRoutingLLM(llm LLM, config *RoutingConfig) *RoutingLLM {
+	return &RoutingLLM{
+		LLM:    llm,
+		Config: config,
+	}
+}
+
+func (this *RoutingLLM) SetConfig(config *RoutingConfig) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.Config = config
+}
+
+func (this *RoutingLLM) route(request *util.CompletionRequest) {
+	this.mutex.RLock()
+	config := this.Config
+	this.mutex.RUnlock()
+	model := config.ModelFor(request.Task)
+	if model != "" && model != request.Model {
+		log.Printf("Routing %s request from %s to %s", request.Task, request.Model, model)
+		request.Model = model
+	}
+}
+
+func (this *RoutingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	this.route(request)
+	return this.LLM.CompletionStream(request, writer)
+}
+
+func (this *RoutingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.route(request)
+	return this.LLM.Completion(request)
+}
+
+func (this *RoutingLLM) Embeddings(request *util.EmbeddingRequest) ([][]float32, error) {
+	return this.LLM.Embeddings(request)
+}
+
+func (this *RoutingLLM) Transcribe(ctx context.Context, path, model, language string) (string, error) {
+	return transcribeWith(this.LLM, ctx, path, model, language)
+}
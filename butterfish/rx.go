@@ -0,0 +1,298 @@
+package butterfish
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// butterfish rx builds a regex, jq filter, or awk program from a
+// description, runs it on sample input right away, and shows the output.
+// You can then say what's wrong with it and get a new attempt, which sees
+// the earlier expressions, their output, and your feedback. With --expect
+// the output is compared to a file of the expected output instead, and
+// attempts continue until it matches.
+
+const (
+	rxKindRegex = "regex"
+	rxKindJq    = "jq"
+	rxKindAwk   = "awk"
+
+	rxRunTimeout = 10 * time.Second
+	// Lines of sample input and of output sent to the model and shown
+	rxSampleLines = 40
+	rxOutputLines = 30
+)
+
+// How each kind of expression is described to the model
+var rxLanguages = map[string]string{
+	rxKindRegex: "a regular expression in RE2 syntax, as used by Go and close to grep -E, that's matched against each line of the input. Use capture groups for the parts to extract, each match prints its groups separated by tabs, or the whole match if there are no groups",
+	rxKindJq:    "a jq filter, run as jq <filter> on the input",
+	rxKindAwk:   "an awk program, run as awk <program> on the input",
+}
+
+// An expression that was tried, its output, and what was wrong with it
+type rxAttempt struct {
+	Expression string
+	Output     string
+	Feedback   string
+}
+
+func formatRxAttempts(attempts []rxAttempt) string {
+	if len(attempts) == 0 {
+		return "(none yet)"
+	}
+	builder := strings.Builder{}
+	for i, attempt := range attempts {
+		fmt.Fprintf(&builder, "Attempt %d: %s\nOutput:\n%s\nWhat's wrong: %s\n\n",
+			i+1, attempt.Expression, attempt.Output, attempt.Feedback)
+	}
+	return strings.TrimRight(builder.String(), "\n")
+}
+
+// Run a regex on each line of the input, printing the groups of each match
+// separated by tabs, or the whole match if it has no groups
+func runRegex(expression, input string) (string, error) {
+	re, err := regexp.Compile(expression)
+	if err != nil {
+		return "", err
+	}
+	output := []string{}
+	for _, line := range strings.Split(strings.TrimRight(input, "\n"), "\n") {
+		for _, match := range re.FindAllStringSubmatch(line, -1) {
+			if len(match) > 1 {
+				output = append(output, strings.Join(match[1:], "\t"))
+			} else {
+				output = append(output, match[0])
+			}
+		}
+	}
+	return strings.Join(output, "\n"), nil
+}
+
+// awk constructs that run commands or write files: system(), piping to or
+// from a command, and redirecting print. Parenthesized comparisons in print
+// are caught too, which only means the program isn't run without gawk.
+var awkUnsafeRegexp = regexp.MustCompile(`\bsystem\s*\(|\|\s*getline\b|\bprintf?\b[^;{}\n]*(>|\|)`)
+
+// The command to run an awk program written by the model. gawk --sandbox
+// turns off system(), pipes, and redirection, other awks are only run if
+// the program doesn't use them.
+func awkCommand(ctx context.Context, expression string) (*exec.Cmd, error) {
+	if gawk, err := exec.LookPath("gawk"); err == nil {
+		return exec.CommandContext(ctx, gawk, "--sandbox", expression), nil
+	}
+	program, err := exec.LookPath("awk")
+	if err != nil {
+		return nil, errors.New("awk isn't installed")
+	}
+	if awkUnsafeRegexp.MatchString(expression) {
+		return nil, errors.New("The awk program runs commands or writes files, it's only run with gawk --sandbox, install gawk to run it")
+	}
+	return exec.CommandContext(ctx, program, expression), nil
+}
+
+// jq's $ENV and env give the environment, including any secrets in it, and
+// the output goes back to the model. A field named env, like .env, is fine.
+var jqEnvRegexp = regexp.MustCompile(`\$ENV\b|(^|[^.\w$])env\b`)
+
+// The command to run a jq filter written by the model. Filters that read
+// the environment are refused, and jq is run with an empty environment in
+// case one gets past the check.
+func jqCommand(ctx context.Context, expression string) (*exec.Cmd, error) {
+	program, err := exec.LookPath("jq")
+	if err != nil {
+		return nil, errors.New("jq isn't installed")
+	}
+	if jqEnvRegexp.MatchString(expression) {
+		return nil, errors.New("The jq filter reads environment variables, it isn't run")
+	}
+	cmd := exec.CommandContext(ctx, program, expression)
+	cmd.Env = []string{}
+	return cmd, nil
+}
+
+// Run an expression on the input, jq and awk have to be installed
+func runRxExpression(ctx context.Context, kind, expression, input string) (string, error) {
+	if kind == rxKindRegex {
+		return runRegex(expression, input)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rxRunTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	var err error
+	if kind == rxKindAwk {
+		cmd, err = awkCommand(ctx, expression)
+	} else {
+		cmd, err = jqCommand(ctx, expression)
+	}
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdin = strings.NewReader(input)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(output), "\n"), nil
+}
+
+// Ask the model for an expression, given the earlier attempts
+func (this *ButterfishCtx) generateRxExpression(kind, description, sample, model string, attempts []rxAttempt) (string, error) {
+	capture := outputCapture{Mode: captureHead, Lines: rxSampleLines}
+	promptStr, err := this.GetPrompt(prompt.PromptExpressionBuilder,
+		"language", rxLanguages[kind],
+		"content", description,
+		"sample", capture.Apply(sample),
+		"attempts", formatRxAttempts(attempts))
+	if err != nil {
+		return "", err
+	}
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := this.LLMClient.Completion(&util.CompletionRequest{
+		Ctx:              this.Ctx,
+		Prompt:           promptStr,
+		PromptName:       prompt.PromptExpressionBuilder,
+		Model:            model,
+		MaxTokens:        512,
+		Temperature:      0.2,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.PromptSystemMessage,
+		Task:             TaskGencmd,
+		Verbose:          this.Config.Verbose > 0,
+		TokenTimeout:     this.Config.TokenTimeout,
+	})
+	if err != nil {
+		return "", err
+	}
+	// models sometimes quote the expression in backticks anyway
+	expression := strings.TrimSpace(stripCodeFence(response.Completion))
+	expression = strings.TrimSpace(strings.Trim(expression, "`"))
+	if expression == "" {
+		return "", errors.New("No expression came back")
+	}
+	return expression, nil
+}
+
+// Build an expression, showing its output on the sample each time. With
+// expected output, attempts continue until the output matches it, otherwise
+// feedback is read from input until the user replies with nothing.
+// Returns the final expression.
+func (this *ButterfishCtx) buildRxExpression(kind, description, sample, expected, model string, maxAttempts int, input *bufio.Reader) (string, error) {
+	attempts := []rxAttempt{}
+	for attempt := 1; ; attempt++ {
+		expression, err := this.generateRxExpression(kind, description, sample, model, attempts)
+		if err != nil {
+			return "", err
+		}
+		this.StylePrintf(this.Config.Styles.Highlight, "%s\n", expression)
+
+		output, runErr := runRxExpression(this.Ctx, kind, expression, sample)
+		shown := outputCapture{Mode: captureHead, Lines: rxOutputLines}.Apply(output)
+		if runErr != nil {
+			shown = fmt.Sprintf("Error: %s", runErr)
+			this.StylePrintf(this.Config.Styles.Error, "%s\n", shown)
+		} else if shown == "" {
+			this.StylePrintf(this.Config.Styles.Grey, "(no output)\n")
+		} else {
+			this.StylePrintf(this.Config.Styles.Grey, "%s\n", shown)
+		}
+
+		feedback := ""
+		switch {
+		case expected != "" && runErr == nil && strings.TrimSpace(output) == strings.TrimSpace(expected):
+			this.StylePrintf(this.Config.Styles.Answer, "The output matches the expected output.\n")
+			return expression, nil
+		case runErr != nil:
+			feedback = "it failed to run"
+		case expected != "":
+			feedback = fmt.Sprintf("the output should be:\n%s", expected)
+		case input == nil:
+			return expression, nil
+		default:
+			this.StylePrintf(this.Config.Styles.Question, "What's wrong with it (enter to keep): ")
+			answer, err := input.ReadString('\n')
+			feedback = strings.TrimSpace(answer)
+			if feedback == "" {
+				if err != nil {
+					fmt.Fprintf(this.Out, "\n")
+				}
+				return expression, nil
+			}
+		}
+
+		if attempt >= maxAttempts {
+			return "", fmt.Errorf("No working expression after %d attempts", attempt)
+		}
+		attempts = append(attempts, rxAttempt{Expression: expression, Output: shown, Feedback: feedback})
+	}
+}
+
+func (this *ButterfishCtx) rxCommand(options *CliCommandConfig) error {
+	rx := options.Rx
+	description := strings.Trim(strings.Join(rx.Description, " "), "\"'")
+	if description == "" {
+		return errors.New("Please describe what the expression should match or extract")
+	}
+
+	// the sample comes from a file or stdin, in which case feedback is read
+	// from the terminal
+	var sampleReader io.Reader
+	input := bufio.NewReader(os.Stdin)
+	if rx.Sample != "" {
+		file, err := os.Open(rx.Sample)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		sampleReader = file
+	} else if util.IsPipedStdin() {
+		sampleReader = os.Stdin
+		input = nil
+		if tty, err := os.Open("/dev/tty"); err == nil {
+			defer tty.Close()
+			input = bufio.NewReader(tty)
+		}
+	} else {
+		return errors.New("Please give sample input with --sample or on stdin")
+	}
+	// without a terminal there's no feedback, only --expect checks
+	if this.Config.Headless {
+		input = nil
+	}
+
+	sample, err := io.ReadAll(sampleReader)
+	if err != nil {
+		return err
+	}
+
+	expected := ""
+	if rx.Expect != "" {
+		data, err := os.ReadFile(rx.Expect)
+		if err != nil {
+			return err
+		}
+		expected = string(data)
+	}
+
+	_, err = this.buildRxExpression(rx.Kind, description, string(sample), expected, rx.Model, rx.MaxAttempts, input)
+	return err
+}
@@ -0,0 +1,138 @@
+package butterfish
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/alecthomas/kong"
+)
+
+// Sampling defaults for the prompt, gencmd, and summarize commands, set in
+// the config file and used when the matching flag isn't given, e.g.
+//
+//	sampling:
+//	  gencmd:
+//	    temperature: 0
+//	    logit_bias:
+//	      "```": -100
+//	  prompt:
+//	    temperature: 1.1
+//	    top_p: 0.9
+//	    max_tokens: 2048
+type SamplingConfig struct {
+	// Pointers so that a temperature of 0 can be told apart from unset
+	Temperature *float32 `yaml:"temperature,omitempty"`
+	TopP        *float32 `yaml:"top_p,omitempty"`
+	MaxTokens   int      `yaml:"max_tokens,omitempty"`
+	// Sequences that end the response
+	Stop []string `yaml:"stop,omitempty"`
+	// Bias from -100 (never) to 100 (always) for each text or token id, text
+	// is biased by its tokens in the model's encoding, so it only works with
+	// OpenAI models
+	LogitBias map[string]int `yaml:"logit_bias,omitempty"`
+}
+
+var samplingCommands = []string{"prompt", "gencmd", "summarize"}
+
+func (this *SamplingConfig) Validate(command string) error {
+	if !slices.Contains(samplingCommands, command) {
+		return fmt.Errorf("sampling for unknown command %s, commands are %s",
+			command, strings.Join(samplingCommands, ", "))
+	}
+	if this.Temperature != nil && (*this.Temperature < 0 || *this.Temperature > 2) {
+		return fmt.Errorf("sampling %s temperature must be between 0 and 2", command)
+	}
+	if this.TopP != nil && (*this.TopP <= 0 || *this.TopP > 1) {
+		return fmt.Errorf("sampling %s top_p must be above 0 and at most 1", command)
+	}
+	if this.MaxTokens < 0 {
+		return fmt.Errorf("sampling %s max_tokens can't be negative", command)
+	}
+	return validateStopAndBias(this.Stop, this.LogitBias)
+}
+
+// The API takes up to 4 stop sequences and biases from -100 to 100
+func validateStopAndBias(stop []string, logitBias map[string]int) error {
+	if len(stop) > 4 {
+		return fmt.Errorf("at most 4 stop sequences can be given, got %d", len(stop))
+	}
+	for text, bias := range logitBias {
+		if bias < -100 || bias > 100 {
+			return fmt.Errorf("logit bias for %q must be between -100 and 100", text)
+		}
+	}
+	return nil
+}
+
+// Set the config's gencmd and summarize sampling from the config file, which
+// is also used by gencmd in shell mode
+func (this *SamplingConfig) apply(temperature, topP *float32, maxTokens *int,
+	stop *[]string, logitBias *map[string]int) {
+	if this.Temperature != nil {
+		*temperature = *this.Temperature
+	}
+	if this.TopP != nil {
+		*topP = *this.TopP
+	}
+	if this.MaxTokens != 0 {
+		*maxTokens = this.MaxTokens
+	}
+	if len(this.Stop) > 0 {
+		*stop = this.Stop
+	}
+	if len(this.LogitBias) > 0 {
+		*logitBias = this.LogitBias
+	}
+}
+
+// Set the temperature, top-p, max tokens, stop, and logit bias flags of the
+// command being run from the config file's sampling section if they weren't
+// given
+func ApplySamplingDefaults(ctx *kong.Context, config *ButterfishConfig) {
+	sampling, ok := config.Sampling[commandName(ctx)]
+	if !ok {
+		return
+	}
+
+	given := GivenFlags(ctx)
+	for _, flag := range ctx.Flags() {
+		if given[flag.Name] {
+			continue
+		}
+		target := flag.Value.Target
+		switch flag.Name {
+		case "temperature":
+			if sampling.Temperature != nil {
+				target.SetFloat(float64(*sampling.Temperature))
+			}
+		case "top-p":
+			if sampling.TopP != nil {
+				target.SetFloat(float64(*sampling.TopP))
+			}
+		case "max-tokens", "num-tokens":
+			if sampling.MaxTokens != 0 {
+				target.SetInt(int64(sampling.MaxTokens))
+			}
+		case "stop":
+			if len(sampling.Stop) > 0 {
+				target.Set(reflect.ValueOf(sampling.Stop))
+			}
+		case "logit-bias":
+			if len(sampling.LogitBias) > 0 {
+				target.Set(reflect.ValueOf(sampling.LogitBias))
+			}
+		}
+	}
+}
+
+// The client leaves out a temperature of 0, and the API then uses 1, so a
+// temperature of 0 is sent as the smallest one above it
+func requestTemperature(temperature float32) float32 {
+	if temperature == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return temperature
+}
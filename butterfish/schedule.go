@@ -0,0 +1,440 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/mitchellh/go-homedir"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// butterfish schedule turns a description like "backup ~/photos nightly at
+// 2am" into a crontab entry, or a systemd timer and service with --systemd.
+// The schedule is validated, a cron schedule by parsing it and a systemd one
+// with systemd-analyze if it's installed, and the model is asked again if
+// it's invalid. With --install the job is added to the user's crontab, or
+// the units are written to ~/.config/systemd/user and the timer is started,
+// after confirming.
+
+const (
+	scheduleFormatCron    = "cron"
+	scheduleFormatSystemd = "systemd"
+
+	scheduleMaxAttempts = 3
+	scheduleToolTimeout = 10 * time.Second
+	// The unit name is cut to this length
+	scheduleMaxNameLength = 40
+)
+
+var scheduleSchema = &jsonschema.Definition{
+	Type: jsonschema.Object,
+	Properties: map[string]jsonschema.Definition{
+		"name": {
+			Type:        jsonschema.String,
+			Description: "A short name for the job in lowercase words separated by dashes, e.g. backup-photos",
+		},
+		"schedule": {
+			Type:        jsonschema.String,
+			Description: "When the job runs",
+		},
+		"command": {
+			Type:        jsonschema.String,
+			Description: "The shell command to run",
+		},
+		"explanation": {
+			Type:        jsonschema.String,
+			Description: "One sentence on what runs and when",
+		},
+	},
+	Required:             []string{"name", "schedule", "command", "explanation"},
+	AdditionalProperties: false,
+}
+
+// A generated job
+type ScheduledJob struct {
+	Name        string `json:"name"`
+	Schedule    string `json:"schedule"`
+	Command     string `json:"command"`
+	Explanation string `json:"explanation"`
+}
+
+var cronMacros = map[string]bool{
+	"@reboot": true, "@yearly": true, "@annually": true, "@monthly": true,
+	"@weekly": true, "@daily": true, "@midnight": true, "@hourly": true,
+}
+
+// The range and names of each field of a cron schedule
+var cronFields = []struct {
+	Name     string
+	Min, Max int
+	Names    []string
+}{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// Check a cron schedule, i.e. five fields or a macro like @daily
+func validateCronSchedule(schedule string) error {
+	fields := strings.Fields(schedule)
+	if len(fields) == 1 && cronMacros[fields[0]] {
+		return nil
+	}
+	if len(fields) != len(cronFields) {
+		return fmt.Errorf("cron schedule %q should have 5 fields, it has %d", schedule, len(fields))
+	}
+
+	for i, field := range fields {
+		spec := cronFields[i]
+		value := func(s string) (int, error) {
+			for j, name := range spec.Names {
+				if strings.ToLower(s) == name {
+					return j + spec.Min, nil
+				}
+			}
+			n, err := strconv.Atoi(s)
+			if err != nil || n < spec.Min || n > spec.Max {
+				return 0, fmt.Errorf("%s %q should be from %d to %d", spec.Name, s, spec.Min, spec.Max)
+			}
+			return n, nil
+		}
+
+		for _, part := range strings.Split(field, ",") {
+			part, step, hasStep := strings.Cut(part, "/")
+			if hasStep {
+				n, err := strconv.Atoi(step)
+				if err != nil || n <= 0 {
+					return fmt.Errorf("%s step %q should be a positive number", spec.Name, step)
+				}
+			}
+			if part == "*" {
+				continue
+			}
+			start, end, isRange := strings.Cut(part, "-")
+			low, err := value(start)
+			if err != nil {
+				return err
+			}
+			if isRange {
+				high, err := value(end)
+				if err != nil {
+					return err
+				}
+				if high < low {
+					return fmt.Errorf("%s range %q is backwards", spec.Name, part)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Check a systemd OnCalendar expression with systemd-analyze, if it's
+// installed
+func validateSystemdCalendar(ctx context.Context, schedule string) error {
+	if strings.TrimSpace(schedule) == "" {
+		return errors.New("the systemd schedule is empty")
+	}
+	analyze, err := exec.LookPath("systemd-analyze")
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, scheduleToolTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, analyze, "calendar", schedule).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemd-analyze calendar %q failed: %s", schedule, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+var unitNameRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+// A name that's safe for a systemd unit file
+func scheduleUnitName(name string) string {
+	name = strings.Trim(unitNameRegexp.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(name) > scheduleMaxNameLength {
+		name = strings.TrimRight(name[:scheduleMaxNameLength], "-")
+	}
+	if name == "" {
+		return "butterfish-job"
+	}
+	return name
+}
+
+// The crontab lines for a job. Cron treats % in a command as a newline, so
+// it's escaped. A real newline would add lines of its own to the crontab, so
+// fields with one are refused.
+func (this *ScheduledJob) Crontab() (string, error) {
+	for _, field := range []struct{ Name, Value string }{
+		{"command", this.Command},
+		{"schedule", this.Schedule},
+		{"explanation", this.Explanation},
+	} {
+		if strings.ContainsAny(field.Value, "\r\n") {
+			return "", fmt.Errorf("the %s has more than one line", field.Name)
+		}
+	}
+	return fmt.Sprintf("# %s\n%s %s\n", this.Explanation, this.Schedule,
+		strings.ReplaceAll(this.Command, "%", `\%`)), nil
+}
+
+// Quote a command for ExecStart, escaping systemd's specifiers and variable
+// expansion
+func systemdQuote(command string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$")
+	return `"` + replacer.Replace(command) + `"`
+}
+
+// The service unit, which runs the command with sh so pipes and ~ work
+func (this *ScheduledJob) SystemdService() string {
+	return fmt.Sprintf("[Unit]\nDescription=%s\n\n[Service]\nType=oneshot\nExecStart=/bin/sh -c %s\n",
+		this.Explanation, systemdQuote(this.Command))
+}
+
+func (this *ScheduledJob) SystemdTimer() string {
+	return fmt.Sprintf("[Unit]\nDescription=%s\n\n[Timer]\nOnCalendar=%s\nPersistent=true\n\n[Install]\nWantedBy=timers.target\n",
+		this.Explanation, this.Schedule)
+}
+
+// Generate a job for the description, asking again with the problem if the
+// schedule isn't valid
+func (this *ButterfishCtx) generateScheduledJob(description, format, model string) (*ScheduledJob, error) {
+	promptName := prompt.PromptScheduleCron
+	if format == scheduleFormatSystemd {
+		promptName = prompt.PromptScheduleSystemd
+	}
+	promptStr, err := this.GetPrompt(promptName, "content", description)
+	if err != nil {
+		return nil, err
+	}
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	original := promptStr
+	for attempt := 1; ; attempt++ {
+		response, err := this.completeWithSchema(&util.CompletionRequest{
+			Ctx:              this.Ctx,
+			Prompt:           promptStr,
+			PromptName:       promptName,
+			Model:            model,
+			MaxTokens:        512,
+			Temperature:      0.2,
+			SystemMessage:    sysMsg,
+			SystemPromptName: prompt.PromptSystemMessage,
+			Task:             TaskGencmd,
+			Verbose:          this.Config.Verbose > 0,
+			TokenTimeout:     this.Config.TokenTimeout,
+		}, scheduleSchema)
+		if err != nil {
+			return nil, err
+		}
+
+		job := &ScheduledJob{}
+		err = json.Unmarshal([]byte(response.Completion), job)
+		if err != nil {
+			return nil, err
+		}
+		job.Name = scheduleUnitName(job.Name)
+		job.Schedule = strings.TrimSpace(job.Schedule)
+		job.Command = strings.TrimSpace(job.Command)
+		job.Explanation = strings.Join(strings.Fields(job.Explanation), " ")
+		if job.Command == "" {
+			err = errors.New("the command is empty")
+		} else if strings.ContainsAny(job.Command, "\r\n") {
+			err = errors.New("the command has more than one line")
+		} else if format == scheduleFormatSystemd {
+			err = validateSystemdCalendar(this.Ctx, job.Schedule)
+		} else {
+			err = validateCronSchedule(job.Schedule)
+		}
+		if err == nil {
+			return job, nil
+		}
+		if attempt >= scheduleMaxAttempts {
+			return nil, fmt.Errorf("No valid schedule after %d attempts, %s", attempt, err)
+		}
+
+		log.Printf("Invalid schedule (attempt %d): %s", attempt, err)
+		promptStr = fmt.Sprintf("%s\n\nYour previous answer was rejected because %s. Previous answer:\n%s",
+			original, err, response.Completion)
+	}
+}
+
+// The user's current crontab. crontab -l fails if there isn't one yet, which
+// is the same as an empty one, but any other failure is returned since
+// writing over a crontab we couldn't read would lose it.
+func readCrontab(ctx context.Context) (string, error) {
+	existing, err := exec.CommandContext(ctx, "crontab", "-l").Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if isNoCrontab(string(exitErr.Stderr)) {
+				return "", nil
+			}
+			return "", fmt.Errorf("crontab -l: %s %s", err, exitErr.Stderr)
+		}
+		return "", fmt.Errorf("crontab -l: %w", err)
+	}
+	return string(existing), nil
+}
+
+// Whether crontab -l's error output says the user has no crontab
+func isNoCrontab(stderr string) bool {
+	return strings.Contains(strings.ToLower(stderr), "no crontab for")
+}
+
+// Add the job to the user's crontab, unless it's already there
+func installCrontab(ctx context.Context, entry string) error {
+	ctx, cancel := context.WithTimeout(ctx, scheduleToolTimeout)
+	defer cancel()
+	current, err := readCrontab(ctx)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(current, entry) {
+		return nil
+	}
+	if current != "" && !strings.HasSuffix(current, "\n") {
+		current += "\n"
+	}
+
+	cmd := exec.CommandContext(ctx, "crontab", "-")
+	cmd.Stdin = strings.NewReader(current + entry)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("crontab: %s %s", err, output)
+	}
+	return nil
+}
+
+// Write the units to the user's systemd directory and start the timer,
+// returns the directory
+func installSystemdUnits(ctx context.Context, job *ScheduledJob) (string, error) {
+	dir, err := homedir.Expand("~/.config/systemd/user")
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	units := []struct{ Path, Content string }{
+		{filepath.Join(dir, job.Name+".service"), job.SystemdService()},
+		{filepath.Join(dir, job.Name+".timer"), job.SystemdTimer()},
+	}
+	// check both before writing either so we don't leave half a pair behind
+	for _, unit := range units {
+		if _, err := os.Lstat(unit.Path); err == nil {
+			return "", fmt.Errorf("%s already exists", unit.Path)
+		}
+	}
+	for i, unit := range units {
+		err = os.WriteFile(unit.Path, []byte(unit.Content), 0644)
+		if err != nil {
+			for _, written := range units[:i] {
+				os.Remove(written.Path)
+			}
+			return "", err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, scheduleToolTimeout)
+	defer cancel()
+	for _, args := range [][]string{
+		{"--user", "daemon-reload"},
+		{"--user", "enable", "--now", job.Name + ".timer"},
+	} {
+		output, err := exec.CommandContext(ctx, "systemctl", args...).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("systemctl %s: %s %s", strings.Join(args, " "), err, output)
+		}
+	}
+	return dir, nil
+}
+
+func (this *ButterfishCtx) scheduleCommand(options *CliCommandConfig) error {
+	schedule := options.Schedule
+	description := this.cleanInput(schedule.Description)
+	if description == "" {
+		return errors.New("Please describe the job to schedule, e.g. 'backup ~/photos nightly at 2am'")
+	}
+	format := scheduleFormatCron
+	if schedule.Systemd {
+		format = scheduleFormatSystemd
+	}
+
+	job, err := this.generateScheduledJob(description, format, schedule.Model)
+	if err != nil {
+		return err
+	}
+	if schedule.Name != "" {
+		job.Name = scheduleUnitName(schedule.Name)
+	}
+
+	this.StylePrintf(this.Config.Styles.Answer, "%s\n\n", job.Explanation)
+	if format == scheduleFormatSystemd {
+		this.StylePrintf(this.Config.Styles.Grey, "# %s.service\n", job.Name)
+		this.StylePrintf(this.Config.Styles.Highlight, "%s\n", job.SystemdService())
+		this.StylePrintf(this.Config.Styles.Grey, "# %s.timer\n", job.Name)
+		this.StylePrintf(this.Config.Styles.Highlight, "%s", job.SystemdTimer())
+	} else {
+		entry, err := job.Crontab()
+		if err != nil {
+			return err
+		}
+		this.StylePrintf(this.Config.Styles.Highlight, "%s", entry)
+	}
+	if missing := missingBinaries(job.Command); len(missing) > 0 {
+		this.StylePrintf(this.Config.Styles.Error, "Not installed: %s\n", strings.Join(missing, ", "))
+	}
+
+	if !schedule.Install {
+		return nil
+	}
+	if !schedule.Yes {
+		question := "Add this to your crontab?"
+		if format == scheduleFormatSystemd {
+			question = fmt.Sprintf("Install and start %s.timer?", job.Name)
+		}
+		ok, err := this.confirm(question)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	if format == scheduleFormatSystemd {
+		dir, err := installSystemdUnits(this.Ctx, job)
+		if err != nil {
+			return err
+		}
+		this.StylePrintf(this.Config.Styles.Grey, "Wrote %s.service and %s.timer to %s and started the timer, check it with: systemctl --user list-timers %s.timer\n",
+			job.Name, job.Name, dir, job.Name)
+		return nil
+	}
+	entry, err := job.Crontab()
+	if err != nil {
+		return err
+	}
+	err = installCrontab(this.Ctx, entry)
+	if err != nil {
+		return err
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "Added to your crontab, check it with: crontab -l\n")
+	return nil
+}
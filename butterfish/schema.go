@@ -0,0 +1,129 @@
+package butterfish
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// The prompt command can take a JSON schema for its output so scripts get
+// reliably parseable results. Models that support structured output are
+// asked to enforce the schema, and we validate every response and retry with
+// the validation error otherwise.
+
+const schemaMaxAttempts = 3
+
+func LoadResponseSchema(path string) (*jsonschema.Definition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &jsonschema.Definition{}
+	err = json.Unmarshal(data, schema)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing schema %s: %w", path, err)
+	}
+	if schema.Type == "" {
+		return nil, fmt.Errorf("Schema %s must have a type", path)
+	}
+	return schema, nil
+}
+
+// Models sometimes wrap JSON in a markdown code block even when asked not to
+func stripJSONFence(response string) string {
+	response = strings.TrimSpace(response)
+	if !strings.HasPrefix(response, "```") {
+		return response
+	}
+	_, body, _ := strings.Cut(response, "\n")
+	body, _, _ = strings.Cut(body, "```")
+	return strings.TrimSpace(body)
+}
+
+// Check that a response is JSON matching the schema, returns the JSON
+// indented for printing
+func validateSchemaResponse(schema *jsonschema.Definition, response string) (string, error) {
+	response = stripJSONFence(response)
+
+	var data any
+	err := json.Unmarshal([]byte(response), &data)
+	if err != nil {
+		return "", fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	if !jsonschema.Validate(*schema, data) {
+		return "", errors.New("response does not match the schema")
+	}
+
+	indented := bytes.Buffer{}
+	err = json.Indent(&indented, []byte(response), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return indented.String(), nil
+}
+
+func schemaSystemMessage(sysMsg string, schema *jsonschema.Definition) (string, error) {
+	schemaJSON, err := json.Marshal(schema)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s\n\nRespond with only JSON, no explanation or code block, that matches this JSON schema:\n%s",
+		sysMsg, schemaJSON), nil
+}
+
+// Run a prompt whose response must match a schema, retrying with the
+// validation error if it doesn't. Returns the validated JSON, indented.
+func (this *ButterfishCtx) completeWithSchema(req *util.CompletionRequest, schema *jsonschema.Definition) (*util.CompletionResponse, error) {
+	sysMsg, err := schemaSystemMessage(req.SystemMessage, schema)
+	if err != nil {
+		return nil, err
+	}
+	req.SystemMessage = sysMsg
+	req.ResponseSchema = schema
+	// structured output isn't available with instruct models and some others,
+	// they rely on the system message and validation
+	if !supportsJSONMode(req.Model) {
+		req.ResponseSchema = nil
+	}
+
+	prompt := req.Prompt
+	for attempt := 1; ; attempt++ {
+		response, err := this.LLMClient.Completion(req)
+		if err != nil {
+			return nil, err
+		}
+
+		output, err := validateSchemaResponse(schema, response.Completion)
+		if err == nil {
+			response.Completion = output
+			return response, nil
+		}
+		if attempt >= schemaMaxAttempts {
+			return nil, fmt.Errorf("No valid response after %d attempts, the last %s:\n%s",
+				attempt, err, response.Completion)
+		}
+
+		log.Printf("Invalid schema response (attempt %d): %s", attempt, err)
+		req.Prompt = fmt.Sprintf("%s\n\nYour previous response was rejected because the %s. Previous response:\n%s",
+			prompt, err, response.Completion)
+	}
+}
+
+// Run a prompt with a schema for the prompt command. The validated JSON is
+// printed without styling so it can be piped to other programs.
+func (this *ButterfishCtx) schemaPrompt(req *util.CompletionRequest, schema *jsonschema.Definition) (*util.CompletionResponse, error) {
+	response, err := this.completeWithSchema(req, schema)
+	if err != nil {
+		return nil, err
+	}
+	this.teeWriter(this.Out).Write([]byte(response.Completion + "\n"))
+	return response, nil
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -16,12 +17,11 @@ import (
 	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/bakks/butterfish/prompt"
 	"github.com/bakks/butterfish/util"
-	"github.com/sashabaranov/go-openai/jsonschema"
 
-	"github.com/bakks/tiktoken-go"
 	"github.com/mitchellh/go-ps"
 	"golang.org/x/term"
 )
@@ -31,7 +31,6 @@ import (
 // in Tiktoken
 // These models are used specifically for counting tokens to pack into
 // the prompt context
-const DEFAULT_AUTOSUGGEST_ENCODER = "gpt-3.5-turbo-instruct"
 const DEFAULT_PROMPT_ENCODER = "gpt-4-turbo"
 
 const ESC_CUP = "\x1b[6n" // Request the cursor position
@@ -78,8 +77,39 @@ var LightShellColorScheme = &ShellColorScheme{
 	Error:            "\x1b[38;5;196m",
 }
 
+// Create the file we write the status line to, exported to the child shell
+// as BUTTERFISH_STATUS_FILE so it can be included in the shell prompt, e.g.
+// PS1='$(cat $BUTTERFISH_STATUS_FILE 2>/dev/null) $ '
+// It's in a new directory that only we can use, under $XDG_RUNTIME_DIR if
+// it's set, so other users can't put a file or link there for us to write
+// to. Returns the path and a function that removes the directory.
+func createShellStatusFile() (string, func(), error) {
+	dir, err := os.MkdirTemp(os.Getenv("XDG_RUNTIME_DIR"), "butterfish-")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.RemoveAll(dir) }
+
+	path := filepath.Join(dir, "status")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	file.Close()
+	return path, remove, nil
+}
+
 func RunShell(ctx context.Context, config *ButterfishConfig) error {
-	envVars := []string{"BUTTERFISH_SHELL=1"}
+	statusFile, removeStatusFile, err := createShellStatusFile()
+	if err != nil {
+		return err
+	}
+	defer removeStatusFile()
+	envVars := []string{
+		"BUTTERFISH_SHELL=1",
+		"BUTTERFISH_STATUS_FILE=" + statusFile,
+	}
 
 	ptmx, ptyCleanup, err := ptyCommand(ctx, envVars, []string{config.ShellBinary})
 	if err != nil {
@@ -91,9 +121,10 @@ func RunShell(ctx context.Context, config *ButterfishConfig) error {
 	if err != nil {
 		return err
 	}
+	defer bf.Close()
 	//fmt.Println("Starting butterfish shell")
 
-	bf.ShellMultiplexer(ptmx, ptmx, os.Stdin, os.Stdout)
+	bf.ShellMultiplexer(ptmx, ptmx, os.Stdin, os.Stdout, statusFile)
 	return nil
 }
 
@@ -119,6 +150,8 @@ func HistoryTypeToString(historyType int) string {
 		return "LLM Output"
 	case historyTypeFunctionOutput:
 		return "Function Output"
+	case historyTypeToolOutput:
+		return "Tool Output"
 	default:
 		return "Unknown"
 	}
@@ -139,6 +172,10 @@ type HistoryBuffer struct {
 	Content        *ShellBuffer
 	FunctionName   string
 	FunctionParams string
+	ToolCalls      []*util.ToolCall
+	ToolCallId     string
+	// The host of the ssh session the block came from, empty if local
+	Host string
 
 	// This is to cache tokenization plus truncation of the content
 	// It maps from encoding name to the tokenization of the output
@@ -177,7 +214,11 @@ func (this *HistoryBuffer) GetTokenization(encoding string, length int) (string,
 // HistoryBlocks.
 type ShellHistory struct {
 	Blocks []*HistoryBuffer
-	mutex  sync.Mutex
+	// New blocks are tagged with this host, set during an ssh session
+	Host string
+	// Shell input and output aren't added while this is set, see private.go
+	Private bool
+	mutex   sync.Mutex
 }
 
 func NewShellHistory() *ShellHistory {
@@ -192,9 +233,28 @@ func (this *ShellHistory) add(historyType int, block string) {
 	this.Blocks = append(this.Blocks, &HistoryBuffer{
 		Type:    historyType,
 		Content: buffer,
+		Host:    this.Host,
 	})
 }
 
+func (this *ShellHistory) SetHost(host string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.Host = host
+}
+
+func (this *ShellHistory) SetPrivate(private bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.Private = private
+}
+
+func (this *ShellHistory) Clear() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.Blocks = make([]*HistoryBuffer, 0)
+}
+
 func (this *ShellHistory) Append(historyType int, data string) {
 	// if data is empty, we don't want to add a new block
 	if len(data) == 0 {
@@ -204,12 +264,16 @@ func (this *ShellHistory) Append(historyType int, data string) {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
 
+	if this.Private && (historyType == historyTypeShellInput || historyType == historyTypeShellOutput) {
+		return
+	}
+
 	numBlocks := len(this.Blocks)
 	// if we have a block already, and it matches the type, append to it
 	if numBlocks > 0 {
 		lastBlock := this.Blocks[numBlocks-1]
 
-		if lastBlock.Type == historyType {
+		if lastBlock.Type == historyType && lastBlock.Host == this.Host {
 			lastBlock.Content.Write(data)
 			return
 		}
@@ -231,7 +295,18 @@ func (this *ShellHistory) AddFunctionCall(name, params string) {
 	})
 }
 
-func (this *ShellHistory) AppendFunctionOutput(name, data string) {
+func (this *ShellHistory) AddToolCalls(toolCalls []*util.ToolCall) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.Blocks = append(this.Blocks, &HistoryBuffer{
+		Type:      historyTypeLLMOutput,
+		ToolCalls: toolCalls,
+		Content:   NewShellBuffer(),
+	})
+}
+
+func (this *ShellHistory) AppendToolOutput(id, name, data string) {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
 
@@ -245,16 +320,17 @@ func (this *ShellHistory) AppendFunctionOutput(name, data string) {
 	// if we have a block already, and it matches the type, append to it
 	if numBlocks > 0 {
 		lastBlock = this.Blocks[numBlocks-1]
-		if lastBlock.Type == historyTypeFunctionOutput && lastBlock.FunctionName == name {
+		if lastBlock.Type == historyTypeToolOutput && lastBlock.ToolCallId == id {
 			lastBlock.Content.Write(data)
 			return
 		}
 	}
 
 	// if the history type doesn't match we fall through and add a new block
-	this.add(historyTypeFunctionOutput, data)
+	this.add(historyTypeToolOutput, data)
 	lastBlock = this.Blocks[numBlocks]
 	lastBlock.FunctionName = name
+	lastBlock.ToolCallId = id
 }
 
 // Go back in history for a certain number of bytes.
@@ -266,7 +342,7 @@ func (this *ShellHistory) GetLastNBytes(numBytes int, truncateLength int) []util
 
 	for i := len(this.Blocks) - 1; i >= 0 && numBytes > 0; i-- {
 		block := this.Blocks[i]
-		content := sanitizeTTYString(block.Content.String())
+		content := denoiseHistoryContent(block.Type, block.Content.String())
 		if len(content) > truncateLength {
 			content = content[:truncateLength]
 		}
@@ -360,6 +436,7 @@ type ShellState struct {
 	ParentOut  io.Writer
 	ChildIn    io.Writer
 	Sigwinch   chan os.Signal
+	Sighup     chan os.Signal // reloads the config, see reload.go
 
 	// set based on model
 	PromptMaxTokens      int
@@ -371,15 +448,34 @@ type ShellState struct {
 	GoalModeBuffer         string
 	GoalModeGoal           string
 	GoalModeUnsafe         bool
+	GoalModeCommand        string
+	goalModePendingCommand string // typed for the user to accept, see checkpointAcceptedGoalCommand
+	GoalModeFailures       int
+	GoalModeFailedAttempts []string
 	ActiveFunction         string
+	ActiveToolCallId       string
+	RecentExitCodes        []int
+	StatusFile             string    // the status line is written here if set, see RunShell
+	RemoteHost             string    // set while the user is in an ssh session
+	REPL                   *replInfo // set while the user is in a REPL, see repl.go
 	PromptSuffixCounter    int
+	lastPrompt             string // the shell's last prompt as it was shown
 	ChildOutReader         chan *byteMsg
 	ParentInReader         chan *byteMsg
 	CursorPosChan          chan *cursorPosition
 	PromptOutputChan       chan *util.CompletionResponse
 	PrintErrorChan         chan error
 	AutosuggestChan        chan *AutosuggestResult
+	AnnotationChan         chan string
+	CommandPreviewChan     chan *commandPreviewResult
+	TranscriptChan         chan *transcriptResult
 	History                *ShellHistory
+	Branches               *ConversationBranches
+	Pins                   []*Pin
+	ProjectContextCache    *projectContextCache
+	shellProfile           string // see LoadShellProfile
+	shellProfileMutex      sync.Mutex
+	SessionStart           time.Time
 	PromptAnswerWriter     io.Writer
 	PromptGoalAnswerWriter io.Writer
 	StyleWriter            *util.StyleCodeblocksWriter
@@ -388,18 +484,52 @@ type ShellState struct {
 	Command                *ShellBuffer
 	TerminalWidth          int
 	Color                  *ShellColorScheme
+	KeyBindings            *KeyBindings
+	Tmux                   *TmuxAnswers
+	Terminal               *TerminalProtocols // nil if the terminal has none we use, see terminal.go
+	AnswerMarked           bool               // an answer start marker was written, see accessible.go
+	Recording              *audioRecording    // a voice prompt being recorded, see speech.go
+	TranscribeCancel       context.CancelFunc // set while a voice prompt is transcribed
+	Speaker                *AnswerSpeaker     // reads answers aloud, see tts.go
+	SpeakEnabled           bool
 	LastTabPassthrough     time.Time
+	LastContextTokens      int
 	parentInBuffer         []byte
 	// these are used to estimate number of tokens
-	AutosuggestEncoder *tiktoken.Tiktoken
-	PromptEncoder      *tiktoken.Tiktoken
+	AutosuggestTokenizer Tokenizer
+	PromptTokenizer      Tokenizer
 
 	// autosuggest config
 	AutosuggestEnabled bool
 	LastAutosuggest    string
 	AutosuggestCtx     context.Context
 	AutosuggestCancel  context.CancelFunc
+	PendingAutosuggest *pendingAutosuggest
 	AutosuggestBuffer  *ShellBuffer
+
+	// command annotation state, see annotate.go
+	AnnotateEnabled bool
+	CommandPending  bool // set when a command is run, cleared when it's described
+	CommandStart    time.Time
+
+	// explain goal mode commands before offering them, see preview.go
+	ExplainFirstEnabled bool
+
+	// leave all commands out of the history, see private.go
+	PrivateEnabled bool
+
+	// fixes learned from suggested commands, see fixes.go
+	Fixes                 *FixKnowledgeBase
+	FailedCommand         *failedCommand
+	FixCandidate          string
+	KnownFix              string
+	CommandFromSuggestion bool
+
+	// the pipeline being built with !pipe, see pipeline.go
+	Pipeline *ShellPipeline
+	// typed at the next prompt for the user to review and run, set before
+	// sending to PromptOutputChan
+	PendingChildInput string
 }
 
 func (this *ShellState) setState(state int) {
@@ -412,6 +542,9 @@ func (this *ShellState) setState(state int) {
 	}
 
 	this.State = state
+	if state == statePromptResponse {
+		this.markAnswerStart()
+	}
 }
 
 func clearByteChan(r <-chan *byteMsg, timeout time.Duration) {
@@ -537,6 +670,20 @@ func ParsePS1(data string, regex *regexp.Regexp, currIcon string) (int, int, str
 	return lastStatus, prompts, cleaned
 }
 
+// The last whole prompt in child output as it's shown, without our escape
+// sequences, empty if there isn't one
+func (this *ShellState) lastPromptText(data string) string {
+	start := strings.LastIndex(data, PROMPT_PREFIX)
+	if start == -1 {
+		return ""
+	}
+	_, prompts, prompt := this.ParsePS1(data[start:])
+	if prompts == 0 {
+		return ""
+	}
+	return prompt
+}
+
 func (this *ShellState) ParsePS1(data string) (int, int, string) {
 	var regex *regexp.Regexp
 	if this.Butterfish.Config.ShellLeavePromptAlone {
@@ -582,7 +729,7 @@ func min(a, b int) int {
 
 func (this *ButterfishCtx) ShellMultiplexer(
 	childIn io.Writer, childOut io.Reader,
-	parentIn io.Reader, parentOut io.Writer) {
+	parentIn io.Reader, parentOut io.Writer, statusFile string) {
 
 	this.SetPS1(childIn)
 
@@ -622,8 +769,32 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		colorScheme.AnswerHighlight,
 		codeblocksColorScheme)
 
+	// In tmux mode prompt answers go to a separate pane or popup, goal mode
+	// answers stay inline since they're interleaved with commands
+	var tmuxAnswers *TmuxAnswers
+	if this.Config.ShellTmuxMode != "" {
+		tmuxAnswers, err = NewTmuxAnswers(this.Config.ShellTmuxMode)
+		if err != nil {
+			log.Printf("Not using tmux mode: %s", err)
+			fmt.Fprintf(parentOut, "Not using tmux mode: %s\r\n", err)
+		} else {
+			defer tmuxAnswers.Close()
+			styleCodeblocksWriter = util.NewStyleCodeblocksWriter(
+				tmuxAnswers,
+				tmuxAnswers.Width(termWidth),
+				colorScheme.Answer,
+				colorScheme.AnswerHighlight,
+				codeblocksColorScheme)
+		}
+	}
+
+	styleCodeblocksWriter.SetPlain(this.Config.PlainOutput)
+	styleCodeblocksWriterGoal.SetPlain(this.Config.PlainOutput)
+
 	sigwinch := make(chan os.Signal, 1)
 	signal.Notify(sigwinch, syscall.SIGWINCH)
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
 
 	promptMaxTokens := min(
 		NumTokensForModel(this.Config.ShellPromptModel),
@@ -632,11 +803,18 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		NumTokensForModel(this.Config.ShellAutosuggestModel),
 		this.Config.ShellMaxPromptTokens)
 
+	keyBindings := this.Config.ShellKeyBindings
+	if keyBindings == nil {
+		keyBindings = DefaultKeyBindings()
+	}
+
 	shellState := &ShellState{
 		Butterfish:             this,
 		ParentOut:              parentOut,
 		ChildIn:                childIn,
+		StatusFile:             statusFile,
 		Sigwinch:               sigwinch,
+		Sighup:                 sighup,
 		State:                  stateNormal,
 		ChildOutReader:         childOutReader,
 		ParentInReader:         parentInReader,
@@ -652,23 +830,41 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		TerminalWidth:          termWidth,
 		AutosuggestEnabled:     this.Config.ShellAutosuggestEnabled,
 		AutosuggestChan:        make(chan *AutosuggestResult),
+		AnnotationChan:         make(chan string, 1),
+		CommandPreviewChan:     make(chan *commandPreviewResult, 1),
+		TranscriptChan:         make(chan *transcriptResult, 1),
+		AnnotateEnabled:        this.Config.ShellAnnotate,
+		Speaker:                &AnswerSpeaker{Butterfish: this},
+		SpeakEnabled:           this.Config.ShellSpeak,
+		ExplainFirstEnabled:    this.Config.ExplainBeforeExecute,
 		Color:                  colorScheme,
+		KeyBindings:            keyBindings,
+		Tmux:                   tmuxAnswers,
+		Terminal:               NewTerminalProtocols(this.Config.ShellTerminal, parentOut),
 		parentInBuffer:         []byte{},
 		PromptMaxTokens:        promptMaxTokens,
 		AutosuggestMaxTokens:   autoSuggestMaxTokens,
+		SessionStart:           time.Now(),
+		ProjectContextCache:    &projectContextCache{entries: map[string]string{}},
 	}
 
+	shellState.Branches = NewConversationBranches(shellState.History)
 	shellState.Prompt.SetTerminalWidth(termWidth)
 	shellState.Prompt.SetColor(colorScheme.Prompt)
 
 	go readerToChannel(childOut, childOutReader)
 	go readerToChannelWithPosition(parentIn, parentInReader, parentPositionChan)
 
+	if !this.Config.ShellNoProfile {
+		shellState.LoadShellProfile()
+	}
+
 	// clear out any existing output to hide the PS1 export stuff
 	clearByteChan(childOutReader, 1000*time.Millisecond)
 
 	// start
 	shellState.Mux()
+	shellState.SaveSession()
 }
 
 func (this *ShellState) Errorf(format string, args ...any) {
@@ -764,6 +960,9 @@ func (this *ShellState) Mux() {
 		case pos := <-this.CursorPosChan:
 			fmt.Fprintf(this.ChildIn, "\x1b[%d;%dR", pos.Row, pos.Column)
 
+		case <-this.Sighup:
+			this.ReloadConfigOnSignal()
+
 		// the terminal window resized and we got a SIGWINCH
 		case <-this.Sigwinch:
 			termWidth, _, err := term.GetSize(int(os.Stdout.Fd()))
@@ -775,7 +974,11 @@ func (this *ShellState) Mux() {
 			}
 			this.TerminalWidth = termWidth
 			this.Prompt.SetTerminalWidth(termWidth)
-			this.StyleWriter.SetTerminalWidth(termWidth)
+			if this.Tmux != nil {
+				this.StyleWriter.SetTerminalWidth(this.Tmux.Width(termWidth))
+			} else {
+				this.StyleWriter.SetTerminalWidth(termWidth)
+			}
 			if this.AutosuggestBuffer != nil {
 				this.AutosuggestBuffer.SetTerminalWidth(termWidth)
 			}
@@ -783,6 +986,18 @@ func (this *ShellState) Mux() {
 				this.Command.SetTerminalWidth(termWidth)
 			}
 
+		// We received a command annotation, see annotate.go
+		case annotation := <-this.AnnotationChan:
+			this.ShowAnnotation(annotation)
+
+		// We received the explanation of a goal mode command, see preview.go
+		case result := <-this.CommandPreviewChan:
+			this.ShowCommandPreview(result)
+
+		// We received the transcript of a voice prompt, see speech.go
+		case result := <-this.TranscriptChan:
+			this.ShowTranscript(result)
+
 		// We received an autosuggest result from the autosuggest goroutine
 		case result := <-this.AutosuggestChan:
 			// request cursor position
@@ -808,12 +1023,27 @@ func (this *ShellState) Mux() {
 		// calling functions returned, etc.
 		case output := <-this.PromptOutputChan:
 			historyData := output.Completion
+			if output.Truncated && historyData != "" {
+				// let the model know it didn't finish this answer
+				historyData += "\n[response interrupted]"
+			}
 			if historyData != "" {
 				this.History.Append(historyTypeLLMOutput, historyData)
 			}
 			if output.FunctionName != "" {
 				this.History.AddFunctionCall(output.FunctionName, output.FunctionParameters)
 			}
+			if len(output.ToolCalls) > 0 {
+				this.History.AddToolCalls(output.ToolCalls)
+			}
+			if this.Tmux != nil && !this.GoalMode && historyData != "" {
+				this.Tmux.AnswerDone()
+			} else if this.Terminal != nil && this.Tmux == nil && historyData != "" {
+				this.Terminal.AnswerEnd(historyData, shellWorkingDir())
+			}
+			if this.SpeakEnabled && !this.GoalMode && output.Completion != "" {
+				this.Speaker.Speak(output.Completion)
+			}
 
 			// If there is child output waiting to be printed, print that now
 			if len(childOutBuffer) > 0 {
@@ -822,12 +1052,25 @@ func (this *ShellState) Mux() {
 				childOutBuffer = []byte{}
 			}
 
+			// Local commands like Status send responses without token usage, we
+			// only update the status after real LLM calls
+			if output.PromptTokens > 0 || output.CompletionTokens > 0 {
+				this.LastContextTokens = output.PromptTokens
+				this.UpdateStatusLine()
+			}
+
+			this.markAnswerEnd()
+			this.CheckBudget()
+
 			// Get a new prompt
 			this.ChildIn.Write([]byte("\n"))
+			if this.PendingChildInput != "" {
+				this.ChildIn.Write([]byte(this.PendingChildInput))
+				this.PendingChildInput = ""
+			}
 
 			if this.GoalMode {
-				this.ActiveFunction = output.FunctionName
-				this.GoalModeFunction(output)
+				this.GoalModeToolCalls(output)
 				if this.GoalMode {
 					continue
 				}
@@ -850,8 +1093,19 @@ func (this *ShellState) Mux() {
 
 			lastStatus, prompts, childOutStr := this.ParsePS1(string(childOutMsg.Data))
 			this.PromptSuffixCounter += prompts
+			replPrompt := false
+			if prompts > 0 {
+				if prompt := this.lastPromptText(string(childOutMsg.Data)); prompt != "" {
+					this.lastPrompt = prompt
+				}
+				this.AddExitCode(lastStatus)
+				this.ExitRemote()
+				this.ExitREPL()
+			} else if this.State == stateNormal && !this.GoalMode && this.RemoteHost == "" {
+				replPrompt = this.CheckREPLPrompt(childOutStr)
+			}
 
-			if prompts > 0 && this.State == stateNormal && !this.GoalMode {
+			if (prompts > 0 || replPrompt) && this.State == stateNormal && !this.GoalMode {
 				// If we get a prompt and we're at the start of a command
 				// then we should request autosuggest
 				newAutosuggestDelay := this.Butterfish.Config.ShellNewlineAutosuggestTimeout
@@ -880,6 +1134,7 @@ func (this *ShellState) Mux() {
 				}
 			} else if this.ActiveFunction != "" {
 				this.ActiveFunction = ""
+				this.ActiveToolCallId = ""
 			}
 
 			// If we're getting child output while typing in a shell command, this
@@ -887,12 +1142,28 @@ func (this *ShellState) Mux() {
 			// completion, or something unknown, so we don't want to add to history.
 			if this.State != stateShell && !this.FilterChildOut(string(childOutMsg.Data)) {
 				if this.ActiveFunction != "" {
-					this.History.AppendFunctionOutput(this.ActiveFunction, childOutStr)
+					this.History.AppendToolOutput(this.ActiveToolCallId, this.ActiveFunction, childOutStr)
 				} else {
 					this.History.Append(historyTypeShellOutput, childOutStr)
 				}
 			}
 
+			// The command is done once we see a prompt, describe it now that its
+			// output is in the history
+			if prompts > 0 && this.CommandPending {
+				this.CommandPending = false
+				if !this.GoalMode {
+					// describing calls the model, only do it if it's used
+					if this.AnnotateEnabled || this.Butterfish.Config.ShellRecordHistory {
+						this.DescribeLastCommand(lastStatus)
+					}
+					this.SummarizeLongCommand(lastStatus)
+					if this.Butterfish.Config.ShellLearnFixes {
+						this.LearnFix(lastStatus)
+					}
+				}
+			}
+
 			// If the user is in shell mode and presses tab, and we're not doing a
 			// butterfish autocomplete, then we want to edit the command buffer with
 			// whatever the shell outputs immediately after tab. We treat stuff
@@ -916,13 +1187,19 @@ func (this *ShellState) Mux() {
 
 			if endOfFunctionCall {
 				// move cursor to the beginning of the line and clear the line
-				fmt.Fprintf(this.ParentOut, "\r%s", ESC_CLEAR)
+				fmt.Fprint(this.ParentOut, this.ownLinePrefix())
 				var status string
-				if this.ActiveFunction == "command" {
-					status = fmt.Sprintf("Exit Code: %d\n", lastStatus)
+				if this.ActiveFunction == toolRunCommand {
+					status = this.GoalModeCommandResult(lastStatus)
+				}
+				if this.GoalMode {
+					this.GoalModeFunctionResponse(status)
+				} else if status != "" {
+					// we ran out of retries, record the result without prompting
+					this.History.AppendToolOutput(this.ActiveToolCallId, this.ActiveFunction, status)
 				}
-				this.GoalModeFunctionResponse(status)
 				this.ActiveFunction = ""
+				this.ActiveToolCallId = ""
 				this.GoalModeBuffer = ""
 				this.PromptSuffixCounter = 0
 			}
@@ -984,21 +1261,26 @@ func (this *ShellState) ParentInputLoop(data []byte) {
 func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 	hasCarriageReturn := bytes.Contains(data, []byte{'\r'})
 
+	if this.Recording != nil || this.TranscribeCancel != nil {
+		return this.VoicePromptInput(data)
+	}
+
 	switch this.State {
 	case statePromptResponse:
-		// Ctrl-C while receiving prompt
-		// We're buffering the input right now so we check both the first and last
-		// bytes for Ctrl-C
-		if data[0] == 0x03 || data[len(data)-1] == 0x03 {
+		// Interrupt (Ctrl-C by default) while receiving prompt
+		// We're buffering the input right now so we check both the start and end
+		// of the input for the interrupt key
+		interrupt := this.KeyBindings.Sequence(keyActionInterrupt)
+		if interrupt != nil && (bytes.HasPrefix(data, interrupt) || bytes.HasSuffix(data, interrupt)) {
 			log.Printf("Canceling prompt response")
 			this.PromptResponseCancel()
 			this.PromptResponseCancel = nil
 			this.GoalMode = false
 			this.setState(stateNormal)
-			if data[0] == 0x03 {
-				return data[1:]
+			if bytes.HasPrefix(data, interrupt) {
+				return data[len(interrupt):]
 			} else {
-				return data[:len(data)-1]
+				return data[:len(data)-len(interrupt)]
 			}
 		}
 
@@ -1006,18 +1288,24 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 		return data
 
 	case stateNormal:
-		if HasRunningChildren() {
+		if this.REPL == nil && HasRunningChildren() {
 			// If we have running children then the shell is running something,
-			// so just forward the input.
+			// so just forward the input. REPLs get autosuggest like the shell.
 			this.ChildIn.Write(data)
 			return nil
 		}
 
-		if data[0] == 0x03 {
+		action, length, partial := this.KeyBindings.Match(data)
+		if partial {
+			// wait for the rest of the chord
+			return data
+		}
+
+		if action == keyActionInterrupt {
+			this.Speaker.Stop()
 			if this.GoalMode {
-				// Ctrl-C while in goal mode
-				fmt.Fprintf(this.PromptGoalAnswerWriter, "\n%sExited goal mode.%s\n", this.Color.Answer, this.Color.Command)
-				this.GoalMode = false
+				// Interrupt while in goal mode
+				this.ExitGoalMode()
 			}
 
 			if this.Command != nil {
@@ -1027,46 +1315,60 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 				this.Prompt.Clear()
 			}
 			this.setState(stateNormal)
-			this.ChildIn.Write([]byte{data[0]})
+			// the child shell should still see a Ctrl-C so it clears its line
+			this.ChildIn.Write([]byte{0x03})
 
-			return data[1:]
+			return data[length:]
 		}
 
-		// Check if the first character is uppercase or a bang
-		if unicode.IsUpper(rune(data[0])) || data[0] == '!' {
-			this.setState(statePrompting)
-			this.ClearAutosuggest(this.Color.Command)
-			this.Prompt.Clear()
-			this.Prompt.Write(string(data))
+		if action == keyActionClearContext {
+			this.ClearContext()
+			return data[length:]
+		}
+
+		if action == keyActionExplainLastCommand {
+			this.ParentOut.Write([]byte("\r\n"))
+			this.BreakdownCommand("")
+			return data[length:]
+		}
 
-			// Write the actual prompt start
-			color := this.Color.Prompt
-			if data[0] == '!' {
-				color = this.Color.PromptGoal
+		if action == keyActionVoicePrompt {
+			this.StartVoicePrompt()
+			return data[length:]
+		}
+
+		if action == keyActionToggleGoalMode {
+			if this.GoalMode {
+				this.ExitGoalMode()
+				this.ChildIn.Write([]byte("\n"))
+				return data[length:]
 			}
-			this.Prompt.SetColor(color)
-			fmt.Fprintf(this.ParentOut, "%s%s", color, data)
+			// start a goal mode prompt as if the user had typed a bang
+			this.StartPrompt([]byte{'!'})
+			return data[length:]
+		}
 
-			// We're starting a prompt managed here in the wrapper, so we want to
-			// get the cursor position
-			_, col := this.GetCursorPosition()
-			this.Prompt.SetPromptLength(col - 1 - this.Prompt.Size())
+		// Check if the first character is uppercase or a bang, in a REPL
+		// everything is input to the REPL
+		if this.REPL == nil && (unicode.IsUpper(rune(data[0])) || data[0] == '!') {
+			this.StartPrompt(data)
 			return data[1:]
 
-		} else if data[0] == '\t' { // user is asking to fill in an autosuggest
+		} else if action == keyActionAcceptAutosuggest { // user is asking to fill in an autosuggest
 			if this.LastAutosuggest != "" {
 				this.RealizeAutosuggest(this.Command, true, this.Color.Command)
 				this.setState(stateShell)
-				return data[1:]
+				return data[length:]
 			} else {
-				// no last autosuggest found, just forward the tab
+				// no last autosuggest found, just forward the key
 				this.LastTabPassthrough = time.Now()
-				this.ChildIn.Write([]byte{data[0]})
+				this.ChildIn.Write(data[:length])
 			}
-			return data[1:]
+			return data[length:]
 
 		} else if data[0] == '\r' {
 			this.ClearAutosuggest(this.Color.Command)
+			this.checkpointAcceptedGoalCommand()
 			this.ChildIn.Write(data)
 			return data[1:]
 
@@ -1088,6 +1390,12 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 		}
 
 	case statePrompting:
+		action, length, partial := this.KeyBindings.Match(data)
+		if partial {
+			// wait for the rest of the chord
+			return data
+		}
+
 		if hasCarriageReturn {
 			// check if the input contains a newline
 			this.ClearAutosuggest(this.Color.Command)
@@ -1103,6 +1411,9 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 				// This was a local prompt like "help", we're done now
 				return data[index+1:]
 			}
+			if promptStr[0] == '!' && this.HandleBangCommand(promptStr[1:]) {
+				return data[index+1:]
+			}
 
 			if promptStr[0] == '!' {
 				this.GoalModeStart()
@@ -1120,18 +1431,23 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			toPrint := this.Prompt.Write(string(data))
 			this.ParentOut.Write(toPrint)
 
-		} else if data[0] == '\t' { // user is asking to fill in an autosuggest
+		} else if action == keyActionAcceptAutosuggest { // user is asking to fill in an autosuggest
 			// Tab was pressed, fill in lastAutosuggest
 			if this.LastAutosuggest != "" {
 				this.RealizeAutosuggest(this.Prompt, false, this.Color.Prompt)
-			} else {
+			} else if data[0] == '\t' {
 				// no last autosuggest found, just forward the tab
-				this.ParentOut.Write(data)
+				this.ParentOut.Write(data[:length])
 			}
 
-			return data[1:]
+			return data[length:]
+
+		} else if action == keyActionVoicePrompt {
+			// speak the rest of the prompt
+			this.StartVoicePrompt()
+			return data[length:]
 
-		} else if data[0] == 0x03 { // Ctrl-C
+		} else if action == keyActionInterrupt { // Ctrl-C by default
 			if this.PromptResponseCancel != nil {
 				this.PromptResponseCancel()
 				this.PromptResponseCancel = nil
@@ -1141,7 +1457,7 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			this.ParentOut.Write(toPrint)
 			this.ParentOut.Write([]byte(this.Color.Command))
 			this.setState(stateNormal)
-			return data[1:]
+			return data[length:]
 
 		} else { // otherwise user is typing a prompt
 			toPrint := this.Prompt.Write(string(data))
@@ -1155,15 +1471,33 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 		}
 
 	case stateShell:
+		action, length, partial := this.KeyBindings.Match(data)
+		if partial {
+			// wait for the rest of the chord
+			return data
+		}
+
 		if hasCarriageReturn { // user is submitting a command
 			this.ClearAutosuggest(this.Color.Command)
 
 			this.setState(stateNormal)
 
 			index := bytes.Index(data, []byte{'\r'})
+			this.checkpointAcceptedGoalCommand()
 			this.ChildIn.Write(data[:index+1])
+			private := this.PrivateEnabled ||
+				isPrivateCommand(this.Butterfish.Config.ShellPrivateCommands, this.Command.String())
+			this.History.SetPrivate(private)
+			if this.Butterfish.Config.ShellLearnFixes && !private && this.REPL == nil {
+				this.WatchFix(this.Command.String())
+			}
 			this.History.Append(historyTypeShellInput, this.Command.String())
+			this.CheckRemoteCommand(this.Command.String())
 			this.Command = NewShellBuffer()
+			// a line in a REPL isn't a command, it's done at the next REPL prompt
+			this.CommandPending = !private && this.REPL == nil && (this.AnnotateEnabled || this.Butterfish.Config.ShellRecordHistory ||
+				this.Butterfish.Config.ShellSummarizeAfter > 0 || this.Butterfish.Config.ShellLearnFixes)
+			this.CommandStart = time.Now()
 
 			if this.AutosuggestCancel != nil {
 				// We'll likely have a pending autosuggest in the background, cancel it
@@ -1172,28 +1506,30 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 
 			return data[index+1:]
 
-		} else if data[0] == 0x03 { // Ctrl-C
+		} else if action == keyActionInterrupt { // Ctrl-C by default
 			this.Command.Clear()
+			this.goalModePendingCommand = ""
 			this.setState(stateNormal)
-			this.ChildIn.Write([]byte{data[0]})
+			// the child shell should still see a Ctrl-C so it clears its line
+			this.ChildIn.Write([]byte{0x03})
 
 			if this.AutosuggestCancel != nil {
 				// We'll likely have a pending autosuggest in the background, cancel it
 				this.AutosuggestCancel()
 			}
 
-			return data[1:]
+			return data[length:]
 
-		} else if data[0] == '\t' { // user is asking to fill in an autosuggest
+		} else if action == keyActionAcceptAutosuggest { // user is asking to fill in an autosuggest
 			// Tab was pressed, fill in lastAutosuggest
 			if this.LastAutosuggest != "" {
 				this.RealizeAutosuggest(this.Command, true, this.Color.Command)
 			} else {
-				// no last autosuggest found, just forward the tab
+				// no last autosuggest found, just forward the key
 				this.LastTabPassthrough = time.Now()
-				this.ChildIn.Write([]byte{data[0]})
+				this.ChildIn.Write(data[:length])
 			}
-			return data[1:]
+			return data[length:]
 
 		} else { // otherwise user is typing a command
 			this.Command.Write(string(data))
@@ -1211,6 +1547,44 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 	return nil
 }
 
+// Start a prompt managed here in the wrapper, data is the first input which
+// is either a capital letter or a bang for goal mode.
+func (this *ShellState) StartPrompt(data []byte) {
+	this.setState(statePrompting)
+	this.ClearAutosuggest(this.Color.Command)
+	this.Prompt.Clear()
+	this.Prompt.Write(string(data))
+
+	// Write the actual prompt start
+	color := this.Color.Prompt
+	if data[0] == '!' {
+		color = this.Color.PromptGoal
+	}
+	this.Prompt.SetColor(color)
+	fmt.Fprintf(this.ParentOut, "%s%s", color, data)
+
+	// We're starting a prompt managed here in the wrapper, so we want to
+	// get the cursor position
+	_, col := this.GetCursorPosition()
+	this.Prompt.SetPromptLength(col - 1 - this.Prompt.Size())
+}
+
+func (this *ShellState) ExitGoalMode() {
+	fmt.Fprintf(this.PromptGoalAnswerWriter, "\n%sExited goal mode.%s\n", this.Color.Answer, this.Color.Command)
+	this.GoalMode = false
+	this.goalModePendingCommand = ""
+}
+
+// Forget the shell and LLM history so that it isn't sent as context in
+// future prompts
+func (this *ShellState) ClearContext() {
+	this.History.Clear()
+	this.LastContextTokens = 0
+	fmt.Fprintf(this.ParentOut, "\r\n%sCleared history context.%s", this.Color.Answer, this.Color.Command)
+	// Get a new prompt
+	this.ChildIn.Write([]byte("\n"))
+}
+
 // We want to queue up the prompt response, which does the processing (except
 // for actually printing it). The processing like adding to history or
 // executing the next step in goal mode. We have to do this in a goroutine
@@ -1221,12 +1595,91 @@ func (this *ShellState) SendPromptResponse(data string) {
 	}()
 }
 
+// Format a token count compactly, e.g. 950 or 12.3k
+func formatTokenCount(tokens int) string {
+	if tokens < 1000 {
+		return fmt.Sprintf("%d", tokens)
+	}
+	return fmt.Sprintf("%.1fk", float64(tokens)/1000)
+}
+
+// A one-line summary of the model, the size of the last prompt context, and
+// the session token usage and spend
+func (this *ShellState) StatusLine() string {
+	usage := this.Butterfish.Usage
+	status := fmt.Sprintf("%s | context %s | session %s tokens | %s",
+		this.Butterfish.Config.ShellPromptModel,
+		formatTokenCount(this.LastContextTokens),
+		formatTokenCount(usage.TotalTokens()),
+		usage.CostString())
+	if this.PrivateEnabled {
+		status = "private | " + status
+	}
+	if this.Branches != nil && this.Branches.Current != mainBranch {
+		status = "branch:" + this.Branches.Current + " | " + status
+	}
+	if this.REPL != nil {
+		status = this.REPL.Name + " | " + status
+	}
+	if this.RemoteHost != "" {
+		status = "ssh:" + this.RemoteHost + " | " + status
+	}
+	return status
+}
+
+// Write the status line to the status file and, if enabled, print it below
+// the response.
+func (this *ShellState) UpdateStatusLine() {
+	status := this.StatusLine()
+
+	if this.StatusFile != "" {
+		err := writeStatusFile(this.StatusFile, status)
+		if err != nil {
+			log.Printf("Error writing status file: %s", err)
+		}
+	}
+
+	if this.Butterfish.Config.ShellStatusLine {
+		fmt.Fprintf(this.ParentOut, "%s[%s]%s\r\n",
+			this.Color.Autosuggest, status, this.Color.Command)
+	}
+}
+
+// Overwrite the status file, which createShellStatusFile made, without
+// following a link if one has replaced it
+func writeStatusFile(path, status string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(status + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 func (this *ShellState) PrintStatus() {
 	text := fmt.Sprintf("You're using Butterfish Shell\n%s\n\n", this.Butterfish.Config.BuildInfo)
 
 	if this.GoalMode {
 		text += fmt.Sprintf("You're in Goal mode, the goal you've given to the agent is:\n%s\n\n", this.GoalModeGoal)
 	}
+	if this.RemoteHost != "" {
+		text += fmt.Sprintf("You're connected to the remote host %s with ssh.\n\n", this.RemoteHost)
+	}
+	if this.REPL != nil {
+		text += fmt.Sprintf("You're in a %s REPL, autosuggest predicts %s.\n\n", this.REPL.Name, this.REPL.Language)
+	}
+	if this.PrivateEnabled {
+		text += "Private mode is on, commands and their output are left out of the history.\n\n"
+	}
+	if this.Branches != nil && this.Branches.Current != mainBranch {
+		text += fmt.Sprintf("You're on the conversation branch %s, use !return to go back.\n\n", this.Branches.Current)
+	}
+	if path, config, err := findProjectConfig(shellWorkingDir()); err == nil && config != nil && config.Persona != "" && this.RemoteHost == "" {
+		text += fmt.Sprintf("The persona from %s is added to requests.\n\n", path)
+	}
 
 	text += fmt.Sprintf("Prompting model:       %s\n", this.Butterfish.Config.ShellPromptModel)
 	text += fmt.Sprintf("Prompt history window: %d tokens\n", this.PromptMaxTokens)
@@ -1234,6 +1687,14 @@ func (this *ShellState) PrintStatus() {
 	text += fmt.Sprintf("Autosuggest model:     %s\n", this.Butterfish.Config.ShellAutosuggestModel)
 	text += fmt.Sprintf("Autosuggest timeout:   %s\n", this.Butterfish.Config.ShellAutosuggestTimeout)
 	text += fmt.Sprintf("Autosuggest history:   %d tokens\n", this.AutosuggestMaxTokens)
+	if usage := this.Butterfish.Usage; usage != nil {
+		text += fmt.Sprintf("Session LLM calls:     %d\n", usage.TotalCalls())
+		text += fmt.Sprintf("Session tokens:        %d\n", usage.TotalTokens())
+		text += fmt.Sprintf("Session spend:         %s (estimated)\n", usage.CostString())
+		if budget := this.Butterfish.Budget; budget != nil && budget.Config != nil {
+			text += fmt.Sprintf("Session budget:        soft $%.2f, hard $%.2f (0 is off)\n", budget.Config.SoftLimit, budget.Config.HardLimit)
+		}
+	}
 	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
 	this.SendPromptResponse(text)
 }
@@ -1254,7 +1715,7 @@ func (this *ShellState) PrintHelp() {
 
 func (this *ShellState) PrintHistory() {
 	maxHistoryBlockTokens := this.Butterfish.Config.ShellMaxHistoryBlockTokens
-	historyBlocks, _ := getHistoryBlocksByTokens(this.History, this.getPromptEncoder(),
+	historyBlocks, _ := getHistoryBlocksByTokens(this.History, this.getPromptTokenizer(),
 		maxHistoryBlockTokens, this.PromptMaxTokens, 4)
 	strBuilder := strings.Builder{}
 
@@ -1297,6 +1758,8 @@ func (this *ShellState) GoalModeStart() {
 	this.GoalMode = true
 	fmt.Fprintf(this.PromptGoalAnswerWriter, "%sGoal mode starting...%s\n", this.Color.Answer, this.Color.Command)
 	this.GoalModeGoal = goal
+	this.GoalModeFailures = 0
+	this.GoalModeFailedAttempts = nil
 	this.Prompt.Clear()
 
 	prompt := "Start now."
@@ -1315,20 +1778,131 @@ func (this *ShellState) GoalModeChat() {
 func (this *ShellState) GoalModeFunctionResponse(output string) {
 	log.Printf("Goal mode response: %s\n", output)
 	if output != "" {
-		this.History.AppendFunctionOutput(this.ActiveFunction, output)
+		this.History.AppendToolOutput(this.ActiveToolCallId, this.ActiveFunction, output)
 	}
 	this.ActiveFunction = ""
+	this.ActiveToolCallId = ""
 	this.goalModePrompt("")
 }
 
-func (this *ShellState) GoalModeFunction(output *util.CompletionResponse) {
-	switch output.FunctionName {
-	case "command":
-		log.Printf("Goal mode command: %s", output.FunctionParameters)
+// The number of bytes of output from a failed command that we keep in the
+// list of failed attempts
+const goalModeAttemptOutputBytes = 200
+
+// Build the function response for a goal mode command that has finished.
+// When a command fails we count it against the retry budget and remember it
+// as a failed attempt, the list of failed attempts is sent with each failure
+// so the model doesn't repeat itself even if older history has been
+// truncated. If we run out of retries we exit goal mode.
+func (this *ShellState) GoalModeCommandResult(exitCode int) string {
+	// 130 means the user pressed ctrl-c rather than running the command
+	if !this.GoalModeUnsafe && exitCode != 130 {
+		this.Butterfish.Stats.Record(StatsEvent{Type: statsEventCommandAccepted})
+	}
+
+	status := fmt.Sprintf("Exit Code: %d\n", exitCode)
+	if exitCode == 0 {
+		this.GoalModeFailures = 0
+		return status
+	}
+
+	output := strings.TrimSpace(stripANSI(this.GoalModeBuffer))
+	if len(output) > goalModeAttemptOutputBytes {
+		// start on a rune boundary so we don't split a character
+		start := len(output) - goalModeAttemptOutputBytes
+		for start < len(output) && !utf8.RuneStart(output[start]) {
+			start++
+		}
+		output = "..." + output[start:]
+	}
+	attempt := fmt.Sprintf("%s (exit code %d)", this.GoalModeCommand, exitCode)
+	if output != "" {
+		attempt += ": " + strings.ReplaceAll(output, "\n", " ")
+	}
+	return status + this.GoalModeFailure(attempt)
+}
+
+// Record a failed attempt and return a message for the model listing the
+// attempts so far, exits goal mode if we're out of retries
+func (this *ShellState) GoalModeFailure(attempt string) string {
+	this.GoalModeFailures++
+	this.GoalModeFailedAttempts = append(this.GoalModeFailedAttempts, attempt)
+
+	maxRetries := this.Butterfish.Config.ShellGoalModeMaxRetries
+	if this.GoalModeFailures > maxRetries {
+		fmt.Fprintf(this.PromptGoalAnswerWriter,
+			"%sExited goal mode after %d failed attempts in a row, over to you.%s\n",
+			this.Color.Answer, this.GoalModeFailures, this.Color.Command)
+		this.GoalMode = false
+		this.fireHooks(hookGoalFailed, this.GoalModeCommand,
+			fmt.Sprintf("Gave up after %d failed attempts in a row, the last was %s", this.GoalModeFailures, attempt))
+		return fmt.Sprintf("The command failed and the retry budget of %d is used up, goal mode was stopped.\n", maxRetries)
+	}
+
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "The command failed, this is failure %d of %d allowed in a row. Read the error output, work out the cause, and try a different fix. Don't repeat an attempt that already failed. Attempts that have failed so far:\n",
+		this.GoalModeFailures, maxRetries)
+	for _, attempt := range this.GoalModeFailedAttempts {
+		fmt.Fprintf(&builder, "- %s\n", attempt)
+	}
+	return builder.String()
+}
+
+// Handle the tool calls from a goal mode response. Local tools like
+// read_file are run right away and their output goes straight back to the
+// model. Tools that use the shell or the user can only be called once per
+// response since we wait on them, further calls are skipped.
+func (this *ShellState) GoalModeToolCalls(output *util.CompletionResponse) {
+	if len(output.ToolCalls) == 0 {
+		log.Printf("No function called in goal mode")
+		modelStr := fmt.Sprintf("You must call a function in goal mode responses.")
+		this.History.Append(historyTypePrompt, modelStr)
+		this.GoalModeFunctionResponse("")
+		return
+	}
+
+	var shellCall *util.ToolCall
+	for _, toolCall := range output.ToolCalls {
+		name := toolCall.Function.Name
+		if isLocalTool(name) {
+			log.Printf("Goal mode %s: %s", name, toolCall.Function.Parameters)
+			fmt.Fprintf(this.PromptGoalAnswerWriter, "%s%s %s%s\n",
+				this.Color.GoalMode, name, toolCall.Function.Parameters, this.Color.Command)
+			var result string
+			if this.RemoteHost != "" {
+				// these tools can only see the local machine
+				result = fmt.Sprintf("Error: %s only works on the local machine but the shell is connected to %s, use run_command instead.", name, this.RemoteHost)
+			} else {
+				result = this.Butterfish.RunLocalTool(this.Butterfish.Ctx, toolCall)
+			}
+			this.History.AppendToolOutput(toolCall.Id, name, result)
+		} else if shellCall == nil {
+			shellCall = toolCall
+		} else {
+			this.History.AppendToolOutput(toolCall.Id, name,
+				"Not run, only one of run_command, user_input, or finish can be called at a time.")
+		}
+	}
+
+	if shellCall == nil {
+		// only local tools were called, send their output back
+		this.GoalModeFunctionResponse("")
+		return
+	}
+
+	this.ActiveFunction = shellCall.Function.Name
+	this.ActiveToolCallId = shellCall.Id
+	this.GoalModeFunction(shellCall.Function.Name, shellCall.Function.Parameters)
+}
+
+func (this *ShellState) GoalModeFunction(name, params string) {
+	switch name {
+	case toolRunCommand:
+		log.Printf("Goal mode command: %s", params)
 		this.GoalModeBuffer = ""
 		this.PromptSuffixCounter = 0
 		this.setState(stateNormal)
-		cmd, err := parseCommandParams(output.FunctionParameters)
+		cmd, err := parseCommandParams(params)
 		if err != nil {
 			// we failed to parse the command json, send error back to model
 			log.Printf("Error parsing function arguments: %s", err)
@@ -1337,17 +1911,50 @@ func (this *ShellState) GoalModeFunction(output *util.CompletionResponse) {
 			return
 		}
 		log.Printf("Goal mode command: %s", cmd)
+
+		// Don't bother running a command that we already know fails
+		for _, attempt := range this.GoalModeFailedAttempts {
+			if strings.HasPrefix(attempt, cmd+" (exit code") {
+				log.Printf("Goal mode repeated failed command: %s", cmd)
+				modelStr := "You already tried this exact command and it failed, it was not run again. " +
+					this.GoalModeFailure(cmd+" (repeated, not run)")
+				if this.GoalMode {
+					this.GoalModeFunctionResponse(modelStr)
+				} else {
+					this.History.AppendToolOutput(this.ActiveToolCallId, this.ActiveFunction, modelStr)
+				}
+				return
+			}
+		}
+
+		this.GoalModeCommand = cmd
+		if this.GoalModeUnsafe {
+			this.CheckpointGoalCommand(cmd)
+		} else {
+			// checkpointed once the user runs it
+			this.goalModePendingCommand = cmd
+			this.fireHooks(hookGoalConfirm, cmd, "Run this command? "+cmd)
+		}
+		if this.ExplainFirstEnabled && !this.GoalModeUnsafe {
+			// the command is typed once it's explained
+			this.PreviewGoalModeCommand(cmd)
+			return
+		}
 		fmt.Fprintf(this.ChildIn, "%s", cmd)
 		if this.GoalModeUnsafe {
 			fmt.Fprintf(this.ChildIn, "\n")
+		} else {
+			// the user decides whether to run the command, see
+			// GoalModeCommandResult
+			this.Butterfish.Stats.Record(StatsEvent{Type: statsEventCommandGenerated})
 		}
 
-	case "user_input":
-		log.Printf("Goal mode user_input: %s", output.FunctionParameters)
+	case toolUserInput:
+		log.Printf("Goal mode user_input: %s", params)
 		this.GoalModeBuffer = ""
 		this.PromptSuffixCounter = -999999
 		this.setState(stateNormal)
-		question, err := parseUserInputParams(output.FunctionParameters)
+		question, err := parseUserInputParams(params)
 		if err != nil {
 			log.Printf("Error parsing function arguments: %s", err)
 			modelStr := fmt.Sprintf("Error parsing your json, try again: %s", err)
@@ -1355,103 +1962,62 @@ func (this *ShellState) GoalModeFunction(output *util.CompletionResponse) {
 			return
 		}
 
+		// the user's answer comes as a prompt, the tool call still needs output
+		this.History.AppendToolOutput(this.ActiveToolCallId, this.ActiveFunction,
+			"The question was shown to the user, their answer follows.")
+		this.ActiveFunction = ""
+		this.ActiveToolCallId = ""
 		fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s\n", this.Color.Answer, question, this.Color.Command)
+		this.fireHooks(hookGoalConfirm, "", question)
 
-	case "finish":
-		log.Printf("Goal mode finishing: %s", output.FunctionParameters)
+	case toolFinish:
+		log.Printf("Goal mode finishing: %s", params)
 		this.GoalModeBuffer = ""
 		this.setState(stateNormal)
-		success, err := parseFinishParams(output.FunctionParameters)
+		success, err := parseFinishParams(params)
 		if err != nil {
 			log.Printf("Error parsing function arguments: %s", err)
 			modelStr := fmt.Sprintf("Error parsing your json, try again: %s", err)
-			this.History.AppendFunctionOutput(output.FunctionName, modelStr)
 			this.GoalModeFunctionResponse(modelStr)
 			return
 		}
 
 		result := "SUCCESS"
+		event := hookGoalComplete
 		if !success {
 			result = "FAILURE"
+			event = hookGoalFailed
 		}
 
+		this.History.AppendToolOutput(this.ActiveToolCallId, this.ActiveFunction,
+			fmt.Sprintf("Exited goal mode with %s.", result))
+		this.ActiveFunction = ""
+		this.ActiveToolCallId = ""
 		fmt.Fprintf(this.PromptGoalAnswerWriter, "%sExited goal mode with %s.%s\n", this.Color.Answer, result, this.Color.Command)
 		this.GoalMode = false
-
-	case "":
-		log.Printf("No function called in goal mode")
-		modelStr := fmt.Sprintf("You must call a function in goal mode responses.")
-		this.History.Append(historyTypePrompt, modelStr)
-		this.GoalModeFunctionResponse("")
+		this.fireHooks(event, "", "Exited goal mode with "+result+".")
 
 	default:
-		log.Printf("Invalid function name called in goal mode: %s", output.FunctionName)
-		modelStr := fmt.Sprintf("Invalid function name: %s", output.FunctionName)
+		log.Printf("Invalid function name called in goal mode: %s", name)
+		modelStr := fmt.Sprintf("Invalid function name: %s", name)
 		this.GoalModeFunctionResponse(modelStr)
 
 	}
 }
 
-var goalModeFunctions = []util.FunctionDefinition{
-	{
-		Name:        "command",
-		Description: "Run a command in the shell to help achieve your goal",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"cmd": {
-					Type:        jsonschema.String,
-					Description: "The string command including any arguments, for example 'ls ~'",
-				},
-			},
-			Required: []string{"cmd"},
-		},
-	},
-
-	{
-		Name:        "user_input",
-		Description: "Resolve an ambiguity in the goal or provide additional information or hand off a goal that can't be accomplished to the user.",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"question": {
-					Type:        jsonschema.String,
-					Description: "The question to ask the user",
-				},
-			},
-			Required: []string{"question"},
-		},
-	},
-
-	{
-		Name:        "finish",
-		Description: "Finish the goal and exit goal mode, call only if the goal is accomplished or multiple strategies have been attempted and the goal is impossible.",
-		Parameters: jsonschema.Definition{
-			Type: jsonschema.Object,
-			Properties: map[string]jsonschema.Definition{
-				"success": {
-					Type:        jsonschema.Boolean,
-					Description: "Whether the goal was accomplished",
-				},
-			},
-			Required: []string{"success"},
-		},
-	},
-}
-
-var goalModeFunctionsString string
-
-// serialize goalModeFunctions to json and cache in goalModeFunctionsString
-func getGoalModeFunctionsString() string {
-	if goalModeFunctionsString == "" {
-		bytes, err := json.Marshal(goalModeFunctions)
+var goalModeToolsString string
+
+// serialize goalModeTools to json and cache in goalModeToolsString
+func getGoalModeToolsString() string {
+	if goalModeToolsString == "" {
+		bytes, err := json.Marshal(goalModeTools)
 		if err != nil {
 			log.Fatal(err)
 		}
-		goalModeFunctionsString = string(bytes)
-		log.Printf("goalModeFunctionsString: %s", goalModeFunctionsString)
+		goalModeToolsString = string(bytes)
+		log.Printf("goalModeToolsString: %s", goalModeToolsString)
 	}
-	return goalModeFunctionsString
+	return goalModeToolsString
 }
 
 func (this *ShellState) goalModePrompt(lastPrompt string) {
@@ -1459,10 +2025,9 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 	requestCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	this.PromptResponseCancel = cancel
 
-	sysMsg, err := this.Butterfish.PromptLibrary.GetPrompt(
+	sysMsg, err := this.GetSystemMessage(
 		prompt.GoalModeSystemMessage,
-		"goal", this.GoalModeGoal,
-		"sysinfo", GetSystemInfo())
+		"goal", this.GoalModeGoal)
 	if err != nil {
 		msg := fmt.Errorf("ERROR: could not retrieve prompting system message: %s", err)
 		log.Println(msg)
@@ -1470,8 +2035,10 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 		return
 	}
 
+	sysMsg += pinsSystemNote(this.Pins)
+
 	tokensForAnswer := 1024
-	lastPrompt, historyBlocks, err := this.AssembleChat(lastPrompt, sysMsg, getGoalModeFunctionsString(), tokensForAnswer)
+	lastPrompt, historyBlocks, err := this.AssembleChat(lastPrompt, sysMsg, getGoalModeToolsString(), tokensForAnswer)
 	if err != nil {
 		this.PrintError(err)
 		return
@@ -1485,7 +2052,9 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 		Temperature:   0.6,
 		HistoryBlocks: historyBlocks,
 		SystemMessage: sysMsg,
-		Functions:     goalModeFunctions,
+		Tools:         goalModeTools,
+		Task:          TaskGoalMode,
+		PromptName:    prompt.GoalModeSystemMessage,
 		Verbose:       this.Butterfish.Config.Verbose > 0,
 	}
 
@@ -1514,22 +2083,181 @@ func (this *ShellState) HandleLocalPrompt() bool {
 	return true
 }
 
-// Given an encoder, a string, and a maximum number of takens, we count the
-// number of tokens in the string and truncate to the max tokens if the would
-// exceed it. Returns the number of tokens, the truncated string, and a bool
-// indicating whether the string was truncated.
-func countAndTruncate(data string,
-	encoder *tiktoken.Tiktoken,
-	maxTokens int) (int, string, bool) {
-	tokens := encoder.Encode(data, nil, nil)
-	truncated := false
-	if len(tokens) >= maxTokens {
-		tokens = tokens[:maxTokens]
-		data = encoder.Decode(tokens)
-		truncated = true
+// Handle butterfish commands that start with a bang, like "!pane", rather
+// than treating them as goals. Commands are lowercase so that goals, which
+// usually start with a capital, don't collide. Returns true if the input was
+// a command.
+func (this *ShellState) HandleBangCommand(input string) bool {
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		return false
+	}
+
+	args := fields[1:]
+	switch fields[0] {
+	case "pane":
+		this.AddTmuxPaneContext(args)
+	case "fetch":
+		this.FetchURLContext(args)
+	case "explain":
+		this.ExplainCommand(strings.Join(args, " "))
+	case "breakdown":
+		this.BreakdownCommand(strings.Join(args, " "))
+	case "export":
+		this.ExportTranscript(strings.Join(args, " "))
+	case "annotate":
+		this.ToggleAnnotate(args)
+	case "pipe":
+		this.PipelineCommand(args)
+	case "explainfirst":
+		this.ToggleExplainFirst(args)
+	case "private":
+		this.TogglePrivate(args)
+	case "speak":
+		this.ToggleSpeak(args)
+	case "budget":
+		this.BudgetCommand(args)
+	case "pin":
+		this.PinCommand(args)
+	case "pins":
+		this.PinsCommand(args)
+	case "fork", "switch", "return", "merge", "branches":
+		this.BranchCommand(fields[0], args)
+	case "reload":
+		this.ReloadConfig()
+	default:
+		return false
+	}
+
+	this.Prompt.Clear()
+	return true
+}
+
+// Explain a shell command using its local man page or --help output. If
+// command is empty we explain the last command run in the shell.
+func (this *ShellState) ExplainCommand(command string) {
+	if command == "" {
+		this.History.IterateBlocks(func(block *HistoryBuffer) bool {
+			if block.Type == historyTypeShellInput {
+				command = strings.TrimSpace(block.Content.String())
+			}
+			return command == ""
+		})
+	}
+	if command == "" {
+		fmt.Fprintf(this.ParentOut, "%sNo command to explain.%s\r\n", this.Color.Answer, this.Color.Command)
+		this.SendPromptResponse("")
+		return
+	}
+
+	this.setState(statePromptResponse)
+	requestCtx, cancel := context.WithCancel(context.Background())
+	this.PromptResponseCancel = cancel
+	this.History.Append(historyTypePrompt, "Explain "+command)
+
+	// looking up docs can be slow so we do it in the goroutine
+	bf := this.Butterfish.snapshot()
+	go func() {
+		promptStr, err := bf.explainPrompt(requestCtx, command)
+		if err != nil {
+			fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s\n", this.Color.Error, err, this.Color.Command)
+			this.PromptOutputChan <- &util.CompletionResponse{}
+			return
+		}
+
+		request := &util.CompletionRequest{
+			Ctx:           requestCtx,
+			Prompt:        promptStr,
+			Model:         bf.Config.ShellPromptModel,
+			MaxTokens:     bf.Config.ShellMaxResponseTokens,
+			Temperature:   0.3,
+			SystemMessage: "You are an assistant that explains Unix shell commands.",
+			Verbose:       bf.Config.Verbose > 0,
+			Task:          TaskExplain,
+			PromptName:    prompt.PromptExplainCommand,
+			TokenTimeout:  bf.Config.TokenTimeout,
+		}
+
+		CompletionRoutine(request, bf.LLMClient,
+			this.PromptAnswerWriter, this.PromptOutputChan,
+			this.Color.Answer, this.Color.Error, this.StyleWriter)
+	}()
+}
+
+// Add a tmux pane's contents to the history so that it's sent as context with
+// the next prompt
+func (this *ShellState) AddTmuxPaneContext(args []string) {
+	target := ""
+	if len(args) > 0 {
+		target = args[0]
+	}
+
+	var text string
+	if !InTmux() {
+		text = "Not running inside tmux.\n"
+	} else {
+		content, target, err := CaptureTmuxPane(target)
+		if err != nil {
+			text = fmt.Sprintf("Could not capture tmux pane: %s\n", err)
+		} else {
+			this.History.Append(historyTypeShellOutput,
+				fmt.Sprintf("Contents of tmux pane %s:\n%s\n", target, content))
+			text = fmt.Sprintf("Added %d lines from tmux pane %s to context.\n",
+				strings.Count(content, "\n")+1, target)
+		}
 	}
 
-	return len(tokens), data, truncated
+	fmt.Fprintf(this.ParentOut, "%s%s%s", this.Color.Answer,
+		strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+	this.SendPromptResponse("")
+}
+
+// Web pages added with !fetch are chunked like `butterfish index add-url`
+// with its default flags
+const (
+	fetchChunkSize = 512
+	fetchMaxChunks = 256
+)
+
+// Download a web page and add its text to the history so that it's sent as
+// context with the next prompt. The page is also added to the index of the
+// current project, so it can be found by later searches.
+func (this *ShellState) FetchURLContext(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(this.ParentOut, "%sUsage: !fetch <url>%s\r\n", this.Color.Answer, this.Color.Command)
+		this.SendPromptResponse("")
+		return
+	}
+	pageURL := args[0]
+
+	this.setState(statePromptResponse)
+	requestCtx, cancel := context.WithCancel(context.Background())
+	this.PromptResponseCancel = cancel
+
+	// downloading and embedding can be slow so we do it in the goroutine
+	bf := this.Butterfish.snapshot()
+	go func() {
+		dir := projectRoot(requestCtx, shellWorkingDir())
+		doc, err := bf.cachedIndex(dir).IndexURL(requestCtx, dir, pageURL,
+			fetchChunkSize, fetchMaxChunks)
+
+		var text string
+		if err != nil {
+			text = fmt.Sprintf("Could not fetch %s: %s\n", pageURL, err)
+		} else {
+			source := pageURL
+			if doc.Title != "" {
+				source = fmt.Sprintf("%s (%s)", doc.Title, pageURL)
+			}
+			this.History.Append(historyTypeShellOutput,
+				fmt.Sprintf("Contents of web page %s:\n%s\n", source, doc.Text))
+			text = fmt.Sprintf("Added %s to context and to the index in %s.\n", source, dir)
+		}
+
+		fmt.Fprintf(this.ParentOut, "%s%s%s", this.Color.Answer,
+			strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+		this.PromptOutputChan <- &util.CompletionResponse{}
+	}()
 }
 
 // Prepare to call assembleChat() based on the ShellState variables for
@@ -1543,8 +2271,15 @@ func (this *ShellState) AssembleChat(prompt, sysMsg, functions string, reserveFo
 	// How much for the total request (prompt, history, sys msg)
 	maxCombinedPromptTokens := totalTokens - reserveForAnswer
 
+	tokenizer := this.getPromptTokenizer()
+	// compress long history blocks rather than cutting them off
+	if compression := this.Butterfish.Config.Compression; compression != nil && compression.HistoryTokens > 0 {
+		maxHistoryBlockTokens = compression.HistoryTokens
+		tokenizer = &CompressingTokenizer{Tokenizer: tokenizer}
+	}
+
 	return assembleChat(prompt, sysMsg, functions, this.History,
-		this.Butterfish.Config.ShellPromptModel, this.getPromptEncoder(),
+		this.Butterfish.Config.ShellPromptModel, tokenizer,
 		maxPromptTokens, maxHistoryBlockTokens, maxCombinedPromptTokens)
 }
 
@@ -1557,7 +2292,7 @@ func assembleChat(
 	functions string,
 	history *ShellHistory,
 	model string,
-	encoder *tiktoken.Tiktoken,
+	tokenizer Tokenizer,
 	maxPromptTokens int,
 	maxHistoryBlockTokens int,
 	maxTokens int,
@@ -1569,37 +2304,37 @@ func assembleChat(
 	usedTokens := 3
 
 	// account for prompt
-	numPromptTokens, prompt, truncated := countAndTruncate(prompt, encoder, maxPromptTokens)
+	numPromptTokens, prompt, truncated := tokenizer.Truncate(prompt, maxPromptTokens)
 	if truncated {
 		log.Printf("WARNING: truncated the prompt to %d tokens", numPromptTokens)
 	}
 	usedTokens += numPromptTokens
 
 	// account for system message
-	sysMsgTokens := encoder.Encode(sysMsg, nil, nil)
-	if len(sysMsgTokens) > 1028 {
+	sysMsgTokens := tokenizer.CountTokens(sysMsg)
+	if sysMsgTokens > 1028 {
 		log.Printf("WARNING: the system message is very long, this may cause you to hit the token limit. Recommend you reduce the size in prompts.yaml")
 	}
 
-	usedTokens += usedTokens + len(sysMsgTokens)
+	usedTokens += usedTokens + sysMsgTokens
 	if usedTokens > maxTokens {
 		return "", nil, fmt.Errorf("System message too long, %d tokens, max is %d", usedTokens, maxTokens)
 	}
 
 	// account for functions
-	functionTokens := encoder.Encode(functions, nil, nil)
-	if len(functionTokens) > 1028 {
+	functionTokens := tokenizer.CountTokens(functions)
+	if functionTokens > 1028 {
 		log.Printf("WARNING: the functions are very long and are taking up %d tokens. This may cause you to hit the token limit.", functionTokens)
 	}
 
-	usedTokens += usedTokens + len(functionTokens)
+	usedTokens += usedTokens + functionTokens
 	if usedTokens > maxTokens {
 		return "", nil, fmt.Errorf("System message plus functions too long, %d tokens, max is %d", usedTokens, maxTokens)
 	}
 
 	blocks, historyTokens := getHistoryBlocksByTokens(
 		history,
-		encoder,
+		tokenizer,
 		maxHistoryBlockTokens,
 		maxTokens-usedTokens,
 		tokensPerMessage)
@@ -1609,7 +2344,7 @@ func assembleChat(
 		panic("Too many tokens, this should not happen")
 	}
 
-	return prompt, blocks, nil
+	return prompt, pairToolOutputs(blocks), nil
 }
 
 // Iterate through a history and build a list of HistoryBlocks up until the
@@ -1619,7 +2354,7 @@ func assembleChat(
 // We return the history blocks and the number of tokens it uses.
 func getHistoryBlocksByTokens(
 	history *ShellHistory,
-	encoder *tiktoken.Tiktoken,
+	tokenizer Tokenizer,
 	maxHistoryBlockTokens,
 	maxTokens,
 	tokensPerMessage int,
@@ -1629,7 +2364,7 @@ func getHistoryBlocksByTokens(
 	usedTokens := 0
 
 	history.IterateBlocks(func(block *HistoryBuffer) bool {
-		if block.Content.Size() == 0 && block.FunctionName == "" {
+		if block.Content.Size() == 0 && block.FunctionName == "" && block.ToolCalls == nil {
 			// empty block, skip
 			return true
 		}
@@ -1637,38 +2372,58 @@ func getHistoryBlocksByTokens(
 		roleString := ShellHistoryTypeToRole(block.Type)
 
 		// add tokens for role
-		msgTokens += len(encoder.Encode(roleString, nil, nil))
+		msgTokens += tokenizer.CountTokens(roleString)
 
 		if block.FunctionName != "" {
 			// add tokens for function name
-			msgTokens += len(encoder.Encode(block.FunctionName, nil, nil))
+			msgTokens += tokenizer.CountTokens(block.FunctionName)
 		}
 		if block.FunctionParams != "" {
 			// add tokens for function params
-			msgTokens += len(encoder.Encode(block.FunctionParams, nil, nil))
+			msgTokens += tokenizer.CountTokens(block.FunctionParams)
+		}
+		for _, toolCall := range block.ToolCalls {
+			// add tokens for tool call name and params
+			msgTokens += tokenizer.CountTokens(toolCall.Function.Name)
+			msgTokens += tokenizer.CountTokens(toolCall.Function.Parameters)
 		}
 
 		// check existing block tokenizations
 		contentLen := block.Content.Size()
-		content, contentTokens, ok := block.GetTokenization(encoder.EncoderName(), contentLen)
+		content, contentTokens, ok := block.GetTokenization(tokenizer.Name(), contentLen)
 
 		if !ok { // cache miss
 			contentStr := block.Content.String()
-			// avoid processing super long strings with a ceiling
+			// avoid processing super long strings with a ceiling, output is
+			// allowed more since denoising can shrink it a lot
 			ceiling := maxHistoryBlockTokens * 4
-			if contentLen > ceiling {
-				contentStr = contentStr[:ceiling]
+			if contentLen > ceiling*denoiseCeilingFactor {
+				contentStr = contentStr[:ceiling*denoiseCeilingFactor]
 			}
 
-			// remove ANSI escape codes
-			historyContent := sanitizeTTYString(contentStr)
+			// remove ANSI escape codes and terminal noise, see denoise.go
+			historyContent := denoiseHistoryContent(block.Type, contentStr)
+			// keep the informative lines of long blocks, see compression.go,
+			// this looks at the whole block so comes before the ceiling
+			if compressor, ok := tokenizer.(*CompressingTokenizer); ok {
+				historyContent = compressor.Compress(historyContent, maxHistoryBlockTokens)
+			} else if len(historyContent) > ceiling {
+				historyContent = historyContent[:ceiling]
+			}
 			// encode and truncate
-			contentTokens, content, _ = countAndTruncate(historyContent, encoder, maxHistoryBlockTokens)
+			contentTokens, content, _ = tokenizer.Truncate(historyContent, maxHistoryBlockTokens)
 			// save truncated string
-			block.SetTokenization(encoder.EncoderName(), contentLen, contentTokens, content)
+			block.SetTokenization(tokenizer.Name(), contentLen, contentTokens, content)
 		}
 		msgTokens += contentTokens
 
+		// tag shell activity from an ssh session with the host
+		if block.Host != "" && (block.Type == historyTypeShellInput || block.Type == historyTypeShellOutput) {
+			tag := fmt.Sprintf("[on remote host %s]\n", block.Host)
+			msgTokens += tokenizer.CountTokens(tag)
+			content = tag + content
+		}
+
 		if usedTokens+msgTokens > maxTokens {
 			// we're done adding blocks
 			return false
@@ -1680,6 +2435,8 @@ func getHistoryBlocksByTokens(
 			Content:        content,
 			FunctionName:   block.FunctionName,
 			FunctionParams: block.FunctionParams,
+			ToolCalls:      block.ToolCalls,
+			ToolCallId:     block.ToolCallId,
 		}
 
 		// we prepend the block so that the history is in the correct order
@@ -1690,23 +2447,104 @@ func getHistoryBlocksByTokens(
 	return blocks, usedTokens
 }
 
+// The chat API requires that each tool call is answered by a tool message
+// directly after the assistant message that made the call. Our history can
+// have shell input or prompts interleaved with tool output, be truncated
+// before the call, or have a call that never got output (e.g. the user
+// interrupted goal mode), so we reorder tool output to follow its call, merge
+// output split across blocks, fill in missing output, and drop orphans.
+func pairToolOutputs(blocks []util.HistoryBlock) []util.HistoryBlock {
+	result := []util.HistoryBlock{}
+
+	for i, block := range blocks {
+		if block.Type == historyTypeToolOutput {
+			// output is added right after its call below, anything left over
+			// has no call in the history
+			continue
+		}
+
+		result = append(result, block)
+
+		for _, toolCall := range block.ToolCalls {
+			output := util.HistoryBlock{
+				Type:         historyTypeToolOutput,
+				FunctionName: toolCall.Function.Name,
+				ToolCallId:   toolCall.Id,
+			}
+			for _, later := range blocks[i+1:] {
+				if later.Type == historyTypeToolOutput && later.ToolCallId == toolCall.Id {
+					output.Content += later.Content
+				}
+			}
+			if output.Content == "" {
+				output.Content = "(no output)"
+			}
+			result = append(result, output)
+		}
+	}
+
+	return result
+}
+
+// Remember the exit code of a command for the {ctx_exit_codes} field
+func (this *ShellState) AddExitCode(code int) {
+	this.RecentExitCodes = append(this.RecentExitCodes, code)
+	if len(this.RecentExitCodes) > contextMaxExitCodes {
+		this.RecentExitCodes = this.RecentExitCodes[1:]
+	}
+}
+
+// Fetch a system message with automatic fields filled in, {cwd} is the
+// child shell's working directory rather than ours
+func (this *ShellState) contextEnv() *ContextEnv {
+	env := NewContextEnv(this.Butterfish.Ctx, this.Butterfish.shellName(), shellWorkingDir)
+	env.ExitCodes = append([]int{}, this.RecentExitCodes...)
+	env.RemoteHost = this.RemoteHost
+	env.ShellProfile = this.ShellProfile()
+	env.EnvContext = this.Butterfish.Config.EnvContext
+	return env
+}
+
+// Fetch a prompt with automatic fields filled in as they are for the shell's
+// system messages
+func (this *ShellState) GetPrompt(name string, args ...string) (string, error) {
+	return this.Butterfish.getPrompt(name, this.contextEnv, args...)
+}
+
+func (this *ShellState) GetSystemMessage(name string, args ...string) (string, error) {
+	sysMsg, err := this.Butterfish.systemMessage(name, this.contextEnv(), args...)
+	if err != nil {
+		return "", err
+	}
+	if this.RemoteHost != "" {
+		sysMsg += remoteSystemNote(this.RemoteHost)
+	}
+	if this.REPL != nil {
+		sysMsg += replSystemNote(this.REPL)
+	}
+	return sysMsg, nil
+}
+
 func (this *ShellState) SendPrompt() {
 	this.setState(statePromptResponse)
 
 	requestCtx, cancel := context.WithCancel(context.Background())
 	this.PromptResponseCancel = cancel
 
-	sysMsg, err := this.Butterfish.PromptLibrary.GetPrompt(
-		prompt.ShellSystemMessage, "sysinfo", GetSystemInfo())
+	sysMsg, err := this.GetSystemMessage(prompt.ShellSystemMessage)
 	if err != nil {
 		msg := fmt.Errorf("Could not retrieve prompting system message: %s", err)
 		this.PrintError(msg)
 		return
 	}
 
-	prompt := this.Prompt.String()
+	promptStr := this.Prompt.String()
+	if !this.Butterfish.Config.ShellNoKeywordContext {
+		sysMsg += keywordContextFor(promptStr, sysMsg, this.contextEnv())
+	}
+	sysMsg += pinsSystemNote(this.Pins)
 	tokensReservedForAnswer := this.Butterfish.Config.ShellMaxResponseTokens
-	prompt, historyBlocks, err := this.AssembleChat(prompt, sysMsg, "", tokensReservedForAnswer)
+	promptStr, historyBlocks, err := this.AssembleChat(promptStr, sysMsg, "", tokensReservedForAnswer)
 	if err != nil {
 		this.PrintError(err)
 		return
@@ -1714,18 +2552,28 @@ func (this *ShellState) SendPrompt() {
 
 	request := &util.CompletionRequest{
 		Ctx:           requestCtx,
-		Prompt:        prompt,
+		Prompt:        promptStr,
 		Model:         this.Butterfish.Config.ShellPromptModel,
 		MaxTokens:     tokensReservedForAnswer,
-		Temperature:   0.7,
+		Temperature:   this.Butterfish.Config.ShellTemperature,
 		HistoryBlocks: historyBlocks,
 		SystemMessage: sysMsg,
 		Verbose:       this.Butterfish.Config.Verbose > 0,
+		Task:          TaskShellPrompt,
+		PromptName:    prompt.ShellSystemMessage,
 		TokenTimeout:  this.Butterfish.Config.TokenTimeout,
 	}
 
 	this.History.Append(historyTypePrompt, this.Prompt.String())
 
+	if this.Tmux != nil {
+		// the answer pane doesn't show the prompt, so add it as a header
+		fmt.Fprintf(this.PromptAnswerWriter, "\n%s> %s%s\n\n",
+			this.Color.Prompt, this.Prompt.String(), this.Color.Command)
+	} else if this.Terminal != nil {
+		this.Terminal.AnswerStart()
+	}
+
 	// we run this in a goroutine so that we can still receive input
 	// like Ctrl-C while waiting for the response
 	go CompletionRoutine(request, this.Butterfish.LLMClient,
@@ -1747,18 +2595,23 @@ func CompletionRoutine(
 	writer.Write([]byte(normalColor))
 	output, err := client.CompletionStream(request, writer)
 
-	// handle any completion errors
+	// handle any completion errors, a cancelled context means the user
+	// interrupted the response so we don't print an error
+	canceled := err != nil && strings.Contains(err.Error(), "context canceled")
 	if err != nil {
 		errStr := fmt.Sprintf("Error prompting LLM: %s\n", err)
 
 		log.Printf("%s", errStr)
 
-		if !strings.Contains(errStr, "context canceled") {
+		if !canceled {
 			fmt.Fprintf(writer, "%s%s", errorColor, errStr)
 		}
 	}
 
-	if output == nil && err != nil {
+	if output == nil && canceled {
+		// cancelled before we got any output, there's nothing to keep
+		output = &util.CompletionResponse{Truncated: true}
+	} else if output == nil && err != nil {
 		output = &util.CompletionResponse{Completion: err.Error()}
 	}
 
@@ -1800,6 +2653,10 @@ func (this *ShellState) RealizeAutosuggest(buffer *ShellBuffer, sendToChild bool
 	// Write the autosuggest
 	fmt.Fprintf(writer, "%s", this.LastAutosuggest)
 	buffer.Write(this.LastAutosuggest)
+	this.Butterfish.Stats.Record(StatsEvent{Type: statsEventAutosuggestAccepted})
+	if sendToChild {
+		this.CommandFromSuggestion = true
+	}
 
 	// clear the autosuggest now that we've used it
 	this.LastAutosuggest = ""
@@ -1818,46 +2675,36 @@ func (this *ShellState) ShowAutosuggest(
 		return
 	}
 
-	// if suggestion starts with "prediction: " remove that
-	// this is a dumb artifact of autosuggest few-shot learning
-	const predictionPrefix = "prediction: "
-	if strings.HasPrefix(suggestion, predictionPrefix) {
-		suggestion = suggestion[len(predictionPrefix):]
-	}
-
-	//log.Printf("ShowAutosuggest: %s", result.Suggestion)
-
-	if result.Command != buffer.String() {
-		// this is an old result, it doesn't match the current command/prompt buffer
-		log.Printf("Autosuggest result is old, ignoring. Expected: %s, got: %s", buffer.String(), result.Command)
-		// TODO we can check the prefix and try to continue in this case
-		return
-	}
+	suggestion = strings.TrimPrefix(suggestion, autosuggestPredictionPrefix)
 
-	if suggestion == this.LastAutosuggest {
-		// if the suggestion is the same as the last one, ignore it
-		return
+	// if the suggestion is multiple lines grab the first one
+	if strings.Contains(suggestion, "\n") {
+		suggestion = strings.Split(suggestion, "\n")[0]
 	}
 
-	if suggestion == strings.TrimSpace(buffer.String()) {
+	current := buffer.String()
+	if suggestion == strings.TrimSpace(current) {
 		// if the suggestion is the same as the command, ignore it
 		return
 	}
 
-	// if the suggestion is multiple lines grab the first one
-	if strings.Contains(suggestion, "\n") {
-		suggestion = strings.Split(suggestion, "\n")[0]
+	// The result can be for an earlier buffer if the user kept typing while
+	// the request finished, see RequestAutosuggest. The prefix strategy is
+	// required for commands.
+	suggestion, ok := autosuggestRemainder(result.Command, suggestion, current, this.State == stateShell)
+	if !ok {
+		// ask again unless there's already a newer request
+		pending := this.PendingAutosuggest
+		if result.Command != current && (pending == nil || pending.Command == result.Command) {
+			log.Printf("Autosuggest for %q doesn't match %q, requesting again", result.Command, current)
+			this.RequestAutosuggest(0, current)
+		}
+		return
 	}
 
-	if result.Command != "" {
-		if strings.HasPrefix(
-			strings.ToLower(suggestion), strings.ToLower(result.Command)) {
-			// if the suggestion starts with the original command, remove original text
-			suggestion = suggestion[len(result.Command):]
-		} else if this.State == stateShell {
-			// the prefix strategy is required for commands
-			return
-		}
+	if suggestion == "" || suggestion == this.LastAutosuggest {
+		// if the suggestion is the same as the last one, ignore it
+		return
 	}
 
 	// Print out autocomplete suggestion
@@ -1876,6 +2723,7 @@ func (this *ShellState) ShowAutosuggest(
 		suggestion, jumpForward, this.Color.Autosuggest)
 
 	this.ParentOut.Write([]byte(buf))
+	this.Butterfish.Stats.Record(StatsEvent{Type: statsEventAutosuggestShown})
 }
 
 // Update autosuggest when we receive new data.
@@ -1918,40 +2766,18 @@ func (this *ShellState) ClearAutosuggest(colorStr string) {
 	this.AutosuggestBuffer = nil
 }
 
-func (this *ShellState) getAutosuggestEncoder() *tiktoken.Tiktoken {
-	if this.AutosuggestEncoder == nil {
-		modelName := this.Butterfish.Config.ShellAutosuggestModel
-		encoder, err := tiktoken.EncodingForModel(modelName)
-		if err != nil {
-			log.Printf("Warning: Error getting encoder for autosuggest model %s: %s", modelName, err)
-			encoder, err = tiktoken.EncodingForModel(DEFAULT_AUTOSUGGEST_ENCODER)
-			if err != nil {
-				panic(fmt.Sprintf("Error getting encoder for fallback autosuggest model %s: %s", modelName, err))
-			}
-		}
-
-		this.AutosuggestEncoder = encoder
+func (this *ShellState) getAutosuggestTokenizer() Tokenizer {
+	if this.AutosuggestTokenizer == nil {
+		this.AutosuggestTokenizer = TokenizerForModel(this.Butterfish.Config.ShellAutosuggestModel)
 	}
-
-	return this.AutosuggestEncoder
+	return this.AutosuggestTokenizer
 }
 
-func (this *ShellState) getPromptEncoder() *tiktoken.Tiktoken {
-	if this.PromptEncoder == nil {
-		modelName := this.Butterfish.Config.ShellPromptModel
-		encoder, err := tiktoken.EncodingForModel(modelName)
-		if err != nil {
-			log.Printf("Warning: Error getting encoder for prompt model %s: %s", modelName, err)
-			encoder, err = tiktoken.EncodingForModel(DEFAULT_PROMPT_ENCODER)
-			if err != nil {
-				panic(fmt.Sprintf("Error getting encoder for fallback prompt model %s: %s", modelName, err))
-			}
-		}
-
-		this.PromptEncoder = encoder
+func (this *ShellState) getPromptTokenizer() Tokenizer {
+	if this.PromptTokenizer == nil {
+		this.PromptTokenizer = TokenizerForModel(this.Butterfish.Config.ShellPromptModel)
 	}
-
-	return this.PromptEncoder
+	return this.PromptTokenizer
 }
 
 // rewrite this for autosuggest
@@ -1959,49 +2785,87 @@ func (this *ShellState) RequestAutosuggest(delay time.Duration, command string)
 	if !this.AutosuggestEnabled {
 		return
 	}
+	if this.RemoteHost != "" && this.Butterfish.Config.ShellRemotePauseAutosuggest {
+		return
+	}
+	if command == "" && this.KnownFix != "" {
+		this.suggestKnownFix()
+		return
+	}
+
+	// If the request for what the user had typed is already streaming and its
+	// output agrees with what they've typed since, let it finish
+	promptName := autosuggestPromptName(command)
+	if this.REPL != nil {
+		promptName = replAutosuggestPromptName(command)
+	}
+	if this.PendingAutosuggest.CanContinue(command, promptName, this.State == stateShell) {
+		log.Printf("Continuing autosuggest for %q with %q", this.PendingAutosuggest.Command, command)
+		return
+	}
 
 	if this.AutosuggestCancel != nil {
 		// clear out a previous request
 		this.AutosuggestCancel()
 	}
 	this.AutosuggestCtx, this.AutosuggestCancel = context.WithCancel(context.Background())
+	this.PendingAutosuggest = nil
+
+	// what's typed in private mode, or a private command, isn't sent
+	if this.PrivateEnabled || isPrivateCommand(this.Butterfish.Config.ShellPrivateCommands, command) {
+		return
+	}
 
 	// if command is only whitespace, don't bother sending it
 	if len(command) > 0 && strings.TrimSpace(command) == "" {
 		return
 	}
 
-	var suggestPrompt string
-	var err error
-
-	if len(command) == 0 {
-		// command completion when we haven't started a command
-		suggestPrompt, err = this.Butterfish.PromptLibrary.GetUninterpolatedPrompt(prompt.ShellAutosuggestNewCommand)
-	} else if !unicode.IsUpper(rune(command[0])) {
-		// command completion when we have started typing a command
-		suggestPrompt, err = this.Butterfish.PromptLibrary.GetUninterpolatedPrompt(prompt.ShellAutosuggestCommand)
-	} else {
-		// prompt completion, like we're asking a question
-		suggestPrompt, err = this.Butterfish.PromptLibrary.GetUninterpolatedPrompt(prompt.ShellAutosuggestPrompt)
+	suggestPrompt, err := this.Butterfish.PromptLibrary.GetUninterpolatedPrompt(promptName)
+	if err != nil {
+		log.Printf("Error getting prompt from library: %s", err)
+		return
+	}
+	if this.REPL != nil {
+		suggestPrompt = fillREPLFields(suggestPrompt, this.REPL)
 	}
 
+	sysMsg, err := this.GetSystemMessage(prompt.ShellAutosuggestSystemMessage)
 	if err != nil {
-		log.Printf("Error getting prompt from library: %s", err)
+		log.Printf("Error getting autosuggest system message: %s", err)
 		return
 	}
 
+	this.PendingAutosuggest = &pendingAutosuggest{
+		Ctx:        this.AutosuggestCtx,
+		Command:    command,
+		PromptName: promptName,
+	}
+
+	var projectContext func(context.Context) string
+	if this.Butterfish.Config.ShellProjectContext && this.RemoteHost == "" {
+		// this runs in the autosuggest goroutine
+		bf := this.Butterfish.snapshot()
+		projectContext = func(ctx context.Context) string {
+			return this.AutosuggestProjectContext(ctx, bf)
+		}
+	}
+
 	go RequestCancelableAutosuggest(
 		this.AutosuggestCtx,
+		this.PendingAutosuggest,
 		delay,
 		command,
 		suggestPrompt,
+		sysMsg,
+		projectContext,
 		this.Butterfish.LLMClient,
 		this.Butterfish.Config.ShellAutosuggestModel,
 		this.Butterfish.Config.Verbose > 1,
 		this.History,
 		this.Butterfish.Config.ShellMaxHistoryBlockTokens,
 		this.AutosuggestChan,
-		this.getAutosuggestEncoder())
+		this.getAutosuggestTokenizer())
 
 }
 
@@ -2009,30 +2873,38 @@ func (this *ShellState) RequestAutosuggest(delay time.Duration, command string)
 // taken when this is a goroutine. That's why it has so many args.
 func RequestCancelableAutosuggest(
 	ctx context.Context,
+	pending *pendingAutosuggest,
 	delay time.Duration,
 	currCommand string,
 	rawPrompt string,
+	sysMsg string,
+	projectContext func(context.Context) string,
 	llmClient LLM,
 	model string,
 	verbose bool,
 	history *ShellHistory,
 	maxHistoryBlockTokens int,
 	autosuggestChan chan<- *AutosuggestResult,
-	encoder *tiktoken.Tiktoken,
+	tokenizer Tokenizer,
 ) {
 
+	defer pending.finish()
 	if delay > 0 {
 		time.Sleep(delay)
 	}
 	if ctx.Err() != nil {
 		return
 	}
+	pending.start()
+	if projectContext != nil {
+		sysMsg += projectContext(ctx)
+	}
 
 	totalTokens := 1600 // limit autosuggest to 1600 tokens for cost reasons
 	reserveForAnswer := 64
 	var err error
 
-	historyBlocks, _ := getHistoryBlocksByTokens(history, encoder,
+	historyBlocks, _ := getHistoryBlocksByTokens(history, tokenizer,
 		maxHistoryBlockTokens, totalTokens-reserveForAnswer, 4)
 
 	historyStr := HistoryBlocksToString(historyBlocks)
@@ -2053,15 +2925,25 @@ func RequestCancelableAutosuggest(
 	}
 
 	request := &util.CompletionRequest{
-		Ctx:         ctx,
-		Prompt:      prmpt,
-		Model:       model,
-		MaxTokens:   reserveForAnswer,
-		Temperature: 0.2,
-		Verbose:     verbose,
+		Ctx:              ctx,
+		Prompt:           prmpt,
+		Model:            model,
+		MaxTokens:        reserveForAnswer,
+		Temperature:      0.2,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.ShellAutosuggestSystemMessage,
+		Verbose:          verbose,
+		Task:             TaskAutosuggest,
+		PromptName:       pending.PromptName,
 	}
 
-	response, err := llmClient.Completion(request)
+	// The completion API has no system message so we prepend it to the prompt
+	if IsCompletionModel(model) && sysMsg != "" {
+		request.Prompt = sysMsg + "\n\n" + prmpt
+	}
+
+	// we stream so that RequestAutosuggest can see the partial suggestion
+	response, err := llmClient.CompletionStream(request, pending)
 	if err != nil {
 		if !strings.Contains(err.Error(), "context canceled") {
 			log.Printf("Autosuggest error: %s", err)
@@ -2076,13 +2958,13 @@ func RequestCancelableAutosuggest(
 	autosuggestChan <- autoSuggest
 }
 
-// Given a PID, this function identifies all the child PIDs of the given PID
-// and returns them as a slice of ints.
-func countChildPids(pid int) (int, error) {
+// Given a PID, this function identifies all the descendants of the given PID
+// and returns their executables, leaving out shells.
+func childExecutables(pid int) ([]string, error) {
 	// Get all the processes
 	processes, err := ps.Processes()
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
 	// Keep a set of pids, loop through and add children to the set, keep
@@ -2111,19 +2993,28 @@ func countChildPids(pid int) (int, error) {
 		}
 	}
 
-	// subtract 1 because we don't want to count the parent pid
-	totalPids := -1
-
+	// leave out the parent pid
+	delete(pids, pid)
+	executables := []string{}
 	for _, process := range pids {
 		switch process {
 		case "sh", "bash", "zsh":
 			// We want to keep butterfish on for child shells
 		default:
-			totalPids++
+			executables = append(executables, process)
 		}
 	}
 
-	return totalPids, nil
+	return executables, nil
+}
+
+// The number of descendants of the given PID, leaving out shells.
+func countChildPids(pid int) (int, error) {
+	executables, err := childExecutables(pid)
+	if err != nil {
+		return -1, err
+	}
+	return len(executables), nil
 }
 
 func HasRunningChildren() bool {
@@ -0,0 +1,201 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// At shell mode startup we read the user's aliases, shell functions, and
+// which well-known tools are on their PATH, so that generated commands use
+// e.g. their gst alias or rg rather than generic equivalents. The summary is
+// available to system messages as {shell_profile}. Only the program an alias
+// runs is kept, not its arguments, since aliases can hold tokens or
+// passwords.
+
+const (
+	shellProfileTimeout      = 5 * time.Second
+	shellProfileMaxAliases   = 40
+	shellProfileMaxFunctions = 30
+	shellProfileMarker       = "__butterfish_profile__"
+)
+
+// Tools that are mentioned when they're installed, mostly alternatives to
+// standard commands and tooling that the model wouldn't otherwise assume
+var shellProfileTools = []string{
+	"rg", "ag", "fd", "bat", "eza", "exa", "lsd", "jq", "yq", "fzf", "delta",
+	"sd", "dust", "duf", "procs", "btop", "htop", "zoxide", "tldr", "hyperfine",
+	"http", "xh", "curl", "wget", "rsync", "tmux", "git", "gh", "glab",
+	"docker", "podman", "kubectl", "helm", "k9s", "terraform", "aws", "gcloud",
+	"az", "make", "just", "go", "cargo", "node", "npm", "pnpm", "yarn", "bun",
+	"deno", "python3", "pip", "uv", "poetry", "ruby", "brew", "apt", "dnf",
+	"pacman", "nix", "mise", "asdf", "nvim", "vim", "emacs", "code", "ffmpeg",
+	"watchexec", "entr",
+}
+
+type ShellAlias struct {
+	Name string
+	// The program the alias runs, empty for builtins and paths
+	Program string
+}
+
+type ShellProfile struct {
+	Aliases   []ShellAlias
+	Functions []string
+	Tools     []string
+}
+
+// A compact summary of the profile for the system message
+func (this *ShellProfile) String() string {
+	parts := []string{}
+	if len(this.Aliases) > 0 {
+		aliases := []string{}
+		for _, alias := range this.Aliases {
+			if alias.Program == "" {
+				aliases = append(aliases, alias.Name)
+			} else {
+				aliases = append(aliases, fmt.Sprintf("%s (runs %s)", alias.Name, alias.Program))
+			}
+		}
+		parts = append(parts, "aliases: "+strings.Join(aliases, ", "))
+	}
+	if len(this.Functions) > 0 {
+		parts = append(parts, "functions: "+strings.Join(this.Functions, ", "))
+	}
+	if len(this.Tools) > 0 {
+		parts = append(parts, "installed tools: "+strings.Join(this.Tools, ", "))
+	}
+	if len(parts) == 0 {
+		return "none found"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// The script run in an interactive shell to list aliases and functions, the
+// marker separates them from anything the startup files print. Returns an
+// empty string for shells we don't know how to ask.
+func shellProfileScript(shell string) string {
+	switch filepath.Base(shell) {
+	case "bash":
+		return fmt.Sprintf("echo %[1]s; alias; echo %[1]s; compgen -A function", shellProfileMarker)
+	case "zsh":
+		return fmt.Sprintf("echo %[1]s; alias; echo %[1]s; print -l ${(k)functions}", shellProfileMarker)
+	}
+	return ""
+}
+
+// Matches alias output from bash (alias ll='ls -l') and zsh (ll='ls -l')
+var shellAliasRegex = regexp.MustCompile(`^(?:alias )?([^\s=]+)=(.*)$`)
+
+// Parse the output of shellProfileScript into aliases, with the program each
+// runs, and functions. Functions starting with _ are skipped, they're usually
+// completions.
+func parseShellProfile(output string) ([]ShellAlias, []string) {
+	sections := strings.Split(output, shellProfileMarker+"\n")
+	if len(sections) < 3 {
+		return nil, nil
+	}
+
+	aliases := []ShellAlias{}
+	for _, line := range strings.Split(sections[1], "\n") {
+		matches := shellAliasRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if matches == nil {
+			continue
+		}
+		value := matches[2]
+		if len(value) >= 2 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") {
+			value = strings.ReplaceAll(value[1:len(value)-1], `'\''`, "'")
+		}
+		program := ""
+		if programs := commandBinaries(value); len(programs) > 0 {
+			program = programs[0]
+		}
+		aliases = append(aliases, ShellAlias{Name: matches[1], Program: program})
+		if len(aliases) >= shellProfileMaxAliases {
+			break
+		}
+	}
+
+	functions := []string{}
+	for _, line := range strings.Split(sections[2], "\n") {
+		name := strings.TrimSpace(line)
+		if name == "" || strings.HasPrefix(name, "_") || strings.ContainsAny(name, " \t") {
+			continue
+		}
+		functions = append(functions, name)
+		if len(functions) >= shellProfileMaxFunctions {
+			break
+		}
+	}
+	return aliases, functions
+}
+
+// The tools from shellProfileTools found in the directories of path
+func findProfileTools(path string) []string {
+	tools := []string{}
+	for _, tool := range shellProfileTools {
+		for _, dir := range filepath.SplitList(path) {
+			if dir == "" {
+				continue
+			}
+			info, err := os.Stat(filepath.Join(dir, tool))
+			if err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+				tools = append(tools, tool)
+				break
+			}
+		}
+	}
+	return tools
+}
+
+// Read the aliases and functions defined by the shell's startup files, by
+// running it once interactively, and the tools on the PATH. Aliases and
+// functions are left empty if the shell isn't supported or fails.
+func LoadShellProfile(ctx context.Context, shell string) *ShellProfile {
+	profile := &ShellProfile{Tools: findProfileTools(os.Getenv("PATH"))}
+
+	script := shellProfileScript(shell)
+	if script == "" {
+		log.Printf("Not reading aliases and functions, %s isn't supported", shell)
+		return profile
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, shellProfileTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, shell, "-i", "-c", script)
+	// background jobs started by startup files can hold the output open
+	cmd.WaitDelay = time.Second
+	output, err := cmd.Output()
+	if err != nil {
+		log.Printf("Error reading aliases and functions from %s: %s", shell, err)
+		return profile
+	}
+	profile.Aliases, profile.Functions = parseShellProfile(string(output))
+	return profile
+}
+
+// Load the shell profile in the background so startup isn't delayed, until
+// it's loaded {shell_profile} is unknown
+func (this *ShellState) LoadShellProfile() {
+	shell := this.Butterfish.shellPath()
+
+	go func() {
+		profile := LoadShellProfile(this.Butterfish.Ctx, shell)
+		log.Printf("Shell profile: %s", profile)
+		this.shellProfileMutex.Lock()
+		this.shellProfile = profile.String()
+		this.shellProfileMutex.Unlock()
+	}()
+}
+
+func (this *ShellState) ShellProfile() string {
+	this.shellProfileMutex.Lock()
+	defer this.shellProfileMutex.Unlock()
+	return this.shellProfile
+}
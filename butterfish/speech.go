@@ -0,0 +1,392 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Prompts can be spoken rather than typed with `butterfish prompt --mic` or
+// the voice_prompt key in shell mode. Audio is recorded with sox, arecord, or
+// ffmpeg, whichever is installed, until the user presses Enter, then it's
+// transcribed with the Whisper API, or a local model if a command is set in
+// the config file, e.g.
+//
+//	speech:
+//	  transcribe_command: whisper-cli -nt -m ~/models/ggml-base.en.bin -f {file}
+type SpeechConfig struct {
+	// Transcription model for the API, defaultTranscribeModel if empty
+	Model string `yaml:"model,omitempty"`
+	// Records audio to {file} until it's interrupted, overrides the
+	// recorders we look for
+	RecordCommand string `yaml:"record_command,omitempty"`
+	// Prints the transcript of the audio in {file}, transcribes locally
+	// rather than with the API
+	TranscribeCommand string `yaml:"transcribe_command,omitempty"`
+
+	// How answers are read aloud, TTSSystem or TTSAPI, see tts.go
+	TTS string `yaml:"tts,omitempty"`
+	// Speech API model and voice, defaultTTSModel and defaultTTSVoice if
+	// empty
+	TTSModel string `yaml:"tts_model,omitempty"`
+	Voice    string `yaml:"voice,omitempty"`
+	// Reads text on stdin aloud, overrides the synthesizers we look for
+	SpeakCommand string `yaml:"speak_command,omitempty"`
+	// Longer answers aren't read, defaultSpeakMaxChars if 0
+	SpeakMaxChars int `yaml:"speak_max_chars,omitempty"`
+}
+
+const (
+	defaultTranscribeModel = openai.Whisper1
+	// How long a recorder has to finish writing its file once interrupted
+	recordStopTimeout = 3 * time.Second
+	// A WAV file this size or smaller has a header but no audio
+	emptyWAVBytes = 44
+)
+
+func (this *SpeechConfig) Validate() error {
+	for _, command := range []string{this.RecordCommand, this.TranscribeCommand} {
+		if command != "" && !strings.Contains(command, "{file}") {
+			return fmt.Errorf("speech command %q needs a {file} field", command)
+		}
+	}
+	if this.TTS != "" && this.TTS != TTSSystem && this.TTS != TTSAPI {
+		return fmt.Errorf("speech tts must be %s or %s", TTSSystem, TTSAPI)
+	}
+	if this.SpeakMaxChars < 0 {
+		return errors.New("speech speak_max_chars can't be negative")
+	}
+	return nil
+}
+
+// The command that records 16kHz mono audio to path, using the first of the
+// recorders that's installed
+func recorderCommand(path string, config *SpeechConfig, lookPath func(string) (string, error)) ([]string, error) {
+	if config != nil && config.RecordCommand != "" {
+		return []string{"sh", "-c", fillFileField(config.RecordCommand, path)}, nil
+	}
+
+	ffmpegInput := []string{"-f", "pulse", "-i", "default"}
+	if runtime.GOOS == "darwin" {
+		ffmpegInput = []string{"-f", "avfoundation", "-i", ":0"}
+	}
+	recorders := [][]string{
+		{"rec", "-q", "-c", "1", "-r", "16000", path},
+		{"arecord", "-q", "-f", "S16_LE", "-c", "1", "-r", "16000", path},
+		append(append([]string{"ffmpeg", "-loglevel", "error"}, ffmpegInput...),
+			"-ac", "1", "-ar", "16000", "-y", path),
+	}
+	for _, recorder := range recorders {
+		if _, err := lookPath(recorder[0]); err == nil {
+			return recorder, nil
+		}
+	}
+	return nil, errors.New("No audio recorder found, install sox, alsa-utils, or ffmpeg, or set speech.record_command in the config file")
+}
+
+// Replace {file} in a command with the quoted path
+func fillFileField(command, path string) string {
+	return strings.ReplaceAll(command, "{file}", "'"+strings.ReplaceAll(path, "'", `'\''`)+"'")
+}
+
+// Audio being recorded to a temporary file
+type audioRecording struct {
+	Path string
+	cmd  *exec.Cmd
+	done chan error
+}
+
+// Start recording, the recording runs until Stop or Cancel is called or ctx
+// is done
+func startRecording(ctx context.Context, config *SpeechConfig) (*audioRecording, error) {
+	dir, err := os.MkdirTemp("", "butterfish-speech")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "prompt.wav")
+	args, err := recorderCommand(path, config, exec.LookPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// ffmpeg reads keys from stdin, and recorders shouldn't see the user's
+	// Enter
+	cmd.Stdin = nil
+	// a record_command runs under sh, stopping it stops the recorder
+	setProcessGroup(cmd)
+	stderr := &strings.Builder{}
+	cmd.Stderr = stderr
+	err = cmd.Start()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	log.Printf("Recording audio with %s", args[0])
+
+	recording := &audioRecording{Path: path, cmd: cmd, done: make(chan error, 1)}
+	go func() {
+		err := cmd.Wait()
+		if err != nil && stderr.Len() > 0 {
+			err = fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		recording.done <- err
+	}()
+	return recording, nil
+}
+
+// Stop recording and return the path of the audio, which Remove deletes
+func (this *audioRecording) Stop() (string, error) {
+	// recorders finish the file when interrupted, and exit with an error
+	// code, so the exit status only matters if nothing was recorded
+	var exitErr error
+	signalProcessGroup(this.cmd, syscall.SIGINT)
+	select {
+	case exitErr = <-this.done:
+	case <-time.After(recordStopTimeout):
+		signalProcessGroup(this.cmd, syscall.SIGKILL)
+		exitErr = <-this.done
+	}
+
+	info, err := os.Stat(this.Path)
+	if err != nil || info.Size() <= emptyWAVBytes {
+		this.Remove()
+		if exitErr != nil {
+			return "", fmt.Errorf("Error recording audio: %w", exitErr)
+		}
+		return "", errors.New("Nothing was recorded, check that a microphone is connected")
+	}
+	return this.Path, nil
+}
+
+// Stop recording and throw the audio away
+func (this *audioRecording) Cancel() {
+	signalProcessGroup(this.cmd, syscall.SIGKILL)
+	<-this.done
+	this.Remove()
+}
+
+func (this *audioRecording) Remove() {
+	os.RemoveAll(filepath.Dir(this.Path))
+}
+
+// whisper.cpp prints segment timestamps unless told not to
+var transcriptTimestampRegex = regexp.MustCompile(`(?m)^\s*\[[0-9:.]+ --> [0-9:.]+\]\s*`)
+
+// Transcribe the audio at path, with the local command if one is set
+func (this *ButterfishCtx) transcribe(ctx context.Context, path string) (string, error) {
+	config := this.Config.Speech
+	if config == nil {
+		config = &SpeechConfig{}
+	}
+
+	if config.TranscribeCommand != "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", fillFileField(config.TranscribeCommand, path))
+		setProcessGroup(cmd)
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("Error running speech.transcribe_command: %w", err)
+		}
+		text := transcriptTimestampRegex.ReplaceAllString(string(output), "")
+		return strings.Join(strings.Fields(text), " "), nil
+	}
+
+	model := config.Model
+	if model == "" {
+		model = defaultTranscribeModel
+	}
+	language, _, _ := strings.Cut(resolveLanguage(this.Config.Language, os.Getenv), "-")
+	return transcribeWith(this.LLMClient, ctx, path, model, language)
+}
+
+// An LLM that can transcribe audio. The LLM wrappers pass transcriptions on
+// so that they're held to the budget and rate limit like other calls.
+type Transcriber interface {
+	Transcribe(ctx context.Context, path, model, language string) (string, error)
+}
+
+// Transcribe with llm, if it can
+func transcribeWith(llm LLM, ctx context.Context, path, model, language string) (string, error) {
+	transcriber, ok := llm.(Transcriber)
+	if !ok {
+		return "", errors.New("The LLM client can't transcribe audio, set speech.transcribe_command in the config file")
+	}
+	return transcriber.Transcribe(ctx, path, model, language)
+}
+
+// Transcribe audio with the API, language is an ISO-639-1 code or empty to
+// detect it
+func (this *GPT) Transcribe(ctx context.Context, path, model, language string) (string, error) {
+	response, err := this.client.CreateTranscription(ctx, openai.AudioRequest{
+		Model:    model,
+		FilePath: path,
+		Language: language,
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response.Text), nil
+}
+
+// Record a prompt for the prompt command and show its transcript. Enter is
+// read from the terminal since stdin may be piped.
+func (this *ButterfishCtx) micPrompt() (string, error) {
+	if err := this.requireInteractive("Press Enter to stop recording"); err != nil {
+		return "", err
+	}
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return "", errors.New("--mic needs a terminal to stop the recording from")
+	}
+	defer tty.Close()
+	transcript, err := this.recordPrompt(tty)
+	if err != nil {
+		return "", err
+	}
+	if transcript == "" {
+		return "", errors.New("The transcript is empty, nothing was heard")
+	}
+	this.StylePrintf(this.Config.Styles.Question, "%s\n", transcript)
+	return transcript, nil
+}
+
+// Record from the microphone until the user presses Enter on the terminal,
+// then return the transcript
+func (this *ButterfishCtx) recordPrompt(tty io.Reader) (string, error) {
+	recording, err := startRecording(this.Ctx, this.Config.Speech)
+	if err != nil {
+		return "", err
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "Recording, press Enter to stop...\n")
+	buffer := make([]byte, 1)
+	for {
+		_, err = tty.Read(buffer)
+		if err != nil || buffer[0] == '\n' || buffer[0] == '\r' {
+			break
+		}
+	}
+	if err != nil && err != io.EOF {
+		recording.Cancel()
+		return "", err
+	}
+
+	path, err := recording.Stop()
+	if err != nil {
+		return "", err
+	}
+	defer recording.Remove()
+	return this.transcribe(this.Ctx, path)
+}
+
+type transcriptResult struct {
+	Text string
+	Err  error
+}
+
+// Start recording a prompt in shell mode, the transcript is submitted as the
+// prompt, after any prompt text typed so far, e.g. ! for a goal
+func (this *ShellState) StartVoicePrompt() {
+	recording, err := startRecording(this.Butterfish.Ctx, this.Butterfish.Config.Speech)
+	if err != nil {
+		this.Prompt.Clear()
+		this.PrintError(err)
+		return
+	}
+	this.Recording = recording
+	this.ClearAutosuggest(this.Color.Command)
+	fmt.Fprintf(this.ParentOut, "\r\n%sRecording, press Enter to stop or Ctrl-C to cancel...%s",
+		this.Color.Answer, this.Color.Command)
+}
+
+// Input while recording or transcribing, Enter or the voice_prompt key stops
+// the recording, the interrupt key cancels, and anything else is dropped
+func (this *ShellState) VoicePromptInput(data []byte) []byte {
+	action, length, partial := this.KeyBindings.Match(data)
+	if partial {
+		return data
+	}
+
+	if action == keyActionInterrupt {
+		if this.Recording != nil {
+			this.Recording.Cancel()
+			this.Recording = nil
+		}
+		if this.TranscribeCancel != nil {
+			this.TranscribeCancel()
+			this.TranscribeCancel = nil
+		}
+		fmt.Fprintf(this.ParentOut, "\r\n%sCanceled voice prompt.%s", this.Color.Answer, this.Color.Command)
+		this.Prompt.Clear()
+		this.setState(stateNormal)
+		this.ChildIn.Write([]byte("\n"))
+		return data[length:]
+	}
+
+	if this.Recording != nil && (action == keyActionVoicePrompt || bytes.ContainsRune(data, '\r')) {
+		recording := this.Recording
+		this.Recording = nil
+		fmt.Fprintf(this.ParentOut, "\r\n%sTranscribing...%s", this.Color.Answer, this.Color.Command)
+
+		ctx, cancel := context.WithCancel(this.Butterfish.Ctx)
+		this.TranscribeCancel = cancel
+		bf := this.Butterfish.snapshot()
+		go func() {
+			result := &transcriptResult{}
+			path, err := recording.Stop()
+			if err == nil {
+				result.Text, err = bf.transcribe(ctx, path)
+				recording.Remove()
+			}
+			result.Err = err
+			select {
+			case this.TranscriptChan <- result:
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return nil
+}
+
+// Submit a transcript as the prompt, as if it had been typed
+func (this *ShellState) ShowTranscript(result *transcriptResult) {
+	if this.TranscribeCancel == nil {
+		// the voice prompt was canceled
+		return
+	}
+	this.TranscribeCancel = nil
+
+	prefix := ""
+	if this.State == statePrompting {
+		prefix = this.Prompt.String()
+	}
+	this.Prompt.Clear()
+	if result.Err == nil && result.Text == "" {
+		result.Err = errors.New("Nothing was heard.")
+	}
+	if result.Err != nil {
+		fmt.Fprint(this.ParentOut, "\r\n")
+		this.PrintError(result.Err)
+		return
+	}
+
+	if prefix != "" && !strings.HasSuffix(prefix, " ") && !strings.HasSuffix(prefix, "!") {
+		prefix += " "
+	}
+	fmt.Fprint(this.ParentOut, "\r\n")
+	this.StartPrompt([]byte(prefix + result.Text))
+	this.ParentInput(this.Butterfish.Ctx, []byte{'\r'})
+}
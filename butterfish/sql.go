@@ -0,0 +1,450 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/mitchellh/go-homedir"
+)
+
+// butterfish sql writes a query for a request in plain words against a
+// database schema. The schema is either introspected from a DSN, e.g.
+// postgres://localhost/shop or a sqlite file, or read from a file of DDL.
+// It's cached per project (the git repo, or else the current directory) so
+// later queries don't need the DSN or DDL again. With --run the query is run
+// read-only through the database's own client (psql, mysql, or sqlite3).
+
+const (
+	defaultSQLSchemaDir = "~/.config/butterfish/sql_schemas"
+	sqlRunTimeout       = 30 * time.Second
+	// Schemas are cut to this many bytes in the prompt
+	sqlMaxSchemaBytes = 24000
+)
+
+const (
+	sqlDialectPostgres = "postgres"
+	sqlDialectMySQL    = "mysql"
+	sqlDialectSQLite   = "sqlite"
+)
+
+// The dialect of a DSN, by its scheme or, for sqlite, the file extension
+func sqlDialect(dsn string) (string, error) {
+	scheme, rest, found := strings.Cut(dsn, "://")
+	if !found {
+		switch strings.ToLower(filepath.Ext(dsn)) {
+		case ".db", ".sqlite", ".sqlite3":
+			return sqlDialectSQLite, nil
+		}
+		return "", fmt.Errorf("Can't tell the database from %s, use a URL like postgres://, mysql://, or sqlite://", redactDSN(dsn))
+	}
+	switch strings.ToLower(scheme) {
+	case "postgres", "postgresql":
+		return sqlDialectPostgres, nil
+	case "mysql":
+		return sqlDialectMySQL, nil
+	case "sqlite", "sqlite3", "file":
+		if rest == "" {
+			return "", errors.New("The sqlite DSN is missing a path")
+		}
+		return sqlDialectSQLite, nil
+	}
+	return "", fmt.Errorf("Unsupported database %s, use postgres, mysql, or sqlite", scheme)
+}
+
+// The DSN without its password, so it can be shown and cached
+func redactDSN(dsn string) string {
+	parsed, err := url.Parse(dsn)
+	if err != nil || parsed.User == nil {
+		return dsn
+	}
+	if _, hasPassword := parsed.User.Password(); hasPassword {
+		parsed.User = url.UserPassword(parsed.User.Username(), "xxxxx")
+	}
+	return parsed.String()
+}
+
+// The path of a sqlite database from its DSN
+func sqlitePath(dsn string) string {
+	_, path, found := strings.Cut(dsn, "://")
+	if !found {
+		return dsn
+	}
+	return path
+}
+
+// The mysql client takes flags rather than a URL, the password goes in the
+// environment so it isn't visible in ps
+func mysqlArgs(dsn string) ([]string, []string, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	args := []string{}
+	env := []string{}
+	if parsed.Hostname() != "" {
+		args = append(args, "-h", parsed.Hostname())
+	}
+	if parsed.Port() != "" {
+		args = append(args, "-P", parsed.Port())
+	}
+	if parsed.User != nil {
+		args = append(args, "-u", parsed.User.Username())
+		if password, ok := parsed.User.Password(); ok {
+			env = append(env, "MYSQL_PWD="+password)
+		}
+	}
+	if database := strings.TrimPrefix(parsed.Path, "/"); database != "" {
+		args = append(args, database)
+	}
+	return args, env, nil
+}
+
+// The DSN for pg_dump and psql without its password, which goes in the
+// environment so it isn't visible in ps
+func postgresArgs(dsn string) (string, []string, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return "", nil, err
+	}
+	env := []string{}
+	if parsed.User != nil {
+		if password, ok := parsed.User.Password(); ok {
+			env = append(env, "PGPASSWORD="+password)
+			parsed.User = url.User(parsed.User.Username())
+		}
+	}
+	query := parsed.Query()
+	if password := query.Get("password"); password != "" {
+		env = append(env, "PGPASSWORD="+password)
+		query.Del("password")
+		parsed.RawQuery = query.Encode()
+	}
+	return parsed.String(), env, nil
+}
+
+// Run a database client, returning its output or its error output
+func runSQLClient(ctx context.Context, env []string, name string, args ...string) (string, error) {
+	program, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%s isn't installed", name)
+	}
+	ctx, cancel := context.WithTimeout(ctx, sqlRunTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, program, args...)
+	cmd.Env = append(os.Environ(), env...)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
+
+// Read the schema of a database as DDL with its client
+func introspectSchema(ctx context.Context, dsn string) (string, error) {
+	dialect, err := sqlDialect(dsn)
+	if err != nil {
+		return "", err
+	}
+	switch dialect {
+	case sqlDialectPostgres:
+		dsn, env, err := postgresArgs(dsn)
+		if err != nil {
+			return "", err
+		}
+		return runSQLClient(ctx, env, "pg_dump", "--schema-only", "--no-owner", "--no-privileges", dsn)
+	case sqlDialectMySQL:
+		args, env, err := mysqlArgs(dsn)
+		if err != nil {
+			return "", err
+		}
+		return runSQLClient(ctx, env, "mysqldump", append([]string{"--no-data", "--skip-comments"}, args...)...)
+	default:
+		return runSQLClient(ctx, nil, "sqlite3", "-readonly", sqlitePath(dsn), ".schema")
+	}
+}
+
+// Statements that only read. This is checked before running a query on top
+// of the read-only session, so a write is refused with a clear message.
+var sqlReadOnlyKeywords = map[string]bool{
+	"select": true, "with": true, "explain": true, "show": true,
+	"describe": true, "desc": true, "values": true, "table": true,
+}
+
+// Ways a query that starts with a read-only keyword can still write, through
+// the database's file functions or the client: sqlite's writefile(),
+// load_extension(), and edit(), mysql's SELECT ... INTO OUTFILE, and client
+// backslash commands like \! which run a shell command
+var sqlUnsafeRegex = regexp.MustCompile(`(?i)\b(writefile|load_extension|edit)\s*\(|\binto\s+(outfile|dumpfile)\b|\\[a-z!]`)
+
+func isReadOnlySQL(query string) bool {
+	if sqlUnsafeRegex.MatchString(query) {
+		return false
+	}
+	fields := strings.Fields(strings.TrimLeft(query, "( \t\n"))
+	if len(fields) == 0 || !sqlReadOnlyKeywords[strings.ToLower(fields[0])] {
+		return false
+	}
+	// a CTE can still write, e.g. WITH x AS (DELETE ... RETURNING *)
+	for _, field := range fields {
+		switch strings.ToLower(strings.Trim(field, "(),;")) {
+		case "insert", "update", "delete", "drop", "alter", "create", "truncate", "grant", "revoke", "merge":
+			return false
+		}
+	}
+	return true
+}
+
+// Run a query in a read-only session and return the output table
+func runReadOnlySQL(ctx context.Context, dsn, query string) (string, error) {
+	if !isReadOnlySQL(query) {
+		return "", errors.New("Only read-only queries are run, this one could change the database")
+	}
+	dialect, err := sqlDialect(dsn)
+	if err != nil {
+		return "", err
+	}
+	switch dialect {
+	case sqlDialectPostgres:
+		dsn, env, err := postgresArgs(dsn)
+		if err != nil {
+			return "", err
+		}
+		env = append(env, "PGOPTIONS=-c default_transaction_read_only=on")
+		return runSQLClient(ctx, env, "psql", dsn, "-X", "-v", "ON_ERROR_STOP=1", "-c", query)
+	case sqlDialectMySQL:
+		args, env, err := mysqlArgs(dsn)
+		if err != nil {
+			return "", err
+		}
+		args = append([]string{"--init-command=SET SESSION TRANSACTION READ ONLY", "--system-command=OFF",
+			"-t", "-e", query}, args...)
+		return runSQLClient(ctx, env, "mysql", args...)
+	default:
+		// -safe turns off functions and dot commands that touch other files
+		return runSQLClient(ctx, nil, "sqlite3", "-safe", "-readonly", "-header", "-column", sqlitePath(dsn), query)
+	}
+}
+
+// A schema cached for a project
+type SQLSchema struct {
+	Project string `json:"project"`
+	Dialect string `json:"dialect"`
+	// The DSN without its password, or the DDL file the schema came from
+	Source  string    `json:"source"`
+	Schema  string    `json:"schema"`
+	Updated time.Time `json:"updated"`
+}
+
+type SQLSchemaCache struct {
+	Dir string
+}
+
+func NewSQLSchemaCache(dir string) (*SQLSchemaCache, error) {
+	if dir == "" {
+		dir = defaultSQLSchemaDir
+	}
+	dir, err := homedir.Expand(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLSchemaCache{Dir: dir}, nil
+}
+
+func (this *SQLSchemaCache) path(project string) string {
+	hash := sha256.Sum256([]byte(project))
+	return filepath.Join(this.Dir, hex.EncodeToString(hash[:8])+".json")
+}
+
+// The cached schema of a project, nil if there isn't one
+func (this *SQLSchemaCache) Load(project string) (*SQLSchema, error) {
+	data, err := os.ReadFile(this.path(project))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	schema := &SQLSchema{}
+	err = json.Unmarshal(data, schema)
+	if err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func (this *SQLSchemaCache) Save(schema *SQLSchema) error {
+	// schemas can say a lot about a system, only the user can read them
+	err := os.MkdirAll(this.Dir, 0700)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(this.path(schema.Project), data, 0600)
+}
+
+// The schema to write the query against: from the DDL file if given, else
+// the cache, else introspected from the DSN. The cache is refreshed if the
+// DSN or DDL file changed or refresh is set.
+func (this *ButterfishCtx) sqlSchema(cache *SQLSchemaCache, project, dsn, ddlPath, dialect string, refresh bool) (*SQLSchema, error) {
+	cached, err := cache.Load(project)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &SQLSchema{Project: project, Dialect: dialect, Updated: time.Now()}
+	switch {
+	case ddlPath != "":
+		ddl, err := os.ReadFile(ddlPath)
+		if err != nil {
+			return nil, err
+		}
+		schema.Source, err = filepath.Abs(ddlPath)
+		if err != nil {
+			return nil, err
+		}
+		schema.Schema = string(ddl)
+	case dsn != "":
+		schema.Source = redactDSN(dsn)
+		if cached != nil && cached.Source == schema.Source && !refresh {
+			return cached, nil
+		}
+		if schema.Dialect == "" {
+			schema.Dialect, err = sqlDialect(dsn)
+			if err != nil {
+				return nil, err
+			}
+		}
+		this.StylePrintf(this.Config.Styles.Grey, "Reading the schema of %s\n", schema.Source)
+		schema.Schema, err = introspectSchema(this.Ctx, dsn)
+		if err != nil {
+			return nil, err
+		}
+	case cached != nil:
+		if dialect != "" {
+			cached.Dialect = dialect
+		}
+		return cached, nil
+	default:
+		return nil, errors.New("No schema cached for this project, give one with --dsn or --schema")
+	}
+
+	if strings.TrimSpace(schema.Schema) == "" {
+		return nil, fmt.Errorf("The schema from %s is empty", schema.Source)
+	}
+	if schema.Dialect == "" && cached != nil {
+		schema.Dialect = cached.Dialect
+	}
+	err = cache.Save(schema)
+	if err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// Ask the model for a query for the request against the schema
+func (this *ButterfishCtx) generateSQL(schema *SQLSchema, request, model string) (string, error) {
+	dialect := schema.Dialect
+	if dialect == "" {
+		dialect = "standard SQL"
+	}
+	ddl := schema.Schema
+	if len(ddl) > sqlMaxSchemaBytes {
+		ddl = ddl[:sqlMaxSchemaBytes] + "\n..."
+	}
+	promptStr, err := this.GetPrompt(prompt.PromptSQLQuery,
+		"dialect", dialect,
+		"schema", ddl,
+		"content", request)
+	if err != nil {
+		return "", err
+	}
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := this.LLMClient.Completion(&util.CompletionRequest{
+		Ctx:              this.Ctx,
+		Prompt:           promptStr,
+		PromptName:       prompt.PromptSQLQuery,
+		Model:            model,
+		MaxTokens:        1024,
+		Temperature:      0.2,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.PromptSystemMessage,
+		Task:             TaskGencmd,
+		Verbose:          this.Config.Verbose > 0,
+		TokenTimeout:     this.Config.TokenTimeout,
+	})
+	if err != nil {
+		return "", err
+	}
+	query := strings.TrimSpace(stripCodeFence(response.Completion))
+	if query == "" {
+		return "", errors.New("No query came back")
+	}
+	return query, nil
+}
+
+func (this *ButterfishCtx) sqlCommand(options *CliCommandConfig) error {
+	sql := options.Sql
+	request := strings.Trim(strings.Join(sql.Request, " "), "\"'")
+	if request == "" {
+		return errors.New("Please describe the query you want")
+	}
+	if sql.Run && sql.Dsn == "" {
+		return errors.New("--run needs a database to run the query on, give it with --dsn")
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	cache, err := NewSQLSchemaCache("")
+	if err != nil {
+		return err
+	}
+	schema, err := this.sqlSchema(cache, projectRoot(this.Ctx, dir), sql.Dsn, sql.Schema, sql.Dialect, sql.Refresh)
+	if err != nil {
+		return err
+	}
+
+	query, err := this.generateSQL(schema, request, sql.Model)
+	if err != nil {
+		return err
+	}
+	this.StylePrintf(this.Config.Styles.Highlight, "%s\n", query)
+	if !sql.Run {
+		return nil
+	}
+
+	output, err := runReadOnlySQL(this.Ctx, sql.Dsn, query)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(output) == "" {
+		this.StylePrintf(this.Config.Styles.Grey, "(no rows)\n")
+		return nil
+	}
+	fmt.Fprint(this.Out, output)
+	return nil
+}
@@ -0,0 +1,285 @@
+package butterfish
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Butterfish appends a small record of each LLM call, autosuggest, and goal
+// mode command to a local file so that `butterfish stats` can report on how
+// it's being used. Records only hold counts, models, and timings, never
+// prompts or commands, and nothing leaves the machine.
+const defaultStatsPath = "~/.config/butterfish/stats.jsonl"
+
+// Once the file is bigger than this it's moved to <path>.1, replacing the
+// previous one, so we keep between one and two files worth of history
+const statsMaxBytes = 8 * 1024 * 1024
+
+const (
+	statsEventLLM                 = "llm"
+	statsEventAutosuggestShown    = "autosuggest_shown"
+	statsEventAutosuggestAccepted = "autosuggest_accepted"
+	statsEventCommandGenerated    = "command_generated"
+	statsEventCommandAccepted     = "command_accepted"
+)
+
+type StatsEvent struct {
+	Time             time.Time `json:"time"`
+	Type             string    `json:"type"`
+	Model            string    `json:"model,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens,omitempty"`
+	CompletionTokens int       `json:"completion_tokens,omitempty"`
+	Cost             float64   `json:"cost,omitempty"`
+	LatencyMs        int64     `json:"latency_ms,omitempty"`
+}
+
+type StatsLog struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+func NewStatsLog(path string) (*StatsLog, error) {
+	if path == "" {
+		path = defaultStatsPath
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsLog{Path: path}, nil
+}
+
+// Append an event, the time is filled in if it's not set. This is a no-op
+// on a nil StatsLog.
+func (this *StatsLog) Record(event StatsEvent) {
+	if this == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	err := this.append(&event)
+	if err != nil {
+		log.Printf("Error recording stats: %s", err)
+	}
+}
+
+func (this *StatsLog) append(event *StatsEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(this.Path), 0755)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(this.Path)
+	if err == nil && info.Size() > statsMaxBytes {
+		err = os.Rename(this.Path, this.Path+".1")
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(this.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Load events since a time, oldest first, skipping lines that can't be parsed
+func (this *StatsLog) Load(since time.Time) ([]*StatsEvent, error) {
+	events := []*StatsEvent{}
+	for _, path := range []string{this.Path + ".1", this.Path} {
+		file, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			event := &StatsEvent{}
+			if json.Unmarshal(scanner.Bytes(), event) == nil && !event.Time.Before(since) {
+				events = append(events, event)
+			}
+		}
+		file.Close()
+		if scanner.Err() != nil {
+			return nil, scanner.Err()
+		}
+	}
+	return events, nil
+}
+
+// Usage of one model on one day
+type dailyModelUsage struct {
+	Day    string
+	Model  string
+	Calls  int
+	Tokens int
+	Cost   float64
+}
+
+type modelLatency struct {
+	Model         string
+	Calls         int
+	P50, P90, P99 time.Duration
+}
+
+type StatsReport struct {
+	CommandsGenerated   int
+	CommandsAccepted    int
+	AutosuggestShown    int
+	AutosuggestAccepted int
+	Usage               []*dailyModelUsage
+	Latency             []*modelLatency
+	TotalTokens         int
+	TotalCost           float64
+}
+
+// The value at percentile p (0 to 100) of sorted durations, using the
+// nearest rank
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return sorted[rank]
+}
+
+func BuildStatsReport(events []*StatsEvent) *StatsReport {
+	report := &StatsReport{}
+	usage := map[string]*dailyModelUsage{}
+	latencies := map[string][]time.Duration{}
+
+	for _, event := range events {
+		switch event.Type {
+		case statsEventCommandGenerated:
+			report.CommandsGenerated++
+		case statsEventCommandAccepted:
+			report.CommandsAccepted++
+		case statsEventAutosuggestShown:
+			report.AutosuggestShown++
+		case statsEventAutosuggestAccepted:
+			report.AutosuggestAccepted++
+		case statsEventLLM:
+			day := event.Time.Local().Format("2006-01-02")
+			key := day + " " + event.Model
+			if usage[key] == nil {
+				usage[key] = &dailyModelUsage{Day: day, Model: event.Model}
+			}
+			tokens := event.PromptTokens + event.CompletionTokens
+			usage[key].Calls++
+			usage[key].Tokens += tokens
+			usage[key].Cost += event.Cost
+			report.TotalTokens += tokens
+			report.TotalCost += event.Cost
+			if event.LatencyMs > 0 {
+				latencies[event.Model] = append(latencies[event.Model],
+					time.Duration(event.LatencyMs)*time.Millisecond)
+			}
+		}
+	}
+
+	for _, dayUsage := range usage {
+		report.Usage = append(report.Usage, dayUsage)
+	}
+	sort.Slice(report.Usage, func(i, j int) bool {
+		if report.Usage[i].Day != report.Usage[j].Day {
+			return report.Usage[i].Day < report.Usage[j].Day
+		}
+		return report.Usage[i].Model < report.Usage[j].Model
+	})
+
+	for model, durations := range latencies {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		report.Latency = append(report.Latency, &modelLatency{
+			Model: model,
+			Calls: len(durations),
+			P50:   percentile(durations, 50),
+			P90:   percentile(durations, 90),
+			P99:   percentile(durations, 99),
+		})
+	}
+	sort.Slice(report.Latency, func(i, j int) bool {
+		return report.Latency[i].Model < report.Latency[j].Model
+	})
+	return report
+}
+
+func rateString(part, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", 100*float64(part)/float64(total))
+}
+
+func (this *StatsReport) String() string {
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "Goal mode commands:  %d generated, %d accepted (%s)\n",
+		this.CommandsGenerated, this.CommandsAccepted, rateString(this.CommandsAccepted, this.CommandsGenerated))
+	fmt.Fprintf(&builder, "Autosuggest:         %d shown, %d accepted (%s)\n",
+		this.AutosuggestShown, this.AutosuggestAccepted, rateString(this.AutosuggestAccepted, this.AutosuggestShown))
+	fmt.Fprintf(&builder, "LLM usage:           %s tokens, $%.4f estimated\n",
+		formatTokenCount(this.TotalTokens), this.TotalCost)
+
+	if len(this.Usage) > 0 {
+		builder.WriteString("\nUsage per day:\n")
+		for _, usage := range this.Usage {
+			fmt.Fprintf(&builder, "  %s  %-28s %6d calls %8s tokens  $%.4f\n",
+				usage.Day, usage.Model, usage.Calls, formatTokenCount(usage.Tokens), usage.Cost)
+		}
+	}
+
+	if len(this.Latency) > 0 {
+		builder.WriteString("\nLatency per model:\n")
+		for _, latency := range this.Latency {
+			fmt.Fprintf(&builder, "  %-28s %6d calls  p50 %6.2fs  p90 %6.2fs  p99 %6.2fs\n",
+				latency.Model, latency.Calls, latency.P50.Seconds(), latency.P90.Seconds(), latency.P99.Seconds())
+		}
+	}
+	return builder.String()
+}
+
+func (this *ButterfishCtx) statsCommand(options *CliCommandConfig) error {
+	days := options.Stats.Days
+	if days < 1 {
+		return errors.New("Please give a number of days of at least 1")
+	}
+	since := startOfDay(time.Now()).AddDate(0, 0, 1-days)
+	events, err := this.Stats.Load(since)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("No stats recorded in %s in the last %d days", this.Stats.Path, days)
+	}
+
+	this.StylePrintf(this.Config.Styles.Highlight, "Butterfish usage since %s\n\n", since.Format("2006-01-02"))
+	this.StylePrintf(this.Config.Styles.Foreground, "%s", BuildStatsReport(events))
+	return nil
+}
@@ -0,0 +1,276 @@
+package butterfish
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Task discovery finds the tasks a project defines in its Makefile,
+// package.json scripts, or justfile, so that a request like "build the
+// project" can be mapped to the project's own task. Tasks are listed with
+// `butterfish tasks` and given to the model with the {ctx_tasks} context
+// provider, which is also added to shell prompts that mention building,
+// testing, and the like.
+
+type ProjectTask struct {
+	Name string
+	// The file the task is defined in, e.g. Makefile
+	Source string
+	// The command that runs the task, e.g. make build
+	Command     string
+	Description string
+}
+
+var (
+	makefileNames = []string{"GNUmakefile", "makefile", "Makefile"}
+	justfileNames = []string{"justfile", "Justfile", ".justfile"}
+)
+
+// A rule line, i.e. targets then a colon that isn't part of an assignment
+// like := or ::=
+var makeRuleRegex = regexp.MustCompile(`^([A-Za-z0-9_][A-Za-z0-9_.\-/]*(?:[ \t]+[A-Za-z0-9_][A-Za-z0-9_.\-/]*)*)[ \t]*::?(?:[^=:]|$)`)
+
+// A recipe line, i.e. a name, optional parameters, then a colon that isn't
+// part of an assignment
+var justRecipeRegex = regexp.MustCompile(`^@?([A-Za-z_][A-Za-z0-9_\-]*)(?:[ \t][^:]*)?:(?:[^=]|$)`)
+
+// The comment on the line above a task, used as its description
+func commentDescription(previous string) string {
+	if !strings.HasPrefix(previous, "#") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimLeft(previous, "#"))
+}
+
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return lines, scanner.Err()
+}
+
+// Find the first of names that exists in dir, empty if none do
+func findFile(dir string, names []string) string {
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// Parse the targets of a Makefile. We skip special targets like .PHONY,
+// pattern rules, and targets that look like files, e.g. bin/app or main.o,
+// since those aren't tasks you'd run by name. A target is described by a
+// comment on the line above or a ## comment at the end of the rule.
+func ParseMakefileTasks(path string) ([]*ProjectTask, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := []*ProjectTask{}
+	seen := map[string]bool{}
+	previous := ""
+	for _, line := range lines {
+		match := makeRuleRegex.FindStringSubmatch(line)
+		if match != nil {
+			description := commentDescription(previous)
+			if _, after, ok := strings.Cut(line, "##"); ok {
+				description = strings.TrimSpace(after)
+			}
+			for _, target := range strings.Fields(match[1]) {
+				if seen[target] || strings.ContainsAny(target, "./") {
+					continue
+				}
+				seen[target] = true
+				tasks = append(tasks, &ProjectTask{
+					Name:        target,
+					Source:      filepath.Base(path),
+					Command:     "make " + target,
+					Description: description,
+				})
+			}
+		}
+		// keep the comment above a .PHONY line for the rule below it
+		if !strings.HasPrefix(line, ".PHONY") {
+			previous = line
+		}
+	}
+	return tasks, nil
+}
+
+// The package manager for a node project, based on its lock file
+func nodePackageManager(dir string) string {
+	lockFiles := []struct{ file, manager string }{
+		{"pnpm-lock.yaml", "pnpm"},
+		{"yarn.lock", "yarn"},
+		{"bun.lockb", "bun"},
+	}
+	for _, lockFile := range lockFiles {
+		if _, err := os.Stat(filepath.Join(dir, lockFile.file)); err == nil {
+			return lockFile.manager
+		}
+	}
+	return "npm"
+}
+
+// Parse the scripts of a package.json, the description of each is the
+// script itself
+func ParsePackageJSONTasks(path string) ([]*ProjectTask, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pkg := struct {
+		Scripts map[string]string `json:"scripts"`
+	}{}
+	err = json.Unmarshal(data, &pkg)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", path, err)
+	}
+
+	names := make([]string, 0, len(pkg.Scripts))
+	for name := range pkg.Scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	manager := nodePackageManager(filepath.Dir(path))
+	tasks := []*ProjectTask{}
+	for _, name := range names {
+		tasks = append(tasks, &ProjectTask{
+			Name:        name,
+			Source:      filepath.Base(path),
+			Command:     manager + " run " + name,
+			Description: pkg.Scripts[name],
+		})
+	}
+	return tasks, nil
+}
+
+// Parse the recipes of a justfile, skipping private recipes, i.e. those
+// starting with an underscore or marked [private]
+func ParseJustfileTasks(path string) ([]*ProjectTask, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := []*ProjectTask{}
+	description := ""
+	private := false
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "#"):
+			description = commentDescription(line)
+			continue
+		case strings.HasPrefix(line, "["):
+			// attributes like [private] or [linux] come before the recipe
+			private = private || strings.Contains(line, "private")
+			continue
+		}
+
+		match := justRecipeRegex.FindStringSubmatch(line)
+		if match != nil && !private && !strings.HasPrefix(match[1], "_") {
+			tasks = append(tasks, &ProjectTask{
+				Name:        match[1],
+				Source:      filepath.Base(path),
+				Command:     "just " + match[1],
+				Description: description,
+			})
+		}
+		description = ""
+		private = false
+	}
+	return tasks, nil
+}
+
+// Find the tasks defined in dir
+func DiscoverTasks(dir string) ([]*ProjectTask, error) {
+	tasks := []*ProjectTask{}
+
+	parsers := []struct {
+		path  string
+		parse func(string) ([]*ProjectTask, error)
+	}{
+		{findFile(dir, makefileNames), ParseMakefileTasks},
+		{findFile(dir, []string{"package.json"}), ParsePackageJSONTasks},
+		{findFile(dir, justfileNames), ParseJustfileTasks},
+	}
+	for _, parser := range parsers {
+		if parser.path == "" {
+			continue
+		}
+		found, err := parser.parse(parser.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, found...)
+	}
+	return tasks, nil
+}
+
+// One task per line with its command and description, aligned
+func formatTasks(tasks []*ProjectTask) string {
+	width := 0
+	for _, task := range tasks {
+		width = max(width, len(task.Command))
+	}
+
+	builder := strings.Builder{}
+	for _, task := range tasks {
+		description := strings.Join(strings.Fields(task.Description), " ")
+		line := fmt.Sprintf("%-*s  (%s) %s", width, task.Command, task.Source, description)
+		builder.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+	return builder.String()
+}
+
+func tasksContextProvider(env *ContextEnv) (string, error) {
+	tasks, err := DiscoverTasks(env.Cwd())
+	if err != nil {
+		return "", err
+	}
+	if len(tasks) == 0 {
+		return "(no Makefile, package.json, or justfile tasks in this directory)", nil
+	}
+	return formatTasks(tasks), nil
+}
+
+func (this *ButterfishCtx) tasksCommand(options *CliCommandConfig) error {
+	dir := options.Tasks.Dir
+	if dir == "" {
+		dir = "."
+	}
+	tasks, err := DiscoverTasks(dir)
+	if err != nil {
+		return err
+	}
+	if len(tasks) == 0 {
+		return fmt.Errorf("No Makefile, package.json, or justfile tasks found in %s", dir)
+	}
+	this.StylePrintf(this.Config.Styles.Foreground, "%s", formatTasks(tasks))
+	return nil
+}
@@ -0,0 +1,36 @@
+package butterfish
+
+import (
+	"io"
+	"os"
+)
+
+// With --out (or --tee) on prompt and summarize, responses are copied to a
+// file as they stream in, before they're styled for the terminal, so a long
+// response isn't lost if the terminal scrolls or the session dies.
+
+// Open path for the copy of responses, returns a function that closes it.
+// An empty path doesn't copy responses.
+func (this *ButterfishCtx) openTee(path string) (func() error, error) {
+	if path == "" {
+		return func() error { return nil }, nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	this.Tee = file
+	return func() error {
+		this.Tee = nil
+		return file.Close()
+	}, nil
+}
+
+// Copy what's written to writer to the tee file, if one is open
+func (this *ButterfishCtx) teeWriter(writer io.Writer) io.Writer {
+	if this.Tee == nil {
+		return writer
+	}
+	return io.MultiWriter(this.Tee, writer)
+}
@@ -0,0 +1,190 @@
+package butterfish
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Some terminals have protocols beyond ANSI that we use in shell mode when
+// we detect them, or when --terminal names one:
+//
+//   - Answers are marked as command output with OSC 133 semantic zones, so
+//     "select/copy last output" in iTerm2, WezTerm, and Kitty copies the
+//     answer. iTerm2 also gets a mark to jump back to the answer with.
+//   - In WezTerm the answer is set as the butterfish_answer user var, so a
+//     key binding in wezterm.lua can copy it.
+//   - Images an answer refers to, e.g. a plot saved by a data analysis
+//     script, are shown inline with the iTerm2 image protocol, which WezTerm
+//     also supports, or the Kitty graphics protocol.
+
+const (
+	TerminalAuto    = "auto"
+	TerminalNone    = "none"
+	TerminalITerm2  = "iterm2"
+	TerminalWezTerm = "wezterm"
+	TerminalKitty   = "kitty"
+)
+
+const (
+	// Images larger than this aren't shown
+	terminalMaxImageBytes = 10 * 1024 * 1024
+	terminalMaxImages     = 4
+	// The Kitty graphics protocol sends base64 data in chunks of this size
+	kittyChunkSize = 4096
+	// Longer answers are cut before being set as a WezTerm user var
+	terminalMaxUserVarBytes = 64 * 1024
+)
+
+// The terminal we're running in, or TerminalNone if it doesn't have any of
+// the protocols we use. Escapes don't pass through tmux without wrapping,
+// so we don't use them there.
+func detectTerminal(getenv func(string) string) string {
+	if getenv("TMUX") != "" {
+		return TerminalNone
+	}
+	switch {
+	case getenv("TERM_PROGRAM") == "iTerm.app":
+		return TerminalITerm2
+	case getenv("TERM_PROGRAM") == "WezTerm":
+		return TerminalWezTerm
+	case getenv("TERM") == "xterm-kitty" || getenv("KITTY_WINDOW_ID") != "":
+		return TerminalKitty
+	}
+	return TerminalNone
+}
+
+// TerminalProtocols writes terminal specific escapes around answers
+type TerminalProtocols struct {
+	Kind string
+	Out  io.Writer
+	// set between AnswerStart and AnswerEnd, goal mode answers aren't marked
+	answering bool
+}
+
+// Protocols for the terminal named by setting, auto detects it. Returns nil
+// if the terminal doesn't have any we use.
+func NewTerminalProtocols(setting string, out io.Writer) *TerminalProtocols {
+	kind := setting
+	if kind == "" || kind == TerminalAuto {
+		kind = detectTerminal(os.Getenv)
+	}
+	if kind == TerminalNone {
+		return nil
+	}
+	return &TerminalProtocols{Kind: kind, Out: out}
+}
+
+func osc(body string) string {
+	return "\x1b]" + body + "\x07"
+}
+
+// Called before an answer is printed
+func (this *TerminalProtocols) AnswerStart() {
+	if this.Kind == TerminalITerm2 {
+		fmt.Fprint(this.Out, osc("1337;SetMark"))
+	}
+	fmt.Fprint(this.Out, osc("133;C"))
+	this.answering = true
+}
+
+// Called once an answer is printed, cwd is where relative image paths are
+// looked up
+func (this *TerminalProtocols) AnswerEnd(answer, cwd string) {
+	if this.answering {
+		fmt.Fprint(this.Out, osc("133;D;0"))
+		this.answering = false
+	}
+	if this.Kind == TerminalWezTerm {
+		if len(answer) > terminalMaxUserVarBytes {
+			answer = strings.ToValidUTF8(answer[:terminalMaxUserVarBytes], "")
+		}
+		fmt.Fprint(this.Out, osc("1337;SetUserVar=butterfish_answer="+base64.StdEncoding.EncodeToString([]byte(answer))))
+	}
+
+	for _, path := range answerImages(answer, cwd) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		image := this.inlineImage(filepath.Base(path), data)
+		if image != "" {
+			fmt.Fprintf(this.Out, "%s\r\n", image)
+		}
+	}
+}
+
+// The escape that shows an image inline, empty if the terminal can't show it
+func (this *TerminalProtocols) inlineImage(name string, data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if this.Kind != TerminalKitty {
+		return osc(fmt.Sprintf("1337;File=name=%s;size=%d;inline=1;preserveAspectRatio=1:%s",
+			base64.StdEncoding.EncodeToString([]byte(name)), len(data), encoded))
+	}
+
+	// Kitty only takes PNGs without decoding them ourselves
+	if !strings.EqualFold(filepath.Ext(name), ".png") {
+		return ""
+	}
+	builder := strings.Builder{}
+	for start := 0; start < len(encoded); start += kittyChunkSize {
+		end := min(start+kittyChunkSize, len(encoded))
+		more := 0
+		if end < len(encoded) {
+			more = 1
+		}
+		if start == 0 {
+			fmt.Fprintf(&builder, "\x1b_Ga=T,f=100,m=%d;%s\x1b\\", more, encoded[start:end])
+		} else {
+			fmt.Fprintf(&builder, "\x1b_Gm=%d;%s\x1b\\", more, encoded[start:end])
+		}
+	}
+	return builder.String()
+}
+
+var (
+	markdownImageRegex = regexp.MustCompile(`!\[[^\]]*\]\(([^)\s]+)\)`)
+	imagePathRegex     = regexp.MustCompile(`(?i)(?:^|[\s'"` + "`" + `(])((?:~|\.{1,2})?/?[\w./-]*\w\.(?:png|jpe?g|gif))\b`)
+)
+
+// Existing image files an answer refers to, by markdown image or by path
+func answerImages(answer, cwd string) []string {
+	candidates := []string{}
+	for _, match := range markdownImageRegex.FindAllStringSubmatch(answer, -1) {
+		candidates = append(candidates, match[1])
+	}
+	for _, match := range imagePathRegex.FindAllStringSubmatch(answer, -1) {
+		candidates = append(candidates, match[1])
+	}
+
+	images := []string{}
+	seen := map[string]bool{}
+	for _, candidate := range candidates {
+		path, err := homedir.Expand(strings.TrimPrefix(candidate, "file://"))
+		if err != nil {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cwd, path)
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || info.Size() > terminalMaxImageBytes {
+			continue
+		}
+		images = append(images, path)
+		if len(images) == terminalMaxImages {
+			break
+		}
+	}
+	return images
+}
@@ -0,0 +1,178 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Ways of showing LLM answers when running inside tmux
+const (
+	TmuxModePane  = "pane"
+	TmuxModePopup = "popup"
+)
+
+// The number of lines of scrollback to capture when sending a pane's
+// contents as context
+const tmuxCaptureLines = 200
+
+func InTmux() bool {
+	return os.Getenv("TMUX") != ""
+}
+
+func tmuxCommand(args ...string) (string, error) {
+	cmd := exec.Command("tmux", args...)
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("tmux %s: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("tmux %s: %w", args[0], err)
+	}
+	return string(output), nil
+}
+
+// TmuxAnswers renders LLM answers outside of the main shell pane. Answers are
+// appended to a file which is either followed in a split pane, or opened in a
+// popup after each answer.
+type TmuxAnswers struct {
+	Mode   string
+	Path   string
+	PaneID string
+	file   *os.File
+}
+
+// Create the answer file and, in pane mode, the split pane that follows it
+func NewTmuxAnswers(mode string) (*TmuxAnswers, error) {
+	if mode != TmuxModePane && mode != TmuxModePopup {
+		return nil, fmt.Errorf("Unknown tmux mode %q, expected %s or %s", mode, TmuxModePane, TmuxModePopup)
+	}
+	if !InTmux() {
+		return nil, fmt.Errorf("tmux mode is enabled but we're not running inside tmux")
+	}
+
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("butterfish_answers_%d", os.Getpid()))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	answers := &TmuxAnswers{
+		Mode: mode,
+		Path: path,
+		file: file,
+	}
+
+	if mode == TmuxModePane {
+		paneID, err := tmuxCommand(tmuxSplitArgs(path)...)
+		if err != nil {
+			answers.Close()
+			return nil, err
+		}
+		answers.PaneID = strings.TrimSpace(paneID)
+	}
+
+	return answers, nil
+}
+
+// Arguments to split off a pane that follows the answer file, printing the
+// new pane's ID. -d keeps focus in the current pane.
+func tmuxSplitArgs(path string) []string {
+	return []string{"split-window", "-h", "-d", "-l", "40%",
+		"-P", "-F", "#{pane_id}", "tail -n +1 -f " + path}
+}
+
+// Arguments to open the answer file in a pager scrolled to the end
+func tmuxPopupArgs(path string) []string {
+	return []string{"display-popup", "-E", "-w", "80%", "-h", "80%",
+		"less -R +G " + path}
+}
+
+// Arguments to print the target pane's contents plus recent scrollback, with
+// wrapped lines joined
+func tmuxCaptureArgs(target string) []string {
+	return []string{"capture-pane", "-p", "-J", "-t", target,
+		"-S", fmt.Sprintf("-%d", tmuxCaptureLines)}
+}
+
+// Parse the output of display-message for #{pane_width}, falling back to
+// the given width if it isn't a usable width
+func parseTmuxPaneWidth(output string, fallback int) int {
+	width, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil || width <= 0 {
+		return fallback
+	}
+	return width
+}
+
+func (this *TmuxAnswers) Write(p []byte) (int, error) {
+	return this.file.Write(p)
+}
+
+// The width to wrap answers to, i.e. the answer pane width in pane mode, or
+// the popup width otherwise
+func (this *TmuxAnswers) Width(termWidth int) int {
+	if this.PaneID == "" {
+		return termWidth * 8 / 10
+	}
+
+	output, err := tmuxCommand("display-message", "-p", "-t", this.PaneID, "#{pane_width}")
+	if err != nil {
+		log.Printf("Error getting tmux pane width: %s", err)
+		return termWidth
+	}
+	return parseTmuxPaneWidth(output, termWidth)
+}
+
+// Called when an answer is complete, in popup mode this opens the answer
+// file in a pager scrolled to the end.
+func (this *TmuxAnswers) AnswerDone() {
+	if this.Mode != TmuxModePopup {
+		return
+	}
+
+	// display-popup blocks until the popup is closed, so don't wait on it
+	cmd := exec.Command("tmux", tmuxPopupArgs(this.Path)...)
+	err := cmd.Start()
+	if err != nil {
+		log.Printf("Error opening tmux popup: %s", err)
+		return
+	}
+	go cmd.Wait()
+}
+
+// Close the answer pane and remove the answer file
+func (this *TmuxAnswers) Close() {
+	if this.PaneID != "" {
+		_, err := tmuxCommand("kill-pane", "-t", this.PaneID)
+		if err != nil {
+			log.Printf("Error closing tmux pane: %s", err)
+		}
+	}
+	this.file.Close()
+	os.Remove(this.Path)
+}
+
+// Capture the visible contents plus recent scrollback of a tmux pane. If
+// target is empty we use the marked pane (see tmux select-pane -m), falling
+// back to the last active pane.
+func CaptureTmuxPane(target string) (string, string, error) {
+	if target == "" {
+		target = "{marked}"
+		_, err := tmuxCommand("display-message", "-p", "-t", target, "#{pane_id}")
+		if err != nil {
+			target = "{last}"
+		}
+	}
+
+	output, err := tmuxCommand(tmuxCaptureArgs(target)...)
+	if err != nil {
+		return "", target, err
+	}
+
+	return strings.TrimRight(output, "\n "), target, nil
+}
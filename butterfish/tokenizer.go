@@ -0,0 +1,156 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/bakks/tiktoken-go"
+)
+
+// Tokenizer counts and truncates text in the tokens of a specific model, so
+// that we can fit prompts into a model's context window
+type Tokenizer interface {
+	// The name of the encoding, tokenizations are cached by this name
+	Name() string
+	// Returns false if the token count is an estimate
+	Exact() bool
+	CountTokens(text string) int
+	// Truncate text to at most maxTokens, returns the number of tokens in the
+	// result, the result, and whether the text was truncated
+	Truncate(text string, maxTokens int) (int, string, bool)
+}
+
+// A Tokenizer for OpenAI models using the model's tiktoken encoding
+type TiktokenTokenizer struct {
+	encoder *tiktoken.Tiktoken
+}
+
+func (this *TiktokenTokenizer) Name() string {
+	return this.encoder.EncoderName()
+}
+
+func (this *TiktokenTokenizer) Exact() bool {
+	return true
+}
+
+func (this *TiktokenTokenizer) CountTokens(text string) int {
+	return len(this.encoder.Encode(text, nil, nil))
+}
+
+func (this *TiktokenTokenizer) Truncate(text string, maxTokens int) (int, string, bool) {
+	tokens := this.encoder.Encode(text, nil, nil)
+	if len(tokens) <= maxTokens {
+		return len(tokens), text, false
+	}
+	tokens = tokens[:maxTokens]
+	return len(tokens), this.encoder.Decode(tokens), true
+}
+
+// A Tokenizer that estimates tokens from the number of characters, for models
+// we don't have a local tokenizer for
+type ApproxTokenizer struct {
+	CharsPerToken float64
+}
+
+func NewApproxTokenizer(charsPerToken float64) *ApproxTokenizer {
+	return &ApproxTokenizer{CharsPerToken: charsPerToken}
+}
+
+func (this *ApproxTokenizer) Name() string {
+	return fmt.Sprintf("approx_%g", this.CharsPerToken)
+}
+
+func (this *ApproxTokenizer) Exact() bool {
+	return false
+}
+
+func (this *ApproxTokenizer) CountTokens(text string) int {
+	chars := utf8.RuneCountInString(text)
+	return int(math.Ceil(float64(chars) / this.CharsPerToken))
+}
+
+func (this *ApproxTokenizer) Truncate(text string, maxTokens int) (int, string, bool) {
+	count := this.CountTokens(text)
+	if count <= maxTokens {
+		return count, text, false
+	}
+
+	maxChars := int(float64(maxTokens) * this.CharsPerToken)
+	chars := 0
+	for i := range text {
+		if chars == maxChars {
+			text = text[:i]
+			break
+		}
+		chars++
+	}
+	return this.CountTokens(text), text, true
+}
+
+// Other providers don't publish tokenizers we can run locally, for their
+// models we estimate with a rough characters-per-token ratio
+var providerCharsPerToken = map[string]float64{
+	"claude":  3.5,
+	"gemini":  4,
+	"llama":   3.8,
+	"mistral": 3.7,
+}
+
+// The ratio used when we can't load an encoding at all
+const defaultCharsPerToken = 4
+
+var tokenizers = map[string]Tokenizer{}
+var tokenizersMutex sync.Mutex
+
+// Get the tokenizer for a model, tokenizers are cached. For OpenAI models we
+// use the model's tiktoken encoding, falling back to the encoding of
+// DEFAULT_PROMPT_ENCODER for models tiktoken doesn't know about, and for other
+// providers we estimate.
+func TokenizerForModel(model string) Tokenizer {
+	tokenizersMutex.Lock()
+	defer tokenizersMutex.Unlock()
+
+	tokenizer, ok := tokenizers[model]
+	if ok {
+		return tokenizer
+	}
+
+	tokenizer = newTokenizerForModel(model)
+	tokenizers[model] = tokenizer
+	return tokenizer
+}
+
+// The token ids of text in the model's tiktoken encoding, an error if
+// tiktoken doesn't know the model
+func tokenIDsForModel(model, text string) ([]int, error) {
+	encoder, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		return nil, fmt.Errorf("the token ids of %s aren't known", model)
+	}
+	return encoder.Encode(text, nil, nil), nil
+}
+
+func newTokenizerForModel(model string) Tokenizer {
+	lowerModel := strings.ToLower(model)
+	for provider, charsPerToken := range providerCharsPerToken {
+		if strings.Contains(lowerModel, provider) {
+			return NewApproxTokenizer(charsPerToken)
+		}
+	}
+
+	encoder, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		encoder, err = tiktoken.EncodingForModel(DEFAULT_PROMPT_ENCODER)
+	}
+	if err != nil {
+		// the encodings are downloaded on first use, so this can fail offline
+		log.Printf("Warning: unable to load a tokenizer for model %s, estimating tokens: %s", model, err)
+		return NewApproxTokenizer(defaultCharsPerToken)
+	}
+
+	return &TiktokenTokenizer{encoder: encoder}
+}
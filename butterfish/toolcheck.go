@@ -0,0 +1,378 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// Before gencmd shows a command we check that the programs it runs are
+// installed. If some aren't, the model is asked for an alternative that uses
+// installed tools, and failing that we offer to install them with the
+// system's package manager.
+
+// Shell builtins, which aren't found on the PATH
+var shellBuiltins = map[string]bool{
+	".": true, ":": true, "[": true, "[[": true, "alias": true, "bg": true,
+	"bind": true, "break": true, "builtin": true, "case": true, "cd": true,
+	"continue": true, "declare": true, "done": true, "echo": true,
+	"esac": true, "eval": true, "exit": true, "export": true, "false": true,
+	"fg": true, "fi": true, "for": true, "function": true, "getopts": true,
+	"hash": true, "in": true, "jobs": true, "kill": true, "let": true,
+	"local": true, "popd": true, "printf": true, "pushd": true, "pwd": true,
+	"read": true, "readonly": true, "return": true, "select": true,
+	"set": true, "shift": true, "source": true, "test": true, "trap": true,
+	"true": true, "type": true, "typeset": true, "ulimit": true,
+	"umask": true, "unalias": true, "unset": true, "wait": true, "}": true,
+}
+
+// Keywords that can come before a command, e.g. "then ls"
+var shellKeywords = map[string]bool{
+	"if": true, "then": true, "do": true, "else": true, "elif": true,
+	"while": true, "until": true, "!": true, "{": true,
+}
+
+// Programs that run the command given as their next argument
+var commandWrappers = map[string]bool{
+	"sudo": true, "env": true, "time": true, "nohup": true, "nice": true,
+	"xargs": true, "watch": true, "exec": true, "command": true,
+}
+
+// The options of each wrapper that take the next word as their argument,
+// e.g. sudo -u root, so that the argument isn't taken for the program
+var wrapperArgOptions = map[string]map[string]bool{
+	"sudo": {
+		"-u": true, "--user": true, "-g": true, "--group": true, "-h": true,
+		"--host": true, "-p": true, "--prompt": true, "-C": true,
+		"--close-from": true, "-D": true, "--chdir": true, "-r": true,
+		"--role": true, "-t": true, "--type": true, "-U": true,
+		"--other-user": true, "-T": true, "--command-timeout": true,
+	},
+	"env":  {"-u": true, "--unset": true, "-C": true, "--chdir": true, "-P": true},
+	"time": {"-f": true, "--format": true, "-o": true, "--output": true},
+	"nice": {"-n": true, "--adjustment": true},
+	"xargs": {
+		"-a": true, "--arg-file": true, "-d": true, "--delimiter": true,
+		"-E": true, "-I": true, "-L": true, "--max-lines": true, "-n": true,
+		"--max-args": true, "-P": true, "--max-procs": true, "-s": true,
+		"--max-chars": true,
+	},
+	"watch": {"-n": true, "--interval": true},
+	"exec":  {"-a": true},
+}
+
+var shellAssignmentRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// Split the words of a simple command into the wrappers like sudo that it
+// starts with, and the program with its arguments. Variable assignments,
+// keywords, function definitions, and the wrappers' options are skipped.
+// fields is empty if there isn't a program.
+func splitWrappers(words []string) (wrappers []string, fields []string) {
+	for i := 0; i < len(words); i++ {
+		word := strings.TrimLeft(words[i], "({")
+		switch {
+		case word == "" || shellKeywords[word] || shellAssignmentRegex.MatchString(word) ||
+			strings.HasSuffix(word, "()"):
+			continue
+		case word == "function":
+			// and the function's name
+			i++
+			continue
+		case commandWrappers[word]:
+			wrappers = append(wrappers, word)
+			i = skipWrapperOptions(word, words, i+1) - 1
+			continue
+		}
+		return wrappers, append([]string{word}, words[i+1:]...)
+	}
+	return wrappers, nil
+}
+
+// The index of the first word after a wrapper's options, starting from i
+func skipWrapperOptions(wrapper string, words []string, i int) int {
+	for ; i < len(words); i++ {
+		word := words[i]
+		switch {
+		case word == "--":
+			return i + 1
+		case wrapper == "env" && shellAssignmentRegex.MatchString(word):
+			// env takes assignments before the program
+		case !strings.HasPrefix(word, "-") || word == "-":
+			return i
+		case wrapperArgOptions[wrapper][word]:
+			i++
+		}
+	}
+	return i
+}
+
+// Shell functions defined in a command, e.g. mkcd in
+// "mkcd() { mkdir -p $1 && cd $1; }; mkcd build"
+func commandFunctions(command string) map[string]bool {
+	functions := map[string]bool{}
+	for _, words := range splitShellCommands(command) {
+		for i, word := range words {
+			if name, ok := strings.CutSuffix(word, "()"); ok && name != "" {
+				functions[name] = true
+			} else if word == "function" && i+1 < len(words) {
+				functions[strings.TrimSuffix(words[i+1], "()")] = true
+			}
+		}
+	}
+	return functions
+}
+
+// The programs a command line runs, in order without duplicates. Builtins,
+// functions the command defines, variable expansions, and relative or
+// absolute paths are skipped.
+func commandBinaries(command string) []string {
+	binaries := []string{}
+	seen := map[string]bool{}
+	functions := commandFunctions(command)
+	add := func(binary string) {
+		if !seen[binary] {
+			seen[binary] = true
+			binaries = append(binaries, binary)
+		}
+	}
+
+	for _, words := range splitShellCommands(command) {
+		wrappers, fields := splitWrappers(words)
+		for _, wrapper := range wrappers {
+			if wrapper != "time" && wrapper != "exec" && wrapper != "command" {
+				add(wrapper)
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		program := fields[0]
+		if !shellBuiltins[program] && !functions[program] &&
+			!strings.ContainsAny(program, "/$`") && !strings.HasPrefix(program, ">") {
+			add(program)
+		}
+	}
+	return binaries
+}
+
+// The programs a command runs that aren't on the PATH
+func missingBinaries(command string) []string {
+	missing := []string{}
+	for _, binary := range commandBinaries(command) {
+		_, err := exec.LookPath(binary)
+		if err != nil {
+			missing = append(missing, binary)
+		}
+	}
+	return missing
+}
+
+// The names that the user's interactive shell defines as aliases or
+// functions, of those given, which aren't on the PATH but do run
+func shellDefinedNames(ctx context.Context, shell string, names []string) map[string]bool {
+	defined := map[string]bool{}
+	if shell == "" || len(names) == 0 {
+		return defined
+	}
+	quoted := []string{}
+	for _, name := range names {
+		quoted = append(quoted, "'"+strings.ReplaceAll(name, "'", `'\''`)+"'")
+	}
+	script := fmt.Sprintf(`for name in %s; do type "$name" >/dev/null 2>&1 && echo "$name"; done`,
+		strings.Join(quoted, " "))
+
+	ctx, cancel := context.WithTimeout(ctx, shellProfileTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, shell, "-i", "-c", script)
+	cmd.WaitDelay = time.Second
+	output, err := cmd.Output()
+	if err != nil && len(output) == 0 {
+		log.Printf("Error checking for aliases and functions with %s: %s", shell, err)
+		return defined
+	}
+	for _, name := range strings.Fields(string(output)) {
+		defined[name] = true
+	}
+	return defined
+}
+
+// The programs a command runs that aren't on the PATH and aren't aliases or
+// functions of the user's shell
+func (this *ButterfishCtx) missingCommandBinaries(command string) []string {
+	missing := missingBinaries(command)
+	if len(missing) == 0 {
+		return missing
+	}
+	defined := shellDefinedNames(this.Ctx, this.shellPath(), missing)
+	filtered := []string{}
+	for _, binary := range missing {
+		if !defined[binary] {
+			filtered = append(filtered, binary)
+		}
+	}
+	return filtered
+}
+
+// Package names for programs whose package is named differently, per
+// package manager, the empty key applies to all of them
+var toolPackages = map[string]map[string]string{
+	"rg":    {"": "ripgrep"},
+	"ag":    {"": "the_silver_searcher", "apt": "silversearcher-ag"},
+	"fd":    {"apt": "fd-find"},
+	"http":  {"": "httpie"},
+	"delta": {"": "git-delta"},
+	"btm":   {"": "bottom"},
+	"nvim":  {"": "neovim"},
+}
+
+// The package managers we know how to install with, in order of preference,
+// with the command to install packages
+var packageManagers = []struct {
+	Name    string
+	Install string
+}{
+	{"brew", "brew install"},
+	{"apt", "sudo apt install"},
+	{"dnf", "sudo dnf install"},
+	{"yum", "sudo yum install"},
+	{"pacman", "sudo pacman -S"},
+	{"zypper", "sudo zypper install"},
+	{"apk", "sudo apk add"},
+	{"port", "sudo port install"},
+	{"winget", "winget install"},
+}
+
+// The first package manager on the PATH, brew is only used on macOS
+func detectPackageManager() string {
+	for _, manager := range packageManagers {
+		if manager.Name == "brew" && runtime.GOOS != "darwin" {
+			continue
+		}
+		_, err := exec.LookPath(manager.Name)
+		if err == nil {
+			return manager.Name
+		}
+	}
+	return ""
+}
+
+// A command to install programs with a package manager, or an empty string
+// if we don't know the package manager
+func installCommand(manager string, binaries []string) string {
+	for _, candidate := range packageManagers {
+		if candidate.Name != manager {
+			continue
+		}
+		packages := []string{}
+		for _, binary := range binaries {
+			name := binary
+			if names, ok := toolPackages[binary]; ok {
+				if names[manager] != "" {
+					name = names[manager]
+				} else if names[""] != "" {
+					name = names[""]
+				}
+			}
+			packages = append(packages, name)
+		}
+		return candidate.Install + " " + strings.Join(packages, " ")
+	}
+	return ""
+}
+
+// Ask the model to rewrite a command without the missing programs, returns
+// an empty string if it can't
+func (this *ButterfishCtx) alternativeCommand(description, command string, missing []string) (string, error) {
+	tools := findProfileTools(os.Getenv("PATH"))
+	promptStr, err := this.GetPrompt(prompt.PromptGenerateAlternative,
+		"content", description,
+		"command", command,
+		"missing", strings.Join(missing, ", "),
+		"tools", strings.Join(tools, ", "))
+	if err != nil {
+		return "", err
+	}
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := this.LLMClient.Completion(&util.CompletionRequest{
+		Ctx:              this.Ctx,
+		Prompt:           promptStr,
+		PromptName:       prompt.PromptGenerateAlternative,
+		Model:            this.Config.GencmdModel,
+		MaxTokens:        this.Config.GencmdMaxTokens,
+		Temperature:      requestTemperature(this.Config.GencmdTemperature),
+		TopP:             this.Config.GencmdTopP,
+		Stop:             this.Config.GencmdStop,
+		LogitBias:        this.Config.GencmdLogitBias,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.PromptSystemMessage,
+		Task:             TaskGencmd,
+		TokenTimeout:     this.Config.TokenTimeout,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	alternative := strings.TrimSpace(resp.Completion)
+	if alternative == "NONE" || len(this.missingCommandBinaries(alternative)) > 0 {
+		return "", nil
+	}
+	return alternative, nil
+}
+
+// Check that a generated command can run. If it uses programs that aren't
+// installed we try an alternative from the model, then offer to install the
+// programs. Returns the command to show, which is the original if no
+// alternative was found.
+func (this *ButterfishCtx) ensureRunnableCommand(description, command string, force bool) (string, error) {
+	missing := this.missingCommandBinaries(command)
+	if len(missing) == 0 {
+		return command, nil
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "%s\n", command)
+	this.StylePrintf(this.Config.Styles.Error, "Not installed: %s\n", strings.Join(missing, ", "))
+
+	alternative, err := this.alternativeCommand(description, command, missing)
+	if err != nil {
+		return "", err
+	}
+	if alternative != "" {
+		this.StylePrintf(this.Config.Styles.Grey, "Using installed tools instead:\n")
+		this.updateCommandRegister(alternative)
+		return alternative, nil
+	}
+
+	install := installCommand(GetPlatform().PackageManager, missing)
+	if install == "" {
+		return "", fmt.Errorf("No alternative found, and no package manager to install %s", strings.Join(missing, ", "))
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "No alternative with installed tools, you can install them with:\n")
+	this.StylePrintf(this.Config.Styles.Highlight, "%s\n", install)
+	if force {
+		// we don't install packages without asking
+		return "", errors.New("Not running a command that uses programs that aren't installed")
+	}
+
+	ok, err := this.confirm("Run the install command?")
+	if err != nil || !ok {
+		return command, err
+	}
+	_, err = this.execCommand(install)
+	if err != nil {
+		return "", err
+	}
+	return command, nil
+}
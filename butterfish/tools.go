@@ -0,0 +1,343 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/mitchellh/go-ps"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// Tools available to the model in goal mode. run_command, user_input, and
+// finish interact with the shell and the user, the others are run locally
+// and their results are sent straight back to the model.
+const (
+	toolRunCommand  = "run_command"
+	toolUserInput   = "user_input"
+	toolFinish      = "finish"
+	toolReadFile    = "read_file"
+	toolListDir     = "list_dir"
+	toolSearchIndex = "search_index"
+	toolReadScratch = "read_scratchpad"
+	toolSaveScratch = "write_scratchpad"
+)
+
+// Limits on the output of local tools so we don't blow the context window
+const (
+	toolMaxOutputBytes    = 8000
+	toolMaxDirEntries     = 200
+	toolSearchIndexResult = 3
+	toolMaxScratchBytes   = 16000
+)
+
+// The goal mode scratchpad is a markdown file in the root of the project,
+// i.e. the git repo the shell is in, or else the shell's directory. The
+// model uses it to keep notes on long running tasks across sessions.
+const scratchpadFile = ".butterfish_scratchpad.md"
+
+func goalModeTool(name, description string, properties map[string]jsonschema.Definition, required ...string) util.ToolDefinition {
+	return util.ToolDefinition{
+		Type: "function",
+		Function: util.FunctionDefinition{
+			Name:        name,
+			Description: description,
+			Parameters: jsonschema.Definition{
+				Type:       jsonschema.Object,
+				Properties: properties,
+				Required:   required,
+			},
+		},
+	}
+}
+
+var goalModeTools = []util.ToolDefinition{
+	goalModeTool(toolRunCommand,
+		"Run a command in the shell to help achieve your goal",
+		map[string]jsonschema.Definition{
+			"cmd": {
+				Type:        jsonschema.String,
+				Description: "The string command including any arguments, for example 'ls ~'",
+			},
+		}, "cmd"),
+
+	goalModeTool(toolReadFile,
+		"Read the contents of a text file, relative paths are resolved from the shell's current directory",
+		map[string]jsonschema.Definition{
+			"path": {
+				Type:        jsonschema.String,
+				Description: "The path of the file to read",
+			},
+		}, "path"),
+
+	goalModeTool(toolListDir,
+		"List the entries of a directory, directories are shown with a trailing slash",
+		map[string]jsonschema.Definition{
+			"path": {
+				Type:        jsonschema.String,
+				Description: "The directory to list, defaults to the shell's current directory",
+			},
+		}),
+
+	goalModeTool(toolSearchIndex,
+		"Search the embeddings index of the shell's current directory for file excerpts related to a query. Only works for files indexed with 'butterfish index'.",
+		map[string]jsonschema.Definition{
+			"query": {
+				Type:        jsonschema.String,
+				Description: "What to search for, in natural language",
+			},
+		}, "query"),
+
+	goalModeTool(toolReadScratch,
+		"Read the scratchpad for the current project, a markdown file of notes kept across sessions. Read it when starting a goal to pick up any earlier progress on the task.",
+		map[string]jsonschema.Definition{}),
+
+	goalModeTool(toolSaveScratch,
+		"Replace the contents of the scratchpad for the current project. Use it to track the state of a long running task, e.g. the plan, what's done, what's left, and decisions made, so that a later session can continue it.",
+		map[string]jsonschema.Definition{
+			"content": {
+				Type:        jsonschema.String,
+				Description: "The full markdown content of the scratchpad",
+			},
+		}, "content"),
+
+	goalModeTool(toolUserInput,
+		"Resolve an ambiguity in the goal or provide additional information or hand off a goal that can't be accomplished to the user.",
+		map[string]jsonschema.Definition{
+			"question": {
+				Type:        jsonschema.String,
+				Description: "The question to ask the user",
+			},
+		}, "question"),
+
+	goalModeTool(toolFinish,
+		"Finish the goal and exit goal mode, call only if the goal is accomplished or multiple strategies have been attempted and the goal is impossible.",
+		map[string]jsonschema.Definition{
+			"success": {
+				Type:        jsonschema.Boolean,
+				Description: "Whether the goal was accomplished",
+			},
+		}, "success"),
+}
+
+// Returns true if the tool is run locally rather than in the shell
+func isLocalTool(name string) bool {
+	switch name {
+	case toolReadFile, toolListDir, toolSearchIndex, toolReadScratch, toolSaveScratch:
+		return true
+	}
+	return false
+}
+
+type pathParams struct {
+	Path string `json:"path"`
+}
+
+type queryParams struct {
+	Query string `json:"query"`
+}
+
+type scratchpadParams struct {
+	Content string `json:"content"`
+}
+
+// Find the working directory of the child shell so that relative paths match
+// what the model sees when running commands. This only works where /proc is
+// available, otherwise we fall back to our own working directory.
+func shellWorkingDir() string {
+	if runtime.GOOS == "linux" {
+		processes, err := ps.Processes()
+		if err == nil {
+			for _, process := range processes {
+				if process.PPid() != os.Getpid() {
+					continue
+				}
+				dir, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", process.Pid()))
+				if err == nil {
+					return dir
+				}
+			}
+		}
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	return dir
+}
+
+func resolveToolPath(dir, path string) string {
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func truncateToolOutput(output string) string {
+	if len(output) > toolMaxOutputBytes {
+		return output[:toolMaxOutputBytes] +
+			fmt.Sprintf("\n... (truncated, %d bytes total)", len(output))
+	}
+	return output
+}
+
+func readFileTool(dir string, params string) (string, error) {
+	var args pathParams
+	err := json.Unmarshal([]byte(params), &args)
+	if err != nil {
+		return "", err
+	}
+	if args.Path == "" {
+		return "", fmt.Errorf("path is required")
+	}
+
+	data, err := os.ReadFile(resolveToolPath(dir, args.Path))
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsRune(string(data[:min(len(data), 1024)]), 0) {
+		return "", fmt.Errorf("%s looks like a binary file", args.Path)
+	}
+
+	return truncateToolOutput(string(data)), nil
+}
+
+func listDirTool(dir string, params string) (string, error) {
+	var args pathParams
+	if params != "" {
+		err := json.Unmarshal([]byte(params), &args)
+		if err != nil {
+			return "", err
+		}
+	}
+	if args.Path == "" {
+		args.Path = "."
+	}
+
+	entries, err := os.ReadDir(resolveToolPath(dir, args.Path))
+	if err != nil {
+		return "", err
+	}
+
+	builder := strings.Builder{}
+	for i, entry := range entries {
+		if i >= toolMaxDirEntries {
+			fmt.Fprintf(&builder, "... (%d more entries)\n", len(entries)-i)
+			break
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		builder.WriteString(name)
+		builder.WriteString("\n")
+	}
+	if len(entries) == 0 {
+		builder.WriteString("(empty directory)\n")
+	}
+
+	return builder.String(), nil
+}
+
+func (this *ButterfishCtx) searchIndexTool(ctx context.Context, dir string, params string) (string, error) {
+	var args queryParams
+	err := json.Unmarshal([]byte(params), &args)
+	if err != nil {
+		return "", err
+	}
+	if args.Query == "" {
+		return "", fmt.Errorf("query is required")
+	}
+
+	results, err := this.cachedIndex(dir).Search(ctx, args.Query, toolSearchIndexResult)
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return fmt.Sprintf("No indexed files found in %s, the user can index it with 'butterfish index'.", dir), nil
+	}
+
+	builder := strings.Builder{}
+	for _, result := range results {
+		fmt.Fprintf(&builder, "%s (score %0.4f):\n%s\n---\n", result.Citation(), result.Score, result.Content)
+	}
+	return truncateToolOutput(builder.String()), nil
+}
+
+// The scratchpad path for the project containing dir
+func scratchpadPath(ctx context.Context, dir string) string {
+	return filepath.Join(projectRoot(ctx, dir), scratchpadFile)
+}
+
+func readScratchpadTool(ctx context.Context, dir string) (string, error) {
+	path := scratchpadPath(ctx, dir)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Sprintf("The scratchpad %s is empty.", path), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return truncateToolOutput(string(data)), nil
+}
+
+func writeScratchpadTool(ctx context.Context, dir string, params string) (string, error) {
+	var args scratchpadParams
+	err := json.Unmarshal([]byte(params), &args)
+	if err != nil {
+		return "", err
+	}
+	if len(args.Content) > toolMaxScratchBytes {
+		return "", fmt.Errorf("content is %d bytes, the scratchpad is limited to %d, keep it to a summary", len(args.Content), toolMaxScratchBytes)
+	}
+
+	path := scratchpadPath(ctx, dir)
+	err = os.WriteFile(path, []byte(strings.TrimRight(args.Content, "\n")+"\n"), 0644)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Saved the scratchpad to %s.", path), nil
+}
+
+// Run a local tool call and return the output for the model, errors are
+// returned as output so the model can correct itself
+func (this *ButterfishCtx) RunLocalTool(ctx context.Context, toolCall *util.ToolCall) string {
+	dir := shellWorkingDir()
+	params := toolCall.Function.Parameters
+
+	var output string
+	var err error
+	switch toolCall.Function.Name {
+	case toolReadFile:
+		output, err = readFileTool(dir, params)
+	case toolListDir:
+		output, err = listDirTool(dir, params)
+	case toolSearchIndex:
+		output, err = this.searchIndexTool(ctx, dir, params)
+	case toolReadScratch:
+		output, err = readScratchpadTool(ctx, dir)
+	case toolSaveScratch:
+		output, err = writeScratchpadTool(ctx, dir, params)
+	default:
+		err = fmt.Errorf("unknown tool %s", toolCall.Function.Name)
+	}
+
+	if err != nil {
+		return fmt.Sprintf("Error: %s", err)
+	}
+	return output
+}
@@ -0,0 +1,322 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/storage"
+	"github.com/bakks/butterfish/util"
+	"github.com/mitchellh/go-homedir"
+)
+
+// The wrapped shell saves its session here when it exits so that it can be
+// exported later with `butterfish transcript export`
+const defaultSessionPath = "~/.config/butterfish/last_session.json"
+
+const (
+	transcriptFormatMarkdown = "markdown"
+	transcriptFormatHTML     = "html"
+)
+
+// Types of transcript entries, these mirror the history types
+const (
+	transcriptPrompt      = "prompt"
+	transcriptShellInput  = "shell_input"
+	transcriptShellOutput = "shell_output"
+	transcriptLLMOutput   = "llm_output"
+	transcriptToolOutput  = "tool_output"
+)
+
+// A single block of a shell session
+type TranscriptEntry struct {
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	// The function or tool that produced the output, if any
+	Name string `json:"name,omitempty"`
+}
+
+// A record of a wrapped shell session, i.e. the commands run, their output,
+// and the exchanges with the LLM
+type Transcript struct {
+	Started time.Time         `json:"started"`
+	Shell   string            `json:"shell"`
+	Entries []TranscriptEntry `json:"entries"`
+}
+
+func transcriptEntryType(historyType int) string {
+	switch historyType {
+	case historyTypePrompt:
+		return transcriptPrompt
+	case historyTypeShellInput:
+		return transcriptShellInput
+	case historyTypeLLMOutput:
+		return transcriptLLMOutput
+	case historyTypeFunctionOutput, historyTypeToolOutput:
+		return transcriptToolOutput
+	default:
+		return transcriptShellOutput
+	}
+}
+
+// Convert the shell history to transcript entries, stripping terminal escape
+// sequences from the content
+func (this *ShellHistory) TranscriptEntries() []TranscriptEntry {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entries := []TranscriptEntry{}
+	for _, block := range this.Blocks {
+		content := sanitizeTTYString(block.Content.String())
+		content = strings.ReplaceAll(content, "\r", "")
+
+		// include the tool calls the LLM made so the transcript shows what it ran
+		for _, call := range block.ToolCalls {
+			content += fmt.Sprintf("\n[%s %s]", call.Function.Name, call.Function.Parameters)
+		}
+		if block.FunctionName != "" && block.Type == historyTypeLLMOutput {
+			content += fmt.Sprintf("\n[%s %s]", block.FunctionName, block.FunctionParams)
+		}
+
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+
+		entry := TranscriptEntry{
+			Type:    transcriptEntryType(block.Type),
+			Content: strings.Trim(content, "\n"),
+		}
+		if entry.Type == transcriptToolOutput {
+			entry.Name = block.FunctionName
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Load a saved session, the cipher may be nil if encryption is off
+func LoadTranscript(path string, cipher *util.Cipher) (*Transcript, error) {
+	return LoadTranscriptFrom(storage.NewDiskStore(""), path, cipher)
+}
+
+// Load a session saved in a store, keyed by path
+func LoadTranscriptFrom(store storage.Store, path string, cipher *util.Cipher) (*Transcript, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := store.Get(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = cipher.Decrypt(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading session %s: %w", path, err)
+	}
+	data, err = util.Decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error decompressing session %s: %w", path, err)
+	}
+
+	transcript := &Transcript{}
+	err = json.Unmarshal(data, transcript)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing session %s: %w", path, err)
+	}
+	return transcript, nil
+}
+
+// Save the session compressed, and encrypted if the cipher isn't nil
+func (this *Transcript) Save(path string, cipher *util.Cipher) error {
+	return this.SaveTo(storage.NewDiskStore(""), path, cipher)
+}
+
+// Save the session to a store, keyed by path
+func (this *Transcript) SaveTo(store storage.Store, path string, cipher *util.Cipher) error {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+	// compress first, encrypted data doesn't compress
+	data, err = util.Compress(data)
+	if err != nil {
+		return err
+	}
+	data, err = cipher.Encrypt(data)
+	if err != nil {
+		return err
+	}
+	// sessions can contain secrets printed in the shell, the disk store
+	// writes files only the user can read
+	return store.Put(context.Background(), path, data)
+}
+
+// Pick the format from a file extension, defaulting to markdown
+func TranscriptFormatForPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		return transcriptFormatHTML
+	default:
+		return transcriptFormatMarkdown
+	}
+}
+
+func (this *Transcript) Render(format string) (string, error) {
+	switch format {
+	case transcriptFormatMarkdown:
+		return this.Markdown(), nil
+	case transcriptFormatHTML:
+		return this.HTML(), nil
+	default:
+		return "", fmt.Errorf("Unknown transcript format %s, use markdown or html", format)
+	}
+}
+
+// A code fence that's longer than any run of backticks in the content
+func markdownFence(content string) string {
+	fence := "```"
+	for strings.Contains(content, fence) {
+		fence += "`"
+	}
+	return fence
+}
+
+func (this *Transcript) header() string {
+	return fmt.Sprintf("Shell: %s, started %s", this.Shell, this.Started.Format(time.RFC1123))
+}
+
+func (this *Transcript) Markdown() string {
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "# Butterfish session\n\n%s\n", this.header())
+
+	for _, entry := range this.Entries {
+		builder.WriteString("\n")
+		switch entry.Type {
+		case transcriptPrompt:
+			fmt.Fprintf(&builder, "> **Prompt:** %s\n", strings.ReplaceAll(entry.Content, "\n", "\n> "))
+		case transcriptLLMOutput:
+			fmt.Fprintf(&builder, "%s\n", entry.Content)
+		case transcriptShellInput:
+			fence := markdownFence(entry.Content)
+			fmt.Fprintf(&builder, "%sconsole\n$ %s\n%s\n", fence, entry.Content, fence)
+		case transcriptToolOutput:
+			fence := markdownFence(entry.Content)
+			fmt.Fprintf(&builder, "**Output of %s:**\n\n%s\n%s\n%s\n", entry.Name, fence, entry.Content, fence)
+		default:
+			fence := markdownFence(entry.Content)
+			fmt.Fprintf(&builder, "%s\n%s\n%s\n", fence, entry.Content, fence)
+		}
+	}
+	return builder.String()
+}
+
+const transcriptHTMLStyle = `body { font-family: sans-serif; max-width: 60em; margin: 2em auto; }
+pre { background: #282828; color: #ebdbb2; padding: 0.5em; overflow-x: auto; }
+.prompt { border-left: 3px solid #458588; padding-left: 0.5em; }
+.answer { white-space: pre-wrap; }`
+
+func (this *Transcript) HTML() string {
+	builder := strings.Builder{}
+	fmt.Fprintf(&builder, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Butterfish session</title>\n<style>\n%s\n</style>\n</head>\n<body>\n", transcriptHTMLStyle)
+	fmt.Fprintf(&builder, "<h1>Butterfish session</h1>\n<p>%s</p>\n", html.EscapeString(this.header()))
+
+	for _, entry := range this.Entries {
+		content := html.EscapeString(entry.Content)
+		switch entry.Type {
+		case transcriptPrompt:
+			fmt.Fprintf(&builder, "<p class=\"prompt\"><b>Prompt:</b> %s</p>\n", content)
+		case transcriptLLMOutput:
+			fmt.Fprintf(&builder, "<div class=\"answer\">%s</div>\n", content)
+		case transcriptShellInput:
+			fmt.Fprintf(&builder, "<pre>$ %s</pre>\n", content)
+		case transcriptToolOutput:
+			fmt.Fprintf(&builder, "<p><b>Output of %s:</b></p>\n<pre>%s</pre>\n", html.EscapeString(entry.Name), content)
+		default:
+			fmt.Fprintf(&builder, "<pre>%s</pre>\n", content)
+		}
+	}
+
+	builder.WriteString("</body>\n</html>\n")
+	return builder.String()
+}
+
+func (this *ButterfishCtx) transcriptExportCommand(options *CliCommandConfig) error {
+	export := options.Transcript.Export
+	transcript, err := LoadTranscriptFrom(this.store(), export.Session, this.Cipher)
+	if err != nil {
+		return err
+	}
+
+	format := export.Format
+	if format == "" {
+		format = TranscriptFormatForPath(export.Output)
+	}
+	output, err := transcript.Render(format)
+	if err != nil {
+		return err
+	}
+
+	if export.Output == "" {
+		this.Printf("%s", output)
+		return nil
+	}
+	return os.WriteFile(export.Output, []byte(output), 0600)
+}
+
+// Build a transcript of the current session
+func (this *ShellState) Transcript() *Transcript {
+	return &Transcript{
+		Started: this.SessionStart,
+		Shell:   this.Butterfish.shellName(),
+		Entries: this.History.TranscriptEntries(),
+	}
+}
+
+// Save the session so it can be exported after the shell exits
+func (this *ShellState) SaveSession() {
+	err := this.Transcript().SaveTo(this.Butterfish.store(), defaultSessionPath, this.Butterfish.Cipher)
+	if err != nil {
+		log.Printf("Error saving session: %s", err)
+	}
+}
+
+// Write a transcript of the session to a markdown or html file, by default a
+// timestamped markdown file in the shell's working directory
+func (this *ShellState) ExportTranscript(path string) {
+	if path == "" {
+		path = fmt.Sprintf("butterfish-transcript-%s.md", time.Now().Format("20060102-150405"))
+	}
+	path, err := homedir.Expand(path)
+	if err == nil && !filepath.IsAbs(path) {
+		path = filepath.Join(shellWorkingDir(), path)
+	}
+
+	var text string
+	if err == nil {
+		var output string
+		output, err = this.Transcript().Render(TranscriptFormatForPath(path))
+		if err == nil {
+			err = os.WriteFile(path, []byte(output), 0600)
+		}
+	}
+	if err != nil {
+		text = fmt.Sprintf("Could not export transcript: %s\n", err)
+	} else {
+		text = fmt.Sprintf("Exported transcript to %s\n", path)
+	}
+
+	fmt.Fprintf(this.ParentOut, "%s%s%s", this.Color.Answer,
+		strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+	this.SendPromptResponse("")
+}
@@ -0,0 +1,237 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// With --speak, or after !speak on, short shell answers are read aloud. Text
+// is spoken with the OS speech synthesizer (say, espeak-ng, espeak, or
+// spd-say) or, with tts: api in the speech section of the config file, the
+// provider's speech API, e.g.
+//
+//	speech:
+//	  tts: api
+//	  voice: nova
+//
+// Code blocks aren't read, and answers that are still longer than
+// speak_max_chars aren't read at all. A new answer or the interrupt key
+// stops the one being read.
+
+const (
+	TTSSystem = "system"
+	TTSAPI    = "api"
+
+	defaultTTSModel      = openai.TTSModel1
+	defaultTTSVoice      = openai.VoiceAlloy
+	defaultSpeakMaxChars = 600
+)
+
+// The command that reads text on stdin aloud, using the first speech
+// synthesizer that's installed
+func speakCommand(config *SpeechConfig, lookPath func(string) (string, error)) ([]string, error) {
+	if config != nil && config.SpeakCommand != "" {
+		return []string{"sh", "-c", config.SpeakCommand}, nil
+	}
+	synthesizers := [][]string{
+		{"say"},
+		{"espeak-ng", "--stdin"},
+		{"espeak", "--stdin"},
+		{"spd-say", "-w", "-e"},
+	}
+	for _, synthesizer := range synthesizers {
+		if _, err := lookPath(synthesizer[0]); err == nil {
+			return synthesizer, nil
+		}
+	}
+	return nil, errors.New("No speech synthesizer found, install espeak-ng, set speech.speak_command, or set speech.tts to api in the config file")
+}
+
+// The command that plays the WAV file at path
+func playerCommand(path string, lookPath func(string) (string, error)) ([]string, error) {
+	players := [][]string{
+		{"afplay", path},
+		{"paplay", path},
+		{"aplay", "-q", path},
+		{"ffplay", "-nodisp", "-autoexit", "-loglevel", "error", path},
+	}
+	for _, player := range players {
+		if _, err := lookPath(player[0]); err == nil {
+			return player, nil
+		}
+	}
+	return nil, errors.New("No audio player found, install alsa-utils or ffmpeg")
+}
+
+var (
+	speakCodeBlockRegex = regexp.MustCompile("(?s)```.*?(```|$)")
+	speakLinkRegex      = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+	speakMarkupRegex    = regexp.MustCompile("(?m)^\\s*(#+|>|[-*+]|\\d+\\.)\\s+|[*`~]+")
+)
+
+// The text of an answer to read aloud, without code blocks and markdown.
+// Returns an empty string if there's nothing to read or it's longer than
+// maxChars.
+func speakableText(answer string, maxChars int) string {
+	text := speakCodeBlockRegex.ReplaceAllString(answer, " ")
+	text = speakLinkRegex.ReplaceAllString(text, "$1")
+	text = speakMarkupRegex.ReplaceAllString(text, "")
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > maxChars {
+		return ""
+	}
+	return text
+}
+
+// Read text aloud, returns once it's been read or ctx is done
+func (this *ButterfishCtx) speak(ctx context.Context, text string) error {
+	config := this.Config.Speech
+	if config == nil {
+		config = &SpeechConfig{}
+	}
+
+	var args []string
+	if config.TTS == TTSAPI {
+		dir, err := os.MkdirTemp("", "butterfish-speech")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "answer.wav")
+		err = this.synthesizeSpeech(ctx, text, path)
+		if err != nil {
+			return err
+		}
+		args, err = playerCommand(path, exec.LookPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+		args, err = speakCommand(config, exec.LookPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	// a speak_command runs under sh, stopping it stops the synthesizer
+	setProcessGroup(cmd)
+	output, err := cmd.CombinedOutput()
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("Error running %s: %s %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Write the speech API's reading of text to a WAV file at path
+func (this *ButterfishCtx) synthesizeSpeech(ctx context.Context, text, path string) error {
+	config := this.Config.Speech
+	model := openai.SpeechModel(config.TTSModel)
+	if model == "" {
+		model = defaultTTSModel
+	}
+	voice := openai.SpeechVoice(config.Voice)
+	if voice == "" {
+		voice = defaultTTSVoice
+	}
+
+	gpt := NewGPT(this.Config.OpenAIToken, this.Config.BaseURL)
+	response, err := gpt.client.CreateSpeech(ctx, openai.CreateSpeechRequest{
+		Model:          model,
+		Input:          text,
+		Voice:          voice,
+		ResponseFormat: openai.SpeechResponseFormatWav,
+	})
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, response)
+	return err
+}
+
+// AnswerSpeaker reads answers aloud one at a time, a new answer stops the
+// one being read
+type AnswerSpeaker struct {
+	Butterfish *ButterfishCtx
+	cancel     context.CancelFunc
+	mutex      sync.Mutex
+}
+
+// Start reading an answer aloud if it's short enough, returns right away
+func (this *AnswerSpeaker) Speak(answer string) {
+	maxChars := defaultSpeakMaxChars
+	if config := this.Butterfish.Config.Speech; config != nil && config.SpeakMaxChars > 0 {
+		maxChars = config.SpeakMaxChars
+	}
+	text := speakableText(answer, maxChars)
+	if text == "" {
+		log.Printf("Not reading answer aloud, it's empty or longer than %d characters", maxChars)
+		return
+	}
+
+	this.Stop()
+	this.mutex.Lock()
+	ctx, cancel := context.WithCancel(this.Butterfish.Ctx)
+	this.cancel = cancel
+	this.mutex.Unlock()
+
+	bf := this.Butterfish.snapshot()
+	go func() {
+		defer cancel()
+		err := bf.speak(ctx, text)
+		if err != nil {
+			log.Printf("Error reading answer aloud: %s", err)
+		}
+	}()
+}
+
+// Stop reading the current answer
+func (this *AnswerSpeaker) Stop() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.cancel != nil {
+		this.cancel()
+		this.cancel = nil
+	}
+}
+
+func (this *ShellState) ToggleSpeak(args []string) {
+	switch {
+	case len(args) > 0 && args[0] == "on":
+		this.SpeakEnabled = true
+	case len(args) > 0 && args[0] == "off":
+		this.SpeakEnabled = false
+	default:
+		this.SpeakEnabled = !this.SpeakEnabled
+	}
+
+	text := "Reading answers aloud off.\n"
+	if this.SpeakEnabled {
+		text = "Reading short answers aloud, press the interrupt key to stop one.\n"
+	} else {
+		this.Speaker.Stop()
+	}
+	fmt.Fprintf(this.ParentOut, "%s%s%s", this.Color.Answer,
+		strings.ReplaceAll(text, "\n", "\r\n"), this.Color.Command)
+	this.SendPromptResponse("")
+}
@@ -0,0 +1,207 @@
+package butterfish
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// SessionUsage keeps a running total of tokens and estimated spend for every
+// LLM call made during a butterfish session. This is thread safe since
+// autosuggest calls happen in goroutines.
+type SessionUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+	Calls            int
+	// Estimated spend in USD, only includes models we know the price of
+	Cost float64
+	// Set if we've made calls to a model we don't know the price of, in which
+	// case Cost is an underestimate
+	UnknownPrice bool
+
+	mutex sync.Mutex
+}
+
+func NewSessionUsage() *SessionUsage {
+	return &SessionUsage{}
+}
+
+// Record the usage of a single call, returns the estimated cost of the call
+func (this *SessionUsage) Add(model string, promptTokens, completionTokens int) float64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.PromptTokens += promptTokens
+	this.CompletionTokens += completionTokens
+	this.Calls++
+
+	cost, ok := EstimateCostForModel(model, promptTokens, completionTokens)
+	if !ok {
+		this.UnknownPrice = true
+	}
+	this.Cost += cost
+	return cost
+}
+
+func (this *SessionUsage) TotalCalls() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.Calls
+}
+
+func (this *SessionUsage) TotalTokens() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.PromptTokens + this.CompletionTokens
+}
+
+func (this *SessionUsage) TotalCost() float64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.Cost
+}
+
+// Format the estimated cost, e.g. $0.0123, with a ~ suffix if some calls
+// were to models we don't have a price for
+func (this *SessionUsage) CostString() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	str := fmt.Sprintf("$%.4f", this.Cost)
+	if this.UnknownPrice {
+		str += "~"
+	}
+	return str
+}
+
+// The legacy streaming API doesn't report token usage, so in that case we
+// count tokens locally with the model's encoding.
+func (this *SessionUsage) countTokens(model string, content ...string) int {
+	tokenizer := TokenizerForModel(model)
+	total := 0
+	for _, str := range content {
+		if str == "" {
+			continue
+		}
+		total += tokenizer.CountTokens(str)
+	}
+	return total
+}
+
+// Fill in token counts on the response if the API didn't report them
+func (this *SessionUsage) estimateUsage(request *util.CompletionRequest, response *util.CompletionResponse) {
+	if response.PromptTokens == 0 {
+		content := []string{request.SystemMessage, request.Prompt}
+		for _, block := range request.HistoryBlocks {
+			content = append(content, block.Content)
+		}
+		response.PromptTokens = this.countTokens(request.Model, content...)
+	}
+
+	if response.CompletionTokens == 0 {
+		response.CompletionTokens = this.countTokens(request.Model,
+			response.Completion, response.FunctionParameters)
+	}
+}
+
+// An LLM implementation that wraps another LLM and records the token usage
+// and estimated cost of each call in a SessionUsage, and in the local stats
+// log if it's set. The use of the library prompts a request was built from
+// and the tokens of the response are also recorded. Calls are refused once
+// the session is over its budget's hard limit.
+type UsageTrackingLLM struct {
+	LLM   LLM
+	Usage *SessionUsage
+	Stats *StatsLog
+	// Replace with SetPrompts once requests may be running, e.g. on reload
+	Prompts *prompt.UsageLog
+	Budget  *SessionBudget
+	mutex   sync.RWMutex
+}
+
+func (this *UsageTrackingLLM) SetPrompts(prompts *prompt.UsageLog) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.Prompts = prompts
+}
+
+func (this *UsageTrackingLLM) prompts() *prompt.UsageLog {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.Prompts
+}
+
+func NewUsageTrackingLLM(llm LLM, usage *SessionUsage) *UsageTrackingLLM {
+	return &UsageTrackingLLM{
+		LLM:   llm,
+		Usage: usage,
+	}
+}
+
+// Record that a request built from library prompts is being sent
+func (this *UsageTrackingLLM) recordSent(request *util.CompletionRequest) {
+	prompts := this.prompts()
+	prompts.RecordInvocation(request.PromptName)
+	if request.SystemPromptName != request.PromptName {
+		prompts.RecordInvocation(request.SystemPromptName)
+	}
+}
+
+func (this *UsageTrackingLLM) record(request *util.CompletionRequest, response *util.CompletionResponse, start time.Time) {
+	if response == nil {
+		return
+	}
+
+	this.Usage.estimateUsage(request, response)
+	cost := this.Usage.Add(request.Model, response.PromptTokens, response.CompletionTokens)
+	this.Stats.Record(StatsEvent{
+		Type:             statsEventLLM,
+		Model:            request.Model,
+		PromptTokens:     response.PromptTokens,
+		CompletionTokens: response.CompletionTokens,
+		Cost:             cost,
+		LatencyMs:        time.Since(start).Milliseconds(),
+	})
+	this.prompts().RecordResponse(request.PromptName, response.CompletionTokens)
+}
+
+func (this *UsageTrackingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	if err := this.Budget.Check(); err != nil {
+		return nil, err
+	}
+	this.recordSent(request)
+	start := time.Now()
+	response, err := this.LLM.CompletionStream(request, writer)
+	this.record(request, response, start)
+	return response, err
+}
+
+func (this *UsageTrackingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	if err := this.Budget.Check(); err != nil {
+		return nil, err
+	}
+	this.recordSent(request)
+	start := time.Now()
+	response, err := this.LLM.Completion(request)
+	this.record(request, response, start)
+	return response, err
+}
+
+func (this *UsageTrackingLLM) Embeddings(request *util.EmbeddingRequest) ([][]float32, error) {
+	if err := this.Budget.Check(); err != nil {
+		return nil, err
+	}
+	return this.LLM.Embeddings(request)
+}
+
+func (this *UsageTrackingLLM) Transcribe(ctx context.Context, path, model, language string) (string, error) {
+	if err := this.Budget.Check(); err != nil {
+		return "", err
+	}
+	return transcribeWith(this.LLM, ctx, path, model, language)
+}
@@ -0,0 +1,169 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// With --verify, an answer from prompt or gencmd is checked by a second model
+// before it's shown, looking for made up commands, flags, and options. If
+// the verifier isn't confident in the answer, its critique is printed with
+// it. Verification can be turned on for commands in the config file, e.g.
+//
+//	verify:
+//	  model: gpt-4o
+//	  min_confidence: 70
+//	  commands: [gencmd]
+type VerifyConfig struct {
+	// The verifier model, defaultVerifyModel if empty
+	Model string `yaml:"model,omitempty"`
+	// Critiques are shown for answers the verifier is less confident in, from
+	// 0 to 100, defaultVerifyMinConfidence if 0
+	MinConfidence int `yaml:"min_confidence,omitempty"`
+	// Commands that are always verified
+	Commands []string `yaml:"commands,omitempty"`
+}
+
+const (
+	defaultVerifyModel         = "gpt-4o"
+	defaultVerifyMinConfidence = 70
+	verifyMaxTokens            = 512
+)
+
+var verifyCommands = []string{"prompt", "gencmd"}
+
+func (this *VerifyConfig) Validate() error {
+	if this.MinConfidence < 0 || this.MinConfidence > 100 {
+		return errors.New("verify min_confidence must be between 0 and 100")
+	}
+	for _, command := range this.Commands {
+		if !slices.Contains(verifyCommands, command) {
+			return fmt.Errorf("verify for unknown command %s, commands are %s",
+				command, strings.Join(verifyCommands, ", "))
+		}
+	}
+	return nil
+}
+
+func (this *VerifyConfig) model() string {
+	if this == nil || this.Model == "" {
+		return defaultVerifyModel
+	}
+	return this.Model
+}
+
+func (this *VerifyConfig) minConfidence() int {
+	if this == nil || this.MinConfidence == 0 {
+		return defaultVerifyMinConfidence
+	}
+	return this.MinConfidence
+}
+
+// Whether answers of command are verified without the --verify flag
+func (this *VerifyConfig) EnabledFor(command string) bool {
+	return this != nil && slices.Contains(this.Commands, command)
+}
+
+var verificationSchema = &jsonschema.Definition{
+	Type: jsonschema.Object,
+	Properties: map[string]jsonschema.Definition{
+		"confidence": {
+			Type:        jsonschema.Integer,
+			Description: "0 to 100, how confident you are that the answer is correct",
+		},
+		"issues": {
+			Type:        jsonschema.Array,
+			Items:       &jsonschema.Definition{Type: jsonschema.String},
+			Description: "Each problem found, empty if there are none",
+		},
+	},
+	Required:             []string{"confidence", "issues"},
+	AdditionalProperties: false,
+}
+
+// The verifier's assessment of an answer
+type Verification struct {
+	Model      string   `json:"-"`
+	Confidence int      `json:"confidence"`
+	Issues     []string `json:"issues"`
+}
+
+func parseVerification(response string) (*Verification, error) {
+	verification := &Verification{}
+	err := json.Unmarshal([]byte(response), verification)
+	if err != nil {
+		return nil, err
+	}
+	verification.Confidence = max(0, min(100, verification.Confidence))
+	return verification, nil
+}
+
+// The critique shown with an answer the verifier isn't confident in
+func (this *Verification) String() string {
+	text := fmt.Sprintf("%s is %d%% confident in this answer", this.Model, this.Confidence)
+	if len(this.Issues) == 0 {
+		return text + "."
+	}
+	text += ":"
+	for _, issue := range this.Issues {
+		text += "\n- " + issue
+	}
+	return text
+}
+
+// Ask the verifier model to critique an answer to the question
+func (this *ButterfishCtx) verifyAnswer(question, answer string) (*Verification, error) {
+	promptStr, err := this.GetPrompt(prompt.PromptVerifyAnswer,
+		"question", question,
+		"answer", answer)
+	if err != nil {
+		return nil, err
+	}
+
+	model := this.Config.Verify.model()
+	response, err := this.completeWithSchema(&util.CompletionRequest{
+		Ctx:           this.Ctx,
+		Prompt:        promptStr,
+		PromptName:    prompt.PromptVerifyAnswer,
+		Model:         model,
+		MaxTokens:     verifyMaxTokens,
+		Temperature:   requestTemperature(0),
+		SystemMessage: "N/A",
+		Task:          TaskVerify,
+		Verbose:       this.Config.Verbose > 0,
+		TokenTimeout:  this.Config.TokenTimeout,
+	}, verificationSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	verification, err := parseVerification(response.Completion)
+	if err != nil {
+		return nil, err
+	}
+	verification.Model = model
+	return verification, nil
+}
+
+// Verify an answer and return the critique to show with it, empty if the
+// verifier is confident. If verification fails the answer is shown anyway.
+func (this *ButterfishCtx) answerCritique(question, answer string) string {
+	verification, err := this.verifyAnswer(question, answer)
+	if err != nil {
+		log.Printf("Error verifying answer: %s", err)
+		return fmt.Sprintf("Couldn't verify this answer: %s", err)
+	}
+	log.Printf("Verification: %s", verification)
+	if verification.Confidence >= this.Config.Verify.minConfidence() {
+		return ""
+	}
+	return verification.String()
+}
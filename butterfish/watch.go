@@ -0,0 +1,362 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// The watch command tails a log file or the output of a command and only
+// surfaces explanations when something noteworthy happens. Lines are checked
+// with cheap heuristics (error bursts and stack traces), then a cheap triage
+// model decides whether the anomaly is worth a look, and only then a stronger
+// model explains it.
+
+const (
+	// How often we check the lines we've collected for anomalies
+	watchCheckInterval = 2 * time.Second
+	// How often we poll a log file for new lines
+	watchPollInterval = 500 * time.Millisecond
+	// Lines of context before an anomaly that we send to the LLM
+	watchContextLines = 30
+	// Maximum lines of an anomaly that we send to the LLM
+	watchMaxAnomalyLines = 100
+	// We don't explain the same anomaly again for this long
+	watchRepeatCooldown  = 10 * time.Minute
+	watchTriageMaxTokens = 128
+)
+
+var (
+	watchErrorRegex = regexp.MustCompile(`(?i)\b(error|err|fatal|panic|exception|fail(ed|ure)?|critical|crit|emerg|alert|segfault|oom|killed)\b`)
+	// The start or body of stack traces in common languages
+	watchStackTraceRegex = regexp.MustCompile(`^(panic: |goroutine \d+ \[|Traceback \(most recent call last\)|\s+at [\w$.<>]+\(.*\)$|\s+File ".*", line \d+|Exception in thread |\s+from .*:\d+:in )`)
+	// Parts of a line that change between repeats of the same error
+	watchVolatileRegex = regexp.MustCompile(`0x[0-9a-fA-F]+|\d+`)
+)
+
+// A window of lines that looks like something went wrong
+type logAnomaly struct {
+	Reason string
+	// Lines leading up to the anomaly
+	Context []string
+	Lines   []string
+}
+
+// Detects anomalies in a stream of log lines. Lines are added as they arrive
+// and Check is called periodically to see whether the lines since the last
+// check are worth looking at.
+type logWatcher struct {
+	// The number of error lines since the last check that counts as a burst
+	BurstThreshold int
+
+	history []string // recent lines that were already checked
+	pending []string // lines since the last check
+	seen    map[[32]byte]time.Time
+}
+
+func newLogWatcher(burstThreshold int) *logWatcher {
+	return &logWatcher{
+		BurstThreshold: burstThreshold,
+		seen:           map[[32]byte]time.Time{},
+	}
+}
+
+func (this *logWatcher) Add(line string) {
+	this.pending = append(this.pending, line)
+}
+
+// A fingerprint of the error lines of an anomaly, ignoring numbers like
+// timestamps and ids, so that a repeating error is only explained once
+func anomalySignature(lines []string) [32]byte {
+	hash := sha256.New()
+	for _, line := range lines {
+		if watchErrorRegex.MatchString(line) || watchStackTraceRegex.MatchString(line) {
+			hash.Write([]byte(watchVolatileRegex.ReplaceAllString(line, "#")))
+			hash.Write([]byte("\n"))
+		}
+	}
+	var sum [32]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+// Check the lines since the last check, returns nil if nothing stands out
+func (this *logWatcher) Check(now time.Time) *logAnomaly {
+	lines := this.pending
+	this.pending = nil
+	defer func() {
+		this.history = append(this.history, lines...)
+		if len(this.history) > watchContextLines {
+			this.history = this.history[len(this.history)-watchContextLines:]
+		}
+	}()
+
+	errorLines := 0
+	stackTrace := false
+	for _, line := range lines {
+		if watchStackTraceRegex.MatchString(line) {
+			stackTrace = true
+		} else if watchErrorRegex.MatchString(line) {
+			errorLines++
+		}
+	}
+
+	reason := ""
+	switch {
+	case stackTrace:
+		reason = "stack trace"
+	case errorLines >= this.BurstThreshold:
+		reason = fmt.Sprintf("burst of %d error lines", errorLines)
+	default:
+		return nil
+	}
+
+	signature := anomalySignature(lines)
+	if last, ok := this.seen[signature]; ok && now.Sub(last) < watchRepeatCooldown {
+		log.Printf("Skipping repeated anomaly (%s)", reason)
+		return nil
+	}
+	this.seen[signature] = now
+
+	anomalyLines := lines
+	if len(anomalyLines) > watchMaxAnomalyLines {
+		anomalyLines = anomalyLines[:watchMaxAnomalyLines]
+	}
+	return &logAnomaly{
+		Reason:  reason,
+		Context: append([]string{}, this.history...),
+		Lines:   anomalyLines,
+	}
+}
+
+// Send lines of a file to a channel as they're appended, like tail -f. If
+// the file is truncated, e.g. by log rotation, we start again from the top.
+func tailFile(ctx context.Context, path string, lines chan<- string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	partial := ""
+
+	for {
+		line, err := reader.ReadString('\n')
+		offset += int64(len(line))
+		if err == nil {
+			select {
+			case lines <- strings.TrimRight(partial+line, "\r\n"):
+			case <-ctx.Done():
+				return nil
+			}
+			partial = ""
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+		partial += line
+
+		select {
+		case <-time.After(watchPollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.Size() < offset {
+			log.Printf("%s was truncated, reading from the start", path)
+			offset, err = file.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			reader.Reset(file)
+			partial = ""
+		}
+	}
+}
+
+// Run a command with the shell and send its stdout and stderr to a channel
+func runWatchedCommand(ctx context.Context, command string, lines chan<- string) error {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.CommandContext(ctx, shell, "-c", command)
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	go func() {
+		writer.CloseWithError(cmd.Wait())
+	}()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		select {
+		case lines <- scanner.Text():
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// Parse the triage model's answer, which is yes or no followed by a short
+// summary, either on the same line or the next
+func parseWatchTriage(response string) (bool, string) {
+	first, rest, _ := strings.Cut(strings.TrimSpace(response), "\n")
+	first = strings.Trim(first, " *")
+	if !strings.HasPrefix(strings.ToLower(first), "yes") {
+		return false, ""
+	}
+
+	summary := strings.TrimSpace(rest)
+	if summary == "" {
+		summary = strings.TrimLeft(first[len("yes"):], " .:-")
+	}
+	return true, summary
+}
+
+func (this *ButterfishCtx) explainAnomaly(options *CliCommandConfig, source string, anomaly *logAnomaly) error {
+	watch := options.Watch
+	contextStr := strings.Join(anomaly.Context, "\n")
+	linesStr := strings.Join(anomaly.Lines, "\n")
+
+	sysMsg, err := this.GetSystemMessage(prompt.PromptSystemMessage)
+	if err != nil {
+		return err
+	}
+
+	triagePrompt, err := this.GetPrompt(prompt.PromptWatchTriage,
+		"source", source,
+		"reason", anomaly.Reason,
+		"context", contextStr,
+		"lines", linesStr)
+	if err != nil {
+		return err
+	}
+	request := &util.CompletionRequest{
+		Ctx:              this.Ctx,
+		Prompt:           triagePrompt,
+		PromptName:       prompt.PromptWatchTriage,
+		Model:            watch.TriageModel,
+		MaxTokens:        watchTriageMaxTokens,
+		Temperature:      0,
+		SystemMessage:    sysMsg,
+		SystemPromptName: prompt.PromptSystemMessage,
+		Verbose:          this.Config.Verbose > 0,
+		TokenTimeout:     this.Config.TokenTimeout,
+	}
+	response, err := this.LLMClient.Completion(request)
+	if err != nil {
+		return err
+	}
+	noteworthy, summary := parseWatchTriage(response.Completion)
+	if !noteworthy {
+		log.Printf("Triage model skipped anomaly (%s)", anomaly.Reason)
+		return nil
+	}
+
+	this.StylePrintf(this.Config.Styles.Highlight, "\n[%s] %s: %s\n",
+		time.Now().Format("15:04:05"), anomaly.Reason, summary)
+	this.StylePrintf(this.Config.Styles.Grey, "%s\n\n", linesStr)
+
+	explainPrompt, err := this.GetPrompt(prompt.PromptWatchExplain,
+		"source", source,
+		"summary", summary,
+		"context", contextStr,
+		"lines", linesStr)
+	if err != nil {
+		return err
+	}
+	_, err = this.Prompt(&promptCommand{
+		Prompt:      explainPrompt,
+		Model:       watch.Model,
+		NumTokens:   watch.NumTokens,
+		Temperature: 0.3,
+		Verbose:     this.Config.Verbose,
+	})
+	this.Printf("\n")
+	return err
+}
+
+// Tail a log file or a command's output and explain anomalies as they happen
+func (this *ButterfishCtx) watchCommand(options *CliCommandConfig) error {
+	watch := options.Watch
+	target := strings.Join(watch.Target, " ")
+	lines := make(chan string, 1024)
+	done := make(chan error, 1)
+
+	source := target
+	info, err := os.Stat(target)
+	if len(watch.Target) == 1 && err == nil && info.Mode().IsRegular() {
+		source = "log file " + target
+		go func() { done <- tailFile(this.Ctx, target, lines) }()
+	} else {
+		source = "output of the command " + target
+		go func() { done <- runWatchedCommand(this.Ctx, target, lines) }()
+	}
+	this.StylePrintf(this.Config.Styles.Grey, "Watching %s, press Ctrl-C to stop\n", source)
+
+	watcher := newLogWatcher(watch.BurstThreshold)
+	ticker := time.NewTicker(watchCheckInterval)
+	defer ticker.Stop()
+
+	check := func() {
+		anomaly := watcher.Check(time.Now())
+		if anomaly == nil {
+			return
+		}
+		err := this.explainAnomaly(options, source, anomaly)
+		if err != nil {
+			this.ErrorPrintf("Could not explain %s: %s\n", anomaly.Reason, err)
+		}
+	}
+
+	for {
+		select {
+		case line := <-lines:
+			if watch.Echo {
+				this.Printf("%s\n", line)
+			}
+			watcher.Add(line)
+
+		case <-ticker.C:
+			check()
+
+		case err := <-done:
+			// drain what's left and check it before we exit
+			for len(lines) > 0 {
+				watcher.Add(<-lines)
+			}
+			check()
+			return err
+		}
+	}
+}
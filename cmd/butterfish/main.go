@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,13 +34,15 @@ Butterfish is a command line tool for working with LLMs. It has two modes: CLI c
 
 Butterfish looks for an API key in OPENAI_API_KEY, or alternatively stores an OpenAI auth token at ~/.config/butterfish/butterfish.env.
 
-Prompts are stored in ~/.config/butterfish/prompts.yaml. Butterfish logs to the system temp dir, usually to /var/tmp/butterfish.log. To print the full prompts and responses from the OpenAI API, use the --verbose flag. Support can be found at https://github.com/bakks/butterfish.
+Prompts are stored in ~/.config/butterfish/prompts.yaml. Other settings, like shell mode keybindings, can be set in ~/.config/butterfish/config.yaml. Butterfish logs to the system temp dir, usually to /var/tmp/butterfish.log. To print the full prompts and responses from the OpenAI API, use the --verbose flag. Support can be found at https://github.com/bakks/butterfish.
 
 If you do not have OpenAI free credits then you will need a subscription and you will need to pay for OpenAI API use. If you're using Shell Mode, autosuggest will probably be the most expensive part. You can reduce spend by disabling shell autosuggest (-A) or increasing the autosuggest timeout (e.g. -t 2000). See "butterfish shell --help".
 `
 const license = "MIT License - Copyright (c) 2023 Peter Bakkum"
 const defaultEnvPath = "~/.config/butterfish/butterfish.env"
 const defaultPromptPath = "~/.config/butterfish/prompts.yaml"
+const defaultModelsPath = "~/.config/butterfish/models.json"
+const defaultConfigPath = "~/.config/butterfish/config.yaml"
 
 const shell_help = `Start the Butterfish shell wrapper. This wraps your existing shell, giving you access to LLM prompting by starting your command with a capital letter. LLM calls include prior shell context. This is great for keeping a chat-like terminal open, sending written prompts, debugging commands, and iterating on past actions.
 
@@ -52,10 +56,31 @@ Use:
 
 Here are special Butterfish commands:
   - Help : Give hints about usage.
-  - Status : Show the current Butterfish configuration.
+  - Status : Show the current Butterfish configuration and session token usage.
   - History : Print out the history that would be sent in a GPT prompt.
-
-If you do not have OpenAI free credits then you will need a subscription and you will need to pay for OpenAI API use. Autosuggest will probably be the most expensive feature. You can reduce spend by disabling shell autosuggest (-A) or increasing the autosuggest timeout (e.g. -t 2000).`
+  - !annotate [on|off] : Toggle printing a one-line annotation of what each command did after it runs.
+  - !breakdown [command] : Explain a command token by token, i.e. each flag, argument, pipe, and redirection, as a table, by default the last command you ran. The explain_last_command keybinding does the same.
+  - !explain [command] : Explain a command using its local man page or --help output, by default the last command you ran.
+  - !explainfirst [on|off] : Toggle explaining goal mode commands, and whether they're read-only or mutating, before they're offered to run.
+  - !export [path] : Export a transcript of the session to a markdown file, or html if the path ends with .html. The session is also saved when the shell exits and can be exported with 'butterfish transcript export'.
+  - !fetch <url> : Download a web page and add its text to the history context, it's also added to the index of the current project.
+  - !pipe <request> : Build a shell pipeline for a request, shown stage by stage with explanations. The first stage is typed at the prompt, then '!pipe next' adds the next stage so you can check each stage's output, '!pipe all' types the whole pipeline, and '!pipe' shows the stages again.
+  - !budget [override] : Show the session's estimated spend and the budget limits set in ~/.config/butterfish/config.yaml, override lets LLM calls continue past the hard limit.
+  - !speak [on|off] : Toggle reading short answers aloud, the interrupt key stops an answer being read.
+  - !private [on|off] : Toggle leaving commands and their output out of the history sent to the model, e.g. while working with secrets. Commands matching private_commands in ~/.config/butterfish/config.yaml are always left out.
+  - !pane [target] : Add the contents of a tmux pane to the history context, by default the marked pane (tmux select-pane -m) or else the last active pane.
+  - !reload : Reload ~/.config/butterfish/config.yaml and the prompt library without losing the conversation, e.g. after changing models or the temperature. Sending butterfish SIGHUP does the same.
+
+Keybindings for accepting autosuggestions (default tab), interrupting (default ctrl-c), toggling goal mode, clearing the history context, breaking down the last command, and speaking a prompt can be set in ~/.config/butterfish/config.yaml, for example:
+
+  keybindings:
+    accept_autosuggest: ctrl-f
+    toggle_goal_mode: ctrl-x g
+    clear_context: ctrl-x ctrl-l
+    explain_last_command: ctrl-x e
+    voice_prompt: ctrl-x v
+
+If you do not have OpenAI free credits then you will need a subscription and you will need to pay for OpenAI API use. Autosuggest will probably be the most expensive feature. You can reduce spend by disabling shell autosuggest (-A) or increasing the autosuggest timeout (e.g. -t 2000). Use -S to print the session token usage and estimated spend after each response, or add $(cat $BUTTERFISH_STATUS_FILE) to your shell prompt.`
 
 type VerboseFlag bool
 
@@ -75,29 +100,68 @@ type CliConfig struct {
 	Verbose      VerboseFlag      `short:"v" default:"false" help:"Verbose mode, prints full LLM prompts (sometimes to log file). Use multiple times for more verbosity, e.g. -vv."`
 	Log          bool             `short:"L" default:"false" help:"Write verbose content to a log file rather than stdout, usually /var/tmp/butterfish.log"`
 	Version      kong.VersionFlag `short:"V" help:"Print version information and exit."`
-	BaseURL      string           `short:"u" default:"https://api.openai.com/v1" help:"Base URL for OpenAI-compatible API. Enables local models with a compatible interface."`
+	BaseURL      string           `short:"u" default:"" help:"Base URL for OpenAI-compatible API. Enables local models with a compatible interface. Defaults to base_url in the config file, or https://api.openai.com/v1."`
 	TokenTimeout int              `short:"z" default:"10000" help:"Timeout before first prompt token is received and between individual tokens. In milliseconds."`
 	LightColor   bool             `short:"l" default:"false" help:"Light color mode, appropriate for a terminal with a white(ish) background"`
+	Plain        bool             `default:"false" help:"Print LLM output as plain text, without rendering markdown headers, lists, bold text, or highlighting code blocks."`
+	Accessible   bool             `default:"false" help:"Screen reader friendly output: plain text, nothing drawn over the line you're typing on (so no autosuggest), and shell answers between [butterfish answer] and [end of answer] lines."`
+	NoPromptFile bool             `default:"false" help:"Use the default prompts without reading or writing ~/.config/butterfish/prompts.yaml, e.g. on a read-only filesystem. Customized prompts aren't used."`
+	Headless     bool             `default:"false" env:"BUTTERFISH_HEADLESS" help:"For CI: never ask for confirmation or input, failing instead (pass -y or -f to commands that ask), print no ANSI escapes, and exit with a status that says what happened: 0 success, 1 bad flags, config, or no API key, 3 couldn't start, 4 the command failed, 5 it needed confirmation, 6 the LLM provider failed or timed out, 9 the session budget was reached."`
 
 	Shell struct {
 		Bin                       string `short:"b" help:"Shell to use (e.g. /bin/zsh), defaults to $SHELL."`
-		Model                     string `short:"m" default:"gpt-4o" help:"Model for when the user manually enters a prompt."`
+		Model                     string `short:"m" default:"${shell_model}" help:"Model for when the user manually enters a prompt."`
 		AutosuggestDisabled       bool   `short:"A" default:"false" help:"Disable autosuggest."`
-		AutosuggestModel          string `short:"a" default:"gpt-3.5-turbo-instruct" help:"Model for autosuggest"`
-		AutosuggestTimeout        int    `short:"t" default:"500" help:"Delay after typing before autosuggest (lower values trigger more calls and are more expensive). In milliseconds."`
-		NewlineAutosuggestTimeout int    `short:"T" default:"3500" help:"Timeout for autosuggest on a fresh line, i.e. before a command has started. Negative values disable. In milliseconds."`
+		AutosuggestModel          string `short:"a" default:"${shell_autosuggest_model}" help:"Model for autosuggest"`
+		AutosuggestTimeout        int    `short:"t" default:"${shell_autosuggest_timeout}" help:"Delay after typing before autosuggest (lower values trigger more calls and are more expensive). In milliseconds."`
+		NewlineAutosuggestTimeout int    `short:"T" default:"${shell_newline_autosuggest_timeout}" help:"Timeout for autosuggest on a fresh line, i.e. before a command has started. Negative values disable. In milliseconds."`
 		NoCommandPrompt           bool   `short:"p" default:"false" help:"Don't change command prompt (shell PS1 variable). If not set, an emoji will be added to the prompt as a reminder you're in Shell Mode."`
-		MaxPromptTokens           int    `short:"P" default:"16384" help:"Maximum number of tokens, we restrict calls to this size regardless of model capabilities."`
-		MaxHistoryBlockTokens     int    `short:"H" default:"1024" help:"Maximum number of tokens of each block of history. For example, if a command has a very long output, it will be truncated to this length when sending the shell's history."`
-		MaxResponseTokens         int    `short:"R" default:"2048" help:"Maximum number of tokens in a response when prompting."`
+		MaxPromptTokens           int    `short:"P" default:"${shell_max_prompt_tokens}" help:"Maximum number of tokens, we restrict calls to this size regardless of model capabilities."`
+		MaxHistoryBlockTokens     int    `short:"H" default:"${shell_max_history_block_tokens}" help:"Maximum number of tokens of each block of history. For example, if a command has a very long output, it will be truncated to this length when sending the shell's history."`
+		MaxResponseTokens         int    `short:"R" default:"${shell_max_response_tokens}" help:"Maximum number of tokens in a response when prompting."`
+		GoalRetries               int    `default:"${shell_goal_retries}" help:"In goal mode, the number of consecutive failed commands the agent can try to fix before stopping and handing control back to you."`
+		Tmux                      string `default:"" placeholder:"pane|popup" help:"When running inside tmux, show prompt answers in a split pane (pane) or in a popup after each answer (popup) rather than inline."`
+		Annotate                  bool   `default:"false" help:"After each command, print a dimmed one-line annotation of what it did. Toggle in the shell with !annotate."`
+		Speak                     bool   `default:"false" help:"Read short answers aloud with the OS speech synthesizer, or the speech API with tts: api in the speech section of ~/.config/butterfish/config.yaml. Toggle in the shell with !speak."`
+		AnnotateModel             string `default:"${shell_annotate_model}" help:"Model for command annotations, a cheap or local model is recommended since it's called after every command."`
+		ExplainFirst              bool   `default:"false" help:"In goal mode, explain each command in one sentence and say whether it's read-only or mutating before offering to run it. Toggle in the shell with !explainfirst, or set explain_before_execute in the config file."`
+		SummarizeAfter            int    `default:"0" help:"When a command runs for longer than this many seconds, print a one-paragraph summary of its output when it finishes. 0 turns this off."`
+		Notify                    bool   `default:"false" help:"With --summarize-after, also send the summary as a desktop notification, with osascript on macOS or notify-send on Linux."`
+		RecordHistory             bool   `default:"false" help:"Record each command you run, with a description from the annotation model, to ~/.config/butterfish/command_history.jsonl so you can ask about it later with 'butterfish history'."`
+		Terminal                  string `default:"auto" enum:"auto,none,iterm2,wezterm,kitty" help:"Terminal protocols to use for answers: mark them as command output so your terminal can copy the last answer, set the butterfish_answer user var in WezTerm, and show images an answer refers to, like a saved plot, inline. Detected by default."`
+		LearnFixes                bool   `default:"false" help:"When a command fails and a command suggested by butterfish then fixes it, save the error and the fix to ~/.config/butterfish/fixes.json. When the same error comes up again the saved fix is shown and offered as the autosuggest without calling the model."`
+		SSHPauseAutosuggest       bool   `default:"false" help:"Pause autosuggest while you're connected to a remote host with ssh from the shell."`
+		NoKeywordContext          bool   `default:"false" help:"Don't add the output of docker ps, kubectl get pods, and the current kube context to prompts that mention containers or kubernetes."`
+		ProjectContext            bool   `default:"false" help:"Add excerpts of project files like the Makefile or package.json to autosuggest requests so suggestions use the project's own commands. Files are found with the embeddings index, so the project needs to be indexed with 'butterfish index'."`
+		NoShellProfile            bool   `default:"false" help:"Don't read your aliases, shell functions, and installed tools at startup. They're read by running your shell once more in the background and passed to the model so generated commands use them."`
+		StatusLine                bool   `short:"S" default:"false" help:"Print a status line after each LLM response showing the model, conversation tokens, and estimated session spend. The same line is always written to the file at $BUTTERFISH_STATUS_FILE, which you can include in your shell prompt."`
 	} `cmd:"" help:"${shell_help}"`
 
+	Init struct {
+	} `cmd:"" help:"Set up butterfish interactively: choose a provider, store your API key, pick models, add an alias and tab completion to your shell's rc file, and write a commented config file to ~/.config/butterfish/config.yaml."`
+
+	Config struct {
+		Check struct {
+		} `cmd:"" help:"Check the config file for unknown settings, values of the wrong type, and deprecated settings, with suggested fixes. Exits with status 1 if there are errors."`
+		Show struct {
+			Effective bool `short:"e" default:"false" help:"Show the settings in effect, i.e. the defaults merged with the config file and flags, rather than the file itself."`
+		} `cmd:"" help:"Print the config file, or with --effective the merged settings in the same format."`
+	} `cmd:"" help:"Check or show the config file, ~/.config/butterfish/config.yaml."`
+
+	Completion struct {
+		Shell string `arg:"" enum:"bash,zsh,fish" help:"Shell to print the completion script for, bash, zsh, or fish."`
+	} `cmd:"" help:"Print a tab completion script for butterfish's subcommands, flags, prompt library names, and indexed paths. For example add 'source <(butterfish completion zsh)' to ~/.zshrc, or 'source <(butterfish completion bash)' to ~/.bashrc."`
+
+	Complete struct {
+		Words []string `arg:"" optional:"" passthrough:""`
+	} `cmd:"" name:"__complete" hidden:"" help:"Print completions for the words typed so far, used by the completion scripts."`
+
 	// We include the cliConsole options here so that we can parse them and hand them
 	// to the console executor, even though we're in the shell context here
 	bf.CliCommandConfig
 }
 
-func getOpenAIToken() string {
+func getOpenAIToken(headless bool) string {
 	path, err := homedir.Expand(defaultEnvPath)
 	if err != nil {
 		log.Fatal(err)
@@ -116,6 +180,11 @@ func getOpenAIToken() string {
 		return token
 	}
 
+	if headless {
+		fmt.Fprintf(os.Stderr, "No API key, set OPENAI_API_KEY\n")
+		os.Exit(bf.ExitUsage)
+	}
+
 	// If we don't have a token, we'll prompt the user to create one
 	fmt.Printf("Butterfish requires an OpenAI API key, please visit https://beta.openai.com/account/api-keys to create one and paste it below (it should start with sk-):\n")
 
@@ -155,17 +224,47 @@ func getOpenAIToken() string {
 	return token
 }
 
-func makeButterfishConfig(options *CliConfig) *bf.ButterfishConfig {
+// Build the config from flags and the config file, the API key is only
+// looked up (and asked for if there isn't one) if needToken is set
+func makeButterfishConfig(options *CliConfig, needToken bool) *bf.ButterfishConfig {
 	config := bf.MakeButterfishConfig()
-	config.OpenAIToken = getOpenAIToken()
+
+	cassettePath, cassetteMode, err := bf.CassetteFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.CassettePath = cassettePath
+	config.CassetteMode = cassetteMode
+	// a replayed session doesn't call the API so doesn't need a token
+	if needToken && cassetteMode != bf.CassetteModeReplay {
+		config.OpenAIToken = getOpenAIToken(options.Headless)
+	}
 	config.BaseURL = options.BaseURL
 	config.PromptLibraryPath = defaultPromptPath
+	config.NoPromptFile = options.NoPromptFile
+	config.ConfigFilePath = defaultConfigPath
+	config.ModelsPath = defaultModelsPath
 	config.TokenTimeout = time.Duration(options.TokenTimeout) * time.Millisecond
+	config.PlainOutput = options.Plain || options.Accessible || options.Headless
+	config.Accessible = options.Accessible
+	config.Headless = options.Headless
 
 	if options.Verbose {
 		config.Verbose = verboseCount
 	}
 
+	configFile, err := bf.LoadConfigFile(defaultConfigPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, warning := range configFile.Warnings {
+		fmt.Fprintf(os.Stderr, "%s in %s\n", warning, defaultConfigPath)
+	}
+	err = configFile.Apply(config)
+	if err != nil {
+		log.Fatalf("Error in %s: %s", defaultConfigPath, err)
+	}
+
 	return config
 }
 
@@ -175,24 +274,38 @@ func getBuildInfo() string {
 	return fmt.Sprintf("%s %s %s\n(commit %s) (built %s)\n%s\n", BuildVersion, buildOs, buildArch, BuildCommit, BuildTimestamp, license)
 }
 
-func main() {
-	// start pprof server in goroutine
-	// go func() {
-	// 	log.Println(http.ListenAndServe("localhost:6060", nil))
-	// }()
-
+// The parser for the command line, this fails if flags clash, e.g. two with
+// the same short flag
+func newCliParser(cli *CliConfig) (*kong.Kong, error) {
 	desc := fmt.Sprintf("%s\n%s", description, getBuildInfo())
-	cli := &CliConfig{}
-
-	cliParser, err := kong.New(cli,
+	return kong.New(cli,
 		kong.Name("butterfish"),
 		kong.Description(desc),
 		kong.UsageOnError(),
 		kong.Vars{
 			"shell_help": shell_help,
 			"version":    getBuildInfo(),
+
+			"shell_model":                       bf.DefaultShellPromptModel,
+			"shell_autosuggest_model":           bf.DefaultShellAutosuggestModel,
+			"shell_annotate_model":              bf.DefaultShellAnnotateModel,
+			"shell_autosuggest_timeout":         strconv.FormatInt(bf.DefaultShellAutosuggestTimeout.Milliseconds(), 10),
+			"shell_newline_autosuggest_timeout": strconv.FormatInt(bf.DefaultShellNewlineAutosuggestTimeout.Milliseconds(), 10),
+			"shell_max_prompt_tokens":           strconv.Itoa(bf.DefaultShellMaxPromptTokens),
+			"shell_max_history_block_tokens":    strconv.Itoa(bf.DefaultShellMaxHistoryBlockTokens),
+			"shell_max_response_tokens":         strconv.Itoa(bf.DefaultShellMaxResponseTokens),
+			"shell_goal_retries":                strconv.Itoa(bf.DefaultShellGoalModeMaxRetries),
 		})
+}
 
+func main() {
+	// start pprof server in goroutine
+	// go func() {
+	// 	log.Println(http.ListenAndServe("localhost:6060", nil))
+	// }()
+
+	cli := &CliConfig{}
+	cliParser, err := newCliParser(cli)
 	if err != nil {
 		panic(err)
 	}
@@ -200,11 +313,67 @@ func main() {
 	parsedCmd, err := cliParser.Parse(os.Args[1:])
 	cliParser.FatalIfErrorf(err)
 
-	config := makeButterfishConfig(cli)
+	if cli.Headless && (parsedCmd.Command() == "init" || parsedCmd.Command() == "shell") {
+		cliParser.Fatalf("%s is interactive and can't be run with --headless", parsedCmd.Command())
+	}
+
+	// init and completion don't need an API key or config
+	switch parsedCmd.Command() {
+	case "init":
+		configPath, err := homedir.Expand(defaultConfigPath)
+		cliParser.FatalIfErrorf(err)
+		envPath, err := homedir.Expand(defaultEnvPath)
+		cliParser.FatalIfErrorf(err)
+		wizard, err := bf.NewInitWizard(os.Stdin, os.Stdout, configPath, envPath)
+		cliParser.FatalIfErrorf(err)
+		cliParser.FatalIfErrorf(wizard.Run())
+		return
+
+	case "config check":
+		valid, err := bf.CheckConfigFile(defaultConfigPath, os.Stdout, cliParser.Model)
+		cliParser.FatalIfErrorf(err)
+		if !valid {
+			os.Exit(1)
+		}
+		return
+
+	case "config show":
+		config := makeButterfishConfig(cli, false)
+		cliParser.FatalIfErrorf(bf.ShowConfig(os.Stdout, defaultConfigPath, config, cli.Config.Show.Effective))
+		return
+
+	case "completion <shell>":
+		script, err := bf.CompletionScript(cli.Completion.Shell)
+		cliParser.FatalIfErrorf(err)
+		fmt.Print(script)
+		return
+
+	case "__complete", "__complete <words>":
+		words := cli.Complete.Words
+		if len(words) > 0 && words[0] == "--" {
+			words = words[1:]
+		}
+		promptPath, err := homedir.Expand(defaultPromptPath)
+		cliParser.FatalIfErrorf(err)
+		for _, candidate := range bf.CompleteArgs(cliParser.Model, words, promptPath) {
+			fmt.Println(candidate)
+		}
+		return
+	}
+
+	config := makeButterfishConfig(cli, true)
 	config.BuildInfo = getBuildInfo()
+	err = bf.ApplyModelDefaults(parsedCmd, config)
+	if err != nil {
+		log.Fatalf("Error in %s: %s", defaultConfigPath, err)
+	}
+	bf.ApplySamplingDefaults(parsedCmd, config)
 	ctx := context.Background()
 
-	errorWriter := util.NewStyledWriter(os.Stderr, config.Styles.Error)
+	var errorWriter io.Writer = util.NewStyledWriter(os.Stderr, config.Styles.Error)
+	if cli.Headless {
+		errorWriter = bf.NewPlainWriter(os.Stderr)
+	}
 
 	switch parsedCmd.Command() {
 	case "shell":
@@ -226,10 +395,20 @@ func main() {
 			os.Exit(7)
 		}
 
+		// models from the config file are used unless a flag is given
+		config.ShellFlagsGiven = bf.GivenFlags(parsedCmd)
+		if config.ShellFlagsGiven["model"] || config.ShellPromptModel == "" {
+			config.ShellPromptModel = cli.Shell.Model
+		}
+		if config.ShellFlagsGiven["autosuggest-model"] || config.ShellAutosuggestModel == "" {
+			config.ShellAutosuggestModel = cli.Shell.AutosuggestModel
+		}
+		if config.ShellFlagsGiven["annotate-model"] || config.ShellAnnotateModel == "" {
+			config.ShellAnnotateModel = cli.Shell.AnnotateModel
+		}
+
 		config.ShellBinary = shell
-		config.ShellPromptModel = cli.Shell.Model
 		config.ShellAutosuggestEnabled = !cli.Shell.AutosuggestDisabled
-		config.ShellAutosuggestModel = cli.Shell.AutosuggestModel
 		config.ShellAutosuggestTimeout = time.Duration(cli.Shell.AutosuggestTimeout) * time.Millisecond
 		config.ShellNewlineAutosuggestTimeout = time.Duration(cli.Shell.NewlineAutosuggestTimeout) * time.Millisecond
 		config.ColorDark = !cli.LightColor
@@ -238,6 +417,26 @@ func main() {
 		config.ShellMaxPromptTokens = cli.Shell.MaxPromptTokens
 		config.ShellMaxHistoryBlockTokens = cli.Shell.MaxHistoryBlockTokens
 		config.ShellMaxResponseTokens = cli.Shell.MaxResponseTokens
+		config.ShellStatusLine = cli.Shell.StatusLine
+		config.ShellTmuxMode = cli.Shell.Tmux
+		config.ShellTerminal = cli.Shell.Terminal
+		if cli.Accessible {
+			// autosuggest is drawn after the cursor and images aren't text
+			config.ShellAutosuggestEnabled = false
+			config.ShellTerminal = bf.TerminalNone
+		}
+		config.ShellGoalModeMaxRetries = cli.Shell.GoalRetries
+		config.ShellAnnotate = cli.Shell.Annotate
+		config.ShellSpeak = cli.Shell.Speak
+		config.ShellRecordHistory = cli.Shell.RecordHistory
+		config.ShellLearnFixes = cli.Shell.LearnFixes
+		config.ShellSummarizeAfter = time.Duration(cli.Shell.SummarizeAfter) * time.Second
+		config.ShellNotify = cli.Shell.Notify
+		config.ExplainBeforeExecute = config.ExplainBeforeExecute || cli.Shell.ExplainFirst
+		config.ShellRemotePauseAutosuggest = cli.Shell.SSHPauseAutosuggest
+		config.ShellNoKeywordContext = cli.Shell.NoKeywordContext
+		config.ShellProjectContext = cli.Shell.ProjectContext
+		config.ShellNoProfile = cli.Shell.NoShellProfile
 
 		bf.RunShell(ctx, config)
 
@@ -248,15 +447,22 @@ func main() {
 		butterfishCtx, err := bf.NewButterfish(ctx, config)
 		if err != nil {
 			fmt.Fprintf(errorWriter, err.Error())
-			os.Exit(3)
+			os.Exit(bf.ExitStartup)
 		}
 		//butterfishCtx.Config.Styles.PrintTestColors()
+		if cli.Headless {
+			butterfishCtx.Out = bf.NewPlainWriter(os.Stdout)
+		}
 
 		err = butterfishCtx.ExecCommand(parsedCmd, &cli.CliCommandConfig)
+		butterfishCtx.Close()
 
 		if err != nil {
 			butterfishCtx.StylePrintf(config.Styles.Error, "Error: %s\n", err.Error())
-			os.Exit(4)
+			if cli.Headless {
+				os.Exit(bf.ExitCode(err))
+			}
+			os.Exit(bf.ExitFailed)
 		}
 	}
 }
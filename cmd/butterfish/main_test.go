@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCliParser(t *testing.T) {
+	// kong rejects clashing flags when the parser is built, which would
+	// otherwise crash every invocation
+	parser, err := newCliParser(&CliConfig{})
+	assert.NoError(t, err)
+
+	_, err = parser.Parse([]string{"undo", "--list"})
+	assert.NoError(t, err)
+}
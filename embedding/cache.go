@@ -0,0 +1,177 @@
+package embedding
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/bakks/butterfish/storage"
+)
+
+// EmbeddingCaches hold embeddings by the model, dimensions, and sha256 of the
+// embedded text, so that text embedded before, in another index, on another
+// branch, or in a duplicate file, isn't embedded again
+type EmbeddingCache interface {
+	Get(model string, dimensions int, key [sha256.Size]byte) ([]float32, bool)
+	Put(model string, dimensions int, key [sha256.Size]byte, vector []float32) error
+}
+
+// The key of a chunk's text in an EmbeddingCache
+func ContentKey(content string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(content))
+}
+
+// Cache files are kept under this size by default, the oldest embeddings
+// are dropped when it's reached
+const DefaultEmbeddingCacheMaxBytes = 256 << 20
+
+// DiskEmbeddingCache keeps a file of embeddings for each model and number of
+// dimensions in a directory of a store, e.g. ~/.config/butterfish/embeddings
+// on disk. A file is read the first time its model is used and new
+// embeddings are appended to it, each as the sha256 of the text, the number
+// of values, and the values as little endian float32s. When a file would
+// grow past MaxBytes it's rewritten with the newest half of its embeddings.
+type DiskEmbeddingCache struct {
+	Dir      string
+	Store    storage.Store
+	MaxBytes int
+
+	spaces map[embeddingSpace]*cacheSpace
+	mutex  sync.Mutex
+}
+
+// The embeddings of a cache file, in the order they're in the file
+type cacheSpace struct {
+	vectors map[[sha256.Size]byte][]float32
+	order   [][sha256.Size]byte
+	size    int
+}
+
+func NewDiskEmbeddingCache(dir string) *DiskEmbeddingCache {
+	return NewStoreEmbeddingCache(storage.NewDiskStore(""), dir)
+}
+
+func NewStoreEmbeddingCache(store storage.Store, dir string) *DiskEmbeddingCache {
+	return &DiskEmbeddingCache{
+		Dir:      dir,
+		Store:    store,
+		MaxBytes: DefaultEmbeddingCacheMaxBytes,
+		spaces:   map[embeddingSpace]*cacheSpace{},
+	}
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func (this *DiskEmbeddingCache) key(space embeddingSpace) string {
+	name := unsafeFileChars.ReplaceAllString(space.Model, "_")
+	return path.Join(filepath.ToSlash(this.Dir), fmt.Sprintf("%s_%d.cache", name, space.Dimensions))
+}
+
+func encodeCacheRecord(key [sha256.Size]byte, vector []float32) []byte {
+	record := make([]byte, sha256.Size+4+4*len(vector))
+	copy(record, key[:])
+	binary.LittleEndian.PutUint32(record[sha256.Size:], uint32(len(vector)))
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(record[sha256.Size+4+4*i:], math.Float32bits(value))
+	}
+	return record
+}
+
+func (this *cacheSpace) add(key [sha256.Size]byte, vector []float32) {
+	this.vectors[key] = vector
+	this.order = append(this.order, key)
+	this.size += sha256.Size + 4 + 4*len(vector)
+}
+
+// The cached embeddings of a model and dimensions, read from disk the first
+// time. A file cut short by a crash is truncated to the records before the
+// cut, so that later records aren't appended after the partial one.
+func (this *DiskEmbeddingCache) load(space embeddingSpace) *cacheSpace {
+	cached, ok := this.spaces[space]
+	if ok {
+		return cached
+	}
+	cached = &cacheSpace{vectors: map[[sha256.Size]byte][]float32{}}
+	this.spaces[space] = cached
+
+	data, err := this.Store.Get(context.Background(), this.key(space))
+	if err != nil {
+		return cached
+	}
+	reader := bytes.NewReader(data)
+	for {
+		var key [sha256.Size]byte
+		var length uint32
+		if _, err := io.ReadFull(reader, key[:]); err != nil {
+			break
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+			break
+		}
+		if int(length) > reader.Len()/4 {
+			break
+		}
+		vector := make([]float32, length)
+		if err := binary.Read(reader, binary.LittleEndian, vector); err != nil {
+			break
+		}
+		cached.add(key, vector)
+	}
+
+	if cached.size < len(data) {
+		err = this.Store.Put(context.Background(), this.key(space), data[:cached.size])
+		if err != nil {
+			log.Printf("Error truncating embedding cache %s: %s", this.key(space), err)
+		}
+	}
+	return cached
+}
+
+func (this *DiskEmbeddingCache) Get(model string, dimensions int, key [sha256.Size]byte) ([]float32, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	vector, ok := this.load(embeddingSpace{model, dimensions}).vectors[key]
+	return vector, ok
+}
+
+func (this *DiskEmbeddingCache) Put(model string, dimensions int, key [sha256.Size]byte, vector []float32) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	space := embeddingSpace{model, dimensions}
+	cached := this.load(space)
+	if _, ok := cached.vectors[key]; ok {
+		return nil
+	}
+	record := encodeCacheRecord(key, vector)
+	if this.MaxBytes <= 0 || cached.size+len(record) <= this.MaxBytes {
+		cached.add(key, vector)
+		return this.Store.Append(context.Background(), this.key(space), record)
+	}
+
+	// over the limit, keep the newest half
+	remaining := cached.size
+	drop := 0
+	for drop < len(cached.order) && remaining+len(record) > this.MaxBytes/2 {
+		remaining -= sha256.Size + 4 + 4*len(cached.vectors[cached.order[drop]])
+		drop++
+	}
+	kept := &cacheSpace{vectors: map[[sha256.Size]byte][]float32{}}
+	data := make([]byte, 0, remaining+len(record))
+	for _, oldKey := range cached.order[drop:] {
+		kept.add(oldKey, cached.vectors[oldKey])
+		data = append(data, encodeCacheRecord(oldKey, cached.vectors[oldKey])...)
+	}
+	kept.add(key, vector)
+	data = append(data, record...)
+	this.spaces[space] = kept
+	return this.Store.Put(context.Background(), this.key(space), data)
+}
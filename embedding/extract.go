@@ -0,0 +1,528 @@
+package embedding
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/spf13/afero"
+	"golang.org/x/net/html"
+)
+
+// Extractors get the text of documents that aren't plain text, so that docs
+// folders and downloaded specs in PDF, Word, or HTML can be indexed alongside
+// code. The chunk offsets of an extracted file refer to its extracted text
+// rather than the file, so search results extract the text again to get
+// their content.
+
+type ExtractedDocument struct {
+	Title string
+	Text  string
+	// Parts of Text that are chunked separately, e.g. notebook cells, so
+	// that a chunk doesn't span two of them. If empty Text is chunked as a
+	// whole.
+	Sections []DocumentSection
+}
+
+type DocumentSection struct {
+	// Byte offsets of the section in the document's Text
+	Start int
+	End   int
+	// The 1-based cell number of a notebook cell
+	Cell int
+}
+
+type Extractor func(data []byte) (*ExtractedDocument, error)
+
+var extractors = map[string]Extractor{
+	".pdf":   ExtractPDF,
+	".docx":  ExtractDocx,
+	".html":  ExtractHTML,
+	".htm":   ExtractHTML,
+	".ipynb": ExtractNotebook,
+}
+
+// The extractor for a file based on its extension, nil for plain text files
+func extractorFor(path string) Extractor {
+	return extractors[strings.ToLower(filepath.Ext(path))]
+}
+
+func extractFile(fs afero.Fs, path string) (*ExtractedDocument, error) {
+	extractor := extractorFor(path)
+	if extractor == nil {
+		return nil, fmt.Errorf("No extractor for %s", path)
+	}
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := extractor(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error extracting text from %s: %w", path, err)
+	}
+	return doc, nil
+}
+
+// Collapse runs of spaces and blank lines left by markup
+func cleanExtractedText(text string) string {
+	lines := strings.Split(text, "\n")
+	cleaned := []string{}
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" && (len(cleaned) == 0 || cleaned[len(cleaned)-1] == "") {
+			continue
+		}
+		cleaned = append(cleaned, line)
+	}
+	return strings.TrimSpace(strings.Join(cleaned, "\n"))
+}
+
+// HTML elements whose content isn't page text
+var htmlSkipElements = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true, "svg": true,
+}
+
+// HTML elements that start a new line
+var htmlBlockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "tr": true, "h1": true,
+	"h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "pre": true,
+	"section": true, "article": true, "header": true, "footer": true,
+	"blockquote": true, "table": true, "ul": true, "ol": true, "dt": true, "dd": true,
+}
+
+// Extract the visible text and title of an HTML page
+func ExtractHTML(data []byte) (*ExtractedDocument, error) {
+	root, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &ExtractedDocument{}
+	builder := strings.Builder{}
+	// a block ends a line unless one just ended, so nested blocks don't
+	// leave blank lines
+	newline := func() {
+		if text := builder.String(); text != "" && !strings.HasSuffix(text, "\n") {
+			builder.WriteString("\n")
+		}
+	}
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			switch {
+			case node.Data == "title":
+				if node.FirstChild != nil && doc.Title == "" {
+					doc.Title = strings.TrimSpace(node.FirstChild.Data)
+				}
+				return
+			case htmlSkipElements[node.Data]:
+				return
+			case htmlBlockElements[node.Data]:
+				newline()
+			}
+		}
+		if node.Type == html.TextNode {
+			builder.WriteString(node.Data)
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+		if node.Type == html.ElementNode && htmlBlockElements[node.Data] {
+			newline()
+		}
+	}
+	walk(root)
+
+	doc.Text = cleanExtractedText(builder.String())
+	return doc, nil
+}
+
+// Extract the text of a Word document, i.e. the text runs of
+// word/document.xml, and its title from the document properties
+func ExtractDocx(data []byte) (*ExtractedDocument, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &ExtractedDocument{}
+	found := false
+	for _, file := range archive.File {
+		switch file.Name {
+		case "word/document.xml":
+			found = true
+			doc.Text, err = readDocxXML(file, func(decoder *xml.Decoder, builder *strings.Builder) error {
+				return docxText(decoder, builder)
+			})
+		case "docProps/core.xml":
+			doc.Title, err = readDocxXML(file, func(decoder *xml.Decoder, builder *strings.Builder) error {
+				return xmlElementText(decoder, builder, "title")
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("not a Word document, word/document.xml is missing")
+	}
+
+	doc.Title = strings.TrimSpace(doc.Title)
+	doc.Text = cleanExtractedText(doc.Text)
+	return doc, nil
+}
+
+func readDocxXML(file *zip.File, read func(*xml.Decoder, *strings.Builder) error) (string, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	builder := strings.Builder{}
+	err = read(xml.NewDecoder(reader), &builder)
+	return builder.String(), err
+}
+
+// Text runs are in <w:t> elements, paragraphs end with </w:p>
+func docxText(decoder *xml.Decoder, builder *strings.Builder) error {
+	inText := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			switch token.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				builder.WriteString("\t")
+			case "br", "cr":
+				builder.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch token.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				builder.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				builder.Write(token)
+			}
+		}
+	}
+}
+
+// The text of the first element with the given local name
+func xmlElementText(decoder *xml.Decoder, builder *strings.Builder, name string) error {
+	inElement := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			inElement = token.Name.Local == name
+		case xml.EndElement:
+			if inElement {
+				return nil
+			}
+		case xml.CharData:
+			if inElement {
+				builder.Write(token)
+			}
+		}
+	}
+}
+
+// The most content stream data we'll decompress for one PDF, so a small
+// file that inflates to gigabytes can't use up memory
+const pdfMaxDecodedBytes = 64 << 20
+
+var (
+	pdfStreamRegex = regexp.MustCompile(`>>\s*stream\r?\n`)
+	pdfTitleRegex  = regexp.MustCompile(`/Title\s*(?:\(((?:\\.|[^\\)])*)\)|<([0-9A-Fa-f\s]*)>)`)
+	// Text showing operators, a literal or hex string then Tj, ', or ", or an
+	// array then TJ, and the operators that move to a new line
+	pdfTextOpRegex = regexp.MustCompile(`(?s)(\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>)\s*(?:Tj|'|")|\[((?:\\.|[^\\\]])*)\]\s*TJ|(?:^|\s)(T\*|Td|TD|ET)(?:\s|$)`)
+	pdfStringRegex = regexp.MustCompile(`(?s)\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>|-?\d+(?:\.\d+)?`)
+	// The mappings of a ToUnicode CMap, single codes and ranges of codes
+	pdfBfCharRegex  = regexp.MustCompile(`(?s)beginbfchar(.*?)endbfchar`)
+	pdfBfRangeRegex = regexp.MustCompile(`(?s)beginbfrange(.*?)endbfrange`)
+	pdfCharRegex    = regexp.MustCompile(`<([0-9A-Fa-f]+)>\s*<([0-9A-Fa-f]+)>`)
+	pdfRangeRegex   = regexp.MustCompile(`<([0-9A-Fa-f]+)>\s*<([0-9A-Fa-f]+)>\s*(<[0-9A-Fa-f]+>|\[[^\]]*\])`)
+	pdfHexRegex     = regexp.MustCompile(`<([0-9A-Fa-f]+)>`)
+)
+
+// A minimal PDF text extractor, it decompresses the content streams and
+// reads the text showing operators. Hex strings, which fonts with two byte
+// codes like Word's use, are mapped to text with the document's ToUnicode
+// CMaps. Those are merged rather than matched to each font, so text in
+// several such fonts may not come out readable, and scanned documents have no
+// text to extract.
+func ExtractPDF(data []byte) (*ExtractedDocument, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		return nil, fmt.Errorf("not a PDF file")
+	}
+
+	doc := &ExtractedDocument{}
+	if match := pdfTitleRegex.FindSubmatch(data); match != nil {
+		if match[2] != nil {
+			doc.Title = strings.TrimSpace(pdfBytesToString(decodePDFHex(match[2])))
+		} else {
+			doc.Title = strings.TrimSpace(decodePDFString(match[1]))
+		}
+	}
+
+	contents := [][]byte{}
+	cmap := &pdfCMap{codes: map[uint32]string{}}
+	decoded := 0
+	searchFrom := 0
+	for _, loc := range pdfStreamRegex.FindAllIndex(data, -1) {
+		// skip matches in the data of the previous stream
+		if loc[0] < searchFrom {
+			continue
+		}
+		// the stream's dictionary starts after the obj keyword
+		objStart := bytes.LastIndex(data[searchFrom:loc[0]], []byte("obj"))
+		if objStart < 0 {
+			continue
+		}
+		dict := data[searchFrom+objStart : loc[0]]
+
+		start := loc[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := data[start : start+end]
+		searchFrom = start + end
+
+		// images, fonts, and the like aren't page content
+		if bytes.Contains(dict, []byte("/Subtype")) || bytes.Contains(dict, []byte("/Type")) ||
+			bytes.Contains(dict, []byte("/Length1")) {
+			continue
+		}
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			reader, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			remaining := pdfMaxDecodedBytes - decoded
+			stream, err = io.ReadAll(io.LimitReader(reader, int64(remaining)+1))
+			if len(stream) > remaining {
+				return nil, fmt.Errorf("PDF content is over %dMB decompressed", pdfMaxDecodedBytes>>20)
+			}
+			decoded += len(stream)
+			// truncated streams are common, use what we could read
+			if err != nil && len(stream) == 0 {
+				continue
+			}
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			// other filters are used for images
+			continue
+		}
+
+		if bytes.Contains(stream, []byte("begincmap")) {
+			cmap.parse(stream)
+			continue
+		}
+		contents = append(contents, stream)
+	}
+
+	builder := strings.Builder{}
+	for _, content := range contents {
+		pdfContentText(content, cmap, &builder)
+	}
+	doc.Text = cleanExtractedText(builder.String())
+	return doc, nil
+}
+
+func pdfContentText(content []byte, cmap *pdfCMap, builder *strings.Builder) {
+	for _, match := range pdfTextOpRegex.FindAllSubmatch(content, -1) {
+		switch {
+		case match[1] != nil:
+			builder.WriteString(cmap.decodeString(match[1]))
+		case match[2] != nil:
+			// an array of strings and kerning adjustments, large negative
+			// adjustments are the gaps between words
+			for _, part := range pdfStringRegex.FindAll(match[2], -1) {
+				if part[0] == '(' || part[0] == '<' {
+					builder.WriteString(cmap.decodeString(part))
+				} else if adjustment, err := strconv.ParseFloat(string(part), 64); err == nil && adjustment < -200 {
+					builder.WriteString(" ")
+				}
+			}
+		default:
+			builder.WriteString("\n")
+		}
+	}
+}
+
+// The character codes of a document's ToUnicode CMaps and the text they
+// stand for
+type pdfCMap struct {
+	codes map[uint32]string
+	// The length of the codes, e.g. 2 for CID fonts
+	codeBytes int
+}
+
+func (this *pdfCMap) parse(stream []byte) {
+	for _, section := range pdfBfCharRegex.FindAllSubmatch(stream, -1) {
+		for _, match := range pdfCharRegex.FindAllSubmatch(section[1], -1) {
+			this.add(match[1], 0, decodePDFHex(match[2]))
+		}
+	}
+	for _, section := range pdfBfRangeRegex.FindAllSubmatch(stream, -1) {
+		for _, match := range pdfRangeRegex.FindAllSubmatch(section[1], -1) {
+			low, err1 := strconv.ParseUint(string(match[1]), 16, 32)
+			high, err2 := strconv.ParseUint(string(match[2]), 16, 32)
+			// a bad range could otherwise add billions of codes
+			if err1 != nil || err2 != nil || high < low || high-low > 0xffff {
+				continue
+			}
+			if match[3][0] == '[' {
+				// an array of destinations, one for each code
+				for i, dest := range pdfHexRegex.FindAllSubmatch(match[3], -1) {
+					if uint64(i) > high-low {
+						break
+					}
+					this.add(match[1], uint32(i), decodePDFHex(dest[1]))
+				}
+				continue
+			}
+			// the last byte of the destination counts up through the range
+			dest := decodePDFHex(match[3][1 : len(match[3])-1])
+			for offset := uint64(0); offset <= high-low && len(dest) > 0; offset++ {
+				next := append([]byte{}, dest...)
+				next[len(next)-1] += byte(offset)
+				this.add(match[1], uint32(offset), next)
+			}
+		}
+	}
+}
+
+// Map the code in hex plus an offset to UTF-16BE text
+func (this *pdfCMap) add(codeHex []byte, offset uint32, utf16be []byte) {
+	code, err := strconv.ParseUint(string(codeHex), 16, 32)
+	if err != nil {
+		return
+	}
+	this.codeBytes = max(this.codeBytes, (len(codeHex)+1)/2)
+	this.codes[uint32(code)+offset] = pdfUTF16ToString(utf16be)
+}
+
+// The text of a literal (...) or hex <...> string from a content stream.
+// Hex strings are mapped with the CMap if there is one.
+func (this *pdfCMap) decodeString(raw []byte) string {
+	if raw[0] == '(' {
+		return decodePDFString(raw[1 : len(raw)-1])
+	}
+	data := decodePDFHex(raw[1 : len(raw)-1])
+	if len(this.codes) == 0 {
+		return pdfBytesToString(data)
+	}
+
+	builder := strings.Builder{}
+	for i := 0; i+this.codeBytes <= len(data); i += this.codeBytes {
+		code := uint32(0)
+		for _, b := range data[i : i+this.codeBytes] {
+			code = code<<8 | uint32(b)
+		}
+		builder.WriteString(this.codes[code])
+	}
+	return builder.String()
+}
+
+// Decode the digits of a hex string, whitespace is ignored and a missing
+// last digit is 0
+func decodePDFHex(digits []byte) []byte {
+	clean := make([]byte, 0, len(digits)+1)
+	for _, c := range digits {
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') {
+			clean = append(clean, c)
+		}
+	}
+	if len(clean)%2 == 1 {
+		clean = append(clean, '0')
+	}
+	decoded := make([]byte, len(clean)/2)
+	hex.Decode(decoded, clean)
+	return decoded
+}
+
+// Decode the escapes of a PDF literal string, and UTF-16 if it has a BOM
+func decodePDFString(raw []byte) string {
+	decoded := []byte{}
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c != '\\' || i+1 == len(raw) {
+			decoded = append(decoded, c)
+			continue
+		}
+
+		i++
+		switch raw[i] {
+		case 'n':
+			decoded = append(decoded, '\n')
+		case 'r':
+			decoded = append(decoded, '\r')
+		case 't':
+			decoded = append(decoded, '\t')
+		case 'b', 'f':
+		case '\r', '\n':
+			// an escaped line break continues the string
+		default:
+			if raw[i] >= '0' && raw[i] <= '7' {
+				end := i
+				for end < len(raw) && end < i+3 && raw[end] >= '0' && raw[end] <= '7' {
+					end++
+				}
+				value, _ := strconv.ParseUint(string(raw[i:end]), 8, 8)
+				decoded = append(decoded, byte(value))
+				i = end - 1
+			} else {
+				decoded = append(decoded, raw[i])
+			}
+		}
+	}
+	return pdfBytesToString(decoded)
+}
+
+// The text of a string's bytes, UTF-16 if it has a BOM
+func pdfBytesToString(decoded []byte) string {
+	if len(decoded) >= 2 && decoded[0] == 0xfe && decoded[1] == 0xff {
+		return pdfUTF16ToString(decoded[2:])
+	}
+	return string(decoded)
+}
+
+func pdfUTF16ToString(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
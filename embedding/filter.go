@@ -0,0 +1,168 @@
+package embedding
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/bakks/butterfish/proto"
+	"github.com/spf13/afero"
+)
+
+// Searches can be limited to some of the indexed files with a filter, e.g.
+// 'ext=go,path~internal/,mtime>7d,tag=runbook'. The conditions are separated
+// by commas and a file must match all of them:
+//   ext=go|ts            the file extension is one of these
+//   path~internal/       the path contains this, or matches it as a glob,
+//                        e.g. path~*_test.go or path~cmd/*/main.go
+//   mtime>2024-01-31     modified after a date, or a duration ago, e.g. 7d,
+//   mtime<12h            2w, or 12h
+//   tag=runbook          has this tag, from markdown frontmatter
+
+type SearchFilter struct {
+	// Extensions without the dot, a file matches if it has any of them
+	Extensions []string
+	// Patterns the path must match, see matchPath
+	PathPatterns []string
+	// The modification time range, unset if zero
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	// Tags the file must have, compared ignoring case
+	Tags []string
+}
+
+// Parse a filter expression, the time is used for relative times
+func ParseSearchFilter(expr string, now time.Time) (*SearchFilter, error) {
+	filter := &SearchFilter{}
+	for _, condition := range strings.Split(expr, ",") {
+		condition = strings.TrimSpace(condition)
+		if condition == "" {
+			continue
+		}
+
+		opIndex := strings.IndexAny(condition, "=~<>")
+		if opIndex <= 0 || opIndex == len(condition)-1 {
+			return nil, fmt.Errorf("Bad filter condition '%s', use a field, an operator, and a value, e.g. ext=go", condition)
+		}
+		field, op, value := condition[:opIndex], condition[opIndex], condition[opIndex+1:]
+
+		switch {
+		case field == "ext" && op == '=':
+			for _, ext := range strings.Split(value, "|") {
+				filter.Extensions = append(filter.Extensions, strings.TrimPrefix(ext, "."))
+			}
+		case field == "path" && (op == '~' || op == '='):
+			filter.PathPatterns = append(filter.PathPatterns, value)
+		case field == "mtime" && (op == '>' || op == '<'):
+			t, err := parseFilterTime(value, now)
+			if err != nil {
+				return nil, err
+			}
+			if op == '>' {
+				filter.ModifiedAfter = t
+			} else {
+				filter.ModifiedBefore = t
+			}
+		case field == "tag" && op == '=':
+			filter.Tags = append(filter.Tags, value)
+		default:
+			return nil, fmt.Errorf("Bad filter condition '%s', use ext=, path~, mtime>, mtime<, or tag=", condition)
+		}
+	}
+	return filter, nil
+}
+
+// A date, or a duration before now like 7d, 2w, or 12h
+func parseFilterTime(value string, now time.Time) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", value, now.Location())
+	if err == nil {
+		return t, nil
+	}
+
+	unit := value[len(value)-1]
+	count, err := strconv.Atoi(value[:len(value)-1])
+	if err == nil {
+		switch unit {
+		case 'd':
+			return now.AddDate(0, 0, -count), nil
+		case 'w':
+			return now.AddDate(0, 0, -7*count), nil
+		}
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Bad time '%s' in filter, use a date like 2024-01-31 or a duration like 7d", value)
+	}
+	return now.Add(-duration), nil
+}
+
+// Whether a path contains the pattern, or the pattern matches it as a glob,
+// either the whole path or its last few elements
+func matchPath(pattern, path string) bool {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return strings.Contains(path, pattern)
+	}
+
+	elements := strings.Split(filepath.ToSlash(path), "/")
+	for i := range elements {
+		matched, _ := filepath.Match(pattern, strings.Join(elements[i:], "/"))
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the file or web page at path matches the filter, a nil filter
+// matches everything. Files are only stat'ed for mtime conditions.
+func (this *SearchFilter) Matches(fs afero.Fs, path string, fileIndex *pb.FileEmbeddings) bool {
+	if this == nil {
+		return true
+	}
+
+	if len(this.Extensions) > 0 {
+		ext := strings.TrimPrefix(filepath.Ext(path), ".")
+		found := false
+		for _, extension := range this.Extensions {
+			if strings.EqualFold(ext, extension) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, pattern := range this.PathPatterns {
+		if !matchPath(pattern, path) {
+			return false
+		}
+	}
+
+	if !hasTags(fileIndex.Tags, this.Tags) {
+		return false
+	}
+
+	if this.ModifiedAfter.IsZero() && this.ModifiedBefore.IsZero() {
+		return true
+	}
+	// web pages were modified when they were fetched
+	modified := fileIndex.UpdatedAt.AsTime()
+	if fileIndex.Url == "" {
+		info, err := fs.Stat(path)
+		if err != nil {
+			return false
+		}
+		modified = info.ModTime()
+	}
+	if !this.ModifiedAfter.IsZero() && !modified.After(this.ModifiedAfter) {
+		return false
+	}
+	if !this.ModifiedBefore.IsZero() && !modified.Before(this.ModifiedBefore) {
+		return false
+	}
+	return true
+}
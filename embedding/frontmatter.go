@@ -0,0 +1,115 @@
+package embedding
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Markdown notes often start with YAML frontmatter, e.g.
+//
+//	---
+//	title: Deploying
+//	tags: [ops, runbook]
+//	---
+//
+// We store the title and tags in the index so search results can show the
+// title and searches can be limited to files with some tags.
+
+// Frontmatter longer than this isn't read
+const maxFrontmatterLines = 200
+
+type markdownFrontmatter struct {
+	Title string
+	Tags  []string
+}
+
+func isMarkdown(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// Read the frontmatter at the start of a markdown file, nil if it has none
+func readFrontmatter(fs afero.Fs, path string) (*markdownFrontmatter, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "---" {
+		return nil, scanner.Err()
+	}
+
+	lines := []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "---" {
+			return parseFrontmatter(strings.Join(lines, "\n"))
+		}
+		lines = append(lines, line)
+		if len(lines) > maxFrontmatterLines {
+			break
+		}
+	}
+	// not closed, so it's not frontmatter
+	return nil, scanner.Err()
+}
+
+func parseFrontmatter(text string) (*markdownFrontmatter, error) {
+	var fields struct {
+		Title string      `yaml:"title"`
+		Tags  interface{} `yaml:"tags"`
+	}
+	err := yaml.Unmarshal([]byte(text), &fields)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing frontmatter: %w", err)
+	}
+
+	// tags are either a list or a string separated by commas or spaces
+	tags := []string{}
+	switch value := fields.Tags.(type) {
+	case string:
+		tags = strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	case []interface{}:
+		for _, tag := range value {
+			tags = append(tags, fmt.Sprint(tag))
+		}
+	}
+
+	frontmatter := &markdownFrontmatter{Title: strings.TrimSpace(fields.Title)}
+	for _, tag := range tags {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+		if tag != "" {
+			frontmatter.Tags = append(frontmatter.Tags, tag)
+		}
+	}
+	return frontmatter, nil
+}
+
+// Whether a file has all of the tags, which are compared ignoring case
+func hasTags(fileTags, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, fileTag := range fileTags {
+			if strings.EqualFold(fileTag, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,271 @@
+package embedding
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+
+	pb "github.com/bakks/butterfish/proto"
+)
+
+// An optional approximate nearest neighbor layer, a hierarchical navigable
+// small world (HNSW) graph over the embeddings of a directory, built at index
+// time with `butterfish index --ann`. Searching the graph visits a small part
+// of the vectors, so large directories return in milliseconds rather than
+// scoring every chunk. Directories with fewer than hnswMinNodes chunks are
+// searched exactly since that's fast enough and always accurate.
+
+const (
+	hnswMinNodes = 1000
+	// Neighbors per node on upper levels, level 0 has twice as many
+	hnswM              = 16
+	hnswEfConstruction = 100
+	// Candidates kept while searching, more is slower but more accurate
+	hnswEfSearch = 64
+)
+
+// An embedding in a directory index, in graph node order
+type hnswNodeRef struct {
+	Filename  string
+	Embedding *pb.AnnotatedEmbedding
+}
+
+// The embeddings of a directory index in node order, i.e. files in name
+// order then chunks in order
+func hnswNodes(dirIndex *pb.DirectoryIndex) []hnswNodeRef {
+	names := make([]string, 0, len(dirIndex.Files))
+	for name := range dirIndex.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nodes := []hnswNodeRef{}
+	for _, name := range names {
+		for _, embedding := range dirIndex.Files[name].Embeddings {
+			nodes = append(nodes, hnswNodeRef{name, embedding})
+		}
+	}
+	return nodes
+}
+
+type hnswCandidate struct {
+	id    uint32
+	score float64
+}
+
+// A heap of candidates, either closest or furthest first
+type candidateHeap struct {
+	items        []hnswCandidate
+	closestFirst bool
+}
+
+func (this *candidateHeap) Len() int { return len(this.items) }
+func (this *candidateHeap) Less(i, j int) bool {
+	if this.closestFirst {
+		return this.items[i].score > this.items[j].score
+	}
+	return this.items[i].score < this.items[j].score
+}
+func (this *candidateHeap) Swap(i, j int) {
+	this.items[i], this.items[j] = this.items[j], this.items[i]
+}
+func (this *candidateHeap) Push(x any) { this.items = append(this.items, x.(hnswCandidate)) }
+func (this *candidateHeap) Pop() any {
+	last := this.items[len(this.items)-1]
+	this.items = this.items[:len(this.items)-1]
+	return last
+}
+
+// The graph operations shared by building and searching, so searching can
+// read the stored graph without converting it
+type hnswGraph struct {
+	vector    func(id uint32) []float32
+	neighbors func(id uint32, level int) []uint32
+}
+
+func (this *hnswGraph) score(query []float32, queryNorm float64, id uint32) float64 {
+	return cosineSimilarity(query, queryNorm, this.vector(id))
+}
+
+// Greedy search of one level from the entry points, returning up to ef of
+// the closest nodes found, closest first
+func (this *hnswGraph) searchLevel(query []float32, queryNorm float64,
+	entries []hnswCandidate, ef, level int) []hnswCandidate {
+	visited := map[uint32]bool{}
+	candidates := &candidateHeap{closestFirst: true}
+	results := &candidateHeap{}
+	for _, entry := range entries {
+		visited[entry.id] = true
+		heap.Push(candidates, entry)
+		heap.Push(results, entry)
+	}
+
+	for candidates.Len() > 0 {
+		candidate := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && candidate.score < results.items[0].score {
+			break
+		}
+
+		for _, id := range this.neighbors(candidate.id, level) {
+			if visited[id] {
+				continue
+			}
+			visited[id] = true
+
+			score := this.score(query, queryNorm, id)
+			if results.Len() < ef || score > results.items[0].score {
+				heap.Push(candidates, hnswCandidate{id, score})
+				heap.Push(results, hnswCandidate{id, score})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	found := results.items
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].score > found[j].score
+	})
+	return found
+}
+
+// Descend from the entry point through the upper levels, then search level 0
+func (this *hnswGraph) search(query []float32, entryPoint uint32, maxLevel, ef int) []hnswCandidate {
+	queryNorm := vectorNorm(query)
+	entries := []hnswCandidate{{entryPoint, this.score(query, queryNorm, entryPoint)}}
+	for level := maxLevel; level > 0; level-- {
+		entries = this.searchLevel(query, queryNorm, entries, 1, level)
+	}
+	return this.searchLevel(query, queryNorm, entries, ef, 0)
+}
+
+// Build a graph over the directory's embeddings, nil if there are too few
+// to need one
+func buildHNSW(dirIndex *pb.DirectoryIndex) *pb.HnswGraph {
+	nodes := hnswNodes(dirIndex)
+	if len(nodes) < hnswMinNodes {
+		return nil
+	}
+
+	vectors := make([][]float32, len(nodes))
+	for i, node := range nodes {
+		vectors[i] = EmbeddingVector(node.Embedding)
+	}
+	levels := make([][][]uint32, len(nodes))
+
+	graph := &hnswGraph{
+		vector: func(id uint32) []float32 { return vectors[id] },
+		neighbors: func(id uint32, level int) []uint32 {
+			if level >= len(levels[id]) {
+				return nil
+			}
+			return levels[id][level]
+		},
+	}
+
+	// seeded so that re-indexing the same files gives the same graph
+	random := rand.New(rand.NewSource(int64(len(nodes))))
+	levelMult := 1 / math.Log(hnswM)
+	entryPoint, maxLevel := uint32(0), 0
+
+	for i := range nodes {
+		id := uint32(i)
+		level := int(-math.Log(1-random.Float64()) * levelMult)
+		levels[id] = make([][]uint32, level+1)
+		if i == 0 {
+			maxLevel = level
+			continue
+		}
+
+		query := vectors[id]
+		queryNorm := vectorNorm(query)
+		entries := []hnswCandidate{{entryPoint, graph.score(query, queryNorm, entryPoint)}}
+		for l := maxLevel; l > level; l-- {
+			entries = graph.searchLevel(query, queryNorm, entries, 1, l)
+		}
+
+		for l := min(level, maxLevel); l >= 0; l-- {
+			entries = graph.searchLevel(query, queryNorm, entries, hnswEfConstruction, l)
+			maxNeighbors := hnswM
+			if l == 0 {
+				maxNeighbors = 2 * hnswM
+			}
+
+			for _, neighbor := range entries[:min(len(entries), maxNeighbors)] {
+				levels[id][l] = append(levels[id][l], neighbor.id)
+				levels[neighbor.id][l] = append(levels[neighbor.id][l], id)
+				if len(levels[neighbor.id][l]) > maxNeighbors {
+					levels[neighbor.id][l] = closestNeighbors(graph, neighbor.id, levels[neighbor.id][l], maxNeighbors)
+				}
+			}
+		}
+
+		if level > maxLevel {
+			entryPoint, maxLevel = id, level
+		}
+	}
+
+	stored := &pb.HnswGraph{
+		Nodes:      make([]*pb.HnswNode, len(nodes)),
+		EntryPoint: entryPoint,
+		MaxLevel:   uint32(maxLevel),
+	}
+	for i, nodeLevels := range levels {
+		node := &pb.HnswNode{Levels: make([]*pb.HnswNeighbors, len(nodeLevels))}
+		for l, ids := range nodeLevels {
+			node.Levels[l] = &pb.HnswNeighbors{Ids: ids}
+		}
+		stored.Nodes[i] = node
+	}
+	return stored
+}
+
+// Prune a node's neighbors to the closest n
+func closestNeighbors(graph *hnswGraph, id uint32, neighbors []uint32, n int) []uint32 {
+	query := graph.vector(id)
+	queryNorm := vectorNorm(query)
+	candidates := make([]hnswCandidate, len(neighbors))
+	for i, neighbor := range neighbors {
+		candidates[i] = hnswCandidate{neighbor, graph.score(query, queryNorm, neighbor)}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	pruned := make([]uint32, n)
+	for i := range pruned {
+		pruned[i] = candidates[i].id
+	}
+	return pruned
+}
+
+// Search a directory's graph for the closest numResults nodes, returns
+// false if the graph doesn't match the embeddings, e.g. if it was built by a
+// version that ordered nodes differently, so the caller searches exactly
+func searchHNSW(dirIndex *pb.DirectoryIndex, nodes []hnswNodeRef,
+	query []float32, numResults int) ([]hnswCandidate, bool) {
+	stored := dirIndex.Hnsw
+	if stored == nil || len(stored.Nodes) != len(nodes) || len(nodes) == 0 {
+		return nil, false
+	}
+
+	// reused for dequantizing, each vector is scored before the next is read
+	buf := make([]float32, len(query))
+	graph := &hnswGraph{
+		vector: func(id uint32) []float32 {
+			return embeddingVectorInto(nodes[id].Embedding, buf)
+		},
+		neighbors: func(id uint32, level int) []uint32 {
+			nodeLevels := stored.Nodes[id].Levels
+			if level >= len(nodeLevels) {
+				return nil
+			}
+			return nodeLevels[level].Ids
+		},
+	}
+
+	found := graph.search(query, stored.EntryPoint, int(stored.MaxLevel), max(numResults, hnswEfSearch))
+	return found[:min(len(found), numResults)], true
+}
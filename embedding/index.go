@@ -2,9 +2,13 @@ package embedding
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
+	"math"
 	"mime"
 	"os"
 	"path/filepath"
@@ -13,7 +17,7 @@ import (
 	"time"
 
 	pb "github.com/bakks/butterfish/proto"
-	"github.com/drewlanenga/govector"
+	"github.com/bakks/butterfish/storage"
 	"github.com/golang/protobuf/proto"
 	"github.com/spf13/afero"
 	fsutil "golang.org/x/tools/godoc/util"
@@ -23,38 +27,85 @@ import (
 	util "github.com/bakks/butterfish/util"
 )
 
+// Embedders embed a batch of strings with the given model, dimensions is the
+// length of the returned vectors for models that can shorten them, or 0 for
+// the model's default
 type Embedder interface {
-	CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error)
+	CalculateEmbeddings(ctx context.Context, content []string, model string, dimensions int) ([][]float32, error)
 }
 
+// The model used when none is set, and by indexes created before the model
+// was recorded in the index
+const DefaultEmbeddingModel = "text-embedding-ada-002"
+
+// The limits of a single OpenAI embeddings API call
+const (
+	DefaultChunksPerCall = 2048
+	DefaultTokensPerCall = 300000
+)
+
 type FileEmbeddingIndex interface {
 	SetEmbedder(embedder Embedder)
+	SetEmbeddingModel(model string, dimensions int)
+	SetPrecision(precision string)
+	SetANN(enabled bool)
+	SetFilter(filter *SearchFilter)
 	Search(ctx context.Context, query string, numResults int) ([]*VectorSearchResult, error)
 	Vectorize(ctx context.Context, content string) ([]float32, error)
 	SearchWithVector(ctx context.Context, queryVector []float32, k int) ([]*VectorSearchResult, error)
 	PopulateSearchResults(ctx context.Context, embeddings []*VectorSearchResult) error
 	ClearPaths(ctx context.Context, paths []string) error
 	ClearPath(ctx context.Context, path string) error
+	CompactPaths(ctx context.Context, paths []string) (*CompactStats, error)
 	LoadPaths(ctx context.Context, paths []string) error
 	LoadPath(ctx context.Context, path string) error
 	IndexPaths(ctx context.Context, paths []string, forceUpdate bool, chunkSize, maxChunks int) error
 	IndexPath(ctx context.Context, path string, forceUpdate bool, chunkSize, maxChunks int) error
+	IndexURL(ctx context.Context, path, pageURL string, chunkSize, maxChunks int) (*ExtractedDocument, error)
 	IndexedFiles() []string
+	ExportIndex(ctx context.Context, dir string, out io.Writer) (int, error)
+	ImportIndex(ctx context.Context, dir string, in io.Reader) (*ImportStats, error)
 }
 
 type VectorSearchResult struct {
 	Score    float64
 	FilePath string
-	Start    uint64
-	End      uint64
-	Vector   []float32
-	Content  string
+	// The document title, for files whose text is extracted
+	Title string
+	// The URL of a web page, which is also its FilePath
+	URL string
+	// Tags from markdown frontmatter
+	Tags []string
+	// The 1-based cell number of a chunk of a notebook, 0 for other files
+	Cell    uint32
+	Start   uint64
+	End     uint64
+	Vector  []float32
+	Content string
+}
+
+// Where a result is from, its path or URL, with its title and notebook cell
+// if it has them
+func (this *VectorSearchResult) Citation() string {
+	citation := this.FilePath
+	if this.Title != "" {
+		citation += fmt.Sprintf(" (%s)", this.Title)
+	}
+	if this.Cell > 0 {
+		citation += fmt.Sprintf(" cell %d", this.Cell)
+	}
+	return citation
 }
 
 type DiskCachedEmbeddingIndex struct {
 	// maps absolute path of directory to a directory Index
 	Index map[string]*pb.DirectoryIndex
 
+	// Index files under these paths are searched along with Index without
+	// being loaded into it, they're read one at a time so that searching a
+	// large index doesn't need it all in memory
+	ScanPaths []string
+
 	// Interface to an Embedder used to embed chunks of documents
 	Embedder Embedder
 
@@ -74,15 +125,50 @@ type DiskCachedEmbeddingIndex struct {
 	// The name of the file to cache the index on disk
 	DotfileName string
 
+	// The model and dimensions used to embed files, recorded in each
+	// directory index. Queries are embedded with the model of the index they
+	// search, so these only matter when indexing.
+	EmbeddingModel string
+	Dimensions     int
+
+	// The precision embeddings are stored at when indexing, float32,
+	// float16, or int8, see quantize.go. If empty directories keep the
+	// precision they were indexed at.
+	Precision string
+
+	// If set, searches only return chunks of files that match it, see
+	// filter.go
+	Filter *SearchFilter
+
+	// Whether to build an approximate nearest neighbor graph for directories
+	// with many chunks when indexing, see hnsw.go. Once built a graph is
+	// kept up to date whether or not this is set.
+	ANN bool
+
 	// When we call the embedder we batch chunks together into a single call,
-	// this is the number of chunks to batch together
+	// across files in the same directory, up to this number of chunks and
+	// this number of tokens. We count a byte as a token since a token is at
+	// least one byte, so we stay under the provider's limit.
 	ChunksPerCall int
+	TokensPerCall int
 
 	// When we embed a path we skip these directories
 	IgnoreDirs []string
 
 	// When we embed a path we skip these files
 	IgnoreFiles []string
+
+	// If set, index files are encrypted when saved, and encrypted index files
+	// can only be loaded with the same key
+	Cipher *util.Cipher
+
+	// If set, chunks are looked up here before they're embedded and new
+	// embeddings are added to it, see cache.go
+	Cache EmbeddingCache
+
+	// If set, index files are kept here, keyed by their path, rather than
+	// written next to the indexed files through Fs
+	Store storage.Store
 }
 
 func NewDiskCachedEmbeddingIndex(embedder Embedder, writer io.Writer) *DiskCachedEmbeddingIndex {
@@ -101,13 +187,35 @@ func NewDiskCachedEmbeddingIndex(embedder Embedder, writer io.Writer) *DiskCache
 
 func (this *DiskCachedEmbeddingIndex) SetDefaultConfig() {
 	this.DotfileName = ".butterfish_index"
-	this.ChunksPerCall = 32
+	this.EmbeddingModel = DefaultEmbeddingModel
+	this.ChunksPerCall = DefaultChunksPerCall
+	this.TokensPerCall = DefaultTokensPerCall
 }
 
 func (this *DiskCachedEmbeddingIndex) SetEmbedder(embedder Embedder) {
 	this.Embedder = embedder
 }
 
+func (this *DiskCachedEmbeddingIndex) SetEmbeddingModel(model string, dimensions int) {
+	if model == "" {
+		model = DefaultEmbeddingModel
+	}
+	this.EmbeddingModel = model
+	this.Dimensions = dimensions
+}
+
+func (this *DiskCachedEmbeddingIndex) SetPrecision(precision string) {
+	this.Precision = precision
+}
+
+func (this *DiskCachedEmbeddingIndex) SetANN(enabled bool) {
+	this.ANN = enabled
+}
+
+func (this *DiskCachedEmbeddingIndex) SetFilter(filter *SearchFilter) {
+	this.Filter = filter
+}
+
 func (this *DiskCachedEmbeddingIndex) SetOutput(out io.Writer) {
 	this.Out = out
 	this.Verbosity = 2
@@ -117,23 +225,62 @@ func (this *DiskCachedEmbeddingIndex) SetVerbosity(verbosity int) {
 	this.Verbosity = verbosity
 }
 
-// Search the vectors that have been loaded into memory by embedding the
-// query string and then searching for the closest vectors based on a cosine
-// distance. This method calls the following methods in succession.
+// The model and dimensions a directory index was embedded with, vectors can
+// only be compared with others from the same space
+type embeddingSpace struct {
+	Model      string
+	Dimensions int
+}
+
+func indexEmbeddingSpace(dirIndex *pb.DirectoryIndex) embeddingSpace {
+	model := dirIndex.EmbeddingModel
+	if model == "" {
+		model = DefaultEmbeddingModel
+	}
+	return embeddingSpace{Model: model, Dimensions: int(dirIndex.Dimensions)}
+}
+
+func (this embeddingSpace) String() string {
+	if this.Dimensions == 0 {
+		return this.Model
+	}
+	return fmt.Sprintf("%s (%d dimensions)", this.Model, this.Dimensions)
+}
+
+// Search the index by embedding the query string and then searching for the
+// closest vectors based on a cosine distance. The query is embedded once for
+// each model used by the directory indexes, and each index is searched with
+// the matching query vector. This method calls the following methods in
+// succession.
 // 1. Vectorize()
 // 2. SearchWithVector()
 // 3. PopulateSearchResults()
 func (this *DiskCachedEmbeddingIndex) Search(ctx context.Context, query string, numResults int) ([]*VectorSearchResult, error) {
-	queryVector, err := this.Vectorize(ctx, query)
+	top := newTopResults(numResults)
+	queryVectors := map[embeddingSpace][]float32{}
+
+	err := this.eachDirIndex(ctx, func(dirPath string, dirIndex *pb.DirectoryIndex) error {
+		space := indexEmbeddingSpace(dirIndex)
+		queryVector, ok := queryVectors[space]
+		if !ok {
+			var err error
+			queryVector, err = this.vectorize(ctx, query, space)
+			if err != nil {
+				return err
+			}
+			queryVectors[space] = queryVector
+		}
+		return this.searchDir(ctx, queryVector, dirPath, dirIndex, top)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	results, err := this.SearchWithVector(ctx, queryVector, numResults)
-	if err != nil {
-		return nil, err
+	if len(queryVectors) > 1 {
+		fmt.Fprintf(this.Out, "Warning: the indexes were embedded with different models, their scores may not be comparable, re-index with --force to use one model\n")
 	}
 
+	results := top.Results()
 	err = this.PopulateSearchResults(ctx, results)
 	if err != nil {
 		return nil, err
@@ -142,13 +289,18 @@ func (this *DiskCachedEmbeddingIndex) Search(ctx context.Context, query string,
 	return results, nil
 }
 
-// Vectorize the given string by embedding it with the current embedder.
+// Vectorize the given string by embedding it with the current embedder and
+// the index's embedding model.
 func (this *DiskCachedEmbeddingIndex) Vectorize(ctx context.Context, content string) ([]float32, error) {
+	return this.vectorize(ctx, content, embeddingSpace{this.EmbeddingModel, this.Dimensions})
+}
+
+func (this *DiskCachedEmbeddingIndex) vectorize(ctx context.Context, content string, space embeddingSpace) ([]float32, error) {
 	if this.Embedder == nil {
 		return nil, fmt.Errorf("no embedder set")
 	}
 
-	embeddings, err := this.Embedder.CalculateEmbeddings(ctx, []string{content})
+	embeddings, err := this.Embedder.CalculateEmbeddings(ctx, []string{content}, space.Model, space.Dimensions)
 	if err != nil {
 		return nil, err
 	}
@@ -156,67 +308,205 @@ func (this *DiskCachedEmbeddingIndex) Vectorize(ctx context.Context, content str
 	return embeddings[0], nil
 }
 
-// Super naive vector search operation.
-// - First we brute force search by iterating over all stored vectors
-//     and calculating cosine distance
-// - Next we sort based on score
+// Super naive vector search operation, we brute force search by iterating
+// over all stored vectors and calculating cosine distance, keeping the
+// closest numResults.
 func (this *DiskCachedEmbeddingIndex) SearchWithVector(ctx context.Context,
 	queryVector []float32, numResults int) ([]*VectorSearchResult, error) {
-	// Turn queryVector float array into a govector
-	query, err := govector.AsVector(queryVector)
+	top := newTopResults(numResults)
+	err := this.eachDirIndex(ctx, func(dirPath string, dirIndex *pb.DirectoryIndex) error {
+		return this.searchDir(ctx, queryVector, dirPath, dirIndex, top)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	results := []*VectorSearchResult{}
+	return top.Results(), nil
+}
+
+// Call fn with each loaded directory index, then with each index file under
+// ScanPaths that isn't loaded. Scanned indexes aren't kept, so only one of
+// them is in memory at a time.
+func (this *DiskCachedEmbeddingIndex) eachDirIndex(ctx context.Context,
+	fn func(dirPath string, dirIndex *pb.DirectoryIndex) error) error {
+	for dirPath, dirIndex := range this.Index {
+		err := fn(dirPath, dirIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	scanned := map[string]bool{}
+	for _, path := range this.ScanPaths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+
+		dotfiles, err := this.dotfilesInPath(ctx, path)
+		if err != nil {
+			return err
+		}
 
-	for dirIndexAbsPath, dirIndex := range this.Index {
-		for filename, fileIndex := range dirIndex.Files {
-			if ctx.Err() != nil {
-				return nil, ctx.Err()
+		for _, dotfile := range dotfiles {
+			dirPath := filepath.Dir(dotfile)
+			if _, ok := this.Index[dirPath]; ok || scanned[dirPath] {
+				continue
 			}
+			scanned[dirPath] = true
 
-			for _, embedding := range fileIndex.Embeddings {
-				govec, err := govector.AsVector(embedding.Vector)
+			dirIndex, err := this.readDotfile(dotfile)
+			if err != nil {
+				return err
+			}
+			if dirIndex == nil {
+				continue
+			}
 
-				distance, err := govector.Cosine(query, govec)
-				if err != nil {
-					return nil, err
-				}
+			err = fn(dirPath, dirIndex)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Score every vector in a directory index against the query vector, keeping
+// the closest in top. Vectors of a different length than the query were
+// embedded with a different model than the index records, so we ask for a
+// re-index rather than return meaningless scores.
+func (this *DiskCachedEmbeddingIndex) searchDir(ctx context.Context, queryVector []float32,
+	dirPath string, dirIndex *pb.DirectoryIndex, top *topResults) error {
+	// the graph can't skip files, so filtered searches are exact
+	if dirIndex.Hnsw != nil && this.Filter == nil {
+		nodes := hnswNodes(dirIndex)
+		if len(nodes) > 0 && len(EmbeddingVector(nodes[0].Embedding)) != len(queryVector) {
+			return dimensionMismatch(dirPath, dirIndex, len(EmbeddingVector(nodes[0].Embedding)), len(queryVector))
+		}
 
-				absPath := filepath.Join(dirIndexAbsPath, filename)
-				result := &VectorSearchResult{
-					Score:    distance,
-					FilePath: absPath,
-					Start:    embedding.Start,
-					End:      embedding.End,
-					Vector:   embedding.Vector,
+		found, ok := searchHNSW(dirIndex, nodes, queryVector, top.numResults)
+		if ok {
+			for _, candidate := range found {
+				if !top.Accepts(candidate.score) {
+					continue
 				}
-				results = append(results, result)
+				node := nodes[candidate.id]
+				top.Add(newSearchResult(dirPath, node.Filename, dirIndex.Files[node.Filename],
+					node.Embedding, candidate.score))
 			}
+			return nil
 		}
 	}
 
-	sort.Slice(results, func(i, j int) bool {
-		return results[i].Score > results[j].Score
-	})
+	queryNorm := vectorNorm(queryVector)
+	// reused for dequantizing so we don't allocate for every vector
+	buf := make([]float32, len(queryVector))
 
-	// truncate to numResults results
-	results = results[:util.Min(len(results), numResults)]
+	for filename, fileIndex := range dirIndex.Files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if this.Filter != nil {
+			path := filepath.Join(dirPath, filename)
+			if fileIndex.Url != "" {
+				path = fileIndex.Url
+			}
+			if !this.Filter.Matches(this.Fs, path, fileIndex) {
+				continue
+			}
+		}
 
-	return results, nil
+		for _, embedding := range fileIndex.Embeddings {
+			vector := embeddingVectorInto(embedding, buf)
+			if len(vector) != len(queryVector) {
+				return dimensionMismatch(dirPath, dirIndex, len(vector), len(queryVector))
+			}
+
+			score := cosineSimilarity(queryVector, queryNorm, vector)
+			if !top.Accepts(score) {
+				continue
+			}
+
+			top.Add(newSearchResult(dirPath, filename, fileIndex, embedding, score))
+		}
+	}
+
+	return nil
+}
+
+// A result for a chunk of a file or web page, web pages get their content now
+// since it's in the index
+func newSearchResult(dirPath, filename string, fileIndex *pb.FileEmbeddings,
+	embedding *pb.AnnotatedEmbedding, score float64) *VectorSearchResult {
+	result := &VectorSearchResult{
+		Score:    score,
+		FilePath: filepath.Join(dirPath, filename),
+		Title:    fileIndex.Title,
+		Tags:     fileIndex.Tags,
+		Cell:     embedding.Cell,
+		Start:    embedding.Start,
+		End:      embedding.End,
+		Vector:   EmbeddingVector(embedding),
+	}
+	if fileIndex.Url != "" {
+		result.FilePath = fileIndex.Url
+		result.URL = fileIndex.Url
+		result.Content = pageChunk(fileIndex, embedding.Start, embedding.End)
+	}
+	return result
+}
+
+func dimensionMismatch(dirPath string, dirIndex *pb.DirectoryIndex, indexDimensions, queryDimensions int) error {
+	return fmt.Errorf("The index in %s has %d-dimension vectors but the query embedded with %s has %d, re-index it with `butterfish index --force %s`",
+		dirPath, indexDimensions, indexEmbeddingSpace(dirIndex), queryDimensions, dirPath)
 }
 
 // Given an array of VectorSearchResults, fetch the file contents for each
-// result and store it in the result's Content field.
+// result and store it in the result's Content field. Extracted documents are
+// extracted again since the result's offsets are into their text, and web
+// pages already have their content.
 func (this *DiskCachedEmbeddingIndex) PopulateSearchResults(ctx context.Context,
 	results []*VectorSearchResult) error {
+	extracted := map[string]string{}
+	skipped := map[string]bool{}
 
 	for _, result := range results {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
 
+		if result.URL != "" {
+			continue
+		}
+
+		start := result.Start
+		end := result.End
+
+		if extractorFor(result.FilePath) != nil {
+			if skipped[result.FilePath] {
+				continue
+			}
+			text, ok := extracted[result.FilePath]
+			if !ok {
+				doc, err := extractFile(this.Fs, result.FilePath)
+				if err != nil {
+					// the file may have been broken since it was indexed
+					fmt.Fprintf(this.Out, "Skipping %s: %s\n", result.FilePath, err)
+					skipped[result.FilePath] = true
+					continue
+				}
+				text = doc.Text
+				extracted[result.FilePath] = text
+			}
+			// the file may have changed since it was indexed
+			end = min(end, uint64(len(text)))
+			start = min(start, end)
+			result.Content = text[start:end]
+			continue
+		}
+
 		// read the file
 		f, err := this.Fs.Open(result.FilePath)
 		if err != nil {
@@ -224,9 +514,6 @@ func (this *DiskCachedEmbeddingIndex) PopulateSearchResults(ctx context.Context,
 		}
 		defer f.Close()
 
-		start := result.Start
-		end := result.End
-
 		// seek to the start byte
 		_, err = f.Seek(int64(start), 0)
 		if err != nil {
@@ -254,39 +541,91 @@ func (this *DiskCachedEmbeddingIndex) LoadDotfile(dotfile string) error {
 		fmt.Fprintf(this.Out, "DiskCachedEmbeddingIndex.LoadDotfile(%s)\n", dotfile)
 	}
 
-	// Read the entire dotfile into a bytes buffer
-	file, err := this.Fs.Open(dotfile)
-	if err != nil {
-		return nil
+	dirIndex, err := this.readDotfile(dotfile)
+	if err != nil || dirIndex == nil {
+		return err
 	}
-	defer file.Close()
 
-	// Read the entire file into a buffer
-	buf, err := ioutil.ReadAll(file)
+	absPath, err := filepath.Abs(dotfile)
 	if err != nil {
 		return err
 	}
+	indexName := filepath.Dir(absPath)
+
+	// put the loaded info in the memory index
+	this.Index[indexName] = dirIndex
+
+	if this.Verbosity >= 1 {
+		fmt.Fprintf(this.Out, "Loaded index cache at %s\n", dotfile)
+	}
+	return nil
+}
+
+// Read an index file, nil if there isn't one
+func (this *DiskCachedEmbeddingIndex) readDotfile(dotfile string) (*pb.DirectoryIndex, error) {
+	buf, err := this.readIndexFile(dotfile)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf, err = this.Cipher.Decrypt(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading %s: %w", dotfile, err)
+	}
 
 	// Unmarshal the buffer into a DirectoryIndex
 	var dirIndex pb.DirectoryIndex
 	err = proto.Unmarshal(buf, &dirIndex)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	absPath, err := filepath.Abs(dotfile)
+	return &dirIndex, nil
+}
+
+// The contents of an index file, an error wrapping storage.ErrNotFound if
+// there isn't one
+func (this *DiskCachedEmbeddingIndex) readIndexFile(dotfile string) ([]byte, error) {
+	if this.Store != nil {
+		return this.Store.Get(context.Background(), filepath.ToSlash(dotfile))
+	}
+	buf, err := afero.ReadFile(this.Fs, dotfile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", dotfile, storage.ErrNotFound)
+	}
+	return buf, err
+}
+
+func (this *DiskCachedEmbeddingIndex) writeIndexFile(dotfile string, buf []byte) error {
+	if this.Store != nil {
+		return this.Store.Put(context.Background(), filepath.ToSlash(dotfile), buf)
+	}
+	err := this.Fs.MkdirAll(filepath.Dir(dotfile), 0755)
 	if err != nil {
 		return err
 	}
-	indexName := filepath.Dir(absPath)
+	return afero.WriteFile(this.Fs, dotfile, buf, 0644)
+}
 
-	// put the loaded info in the memory index
-	this.Index[indexName] = &dirIndex
+func (this *DiskCachedEmbeddingIndex) removeIndexFile(dotfile string) error {
+	if this.Store != nil {
+		return this.Store.Delete(context.Background(), filepath.ToSlash(dotfile))
+	}
+	return this.Fs.Remove(dotfile)
+}
 
-	if this.Verbosity >= 1 {
-		fmt.Fprintf(this.Out, "Loaded index cache at %s\n", dotfile)
+func (this *DiskCachedEmbeddingIndex) indexFileSize(dotfile string) (int64, error) {
+	if this.Store != nil {
+		buf, err := this.readIndexFile(dotfile)
+		return int64(len(buf)), err
 	}
-	return nil
+	info, err := this.Fs.Stat(dotfile)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
 }
 
 func (this *DiskCachedEmbeddingIndex) SavePaths(paths []string) error {
@@ -317,6 +656,10 @@ func (this *DiskCachedEmbeddingIndex) SavePath(path string) error {
 	if err != nil {
 		return err
 	}
+	buf, err = this.Cipher.Encrypt(buf)
+	if err != nil {
+		return err
+	}
 
 	if this.DotfileName == "" {
 		panic("DotfileName not set")
@@ -328,7 +671,7 @@ func (this *DiskCachedEmbeddingIndex) SavePath(path string) error {
 	}
 
 	// Write the buffer to the dotfile
-	err = afero.WriteFile(this.Fs, dotfilePath, buf, 0644)
+	err = this.writeIndexFile(dotfilePath, buf)
 	if err != nil {
 		return err
 	}
@@ -420,21 +763,24 @@ func (this *DiskCachedEmbeddingIndex) IndexableFile(path string, file os.FileInf
 		return false
 	}
 
-	// Ignore files that are not text based on file name
-	mimeType := mime.TypeByExtension(filepath.Ext(name))
-	if mimeType != "" && !strings.HasPrefix(mimeType, "text/") {
-		return false
-	}
-
 	// Ignore files in the disallow list
 	if contains(this.IgnoreFiles, name) {
 		return false
 	}
 
-	// Ignore files that are not text based on a content check
-	opener := &vfsOpener{this.Fs}
-	if !fsutil.IsTextFile(opener, filepath.Join(path, name)) {
-		return false
+	// Documents we can extract text from aren't text files themselves
+	if extractorFor(name) == nil {
+		// Ignore files that are not text based on file name
+		mimeType := mime.TypeByExtension(filepath.Ext(name))
+		if mimeType != "" && !strings.HasPrefix(mimeType, "text/") {
+			return false
+		}
+
+		// Ignore files that are not text based on a content check
+		opener := &vfsOpener{this.Fs}
+		if !fsutil.IsTextFile(opener, filepath.Join(path, name)) {
+			return false
+		}
 	}
 
 	if !forceUpdate && previousEmbeddings != nil {
@@ -488,6 +834,25 @@ func (this *DiskCachedEmbeddingIndex) dotfilesInPath(ctx context.Context, path s
 		return nil, ctx.Err()
 	}
 
+	if this.Store != nil {
+		// index files are saved by absolute path
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := this.Store.List(ctx, filepath.ToSlash(path))
+		if err != nil {
+			return nil, err
+		}
+		dotfiles := []string{}
+		for _, key := range keys {
+			if filepath.Base(key) == this.DotfileName {
+				dotfiles = append(dotfiles, filepath.FromSlash(key))
+			}
+		}
+		return dotfiles, nil
+	}
+
 	dotfiles := []string{}
 
 	// Use Walk to search recursively for dotfiles
@@ -537,7 +902,7 @@ func (this *DiskCachedEmbeddingIndex) ClearPath(ctx context.Context, path string
 			fmt.Fprintf(this.Out, "Removing dotfile %s\n", dotfile)
 		}
 
-		err = this.Fs.Remove(dotfile)
+		err = this.removeIndexFile(dotfile)
 		if err != nil {
 			return err
 		}
@@ -550,10 +915,145 @@ func (this *DiskCachedEmbeddingIndex) ClearPath(ctx context.Context, path string
 	return nil
 }
 
+// What compacting an index removed
+type CompactStats struct {
+	// Files that were deleted since they were indexed
+	FilesRemoved int
+	// Chunks of deleted files and chunks identical to another chunk
+	ChunksRemoved int
+	// Index files deleted because nothing in their directory is indexed
+	IndexesRemoved int
+	// Size of the index files before and after
+	BytesBefore int64
+	BytesAfter  int64
+}
+
+func (this *CompactStats) BytesReclaimed() int64 {
+	return this.BytesBefore - this.BytesAfter
+}
+
+func (this *DiskCachedEmbeddingIndex) CompactPaths(ctx context.Context, paths []string) (*CompactStats, error) {
+	stats := &CompactStats{}
+	// shared across paths so duplicates are found across all of them
+	seen := map[[sha256.Size]byte]bool{}
+	for _, path := range paths {
+		err := this.compactPath(ctx, path, seen, stats)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// Indexes only grow as files change and are deleted, so we garbage collect
+// them by reloading each index file under path and:
+// 1. Removing the files that no longer exist
+// 2. Removing chunks whose vector is identical to one already seen, e.g.
+//    license headers, so searches don't return the same text several times
+// 3. Rewriting the index file, or deleting it if nothing is left
+func (this *DiskCachedEmbeddingIndex) compactPath(ctx context.Context, path string,
+	seen map[[sha256.Size]byte]bool, stats *CompactStats) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	dotfiles, err := this.dotfilesInPath(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	for _, dotfile := range dotfiles {
+		size, err := this.indexFileSize(dotfile)
+		if err != nil {
+			return err
+		}
+		stats.BytesBefore += size
+
+		// reload in case the in-memory copy is stale
+		err = this.LoadDotfile(dotfile)
+		if err != nil {
+			return err
+		}
+		dirPath := filepath.Dir(dotfile)
+		dirIndex, ok := this.Index[dirPath]
+		if !ok {
+			continue
+		}
+
+		names := make([]string, 0, len(dirIndex.Files))
+		for name := range dirIndex.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fileIndex := dirIndex.Files[name]
+			// web pages have no file to check
+			fileInfo, err := this.Fs.Stat(filepath.Join(dirPath, name))
+			if fileIndex.Url == "" && (err != nil || fileInfo.IsDir()) {
+				stats.FilesRemoved++
+				stats.ChunksRemoved += len(fileIndex.Embeddings)
+				delete(dirIndex.Files, name)
+				continue
+			}
+
+			kept := fileIndex.Embeddings[:0]
+			for _, embedding := range fileIndex.Embeddings {
+				key := vectorKey(EmbeddingVector(embedding))
+				if seen[key] {
+					stats.ChunksRemoved++
+					continue
+				}
+				seen[key] = true
+				kept = append(kept, embedding)
+			}
+			fileIndex.Embeddings = kept
+		}
+
+		if len(dirIndex.Files) == 0 {
+			err = this.removeIndexFile(dotfile)
+			if err != nil {
+				return err
+			}
+			delete(this.Index, dirPath)
+			stats.IndexesRemoved++
+			continue
+		}
+
+		if dirIndex.Hnsw != nil {
+			dirIndex.Hnsw = buildHNSW(dirIndex)
+		}
+		err = this.SavePath(dirPath)
+		if err != nil {
+			return err
+		}
+		size, err = this.indexFileSize(dotfile)
+		if err != nil {
+			return err
+		}
+		stats.BytesAfter += size
+	}
+
+	return nil
+}
+
+func vectorKey(vector []float32) [sha256.Size]byte {
+	buf := make([]byte, 4*len(vector))
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(value))
+	}
+	return sha256.Sum256(buf)
+}
+
 func (this *DiskCachedEmbeddingIndex) IndexedFiles() []string {
 	var paths []string
 	for path, dirIndex := range this.Index {
-		for name := range dirIndex.Files {
+		for name, fileIndex := range dirIndex.Files {
+			if fileIndex.Url != "" {
+				paths = append(paths, fileIndex.Url)
+				continue
+			}
 			paths = append(paths, filepath.Join(path, name))
 		}
 	}
@@ -622,19 +1122,64 @@ func (this *DiskCachedEmbeddingIndex) IndexPath(ctx context.Context, path string
 		this.Index[dirPath] = dirIndex
 	}
 
-	files = this.FilterUnindexablefiles(dirPath, files, forceUpdate, dirIndex)
-
-	// Update the index for each file
-	for _, file := range files {
-		name := file.Name()
-		path := filepath.Join(dirPath, file.Name())
-		fileEmbeddings, err := this.EmbedFile(ctx, path, chunkSize, maxChunks)
+	// Vectors from different models can't be searched together, so if the
+	// directory was embedded with another model we re-embed all its files
+	space := embeddingSpace{this.EmbeddingModel, this.Dimensions}
+	if len(dirIndex.Files) > 0 && indexEmbeddingSpace(dirIndex) != space {
+		fmt.Fprintf(this.Out, "Re-indexing %s, it was embedded with %s\n", dirPath, indexEmbeddingSpace(dirIndex))
+		files, err = afero.ReadDir(this.Fs, dirPath)
 		if err != nil {
 			return err
 		}
+		pages := []*pb.FileEmbeddings{}
+		for _, fileIndex := range dirIndex.Files {
+			if fileIndex.Url != "" {
+				pages = append(pages, fileIndex)
+			}
+		}
+		dirIndex.Files = make(map[string]*pb.FileEmbeddings)
+		forceUpdate = true
+
+		// web pages are embedded again from their stored text
+		for _, page := range pages {
+			pageEmbeddings, err := this.embedPage(ctx, page.Url, page.Title, page.Text, space, chunkSize, maxChunks)
+			if err != nil {
+				return err
+			}
+			dirIndex.Files[page.Url] = pageEmbeddings
+		}
+	}
+	dirIndex.EmbeddingModel = space.Model
+	dirIndex.Dimensions = int32(space.Dimensions)
+	precision := this.Precision
+	if precision == "" {
+		precision = indexPrecision(dirIndex)
+	}
+
+	files = this.FilterUnindexablefiles(dirPath, files, forceUpdate, dirIndex)
+
+	// Update the index for the files, embedding them together
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = filepath.Join(dirPath, file.Name())
+	}
+	fileEmbeddings, err := this.EmbedFiles(ctx, paths, chunkSize, maxChunks)
+	if err != nil {
+		return err
+	}
+
+	for i, file := range files {
+		if fileEmbeddings[i] == nil {
+			continue
+		}
+		dirIndex.Files[file.Name()] = fileEmbeddings[i]
+		fmt.Fprintf(this.Out, "Indexed %s\n", paths[i])
+	}
+	requantize(dirIndex, precision)
 
-		dirIndex.Files[name] = fileEmbeddings
-		fmt.Fprintf(this.Out, "Indexed %s\n", path)
+	// keep the graph up to date once it's been built
+	if (this.ANN && dirIndex.Hnsw == nil) || (dirIndex.Hnsw != nil && (len(files) > 0 || forceUpdate)) {
+		dirIndex.Hnsw = buildHNSW(dirIndex)
 	}
 
 	// TODO remove indexes for files that have been deleted
@@ -649,64 +1194,196 @@ func (this *DiskCachedEmbeddingIndex) IndexPath(ctx context.Context, path string
 // EmbedFile takes a path to a file, splits the file into chunks, and calls
 // the embedding API for each chunk
 func (this *DiskCachedEmbeddingIndex) EmbedFile(ctx context.Context, path string, chunkSize, maxChunks int) (*pb.FileEmbeddings, error) {
-	if this.Embedder == nil {
-		return nil, fmt.Errorf("No embedder set")
+	fileEmbeddings, err := this.EmbedFiles(ctx, []string{path}, chunkSize, maxChunks)
+	if err != nil {
+		return nil, err
 	}
-	if this.Verbosity >= 1 {
-		fmt.Fprintf(this.Out, "Embedding %s\n", path)
+	if fileEmbeddings[0] == nil {
+		return nil, fmt.Errorf("Couldn't extract the text of %s", path)
 	}
+	return fileEmbeddings[0], nil
+}
 
-	annotatedVectors := []*pb.AnnotatedEmbedding{}
+// A chunk of a file being embedded
+type fileChunk struct {
+	// index of the file in the paths being embedded
+	file    int
+	start   uint64
+	content string
+	// the notebook cell the chunk is from
+	cell uint32
+}
 
-	absPath, err := filepath.Abs(path)
-	if err != nil {
-		return nil, err
+// Split the text of an extracted document into chunks, each section is
+// chunked on its own
+func documentChunks(doc *ExtractedDocument, file, chunkSize, maxChunks int) []*fileChunk {
+	sections := doc.Sections
+	if len(sections) == 0 {
+		sections = []DocumentSection{{Start: 0, End: len(doc.Text)}}
 	}
-	timestamp := time.Now()
 
+	chunks := []*fileChunk{}
+	for _, section := range sections {
+		for start := section.Start; start < section.End; start += chunkSize {
+			if maxChunks != -1 && len(chunks) >= maxChunks {
+				return chunks
+			}
+			end := min(start+chunkSize, section.End)
+			chunks = append(chunks, &fileChunk{
+				file:    file,
+				start:   uint64(start),
+				content: doc.Text[start:end],
+				cell:    uint32(section.Cell),
+			})
+		}
+	}
+	return chunks
+}
+
+// EmbedFiles splits each file into chunks and calls the embedding API for the
+// chunks of all the files together, so that directories of small files don't
+// take a call per file. Calls are batched up to ChunksPerCall chunks and
+// TokensPerCall tokens. Files whose text can't be extracted are skipped and
+// left nil in the result.
+func (this *DiskCachedEmbeddingIndex) EmbedFiles(ctx context.Context, paths []string, chunkSize, maxChunks int) ([]*pb.FileEmbeddings, error) {
+	if this.Embedder == nil {
+		return nil, fmt.Errorf("No embedder set")
+	}
 	if chunkSize == 0 {
 		return nil, fmt.Errorf("Chunk size must be greater than 0")
 	}
 
-	// first we chunk the file
-	chunks, err := util.GetFileChunks(ctx, this.Fs, absPath, chunkSize, maxChunks)
+	// first we chunk the files
+	chunks := []*fileChunk{}
+	fileEmbeddings := make([]*pb.FileEmbeddings, len(paths))
+	for i, path := range paths {
+		if this.Verbosity >= 1 {
+			fmt.Fprintf(this.Out, "Embedding %s\n", path)
+		}
+
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		timestamp := time.Now()
+
+		fileEmbeddings[i] = &pb.FileEmbeddings{
+			Path:       filepath.Base(absPath),
+			UpdatedAt:  timestamppb.New(timestamp),
+			Embeddings: []*pb.AnnotatedEmbedding{},
+		}
+
+		if extractorFor(absPath) != nil {
+			doc, err := extractFile(this.Fs, absPath)
+			if err != nil {
+				fmt.Fprintf(this.Out, "Skipping %s: %s\n", path, err)
+				fileEmbeddings[i] = nil
+				continue
+			}
+			fileEmbeddings[i].Title = doc.Title
+			chunks = append(chunks, documentChunks(doc, i, chunkSize, maxChunks)...)
+			continue
+		}
+
+		if isMarkdown(absPath) {
+			frontmatter, err := readFrontmatter(this.Fs, absPath)
+			if err != nil {
+				fmt.Fprintf(this.Out, "Ignoring the frontmatter of %s: %s\n", path, err)
+			} else if frontmatter != nil {
+				fileEmbeddings[i].Title = frontmatter.Title
+				fileEmbeddings[i].Tags = frontmatter.Tags
+			}
+		}
+
+		fileChunks, err := util.GetFileChunks(ctx, this.Fs, absPath, chunkSize, maxChunks)
+		if err != nil {
+			return nil, err
+		}
+		for j, content := range util.ByteToString(fileChunks) {
+			chunks = append(chunks, &fileChunk{
+				file:    i,
+				start:   uint64(j) * uint64(chunkSize),
+				content: content,
+			})
+		}
+	}
+
+	err := this.embedChunks(ctx, chunks, fileEmbeddings, embeddingSpace{this.EmbeddingModel, this.Dimensions})
 	if err != nil {
 		return nil, err
 	}
-	stringChunks := util.ByteToString(chunks)
+	return fileEmbeddings, nil
+}
+
+// Call the embedding API for each batch of chunks, adding the embeddings to
+// the chunks' files. Chunks in the Cache aren't sent.
+func (this *DiskCachedEmbeddingIndex) embedChunks(ctx context.Context, chunks []*fileChunk,
+	fileEmbeddings []*pb.FileEmbeddings, space embeddingSpace) error {
+	vectors := make([][]float32, len(chunks))
+	uncached := []int{}
+	for i, chunk := range chunks {
+		if this.Cache != nil {
+			vector, ok := this.Cache.Get(space.Model, space.Dimensions, ContentKey(chunk.content))
+			if ok {
+				vectors[i] = vector
+				continue
+			}
+		}
+		uncached = append(uncached, i)
+	}
+	if this.Verbosity >= 2 && len(uncached) < len(chunks) {
+		fmt.Fprintf(this.Out, "Reusing %d cached embeddings\n", len(chunks)-len(uncached))
+	}
 
-	// then we call the embedding API for each block of chunks
-	for i := 0; i < len(chunks); i += this.ChunksPerCall {
+	for start := 0; start < len(uncached); {
 		// check if we should bail out
 		if ctx.Err() != nil {
-			return nil, ctx.Err()
+			return ctx.Err()
 		}
 
-		callChunks := stringChunks[i:util.Min(i+this.ChunksPerCall, len(chunks))]
-		newEmbeddings, err := this.Embedder.CalculateEmbeddings(ctx, callChunks)
-		if err != nil {
-			return nil, err
+		end, tokens := start, 0
+		for end < len(uncached) && (end == start ||
+			(end-start < this.ChunksPerCall && tokens+len(chunks[uncached[end]].content) <= this.TokensPerCall)) {
+			tokens += len(chunks[uncached[end]].content)
+			end++
 		}
 
-		// iterate through response, create an annotation, and create an annotated vector
-		for j, embedding := range newEmbeddings {
-			rangeStart := uint64(i+j) * uint64(chunkSize)
-			rangeEnd := rangeStart + uint64(len(callChunks[j]))
+		callChunks := make([]string, end-start)
+		for i, chunk := range uncached[start:end] {
+			callChunks[i] = chunks[chunk].content
+		}
+		newEmbeddings, err := this.Embedder.CalculateEmbeddings(ctx, callChunks, space.Model, space.Dimensions)
+		if err != nil {
+			return err
+		}
+		if len(newEmbeddings) != len(callChunks) {
+			return fmt.Errorf("Embedder returned %d embeddings for %d chunks", len(newEmbeddings), len(callChunks))
+		}
 
-			av := &pb.AnnotatedEmbedding{
-				Start:  rangeStart,
-				End:    rangeEnd,
-				Vector: embedding,
+		for i, embedding := range newEmbeddings {
+			vectors[uncached[start+i]] = embedding
+			if this.Cache != nil {
+				err = this.Cache.Put(space.Model, space.Dimensions, ContentKey(callChunks[i]), embedding)
+				if err != nil {
+					fmt.Fprintf(this.Out, "Error caching embedding: %s\n", err)
+				}
 			}
-			annotatedVectors = append(annotatedVectors, av)
 		}
+
+		start = end
 	}
 
-	fileEmbeddings := &pb.FileEmbeddings{
-		Path:       filepath.Base(absPath),
-		UpdatedAt:  timestamppb.New(timestamp),
-		Embeddings: annotatedVectors,
+	// add an annotated vector to each chunk's file, in the order of the chunks
+	for i, chunk := range chunks {
+		file := fileEmbeddings[chunk.file]
+		av := &pb.AnnotatedEmbedding{
+			Start: chunk.start,
+			End:   chunk.start + uint64(len(chunk.content)),
+			Cell:  chunk.cell,
+		}
+		quantize(av, vectors[i], this.Precision)
+		file.Embeddings = append(file.Embeddings, av)
 	}
 
-	return fileEmbeddings, nil
+	return nil
 }
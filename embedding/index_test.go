@@ -1,11 +1,23 @@
 package embedding
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
 	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	pb "github.com/bakks/butterfish/proto"
+	"github.com/bakks/butterfish/storage"
+	"github.com/bakks/butterfish/util"
+	"github.com/klauspost/compress/zstd"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
@@ -60,18 +72,23 @@ func TestSearch(t *testing.T) {
 
 // A mock embedder that implements the Embedder interface
 type mockEmbedder struct {
-	Calls int
+	Calls     int
+	LastModel string
 }
 
-func (this *mockEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
+func (this *mockEmbedder) CalculateEmbeddings(ctx context.Context, content []string, model string, dimensions int) ([][]float32, error) {
+	if dimensions == 0 {
+		dimensions = 128
+	}
 	embeddings := make([][]float32, len(content))
 	for i, str := range content {
 		// create a fake embedding of the ascii values of the first 5 chars
-		embeddings[i] = make([]float32, 128)
+		embeddings[i] = make([]float32, dimensions)
 		embeddings[i][int(str[0])] = 1
 	}
 
 	this.Calls++
+	this.LastModel = model
 
 	return embeddings, nil
 }
@@ -172,3 +189,628 @@ func TestFileCaching(t *testing.T) {
 
 	// TODO test showindexed
 }
+
+func TestEncryptedFileCaching(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	key, _ := util.NewCipherKey()
+	cipher, err := util.NewCipher(key)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.Cipher = cipher
+	err = index.IndexPath(ctx, "/a/b/c", false, 512, 8)
+	assert.NoError(t, err)
+	data, err := afero.ReadFile(fs, "/a/b/c/d/.butterfish_index")
+	assert.NoError(t, err)
+	assert.True(t, util.IsEncrypted(data))
+
+	// loading without the key fails, with it we get the index back
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	err = index.LoadPath(ctx, "/a/b/c")
+	assert.Error(t, err)
+
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	index.Cipher = cipher
+	err = index.LoadPath(ctx, "/a/b/c")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/a/b/c/d/four"}, index.IndexedFiles())
+}
+
+func TestEmbeddingModels(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	ctx := context.Background()
+
+	// chunks from both files in /a are embedded in one call, and /a/b and
+	// /a/b/c/d take a call each
+	index, embedder := newTestDiskCachedEmbeddingIndex(fs)
+	index.SetEmbeddingModel("small", 64)
+	err := index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, embedder.Calls)
+	assert.Equal(t, "small", index.Index["/a"].EmbeddingModel)
+	assert.Equal(t, int32(64), index.Index["/a"].Dimensions)
+
+	// with a one chunk limit per call each file takes a call
+	index, embedder = newTestDiskCachedEmbeddingIndex(fs)
+	index.SetEmbeddingModel("small", 64)
+	index.ChunksPerCall = 1
+	err = index.IndexPath(ctx, "/a", true, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, embedder.Calls)
+
+	// a new index with the default model searches with the indexed model
+	index, embedder = newTestDiskCachedEmbeddingIndex(fs)
+	err = index.LoadPath(ctx, "/a")
+	assert.NoError(t, err)
+	scored, err := index.Search(ctx, "222", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/a/two", scored[0].FilePath)
+	assert.Equal(t, "small", embedder.LastModel)
+
+	// vectors that don't match the recorded model are reported
+	index.Index["/a"].Dimensions = 0
+	_, err = index.Search(ctx, "222", 1)
+	assert.ErrorContains(t, err, "re-index")
+
+	// indexing with another model re-embeds the directory
+	err = index.IndexPath(ctx, "/a/b/c", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultEmbeddingModel, index.Index["/a/b/c/d"].EmbeddingModel)
+	assert.Equal(t, 128, len(index.Index["/a/b/c/d"].Files["four"].Embeddings[0].Vector))
+}
+
+func TestCompactPaths(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	ctx := context.Background()
+	err := afero.WriteFile(fs, "/a/three", []byte("111111"), 0644)
+	assert.NoError(t, err)
+
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	err = index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+
+	err = fs.Remove("/a/two")
+	assert.NoError(t, err)
+	err = fs.Remove("/a/b/nine")
+	assert.NoError(t, err)
+
+	// two and nine are gone, and three duplicates one
+	stats, err := index.CompactPaths(ctx, []string{"/a"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.FilesRemoved)
+	assert.Equal(t, 3, stats.ChunksRemoved)
+	assert.Equal(t, 1, stats.IndexesRemoved)
+	assert.Greater(t, stats.BytesReclaimed(), int64(0))
+
+	exists, err := afero.Exists(fs, "/a/b/.butterfish_index")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	err = index.LoadPath(ctx, "/a")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"/a/one", "/a/three", "/a/b/c/d/four"}, index.IndexedFiles())
+	assert.Empty(t, index.Index["/a"].Files["three"].Embeddings)
+}
+
+func TestQuantizedIndex(t *testing.T) {
+	vector := []float32{0.5, -0.25, 0.001, -1, 0}
+	for _, precision := range []string{PrecisionFloat16, PrecisionInt8} {
+		embedding := &pb.AnnotatedEmbedding{}
+		quantize(embedding, vector, precision)
+		assert.Equal(t, precision, embeddingPrecision(embedding))
+		assert.InDeltaSlice(t, vector, EmbeddingVector(embedding), 0.005)
+	}
+	assert.Equal(t, float32(65504), float16ToFloat32(float32ToFloat16(65504)))
+	assert.InDelta(t, 1e-6, float16ToFloat32(float32ToFloat16(1e-6)), 1e-7)
+
+	fs := makeFakeFilesystem(t)
+	ctx := context.Background()
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	err := index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+	full, err := afero.ReadFile(fs, "/a/.butterfish_index")
+	assert.NoError(t, err)
+
+	// re-indexing at int8 converts the stored vectors without re-embedding
+	index, embedder := newTestDiskCachedEmbeddingIndex(fs)
+	index.SetPrecision(PrecisionInt8)
+	err = index.LoadPath(ctx, "/a")
+	assert.NoError(t, err)
+	err = index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, embedder.Calls)
+	small, err := afero.ReadFile(fs, "/a/.butterfish_index")
+	assert.NoError(t, err)
+	assert.Less(t, len(small)*3, len(full))
+
+	// without a precision set the directory stays at int8
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	err = index.LoadPath(ctx, "/a")
+	assert.NoError(t, err)
+	err = index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, PrecisionInt8, indexPrecision(index.Index["/a"]))
+
+	scored, err := index.Search(ctx, "222", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/a/two", scored[0].FilePath)
+}
+
+func TestScanPaths(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	ctx := context.Background()
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	err := index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+
+	// searching scanned index files doesn't load them
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	index.ScanPaths = []string{"/a/b", "/a"}
+	scored, err := index.Search(ctx, "999", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(scored))
+	assert.Equal(t, "/a/b/nine", scored[0].FilePath)
+	assert.Equal(t, "999999", scored[0].Content)
+	assert.Empty(t, index.Index)
+
+	// loaded indexes are searched from memory
+	err = index.LoadPath(ctx, "/a/b/c")
+	assert.NoError(t, err)
+	index.Index["/a/b/c/d"].Files["four"].Embeddings[0].Start = 1
+	scored, err = index.Search(ctx, "444", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "44444", scored[0].Content)
+
+	// no index files, no results
+	index, embedder := newTestDiskCachedEmbeddingIndex(fs)
+	err = fs.MkdirAll("/empty", 0755)
+	assert.NoError(t, err)
+	index.ScanPaths = []string{"/empty"}
+	scored, err = index.Search(ctx, "444", 3)
+	assert.NoError(t, err)
+	assert.Empty(t, scored)
+	assert.Equal(t, 0, embedder.Calls)
+}
+
+func TestHNSWSearch(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	dirIndex := NewDirectoryIndex()
+	for i := 0; i < 2000; i++ {
+		vector := make([]float32, 16)
+		for j := range vector {
+			vector[j] = random.Float32()*2 - 1
+		}
+		dirIndex.Files[fmt.Sprintf("file%d", i)] = &pb.FileEmbeddings{
+			Embeddings: []*pb.AnnotatedEmbedding{{Start: 0, End: 1, Vector: vector}},
+		}
+	}
+	ctx := context.Background()
+	index := &DiskCachedEmbeddingIndex{Index: map[string]*pb.DirectoryIndex{"/big": dirIndex}}
+
+	query := make([]float32, 16)
+	for j := range query {
+		query[j] = random.Float32()*2 - 1
+	}
+	exact, err := index.SearchWithVector(ctx, query, 10)
+	assert.NoError(t, err)
+
+	dirIndex.Hnsw = buildHNSW(dirIndex)
+	assert.NotNil(t, dirIndex.Hnsw)
+	approximate, err := index.SearchWithVector(ctx, query, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(approximate))
+
+	found := 0
+	for _, result := range approximate {
+		for _, expected := range exact {
+			if result.FilePath == expected.FilePath {
+				found++
+			}
+		}
+	}
+	assert.GreaterOrEqual(t, found, 9)
+
+	// small directories don't get a graph
+	assert.Nil(t, buildHNSW(NewDirectoryIndex()))
+}
+
+func TestExtractors(t *testing.T) {
+	doc, err := ExtractHTML([]byte(`<html><head><title>API Guide</title><style>p {}</style></head>
+<body><h1>Auth</h1><p>Send a  <b>token</b>.</p><script>alert(1)</script></body></html>`))
+	assert.NoError(t, err)
+	assert.Equal(t, "API Guide", doc.Title)
+	assert.Equal(t, "Auth\nSend a token.", doc.Text)
+
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	file, _ := archive.Create("word/document.xml")
+	file.Write([]byte(`<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>Hello</w:t></w:r><w:r><w:t xml:space="preserve"> world</w:t></w:r></w:p><w:p><w:r><w:t>Bye</w:t></w:r></w:p></w:body></w:document>`))
+	file, _ = archive.Create("docProps/core.xml")
+	file.Write([]byte(`<cp:coreProperties xmlns:cp="cp" xmlns:dc="dc"><dc:title>Notes</dc:title></cp:coreProperties>`))
+	archive.Close()
+	doc, err = ExtractDocx(buf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, "Notes", doc.Title)
+	assert.Equal(t, "Hello world\nBye", doc.Text)
+
+	content := &bytes.Buffer{}
+	writer := zlib.NewWriter(content)
+	writer.Write([]byte(`BT /F1 12 Tf 72 700 Td (Rate limits \(per key\)) Tj T* [(Wor) -20 (ld) -400 (wide)] TJ ET`))
+	writer.Close()
+	pdf := append([]byte("%PDF-1.4\n1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n"+
+		"3 0 obj << /Title (The Spec) >> endobj\n"+
+		"4 0 obj << /Length 10 /Filter /FlateDecode >> stream\n"), content.Bytes()...)
+	pdf = append(pdf, []byte("\nendstream\nendobj\n%%EOF\n")...)
+	doc, err = ExtractPDF(pdf)
+	assert.NoError(t, err)
+	assert.Equal(t, "The Spec", doc.Title)
+	assert.Equal(t, "Rate limits (per key)\nWorld wide", doc.Text)
+
+	// hex strings, as bytes with a simple font and through the ToUnicode
+	// CMap with two byte codes
+	hexPDF := []byte("%PDF-1.4\n3 0 obj << /Title <FEFF004800650078> >> endobj\n" +
+		"4 0 obj << /Length 10 >> stream\nBT <48656C6C6F> Tj ET\nendstream\nendobj\n%%EOF\n")
+	doc, err = ExtractPDF(hexPDF)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hex", doc.Title)
+	assert.Equal(t, "Hello", doc.Text)
+	cidPDF := []byte("%PDF-1.4\n" +
+		"4 0 obj << /Length 10 >> stream\nBT [<00030004> -400 <0005>] TJ ET\nendstream\nendobj\n" +
+		"5 0 obj << /Length 10 >> stream\n/CIDInit /ProcSet findresource begin 12 dict begin begincmap\n" +
+		"1 beginbfchar\n<0005> <0021>\nendbfchar\n1 beginbfrange\n<0003> <0004> <0048>\nendbfrange\n" +
+		"endcmap\nendstream\nendobj\n%%EOF\n")
+	doc, err = ExtractPDF(cidPDF)
+	assert.NoError(t, err)
+	assert.Equal(t, "HI !", doc.Text)
+
+	// content that decompresses to more than the limit is refused
+	bomb := &bytes.Buffer{}
+	writer, _ = zlib.NewWriterLevel(bomb, zlib.BestSpeed)
+	writer.Write(make([]byte, pdfMaxDecodedBytes+1))
+	writer.Close()
+	bombPDF := append([]byte("%PDF-1.4\n4 0 obj << /Length 10 /Filter /FlateDecode >> stream\n"), bomb.Bytes()...)
+	bombPDF = append(bombPDF, []byte("\nendstream\nendobj\n%%EOF\n")...)
+	_, err = ExtractPDF(bombPDF)
+	assert.ErrorContains(t, err, "decompressed")
+
+	// extracted documents are indexed and searched by their text
+	fs := afero.NewMemMapFs()
+	err = afero.WriteFile(fs, "/docs/spec.pdf", pdf, 0644)
+	assert.NoError(t, err)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	ctx := context.Background()
+	err = index.IndexPath(ctx, "/docs", false, 8, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, "The Spec", index.Index["/docs"].Files["spec.pdf"].Title)
+
+	scored, err := index.Search(ctx, "rld", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "The Spec", scored[0].Title)
+	assert.Equal(t, "rld wide", scored[0].Content)
+}
+
+func TestIndexURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/docs" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<html><head><title>Docs</title></head><body><p>aaaa</p><p>zzzz</p></body></html>`))
+	}))
+	defer server.Close()
+	pageURL := server.URL + "/docs"
+
+	fs := afero.NewMemMapFs()
+	err := fs.MkdirAll("/site", 0755)
+	assert.NoError(t, err)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	ctx := context.Background()
+
+	doc, err := index.IndexURL(ctx, "/site", pageURL, 5, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, "Docs", doc.Title)
+	assert.Equal(t, "aaaa\nzzzz", doc.Text)
+	assert.Equal(t, []string{pageURL}, index.IndexedFiles())
+
+	// pages are searched from the saved index without a file to read, and
+	// cite their URL
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	index.ScanPaths = []string{"/site"}
+	scored, err := index.Search(ctx, "zz", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, pageURL, scored[0].FilePath)
+	assert.Equal(t, pageURL, scored[0].URL)
+	assert.Equal(t, "Docs", scored[0].Title)
+	assert.Equal(t, "zzzz", scored[0].Content)
+
+	// garbage collection keeps pages
+	stats, err := index.CompactPaths(ctx, []string{"/site"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.FilesRemoved)
+	assert.Contains(t, index.Index["/site"].Files, pageURL)
+
+	_, err = index.IndexURL(ctx, "/site", server.URL+"/missing", 5, 8)
+	assert.ErrorContains(t, err, "404")
+	_, err = index.IndexURL(ctx, "/site", "file:///etc/passwd", 5, 8)
+	assert.Error(t, err)
+}
+
+func TestNotebookAndFrontmatter(t *testing.T) {
+	notebook := `{"cells": [
+		{"cell_type": "markdown", "source": ["# Churn model\n", "Load the data"]},
+		{"cell_type": "raw", "source": "ignored"},
+		{"cell_type": "code", "source": "xs = load()", "outputs": [{"text": "big output"}]}
+	]}`
+	doc, err := ExtractNotebook([]byte(notebook))
+	assert.NoError(t, err)
+	assert.Equal(t, "Churn model", doc.Title)
+	assert.Equal(t, "# Churn model\nLoad the data\n\nxs = load()", doc.Text)
+	assert.Equal(t, []DocumentSection{{Start: 0, End: 27, Cell: 1}, {Start: 29, End: 40, Cell: 3}}, doc.Sections)
+
+	frontmatter, err := parseFrontmatter("title: Deploying\ntags: [ops, '#runbook']")
+	assert.NoError(t, err)
+	assert.Equal(t, &markdownFrontmatter{Title: "Deploying", Tags: []string{"ops", "runbook"}}, frontmatter)
+	frontmatter, err = parseFrontmatter("tags: ops, runbook")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ops", "runbook"}, frontmatter.Tags)
+
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/notes/model.ipynb", []byte(notebook), 0644)
+	afero.WriteFile(fs, "/notes/deploy.md", []byte("---\ntitle: Deploying\ntags: [ops]\n---\nyum install\n"), 0644)
+	afero.WriteFile(fs, "/notes/plain.md", []byte("zypper update\n"), 0644)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	ctx := context.Background()
+	err = index.IndexPath(ctx, "/notes", false, 16, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ops"}, index.Index["/notes"].Files["deploy.md"].Tags)
+
+	// notebook chunks don't span cells and know their cell
+	scored, err := index.Search(ctx, "xs", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), scored[0].Cell)
+	assert.Equal(t, "xs = load()", scored[0].Content)
+	assert.Equal(t, "/notes/model.ipynb (Churn model) cell 3", scored[0].Citation())
+
+	// tag filters skip untagged files
+	scored, err = index.Search(ctx, "zypper", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/notes/plain.md", scored[0].FilePath)
+	index.SetFilter(&SearchFilter{Tags: []string{"OPS"}})
+	scored, err = index.Search(ctx, "zypper", 10)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, scored)
+	for _, result := range scored {
+		assert.Equal(t, "/notes/deploy.md", result.FilePath)
+		assert.Equal(t, "Deploying", result.Title)
+	}
+	index.SetFilter(nil)
+
+	// a file that can't be extracted is skipped rather than stopping indexing
+	afero.WriteFile(fs, "/notes/broken.ipynb", []byte("{not json"), 0644)
+	afero.WriteFile(fs, "/notes/later.md", []byte("apt upgrade\n"), 0644)
+	err = index.IndexPath(ctx, "/notes", false, 16, 8)
+	assert.NoError(t, err)
+	assert.NotContains(t, index.Index["/notes"].Files, "broken.ipynb")
+	assert.Contains(t, index.Index["/notes"].Files, "later.md")
+
+	// and so is an indexed file that has since broken
+	afero.WriteFile(fs, "/notes/model.ipynb", []byte("{not json"), 0644)
+	scored, err = index.Search(ctx, "xs", 10)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, scored)
+}
+
+func TestSearchFilter(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	filter, err := ParseSearchFilter("ext=go|.ts, path~internal/,mtime>7d,mtime<2024-03-09,tag=ops", now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"go", "ts"}, filter.Extensions)
+	assert.Equal(t, []string{"internal/"}, filter.PathPatterns)
+	assert.Equal(t, now.AddDate(0, 0, -7), filter.ModifiedAfter)
+	assert.Equal(t, time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC), filter.ModifiedBefore)
+	assert.Equal(t, []string{"ops"}, filter.Tags)
+
+	filter, err = ParseSearchFilter("mtime>12h", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-12*time.Hour), filter.ModifiedAfter)
+
+	for _, bad := range []string{"ext", "size>10", "ext~go", "mtime>yesterday", "path~"} {
+		_, err = ParseSearchFilter(bad, now)
+		assert.Error(t, err, bad)
+	}
+
+	assert.True(t, matchPath("internal/", "/src/internal/a.go"))
+	assert.True(t, matchPath("*_test.go", "/src/a_test.go"))
+	assert.True(t, matchPath("cmd/*/main.go", "/src/cmd/tool/main.go"))
+	assert.False(t, matchPath("cmd/*/main.go", "/src/cmd/main.go"))
+
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/src/internal/old.go", []byte("package internal"), 0644)
+	afero.WriteFile(fs, "/src/internal/new.go", []byte("package internal"), 0644)
+	afero.WriteFile(fs, "/src/internal/new.md", []byte("notes"), 0644)
+	fs.Chtimes("/src/internal/old.go", now.AddDate(0, -1, 0), now.AddDate(0, -1, 0))
+	fs.Chtimes("/src/internal/new.go", now.Add(-time.Hour), now.Add(-time.Hour))
+
+	filter, err = ParseSearchFilter("ext=go,path~internal/,mtime>7d", now)
+	assert.NoError(t, err)
+	fileIndex := &pb.FileEmbeddings{}
+	assert.True(t, filter.Matches(fs, "/src/internal/new.go", fileIndex))
+	assert.False(t, filter.Matches(fs, "/src/internal/old.go", fileIndex))
+	assert.False(t, filter.Matches(fs, "/src/internal/new.md", fileIndex))
+	assert.False(t, filter.Matches(fs, "/src/internal/gone.go", fileIndex))
+	assert.True(t, (*SearchFilter)(nil).Matches(fs, "/src/internal/old.go", fileIndex))
+
+	// filtered searches only return matching files
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	ctx := context.Background()
+	err = index.IndexPath(ctx, "/src", false, 64, 8)
+	assert.NoError(t, err)
+	index.SetFilter(filter)
+	scored, err := index.Search(ctx, "package", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(scored))
+	assert.Equal(t, "/src/internal/new.go", scored[0].FilePath)
+}
+
+func TestEmbeddingCache(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	ctx := context.Background()
+	cache := NewStoreEmbeddingCache(&storage.DiskStore{Fs: fs, Perm: 0644}, "/cache")
+
+	index, embedder := newTestDiskCachedEmbeddingIndex(fs)
+	index.Cache = cache
+	err := index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Less(t, 0, embedder.Calls)
+
+	// a forced re-index, and a copy of the files, are embedded from the cache
+	afero.WriteFile(fs, "/copy/two", []byte("222222"), 0644)
+	index, embedder = newTestDiskCachedEmbeddingIndex(fs)
+	cache = NewStoreEmbeddingCache(&storage.DiskStore{Fs: fs, Perm: 0644}, "/cache")
+	index.Cache = cache
+	err = index.IndexPath(ctx, "/a", true, 512, 8)
+	assert.NoError(t, err)
+	err = index.IndexPath(ctx, "/copy", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, embedder.Calls)
+	// searching embeds the query
+	scored, err := index.Search(ctx, "222", 2)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"/a/two", "/copy/two"}, []string{scored[0].FilePath, scored[1].FilePath})
+
+	// other models and dimensions aren't shared
+	index.SetEmbeddingModel("text-embedding-3-small", 256)
+	err = index.IndexPath(ctx, "/copy", true, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, embedder.Calls)
+
+	// a record cut short is ignored
+	file, _ := fs.OpenFile("/cache/text-embedding-ada-002_0.cache", os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write([]byte("partial"))
+	file.Close()
+	reloaded := NewStoreEmbeddingCache(&storage.DiskStore{Fs: fs, Perm: 0644}, "/cache")
+	_, ok := reloaded.Get(DefaultEmbeddingModel, 0, ContentKey("222222"))
+	assert.True(t, ok)
+	// and the file is truncated so that later records can be read
+	assert.NoError(t, reloaded.Put(DefaultEmbeddingModel, 0, ContentKey("new"), []float32{1, 2}))
+	reloaded = NewStoreEmbeddingCache(&storage.DiskStore{Fs: fs, Perm: 0644}, "/cache")
+	vector, ok := reloaded.Get(DefaultEmbeddingModel, 0, ContentKey("new"))
+	assert.True(t, ok)
+	assert.Equal(t, []float32{1, 2}, vector)
+
+	// files over the limit keep the newest half, each record here is 44 bytes
+	bounded := NewStoreEmbeddingCache(&storage.DiskStore{Fs: fs, Perm: 0644}, "/bounded")
+	bounded.MaxBytes = 200
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, bounded.Put("model", 2, ContentKey(fmt.Sprint(i)), []float32{float32(i), 0}))
+	}
+	info, err := fs.Stat("/bounded/model_2.cache")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(88), info.Size())
+	reloaded = NewStoreEmbeddingCache(&storage.DiskStore{Fs: fs, Perm: 0644}, "/bounded")
+	_, ok = reloaded.Get("model", 2, ContentKey("0"))
+	assert.False(t, ok)
+	_, ok = reloaded.Get("model", 2, ContentKey("4"))
+	assert.True(t, ok)
+}
+
+func TestExportImportIndex(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	ctx := context.Background()
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	err := index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+
+	archive := bytes.Buffer{}
+	count, err := index.ExportIndex(ctx, "/a", &archive)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// a checkout where one file has changed
+	other := afero.NewMemMapFs()
+	afero.WriteFile(other, "/b/one", []byte("111111"), 0644)
+	afero.WriteFile(other, "/b/two", []byte("changed"), 0644)
+	afero.WriteFile(other, "/b/b/nine", []byte("999999"), 0644)
+	afero.WriteFile(other, "/b/b/c/d/four", []byte("444444"), 0644)
+	imported, _ := newTestDiskCachedEmbeddingIndex(other)
+	stats, err := imported.ImportIndex(ctx, "/b", bytes.NewReader(archive.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, &ImportStats{Indexes: 3, Current: 3, Stale: 1}, stats)
+
+	// only the changed file is embedded again
+	imported, embedder := newTestDiskCachedEmbeddingIndex(other)
+	err = imported.LoadPath(ctx, "/b")
+	assert.NoError(t, err)
+	err = imported.IndexPath(ctx, "/b", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, embedder.Calls)
+	scored, err := imported.Search(ctx, "999", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/b/b/nine", scored[0].FilePath)
+
+	_, err = index.ExportIndex(ctx, "/nothing", &bytes.Buffer{})
+	assert.Error(t, err)
+
+	// a bad archive doesn't import anything
+	badArchive := func(write func(archive *tar.Writer)) []byte {
+		buf := bytes.Buffer{}
+		encoder, _ := zstd.NewWriter(&buf)
+		archive := tar.NewWriter(encoder)
+		write(archive)
+		archive.Flush()
+		encoder.Close()
+		return buf.Bytes()
+	}
+	dotfile, _ := index.readIndexFile("/a/.butterfish_index")
+	for _, bad := range [][]byte{
+		archive.Bytes()[:archive.Len()/2],
+		badArchive(func(archive *tar.Writer) {
+			writeTarFile(archive, ".butterfish_index", dotfile)
+			writeTarFile(archive, "b/.butterfish_index", []byte("not an index"))
+		}),
+		badArchive(func(archive *tar.Writer) {
+			writeTarFile(archive, ".butterfish_index", dotfile)
+			archive.WriteHeader(&tar.Header{Name: "b/.butterfish_index", Mode: 0644,
+				Size: indexArchiveMaxEntryBytes + 1})
+		}),
+	} {
+		fresh := afero.NewMemMapFs()
+		afero.WriteFile(fresh, "/c/one", []byte("111111"), 0644)
+		importer, _ := newTestDiskCachedEmbeddingIndex(fresh)
+		_, err = importer.ImportIndex(ctx, "/c", bytes.NewReader(bad))
+		assert.Error(t, err)
+		files, _ := afero.ReadDir(fresh, "/c")
+		assert.Len(t, files, 1)
+	}
+}
+
+func TestIndexStore(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.Store = store
+	err := index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+
+	// index files are in the store rather than next to the files
+	exists, _ := afero.Exists(fs, "/a/.butterfish_index")
+	assert.False(t, exists)
+	keys, err := store.List(ctx, "/a")
+	assert.NoError(t, err)
+	assert.Contains(t, keys, "/a/.butterfish_index")
+
+	loaded, _ := newTestDiskCachedEmbeddingIndex(fs)
+	loaded.Store = store
+	err = loaded.LoadPath(ctx, "/a")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, index.IndexedFiles(), loaded.IndexedFiles())
+
+	err = loaded.ClearPath(ctx, "/a")
+	assert.NoError(t, err)
+	keys, _ = store.List(ctx, "/a")
+	assert.Empty(t, keys)
+}
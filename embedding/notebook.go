@@ -0,0 +1,90 @@
+package embedding
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Jupyter notebooks are JSON, so we extract the source of their cells and
+// chunk each cell on its own. Search results then point at a cell rather
+// than at an offset into the JSON. Cell outputs aren't indexed, they're
+// often large and can be regenerated.
+
+type notebookCell struct {
+	CellType string          `json:"cell_type"`
+	Source   json.RawMessage `json:"source"`
+}
+
+type notebookFile struct {
+	Cells []notebookCell `json:"cells"`
+}
+
+// Cell sources are either a string or a list of lines
+func notebookSource(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+
+	var source string
+	if json.Unmarshal(raw, &source) == nil {
+		return source, nil
+	}
+
+	var lines []string
+	err := json.Unmarshal(raw, &lines)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(lines, ""), nil
+}
+
+// Extract the markdown and code cells of a notebook, each cell is a section
+// of the text. The title is the first markdown heading.
+func ExtractNotebook(data []byte) (*ExtractedDocument, error) {
+	var notebook notebookFile
+	err := json.Unmarshal(data, &notebook)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &ExtractedDocument{}
+	builder := strings.Builder{}
+	for i, cell := range notebook.Cells {
+		if cell.CellType != "markdown" && cell.CellType != "code" {
+			continue
+		}
+		source, err := notebookSource(cell.Source)
+		if err != nil {
+			return nil, fmt.Errorf("cell %d: %w", i+1, err)
+		}
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+
+		if cell.CellType == "markdown" && doc.Title == "" {
+			for _, line := range strings.Split(source, "\n") {
+				if strings.HasPrefix(line, "#") {
+					doc.Title = strings.TrimSpace(strings.TrimLeft(line, "#"))
+					break
+				}
+			}
+		}
+
+		// cells are separated by a blank line
+		if builder.Len() > 0 {
+			builder.WriteString("\n\n")
+		}
+		start := builder.Len()
+		builder.WriteString(source)
+		doc.Sections = append(doc.Sections, DocumentSection{
+			Start: start,
+			End:   builder.Len(),
+			Cell:  i + 1,
+		})
+	}
+
+	doc.Text = builder.String()
+	return doc, nil
+}
@@ -0,0 +1,189 @@
+package embedding
+
+import (
+	"encoding/binary"
+	"math"
+
+	pb "github.com/bakks/butterfish/proto"
+)
+
+// Embeddings can be stored at a lower precision to shrink indexes, float16
+// halves their size and int8 quarters it, at the cost of a little accuracy in
+// search scores. Vectors stay quantized in memory and are dequantized one at
+// a time as they're compared with the query.
+
+const (
+	PrecisionFloat32 = "float32"
+	PrecisionFloat16 = "float16"
+	PrecisionInt8    = "int8"
+)
+
+func ValidPrecision(precision string) bool {
+	switch precision {
+	case PrecisionFloat32, PrecisionFloat16, PrecisionInt8:
+		return true
+	}
+	return false
+}
+
+// The precision an embedding is stored at
+func embeddingPrecision(embedding *pb.AnnotatedEmbedding) string {
+	switch {
+	case embedding.VectorF16 != nil:
+		return PrecisionFloat16
+	case embedding.VectorI8 != nil:
+		return PrecisionInt8
+	}
+	return PrecisionFloat32
+}
+
+// The precision a directory was indexed at, float32 if it's empty
+func indexPrecision(dirIndex *pb.DirectoryIndex) string {
+	for _, fileIndex := range dirIndex.Files {
+		for _, embedding := range fileIndex.Embeddings {
+			return embeddingPrecision(embedding)
+		}
+	}
+	return PrecisionFloat32
+}
+
+// Store vector in the embedding at the given precision, clearing the other
+// representations
+func quantize(embedding *pb.AnnotatedEmbedding, vector []float32, precision string) {
+	embedding.Vector = nil
+	embedding.VectorF16 = nil
+	embedding.VectorI8 = nil
+	embedding.Scale = 0
+
+	switch precision {
+	case PrecisionFloat16:
+		buf := make([]byte, 2*len(vector))
+		for i, value := range vector {
+			binary.LittleEndian.PutUint16(buf[2*i:], float32ToFloat16(value))
+		}
+		embedding.VectorF16 = buf
+
+	case PrecisionInt8:
+		// scale so the largest magnitude maps to 127
+		maxAbs := float32(0)
+		for _, value := range vector {
+			maxAbs = max(maxAbs, float32(math.Abs(float64(value))))
+		}
+		scale := maxAbs / 127
+		buf := make([]byte, len(vector))
+		if scale > 0 {
+			for i, value := range vector {
+				buf[i] = byte(int8(math.Round(float64(value / scale))))
+			}
+		}
+		embedding.VectorI8 = buf
+		embedding.Scale = scale
+
+	default:
+		embedding.Vector = vector
+	}
+}
+
+// The vector of an embedding, dequantized if it's stored at a lower precision
+func EmbeddingVector(embedding *pb.AnnotatedEmbedding) []float32 {
+	return embeddingVectorInto(embedding, nil)
+}
+
+// Like EmbeddingVector but dequantizes into buf if it's large enough, the
+// result may be buf or the embedding's own vector so it shouldn't be kept
+func embeddingVectorInto(embedding *pb.AnnotatedEmbedding, buf []float32) []float32 {
+	switch embeddingPrecision(embedding) {
+	case PrecisionFloat16:
+		vector := resizeVector(buf, len(embedding.VectorF16)/2)
+		for i := range vector {
+			vector[i] = float16ToFloat32(binary.LittleEndian.Uint16(embedding.VectorF16[2*i:]))
+		}
+		return vector
+
+	case PrecisionInt8:
+		vector := resizeVector(buf, len(embedding.VectorI8))
+		for i, value := range embedding.VectorI8 {
+			vector[i] = float32(int8(value)) * embedding.Scale
+		}
+		return vector
+	}
+	return embedding.Vector
+}
+
+func resizeVector(buf []float32, length int) []float32 {
+	if cap(buf) < length {
+		return make([]float32, length)
+	}
+	return buf[:length]
+}
+
+// Convert the embeddings of a directory index to the given precision, so an
+// index can be shrunk without re-embedding
+func requantize(dirIndex *pb.DirectoryIndex, precision string) {
+	for _, fileIndex := range dirIndex.Files {
+		for _, embedding := range fileIndex.Embeddings {
+			if embeddingPrecision(embedding) != precision {
+				quantize(embedding, EmbeddingVector(embedding), precision)
+			}
+		}
+	}
+}
+
+// Convert to IEEE 754 half precision, rounding to nearest even
+func float32ToFloat16(value float32) uint16 {
+	bits := math.Float32bits(value)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int32(bits>>23&0xff) - 127 + 15
+	mantissa := bits & 0x7fffff
+
+	switch {
+	case bits&0x7fffffff > 0x7f800000:
+		// NaN
+		return sign | 0x7e00
+	case exp >= 0x1f:
+		// too large, or infinity
+		return sign | 0x7c00
+	case exp <= 0:
+		// too small for a normal half, becomes subnormal or zero
+		if exp < -10 {
+			return sign
+		}
+		mantissa |= 0x800000
+		shift := uint32(14 - exp)
+		half := uint16(mantissa >> shift)
+		remainder := mantissa & (1<<shift - 1)
+		halfway := uint32(1) << (shift - 1)
+		if remainder > halfway || (remainder == halfway && half&1 == 1) {
+			half++
+		}
+		return sign | half
+	}
+
+	half := sign | uint16(exp)<<10 | uint16(mantissa>>13)
+	remainder := mantissa & 0x1fff
+	// rounding up may carry into the exponent, which is still correct
+	if remainder > 0x1000 || (remainder == 0x1000 && half&1 == 1) {
+		half++
+	}
+	return half
+}
+
+func float16ToFloat32(half uint16) float32 {
+	sign := uint32(half&0x8000) << 16
+	exp := uint32(half>>10) & 0x1f
+	mantissa := uint32(half) & 0x3ff
+
+	switch exp {
+	case 0x1f:
+		// infinity or NaN
+		return math.Float32frombits(sign | 0x7f800000 | mantissa<<13)
+	case 0:
+		// subnormal or zero
+		value := float32(mantissa) / (1 << 24)
+		if sign != 0 {
+			return -value
+		}
+		return value
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mantissa<<13)
+}
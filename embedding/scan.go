@@ -0,0 +1,85 @@
+package embedding
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// Search scores every vector but only keeps the closest results, so memory
+// doesn't grow with the size of the index.
+
+// A min-heap on score, so the worst kept result is at the top
+type scoredResults []*VectorSearchResult
+
+func (this scoredResults) Len() int           { return len(this) }
+func (this scoredResults) Less(i, j int) bool { return this[i].Score < this[j].Score }
+func (this scoredResults) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+
+func (this *scoredResults) Push(x any) {
+	*this = append(*this, x.(*VectorSearchResult))
+}
+
+func (this *scoredResults) Pop() any {
+	old := *this
+	last := old[len(old)-1]
+	*this = old[:len(old)-1]
+	return last
+}
+
+// The closest numResults results seen so far
+type topResults struct {
+	results    scoredResults
+	numResults int
+}
+
+func newTopResults(numResults int) *topResults {
+	return &topResults{numResults: numResults}
+}
+
+// Whether a result with this score would be kept, checked before building
+// the result
+func (this *topResults) Accepts(score float64) bool {
+	if len(this.results) < this.numResults {
+		return true
+	}
+	return this.numResults > 0 && score > this.results[0].Score
+}
+
+// Add a result, replacing the worst kept result if we're full. Call only if
+// Accepts returns true for its score.
+func (this *topResults) Add(result *VectorSearchResult) {
+	if len(this.results) < this.numResults {
+		heap.Push(&this.results, result)
+		return
+	}
+	this.results[0] = result
+	heap.Fix(&this.results, 0)
+}
+
+// The kept results, closest first
+func (this *topResults) Results() []*VectorSearchResult {
+	results := append([]*VectorSearchResult{}, this.results...)
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	return results
+}
+
+func vectorNorm(vector []float32) float64 {
+	sum := 0.0
+	for _, value := range vector {
+		sum += float64(value) * float64(value)
+	}
+	return math.Sqrt(sum)
+}
+
+// Cosine similarity of two vectors of the same length, with the query's norm
+// computed once for the whole search
+func cosineSimilarity(query []float32, queryNorm float64, vector []float32) float64 {
+	dot := 0.0
+	for i, value := range vector {
+		dot += float64(query[i]) * float64(value)
+	}
+	return dot / (queryNorm * vectorNorm(vector))
+}
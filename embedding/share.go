@@ -0,0 +1,298 @@
+package embedding
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pb "github.com/bakks/butterfish/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Indexes are shared as a zstd compressed tar of the index files under a
+// directory, so an index built in CI can be downloaded rather than embedded
+// again. Index files record when each file was embedded, which says nothing
+// about a checkout made at another time, so the archive also holds the
+// sha256 of each indexed file. On import, files that match are marked as
+// just indexed and files that differ are re-embedded by the next index.
+
+const indexManifestName = "butterfish_index_manifest.json"
+
+type indexManifest struct {
+	// sha256 of each indexed file, by path relative to the exported directory
+	Files map[string]string `json:"files"`
+}
+
+type ImportStats struct {
+	Indexes int
+	// Indexed files that match the exported ones
+	Current int
+	// Indexed files that are missing or differ, they'll be re-embedded
+	Stale int
+}
+
+func (this *DiskCachedEmbeddingIndex) fileSHA256(filePath string) (string, error) {
+	data, err := afero.ReadFile(this.Fs, filePath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Pages added with add-url are indexed by URL rather than file name
+func isPageEntry(name string) bool {
+	return strings.Contains(name, "://")
+}
+
+// Write the index files under dir to out, returns the number written
+func (this *DiskCachedEmbeddingIndex) ExportIndex(ctx context.Context, dir string, out io.Writer) (int, error) {
+	dotfiles, err := this.dotfilesInPath(ctx, dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(dotfiles) == 0 {
+		return 0, fmt.Errorf("No %s files found in %s, run butterfish index first", this.DotfileName, dir)
+	}
+
+	encoder, err := zstd.NewWriter(out)
+	if err != nil {
+		return 0, err
+	}
+	archive := tar.NewWriter(encoder)
+	manifest := indexManifest{Files: map[string]string{}}
+
+	for _, dotfile := range dotfiles {
+		rel, err := filepath.Rel(dir, dotfile)
+		if err != nil {
+			return 0, err
+		}
+		data, err := this.readIndexFile(dotfile)
+		if err != nil {
+			return 0, err
+		}
+		err = writeTarFile(archive, filepath.ToSlash(rel), data)
+		if err != nil {
+			return 0, err
+		}
+
+		dirIndex, err := this.readDotfile(dotfile)
+		if err != nil {
+			return 0, err
+		}
+		for name := range dirIndex.GetFiles() {
+			if isPageEntry(name) {
+				continue
+			}
+			sum, err := this.fileSHA256(filepath.Join(filepath.Dir(dotfile), name))
+			if err != nil {
+				// deleted since it was indexed
+				continue
+			}
+			manifest.Files[path.Join(filepath.ToSlash(filepath.Dir(rel)), name)] = sum
+		}
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	err = writeTarFile(archive, indexManifestName, manifestJSON)
+	if err != nil {
+		return 0, err
+	}
+	err = archive.Close()
+	if err != nil {
+		return 0, err
+	}
+	return len(dotfiles), encoder.Close()
+}
+
+func writeTarFile(archive *tar.Writer, name string, data []byte) error {
+	err := archive.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(data)
+	return err
+}
+
+// The largest index file or manifest read from an archive, and the most read
+// from one archive altogether, so a bad archive can't use up memory
+const (
+	indexArchiveMaxEntryBytes = 256 << 20
+	indexArchiveMaxBytes      = 1 << 30
+)
+
+// Read index files exported with ExportIndex from in into dir, replacing
+// the index files there. The whole archive is read and checked before any
+// index file is written, so a truncated or malformed one changes nothing.
+func (this *DiskCachedEmbeddingIndex) ImportIndex(ctx context.Context, dir string, in io.Reader) (*ImportStats, error) {
+	decoder, err := zstd.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	archive := tar.NewReader(decoder)
+
+	manifest := indexManifest{}
+	names := []string{}
+	dirIndexes := []*pb.DirectoryIndex{}
+	total := 0
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the index archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if header.Size > indexArchiveMaxEntryBytes {
+			return nil, fmt.Errorf("%s in the index archive is over %dMB", header.Name, indexArchiveMaxEntryBytes>>20)
+		}
+		data, err := io.ReadAll(io.LimitReader(archive, indexArchiveMaxEntryBytes))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the index archive: %w", err)
+		}
+		total += len(data)
+		if total > indexArchiveMaxBytes {
+			return nil, fmt.Errorf("The index archive is over %dMB", indexArchiveMaxBytes>>20)
+		}
+
+		if header.Name == indexManifestName {
+			err = json.Unmarshal(data, &manifest)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing the index manifest: %w", err)
+			}
+			continue
+		}
+
+		// only index files are extracted, and only under dir
+		name := path.Clean(header.Name)
+		if path.Base(name) != this.DotfileName || path.IsAbs(name) || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("Unexpected file %s in the index archive", header.Name)
+		}
+		data, err = this.Cipher.Decrypt(data)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s from the index archive: %w", name, err)
+		}
+		dirIndex := &pb.DirectoryIndex{}
+		err = proto.Unmarshal(data, dirIndex)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s from the index archive: %w", name, err)
+		}
+		names = append(names, name)
+		dirIndexes = append(dirIndexes, dirIndex)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("No index files found in the archive")
+	}
+
+	stats := &ImportStats{Indexes: len(names)}
+	now := timestamppb.Now()
+	indexDirs := make([]string, len(names))
+	files := map[string][]byte{}
+	for i, name := range names {
+		dotfile := filepath.Join(dir, filepath.FromSlash(name))
+		dirIndex := dirIndexes[i]
+		for fileName, file := range dirIndex.GetFiles() {
+			if isPageEntry(fileName) {
+				continue
+			}
+			sum, err := this.fileSHA256(filepath.Join(filepath.Dir(dotfile), fileName))
+			if err == nil && sum == manifest.Files[path.Join(path.Dir(name), fileName)] {
+				file.UpdatedAt = now
+				stats.Current++
+			} else {
+				// older than any file, so it's re-embedded
+				file.UpdatedAt = timestamppb.New(time.Unix(0, 0))
+				stats.Stale++
+			}
+		}
+
+		indexDirs[i], err = filepath.Abs(filepath.Dir(dotfile))
+		if err != nil {
+			return nil, err
+		}
+		buf, err := proto.Marshal(dirIndex)
+		if err != nil {
+			return nil, err
+		}
+		buf, err = this.Cipher.Encrypt(buf)
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.Join(indexDirs[i], this.DotfileName)] = buf
+	}
+
+	err = this.replaceIndexFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	for i, indexDir := range indexDirs {
+		this.Index[indexDir] = dirIndexes[i]
+	}
+	return stats, nil
+}
+
+// Write index files, on disk each is written to a temporary file first and
+// they're renamed into place once all of them are written, so a failure
+// partway leaves the old files
+func (this *DiskCachedEmbeddingIndex) replaceIndexFiles(files map[string][]byte) error {
+	if this.Store != nil {
+		for dotfile, buf := range files {
+			err := this.writeIndexFile(dotfile, buf)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	temps := map[string]string{}
+	removeTemps := func() {
+		for _, temp := range temps {
+			this.Fs.Remove(temp)
+		}
+	}
+	for dotfile, buf := range files {
+		temp := dotfile + ".import"
+		err := this.writeIndexFile(temp, buf)
+		if err != nil {
+			removeTemps()
+			return err
+		}
+		temps[dotfile] = temp
+	}
+	for dotfile, temp := range temps {
+		err := this.Fs.Rename(temp, dotfile)
+		if err != nil {
+			removeTemps()
+			return err
+		}
+	}
+	return nil
+}
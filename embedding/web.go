@@ -0,0 +1,189 @@
+package embedding
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pb "github.com/bakks/butterfish/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Web pages can be added to the index of a directory, e.g. the docs of a
+// library the project uses, with `butterfish index add-url`. A page has no
+// file to read its chunks from later, so its text is stored in the index
+// along with its URL, and search results cite the URL as their path.
+
+// The most of a page we download, the rest is ignored
+const maxPageBytes = 10 << 20
+
+const fetchTimeout = 30 * time.Second
+
+// Download a web page and extract its text. HTML and PDF are extracted,
+// other text types are used as they are.
+func FetchURL(ctx context.Context, pageURL string) (*ExtractedDocument, error) {
+	parsed, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("Can't fetch %s, only http and https URLs are supported", pageURL)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", "butterfish")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error fetching %s: %s", pageURL, response.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxPageBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := response.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching %s, bad content type %s: %w", pageURL, contentType, err)
+	}
+
+	var doc *ExtractedDocument
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		doc, err = ExtractHTML(data)
+	case mediaType == "application/pdf":
+		doc, err = ExtractPDF(data)
+	case strings.HasPrefix(mediaType, "text/") || mediaType == "application/json":
+		doc = &ExtractedDocument{Text: cleanExtractedText(string(data))}
+	default:
+		return nil, fmt.Errorf("Can't index %s, its content type is %s", pageURL, mediaType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error extracting text from %s: %w", pageURL, err)
+	}
+	if doc.Text == "" {
+		return nil, fmt.Errorf("No text found at %s", pageURL)
+	}
+	return doc, nil
+}
+
+// Fetch a web page and add it to the index of the directory at path, which
+// is saved. If the page was added before it's fetched and embedded again.
+// Returns the page so it can also be used directly, e.g. as shell context.
+func (this *DiskCachedEmbeddingIndex) IndexURL(ctx context.Context, path, pageURL string, chunkSize, maxChunks int) (*ExtractedDocument, error) {
+	if this.Verbosity >= 2 {
+		fmt.Fprintf(this.Out, "DiskCachedEmbeddingIndex.IndexURL(%s, %s)\n", path, pageURL)
+	}
+
+	dirPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := FetchURL(ctx, pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// we only need this directory's index, not the ones below it
+	dirIndex, ok := this.Index[dirPath]
+	if !ok {
+		err = this.LoadDotfile(filepath.Join(dirPath, this.DotfileName))
+		if err != nil {
+			return nil, err
+		}
+		dirIndex, ok = this.Index[dirPath]
+		if !ok {
+			dirIndex = NewDirectoryIndex()
+			this.Index[dirPath] = dirIndex
+		}
+	}
+
+	// the page is embedded like the directory's files so they're searched
+	// together
+	space := embeddingSpace{this.EmbeddingModel, this.Dimensions}
+	if len(dirIndex.Files) > 0 {
+		space = indexEmbeddingSpace(dirIndex)
+	}
+	pageEmbeddings, err := this.embedPage(ctx, pageURL, doc.Title, doc.Text, space, chunkSize, maxChunks)
+	if err != nil {
+		return nil, err
+	}
+
+	dirIndex.Files[pageURL] = pageEmbeddings
+	dirIndex.EmbeddingModel = space.Model
+	dirIndex.Dimensions = int32(space.Dimensions)
+	precision := this.Precision
+	if precision == "" {
+		precision = indexPrecision(dirIndex)
+	}
+	requantize(dirIndex, precision)
+	if this.ANN || dirIndex.Hnsw != nil {
+		dirIndex.Hnsw = buildHNSW(dirIndex)
+	}
+
+	fmt.Fprintf(this.Out, "Indexed %s\n", pageURL)
+	return doc, this.SavePath(dirPath)
+}
+
+// Chunk and embed the text of a web page
+func (this *DiskCachedEmbeddingIndex) embedPage(ctx context.Context, pageURL, title, text string,
+	space embeddingSpace, chunkSize, maxChunks int) (*pb.FileEmbeddings, error) {
+	if this.Embedder == nil {
+		return nil, fmt.Errorf("No embedder set")
+	}
+	if chunkSize == 0 {
+		return nil, fmt.Errorf("Chunk size must be greater than 0")
+	}
+	if this.Verbosity >= 1 {
+		fmt.Fprintf(this.Out, "Embedding %s\n", pageURL)
+	}
+
+	chunks := documentChunks(&ExtractedDocument{Text: text}, 0, chunkSize, maxChunks)
+	// we only keep the text that was embedded
+	if len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		text = text[:last.start+uint64(len(last.content))]
+	}
+
+	pageEmbeddings := &pb.FileEmbeddings{
+		Path:       pageURL,
+		UpdatedAt:  timestamppb.Now(),
+		Embeddings: []*pb.AnnotatedEmbedding{},
+		Title:      title,
+		Url:        pageURL,
+		Text:       text,
+	}
+	err := this.embedChunks(ctx, chunks, []*pb.FileEmbeddings{pageEmbeddings}, space)
+	if err != nil {
+		return nil, err
+	}
+	return pageEmbeddings, nil
+}
+
+// The content of a page's chunk, clamped in case the offsets are bad
+func pageChunk(page *pb.FileEmbeddings, start, end uint64) string {
+	end = min(end, uint64(len(page.Text)))
+	start = min(start, end)
+	return page.Text[start:end]
+}
@@ -0,0 +1,224 @@
+// Package client is the Go API for using butterfish from other programs: an
+// LLM Provider, the PromptLibrary, the embeddings Index, and a
+// ShellController that runs butterfish's wrapped shell.
+//
+// The rest of the module is butterfish's own code and changes with the CLI.
+// This package is versioned on its own with semantic versioning, see
+// APIVersion: nothing exported here is removed or changed incompatibly
+// without a new major version.
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/bakks/butterfish/butterfish"
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/storage"
+	"github.com/bakks/butterfish/util"
+)
+
+// The version of this package's API
+const APIVersion = "1.1.0"
+
+// A message of a conversation, Role is user or assistant
+type Message struct {
+	Role    string
+	Content string
+}
+
+type CompletionRequest struct {
+	Model         string
+	SystemMessage string
+	// Earlier messages of the conversation, oldest first
+	History     []Message
+	Prompt      string
+	MaxTokens   int
+	Temperature float32
+}
+
+type CompletionResponse struct {
+	Completion string
+	// Token usage as reported by the provider, 0 if it wasn't reported
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// A Provider is an LLM API. Use NewOpenAIProvider for OpenAI and compatible
+// APIs, or implement it to use another. Goal mode in the shell needs tool
+// calls, which only the OpenAI provider supports.
+type Provider interface {
+	Complete(ctx context.Context, request *CompletionRequest) (*CompletionResponse, error)
+	// Write the completion to writer as it's generated
+	Stream(ctx context.Context, request *CompletionRequest, writer io.Writer) (*CompletionResponse, error)
+	// Embed texts with the model, dimensions is the length of the vectors for
+	// models that can shorten them, 0 for the model's default
+	Embed(ctx context.Context, texts []string, model string, dimensions int) ([][]float32, error)
+}
+
+// A PromptLibrary holds the prompts butterfish sends, by name
+type PromptLibrary interface {
+	// Get a prompt by name with its fields filled in, the arguments are
+	// pairs of field and value, e.g. GetPrompt("greeting", "name", "Peter")
+	GetPrompt(name string, args ...string) (string, error)
+	// Get a prompt by name without filling in its fields
+	GetUninterpolatedPrompt(name string) (string, error)
+	// Fill in the fields of a prompt
+	InterpolatePrompt(prompt string, args ...string) (string, error)
+}
+
+// Load the prompt library at path, with butterfish's default prompts added,
+// e.g. ~/.config/butterfish/prompts.yaml. It's kept in store, or in the file
+// at path if store is nil.
+func NewPromptLibrary(path string, store storage.Store) (PromptLibrary, error) {
+	return butterfish.NewDiskPromptLibrary(path, false, io.Discard, store)
+}
+
+// A prompt library kept in memory, with butterfish's default prompts if
+// withDefaults is set. Prompts are added with SetPrompt, nothing is written to
+// disk.
+func NewMemoryPromptLibrary(withDefaults bool) *prompt.MemoryPromptLibrary {
+	if withDefaults {
+		return prompt.NewMemoryPromptLibrary(prompt.DefaultPrompts)
+	}
+	return prompt.NewMemoryPromptLibrary(nil)
+}
+
+// A provider for the OpenAI API, or a compatible API at baseURL if it isn't
+// empty
+func NewOpenAIProvider(token, baseURL string) Provider {
+	return &llmProvider{llm: butterfish.NewGPT(token, baseURL)}
+}
+
+// A Provider backed by one of butterfish's LLM clients
+type llmProvider struct {
+	llm butterfish.LLM
+}
+
+func (this *llmProvider) request(ctx context.Context, request *CompletionRequest) *util.CompletionRequest {
+	history := []util.HistoryBlock{}
+	for _, message := range request.History {
+		history = append(history, util.HistoryBlock{
+			Type:    butterfish.HistoryTypeForRole(message.Role),
+			Content: message.Content,
+		})
+	}
+	return &util.CompletionRequest{
+		Ctx:           ctx,
+		Model:         request.Model,
+		SystemMessage: request.SystemMessage,
+		HistoryBlocks: history,
+		Prompt:        request.Prompt,
+		MaxTokens:     request.MaxTokens,
+		Temperature:   request.Temperature,
+	}
+}
+
+func completionResponse(response *util.CompletionResponse) *CompletionResponse {
+	if response == nil {
+		return nil
+	}
+	return &CompletionResponse{
+		Completion:       response.Completion,
+		PromptTokens:     response.PromptTokens,
+		CompletionTokens: response.CompletionTokens,
+	}
+}
+
+func (this *llmProvider) Complete(ctx context.Context, request *CompletionRequest) (*CompletionResponse, error) {
+	response, err := this.llm.Completion(this.request(ctx, request))
+	return completionResponse(response), err
+}
+
+func (this *llmProvider) Stream(ctx context.Context, request *CompletionRequest, writer io.Writer) (*CompletionResponse, error) {
+	response, err := this.llm.CompletionStream(this.request(ctx, request), writer)
+	return completionResponse(response), err
+}
+
+func (this *llmProvider) Embed(ctx context.Context, texts []string, model string, dimensions int) ([][]float32, error) {
+	return this.llm.Embeddings(&util.EmbeddingRequest{
+		Ctx:        ctx,
+		Input:      texts,
+		Model:      model,
+		Dimensions: dimensions,
+	})
+}
+
+// A butterfish LLM client backed by a Provider
+type providerLLM struct {
+	provider Provider
+}
+
+// The butterfish LLM client for a provider
+func toLLM(provider Provider) butterfish.LLM {
+	if llmProvider, ok := provider.(*llmProvider); ok {
+		return llmProvider.llm
+	}
+	return &providerLLM{provider: provider}
+}
+
+func (this *providerLLM) request(request *util.CompletionRequest) (context.Context, *CompletionRequest, error) {
+	// a Provider has no way to return tool calls, so requests that offer
+	// tools fail rather than getting a plain completion back
+	if len(request.Tools) > 0 || len(request.Functions) > 0 {
+		return nil, nil, errors.New("This Provider doesn't support tool calls, which goal mode needs, use NewOpenAIProvider")
+	}
+
+	history := []Message{}
+	for _, block := range request.HistoryBlocks {
+		history = append(history, Message{
+			Role:    butterfish.ShellHistoryTypeToRole(block.Type),
+			Content: block.Content,
+		})
+	}
+	ctx := request.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return ctx, &CompletionRequest{
+		Model:         request.Model,
+		SystemMessage: request.SystemMessage,
+		History:       history,
+		Prompt:        request.Prompt,
+		MaxTokens:     request.MaxTokens,
+		Temperature:   request.Temperature,
+	}, nil
+}
+
+func utilResponse(response *CompletionResponse) *util.CompletionResponse {
+	if response == nil {
+		return nil
+	}
+	return &util.CompletionResponse{
+		Completion:       response.Completion,
+		PromptTokens:     response.PromptTokens,
+		CompletionTokens: response.CompletionTokens,
+	}
+}
+
+func (this *providerLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	ctx, req, err := this.request(request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := this.provider.Complete(ctx, req)
+	return utilResponse(response), err
+}
+
+func (this *providerLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	ctx, req, err := this.request(request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := this.provider.Stream(ctx, req, writer)
+	return utilResponse(response), err
+}
+
+func (this *providerLLM) Embeddings(request *util.EmbeddingRequest) ([][]float32, error) {
+	ctx := request.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return this.provider.Embed(ctx, request.Input, request.Model, request.Dimensions)
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bakks/butterfish/butterfish"
+	"github.com/bakks/butterfish/storage"
+	"github.com/bakks/butterfish/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// Answers with the prompt and the roles of the history, embeds text as its
+// counts of a, b, and c
+type testProvider struct {
+	requests []*CompletionRequest
+}
+
+func (this *testProvider) Complete(ctx context.Context, request *CompletionRequest) (*CompletionResponse, error) {
+	this.requests = append(this.requests, request)
+	roles := []string{}
+	for _, message := range request.History {
+		roles = append(roles, message.Role)
+	}
+	return &CompletionResponse{Completion: request.Prompt + " " + strings.Join(roles, ",")}, nil
+}
+
+func (this *testProvider) Stream(ctx context.Context, request *CompletionRequest, writer io.Writer) (*CompletionResponse, error) {
+	response, err := this.Complete(ctx, request)
+	writer.Write([]byte(response.Completion))
+	return response, err
+}
+
+func (this *testProvider) Embed(ctx context.Context, texts []string, model string, dimensions int) ([][]float32, error) {
+	vectors := [][]float32{}
+	for _, text := range texts {
+		vectors = append(vectors, []float32{
+			float32(strings.Count(text, "a")),
+			float32(strings.Count(text, "b")),
+			float32(strings.Count(text, "c")),
+		})
+	}
+	return vectors, nil
+}
+
+func TestProvider(t *testing.T) {
+	provider := &testProvider{}
+	llm := toLLM(provider)
+	response, err := llm.Completion(&util.CompletionRequest{
+		Prompt: "hi",
+		HistoryBlocks: []util.HistoryBlock{
+			{Type: butterfish.HistoryTypeForRole("user"), Content: "ls"},
+			{Type: butterfish.HistoryTypeForRole("assistant"), Content: "foo.go"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "hi user,assistant", response.Completion)
+
+	// tool calls can't be answered by a Provider
+	_, err = llm.Completion(&util.CompletionRequest{
+		Prompt: "hi",
+		Tools:  []util.ToolDefinition{{Type: "function"}},
+	})
+	assert.ErrorContains(t, err, "tool calls")
+	assert.Equal(t, 1, len(provider.requests))
+
+	// the OpenAI provider is used as it is
+	openai := NewOpenAIProvider("token", "")
+	assert.Equal(t, openai.(*llmProvider).llm, toLLM(openai))
+}
+
+func TestPromptLibrary(t *testing.T) {
+	store := storage.NewMemoryStore()
+	library, err := NewPromptLibrary("/config/prompts.yaml", store)
+	assert.NoError(t, err)
+	prompt, err := library.GetPrompt("summarize", "content", "some text")
+	assert.NoError(t, err)
+	assert.Contains(t, prompt, "some text")
+}
+
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("aaaa"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("bbbb"), 0644)
+
+	store := storage.NewMemoryStore()
+	ctx := context.Background()
+	index := NewIndex(&testProvider{}, &IndexOptions{Store: store})
+	assert.NoError(t, index.Add(ctx, false, dir))
+
+	// another index loads what was added from the store
+	loaded := NewIndex(&testProvider{}, &IndexOptions{Store: store})
+	assert.NoError(t, loaded.Load(ctx, dir))
+	results, err := loaded.Search(ctx, "bb", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, filepath.Join(dir, "b.txt"), results[0].FilePath)
+	assert.Equal(t, "bbbb", results[0].Content)
+}
+
+func TestShellController(t *testing.T) {
+	_, err := NewShellController(&ShellConfig{}).butterfishConfig()
+	assert.Error(t, err)
+
+	config, err := NewShellController(&ShellConfig{Provider: &testProvider{}, Shell: "/bin/zsh", Model: "local"}).butterfishConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "local", config.ShellPromptModel)
+	assert.Equal(t, butterfish.DefaultShellAutosuggestModel, config.ShellAutosuggestModel)
+	assert.Equal(t, "zsh", config.ParseShell())
+	assert.NotNil(t, config.LLMClient)
+}
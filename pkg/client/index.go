@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"io"
+
+	"github.com/bakks/butterfish/embedding"
+	"github.com/bakks/butterfish/storage"
+)
+
+// Index embeds files and searches them, like butterfish index and
+// butterfish indexsearch
+type Index struct {
+	index *embedding.DiskCachedEmbeddingIndex
+}
+
+type IndexOptions struct {
+	// The embedding model and dimensions, the index default if empty
+	Model      string
+	Dimensions int
+	// Where index files are kept, next to the indexed files if nil
+	Store storage.Store
+	// Where progress is written, nothing is written if nil
+	Out io.Writer
+}
+
+type SearchResult struct {
+	FilePath string
+	// 1 is an exact match, 0 is unrelated
+	Score   float64
+	Content string
+}
+
+// The size of the chunks files are split into and the most chunks of a file
+// that are embedded, the same as butterfish index
+const (
+	indexChunkSize = 512
+	indexMaxChunks = 256
+)
+
+type providerEmbedder struct {
+	provider Provider
+}
+
+func (this *providerEmbedder) CalculateEmbeddings(ctx context.Context, content []string, model string, dimensions int) ([][]float32, error) {
+	return this.provider.Embed(ctx, content, model, dimensions)
+}
+
+func NewIndex(provider Provider, options *IndexOptions) *Index {
+	if options == nil {
+		options = &IndexOptions{}
+	}
+	out := options.Out
+	if out == nil {
+		out = io.Discard
+	}
+	index := embedding.NewDiskCachedEmbeddingIndex(&providerEmbedder{provider}, out)
+	if options.Model != "" {
+		index.SetEmbeddingModel(options.Model, options.Dimensions)
+	}
+	index.Store = options.Store
+	return &Index{index: index}
+}
+
+// Load the existing index files under paths, so they're searched
+func (this *Index) Load(ctx context.Context, paths ...string) error {
+	return this.index.LoadPaths(ctx, paths)
+}
+
+// Embed the files under paths, files that haven't changed since they were
+// embedded are skipped unless force is set
+func (this *Index) Add(ctx context.Context, force bool, paths ...string) error {
+	return this.index.IndexPaths(ctx, paths, force, indexChunkSize, indexMaxChunks)
+}
+
+// Remove the index of the files under paths
+func (this *Index) Clear(ctx context.Context, paths ...string) error {
+	return this.index.ClearPaths(ctx, paths)
+}
+
+// The chunks of loaded and added files most similar to query
+func (this *Index) Search(ctx context.Context, query string, numResults int) ([]*SearchResult, error) {
+	results, err := this.index.Search(ctx, query, numResults)
+	if err != nil {
+		return nil, err
+	}
+	found := []*SearchResult{}
+	for _, result := range results {
+		found = append(found, &SearchResult{
+			FilePath: result.FilePath,
+			Score:    result.Score,
+			Content:  result.Content,
+		})
+	}
+	return found, nil
+}
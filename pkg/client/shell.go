@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/bakks/butterfish/butterfish"
+	"github.com/bakks/butterfish/storage"
+)
+
+type ShellConfig struct {
+	Provider Provider
+	// The prompt library, ~/.config/butterfish/prompts.yaml if nil
+	PromptLibrary PromptLibrary
+	// Where sessions, the embedding cache, and index files are kept, files
+	// on disk if nil
+	Store storage.Store
+	// The shell to run, $SHELL if empty
+	Shell string
+	// Models for prompts and autosuggest, butterfish shell's defaults if empty
+	Model            string
+	AutosuggestModel string
+	// Turn off autosuggest
+	NoAutosuggest bool
+}
+
+// ShellController runs butterfish's wrapped shell, as butterfish shell does
+type ShellController struct {
+	Config *ShellConfig
+}
+
+func NewShellController(config *ShellConfig) *ShellController {
+	return &ShellController{Config: config}
+}
+
+// The butterfish config for the shell, with the defaults of butterfish
+// shell's flags
+func (this *ShellController) butterfishConfig() (*butterfish.ButterfishConfig, error) {
+	if this.Config.Provider == nil {
+		return nil, errors.New("The shell needs a Provider")
+	}
+	shell := this.Config.Shell
+	if shell == "" {
+		shell = os.Getenv("SHELL")
+	}
+	if shell == "" {
+		return nil, errors.New("No shell found, set Shell or $SHELL")
+	}
+
+	config := butterfish.MakeButterfishConfig()
+	config.LLMClient = toLLM(this.Config.Provider)
+	config.PromptLibrary = this.Config.PromptLibrary
+	config.PromptLibraryPath = "~/.config/butterfish/prompts.yaml"
+	config.Store = this.Config.Store
+	config.ShellMode = true
+	config.ShellBinary = shell
+	config.ShellPromptModel = butterfish.DefaultShellPromptModel
+	config.ShellAutosuggestModel = butterfish.DefaultShellAutosuggestModel
+	config.ShellAnnotateModel = butterfish.DefaultShellAnnotateModel
+	if this.Config.Model != "" {
+		config.ShellPromptModel = this.Config.Model
+	}
+	if this.Config.AutosuggestModel != "" {
+		config.ShellAutosuggestModel = this.Config.AutosuggestModel
+	}
+	config.ShellAutosuggestEnabled = !this.Config.NoAutosuggest
+	config.ShellAutosuggestTimeout = butterfish.DefaultShellAutosuggestTimeout
+	config.ShellNewlineAutosuggestTimeout = butterfish.DefaultShellNewlineAutosuggestTimeout
+	config.ShellMaxPromptTokens = butterfish.DefaultShellMaxPromptTokens
+	config.ShellMaxHistoryBlockTokens = butterfish.DefaultShellMaxHistoryBlockTokens
+	config.ShellMaxResponseTokens = butterfish.DefaultShellMaxResponseTokens
+	config.ShellGoalModeMaxRetries = butterfish.DefaultShellGoalModeMaxRetries
+	config.ShellTerminal = butterfish.TerminalAuto
+	config.ColorDark = true
+	return config, nil
+}
+
+// Run the shell in the current terminal until it exits
+func (this *ShellController) Run(ctx context.Context) error {
+	config, err := this.butterfishConfig()
+	if err != nil {
+		return err
+	}
+	return butterfish.RunShell(ctx, config)
+}
@@ -1,41 +1,95 @@
 package prompt
 
 const (
-	PromptFixCommand           = "fix_command"
-	PromptSummarize            = "summarize"
-	PromptSummarizeFacts       = "summarize_facts"
-	PromptSummarizeListOfFacts = "summarize_list_of_facts"
-	PromptGenerateCommand      = "generate_command"
-	PromptQuestion             = "question"
-	PromptSystemMessage        = "prompt_system_message"
-	ShellAutosuggestCommand    = "shell_autocomplete_command"
-	ShellAutosuggestNewCommand = "shell_autocomplete_new_command"
-	ShellAutosuggestPrompt     = "shell_autocomplete_prompt"
-	ShellSystemMessage         = "shell_system_message"
-	GoalModeSystemMessage      = "goal_mode_system_message"
+	PromptFixCommand               = "fix_command"
+	PromptSummarize                = "summarize"
+	PromptSummarizeFacts           = "summarize_facts"
+	PromptSummarizeListOfFacts     = "summarize_list_of_facts"
+	PromptGenerateCommand          = "generate_command"
+	PromptQuestion                 = "question"
+	PromptSystemMessage            = "prompt_system_message"
+	ShellAutosuggestCommand        = "shell_autocomplete_command"
+	ShellAutosuggestNewCommand     = "shell_autocomplete_new_command"
+	ShellAutosuggestPrompt         = "shell_autocomplete_prompt"
+	ShellAutosuggestREPLCommand    = "shell_autocomplete_repl_command"
+	ShellAutosuggestREPLNewCommand = "shell_autocomplete_repl_new_command"
+	ShellAutosuggestSystemMessage  = "shell_autosuggest_system_message"
+	ShellSystemMessage             = "shell_system_message"
+	GoalModeSystemMessage          = "goal_mode_system_message"
+	PromptCommitMessage            = "commit_message"
+	PromptGitSummary               = "git_summary"
+	PromptGitSummaryDiffChunk      = "git_summary_diff_chunk"
+	PromptExplainCommand           = "explain_command"
+	PromptBenchJudge               = "bench_judge"
+	ShellAnnotateCommand           = "shell_annotate_command"
+	PromptCommandHistoryQuestion   = "command_history_question"
+	PromptWatchTriage              = "watch_triage"
+	PromptWatchExplain             = "watch_explain"
+	PromptGenerateFile             = "generate_file"
+	PromptReviewScript             = "review_script"
+	PromptRefactorPlan             = "refactor_plan"
+	PromptRefactorEdit             = "refactor_edit"
+	PromptSummarizeBranch          = "summarize_branch"
+	ShellPipeline                  = "shell_pipeline"
+	PromptCommandPreview           = "command_preview"
+	PromptGenerateAlternative      = "generate_command_alternative"
+	PromptVerifyAnswer             = "verify_answer"
+	ShellSummarizeLongCommand      = "shell_summarize_long_command"
+	PromptRefineCommand            = "refine_command"
+	PromptCommandBreakdown         = "command_breakdown"
+	PromptScheduleCron             = "schedule_cron"
+	PromptScheduleSystemd          = "schedule_systemd"
+	PromptExpressionBuilder        = "expression_builder"
+	PromptSQLQuery                 = "sql_query"
 )
 
 // These are the default prompts used for Butterfish, they will be written
 // to the prompts.yaml file every time Butterfish is loaded, unless the
 // OkToReplace field (in the yaml file) is false.
+// Translations holds variants for the language config setting, keyed by
+// locale, a prompt without one for the locale uses Prompt.
+//
+// Prompts, including system messages, can use the fields {os}, {shell},
+// {cwd}, {datetime}, {sysinfo}, and {platform} (the distro and package
+// manager) which are filled in automatically unless they're passed.
+// In shell mode {shell_profile} summarizes the user's aliases, functions, and
+// installed tools.
+// They can also pull in machine state with context provider fields:
+// {ctx_ls}, {ctx_git_branch}, {ctx_git_status}, {ctx_exit_codes},
+// {ctx_uname}, {ctx_env}, {ctx_env_vars}, {ctx_docker_ps},
+// {ctx_kube_context}, {ctx_kube_pods}, and {ctx_tasks}. In shell mode the
+// docker, kube, and tasks providers are also added to the system message when
+// a prompt mentions containers, kubernetes, or building and testing.
 
 var DefaultPrompts []Prompt = []Prompt{
 
 	{
 		Name:        PromptSystemMessage,
-		Prompt:      "You are an assistant that helps the user in a Unix shell. Make your answers technical but succinct.",
+		Prompt:      "You are an assistant that helps the user in a Unix shell. Make your answers technical but succinct. The user is using {shell} on {platform}, use its package manager and paths in instructions.",
 		OkToReplace: true,
+		Translations: map[string]string{
+			"es": "Eres un asistente que ayuda al usuario en una shell de Unix. Da respuestas técnicas pero concisas. El usuario usa {shell} en {platform}, usa su gestor de paquetes y sus rutas en las instrucciones.",
+		},
 	},
 
 	{
 		Name:        ShellSystemMessage,
-		Prompt:      "You are an assistant that helps the user with a Unix shell. Give advice about commands that can be run and examples but keep your answers succinct. Give very short answers for short or easy questions, in-depth answers for complex questions. You don't need to tell the user how to install commands that you mention. It is ok if the user asks questions not directly related to the unix shell. System info about the local machine: '{sysinfo}'",
+		Prompt:      "You are an assistant that helps the user with a Unix shell. Give advice about commands that can be run and examples but keep your answers succinct. Give very short answers for short or easy questions, in-depth answers for complex questions. You don't need to tell the user how to install commands that you mention. It is ok if the user asks questions not directly related to the unix shell. The user's shell is {shell}, the current directory is {cwd}, and the time is {datetime}. The system is {platform}, so any install instructions and paths should be for it. System info about the local machine: '{sysinfo}'. When suggesting commands, prefer the user's own aliases, functions, and installed tools: {shell_profile}",
 		OkToReplace: true,
+		Translations: map[string]string{
+			"es": "Eres un asistente que ayuda al usuario con una shell de Unix. Da consejos sobre los comandos que se pueden ejecutar y ejemplos, pero mantén tus respuestas concisas. Da respuestas muy cortas a preguntas cortas o fáciles, y respuestas detalladas a preguntas complejas. No hace falta que expliques cómo instalar los comandos que menciones. Está bien si el usuario hace preguntas que no tienen que ver directamente con la shell. La shell del usuario es {shell}, el directorio actual es {cwd} y la hora es {datetime}. El sistema es {platform}, así que las instrucciones de instalación y las rutas deben ser para él. Información del sistema de la máquina local: '{sysinfo}'. Al sugerir comandos, prefiere los alias, funciones y herramientas instaladas del propio usuario: {shell_profile}",
+		},
 	},
 
 	{
 		Name:        GoalModeSystemMessage,
-		Prompt:      "You are an agent helping me achieve the following goal: '{goal}'. You will execute unix commands to achieve the goal. To execute a command, call the command function. Only run one command at a time. I will give you the results of the command. If the command fails, try to edit it or try another command to do the same thing. If we haven't reached our goal, you will then continue execute commands. If there is significant ambiguity then ask me questions. You must verify that the goal is achieved. You must call one of the functions in your response but state your reasoning before calling the function. Here is system info about the local machine: '{sysinfo}'",
+		Prompt:      "You are an agent helping me achieve the following goal: '{goal}'. You will execute unix commands to achieve the goal. To execute a command, call the run_command tool. Only run one command at a time. Use the read_file, list_dir, and search_index tools to look at files rather than running commands like cat or ls. The project has a scratchpad of notes kept across sessions, read it with read_scratchpad when you start, and for long tasks keep it up to date with write_scratchpad, noting the plan, progress, and what's left. I will give you the results of the command. If the command fails, try to edit it or try another command to do the same thing. If we haven't reached our goal, you will then continue execute commands. If there is significant ambiguity then ask me questions. You must verify that the goal is achieved. You must call one of the functions in your response but state your reasoning before calling the function. The shell is {shell}, the system is {platform}, and the current directory is {cwd}. Here is system info about the local machine: '{sysinfo}'. Prefer my aliases, functions, and installed tools where they fit: {shell_profile}. These tasks are defined by the project in the current directory, prefer them for building, testing, and similar steps: {ctx_tasks}",
+		OkToReplace: true,
+	},
+
+	{
+		Name:        ShellAutosuggestSystemMessage,
+		Prompt:      "You predict unix shell commands for a user of {shell} on {os}. The user's aliases, functions, and installed tools: {shell_profile}. Respond with only the prediction, no explanation.",
 		OkToReplace: true,
 	},
 
@@ -84,6 +138,33 @@ Predicted command:
 `,
 	},
 
+	// ShellAutosuggestREPLCommand completes a line the user has started typing
+	// in a REPL like python or psql inside the shell
+	{
+		Name:        ShellAutosuggestREPLCommand,
+		OkToReplace: true,
+		Prompt: `You are an autocompleter for the {repl} REPL, where the user types {language}. I will give you the user's history, predict the full line they will type. You will find good suggestions in the history. You must suggest a line longer than has been typed thus far, and it must be {language}, not a shell command.
+
+I will give you the user's history including assistant messages. Respond with only the prediction, no quotes. This is the start of the history:
+-------------
+{history}
+> {command}`,
+	},
+
+	// ShellAutosuggestREPLNewCommand predicts the next line in a REPL
+	{
+		Name:        ShellAutosuggestREPLNewCommand,
+		OkToReplace: true,
+		Prompt: `You are a predictor for the {repl} REPL, where the user types {language}. I will give you the user's history, predict the next line they might type. You will find good suggestions in the history. Only predict {language} for the REPL, not a shell command, and do not predict output. Provide a single line of text for the response.
+
+Start of history:
+-------------
+{history}
+-------------
+Predicted line:
+`,
+	},
+
 	{
 		Name:        ShellAutosuggestPrompt,
 		OkToReplace: true,
@@ -158,6 +239,424 @@ Description and Important Facts:`,
 Shell command:`,
 	},
 
+	// PromptCommitMessage is a prompt for writing a git commit message from a
+	// staged diff
+	{
+		Name:        PromptCommitMessage,
+		OkToReplace: true,
+		Prompt: `Write a git commit message for the following staged changes. Use the conventional commits format: a subject line like "type(scope): summary" where type is one of feat, fix, docs, style, refactor, perf, test, build, ci, or chore, and the scope is optional. Keep the subject under 72 characters and in the imperative mood. If the change is not trivial, add a blank line and a short body explaining what changed and why, wrapped at 72 characters. Respond with only the commit message, no backticks.
+'''
+{diff}
+'''
+
+Commit message:`,
+	},
+
+	// PromptGitSummary is a prompt for writing a pull request description from
+	// a list of commits and their changes, which are either a raw diff or
+	// summaries of diff chunks
+	{
+		Name:        PromptGitSummary,
+		OkToReplace: true,
+		Prompt: `Write a pull request description for the following git commits and changes. Start with a short title line, then a summary paragraph of what the change does and why, then a bulleted list of the notable changes. Mention anything a reviewer should look at closely, like breaking changes or risky areas. Use markdown.
+
+Commits:
+'''
+{commits}
+'''
+
+Changes:
+'''
+{changes}
+'''
+
+Pull request description:`,
+	},
+
+	// PromptGitSummaryDiffChunk is a prompt for summarizing part of a large
+	// diff, the results are combined with PromptGitSummary
+	{
+		Name:        PromptGitSummaryDiffChunk,
+		OkToReplace: true,
+		Prompt: `The following is part of a git diff. Write a concise bullet-point list of the changes it makes, naming the files and functions involved. Focus on behavior changes rather than formatting.
+'''
+{diff}
+'''
+
+Changes:`,
+	},
+
+	// PromptExplainCommand is a prompt for explaining a shell command using
+	// excerpts from its local documentation
+	{
+		Name:        PromptExplainCommand,
+		OkToReplace: true,
+		Prompt: `Explain what the following shell command does, including each flag and argument. Base your explanation on the documentation excerpts below, which come from the local machine ({source}), and cite the documentation for each flag you explain, e.g. "-l (from the man page: use a long listing format)". If a flag isn't covered by the excerpts, say so. Point out anything dangerous or surprising about the command.
+
+Command: {command}
+
+Documentation excerpts:
+'''
+{docs}
+'''`,
+	},
+
+	// PromptCommandBreakdown is a prompt for explaining a shell command token
+	// by token, answered as JSON and printed as a table
+	{
+		Name:        PromptCommandBreakdown,
+		OkToReplace: true,
+		Prompt: `Break down the following shell command token by token for someone learning the shell. For each token listed below, in the same order, explain in one short line what it does in this command: the program, each flag (explain each letter of combined flags like -czf), arguments, quoting, pipes, redirections, and operators. Base flag explanations on the documentation excerpts, which come from the local machine, and say "not in the local docs" for a flag they don't cover.
+
+Command: {command}
+
+Tokens, one per line:
+'''
+{tokens}
+'''
+
+Documentation excerpts:
+'''
+{docs}
+'''`,
+	},
+
+	// PromptScheduleCron is a prompt for a crontab entry from a description of
+	// a job, answered as JSON
+	{
+		Name:        PromptScheduleCron,
+		OkToReplace: true,
+		Prompt: `Write a crontab entry for the following job:
+'''
+{content}
+'''
+
+The schedule is the five cron fields (minute, hour, day of month, month, day of week) or a macro like @daily. The command runs with sh from the home directory with a minimal PATH, so use absolute paths for programs outside /usr/bin and /bin, and send the output to a log file if it's useful to keep. If the description doesn't say when, pick a sensible time outside working hours.`,
+	},
+
+	// PromptScheduleSystemd is a prompt for a systemd timer from a description
+	// of a job, answered as JSON
+	{
+		Name:        PromptScheduleSystemd,
+		OkToReplace: true,
+		Prompt: `Write a systemd user timer for the following job:
+'''
+{content}
+'''
+
+The schedule is an OnCalendar expression, e.g. "*-*-* 02:00:00" or "Mon..Fri 09:00". The command runs with /bin/sh -c from the home directory, so use absolute paths for programs outside /usr/bin and /bin. If the description doesn't say when, pick a sensible time outside working hours.`,
+	},
+
+	// PromptExpressionBuilder is a prompt for a regex, jq filter, or awk
+	// program for butterfish rx, with the earlier attempts and feedback
+	{
+		Name:        PromptExpressionBuilder,
+		OkToReplace: true,
+		Prompt: `Write {language}.
+
+It should do the following:
+'''
+{content}
+'''
+
+Sample input:
+'''
+{sample}
+'''
+
+Earlier attempts and what was wrong with them:
+'''
+{attempts}
+'''
+
+Respond with only the expression, without quotes or a code block.`,
+	},
+
+	// PromptSQLQuery is a prompt for a SQL query against a schema for
+	// butterfish sql
+	{
+		Name:        PromptSQLQuery,
+		OkToReplace: true,
+		Prompt: `Write a {dialect} query against the following schema.
+
+Schema:
+'''
+{schema}
+'''
+
+The query should do the following:
+'''
+{content}
+'''
+
+Use only the tables and columns in the schema. Prefer a single read-only query. Respond with only the query, without a code block or explanation.`,
+	},
+
+	// PromptSummarizeBranch is a prompt for summarizing a conversation branch
+	// in the shell when it's merged back with !merge
+	{
+		Name:        PromptSummarizeBranch,
+		OkToReplace: true,
+		Prompt: `I forked my shell session into a branch called "{name}" to explore something separately. Below is what happened in that branch: my prompts, the commands I ran and their output, and your answers. Summarize what we tried and what we found, including conclusions, commands that worked, and open questions, so that I can continue in the main session without the details. Be concise.
+
+Branch history:
+'''
+{history}
+'''`,
+	},
+
+	// ShellPipeline is a prompt for breaking a request into the stages of a
+	// shell pipeline with !pipe in shell mode, the response is JSON
+	{
+		Name:        ShellPipeline,
+		OkToReplace: true,
+		Prompt: `Write a shell pipeline that does the following: {request}
+
+Split the pipeline into stages, one per command joined by |, e.g. a find, then xargs grep, then sort. Give each stage's command exactly as it should appear in the pipeline, without the |, and a one-sentence explanation of what it does to its input. Each stage's output must make sense on its own, since the user will run the pipeline one stage at a time to check the intermediate output. Prefer standard tools and flags that work on my system. Use a single stage if no pipe is needed.`,
+	},
+
+	// PromptCommandPreview is a prompt for explaining a generated command and
+	// whether it changes anything before it's offered to run, the response
+	// is JSON
+	{
+		Name:        PromptCommandPreview,
+		OkToReplace: true,
+		Prompt: `Explain in one short sentence what the following shell command will do. Then assess its impact: "read-only" if it only reads files or system state, or "mutating" if it creates, changes, moves, or deletes files, changes processes, packages, or settings, or changes anything on a remote system. If you're unsure, say "mutating".
+
+Command: {command}`,
+	},
+
+	// PromptGenerateAlternative is a prompt for rewriting a generated command
+	// that uses programs that aren't installed
+	{
+		Name:        PromptGenerateAlternative,
+		OkToReplace: true,
+		Prompt: `I asked for a shell command that accomplishes the following goal:
+'''
+{content}
+'''
+
+The command I got was: {command}
+
+These programs aren't installed on my machine: {missing}. Write a different command for the same goal that only uses programs that are installed, like standard Unix tools or these: {tools}. Respond with only the shell command. If the goal can't be accomplished without the missing programs, respond with only NONE.
+
+Shell command:`,
+	},
+
+	// PromptRefineCommand is a prompt for revising a generated command with the
+	// changes the user asked for
+	{
+		Name:        PromptRefineCommand,
+		OkToReplace: true,
+		Prompt: `I asked for a shell command that accomplishes the following goal:
+'''
+{content}
+'''
+
+Here are the commands I got and the changes I asked for, in order:
+'''
+{refinements}
+'''
+
+Change the last command as I asked in the last change, keeping what the earlier changes asked for. Respond with only the shell command.
+
+Shell command:`,
+	},
+
+	// ShellAnnotateCommand is a prompt for a one-line description of a command
+	// that was just run, shown in shell mode when annotations are on
+	{
+		Name:        ShellAnnotateCommand,
+		OkToReplace: true,
+		Prompt: `Describe what the following shell command did in one short line, under 80 characters, for someone learning the shell. Mention the important flags. If the command failed, say why in a few words. Respond with only the description.
+
+Command: {command}
+Exit code: {exit_code}
+Output:
+'''
+{output}
+'''`,
+	},
+
+	// ShellSummarizeLongCommand is a prompt for summarizing the output of a
+	// command that ran for a long time, shown in shell mode with
+	// --summarize-after
+	{
+		Name:        ShellSummarizeLongCommand,
+		OkToReplace: true,
+		Prompt: `The following shell command ran for {duration} while I was away. Summarize its output in one short paragraph so I get the gist when I come back: whether it succeeded, the key results or numbers, and any errors or warnings that need my attention. Respond with only the summary.
+
+Command: {command}
+Exit code: {exit_code}
+Output:
+'''
+{output}
+'''`,
+	},
+
+	// PromptCommandHistoryQuestion is a prompt for answering a question about
+	// commands recorded in the wrapped shell
+	{
+		Name:        PromptCommandHistoryQuestion,
+		OkToReplace: true,
+		Prompt: `Answer the following question about my shell activity using the commands I've run, listed below with when and where they were run, their exit code, and a description. It is now {now}. Quote the exact commands in your answer. If the commands don't answer the question, say so.
+'''
+{commands}
+'''
+
+Question: {question}`,
+	},
+
+	// PromptRefactorPlan is a prompt for planning a refactor across files, the
+	// response is JSON with a summary and the changes to each file
+	{
+		Name:        PromptRefactorPlan,
+		OkToReplace: true,
+		Prompt: `Plan the following refactor: {instruction}
+
+The files that may be relevant are below, each starting with its path. Decide which of them need to change and describe the change to each precisely enough that it can be made without seeing the other files, e.g. the exact names being renamed. Only include files that need to change, and only use the paths given.
+
+{files}`,
+	},
+
+	// PromptRefactorEdit is a prompt for editing one file as part of a
+	// refactor plan
+	{
+		Name:        PromptRefactorEdit,
+		OkToReplace: true,
+		Prompt: `We're making the following refactor across several files: {instruction}
+
+The plan:
+{plan}
+
+Make the change planned for {path}: {change}
+
+Only make that change, keep everything else in the file exactly as it is. Respond with only the complete updated file, no explanation.
+
+Current content:
+'''
+{content}
+'''`,
+	},
+
+	// PromptReviewScript is a prompt for reviewing a shell script with the
+	// findings from shellcheck, the response must end with the line
+	// "Corrected script:" and the corrected script in a code block
+	{
+		Name:        PromptReviewScript,
+		OkToReplace: true,
+		Prompt: `Review the following shell script, shown with line numbers, for bugs, quoting problems, portability issues, security risks, and anything dangerous like unguarded rm commands. Use the shellcheck findings below but skip any that don't matter in practice.
+
+List the issues in order of priority, most serious first, as a numbered list. Give the line number, the severity (high, medium, or low), and a short explanation for each. Then write a line with only "Corrected script:" followed by the complete corrected script, without line numbers, in a single code block. Keep the script's behavior and style except where fixing an issue.
+
+Script:
+'''
+{script}
+'''
+
+Shellcheck findings:
+'''
+{shellcheck}
+'''`,
+	},
+
+	// PromptGenerateFile is the default template for the generate command,
+	// copy it under a new name in prompts.yaml to make your own templates
+	{
+		Name:        PromptGenerateFile,
+		OkToReplace: true,
+		Prompt: `Write {output} following these instructions: {instructions}
+
+Match the language, style, naming, and conventions of the existing project code below. Write complete, working code without placeholders. Respond with only the file contents, no explanation.
+
+Existing project code:
+'''
+{context}
+'''
+
+Current content of the output:
+'''
+{existing}
+'''`,
+	},
+
+	// PromptWatchTriage is a prompt for a cheap model to decide whether log
+	// lines flagged by the watch command are worth explaining
+	{
+		Name:        PromptWatchTriage,
+		OkToReplace: true,
+		Prompt: `I'm watching the {source} and these lines were flagged as a possible problem ({reason}). Decide whether they show something noteworthy that I should look at, like a crash, an outage, or a new error. Routine or expected errors, like a single retried request, are not noteworthy. Answer "yes" or "no" on the first line. If yes, add a one-sentence summary of the problem on the second line.
+
+Preceding lines:
+'''
+{context}
+'''
+
+Flagged lines:
+'''
+{lines}
+'''`,
+	},
+
+	// PromptWatchExplain is a prompt for explaining log lines that the triage
+	// model flagged in the watch command
+	{
+		Name:        PromptWatchExplain,
+		OkToReplace: true,
+		Prompt: `I'm watching the {source} and something went wrong: {summary}. Explain briefly what probably happened and why, and suggest how to investigate or fix it, including commands where useful. Base your answer on the log lines below and say if they aren't enough to tell.
+
+Preceding lines:
+'''
+{context}
+'''
+
+Flagged lines:
+'''
+{lines}
+'''`,
+	},
+
+	// PromptBenchJudge is a prompt for scoring the outputs of two prompt
+	// variants in the prompts bench command
+	{
+		Name:        PromptBenchJudge,
+		OkToReplace: true,
+		Prompt: `You are judging two responses generated from the same input by different prompts. Score each response from 1 to 10 for how correct, helpful, and concise it is given the input. Don't favor a response because it is longer or because of its position. Respond with only JSON in the form {"score_a": 7, "score_b": 5, "reason": "one sentence explaining the scores"}.
+
+Input:
+'''
+{input}
+'''
+
+Response A:
+'''
+{output_a}
+'''
+
+Response B:
+'''
+{output_b}
+'''`,
+	},
+
+	// PromptVerifyAnswer is a prompt for checking an answer from prompt or
+	// gencmd before it's shown, see --verify
+	{
+		Name:        PromptVerifyAnswer,
+		OkToReplace: true,
+		Prompt: `You are reviewing an answer written by another assistant before it's shown to the user. Check it for hallucinations: commands, programs, flags, options, subcommands, config keys, or APIs that don't exist or don't do what the answer claims, and for anything that would fail or cause harm if run. Don't flag matters of style or things that are merely unusual. Respond with only JSON in the form {"confidence": 85, "issues": ["one sentence per problem found"]}, where confidence is from 0 to 100 and issues is empty if there are none.
+
+Question:
+'''
+{question}
+'''
+
+Answer:
+'''
+{answer}
+'''`,
+	},
+
 	// PromptQuestion is a prompt for answering a question
 	{
 		Name:        PromptQuestion,
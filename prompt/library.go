@@ -1,16 +1,20 @@
 package prompt
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 
+	"github.com/bakks/butterfish/storage"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -25,15 +29,156 @@ type Prompt struct {
 	Name        string
 	Prompt      string
 	OkToReplace bool
+	// Where a prompt was synced from, e.g. a team git repo, empty for local
+	// and default prompts
+	Source string `yaml:",omitempty"`
+	// Declarations of the prompt's fields, fields that aren't declared are
+	// required strings
+	Fields []PromptField `yaml:",omitempty"`
+	// Variants of the prompt text in other languages keyed by locale, e.g.
+	// es or pt-BR, with the same fields as Prompt
+	Translations map[string]string `yaml:",omitempty"`
+}
+
+// The prompt text for a locale: an exact match in Translations, then the
+// base language (es for es-MX), then Prompt
+func (this *Prompt) Localized(locale string) string {
+	locale = NormalizeLocale(locale)
+	if locale == "" || len(this.Translations) == 0 {
+		return this.Prompt
+	}
+	if text, ok := this.Translations[locale]; ok {
+		return text
+	}
+	base, _, _ := strings.Cut(locale, "-")
+	if text, ok := this.Translations[base]; ok {
+		return text
+	}
+	return this.Prompt
+}
+
+// A locale in the form Translations are keyed by, e.g. es_MX.UTF-8 gives
+// es-MX. Returns an empty string for the C and POSIX locales.
+func NormalizeLocale(locale string) string {
+	locale, _, _ = strings.Cut(strings.TrimSpace(locale), ".")
+	locale, _, _ = strings.Cut(locale, "@")
+	if locale == "" || locale == "C" || locale == "POSIX" {
+		return ""
+	}
+	language, region, found := strings.Cut(strings.ReplaceAll(locale, "_", "-"), "-")
+	if !found {
+		return strings.ToLower(language)
+	}
+	return strings.ToLower(language) + "-" + strings.ToUpper(region)
+}
+
+const (
+	FieldTypeString = "string"
+	FieldTypeInt    = "int"
+	FieldTypeFloat  = "float"
+	FieldTypeBool   = "bool"
+)
+
+// A field of a prompt, declared so that it can have a type, a default value
+// used when GetPrompt isn't passed the field, and a set of allowed values.
+// See README.md for an example.
+type PromptField struct {
+	Name string
+	// string, int, float, or bool, string if empty
+	Type string `yaml:",omitempty"`
+	// Used when the field isn't passed, the field is required if nil
+	Default *string `yaml:",omitempty"`
+	// If set, the value must be one of these
+	Enum []string `yaml:",omitempty"`
+}
+
+// Check that a value has the field's type and is one of its allowed values
+func (this *PromptField) Validate(value string) error {
+	var err error
+	switch this.Type {
+	case "", FieldTypeString:
+	case FieldTypeInt:
+		_, err = strconv.Atoi(value)
+	case FieldTypeFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case FieldTypeBool:
+		_, err = strconv.ParseBool(value)
+	default:
+		return fmt.Errorf("Field %s has unknown type %s, use string, int, float, or bool", this.Name, this.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("Field %s must be of type %s, got %q", this.Name, this.Type, value)
+	}
+
+	if len(this.Enum) > 0 {
+		for _, allowed := range this.Enum {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("Field %s must be one of %s, got %q", this.Name, strings.Join(this.Enum, ", "), value)
+	}
+	return nil
+}
+
+// Fill in the defaults of declared fields that weren't passed and that the
+// prompt uses, and validate the values of declared fields that were
+func (this *Prompt) resolveArgs(args []string) ([]string, error) {
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf("Prompt %s was passed an odd number of arguments, they should be pairs of field and value", this.Name)
+	}
+	passed := map[string]bool{}
+	for i := 0; i < len(args); i += 2 {
+		passed[args[i]] = true
+	}
+
+	used := map[string]bool{}
+	for _, name := range FieldNames(this.Prompt) {
+		used[name] = true
+	}
+
+	resolved := append([]string{}, args...)
+	for _, field := range this.Fields {
+		if passed[field.Name] || !used[field.Name] || field.Default == nil {
+			continue
+		}
+		resolved = append(resolved, field.Name, *field.Default)
+	}
+
+	for i := 0; i < len(resolved); i += 2 {
+		for _, field := range this.Fields {
+			if field.Name != resolved[i] {
+				continue
+			}
+			err := field.Validate(resolved[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("Prompt %s: %w", this.Name, err)
+			}
+		}
+	}
+	return resolved, nil
 }
 
 // DiskPromptLibrary struct which includes a Path string and a Prompts instance
-// This implements the PromptLibrary interface.
+// This implements the PromptLibrary interface. Its methods are safe to call
+// from several goroutines, reading or changing Prompts directly isn't.
 type DiskPromptLibrary struct {
 	Path          string
 	Prompts       []Prompt
 	Verbose       bool
 	VerboseWriter io.Writer
+	// Where the use of the library's prompts is recorded, by the LLM client
+	// when a request built from one is sent, nothing is recorded if nil
+	Usage *UsageLog
+	// Locale of the prompt variants to use, the default prompts if empty
+	Language string
+	// If set the library is kept here, keyed by Path, rather than in a file
+	Store storage.Store
+
+	mutex sync.RWMutex
+	// The file's prompts as of the last Load or Save, which Save merges
+	// changes made by other shells against
+	saved map[string]Prompt
 }
 
 // NewPromptLibrary function to make a NewPromptLibrary which takes a path argument
@@ -45,107 +190,232 @@ func NewPromptLibrary(path string, verbose bool, verboseWriter io.Writer) *DiskP
 	}
 }
 
-// Returns a list of fields to interpolate (strings wrapped in { and })
-func getFields(prompt string) []string {
-	// regex to find all fields in a string
-	regex := regexp.MustCompile(`\{[a-zA-Z0-9_]+\}`)
-	return regex.FindAllString(prompt, -1)
-}
-
 // Fetch a prompt with a given name, interpolating the fields into the prompt string.
-// Throws an error if fields are missing.
+// Declared fields that aren't passed get their default, and the values of
+// declared fields are validated. Throws an error if fields are missing.
 // The argument pattern is first the field name, then the value, for example:
 //
 //	GetPrompt("my_prompt", "name", "John", "age", "30")
 func (this *DiskPromptLibrary) GetPrompt(name string, args ...string) (string, error) {
 
 	// first find the prompt given the name
-	index := this.ContainsPromptNamed(name)
-	if index == -1 {
+	prompt, ok := this.promptNamed(name)
+	if !ok {
 		return "", errors.New("Prompt not found")
 	}
-	prompt := this.Prompts[index]
 
-	// interpolate the prompt string
-	promptString, err := Interpolate(prompt.Prompt, args...)
+	args, err := prompt.resolveArgs(args)
+	if err != nil {
+		return "", err
+	}
 
-	return promptString, err
+	// interpolate the prompt string
+	return Interpolate(prompt.Localized(this.Language), args...)
 }
 
 // Fetch a prompt with a given name, interpolating later
 func (this *DiskPromptLibrary) GetUninterpolatedPrompt(name string) (string, error) {
 
 	// first find the prompt given the name
-	index := this.ContainsPromptNamed(name)
-	if index == -1 {
+	prompt, ok := this.promptNamed(name)
+	if !ok {
 		return "", errors.New("Prompt not found")
 	}
-	prompt := this.Prompts[index]
 
-	return prompt.Prompt, nil
+	return prompt.Localized(this.Language), nil
 }
 
 func (this *DiskPromptLibrary) InterpolatePrompt(prompt string, args ...string) (string, error) {
 	return Interpolate(prompt, args...)
 }
 
+// Interpolate the fields of a prompt body, see template.go for the syntax.
+// Every field must be passed and every argument must be a field. Values are
+// inserted as they are, they aren't read as fields themselves.
 func Interpolate(p string, args ...string) (string, error) {
+	if len(args)%2 != 0 {
+		return "", errors.New("Odd number of arguments, they should be pairs of field and value")
+	}
+
 	// turn args into a map
 	argMap := make(map[string]string)
 	for i := 0; i < len(args); i += 2 {
 		argMap[args[i]] = args[i+1]
 	}
 
-	fields := getFields(p)
-	promptString := p
-
-	// check that the number of fields matches the number of arguments
-	if len(fields)*2 != len(args) {
-		fieldNames := strings.Join(fields, ", ")
-		return "", fmt.Errorf("Incorrect number of fields provided, prompt requires fields (%s)", fieldNames)
+	parts, _ := parseFields(p)
+	names := FieldNames(p)
+	fields := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		fields = append(fields, "{"+name+"}")
+		seen[name] = true
 	}
+	fieldNames := strings.Join(fields, ", ")
 
-	// interpolate fields using the argMap
-	for _, field := range fields {
-		fieldName := field[1 : len(field)-1] // trim { and } from field
-		value, ok := argMap[fieldName]
-		if !ok {
-			fieldNames := strings.Join(fields, ", ")
-			return "", fmt.Errorf("Missing field %s, prompt requires fields (%s)", field, fieldNames)
+	// check that every field is passed and every argument is a field
+	missing := []string{}
+	for _, name := range names {
+		if _, ok := argMap[name]; !ok {
+			missing = append(missing, "{"+name+"}")
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("Missing fields %s, prompt requires fields (%s)", strings.Join(missing, ", "), fieldNames)
+	}
+	for name := range argMap {
+		if !seen[name] {
+			return "", fmt.Errorf("Unknown field %s, prompt requires fields (%s)", name, fieldNames)
 		}
-		promptString = strings.Replace(promptString, field, value, -1)
 	}
 
-	return promptString, nil
+	builder := strings.Builder{}
+	for _, part := range parts {
+		if part.field {
+			builder.WriteString(argMap[part.text])
+		} else {
+			builder.WriteString(part.text)
+		}
+	}
+	return builder.String(), nil
 }
 
-// Write a yaml file at the path with the contents marshalled from Prompts
+// Write a yaml file at the path with the contents marshalled from Prompts.
+// While holding an advisory lock on the file, changes other shells saved
+// since we last loaded or saved are merged in, then the file is written next
+// to the path and renamed over it, so readers never see a partial file.
 func (this *DiskPromptLibrary) Save() error {
-	if this.Prompts == nil || len(this.Prompts) == 0 {
+	this.mutex.RLock()
+	empty := len(this.Prompts) == 0
+	this.mutex.RUnlock()
+	if empty {
 		return errors.New("No prompts to write, please initialize the prompt library")
 	}
-	bytes, err := yaml.Marshal(this.Prompts)
-	if err != nil {
-		return errors.New("There was a problem marshalling prompt library, please ensure you are passing in a vaild PromptLibrary struct.")
+
+	if this.Store != nil {
+		bytes, _, err := this.marshal()
+		if err != nil {
+			return err
+		}
+		return this.Store.Put(context.Background(), this.Path, bytes)
 	}
 
-	// create any directories necessary to write the file
-	err = os.MkdirAll(filepath.Dir(this.Path), 0755)
+	// create any directories necessary to lock and write the file
+	err := os.MkdirAll(filepath.Dir(this.Path), 0755)
 	if err != nil {
 		return errors.New("Unable to access directory, please check write permissions and try again.")
 	}
+	unlock, err := lockFile(this.Path + ".lock")
+	if err != nil {
+		return errors.New("Unable to lock prompt file, please check write permissions and try again.")
+	}
+	defer unlock()
 
-	err = ioutil.WriteFile(this.Path, bytes, 0644)
+	data, err := os.ReadFile(this.Path)
+	if err == nil {
+		onDisk := []Prompt{}
+		err = yaml.Unmarshal(data, &onDisk)
+		if err != nil {
+			log.Printf("Not merging %s, it isn't valid yaml: %s", this.Path, err)
+		} else {
+			this.merge(onDisk)
+		}
+	}
+
+	bytes, saved, err := this.marshal()
+	if err != nil {
+		return err
+	}
+	store := storage.NewDiskStore("")
+	store.Perm = 0644
+	err = store.Put(context.Background(), this.Path, bytes)
 	if err != nil {
 		return errors.New("Unable to write file, please check write permissions and try again.")
 	}
+
+	this.mutex.Lock()
+	this.saved = saved
+	this.mutex.Unlock()
 	return nil
 }
 
+// The yaml for Prompts, and the prompts it holds by name
+func (this *DiskPromptLibrary) marshal() ([]byte, map[string]Prompt, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	bytes, err := yaml.Marshal(this.Prompts)
+	if err != nil {
+		return nil, nil, errors.New("There was a problem marshalling prompt library, please ensure you are passing in a vaild PromptLibrary struct.")
+	}
+	return bytes, promptsByName(this.Prompts), nil
+}
+
+// Merge in the prompts another shell saved. Prompts it added are added,
+// and prompts it changed are taken unless we've changed them too, in which
+// case ours win.
+func (this *DiskPromptLibrary) merge(onDisk []Prompt) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, theirs := range onDisk {
+		base, known := this.saved[theirs.Name]
+		index := this.indexOf(theirs.Name)
+		if index == -1 {
+			this.Prompts = append(this.Prompts, theirs)
+		} else if known && reflect.DeepEqual(this.Prompts[index], base) {
+			this.Prompts[index] = theirs
+		}
+	}
+}
+
+func promptsByName(prompts []Prompt) map[string]Prompt {
+	byName := make(map[string]Prompt, len(prompts))
+	for _, prompt := range prompts {
+		byName[prompt.Name] = prompt
+	}
+	return byName
+}
+
+// Take an exclusive advisory lock on the file at path, creating it if
+// needed, returns a function that releases the lock
+func lockFile(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
 // Checks for an exact string match between the of a prompt and the internal
 // prompt array of the DiskPromptLibrary, returns the index of the prompt if
 // found, otherwise returns -1
 func (this *DiskPromptLibrary) ContainsPromptNamed(name string) int {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.indexOf(name)
+}
+
+// A copy of the prompt with a name
+func (this *DiskPromptLibrary) promptNamed(name string) (Prompt, bool) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	index := this.indexOf(name)
+	if index == -1 {
+		return Prompt{}, false
+	}
+	return this.Prompts[index], true
+}
+
+// ContainsPromptNamed for callers holding the mutex
+func (this *DiskPromptLibrary) indexOf(name string) int {
 	for i, prompt := range this.Prompts {
 		if prompt.Name == name {
 			return i
@@ -156,8 +426,10 @@ func (this *DiskPromptLibrary) ContainsPromptNamed(name string) int {
 
 // Given an array of Prompt objects, replace prompts in the prompt library based on name, only if OkToReplace is true on the Prompt already in the library
 func (this *DiskPromptLibrary) ReplacePrompts(newPrompts []Prompt) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 	for _, newPrompt := range newPrompts {
-		index := this.ContainsPromptNamed(newPrompt.Name)
+		index := this.indexOf(newPrompt.Name)
 		if index == -1 {
 			this.Prompts = append(this.Prompts, newPrompt)
 		} else if this.Prompts[index].OkToReplace {
@@ -166,8 +438,41 @@ func (this *DiskPromptLibrary) ReplacePrompts(newPrompts []Prompt) {
 	}
 }
 
+// Merge prompts synced from a shared source into the library. New prompts are
+// added, prompts previously synced from the same source are updated, and
+// other prompts are only replaced if OkToReplace is true, so local
+// customizations are kept. Synced prompts are stored with OkToReplace false
+// so the defaults don't overwrite them. Returns the names of the prompts that
+// were added, updated, and skipped.
+func (this *DiskPromptLibrary) SyncPrompts(newPrompts []Prompt, source string) (added, updated, skipped []string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, newPrompt := range newPrompts {
+		newPrompt.OkToReplace = false
+		newPrompt.Source = source
+
+		index := this.indexOf(newPrompt.Name)
+		if index == -1 {
+			this.Prompts = append(this.Prompts, newPrompt)
+			added = append(added, newPrompt.Name)
+		} else if this.Prompts[index].OkToReplace || this.Prompts[index].Source == source {
+			if this.Prompts[index].Prompt != newPrompt.Prompt {
+				updated = append(updated, newPrompt.Name)
+			}
+			this.Prompts[index] = newPrompt
+		} else {
+			skipped = append(skipped, newPrompt.Name)
+		}
+	}
+	return added, updated, skipped
+}
+
 // Check if the library file exists, should be called before Load()
 func (this *DiskPromptLibrary) LibraryFileExists() bool {
+	if this.Store != nil {
+		_, err := this.Store.Get(context.Background(), this.Path)
+		return err == nil
+	}
 	if _, err := os.Stat(this.Path); os.IsNotExist(err) {
 		return false
 	}
@@ -176,15 +481,27 @@ func (this *DiskPromptLibrary) LibraryFileExists() bool {
 
 // Load a yaml file at the path with a contents marshalled into Prompts
 func (this *DiskPromptLibrary) Load() error {
-	data, err := os.ReadFile(this.Path)
+	var data []byte
+	var err error
+	if this.Store != nil {
+		data, err = this.Store.Get(context.Background(), this.Path)
+	} else {
+		data, err = os.ReadFile(this.Path)
+	}
 	if err != nil {
 		return errors.New("Unable to access prompt file, please check write permissions and try again.")
 	}
-	err = yaml.Unmarshal(data, &this.Prompts)
+	prompts := []Prompt{}
+	err = yaml.Unmarshal(data, &prompts)
 	if err != nil {
 		return errors.New("File is not formatted correctly. Please ensure you are passing in a valid YAML file and try again.")
 	}
 
+	this.mutex.Lock()
+	this.Prompts = prompts
+	this.saved = promptsByName(prompts)
+	this.mutex.Unlock()
+
 	if this.Verbose {
 		log.Printf("Loaded %v prompts from %v\n\r", len(this.Prompts), this.Path)
 	}
@@ -0,0 +1,113 @@
+package prompt
+
+import (
+	"errors"
+	"sync"
+)
+
+// MemoryPromptLibrary implements the PromptLibrary interface without a file,
+// for programs embedding butterfish, tests, and butterfish --no-prompt-file.
+// Prompts set on it are only kept in memory. Defaults, e.g. DefaultPrompts,
+// are read-only: they're used for names that haven't been set and they're
+// never changed, so they can be shared between libraries.
+type MemoryPromptLibrary struct {
+	Defaults []Prompt
+	// Locale of the prompt variants to use, the default prompts if empty
+	Language string
+
+	prompts []Prompt
+	mutex   sync.RWMutex
+}
+
+// A library with the given read-only defaults, which may be nil
+func NewMemoryPromptLibrary(defaults []Prompt) *MemoryPromptLibrary {
+	return &MemoryPromptLibrary{Defaults: defaults}
+}
+
+// The prompt with a name, set prompts first and then the defaults
+func (this *MemoryPromptLibrary) lookup(name string) (Prompt, bool) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	for _, prompt := range this.prompts {
+		if prompt.Name == name {
+			return prompt, true
+		}
+	}
+	for _, prompt := range this.Defaults {
+		if prompt.Name == name {
+			return prompt, true
+		}
+	}
+	return Prompt{}, false
+}
+
+// Fetch a prompt by name with its fields interpolated, see
+// DiskPromptLibrary.GetPrompt
+func (this *MemoryPromptLibrary) GetPrompt(name string, args ...string) (string, error) {
+	prompt, ok := this.lookup(name)
+	if !ok {
+		return "", errors.New("Prompt not found")
+	}
+
+	args, err := prompt.resolveArgs(args)
+	if err != nil {
+		return "", err
+	}
+	return Interpolate(prompt.Localized(this.Language), args...)
+}
+
+func (this *MemoryPromptLibrary) GetUninterpolatedPrompt(name string) (string, error) {
+	prompt, ok := this.lookup(name)
+	if !ok {
+		return "", errors.New("Prompt not found")
+	}
+	return prompt.Localized(this.Language), nil
+}
+
+func (this *MemoryPromptLibrary) InterpolatePrompt(prompt string, args ...string) (string, error) {
+	return Interpolate(prompt, args...)
+}
+
+// Add a prompt, or replace the one with the same name. A prompt named like a
+// default takes its place without changing Defaults.
+func (this *MemoryPromptLibrary) SetPrompt(prompt Prompt) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for i := range this.prompts {
+		if this.prompts[i].Name == prompt.Name {
+			this.prompts[i] = prompt
+			return
+		}
+	}
+	this.prompts = append(this.prompts, prompt)
+}
+
+// Remove a prompt that was set, a default of the same name is used again
+func (this *MemoryPromptLibrary) DeletePrompt(name string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for i := range this.prompts {
+		if this.prompts[i].Name == name {
+			this.prompts = append(this.prompts[:i], this.prompts[i+1:]...)
+			return
+		}
+	}
+}
+
+// Every prompt, the set prompts and then the defaults that haven't been
+// replaced
+func (this *MemoryPromptLibrary) Prompts() []Prompt {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	prompts := append([]Prompt{}, this.prompts...)
+	set := map[string]bool{}
+	for _, prompt := range this.prompts {
+		set[prompt.Name] = true
+	}
+	for _, prompt := range this.Defaults {
+		if !set[prompt.Name] {
+			prompts = append(prompts, prompt)
+		}
+	}
+	return prompts
+}
@@ -0,0 +1,118 @@
+package prompt
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Prompt bodies mark fields as {name}. A brace can be escaped with a
+// backslash, e.g. \{ and \}, to include it literally. Prompts with lots of
+// braces, e.g. JSON examples or shell brace expansion, can use {{name}}
+// instead: a prompt that contains a {{name}} field uses that syntax
+// throughout and its single braces are literal.
+
+var fieldNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// A piece of a prompt body, either literal text or a field
+type templatePart struct {
+	text  string
+	field bool
+}
+
+// Split a prompt body into literal text and fields, escapes are removed
+// from the text
+func parseTemplate(template string, double bool) []templatePart {
+	open, close := "{", "}"
+	if double {
+		open, close = "{{", "}}"
+	}
+
+	parts := []templatePart{}
+	literal := strings.Builder{}
+	for i := 0; i < len(template); {
+		c := template[i]
+		if c == '\\' && i+1 < len(template) && (template[i+1] == '{' || template[i+1] == '}') {
+			literal.WriteByte(template[i+1])
+			i += 2
+			continue
+		}
+
+		if strings.HasPrefix(template[i:], open) {
+			rest := template[i+len(open):]
+			end := strings.Index(rest, close)
+			if end > 0 && fieldNameRegex.MatchString(rest[:end]) {
+				if literal.Len() > 0 {
+					parts = append(parts, templatePart{text: literal.String()})
+					literal.Reset()
+				}
+				parts = append(parts, templatePart{text: rest[:end], field: true})
+				i += len(open) + end + len(close)
+				continue
+			}
+		}
+
+		literal.WriteByte(c)
+		i++
+	}
+
+	if literal.Len() > 0 {
+		parts = append(parts, templatePart{text: literal.String()})
+	}
+	return parts
+}
+
+// Parse a prompt body with the syntax it uses, and whether that's {{name}}
+func parseFields(template string) ([]templatePart, bool) {
+	parts := parseTemplate(template, true)
+	for _, part := range parts {
+		if part.field {
+			return parts, true
+		}
+	}
+	return parseTemplate(template, false), false
+}
+
+// The names of the fields in a prompt body, each listed once
+func FieldNames(template string) []string {
+	parts, _ := parseFields(template)
+	names := []string{}
+	seen := map[string]bool{}
+	for _, part := range parts {
+		if part.field && !seen[part.text] {
+			seen[part.text] = true
+			names = append(names, part.text)
+		}
+	}
+	return names
+}
+
+// Escape the braces of a value so that it's literal text in a prompt body
+func Escape(value string) string {
+	value = strings.ReplaceAll(value, "{", `\{`)
+	return strings.ReplaceAll(value, "}", `\}`)
+}
+
+// Fill in some of the fields of a prompt body, the rest are left to be
+// interpolated later. The fill function returns the value of a field and
+// whether it has one. Values are escaped so they aren't read as fields.
+func FillFields(template string, fill func(name string) (string, bool)) string {
+	parts, double := parseFields(template)
+	builder := strings.Builder{}
+	for _, part := range parts {
+		if !part.field {
+			builder.WriteString(Escape(part.text))
+			continue
+		}
+
+		value, ok := fill(part.text)
+		switch {
+		case ok:
+			builder.WriteString(Escape(value))
+		case double:
+			builder.WriteString("{{" + part.text + "}}")
+		default:
+			builder.WriteString("{" + part.text + "}")
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,205 @@
+package prompt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/storage"
+)
+
+// The library keeps usage counts for its prompts in a JSON file next to the
+// library file, e.g. prompts_usage.json, so that `butterfish prompts stats`
+// can show which prompts are never used and which have long responses.
+
+// The usage of a single prompt
+type PromptUsage struct {
+	// How many times the prompt was fetched from the library to build a request
+	Invocations int       `json:"invocations"`
+	LastUsed    time.Time `json:"last_used"`
+	// The responses whose tokens we counted, and the total of those tokens
+	Responses      int `json:"responses"`
+	ResponseTokens int `json:"response_tokens"`
+}
+
+// The average number of tokens in a response, 0 if none were counted
+func (this *PromptUsage) AverageResponseTokens() float64 {
+	if this.Responses == 0 {
+		return 0
+	}
+	return float64(this.ResponseTokens) / float64(this.Responses)
+}
+
+// The sidecar file of a prompt library's usage counts. Counts are kept in
+// memory and added to the file by Flush, which runs usageFlushInterval after
+// the first count and should be called on exit, so recording a use never
+// waits on the disk. The file is read when flushing so that concurrent
+// butterfish processes mostly don't lose each other's counts. A nil UsageLog
+// records nothing.
+type UsageLog struct {
+	Path string
+	// If set the usage file is kept here, keyed by Path, rather than in a file
+	Store storage.Store
+
+	pending    map[string]*PromptUsage
+	flushTimer *time.Timer
+	mutex      sync.Mutex
+	// held while the file is updated, so flushes don't overlap
+	flushMutex sync.Mutex
+}
+
+// How long counts are kept in memory before they're written
+const usageFlushInterval = 30 * time.Second
+
+func NewUsageLog(path string) *UsageLog {
+	return &UsageLog{Path: path}
+}
+
+// The usage file of the library at path, e.g. prompts.yaml has
+// prompts_usage.json
+func UsagePath(libraryPath string) string {
+	return strings.TrimSuffix(libraryPath, filepath.Ext(libraryPath)) + "_usage.json"
+}
+
+func (this *UsageLog) store() storage.Store {
+	if this.Store != nil {
+		return this.Store
+	}
+	store := storage.NewDiskStore("")
+	store.Perm = 0644
+	return store
+}
+
+// The usage saved in the file
+func (this *UsageLog) load() (map[string]*PromptUsage, error) {
+	usage := map[string]*PromptUsage{}
+	data, err := this.store().Get(context.Background(), this.Path)
+	if errors.Is(err, storage.ErrNotFound) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &usage)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// Load the usage of each prompt by name, including counts that haven't been
+// flushed, empty if nothing has been recorded
+func (this *UsageLog) Load() (map[string]*PromptUsage, error) {
+	usage, err := this.load()
+	if err != nil {
+		return nil, err
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	mergeUsage(usage, this.pending)
+	return usage, nil
+}
+
+// Add the counts in from to into
+func mergeUsage(into, from map[string]*PromptUsage) {
+	for name, added := range from {
+		usage := into[name]
+		if usage == nil {
+			usage = &PromptUsage{}
+			into[name] = usage
+		}
+		usage.Invocations += added.Invocations
+		usage.Responses += added.Responses
+		usage.ResponseTokens += added.ResponseTokens
+		if added.LastUsed.After(usage.LastUsed) {
+			usage.LastUsed = added.LastUsed
+		}
+	}
+}
+
+// Record that a request built from a prompt was sent
+func (this *UsageLog) RecordInvocation(name string) {
+	this.update(name, func(usage *PromptUsage) {
+		usage.Invocations++
+		usage.LastUsed = time.Now()
+	})
+}
+
+// Record the number of tokens in a response to a request built from a prompt
+func (this *UsageLog) RecordResponse(name string, tokens int) {
+	this.update(name, func(usage *PromptUsage) {
+		usage.Responses++
+		usage.ResponseTokens += tokens
+	})
+}
+
+func (this *UsageLog) update(name string, change func(usage *PromptUsage)) {
+	if this == nil || name == "" {
+		return
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.pending == nil {
+		this.pending = map[string]*PromptUsage{}
+	}
+	if this.pending[name] == nil {
+		this.pending[name] = &PromptUsage{}
+	}
+	change(this.pending[name])
+
+	if this.flushTimer == nil {
+		this.flushTimer = time.AfterFunc(usageFlushInterval, func() {
+			err := this.Flush()
+			if err != nil {
+				log.Printf("Error recording prompt usage: %s", err)
+			}
+		})
+	}
+}
+
+// Add the counts kept in memory to the file
+func (this *UsageLog) Flush() error {
+	if this == nil {
+		return nil
+	}
+	this.flushMutex.Lock()
+	defer this.flushMutex.Unlock()
+
+	this.mutex.Lock()
+	pending := this.pending
+	this.pending = nil
+	if this.flushTimer != nil {
+		this.flushTimer.Stop()
+		this.flushTimer = nil
+	}
+	this.mutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	usage, err := this.load()
+	if err == nil {
+		mergeUsage(usage, pending)
+		var data []byte
+		data, err = json.MarshalIndent(usage, "", "  ")
+		if err == nil {
+			err = this.store().Put(context.Background(), this.Path, data)
+		}
+	}
+	if err != nil {
+		// keep the counts for the next flush
+		this.mutex.Lock()
+		if this.pending == nil {
+			this.pending = map[string]*PromptUsage{}
+		}
+		mergeUsage(this.pending, pending)
+		this.mutex.Unlock()
+	}
+	return err
+}
@@ -1,6 +1,6 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
-// 	protoc-gen-go v1.31.0
+// 	protoc-gen-go v1.36.1
 // 	protoc        v4.25.0
 // source: butterfish.proto
 
@@ -24,21 +24,26 @@ const (
 // Represents the constituent files of a directory, this should map a relative
 // path from the directory to a file within it (but not within a child dir).
 type DirectoryIndex struct {
-	state         protoimpl.MessageState
-	sizeCache     protoimpl.SizeCache
-	unknownFields protoimpl.UnknownFields
-
+	state protoimpl.MessageState `protogen:"open.v1"`
 	// string should be a relative path, e.g. "./foo.txt"
-	Files map[string]*FileEmbeddings `protobuf:"bytes,1,rep,name=files,proto3" json:"files,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Files map[string]*FileEmbeddings `protobuf:"bytes,1,rep,name=files,proto3" json:"files,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// The model the vectors were embedded with, empty for indexes created
+	// before this was recorded, which used text-embedding-ada-002
+	EmbeddingModel string `protobuf:"bytes,2,opt,name=embedding_model,json=embeddingModel,proto3" json:"embedding_model,omitempty"`
+	// The dimensions requested from the model, 0 for the model's default
+	Dimensions int32 `protobuf:"varint,3,opt,name=dimensions,proto3" json:"dimensions,omitempty"`
+	// Approximate nearest neighbor graph over the embeddings, only built for
+	// directories with many chunks
+	Hnsw          *HnswGraph `protobuf:"bytes,4,opt,name=hnsw,proto3" json:"hnsw,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *DirectoryIndex) Reset() {
 	*x = DirectoryIndex{}
-	if protoimpl.UnsafeEnabled {
-		mi := &file_butterfish_proto_msgTypes[0]
-		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		ms.StoreMessageInfo(mi)
-	}
+	mi := &file_butterfish_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
 }
 
 func (x *DirectoryIndex) String() string {
@@ -49,7 +54,7 @@ func (*DirectoryIndex) ProtoMessage() {}
 
 func (x *DirectoryIndex) ProtoReflect() protoreflect.Message {
 	mi := &file_butterfish_proto_msgTypes[0]
-	if protoimpl.UnsafeEnabled && x != nil {
+	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
 			ms.StoreMessageInfo(mi)
@@ -71,25 +76,54 @@ func (x *DirectoryIndex) GetFiles() map[string]*FileEmbeddings {
 	return nil
 }
 
-type FileEmbeddings struct {
-	state         protoimpl.MessageState
-	sizeCache     protoimpl.SizeCache
-	unknownFields protoimpl.UnknownFields
+func (x *DirectoryIndex) GetEmbeddingModel() string {
+	if x != nil {
+		return x.EmbeddingModel
+	}
+	return ""
+}
 
-	Path string `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"` // filename, relative path to the DirectoryIndex, e.g. ./foo
+func (x *DirectoryIndex) GetDimensions() int32 {
+	if x != nil {
+		return x.Dimensions
+	}
+	return 0
+}
+
+func (x *DirectoryIndex) GetHnsw() *HnswGraph {
+	if x != nil {
+		return x.Hnsw
+	}
+	return nil
+}
+
+type FileEmbeddings struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Path  string                 `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"` // filename, relative path to the DirectoryIndex, e.g. ./foo
 	// When the embedding was created, if an earlier timestamp than the file
 	// edit time then the file should be re-embedded.
 	UpdatedAt  *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
 	Embeddings []*AnnotatedEmbedding  `protobuf:"bytes,3,rep,name=embeddings,proto3" json:"embeddings,omitempty"`
+	// The document title of files whose text is extracted, e.g. PDFs
+	Title string `protobuf:"bytes,4,opt,name=title,proto3" json:"title,omitempty"`
+	// The URL of a web page added with `butterfish index add-url`, these are
+	// keyed by URL in the directory index rather than by file name
+	Url string `protobuf:"bytes,5,opt,name=url,proto3" json:"url,omitempty"`
+	// The text of a web page, its chunks are offsets into this since there's
+	// no file to read them from
+	Text string `protobuf:"bytes,6,opt,name=text,proto3" json:"text,omitempty"`
+	// Tags from the frontmatter of markdown files, searches can be filtered
+	// by them
+	Tags          []string `protobuf:"bytes,7,rep,name=tags,proto3" json:"tags,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *FileEmbeddings) Reset() {
 	*x = FileEmbeddings{}
-	if protoimpl.UnsafeEnabled {
-		mi := &file_butterfish_proto_msgTypes[1]
-		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		ms.StoreMessageInfo(mi)
-	}
+	mi := &file_butterfish_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
 }
 
 func (x *FileEmbeddings) String() string {
@@ -100,7 +134,7 @@ func (*FileEmbeddings) ProtoMessage() {}
 
 func (x *FileEmbeddings) ProtoReflect() protoreflect.Message {
 	mi := &file_butterfish_proto_msgTypes[1]
-	if protoimpl.UnsafeEnabled && x != nil {
+	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
 			ms.StoreMessageInfo(mi)
@@ -136,23 +170,57 @@ func (x *FileEmbeddings) GetEmbeddings() []*AnnotatedEmbedding {
 	return nil
 }
 
-type AnnotatedEmbedding struct {
-	state         protoimpl.MessageState
-	sizeCache     protoimpl.SizeCache
-	unknownFields protoimpl.UnknownFields
+func (x *FileEmbeddings) GetTitle() string {
+	if x != nil {
+		return x.Title
+	}
+	return ""
+}
+
+func (x *FileEmbeddings) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
 
-	Start  uint64    `protobuf:"varint,2,opt,name=start,proto3" json:"start,omitempty"` // start index in bytes to the file chunk
-	End    uint64    `protobuf:"varint,3,opt,name=end,proto3" json:"end,omitempty"`     // end index in bytes to the file chunk
+func (x *FileEmbeddings) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *FileEmbeddings) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+type AnnotatedEmbedding struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Start uint64                 `protobuf:"varint,2,opt,name=start,proto3" json:"start,omitempty"` // start index in bytes to the file chunk
+	End   uint64                 `protobuf:"varint,3,opt,name=end,proto3" json:"end,omitempty"`     // end index in bytes to the file chunk
+	// The vector is stored in one of vector, vector_f16, or vector_i8,
+	// depending on the precision the index was created with
 	Vector []float32 `protobuf:"fixed32,4,rep,packed,name=vector,proto3" json:"vector,omitempty"`
+	// float16 values, 2 little endian bytes each
+	VectorF16 []byte `protobuf:"bytes,5,opt,name=vector_f16,json=vectorF16,proto3" json:"vector_f16,omitempty"`
+	// int8 values, each multiplied by scale to get the vector's value
+	VectorI8 []byte  `protobuf:"bytes,6,opt,name=vector_i8,json=vectorI8,proto3" json:"vector_i8,omitempty"`
+	Scale    float32 `protobuf:"fixed32,7,opt,name=scale,proto3" json:"scale,omitempty"`
+	// The 1-based cell number of a Jupyter notebook chunk, 0 for other files
+	Cell          uint32 `protobuf:"varint,8,opt,name=cell,proto3" json:"cell,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *AnnotatedEmbedding) Reset() {
 	*x = AnnotatedEmbedding{}
-	if protoimpl.UnsafeEnabled {
-		mi := &file_butterfish_proto_msgTypes[2]
-		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		ms.StoreMessageInfo(mi)
-	}
+	mi := &file_butterfish_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
 }
 
 func (x *AnnotatedEmbedding) String() string {
@@ -163,7 +231,7 @@ func (*AnnotatedEmbedding) ProtoMessage() {}
 
 func (x *AnnotatedEmbedding) ProtoReflect() protoreflect.Message {
 	mi := &file_butterfish_proto_msgTypes[2]
-	if protoimpl.UnsafeEnabled && x != nil {
+	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
 			ms.StoreMessageInfo(mi)
@@ -199,39 +267,249 @@ func (x *AnnotatedEmbedding) GetVector() []float32 {
 	return nil
 }
 
+func (x *AnnotatedEmbedding) GetVectorF16() []byte {
+	if x != nil {
+		return x.VectorF16
+	}
+	return nil
+}
+
+func (x *AnnotatedEmbedding) GetVectorI8() []byte {
+	if x != nil {
+		return x.VectorI8
+	}
+	return nil
+}
+
+func (x *AnnotatedEmbedding) GetScale() float32 {
+	if x != nil {
+		return x.Scale
+	}
+	return 0
+}
+
+func (x *AnnotatedEmbedding) GetCell() uint32 {
+	if x != nil {
+		return x.Cell
+	}
+	return 0
+}
+
+// A hierarchical navigable small world graph, the nodes are the embeddings of
+// the directory's files taken in file name order, then in order within each
+// file
+type HnswGraph struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Nodes         []*HnswNode            `protobuf:"bytes,1,rep,name=nodes,proto3" json:"nodes,omitempty"`
+	EntryPoint    uint32                 `protobuf:"varint,2,opt,name=entry_point,json=entryPoint,proto3" json:"entry_point,omitempty"`
+	MaxLevel      uint32                 `protobuf:"varint,3,opt,name=max_level,json=maxLevel,proto3" json:"max_level,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HnswGraph) Reset() {
+	*x = HnswGraph{}
+	mi := &file_butterfish_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HnswGraph) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HnswGraph) ProtoMessage() {}
+
+func (x *HnswGraph) ProtoReflect() protoreflect.Message {
+	mi := &file_butterfish_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HnswGraph.ProtoReflect.Descriptor instead.
+func (*HnswGraph) Descriptor() ([]byte, []int) {
+	return file_butterfish_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *HnswGraph) GetNodes() []*HnswNode {
+	if x != nil {
+		return x.Nodes
+	}
+	return nil
+}
+
+func (x *HnswGraph) GetEntryPoint() uint32 {
+	if x != nil {
+		return x.EntryPoint
+	}
+	return 0
+}
+
+func (x *HnswGraph) GetMaxLevel() uint32 {
+	if x != nil {
+		return x.MaxLevel
+	}
+	return 0
+}
+
+type HnswNode struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The node's neighbors on each level it's in, starting at level 0
+	Levels        []*HnswNeighbors `protobuf:"bytes,1,rep,name=levels,proto3" json:"levels,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HnswNode) Reset() {
+	*x = HnswNode{}
+	mi := &file_butterfish_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HnswNode) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HnswNode) ProtoMessage() {}
+
+func (x *HnswNode) ProtoReflect() protoreflect.Message {
+	mi := &file_butterfish_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HnswNode.ProtoReflect.Descriptor instead.
+func (*HnswNode) Descriptor() ([]byte, []int) {
+	return file_butterfish_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *HnswNode) GetLevels() []*HnswNeighbors {
+	if x != nil {
+		return x.Levels
+	}
+	return nil
+}
+
+type HnswNeighbors struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ids           []uint32               `protobuf:"varint,1,rep,packed,name=ids,proto3" json:"ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HnswNeighbors) Reset() {
+	*x = HnswNeighbors{}
+	mi := &file_butterfish_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HnswNeighbors) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HnswNeighbors) ProtoMessage() {}
+
+func (x *HnswNeighbors) ProtoReflect() protoreflect.Message {
+	mi := &file_butterfish_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HnswNeighbors.ProtoReflect.Descriptor instead.
+func (*HnswNeighbors) Descriptor() ([]byte, []int) {
+	return file_butterfish_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *HnswNeighbors) GetIds() []uint32 {
+	if x != nil {
+		return x.Ids
+	}
+	return nil
+}
+
 var File_butterfish_proto protoreflect.FileDescriptor
 
 var file_butterfish_proto_rawDesc = []byte{
 	0x0a, 0x10, 0x62, 0x75, 0x74, 0x74, 0x65, 0x72, 0x66, 0x69, 0x73, 0x68, 0x2e, 0x70, 0x72, 0x6f,
 	0x74, 0x6f, 0x1a, 0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f,
 	0x62, 0x75, 0x66, 0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72,
-	0x6f, 0x74, 0x6f, 0x22, 0x8d, 0x01, 0x0a, 0x0e, 0x44, 0x69, 0x72, 0x65, 0x63, 0x74, 0x6f, 0x72,
+	0x6f, 0x74, 0x6f, 0x22, 0xf6, 0x01, 0x0a, 0x0e, 0x44, 0x69, 0x72, 0x65, 0x63, 0x74, 0x6f, 0x72,
 	0x79, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x30, 0x0a, 0x05, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x18,
 	0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x44, 0x69, 0x72, 0x65, 0x63, 0x74, 0x6f, 0x72,
 	0x79, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x73, 0x45, 0x6e, 0x74, 0x72,
-	0x79, 0x52, 0x05, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x1a, 0x49, 0x0a, 0x0a, 0x46, 0x69, 0x6c, 0x65,
-	0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20,
-	0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x25, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75,
-	0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0f, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x45, 0x6d,
-	0x62, 0x65, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x73, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a,
-	0x02, 0x38, 0x01, 0x22, 0x94, 0x01, 0x0a, 0x0e, 0x46, 0x69, 0x6c, 0x65, 0x45, 0x6d, 0x62, 0x65,
-	0x64, 0x64, 0x69, 0x6e, 0x67, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x70, 0x61, 0x74, 0x68, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x70, 0x61, 0x74, 0x68, 0x12, 0x39, 0x0a, 0x0a, 0x75, 0x70,
-	0x64, 0x61, 0x74, 0x65, 0x64, 0x5f, 0x61, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a,
-	0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66,
-	0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x09, 0x75, 0x70, 0x64, 0x61,
-	0x74, 0x65, 0x64, 0x41, 0x74, 0x12, 0x33, 0x0a, 0x0a, 0x65, 0x6d, 0x62, 0x65, 0x64, 0x64, 0x69,
-	0x6e, 0x67, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x41, 0x6e, 0x6e, 0x6f,
-	0x74, 0x61, 0x74, 0x65, 0x64, 0x45, 0x6d, 0x62, 0x65, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x52, 0x0a,
-	0x65, 0x6d, 0x62, 0x65, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x73, 0x22, 0x54, 0x0a, 0x12, 0x41, 0x6e,
-	0x6e, 0x6f, 0x74, 0x61, 0x74, 0x65, 0x64, 0x45, 0x6d, 0x62, 0x65, 0x64, 0x64, 0x69, 0x6e, 0x67,
-	0x12, 0x14, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x72, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52,
-	0x05, 0x73, 0x74, 0x61, 0x72, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x65, 0x6e, 0x64, 0x18, 0x03, 0x20,
-	0x01, 0x28, 0x04, 0x52, 0x03, 0x65, 0x6e, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x76, 0x65, 0x63, 0x74,
-	0x6f, 0x72, 0x18, 0x04, 0x20, 0x03, 0x28, 0x02, 0x52, 0x06, 0x76, 0x65, 0x63, 0x74, 0x6f, 0x72,
-	0x42, 0x23, 0x5a, 0x21, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x62,
-	0x61, 0x6b, 0x6b, 0x73, 0x2f, 0x62, 0x75, 0x74, 0x74, 0x65, 0x72, 0x66, 0x69, 0x73, 0x68, 0x2f,
-	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x79, 0x52, 0x05, 0x66, 0x69, 0x6c, 0x65, 0x73, 0x12, 0x27, 0x0a, 0x0f, 0x65, 0x6d, 0x62, 0x65,
+	0x64, 0x64, 0x69, 0x6e, 0x67, 0x5f, 0x6d, 0x6f, 0x64, 0x65, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0e, 0x65, 0x6d, 0x62, 0x65, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x4d, 0x6f, 0x64, 0x65,
+	0x6c, 0x12, 0x1e, 0x0a, 0x0a, 0x64, 0x69, 0x6d, 0x65, 0x6e, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x64, 0x69, 0x6d, 0x65, 0x6e, 0x73, 0x69, 0x6f, 0x6e,
+	0x73, 0x12, 0x1e, 0x0a, 0x04, 0x68, 0x6e, 0x73, 0x77, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x0a, 0x2e, 0x48, 0x6e, 0x73, 0x77, 0x47, 0x72, 0x61, 0x70, 0x68, 0x52, 0x04, 0x68, 0x6e, 0x73,
+	0x77, 0x1a, 0x49, 0x0a, 0x0a, 0x46, 0x69, 0x6c, 0x65, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12,
+	0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65,
+	0x79, 0x12, 0x25, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x0f, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x45, 0x6d, 0x62, 0x65, 0x64, 0x64, 0x69, 0x6e, 0x67,
+	0x73, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0xe4, 0x01, 0x0a,
+	0x0e, 0x46, 0x69, 0x6c, 0x65, 0x45, 0x6d, 0x62, 0x65, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x73, 0x12,
+	0x12, 0x0a, 0x04, 0x70, 0x61, 0x74, 0x68, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x70,
+	0x61, 0x74, 0x68, 0x12, 0x39, 0x0a, 0x0a, 0x75, 0x70, 0x64, 0x61, 0x74, 0x65, 0x64, 0x5f, 0x61,
+	0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74,
+	0x61, 0x6d, 0x70, 0x52, 0x09, 0x75, 0x70, 0x64, 0x61, 0x74, 0x65, 0x64, 0x41, 0x74, 0x12, 0x33,
+	0x0a, 0x0a, 0x65, 0x6d, 0x62, 0x65, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x73, 0x18, 0x03, 0x20, 0x03,
+	0x28, 0x0b, 0x32, 0x13, 0x2e, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x65, 0x64, 0x45, 0x6d,
+	0x62, 0x65, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x52, 0x0a, 0x65, 0x6d, 0x62, 0x65, 0x64, 0x64, 0x69,
+	0x6e, 0x67, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x74, 0x69, 0x74, 0x6c, 0x65, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x05, 0x74, 0x69, 0x74, 0x6c, 0x65, 0x12, 0x10, 0x0a, 0x03, 0x75, 0x72, 0x6c,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x75, 0x72, 0x6c, 0x12, 0x12, 0x0a, 0x04, 0x74,
+	0x65, 0x78, 0x74, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x74, 0x65, 0x78, 0x74, 0x12,
+	0x12, 0x0a, 0x04, 0x74, 0x61, 0x67, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x09, 0x52, 0x04, 0x74,
+	0x61, 0x67, 0x73, 0x22, 0xba, 0x01, 0x0a, 0x12, 0x41, 0x6e, 0x6e, 0x6f, 0x74, 0x61, 0x74, 0x65,
+	0x64, 0x45, 0x6d, 0x62, 0x65, 0x64, 0x64, 0x69, 0x6e, 0x67, 0x12, 0x14, 0x0a, 0x05, 0x73, 0x74,
+	0x61, 0x72, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x73, 0x74, 0x61, 0x72, 0x74,
+	0x12, 0x10, 0x0a, 0x03, 0x65, 0x6e, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x03, 0x65,
+	0x6e, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x76, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x18, 0x04, 0x20, 0x03,
+	0x28, 0x02, 0x52, 0x06, 0x76, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x12, 0x1d, 0x0a, 0x0a, 0x76, 0x65,
+	0x63, 0x74, 0x6f, 0x72, 0x5f, 0x66, 0x31, 0x36, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09,
+	0x76, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x46, 0x31, 0x36, 0x12, 0x1b, 0x0a, 0x09, 0x76, 0x65, 0x63,
+	0x74, 0x6f, 0x72, 0x5f, 0x69, 0x38, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x08, 0x76, 0x65,
+	0x63, 0x74, 0x6f, 0x72, 0x49, 0x38, 0x12, 0x14, 0x0a, 0x05, 0x73, 0x63, 0x61, 0x6c, 0x65, 0x18,
+	0x07, 0x20, 0x01, 0x28, 0x02, 0x52, 0x05, 0x73, 0x63, 0x61, 0x6c, 0x65, 0x12, 0x12, 0x0a, 0x04,
+	0x63, 0x65, 0x6c, 0x6c, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x04, 0x63, 0x65, 0x6c, 0x6c,
+	0x22, 0x6a, 0x0a, 0x09, 0x48, 0x6e, 0x73, 0x77, 0x47, 0x72, 0x61, 0x70, 0x68, 0x12, 0x1f, 0x0a,
+	0x05, 0x6e, 0x6f, 0x64, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x09, 0x2e, 0x48,
+	0x6e, 0x73, 0x77, 0x4e, 0x6f, 0x64, 0x65, 0x52, 0x05, 0x6e, 0x6f, 0x64, 0x65, 0x73, 0x12, 0x1f,
+	0x0a, 0x0b, 0x65, 0x6e, 0x74, 0x72, 0x79, 0x5f, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0d, 0x52, 0x0a, 0x65, 0x6e, 0x74, 0x72, 0x79, 0x50, 0x6f, 0x69, 0x6e, 0x74, 0x12,
+	0x1b, 0x0a, 0x09, 0x6d, 0x61, 0x78, 0x5f, 0x6c, 0x65, 0x76, 0x65, 0x6c, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x0d, 0x52, 0x08, 0x6d, 0x61, 0x78, 0x4c, 0x65, 0x76, 0x65, 0x6c, 0x22, 0x32, 0x0a, 0x08,
+	0x48, 0x6e, 0x73, 0x77, 0x4e, 0x6f, 0x64, 0x65, 0x12, 0x26, 0x0a, 0x06, 0x6c, 0x65, 0x76, 0x65,
+	0x6c, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0e, 0x2e, 0x48, 0x6e, 0x73, 0x77, 0x4e,
+	0x65, 0x69, 0x67, 0x68, 0x62, 0x6f, 0x72, 0x73, 0x52, 0x06, 0x6c, 0x65, 0x76, 0x65, 0x6c, 0x73,
+	0x22, 0x21, 0x0a, 0x0d, 0x48, 0x6e, 0x73, 0x77, 0x4e, 0x65, 0x69, 0x67, 0x68, 0x62, 0x6f, 0x72,
+	0x73, 0x12, 0x10, 0x0a, 0x03, 0x69, 0x64, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x03,
+	0x69, 0x64, 0x73, 0x42, 0x23, 0x5a, 0x21, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f,
+	0x6d, 0x2f, 0x62, 0x61, 0x6b, 0x6b, 0x73, 0x2f, 0x62, 0x75, 0x74, 0x74, 0x65, 0x72, 0x66, 0x69,
+	0x73, 0x68, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -246,24 +524,30 @@ func file_butterfish_proto_rawDescGZIP() []byte {
 	return file_butterfish_proto_rawDescData
 }
 
-var file_butterfish_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
-var file_butterfish_proto_goTypes = []interface{}{
+var file_butterfish_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_butterfish_proto_goTypes = []any{
 	(*DirectoryIndex)(nil),        // 0: DirectoryIndex
 	(*FileEmbeddings)(nil),        // 1: FileEmbeddings
 	(*AnnotatedEmbedding)(nil),    // 2: AnnotatedEmbedding
-	nil,                           // 3: DirectoryIndex.FilesEntry
-	(*timestamppb.Timestamp)(nil), // 4: google.protobuf.Timestamp
+	(*HnswGraph)(nil),             // 3: HnswGraph
+	(*HnswNode)(nil),              // 4: HnswNode
+	(*HnswNeighbors)(nil),         // 5: HnswNeighbors
+	nil,                           // 6: DirectoryIndex.FilesEntry
+	(*timestamppb.Timestamp)(nil), // 7: google.protobuf.Timestamp
 }
 var file_butterfish_proto_depIdxs = []int32{
-	3, // 0: DirectoryIndex.files:type_name -> DirectoryIndex.FilesEntry
-	4, // 1: FileEmbeddings.updated_at:type_name -> google.protobuf.Timestamp
-	2, // 2: FileEmbeddings.embeddings:type_name -> AnnotatedEmbedding
-	1, // 3: DirectoryIndex.FilesEntry.value:type_name -> FileEmbeddings
-	4, // [4:4] is the sub-list for method output_type
-	4, // [4:4] is the sub-list for method input_type
-	4, // [4:4] is the sub-list for extension type_name
-	4, // [4:4] is the sub-list for extension extendee
-	0, // [0:4] is the sub-list for field type_name
+	6, // 0: DirectoryIndex.files:type_name -> DirectoryIndex.FilesEntry
+	3, // 1: DirectoryIndex.hnsw:type_name -> HnswGraph
+	7, // 2: FileEmbeddings.updated_at:type_name -> google.protobuf.Timestamp
+	2, // 3: FileEmbeddings.embeddings:type_name -> AnnotatedEmbedding
+	4, // 4: HnswGraph.nodes:type_name -> HnswNode
+	5, // 5: HnswNode.levels:type_name -> HnswNeighbors
+	1, // 6: DirectoryIndex.FilesEntry.value:type_name -> FileEmbeddings
+	7, // [7:7] is the sub-list for method output_type
+	7, // [7:7] is the sub-list for method input_type
+	7, // [7:7] is the sub-list for extension type_name
+	7, // [7:7] is the sub-list for extension extendee
+	0, // [0:7] is the sub-list for field type_name
 }
 
 func init() { file_butterfish_proto_init() }
@@ -271,51 +555,13 @@ func file_butterfish_proto_init() {
 	if File_butterfish_proto != nil {
 		return
 	}
-	if !protoimpl.UnsafeEnabled {
-		file_butterfish_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*DirectoryIndex); i {
-			case 0:
-				return &v.state
-			case 1:
-				return &v.sizeCache
-			case 2:
-				return &v.unknownFields
-			default:
-				return nil
-			}
-		}
-		file_butterfish_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*FileEmbeddings); i {
-			case 0:
-				return &v.state
-			case 1:
-				return &v.sizeCache
-			case 2:
-				return &v.unknownFields
-			default:
-				return nil
-			}
-		}
-		file_butterfish_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*AnnotatedEmbedding); i {
-			case 0:
-				return &v.state
-			case 1:
-				return &v.sizeCache
-			case 2:
-				return &v.unknownFields
-			default:
-				return nil
-			}
-		}
-	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_butterfish_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   7,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// DiskStore writes each key to a file, relative keys are under Dir and
+// absolute keys are used as they are. Put writes a temporary file and
+// renames it over the old one so a crash never leaves half a file.
+type DiskStore struct {
+	Dir string
+	Fs  afero.Fs
+	// Mode of new files, what butterfish saves can include secrets from the
+	// shell so this is 0600 by default
+	Perm os.FileMode
+}
+
+func NewDiskStore(dir string) *DiskStore {
+	return &DiskStore{
+		Dir:  dir,
+		Fs:   afero.NewOsFs(),
+		Perm: 0600,
+	}
+}
+
+func (this *DiskStore) path(key string) string {
+	path := filepath.FromSlash(key)
+	if filepath.IsAbs(path) || this.Dir == "" {
+		return path
+	}
+	return filepath.Join(this.Dir, path)
+}
+
+func (this *DiskStore) key(path string) string {
+	if this.Dir != "" {
+		if rel, err := filepath.Rel(this.Dir, path); err == nil && filepath.IsLocal(rel) {
+			path = rel
+		}
+	}
+	return filepath.ToSlash(path)
+}
+
+func (this *DiskStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := afero.ReadFile(this.Fs, this.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return data, err
+}
+
+func (this *DiskStore) Put(ctx context.Context, key string, data []byte) error {
+	path := this.path(key)
+	err := this.Fs.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	temp := fmt.Sprintf("%s.%d.%d.tmp", path, os.Getpid(), time.Now().UnixNano())
+	err = afero.WriteFile(this.Fs, temp, data, this.Perm)
+	if err != nil {
+		this.Fs.Remove(temp)
+		return err
+	}
+	err = this.Fs.Rename(temp, path)
+	if err != nil {
+		this.Fs.Remove(temp)
+	}
+	return err
+}
+
+func (this *DiskStore) Append(ctx context.Context, key string, data []byte) error {
+	path := this.path(key)
+	err := this.Fs.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := this.Fs.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, this.Perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (this *DiskStore) Delete(ctx context.Context, key string) error {
+	err := this.Fs.Remove(this.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (this *DiskStore) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	err := afero.Walk(this.Fs, this.path(prefix), func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			keys = append(keys, this.key(path))
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SQLiteStore keeps everything in a table of a SQLite database. Butterfish
+// doesn't link a SQLite driver, open the database with the driver of your
+// choice, e.g. modernc.org/sqlite or github.com/mattn/go-sqlite3:
+//
+//	db, err := sql.Open("sqlite", "butterfish.db")
+//	store, err := storage.NewSQLiteStore(ctx, db)
+type SQLiteStore struct {
+	DB *sql.DB
+}
+
+const sqliteStoreSchema = `CREATE TABLE IF NOT EXISTS butterfish_store (
+	key TEXT PRIMARY KEY,
+	data BLOB NOT NULL
+)`
+
+// Create the store's table if it doesn't exist
+func NewSQLiteStore(ctx context.Context, db *sql.DB) (*SQLiteStore, error) {
+	_, err := db.ExecContext(ctx, sqliteStoreSchema)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating the butterfish_store table: %w", err)
+	}
+	return &SQLiteStore{DB: db}, nil
+}
+
+func (this *SQLiteStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := this.DB.QueryRowContext(ctx,
+		`SELECT data FROM butterfish_store WHERE key = ?`, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return data, err
+}
+
+func (this *SQLiteStore) Put(ctx context.Context, key string, data []byte) error {
+	_, err := this.DB.ExecContext(ctx,
+		`INSERT INTO butterfish_store (key, data) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET data = excluded.data`, key, data)
+	return err
+}
+
+// The read and write are in a transaction so concurrent appends aren't lost
+func (this *SQLiteStore) Append(ctx context.Context, key string, data []byte) error {
+	tx, err := this.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var existing []byte
+	err = tx.QueryRowContext(ctx,
+		`SELECT data FROM butterfish_store WHERE key = ?`, key).Scan(&existing)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO butterfish_store (key, data) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET data = excluded.data`, key, append(existing, data...))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (this *SQLiteStore) Delete(ctx context.Context, key string) error {
+	_, err := this.DB.ExecContext(ctx, `DELETE FROM butterfish_store WHERE key = ?`, key)
+	return err
+}
+
+func (this *SQLiteStore) List(ctx context.Context, prefix string) ([]string, error) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	// keys starting with prefix/ sort between prefix/ and prefix0, since 0
+	// follows /
+	rows, err := this.DB.QueryContext(ctx,
+		`SELECT key FROM butterfish_store WHERE ? = '' OR key = ? OR (key >= ? AND key < ?) ORDER BY key`,
+		prefix, prefix, prefix+"/", prefix+"0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
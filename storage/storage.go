@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Store keeps what butterfish saves between runs: the prompt library,
+// saved sessions, the embedding cache, and index files. Keys are slash
+// separated paths, the disk store writes each key to that file, so
+// butterfish's own files are keyed by where they'd be on disk, e.g.
+// /home/me/.config/butterfish/prompts.yaml. Programs embedding butterfish can
+// use a MemoryStore, e.g. in tests, a SQLiteStore, or their own Store.
+type Store interface {
+	// The data at key, an error wrapping ErrNotFound if there is none
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Replace the data at key, a reader sees the old or new data, never part
+	Put(ctx context.Context, key string, data []byte) error
+	// Add to the end of the data at key, creating it if needed
+	Append(ctx context.Context, key string, data []byte) error
+	// Remove key, it's not an error if there is none
+	Delete(ctx context.Context, key string) error
+	// The keys under prefix as a directory, i.e. prefix itself and keys
+	// starting with prefix/, sorted
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+var ErrNotFound = errors.New("not found")
+
+// Whether key is under prefix as a directory
+func underPrefix(key, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+// MemoryStore keeps everything in memory, it's safe for concurrent use
+type MemoryStore struct {
+	data  map[string][]byte
+	mutex sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: map[string][]byte{}}
+}
+
+func (this *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	data, ok := this.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (this *MemoryStore) Put(ctx context.Context, key string, data []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.data[key] = append([]byte{}, data...)
+	return nil
+}
+
+func (this *MemoryStore) Append(ctx context.Context, key string, data []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.data[key] = append(this.data[key], data...)
+	return nil
+}
+
+func (this *MemoryStore) Delete(ctx context.Context, key string) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.data, key)
+	return nil
+}
+
+func (this *MemoryStore) List(ctx context.Context, prefix string) ([]string, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	keys := []string{}
+	for key := range this.data {
+		if underPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// The behavior every Store should have
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	_, err := store.Get(ctx, "/config/prompts.yaml")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, store.Put(ctx, "/config/prompts.yaml", []byte("old")))
+	assert.NoError(t, store.Put(ctx, "/config/prompts.yaml", []byte("new")))
+	data, err := store.Get(ctx, "/config/prompts.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+
+	assert.NoError(t, store.Append(ctx, "/config/embeddings/ada_0.cache", []byte("ab")))
+	assert.NoError(t, store.Append(ctx, "/config/embeddings/ada_0.cache", []byte("cd")))
+	data, err = store.Get(ctx, "/config/embeddings/ada_0.cache")
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd", string(data))
+
+	assert.NoError(t, store.Put(ctx, "/configs/other", []byte("x")))
+	keys, err := store.List(ctx, "/config")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/config/embeddings/ada_0.cache", "/config/prompts.yaml"}, keys)
+	keys, err = store.List(ctx, "/missing")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	assert.NoError(t, store.Delete(ctx, "/config/prompts.yaml"))
+	assert.NoError(t, store.Delete(ctx, "/config/prompts.yaml"))
+	_, err = store.Get(ctx, "/config/prompts.yaml")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestDiskStore(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	testStore(t, &DiskStore{Fs: fs, Perm: 0600})
+
+	// relative keys are under Dir
+	store := &DiskStore{Dir: "/home/me/.config/butterfish", Fs: fs, Perm: 0600}
+	ctx := context.Background()
+	assert.NoError(t, store.Put(ctx, "last_session.json", []byte("{}")))
+	exists, _ := afero.Exists(fs, "/home/me/.config/butterfish/last_session.json")
+	assert.True(t, exists)
+	keys, err := store.List(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"last_session.json"}, keys)
+}
+
+func TestSQLiteStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "butterfish.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+	store, err := NewSQLiteStore(context.Background(), db)
+	assert.NoError(t, err)
+	testStore(t, store)
+
+	// opening an existing database keeps what's in it
+	store, err = NewSQLiteStore(context.Background(), db)
+	assert.NoError(t, err)
+	data, err := store.Get(context.Background(), "/config/embeddings/ada_0.cache")
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd", string(data))
+}
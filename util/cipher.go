@@ -0,0 +1,85 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Cipher encrypts files at rest with AES-256-GCM. Encrypted data starts with
+// a marker so we can still read files written before encryption was turned
+// on. Methods can be called on a nil Cipher, which means encryption is off:
+// data is written as-is and reading encrypted data fails.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// Encrypted data is the marker, then the nonce, then the sealed data
+var cipherMarker = []byte("BFENC1")
+
+const CipherKeySize = 32
+
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != CipherKeySize {
+		return nil, fmt.Errorf("Encryption key must be %d bytes, got %d", CipherKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Generate a random key for NewCipher
+func NewCipherKey() ([]byte, error) {
+	key := make([]byte, CipherKeySize)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, cipherMarker)
+}
+
+func (this *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
+	if this == nil {
+		return plaintext, nil
+	}
+
+	nonce := make([]byte, this.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, cipherMarker...)
+	out = append(out, nonce...)
+	return this.aead.Seal(out, nonce, plaintext, nil), nil
+}
+
+// Decrypt data from Encrypt, data that isn't encrypted is returned unchanged
+func (this *Cipher) Decrypt(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	if this == nil {
+		return nil, errors.New("Data is encrypted but encryption isn't configured")
+	}
+
+	data = data[len(cipherMarker):]
+	nonceSize := this.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("Encrypted data is truncated")
+	}
+	plaintext, err := this.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, errors.New("Unable to decrypt data, the encryption key may have changed")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"bytes"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Saved sessions are compressed with zstd since verbose command output makes
+// them large. Data that isn't compressed is read as-is so that files written
+// before compression still load.
+
+// Every zstd frame starts with this magic number
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+func IsCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, zstdMagic)
+}
+
+func Compress(data []byte) ([]byte, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil), nil
+}
+
+// Decompress data from Compress, data that isn't compressed is returned
+// unchanged
+func Decompress(data []byte) ([]byte, error) {
+	if !IsCompressed(data) {
+		return data, nil
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return decoder.DecodeAll(data, nil)
+}
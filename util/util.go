@@ -13,6 +13,7 @@ import (
 	"sync"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/alecthomas/chroma/quick"
 	"github.com/charmbracelet/lipgloss"
@@ -28,12 +29,41 @@ type CompletionRequest struct {
 	Model         string
 	MaxTokens     int
 	Temperature   float32
+	TopP          float32        // nucleus sampling, 0 leaves it to the provider
+	Stop          []string       // sequences that end the response
+	LogitBias     map[string]int // -100 to 100 by text or token id
 	HistoryBlocks []HistoryBlock
 	SystemMessage string
 	Functions     []FunctionDefinition
 	Tools         []ToolDefinition
-	Verbose       bool
-	TokenTimeout  time.Duration
+	// If set, the response must be JSON matching this schema, providers that
+	// support structured output are asked to enforce it
+	ResponseSchema *jsonschema.Definition
+	// Images attached to the prompt as URLs or data URLs, for models with
+	// vision
+	Images []string
+	// The kind of request, e.g. autosuggest or summarize, used to route
+	// requests to models
+	Task string
+	// The name of the library prompt the request was built from, if any, so
+	// the prompt's use and response tokens can be tracked
+	PromptName string
+	// The name of the library prompt of SystemMessage, if any, so its use is
+	// tracked too
+	SystemPromptName string
+	Verbose          bool
+	TokenTimeout     time.Duration
+}
+
+type EmbeddingRequest struct {
+	Ctx   context.Context
+	Input []string
+	// The embedding model, the provider's default if empty
+	Model string
+	// The length of the returned vectors, for models that can shorten them,
+	// the model's default if 0
+	Dimensions int
+	Verbose    bool
 }
 
 type FunctionCall struct {
@@ -52,6 +82,13 @@ type CompletionResponse struct {
 	FunctionName       string
 	FunctionParameters string
 	ToolCalls          []*ToolCall
+	// Set if a streamed response was interrupted, e.g. cancelled by the user,
+	// in which case Completion has the partial output
+	Truncated bool
+	// Token usage as reported by the API, these are 0 if the API didn't
+	// report usage (e.g. streaming legacy completions)
+	PromptTokens     int
+	CompletionTokens int
 }
 
 type FunctionDefinition struct {
@@ -147,7 +184,8 @@ func GetFileChunks(ctx context.Context, fs afero.Fs, path string,
 			return ctx.Err()
 		}
 
-		chunks = append(chunks, chunk)
+		// the chunk's buffer is reused for the next chunk
+		chunks = append(chunks, append([]byte{}, chunk...))
 		return nil
 	})
 
@@ -157,7 +195,7 @@ func GetFileChunks(ctx context.Context, fs afero.Fs, path string,
 func GetChunks(reader io.Reader, chunkSize int, maxChunks int) ([][]byte, error) {
 	chunks := make([][]byte, 0)
 	err := ChunkFromReader(reader, chunkSize, maxChunks, func(i int, chunk []byte) error {
-		chunks = append(chunks, chunk)
+		chunks = append(chunks, append([]byte{}, chunk...))
 		return nil
 	})
 	return chunks, err
@@ -201,6 +239,80 @@ func Min(a, b int) int {
 	return b
 }
 
+// Wrap a line to a width, breaking at spaces where possible
+func wrapLine(line string, width int) []string {
+	lines := []string{}
+	runes := []rune(line)
+	for len(runes) > width {
+		cut := width
+		for i := width; i > width/2; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		lines = append(lines, string(runes[:cut]))
+		runes = runes[cut:]
+		if len(runes) > 0 && runes[0] == ' ' {
+			runes = runes[1:]
+		}
+	}
+	return append(lines, string(runes))
+}
+
+// Lay out two blocks of text in columns separated by " | ", wrapping each to
+// fit in the total width
+func SideBySide(left, right string, width int) string {
+	return Columns([]string{left, right}, width)
+}
+
+// Lay out blocks of text in columns separated by " | ", wrapping each to fit
+// in the total width
+func Columns(blocks []string, width int) string {
+	if len(blocks) == 0 {
+		return ""
+	}
+	colWidth := (width - 3*(len(blocks)-1)) / len(blocks)
+	if colWidth < 10 {
+		colWidth = 10
+	}
+
+	wrap := func(text string) []string {
+		lines := []string{}
+		for _, line := range strings.Split(strings.ReplaceAll(text, "\t", "    "), "\n") {
+			lines = append(lines, wrapLine(line, colWidth)...)
+		}
+		return lines
+	}
+	columns := [][]string{}
+	height := 0
+	for _, block := range blocks {
+		column := wrap(block)
+		columns = append(columns, column)
+		height = max(height, len(column))
+	}
+
+	lines := []string{}
+	for i := 0; i < height; i++ {
+		line := ""
+		for j, column := range columns {
+			cell := ""
+			if i < len(column) {
+				cell = column[i]
+			}
+			if j > 0 {
+				line += " | "
+			}
+			line += cell
+			if j < len(columns)-1 {
+				line += strings.Repeat(" ", colWidth-utf8.RuneCountInString(cell))
+			}
+		}
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
 // Returns true if there is piped stdin data that can be read
 func IsPipedStdin() bool {
 	fi, _ := os.Stdin.Stat()
@@ -252,8 +364,15 @@ const (
 	STATE_BLOCK_TWO_TICKS
 	STATE_BLOCK_THREE_TICKS
 	STATE_INLINE
+	STATE_HEADER_HASHES
+	STATE_HEADER
+	STATE_LIST_MARKER
+	STATE_STAR
 )
 
+const ESC_BOLD = "\x1b[1m"
+const ESC_BOLD_OFF = "\x1b[22m"
+
 type StyleCodeblocksWriter struct {
 	Writer        io.Writer
 	terminalWidth int
@@ -264,6 +383,11 @@ type StyleCodeblocksWriter struct {
 	langSuffix    *bytes.Buffer
 	blockBuffer   *bytes.Buffer
 	lock          sync.Mutex
+	// markdown state
+	plain      bool
+	bold       bool
+	hashes     int
+	listMarker byte
 }
 
 func NewStyleCodeblocksWriter(
@@ -298,29 +422,55 @@ func (this *StyleCodeblocksWriter) SetTerminalWidth(width int) {
 	this.terminalWidth = width
 }
 
+// If plain is set then input is passed through without markdown rendering or
+// syntax highlighting
+func (this *StyleCodeblocksWriter) SetPlain(plain bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.plain = plain
+}
+
 func (this *StyleCodeblocksWriter) Reset() {
 	this.state = STATE_NEWLINE
 	this.langSuffix = nil
 	this.blockBuffer = nil
+	this.bold = false
+	this.hashes = 0
 }
 
 // This writer receives bytes in a stream and looks for markdown code
-// blocks (```) and renders them with syntax highlighting.
+// blocks (```) and renders them with syntax highlighting. It also renders
+// headers, bullet lists, and bold text.
 // The hard part is the stream splits the input into chunks, so we need
 // to buffer the input in places.
 func (this *StyleCodeblocksWriter) Write(p []byte) (n int, err error) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
+	if this.plain {
+		return this.Writer.Write(p)
+	}
+
 	toWrite := new(bytes.Buffer)
 
-	for _, char := range p {
+	// we index manually so that some states can reprocess the current char
+	// after deciding it isn't part of a markdown token, by decrementing i
+	for i := 0; i < len(p); i++ {
+		char := p[i]
 
 		switch this.state {
 		case STATE_NORMAL:
 			if char == '\n' {
+				if this.bold {
+					// bold doesn't continue past the end of a line
+					toWrite.WriteString(ESC_BOLD_OFF)
+					this.bold = false
+				}
 				this.state = STATE_NEWLINE
 				toWrite.WriteByte(char)
+			} else if char == '*' {
+				this.state = STATE_STAR
 			} else if char == '`' {
 				this.state = STATE_INLINE
 				toWrite.Write([]byte(this.inlineColor))
@@ -336,9 +486,30 @@ func (this *StyleCodeblocksWriter) Write(p []byte) (n int, err error) {
 				toWrite.WriteByte(char)
 			}
 
+		case STATE_STAR:
+			this.state = STATE_NORMAL
+			if char == '*' {
+				// toggle bold on **
+				if this.bold {
+					toWrite.WriteString(ESC_BOLD_OFF)
+				} else {
+					toWrite.WriteString(ESC_BOLD)
+				}
+				this.bold = !this.bold
+			} else {
+				toWrite.WriteByte('*')
+				i--
+			}
+
 		case STATE_NEWLINE:
 			if char == '`' {
 				this.state = STATE_ONE_TICK
+			} else if char == '#' {
+				this.state = STATE_HEADER_HASHES
+				this.hashes = 1
+			} else if char == '-' || char == '*' || char == '+' {
+				this.state = STATE_LIST_MARKER
+				this.listMarker = char
 			} else if char == '\n' {
 				toWrite.WriteByte(char)
 			} else if char == ' ' || char == '\t' {
@@ -348,6 +519,44 @@ func (this *StyleCodeblocksWriter) Write(p []byte) (n int, err error) {
 				toWrite.WriteByte(char)
 			}
 
+		case STATE_HEADER_HASHES:
+			if char == '#' {
+				this.hashes++
+			} else if char == ' ' {
+				this.state = STATE_HEADER
+				toWrite.WriteString(ESC_BOLD)
+				toWrite.WriteString(this.inlineColor)
+			} else {
+				// not a header, e.g. #hashtag
+				toWrite.WriteString(strings.Repeat("#", this.hashes))
+				this.state = STATE_NORMAL
+				i--
+			}
+
+		case STATE_HEADER:
+			if char == '\n' {
+				this.state = STATE_NEWLINE
+				toWrite.WriteString(ESC_BOLD_OFF)
+				toWrite.WriteString(this.normalColor)
+			}
+			toWrite.WriteByte(char)
+
+		case STATE_LIST_MARKER:
+			this.state = STATE_NORMAL
+			if char == ' ' {
+				toWrite.WriteString(this.inlineColor)
+				toWrite.WriteString("•")
+				toWrite.WriteString(this.normalColor)
+				toWrite.WriteByte(char)
+			} else if char == '*' && this.listMarker == '*' {
+				// bold text at the start of a line
+				toWrite.WriteString(ESC_BOLD)
+				this.bold = true
+			} else {
+				toWrite.WriteByte(this.listMarker)
+				i--
+			}
+
 		case STATE_ONE_TICK:
 			if char == '`' {
 				this.state = STATE_TWO_TICKS
@@ -132,3 +132,114 @@ Foo`
 	// assert buffer equals expected
 	assert.Equal(t, expected, buffer.String())
 }
+
+func TestMarkdownHeader(t *testing.T) {
+	buffer, writer := getStyleCodeblocksWriter()
+
+	writer.Write([]byte("## Head"))
+	writer.Write([]byte("er\nFoo #tag"))
+
+	expected := "\x1b[1mHIGHLIGHTHeader\x1b[22mNORMAL\nFoo #tag"
+	assert.Equal(t, expected, buffer.String())
+}
+
+func TestMarkdownList(t *testing.T) {
+	buffer, writer := getStyleCodeblocksWriter()
+
+	writer.Write([]byte("Steps:\n- one\n  * two\n---\n"))
+
+	expected := "Steps:\nHIGHLIGHT•NORMAL one\n  HIGHLIGHT•NORMAL two\n---\n"
+	assert.Equal(t, expected, buffer.String())
+}
+
+func TestMarkdownBold(t *testing.T) {
+	buffer, writer := getStyleCodeblocksWriter()
+
+	writer.Write([]byte("**Note:** a *b* **c\nd"))
+
+	expected := "\x1b[1mNote:\x1b[22m a *b* \x1b[1mc\x1b[22m\nd"
+	assert.Equal(t, expected, buffer.String())
+}
+
+func TestMarkdownPlain(t *testing.T) {
+	buffer, writer := getStyleCodeblocksWriter()
+	writer.SetPlain(true)
+
+	testStr := "# Header\n- **item** `code`\n"
+	writer.Write([]byte(testStr))
+
+	assert.Equal(t, testStr, buffer.String())
+}
+
+func TestSideBySide(t *testing.T) {
+	output := SideBySide("one two three", "x", 23)
+	assert.Equal(t, "one two    | x\nthree      |", output)
+
+	output = SideBySide("a", "b\nc", 23)
+	assert.Equal(t, "a          | b\n           | c", output)
+
+	output = Columns([]string{"a", "b\nc", "d"}, 36)
+	assert.Equal(t, "a          | b          | d\n           | c          |", output)
+}
+
+func TestCipher(t *testing.T) {
+	key, err := NewCipherKey()
+	assert.Nil(t, err)
+	cipher, err := NewCipher(key)
+	assert.Nil(t, err)
+
+	encrypted, err := cipher.Encrypt([]byte("export TOKEN=secret"))
+	assert.Nil(t, err)
+	assert.True(t, IsEncrypted(encrypted))
+	assert.False(t, bytes.Contains(encrypted, []byte("secret")))
+	decrypted, err := cipher.Decrypt(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, "export TOKEN=secret", string(decrypted))
+
+	// plaintext from before encryption was on is passed through
+	decrypted, err = cipher.Decrypt([]byte("{}"))
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", string(decrypted))
+
+	// a nil cipher means encryption is off
+	var off *Cipher
+	plain, err := off.Encrypt([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", string(plain))
+	_, err = off.Decrypt(encrypted)
+	assert.NotNil(t, err)
+
+	otherKey, _ := NewCipherKey()
+	other, _ := NewCipher(otherKey)
+	_, err = other.Decrypt(encrypted)
+	assert.NotNil(t, err)
+
+	_, err = NewCipher([]byte("short"))
+	assert.NotNil(t, err)
+}
+
+func TestCompress(t *testing.T) {
+	data := []byte(strings.Repeat("compiling module\n", 1000))
+	compressed, err := Compress(data)
+	assert.Nil(t, err)
+	assert.True(t, IsCompressed(compressed))
+	assert.Less(t, len(compressed), len(data)/10)
+	decompressed, err := Decompress(compressed)
+	assert.Nil(t, err)
+	assert.Equal(t, data, decompressed)
+
+	// uncompressed data is passed through
+	decompressed, err = Decompress([]byte("{}"))
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", string(decompressed))
+}
+
+func TestGetChunks(t *testing.T) {
+	chunks, err := GetChunks(strings.NewReader("aaaabbbbcc"), 4, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"aaaa", "bbbb", "cc"}, ByteToString(chunks))
+
+	chunks, err = GetChunks(strings.NewReader("aaaabbbbcc"), 4, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"aaaa", "bbbb"}, ByteToString(chunks))
+}